@@ -6,13 +6,17 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/liquidgecka/blobby/config"
 	"github.com/liquidgecka/blobby/httpserver"
+	"github.com/liquidgecka/blobby/internal/buildinfo"
 	"github.com/liquidgecka/blobby/internal/delayqueue"
 	"github.com/liquidgecka/blobby/internal/sloghelper"
+	"github.com/liquidgecka/blobby/storage"
+	"github.com/liquidgecka/blobby/storage/fid"
 )
 
 // Common arguments.
@@ -26,30 +30,33 @@ var (
 		"V",
 		false,
 		"Display the build version and then exit.")
+
+	CheckConfigFlag = flag.Bool(
+		"t",
+		false,
+		"Validate the config file and then exit without starting.")
 )
 
 // Common variables that are held for the life of the binary.
 var (
-	DelayQueue *delayqueue.DelayQueue
-	Server     httpserver.Server
-	Rotators   []*sloghelper.Rotator
-	log        *slog.Logger
+	Configuration *config.Config
+	DelayQueue    *delayqueue.DelayQueue
+	Server        httpserver.Server
+	Rotators      []*sloghelper.Rotator
+	log           *slog.Logger
 )
 
-// Expected to be set via -ldflags/-X by the linker
-var BuildVersion string
-var BuildTimeEpoch string
+// How long each remote is given to report its machine id at startup.
+const machineIDCheckTimeout = time.Second * 5
 
 func Version() string {
-	if BuildVersion == "" {
-		BuildVersion = "Unknown"
-		BuildTimeEpoch = "unknown"
-	}
+	info := buildinfo.Get()
 	return fmt.Sprintf(
-		"blobby: %s ts=%s go=%s\n",
-		BuildVersion,
-		BuildTimeEpoch,
-		runtime.Version())
+		"blobby: %s commit=%s ts=%s go=%s\n",
+		info.Version,
+		info.Commit,
+		info.TimeEpoch,
+		info.GoVersion)
 }
 
 func WritePIDFile(ctx context.Context, file string) {
@@ -83,6 +90,60 @@ func WritePIDFile(ctx context.Context, file string) {
 	}
 }
 
+// Logs the machine ID that file ids will be generated with and then asks each
+// remote for the ID that it is using. If another server is already using the
+// same ID then the file ids generated by the two would collide so startup is
+// refused.
+func checkMachineID(ctx context.Context, cnf *config.Config) {
+	// Round trip the ID through a file id so the log shows exactly what will
+	// be embedded in the ids this server generates.
+	id := cnf.GetMachineID()
+	var f fid.FID
+	f.Generate(id)
+	formatter, err := fid.NewFormatter("%.L")
+	if err != nil {
+		panic(err)
+	}
+	log.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Using machine id.",
+		sloghelper.Uint32("machine-id", f.Machine()),
+		sloghelper.String("machine-ip", formatter.Format(f)))
+	if f.Machine() != id {
+		log.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"The machine id was not preserved in generated file ids.",
+			sloghelper.Uint32("machine-id", id))
+		os.Exit(5)
+	}
+
+	// Check that no other live server is using the ID.
+	if err := cnf.CheckMachineID(ctx, machineIDCheckTimeout); err != nil {
+		log.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"Another server is using this machine id.",
+			sloghelper.Uint32("machine-id", id),
+			sloghelper.Error("error", err))
+		os.Exit(5)
+	}
+}
+
+// Parses and validates the config file and then exits, reporting every
+// problem that was found. Parsing has no side effects, nothing is listened
+// on and the namespace directories and object stores are never touched, so
+// this is safe to run anywhere the config file can be read.
+func checkConfig() {
+	if _, err := config.Parse(*Config); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", strings.TrimSuffix(err.Error(), "\n"))
+		os.Exit(1)
+	}
+	fmt.Printf("%s: configuration is valid.\n", *Config)
+	os.Exit(0)
+}
+
 // All of the initialization work happens in this function in order to allow
 // a limited scope of variables so that startup temporary data can be purged
 // once the server is fully running.
@@ -96,6 +157,7 @@ func configure(ctx context.Context) {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		os.Exit(1)
 	} else {
+		Configuration = cnf
 		DelayQueue = cnf.GetDelayQueue()
 		Rotators = cnf.GetRotators(ctx)
 		Server = cnf.GetServer(ctx)
@@ -107,26 +169,36 @@ func configure(ctx context.Context) {
 		ctx,
 		slog.LevelError,
 		"Server initializing.",
-		sloghelper.String("build-version", BuildVersion),
-		sloghelper.String("build-time", BuildTimeEpoch))
+		sloghelper.String("build-version", buildinfo.Version),
+		sloghelper.String("build-commit", buildinfo.Commit),
+		sloghelper.String("build-time", buildinfo.TimeEpoch))
 
 	// Start the log rotator.
 	SetupRotation(ctx)
 
+	// Make sure that the machine ID is sane and not in use elsewhere before
+	// any file ids get generated with it.
+	checkMachineID(ctx, cnf)
+
 	// Start the delay queue.
 	DelayQueue.Start()
 
-	// Start and log each configured namespace.
-	for name, ns := range cnf.GetNameSpaces(ctx) {
-		if err := ns.Start(ctx); err != nil {
-			log.LogAttrs(
-				ctx,
-				slog.LevelError,
-				"Unable to start namespace.",
-				sloghelper.String("namespace", name),
-				sloghelper.Error("error", err))
-			os.Exit(4)
-		}
+	// Start each configured namespace, limiting how many can be recovering
+	// existing files at the same time.
+	errs := storage.StartAll(
+		ctx,
+		cnf.GetNameSpaces(ctx),
+		cnf.GetParallelStarts())
+	for name, err := range errs {
+		log.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"Unable to start namespace.",
+			sloghelper.String("namespace", name),
+			sloghelper.Error("error", err))
+	}
+	if len(errs) > 0 {
+		os.Exit(4)
 	}
 
 	log.LogAttrs(
@@ -192,16 +264,32 @@ func main() {
 		fmt.Fprintf(os.Stderr, "-c is a required parameter.\n")
 		os.Exit(1)
 	}
+	if *CheckConfigFlag {
+		checkConfig()
+	}
 
 	// Run through the configuration work.
 	configure(context.Background())
 
+	// A SIGTERM drains the server and then stops it.
+	shutDown := SetupShutDown(context.Background())
+
 	// Start the HTTP server and run it. This is the primary work processor
-	// so its run in the main thread.
+	// so its run in the main thread. It only returns nil once a shut down
+	// has closed the listeners, in which case the shut down is allowed to
+	// finish before exiting.
+	if err := Server.Run(); err != nil {
+		log.LogAttrs(
+			context.Background(),
+			slog.LevelError,
+			"HTTP Server exited!",
+			sloghelper.Error("error", err))
+		os.Exit(1)
+	}
+	<-shutDown
 	log.LogAttrs(
 		context.Background(),
-		slog.LevelError,
-		"HTTP Server exited!",
-		sloghelper.Error("error", Server.Run()))
-	os.Exit(1)
+		slog.LevelInfo,
+		"HTTP Server shut down.")
+	os.Exit(0)
 }
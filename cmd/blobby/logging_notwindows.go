@@ -34,6 +34,16 @@ func SetupRotation(ctx context.Context) {
 				ctx,
 				slog.LevelDebug,
 				"logs rotated.")
+
+			// SIGHUP also reloads the parts of the configuration that can
+			// be changed without restarting.
+			if err := Configuration.Reload(ctx, *Config); err != nil {
+				log.LogAttrs(
+					ctx,
+					slog.LevelError,
+					"Configuration reload failed.",
+					sloghelper.Error("error", err))
+			}
 		}
 	}(schan)
 }
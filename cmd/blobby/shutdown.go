@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// Starts a signal handler that gracefully shuts down the server when a
+// SIGTERM is received. The returned channel is closed once the shut down
+// has finished so that the process does not exit while requests are still
+// being completed.
+func SetupShutDown(ctx context.Context) <-chan struct{} {
+	schan := make(chan os.Signal, 1)
+	signal.Notify(schan, syscall.SIGTERM)
+	log.LogAttrs(
+		ctx,
+		slog.LevelDebug,
+		"Starting signal handler for SIGTERM.")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-schan
+		log.LogAttrs(
+			ctx,
+			slog.LevelInfo,
+			"Received SIGTERM, shutting down.")
+		if err := Server.ShutDown(ctx); err != nil {
+			log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error shutting down the server.",
+				sloghelper.Error("error", err))
+		}
+	}()
+	return done
+}
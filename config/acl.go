@@ -3,6 +3,7 @@ package config
 import (
 	"context"
 	"fmt"
+	"math"
 	"net"
 
 	"github.com/liquidgecka/blobby/httpserver/access"
@@ -11,12 +12,13 @@ import (
 )
 
 var (
-	defaultBasicAuthRealm    = "Blobby"
-	defaultBasicAuthRequired = false
-	defaultSAMLRequired      = false
-	defaultWebUsers          = false
-	defaultWebUsersRequired  = false
-	defaultWhiteListRequired = false
+	defaultBasicAuthRealm      = "Blobby"
+	defaultBasicAuthRequired   = false
+	defaultRateLimitMaxClients = 10000
+	defaultSAMLRequired        = false
+	defaultWebUsers            = false
+	defaultWebUsersRequired    = false
+	defaultWhiteListRequired   = false
 )
 
 type acl struct {
@@ -72,9 +74,21 @@ type acl struct {
 	// and will skip further authentication steps.
 	WhiteListRequired *bool `toml:"white_list_required"`
 
+	// If set then each client is limited to this many requests per second
+	// through this ACL, with bursts of up to rate_limit_burst requests.
+	// Clients are identified by their basic auth user if they have one and
+	// by IP otherwise. At most rate_limit_max_clients are tracked, clients
+	// that have been idle the longest are forgotten first.
+	RateLimit           *float64 `toml:"rate_limit"`
+	RateLimitBurst      *int     `toml:"rate_limit_burst"`
+	RateLimitMaxClients *int     `toml:"rate_limit_max_clients"`
+
 	// A link back to the top of the configuration tree.
 	top *top
 
+	// The name of this ACL in the configuration.
+	name string
+
 	// When WhiteListCIDRs is parsed the results are stored in this list.
 	cidrs []net.IPNet
 
@@ -152,8 +166,20 @@ func (a *acl) access() *access.ACL {
 		keep = true
 	}
 
+	// RateLimit
+	if a.RateLimit != nil {
+		acl.RateLimit = &access.RateLimit{
+			AllowXForwardedForFrom: a.allowXForwardedForFrom,
+			Burst:                  *a.RateLimitBurst,
+			MaxClients:             *a.RateLimitMaxClients,
+			RequestsPerSecond:      *a.RateLimit,
+		}
+		keep = true
+	}
+
 	// Only return something if there was something defined.
 	if keep {
+		acl.Name = a.name
 		return acl
 	} else {
 		return nil
@@ -177,6 +203,33 @@ func (a *acl) preLoad(ctx context.Context) error {
 	return nil
 }
 
+// Prepares an ACL from a newly parsed configuration so that it can replace
+// one in the running configuration. SAML providers and web users can not be
+// reloaded so they are taken from the running configuration, which means
+// that any the ACL uses must already exist there.
+func (a *acl) prepareReload(ctx context.Context, running *top, name string) error {
+	if a == nil || a == &localHostOnlyACL {
+		return nil
+	}
+	for _, provider := range a.SAMLProviders {
+		if _, ok := running.SAML[provider]; !ok {
+			return fmt.Errorf(
+				"%s.saml_providers: %s can not be added without a restart.",
+				name,
+				provider)
+		}
+	}
+	if *a.WebUsers && running.Server.WebUsersHTPasswdURL == nil {
+		return fmt.Errorf(
+			"%s.web_users requires server.web_users_htpasswd_url which "+
+				"can not be added without a restart.",
+			name)
+	}
+	a.top = running
+	a.initLogging(ctx)
+	return a.preLoad(ctx)
+}
+
 func (a *acl) startRefresher(ctx context.Context) {
 	if a != nil {
 		if a.basicAuth != nil {
@@ -188,6 +241,7 @@ func (a *acl) startRefresher(ctx context.Context) {
 func (a *acl) validate(top *top, name string) []string {
 	var errors []string
 	a.top = top
+	a.name = name
 
 	// BasicAuthHTPasswdURL
 	if a.BasicAuthHTPasswdURL != nil {
@@ -333,6 +387,43 @@ func (a *acl) validate(top *top, name string) []string {
 			name))
 	}
 
+	// RateLimit
+	if a.RateLimit != nil && *a.RateLimit <= 0 {
+		errors = append(errors, fmt.Sprintf(
+			"%s.rate_limit must be greater than zero.",
+			name))
+	}
+
+	// RateLimitBurst
+	switch {
+	case a.RateLimitBurst == nil && a.RateLimit != nil:
+		burst := int(math.Ceil(*a.RateLimit))
+		a.RateLimitBurst = &burst
+	case a.RateLimitBurst == nil:
+	case a.RateLimit == nil:
+		errors = append(errors, fmt.Sprintf(
+			"%s.rate_limit_burst requires rate_limit be set.",
+			name))
+	case *a.RateLimitBurst < 1:
+		errors = append(errors, fmt.Sprintf(
+			"%s.rate_limit_burst must be at least 1.",
+			name))
+	}
+
+	// RateLimitMaxClients
+	switch {
+	case a.RateLimitMaxClients == nil:
+		a.RateLimitMaxClients = &defaultRateLimitMaxClients
+	case a.RateLimit == nil:
+		errors = append(errors, fmt.Sprintf(
+			"%s.rate_limit_max_clients requires rate_limit be set.",
+			name))
+	case *a.RateLimitMaxClients < 1:
+		errors = append(errors, fmt.Sprintf(
+			"%s.rate_limit_max_clients must be at least 1.",
+			name))
+	}
+
 	// Return any errors encountered.
 	return errors
 }
@@ -1,12 +1,15 @@
 package config
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	toml "github.com/pelletier/go-toml"
 
@@ -19,6 +22,17 @@ import (
 type Config struct {
 	top *top
 
+	// The raw values from the configuration file that the process was
+	// started with. Reload() compares against this in order to find the
+	// changes that can not be applied without a restart.
+	raw map[string]interface{}
+
+	// Held while reloading so that only one reload can happen at a time,
+	// as well as a function that will stop the secret refreshers that were
+	// started for the previous reload.
+	reloadLock   sync.Mutex
+	reloadCancel context.CancelFunc
+
 	// A series of "Once" objects that ensure that the various stages
 	// of initialization are all run.
 	initializeOnce sync.Once
@@ -35,11 +49,19 @@ func Parse(filename string) (*Config, error) {
 	defer fd.Close()
 
 	// Read the contents of the file into a toml parser.
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, err
+	}
 	top := &top{}
-	decoder := toml.NewDecoder(fd).Strict(true)
+	decoder := toml.NewDecoder(bytes.NewReader(data)).Strict(true)
 	if err := decoder.Decode(top); err != nil {
 		return nil, err
 	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, err
+	}
 
 	// Success.. The toml was read, now we need to validate that it is
 	// correct and that all of the values are valid.
@@ -49,7 +71,7 @@ func Parse(filename string) (*Config, error) {
 	}
 
 	// Success!
-	return &Config{top: top}, nil
+	return &Config{top: top, raw: tree.ToMap()}, nil
 }
 
 // Initializes the logging system.
@@ -100,6 +122,23 @@ func (c *Config) GetRotators(ctx context.Context) []*sloghelper.Rotator {
 	return r
 }
 
+// Returns the machine ID that this server was configured with.
+func (c *Config) GetMachineID() uint32 {
+	return *c.top.MachineID
+}
+
+// Asks every configured remote for its machine ID and returns an error if
+// any of them are using the same ID as this server. Each remote is given
+// timeout to respond, remotes that do not are ignored.
+func (c *Config) CheckMachineID(
+	ctx context.Context,
+	timeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return c.top.remotePool.CheckMachineID(ctx, *c.top.MachineID)
+}
+
 // Returns a map of all namespaces mapped into the Storage structure
 // that will be serving them.
 func (c *Config) GetNameSpaces(ctx context.Context) map[string]*storage.Storage {
@@ -111,6 +150,12 @@ func (c *Config) GetNameSpaces(ctx context.Context) map[string]*storage.Storage
 	return c.top.getNameSpaces()
 }
 
+// Returns the maximum number of name spaces that should be started in
+// parallel. Zero means that there is no limit.
+func (c *Config) GetParallelStarts() int {
+	return *c.top.MaximumParallelStarts
+}
+
 // Returns the httpserver.Server for this config.
 func (c *Config) GetServer(ctx context.Context) httpserver.Server {
 	c.initializeOnce.Do(func() {
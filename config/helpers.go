@@ -2,6 +2,9 @@ package config
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 // Validates that the given string is valid for use as a domain in a cookie.
@@ -91,3 +94,53 @@ func hasEmpty(name string, list []string) (errors []string) {
 	}
 	return
 }
+
+// Returns an error for every pair of namespaces that use the same directory,
+// or where the directory of one is inside the other. Directories are made
+// absolute before being compared so different spellings of the same path
+// are caught, but symlinks are not followed since the directories may not
+// exist yet.
+func sharedDirectories(dirs map[string]string) (errors []string) {
+	names := make([]string, 0, len(dirs))
+	paths := make(map[string]string, len(dirs))
+	for name, dir := range dirs {
+		names = append(names, name)
+		if abs, err := filepath.Abs(dir); err == nil {
+			paths[name] = abs
+		} else {
+			paths[name] = filepath.Clean(dir)
+		}
+	}
+	sort.Strings(names)
+	inside := func(parent, child string) bool {
+		rel, err := filepath.Rel(parent, child)
+		return err == nil &&
+			rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			switch {
+			case paths[a] == paths[b]:
+				errors = append(errors, fmt.Sprintf(
+					"namespace.%s.directory and namespace.%s.directory "+
+						"can not be the same directory.",
+					a,
+					b))
+			case inside(paths[a], paths[b]):
+				errors = append(errors, fmt.Sprintf(
+					"namespace.%s.directory can not be inside "+
+						"namespace.%s.directory.",
+					b,
+					a))
+			case inside(paths[b], paths[a]):
+				errors = append(errors, fmt.Sprintf(
+					"namespace.%s.directory can not be inside "+
+						"namespace.%s.directory.",
+					a,
+					b))
+			}
+		}
+	}
+	return
+}
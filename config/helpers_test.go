@@ -0,0 +1,53 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestSharedDirectories(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Distinct directories, including ones that share a name prefix, are
+	// fine.
+	T.Equal(sharedDirectories(map[string]string{
+		"a": "/data/a",
+		"b": "/data/b",
+		"c": "/data/ab",
+	}), []string(nil))
+
+	// The same directory is rejected, however it is spelled.
+	same := []string{
+		"namespace.a.directory and namespace.b.directory can not be the " +
+			"same directory.",
+	}
+	T.Equal(sharedDirectories(map[string]string{
+		"a": "/data/a",
+		"b": "/data/a",
+	}), same)
+	T.Equal(sharedDirectories(map[string]string{
+		"a": "/data/a",
+		"b": "/data/a/",
+	}), same)
+	T.Equal(sharedDirectories(map[string]string{
+		"a": "/data/b/../a",
+		"b": "/data/a",
+	}), same)
+
+	// A directory inside of another is rejected whichever way around the
+	// namespaces are named.
+	T.Equal(sharedDirectories(map[string]string{
+		"a": "/data",
+		"b": "/data/b",
+	}), []string{
+		"namespace.b.directory can not be inside namespace.a.directory.",
+	})
+	T.Equal(sharedDirectories(map[string]string{
+		"a": "/data/a/nested",
+		"b": "/data/a",
+	}), []string{
+		"namespace.a.directory can not be inside namespace.b.directory.",
+	})
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/liquidgecka/blobby/httpserver"
+)
+
+// An additional endpoint that the HTTP server will listen on along side
+// server.addr and server.port. Each is either a TCP address and port or the
+// path to a Unix socket.
+type listener struct {
+	// The IP address and port to bind too.
+	Addr value `toml:"addr"`
+	Port value `toml:"port"`
+	port int
+
+	// The path of a Unix socket to listen on. This can not be used with
+	// addr or port.
+	Socket *string `toml:"socket"`
+
+	// If true then this endpoint will be served with TLS using the
+	// certificates configured for the server. This requires server.tls to
+	// be enabled.
+	TLS *bool `toml:"tls"`
+}
+
+// Returns the httpserver.ListenerSettings for this listener.
+func (l *listener) settings() httpserver.ListenerSettings {
+	if l.Socket != nil {
+		return httpserver.ListenerSettings{
+			Network: "unix",
+			Address: *l.Socket,
+			TLS:     *l.TLS,
+		}
+	}
+	return httpserver.ListenerSettings{
+		Network: "tcp",
+		Address: net.JoinHostPort(l.Addr.String(), strconv.Itoa(l.port)),
+		TLS:     *l.TLS,
+	}
+}
+
+func (l *listener) validate(t *top, name string) []string {
+	var errors []string
+	var err error
+
+	// Socket
+	if l.Socket != nil {
+		if *l.Socket == "" {
+			errors = append(errors, name+".socket can not be empty.")
+		}
+		if l.Addr.set || l.Port.set {
+			errors = append(errors, fmt.Sprintf(
+				"%s.socket can not be used with %s.addr or %s.port.",
+				name,
+				name,
+				name))
+		}
+	} else {
+		// Addr
+		if !l.Addr.set {
+			l.Addr.raw = []byte{}
+		} else if net.ParseIP(l.Addr.String()) == nil {
+			errors = append(errors, name+".addr is not a valid ip.")
+		}
+
+		// Port
+		if !l.Port.set {
+			errors = append(
+				errors,
+				name+".port is required when not using a socket.")
+		} else if l.port, err = l.Port.Int(); err != nil {
+			errors = append(errors, name+".port must be an integer.")
+		} else if l.port < 1 || l.port > 65535 {
+			errors = append(errors, name+".port is not a valid port.")
+		}
+	}
+
+	// TLS
+	if l.TLS == nil {
+		l.TLS = &defaultTLS
+	} else if *l.TLS && !*t.Server.TLS {
+		errors = append(
+			errors,
+			name+".tls can not be used when server.tls is false.")
+	}
+
+	return errors
+}
@@ -2,10 +2,16 @@ package config
 
 import (
 	"compress/gzip"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/liquidgecka/blobby/httpserver"
 	"github.com/liquidgecka/blobby/internal/sloghelper"
@@ -14,24 +20,112 @@ import (
 )
 
 var (
+	defaultAllowFullRead    = false
+	defaultAsyncReplication = false
+	defaultAsyncMaxPending  = 16
+	defaultCanaryRead       = false
+	defaultClockSkewPolicy  = "ignore"
 	defaultCompress         = false
+	defaultCompressAdaptive = false
+	defaultCompressTarget   = time.Minute
+	defaultCompressMinLevel = 1
+	defaultCompressAlgo     = storage.CompressAlgorithmGzip
+	defaultCompressIndex    = storage.CompressIndexFormatBinary
 	defaultCompressLevel    = 0
 	defaultDelayDelete      = time.Duration(0)
+	defaultDurableReadsOnly = false
+	defaultFileMode         = "0644"
+	defaultHeartBeatTime    = time.Minute
+	defaultIDEncoding       = "base64"
+	defaultIdempotencyKeys  = 100000
+	defaultIdempotencyTTL   = time.Duration(0)
+	defaultIdempotencyStore = false
+	defaultIdempotentInit   = false
+	defaultInsertQueueWait  = time.Duration(0)
+	defaultMillisecondFIDs  = false
+	defaultObjectStore      = "s3"
+	defaultOpenFilesFactor  = float64(2)
 	defaultOpenFilesMinimum = int32(1)
+	defaultOpenFilesStep    = float64(0)
+	defaultOrphanGrace      = time.Duration(0)
+	defaultParallelCompress = false
+	defaultParallelWorkers  = runtime.NumCPU()
+	defaultReadCache        = false
+	defaultReadCacheMaxAge  = time.Duration(0)
+	defaultReadCacheMaxSize = int64(1024 * 1024 * 1024) // 1 GB
+	defaultReadOpenFile     = false
+	defaultRecordCountMeta  = false
 	defaultReplicas         = int(1)
+	defaultReplicaQuorum    = int(0)
+	defaultReplicaMaxDisk   = 0.95
+	defaultRetainForReads   = false
+	defaultRotateEvery      = time.Duration(0)
 	defaultS3BasePath       = ""
+	defaultS3Concurrency    = 4
+	defaultS3PartSize       = int64(1024 * 1024 * 64) // 64 MB
+	defaultS3KMSKeyID       = ""
+	defaultS3SSE            = ""
+	defaultS3StorageClass   = ""
+	defaultS3WarmConns      = 0
+	defaultS3OpTimeout      = time.Duration(0)
+	defaultScrubInterval    = time.Duration(0)
+	defaultScrubQuarantine  = false
+	defaultShardDirectories = 0
+	defaultStaleReads       = false
+	defaultStatusFailures   = false
+	defaultSyncPolicy       = storage.SyncPolicyNone
+	defaultTrackReplicaLag  = false
+	defaultUnhealthyUploads = 0
+	defaultUploadAttempts   = 3
 	defaultUploadFileSize   = uint64(1024 * 1024 * 1024) // 1 GB
 	defaultUploadOlder      = time.Hour
+	defaultUploadRetry      = time.Second
+	defaultUploadRetryMax   = time.Second * 30
+	defaultVerifyBucket     = true
+	defaultVerifyCompress   = false
+	defaultVerifyUpload     = false
 )
 
 type nameSpace struct {
+	// If true then reads of compressed objects that have no compress index
+	// are served by decompressing the whole object from S3 rather than
+	// failing. This requires compress be true.
+	AllowFullDecompressReads *bool `toml:"allow_full_decompress_reads"`
+
+	// If true then inserts are acknowledged once the data is written to the
+	// local disk and replicated in the background. The file will not be
+	// uploaded until replication completes. async_replication_max_pending
+	// limits how many inserts per file can be waiting to be replicated
+	// before further inserts block.
+	AsyncReplication           *bool `toml:"async_replication"`
+	AsyncReplicationMaxPending *int  `toml:"async_replication_max_pending"`
+
 	// The name of AWS profile that should be used for uploading.
 	AWSProfile *string `toml:"aws_profile"`
 
 	// Blast Path Access Control List which establishes protections around
-	// the BLASTSTATUS and BLASTREAD API calls.
+	// the BLASTSTATUS, BLASTLIST, BLASTGET, BLASTMULTIGET and BLASTTAIL
+	// API calls.
 	BlastPathACL *acl `toml:"blast_path_acl"`
 
+	// The maximum number of bytes that a single BLASTGET or BLASTMULTIGET
+	// request can fetch. If not set then there is no limit.
+	BlastPathMaxBytes value `toml:"blast_path_max_bytes"`
+	blastPathMaxBytes uint64
+
+	// If true then after each upload a small random range of the object is
+	// read back from S3 and compared to the local file, retrying the upload
+	// if it does not match.
+	CanaryReadAfterUpload *bool `toml:"canary_read_after_upload"`
+
+	// Controls what happens when the system clock moves backwards when
+	// generating the id of a new file. "ignore" uses the current time
+	// anyway, "clamp" reuses the time of the last generated file so times
+	// only ever move forward, and "refuse" will not create new files until
+	// the clock catches up.
+	ClockSkewPolicy *string `toml:"clock_skew_policy"`
+	clockSkewPolicy fid.ClockSkewPolicy
+
 	// If set to true then uploads will be gzipped as they are sent to
 	// AWS. This ensures that the actual stored contents will be small
 	// but also breaks the ability to perform a GET on uploaded data when
@@ -39,23 +133,161 @@ type nameSpace struct {
 	Compress      *bool `toml:"compress"`
 	CompressLevel *int  `toml:"compress_level"`
 
+	// If true then the compression level is lowered when files are being
+	// queued for compression faster than they can be compressed, which
+	// happens when the machine is short on CPU, and raised again once the
+	// queue is empty. The level stays between compress_level_min (1 by
+	// default) and compress_level_max (the highest level supported by the
+	// algorithm by default) and compress_level is ignored. The level is
+	// lowered when the queue would take longer than
+	// compress_adaptive_target (1m by default) to work through.
+	CompressAdaptive       *bool          `toml:"compress_adaptive"`
+	CompressAdaptiveTarget *time.Duration `toml:"compress_adaptive_target"`
+	CompressLevelMin       *int           `toml:"compress_level_min"`
+	CompressLevelMax       *int           `toml:"compress_level_max"`
+
+	// The algorithm used for compression, either "gzip" or "zstd". This
+	// also controls the range of valid values for compress_level, -1 to 9
+	// for gzip and 0 to 22 for zstd.
+	CompressAlgorithm *string `toml:"compress_algorithm"`
+
+	// If set then compressed files are written with a restart point every
+	// compress_index_interval uncompressed bytes and an index of those
+	// points is uploaded alongside the object. This allows reads of
+	// compressed objects to be served from S3. The index is stored in
+	// compress_index_format which can be "binary" (the default) or "json".
+	CompressIndexInterval value   `toml:"compress_index_interval"`
+	CompressIndexFormat   *string `toml:"compress_index_format"`
+	compressIndexInterval uint64
+
 	// If greater than zero then the local file will have a delay between
 	// its overall shutdown and when the file gets removed from disk. This
 	// can be used to ensure that local caching is available for callers
 	// for some time after the file has stopped being processed.
 	DelayDelete *time.Duration `toml:"delay_delete"`
 
+	// Delete Access Control List which establishes who is allowed to
+	// delete uploaded files from the name space. If this is not set then
+	// deletes are not allowed at all.
+	DeleteACL *acl `toml:"delete_acl"`
+
+	// If set to true then reads will only be served from S3. Data that has
+	// not been uploaded yet will be rejected rather than served from the
+	// local or replica copies.
+	DurableReadsOnly *bool `toml:"durable_reads_only"`
+
 	// The Directory that files should be written to for this namespace.
 	Directory *string `toml:"directory"`
 
+	// The permissions, as an octal string, that files written to directory
+	// are created with. The process umask still applies. The owner must be
+	// able to read and write the files. This defaults to "0644".
+	FileMode *string `toml:"file_mode"`
+	fileMode os.FileMode
+
+	// A replica that does not receive a heart beat from its primary for
+	// heart_beat_time is considered orphaned and uploads its data. Primaries
+	// send heart beats every half of this, offset by a random amount of up
+	// to heart_beat_jitter so that many primaries do not all send their
+	// heart beats at the same moment. The jitter defaults to a tenth of
+	// heart_beat_time and must be less than half of it. Every server
+	// should use the same values for a namespace.
+	HeartBeatTime   *time.Duration `toml:"heart_beat_time"`
+	HeartBeatJitter *time.Duration `toml:"heart_beat_jitter"`
+
+	// The encoding of the IDs returned from inserts. "base64" is the
+	// original encoding and "base62" uses only letters and numbers. Reads
+	// accept IDs in either encoding so this can be changed at any time.
+	IDEncoding *string `toml:"id_encoding"`
+	idEncoding fid.IDEncoding
+
+	// If idempotency_key_ttl is set then inserts that include an
+	// Idempotency-Key header return the ID from an earlier insert with the
+	// same key rather than storing the data again. This only holds if the
+	// retry arrives within the TTL and is sent to the same server, and
+	// only idempotency_key_max_entries keys are remembered. Keys are lost
+	// on restart unless idempotency_key_persist is true.
+	IdempotencyKeyTTL        *time.Duration `toml:"idempotency_key_ttl"`
+	IdempotencyKeyMaxEntries *int           `toml:"idempotency_key_max_entries"`
+	IdempotencyKeyPersist    *bool          `toml:"idempotency_key_persist"`
+
+	// If true then a primary initializing a replica that already exists
+	// and is still accepting data will succeed rather than fail. This lets
+	// primaries safely retry initialize calls.
+	IdempotentReplicaInitialize *bool `toml:"idempotent_replica_initialize"`
+
 	// Insert Access Control List which establishes protections around
 	// who is allowed to insert data into the name space.
 	InsertACL *acl `toml:"insert_acl"`
 
+	// The upper bounds of the buckets used for the insert latency
+	// histograms exposed via prometheus, written as durations like "5ms"
+	// and listed in increasing order. If not set a default set of buckets
+	// ranging from 1ms to 5s is used.
+	InsertLatencyBuckets []string `toml:"insert_latency_buckets"`
+
+	// If set then an insert that has waited this long for a file to write
+	// to is rejected with a 503 and a Retry-After header rather than
+	// holding the connection open until the namespace catches up.
+	InsertQueueTimeout *time.Duration `toml:"insert_queue_timeout"`
+
+	// If set then inserts are rejected with a 507 once the data files of
+	// the primaries and replicas in this namespace would use more than this
+	// much disk space. This keeps a stall in uploading from filling the
+	// disk and breaking every namespace on the machine. The limit applies
+	// to each namespace separately and only counts the data written to the
+	// files, not space reserved by preallocate_size, so leave room for
+	// preallocation and the other namespaces on the same disk.
+	MaxDiskUsage value `toml:"max_disk_usage"`
+	maxDiskUsage int64
+
+	// If set then a single insert larger than this is rejected with a 413,
+	// which keeps one large insert from growing a file far past
+	// upload_file_size.
+	MaxRecordSize value `toml:"max_record_size"`
+	maxRecordSize int64
+
+	// If true then new files are given ids that include the time they were
+	// created in milliseconds rather than seconds, so files created in the
+	// same second get distinct S3 timestamps. Ids generated either way can
+	// always be read.
+	MillisecondFIDs *bool `toml:"millisecond_fids"`
+
+	// The object store that data is uploaded to. Only "s3" (the default) is
+	// supported right now, "gcs" is reserved for when the Google Cloud
+	// Storage client is implemented and is rejected until then. The bucket
+	// is set with s3_bucket and the s3_base_path and key format settings
+	// apply to every store.
+	ObjectStore *string `toml:"object_store"`
+
+	// Controls how eagerly new primary files are opened as inserts queue
+	// up. With n files open another is opened once more than
+	// step*n + factor^n inserts are waiting. The defaults of 2 and 0 open a
+	// new file once more than 2^n inserts are waiting.
+	OpenFilesGrowthFactor *float64 `toml:"open_files_growth_factor"`
+	OpenFilesGrowthStep   *float64 `toml:"open_files_growth_step"`
+
 	// The minimum and maximum number of open primary files.
 	OpenFilesMaximum *int32 `toml:"max_open_files"`
 	OpenFilesMinimum *int32 `toml:"min_open_files"`
 
+	// If greater than zero then a replica whose primary stops sending heart
+	// beats will wait this long before uploading, giving a primary that
+	// was only briefly unreachable a chance to resume.
+	OrphanGracePeriod *time.Duration `toml:"orphan_grace_period"`
+
+	// If true then large files are compressed using several goroutines at
+	// once, up to parallel_compress_workers (the number of CPUs by
+	// default). The output is still a valid gzip or zstd file.
+	ParallelCompress        *bool `toml:"parallel_compress"`
+	ParallelCompressWorkers *int  `toml:"parallel_compress_workers"`
+
+	// If set then this much disk space is reserved for each primary and
+	// replica file when it is opened so that appending inserts does not
+	// fragment it. This is only supported on Linux.
+	PreallocateSize value `toml:"preallocate_size"`
+	preallocateSize int64
+
 	// This ACL controls which servers are allowed to request this name space
 	// act as a replica.
 	PrimaryACL *acl `roml:"primary_acl"`
@@ -64,9 +296,54 @@ type nameSpace struct {
 	// data from this namespace.
 	ReadACL *acl `toml:"read_acl"`
 
+	// If true then local reads are served from the already open file
+	// rather than opening the file by name, which allows reads to finish
+	// even if the file is deleted part way through.
+	ReadFromOpenFile *bool `toml:"read_from_open_file"`
+
+	// If true then the number of records in each file is stored with the
+	// uploaded object as Blobby-Records metadata.
+	RecordCountMetadata *bool `toml:"record_count_metadata"`
+
+	// If true then data read from S3 is cached on local disk so later reads
+	// of the same data do not need to go to S3 again. The cache is kept
+	// below read_cache_max_size (1GB by default) by evicting the least
+	// recently used data, and if read_cache_max_age is set then data older
+	// than that is read from S3 again.
+	ReadCache        *bool          `toml:"read_cache"`
+	ReadCacheMaxAge  *time.Duration `toml:"read_cache_max_age"`
+	ReadCacheMaxSize value          `toml:"read_cache_max_size"`
+	readCacheMaxSize int64
+
 	// The number of replicas that each primary file should be assigned.
+	// Setting this to 0 stores data only on the local disk until it is
+	// uploaded to S3.
 	Replicas *int `toml:"replicas"`
 
+	// If set then inserts succeed once this many replicas have accepted the
+	// data rather than requiring all of them to. Replicas that fail are
+	// dropped from the file and deleted once it has been uploaded. This
+	// must not be greater than replicas.
+	ReplicaQuorum *int `toml:"replica_quorum"`
+
+	// New replicas are preferably assigned to the remotes that report the
+	// most free disk space, and remotes that report using at least this
+	// fraction of their disk are not assigned new replicas at all. Remotes
+	// that do not report their usage are assigned round robin. Setting
+	// this to 0 still prefers emptier remotes but never skips any.
+	ReplicaMaxDiskUsage *float64 `toml:"replica_max_disk_usage"`
+
+	// If true then files are kept readable on the local disk for
+	// delay_delete after they are uploaded. Unlike delay_delete on its own
+	// this retains replicas as well, and retained files are used to serve
+	// durable reads. This requires delay_delete be set.
+	RetainForReads *bool `toml:"retain_for_reads"`
+
+	// If set then all primaries will be rotated when the wall clock reaches
+	// a multiple of this duration, so "1h" will rotate files at the top of
+	// every hour. This is in addition to upload_older and upload_file_size.
+	RotateEvery *time.Duration `toml:"rotate_every"`
+
 	// The S3 bucket and base path that define where data from this name
 	// space will be uploaded. There is also an optional formatter that can
 	// format the eventual Key in S3 using properties like time stamps and
@@ -75,14 +352,148 @@ type nameSpace struct {
 	S3BasePath  *string `toml:"s3_base_path"`
 	S3KeyFormat *string `toml:"s3_key_format"`
 
+	// Additional key formats that objects will also be written under when
+	// uploaded. This is useful when migrating between key formats since
+	// consumers of either format will be able to find the data. Reads will
+	// try each of these formats if the object is not found via
+	// s3_key_format.
+	S3AdditionalKeyFormats []string `toml:"s3_additional_key_formats"`
+
+	// If set then after an object is uploaded under s3_key_format a copy is
+	// also written under a key that starts with this format rendered using
+	// the time of the upload rather than the time the data was created,
+	// followed by the key from s3_key_format. Writing the copy is best
+	// effort and reads never use it.
+	S3KeyUploadFormat *string `toml:"s3_key_upload_format"`
+
+	// Files larger than s3_part_size are uploaded to S3 in parts of this
+	// size, with s3_concurrency parts being uploaded at once. A part that
+	// fails is retried on its own rather than restarting the upload. The
+	// part size can not be smaller than 5MB.
+	S3PartSize    value `toml:"s3_part_size"`
+	S3Concurrency *int  `toml:"s3_concurrency"`
+	s3PartSize    int64
+
+	// The storage class and server side encryption that objects will be
+	// written to S3 with. s3_sse can be "AES256" or "aws:kms", and
+	// s3_kms_key_id can only be set when s3_sse is "aws:kms". If not set
+	// the bucket defaults are used.
+	S3StorageClass *string `toml:"s3_storage_class"`
+	S3SSE          *string `toml:"s3_sse"`
+	S3KMSKeyID     *string `toml:"s3_kms_key_id"`
+
+	// The number of connections to S3 that should be opened when the
+	// name space starts so that early uploads do not pay the cost of
+	// setting up new connections. Zero disables this.
+	S3WarmConnections *int `toml:"s3_warm_connections"`
+
+	// If set then every S3 call, including reading the data returned from
+	// a GET, must finish within this long. Uploads larger than s3_part_size
+	// are given this long for each part. Reads that take longer fail with a
+	// 504 and uploads are retried. This is independent of the timeouts on
+	// the HTTP server.
+	S3OperationTimeout *time.Duration `toml:"s3_operation_timeout"`
+
+	// If set then the local files are scrubbed this often, reading back
+	// every insert and checking it against the hash computed when it was
+	// written. Reads are limited to scrub_bytes_per_second if set. If
+	// scrub_quarantine is true then files that fail are no longer used to
+	// serve reads.
+	ScrubInterval       *time.Duration `toml:"scrub_interval"`
+	ScrubBytesPerSecond value          `toml:"scrub_bytes_per_second"`
+	scrubBytesPerSecond int64
+	ScrubQuarantine     *bool `toml:"scrub_quarantine"`
+
+	// If greater than zero then files in directory are spread across this
+	// many subdirectories, picked by hashing the file id, rather than all
+	// being stored in directory itself. This keeps busy namespaces from
+	// ending up with tens of thousands of files in a single directory.
+	// Files in either layout are recovered at startup so this can be
+	// changed on an existing directory. This can not be more than 256.
+	ShardDirectories *int `toml:"shard_directories"`
+
+	// If true then the status page will include the number of times each
+	// file has failed to upload, which helps track down files that can
+	// never be uploaded.
+	StatusUploadFailures *bool `toml:"status_upload_failures"`
+
+	// If true then reads that fail due to S3 errors will be served from
+	// any copy of the file still on local disk. Combined with delay_delete
+	// this allows recently uploaded data to be read during S3 outages.
+	StaleReadsOnS3Error *bool `toml:"stale_reads_on_s3_error"`
+
+	// Controls when inserted data is synced to disk. "none" leaves it to
+	// the operating system, "on-insert" syncs every insert before it is
+	// acknowledged at the cost of insert latency, and "on-rotate" syncs
+	// each file once it stops accepting new data.
+	SyncPolicy *string `toml:"sync_policy"`
+
+	// If true then primaries track how many bytes behind each replica has
+	// fallen and report the largest gap in the status page and metrics.
+	TrackReplicaLag *bool `toml:"track_replica_lag"`
+
+	// The number of uploads to S3 that must fail in a row before the name
+	// space reports itself as unhealthy on /_health. This lets a load
+	// balancer stop sending inserts to a server that can not durably
+	// store them. Any successful upload resets the count. The default of 0
+	// never reports upload failures as unhealthy.
+	UnhealthyUploadFailures *int `toml:"unhealthy_upload_failures"`
+
 	// Any primary file that grows beyond this size will be automatically
 	// uploaded.
 	UploadFileSize value `toml:"upload_file_size"`
 	uploadFileSize uint64
 
+	// The range that upload_file_size can be changed within at runtime via
+	// /_upload_thresholds. If not set then the configured size is used as
+	// the limit.
+	UploadFileSizeMinimum value `toml:"upload_file_size_minimum"`
+	uploadFileSizeMinimum uint64
+	UploadFileSizeMaximum value `toml:"upload_file_size_maximum"`
+	uploadFileSizeMaximum uint64
+
+	// If set then uploads to S3 from this name space are limited to this
+	// many bytes per second in total, which keeps large uploads from
+	// starving replication traffic. Unlimited if not set.
+	UploadBytesPerSecond value `toml:"upload_bytes_per_second"`
+	uploadBytesPerSecond int64
+
 	// Upload files that are at least this old.
 	UploadOlder *time.Duration `toml:"upload_older"`
 
+	// The range that upload_older can be changed within at runtime via
+	// /_upload_thresholds. If not set then the configured age is used as
+	// the limit.
+	UploadOlderMinimum *time.Duration `toml:"upload_older_minimum"`
+	UploadOlderMaximum *time.Duration `toml:"upload_older_maximum"`
+
+	// The number of times an upload to S3 is attempted before the file is
+	// requeued, and the range of delays that are waited between attempts.
+	// The delay starts at upload_retry_delay and doubles each time up to
+	// upload_retry_max_delay.
+	UploadAttempts      *int           `toml:"upload_attempts"`
+	UploadRetryDelay    *time.Duration `toml:"upload_retry_delay"`
+	UploadRetryMaxDelay *time.Duration `toml:"upload_retry_max_delay"`
+
+	// If set then a JSON description of each file is POSTed to this URL
+	// once it has been uploaded, allowing downstream pipelines to find new
+	// objects without polling. Delivery is best effort and uses the client
+	// timeout.
+	UploadWebhook *string `toml:"upload_webhook"`
+
+	// If true then compressed files are read back and checked against the
+	// original data before being uploaded. This requires compress be true.
+	VerifyCompression *bool `toml:"verify_compression"`
+
+	// If true (the default) then the namespace will fail to start if the
+	// s3_bucket does not exist or can not be accessed.
+	VerifyBucketOnStart *bool `toml:"verify_bucket_on_start"`
+
+	// If true then the hash of each file is stored with the uploaded object
+	// and the object is read back and checked against the local file once
+	// the upload completes. Objects that do not match are uploaded again.
+	VerifyUploadHash *bool `toml:"verify_upload_hash"`
+
 	// A quick reference to the top configuration element.
 	top *top
 
@@ -92,6 +503,15 @@ type nameSpace struct {
 	// The formatter created for S3KeyFormat.
 	formatter *fid.Formatter
 
+	// The formatters created for S3AdditionalKeyFormats.
+	additionalFormatters []*fid.Formatter
+
+	// The formatter created for S3KeyUploadFormat.
+	uploadFormatter *fid.Formatter
+
+	// The durations parsed from InsertLatencyBuckets.
+	insertLatencyBuckets []time.Duration
+
 	// A reference to the storage object.
 	storage *storage.Storage
 
@@ -103,11 +523,13 @@ type nameSpace struct {
 // must be called after validation and logging is initialized.
 func (n *nameSpace) getNameSpaceSettings() *httpserver.NameSpaceSettings {
 	return &httpserver.NameSpaceSettings{
-		BlastPathACL: n.BlastPathACL.access(),
-		InsertACL:    n.InsertACL.access(),
-		PrimaryACL:   n.PrimaryACL.access(),
-		ReadACL:      n.ReadACL.access(),
-		Storage:      n.Storage(),
+		BlastPathACL:      n.BlastPathACL.access(),
+		BlastPathMaxBytes: n.blastPathMaxBytes,
+		DeleteACL:         n.DeleteACL.access(),
+		InsertACL:         n.InsertACL.access(),
+		PrimaryACL:        n.PrimaryACL.access(),
+		ReadACL:           n.ReadACL.access(),
+		Storage:           n.Storage(),
 	}
 }
 
@@ -119,33 +541,114 @@ func (n *nameSpace) Storage() *storage.Storage {
 			sloghelper.String("component", "storage"),
 			sloghelper.String("namespace", n.name))
 		awsSession, _ := n.top.getAWSSession(*n.AWSProfile)
-		uploader := s3manager.NewUploader(awsSession)
 		s3client := s3.New(awsSession)
+		var onUpload func(context.Context, storage.UploadEvent) error
+		if n.UploadWebhook != nil {
+			onUpload = storage.UploadWebhook(
+				*n.UploadWebhook,
+				n.top.Client.HTTPClient())
+		}
+		assignRemotes := n.top.remotePool.AssignRemotesFor(
+			n.name,
+			*n.ReplicaMaxDiskUsage)
 		n.storage = storage.New(&storage.Settings{
-			AssignRemotes:          n.top.remotePool.AssignRemotes,
-			AWSUploader:            uploader,
-			BaseDirectory:          *n.Directory,
-			BaseLogger:             l,
-			CompressLevel:          *n.CompressLevel,
-			Compress:               *n.Compress,
-			CompressWorkQueue:      n.top.getCompressWorkQueue(),
-			DelayDelete:            *n.DelayDelete,
-			DelayQueue:             n.top.getDelayQueue(),
-			DeleteLocalWorkQueue:   n.top.getDeleteLocalWorkQueue(),
-			DeleteRemotesWorkQueue: n.top.getDeleteRemotesWorkQueue(),
-			MachineID:              *n.top.MachineID,
-			NameSpace:              n.name,
-			OpenFilesMaximum:       *n.OpenFilesMaximum,
-			OpenFilesMinimum:       *n.OpenFilesMinimum,
-			Read:                   n.top.remotePool.Read,
-			Replicas:               *n.Replicas,
-			S3BasePath:             *n.S3BasePath,
-			S3Bucket:               *n.S3Bucket,
-			S3Client:               s3client,
-			S3KeyFormat:            n.formatter,
-			UploadLargerThan:       n.uploadFileSize,
-			UploadOlder:            *n.UploadOlder,
-			UploadWorkQueue:        n.top.getUploadWorkQueue(),
+			AllowFullDecompressReads:    *n.AllowFullDecompressReads,
+			AssignRemotes:               assignRemotes,
+			AsyncReplication:            *n.AsyncReplication,
+			AsyncReplicationMaxPending:  *n.AsyncReplicationMaxPending,
+			BaseDirectory:               *n.Directory,
+			BaseLogger:                  l,
+			CanaryReadAfterUpload:       *n.CanaryReadAfterUpload,
+			ClockSkewPolicy:             n.clockSkewPolicy,
+			CompressAdaptive:            *n.CompressAdaptive,
+			CompressAdaptiveTarget:      *n.CompressAdaptiveTarget,
+			CompressAlgorithm:           *n.CompressAlgorithm,
+			CompressIndexFormat:         *n.CompressIndexFormat,
+			CompressIndexInterval:       n.compressIndexInterval,
+			CompressLevel:               *n.CompressLevel,
+			CompressLevelMax:            *n.CompressLevelMax,
+			CompressLevelMin:            *n.CompressLevelMin,
+			Compress:                    *n.Compress,
+			CompressWorkQueue:           n.top.getCompressWorkQueue(),
+			DelayDelete:                 *n.DelayDelete,
+			DelayQueue:                  n.top.getDelayQueue(),
+			DurableReadsOnly:            *n.DurableReadsOnly,
+			FileMode:                    n.fileMode,
+			DeleteLocalWorkQueue:        n.top.getDeleteLocalWorkQueue(),
+			DeleteRemotesWorkQueue:      n.top.getDeleteRemotesWorkQueue(),
+			Head:                        n.top.remotePool.Head,
+			HeartBeatJitter:             *n.HeartBeatJitter,
+			HeartBeatTime:               *n.HeartBeatTime,
+			IDEncoding:                  n.idEncoding,
+			IdempotencyKeyTTL:           *n.IdempotencyKeyTTL,
+			IdempotencyKeyMaxEntries:    *n.IdempotencyKeyMaxEntries,
+			IdempotencyKeyPersist:       *n.IdempotencyKeyPersist,
+			IdempotentReplicaInitialize: *n.IdempotentReplicaInitialize,
+			InsertLatencyBuckets:        n.insertLatencyBuckets,
+			InsertQueueTimeout:          *n.InsertQueueTimeout,
+			MachineID:                   *n.top.MachineID,
+			MaxDiskBytes:                n.maxDiskUsage,
+			MaxRecordBytes:              n.maxRecordSize,
+			MillisecondFIDs:             *n.MillisecondFIDs,
+			NameSpace:                   n.name,
+			OnUpload:                    onUpload,
+			OpenFilesGrowthFactor:       *n.OpenFilesGrowthFactor,
+			OpenFilesGrowthStep:         *n.OpenFilesGrowthStep,
+			OpenFilesMaximum:            *n.OpenFilesMaximum,
+			OpenFilesMinimum:            *n.OpenFilesMinimum,
+			OrphanGracePeriod:           *n.OrphanGracePeriod,
+			ParallelCompress:            *n.ParallelCompress,
+			ParallelCompressWorkers:     *n.ParallelCompressWorkers,
+			PreallocateBytes:            n.preallocateSize,
+			Read:                        n.top.remotePool.Read,
+			ReadCache:                   *n.ReadCache,
+			ReadCacheMaxAge:             *n.ReadCacheMaxAge,
+			ReadCacheMaxBytes:           n.readCacheMaxSize,
+			ReadFromOpenFile:            *n.ReadFromOpenFile,
+			RecordCountMetadata:         *n.RecordCountMetadata,
+			Replicas:                    *n.Replicas,
+			ReplicaQuorum:               *n.ReplicaQuorum,
+			ReplicaHolders:              n.top.remotePool.ReplicaHolders,
+			RetainForReads:              *n.RetainForReads,
+			RotateEvery:                 *n.RotateEvery,
+			S3BasePath:                  *n.S3BasePath,
+			S3Bucket:                    *n.S3Bucket,
+			S3Client:                    s3client,
+			S3KeyFormat:                 n.formatter,
+			S3KeyUploadFormat:           n.uploadFormatter,
+			S3AdditionalKeyFormats:      n.additionalFormatters,
+			S3Concurrency:               *n.S3Concurrency,
+			S3PartSize:                  n.s3PartSize,
+			S3KMSKeyID:                  *n.S3KMSKeyID,
+			S3SSE:                       *n.S3SSE,
+			S3StorageClass:              *n.S3StorageClass,
+			S3OperationTimeout:          *n.S3OperationTimeout,
+			S3WarmConnections:           *n.S3WarmConnections,
+			ScrubBytesPerSecond:         n.scrubBytesPerSecond,
+			ScrubInterval:               *n.ScrubInterval,
+			ScrubQuarantine:             *n.ScrubQuarantine,
+			ShardDirectories:            *n.ShardDirectories,
+			StaleReadsOnS3Error:         *n.StaleReadsOnS3Error,
+			StatusUploadFailures:        *n.StatusUploadFailures,
+			SyncPolicy:                  *n.SyncPolicy,
+			TrackReplicaLag:             *n.TrackReplicaLag,
+			UnhealthyUploadFailures:     *n.UnhealthyUploadFailures,
+			UploadAttempts:              *n.UploadAttempts,
+			UploadBytesPerSecond:        n.uploadBytesPerSecond,
+			UploadLargerThan:            n.uploadFileSize,
+			UploadLargerThanMaximum:     n.uploadFileSizeMaximum,
+			UploadLargerThanMinimum:     n.uploadFileSizeMinimum,
+			UploadOlder:                 *n.UploadOlder,
+			UploadOlderMaximum:          *n.UploadOlderMaximum,
+			UploadOlderMinimum:          *n.UploadOlderMinimum,
+			UploadRetryDelay:            *n.UploadRetryDelay,
+			UploadRetryMaxDelay:         *n.UploadRetryMaxDelay,
+			UploadSemaphore:             n.top.getUploadSemaphore(),
+			UploadWorkQueue:             n.top.getUploadWorkQueue(),
+			VerifyBucketOnStart:         *n.VerifyBucketOnStart,
+			VerifyCompression:           *n.VerifyCompression,
+			VerifyUploadHash:            *n.VerifyUploadHash,
+			Zone:                        n.top.remotePool.Zone,
 		})
 	}
 
@@ -177,11 +680,98 @@ func (n *nameSpace) validate(top *top, name string) []string {
 			n.BlastPathACL.validate(top, name+".blast_path_acl")...)
 	}
 
+	// BlastPathMaxBytes
+	if n.BlastPathMaxBytes.set {
+		if b, err := n.BlastPathMaxBytes.Bytes(); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".blast_path_max_bytes "+err.Error())
+		} else if b < 1 {
+			errors = append(
+				errors,
+				"namespace."+name+".blast_path_max_bytes must be greater "+
+					"than 0.")
+		} else {
+			n.blastPathMaxBytes = uint64(b)
+		}
+	}
+
+	// AsyncReplication
+	if n.AsyncReplication == nil {
+		n.AsyncReplication = &defaultAsyncReplication
+	}
+
+	// AsyncReplicationMaxPending
+	if n.AsyncReplicationMaxPending != nil && !*n.AsyncReplication {
+		errors = append(
+			errors,
+			"namespace."+name+".async_replication_max_pending requires "+
+				"async_replication be true.")
+	} else if n.AsyncReplicationMaxPending == nil {
+		n.AsyncReplicationMaxPending = &defaultAsyncMaxPending
+	} else if *n.AsyncReplicationMaxPending < 1 {
+		errors = append(
+			errors,
+			"namespace."+name+".async_replication_max_pending must be "+
+				"greater than 0.")
+	}
+
+	// CanaryReadAfterUpload
+	if n.CanaryReadAfterUpload == nil {
+		n.CanaryReadAfterUpload = &defaultCanaryRead
+	}
+
+	// ClockSkewPolicy
+	if n.ClockSkewPolicy == nil {
+		n.ClockSkewPolicy = &defaultClockSkewPolicy
+	}
+	switch *n.ClockSkewPolicy {
+	case "ignore":
+		n.clockSkewPolicy = fid.ClockSkewIgnore
+	case "clamp":
+		n.clockSkewPolicy = fid.ClockSkewClamp
+	case "refuse":
+		n.clockSkewPolicy = fid.ClockSkewRefuse
+	default:
+		errors = append(
+			errors,
+			"namespace."+name+".clock_skew_policy must be 'ignore', "+
+				"'clamp', or 'refuse'.")
+	}
+
 	// Compress
 	if n.Compress == nil {
 		n.Compress = &defaultCompress
 	}
 
+	// AllowFullDecompressReads
+	if n.AllowFullDecompressReads == nil {
+		n.AllowFullDecompressReads = &defaultAllowFullRead
+	} else if *n.AllowFullDecompressReads && !*n.Compress {
+		errors = append(
+			errors,
+			"namespace."+name+".allow_full_decompress_reads requires "+
+				"compress be true.")
+	}
+
+	// CompressAlgorithm
+	minLevel, maxLevel := -1, gzip.BestCompression
+	if n.CompressAlgorithm != nil && !*n.Compress {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_algorithm requires compress be "+
+				"true.")
+	} else if n.CompressAlgorithm == nil {
+		n.CompressAlgorithm = &defaultCompressAlgo
+	} else if *n.CompressAlgorithm == storage.CompressAlgorithmZstd {
+		minLevel, maxLevel = 0, 22
+	} else if *n.CompressAlgorithm != storage.CompressAlgorithmGzip {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_algorithm must be 'gzip' or "+
+				"'zstd'.")
+	}
+
 	// CompressLevel
 	if n.CompressLevel != nil && !*n.Compress {
 		errors = append(
@@ -189,10 +779,119 @@ func (n *nameSpace) validate(top *top, name string) []string {
 			"namespace."+name+".compress_level requires compress be true.")
 	} else if n.CompressLevel == nil {
 		n.CompressLevel = &defaultCompressLevel
-	} else if *n.CompressLevel < -1 || *n.CompressLevel > gzip.BestCompression {
+	} else if *n.CompressLevel < minLevel || *n.CompressLevel > maxLevel {
+		errors = append(
+			errors,
+			fmt.Sprintf(
+				"namespace.%s.compress_level must be between %d and %d.",
+				name,
+				minLevel,
+				maxLevel))
+	}
+
+	// CompressAdaptive
+	if n.CompressAdaptive != nil && *n.CompressAdaptive && !*n.Compress {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_adaptive requires compress be "+
+				"true.")
+	} else if n.CompressAdaptive == nil {
+		n.CompressAdaptive = &defaultCompressAdaptive
+	}
+
+	// CompressAdaptiveTarget
+	if n.CompressAdaptiveTarget != nil && !*n.CompressAdaptive {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_adaptive_target requires "+
+				"compress_adaptive be true.")
+	} else if n.CompressAdaptiveTarget == nil {
+		n.CompressAdaptiveTarget = &defaultCompressTarget
+	} else if *n.CompressAdaptiveTarget <= 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_adaptive_target must be "+
+				"greater than 0.")
+	}
+
+	// CompressLevelMin
+	if n.CompressLevelMin != nil && !*n.CompressAdaptive {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_level_min requires "+
+				"compress_adaptive be true.")
+	} else if n.CompressLevelMin == nil {
+		n.CompressLevelMin = &defaultCompressMinLevel
+	} else if *n.CompressLevelMin < 1 || *n.CompressLevelMin > maxLevel {
+		errors = append(
+			errors,
+			fmt.Sprintf(
+				"namespace.%s.compress_level_min must be between 1 and %d.",
+				name,
+				maxLevel))
+	}
+
+	// CompressLevelMax
+	if n.CompressLevelMax != nil && !*n.CompressAdaptive {
 		errors = append(
 			errors,
-			"namespace."+name+".compress_level must be between -1 and 9.")
+			"namespace."+name+".compress_level_max requires "+
+				"compress_adaptive be true.")
+	} else if n.CompressLevelMax == nil {
+		n.CompressLevelMax = &maxLevel
+	} else if *n.CompressLevelMax < *n.CompressLevelMin ||
+		*n.CompressLevelMax > maxLevel {
+		errors = append(
+			errors,
+			fmt.Sprintf(
+				"namespace.%s.compress_level_max must be between "+
+					"compress_level_min and %d.",
+				name,
+				maxLevel))
+	}
+
+	// CompressIndexInterval
+	if n.CompressIndexInterval.set {
+		if !*n.Compress {
+			errors = append(
+				errors,
+				"namespace."+name+".compress_index_interval requires "+
+					"compress be true.")
+		} else if i, err := n.CompressIndexInterval.Bytes(); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".compress_index_interval "+err.Error())
+		} else if i < 1 {
+			errors = append(
+				errors,
+				"namespace."+name+".compress_index_interval must be "+
+					"greater than 0.")
+		} else {
+			n.compressIndexInterval = uint64(i)
+		}
+	}
+
+	// CompressIndexFormat
+	if n.CompressIndexFormat != nil && !n.CompressIndexInterval.set {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_index_format requires "+
+				"compress_index_interval be set.")
+	} else if n.CompressIndexFormat == nil {
+		n.CompressIndexFormat = &defaultCompressIndex
+	} else if *n.CompressIndexFormat != storage.CompressIndexFormatBinary &&
+		*n.CompressIndexFormat != storage.CompressIndexFormatJSON {
+		errors = append(
+			errors,
+			"namespace."+name+".compress_index_format must be 'binary' or "+
+				"'json'.")
+	}
+
+	// DeleteACL
+	if n.DeleteACL != nil {
+		errors = append(
+			errors,
+			n.DeleteACL.validate(top, name+".delete_acl")...)
 	}
 
 	// DelayDelete
@@ -204,11 +903,111 @@ func (n *nameSpace) validate(top *top, name string) []string {
 			"namespace."+name+".delay_delete can not be negative.")
 	}
 
+	// DurableReadsOnly
+	if n.DurableReadsOnly == nil {
+		n.DurableReadsOnly = &defaultDurableReadsOnly
+	} else if *n.DurableReadsOnly && *n.Compress {
+		errors = append(
+			errors,
+			"namespace."+name+".durable_reads_only can not be used with "+
+				"compress.")
+	}
+
 	// Directory
 	if n.Directory == nil {
 		errors = append(errors, "namespace."+name+".directory is required.")
 	}
 
+	// FileMode
+	if n.FileMode == nil {
+		n.FileMode = &defaultFileMode
+	}
+	if mode, err := strconv.ParseUint(*n.FileMode, 8, 32); err != nil {
+		errors = append(
+			errors,
+			"namespace."+name+".file_mode must be an octal mode such as "+
+				"'0644'.")
+	} else if os.FileMode(mode)&^os.ModePerm != 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".file_mode can only contain permission bits.")
+	} else if os.FileMode(mode)&0600 != 0600 {
+		errors = append(
+			errors,
+			"namespace."+name+".file_mode must allow the owner to read "+
+				"and write.")
+	} else {
+		n.fileMode = os.FileMode(mode)
+	}
+
+	// HeartBeatTime
+	if n.HeartBeatTime == nil {
+		n.HeartBeatTime = &defaultHeartBeatTime
+	} else if *n.HeartBeatTime <= 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".heart_beat_time must be greater than 0.")
+	}
+
+	// HeartBeatJitter
+	if n.HeartBeatJitter == nil {
+		jitter := *n.HeartBeatTime / 10
+		n.HeartBeatJitter = &jitter
+	} else if *n.HeartBeatJitter < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".heart_beat_jitter can not be negative.")
+	} else if *n.HeartBeatJitter >= *n.HeartBeatTime/2 {
+		errors = append(
+			errors,
+			"namespace."+name+".heart_beat_jitter must be less than half "+
+				"of heart_beat_time.")
+	}
+
+	// IDEncoding
+	if n.IDEncoding == nil {
+		n.IDEncoding = &defaultIDEncoding
+	}
+	switch *n.IDEncoding {
+	case "base64":
+		n.idEncoding = fid.IDEncodingBase64
+	case "base62":
+		n.idEncoding = fid.IDEncodingBase62
+	default:
+		errors = append(
+			errors,
+			"namespace."+name+".id_encoding must be 'base64' or 'base62'.")
+	}
+
+	// IdempotencyKeyTTL
+	if n.IdempotencyKeyTTL == nil {
+		n.IdempotencyKeyTTL = &defaultIdempotencyTTL
+	} else if *n.IdempotencyKeyTTL < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".idempotency_key_ttl can not be negative.")
+	}
+
+	// IdempotencyKeyMaxEntries
+	if n.IdempotencyKeyMaxEntries == nil {
+		n.IdempotencyKeyMaxEntries = &defaultIdempotencyKeys
+	} else if *n.IdempotencyKeyMaxEntries < 1 {
+		errors = append(
+			errors,
+			"namespace."+name+".idempotency_key_max_entries must be "+
+				"greater than 0.")
+	}
+
+	// IdempotencyKeyPersist
+	if n.IdempotencyKeyPersist == nil {
+		n.IdempotencyKeyPersist = &defaultIdempotencyStore
+	}
+
+	// IdempotentReplicaInitialize
+	if n.IdempotentReplicaInitialize == nil {
+		n.IdempotentReplicaInitialize = &defaultIdempotentInit
+	}
+
 	// InsertACL
 	if n.InsertACL != nil {
 		errors = append(
@@ -216,6 +1015,90 @@ func (n *nameSpace) validate(top *top, name string) []string {
 			n.InsertACL.validate(top, name+".insert_acl")...)
 	}
 
+	// InsertLatencyBuckets
+	for _, bucket := range n.InsertLatencyBuckets {
+		d, err := time.ParseDuration(bucket)
+		if err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".insert_latency_buckets value '"+
+					bucket+"' is not valid ("+err.Error()+")")
+		} else if d <= 0 {
+			errors = append(
+				errors,
+				"namespace."+name+".insert_latency_buckets value '"+
+					bucket+"' must be greater than zero.")
+		} else if l := len(n.insertLatencyBuckets); l > 0 &&
+			d <= n.insertLatencyBuckets[l-1] {
+			errors = append(
+				errors,
+				"namespace."+name+".insert_latency_buckets must be in "+
+					"increasing order.")
+		} else {
+			n.insertLatencyBuckets = append(n.insertLatencyBuckets, d)
+		}
+	}
+
+	// InsertQueueTimeout
+	if n.InsertQueueTimeout == nil {
+		n.InsertQueueTimeout = &defaultInsertQueueWait
+	} else if *n.InsertQueueTimeout < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".insert_queue_timeout can not be negative.")
+	}
+
+	// MaxDiskUsage
+	if n.MaxDiskUsage.set {
+		if u, err := n.MaxDiskUsage.Bytes(); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".max_disk_usage "+err.Error())
+		} else if u < 1 {
+			errors = append(
+				errors,
+				"namespace."+name+".max_disk_usage must be greater than 0.")
+		} else {
+			n.maxDiskUsage = u
+		}
+	}
+
+	// MaxRecordSize
+	if n.MaxRecordSize.set {
+		if u, err := n.MaxRecordSize.Bytes(); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".max_record_size "+err.Error())
+		} else if u < 1 {
+			errors = append(
+				errors,
+				"namespace."+name+".max_record_size must be greater than 0.")
+		} else {
+			n.maxRecordSize = u
+		}
+	}
+
+	// MillisecondFIDs
+	if n.MillisecondFIDs == nil {
+		n.MillisecondFIDs = &defaultMillisecondFIDs
+	}
+
+	// ObjectStore
+	if n.ObjectStore == nil {
+		n.ObjectStore = &defaultObjectStore
+	}
+	switch *n.ObjectStore {
+	case "s3":
+	case "gcs":
+		errors = append(
+			errors,
+			"namespace."+name+".object_store 'gcs' is not implemented yet.")
+	default:
+		errors = append(
+			errors,
+			"namespace."+name+".object_store must be 's3'.")
+	}
+
 	// OpenFilesMinimum
 	if n.OpenFilesMinimum == nil {
 		n.OpenFilesMinimum = &defaultOpenFilesMinimum
@@ -234,6 +1117,73 @@ func (n *nameSpace) validate(top *top, name string) []string {
 			"greater than min_open_files.")
 	}
 
+	// OpenFilesGrowthFactor
+	if n.OpenFilesGrowthFactor == nil {
+		n.OpenFilesGrowthFactor = &defaultOpenFilesFactor
+	} else if *n.OpenFilesGrowthFactor < 1 {
+		errors = append(errors, ""+
+			"namespace."+name+".open_files_growth_factor can not be "+
+			"less than 1.")
+	}
+
+	// OpenFilesGrowthStep
+	if n.OpenFilesGrowthStep == nil {
+		n.OpenFilesGrowthStep = &defaultOpenFilesStep
+	} else if *n.OpenFilesGrowthStep < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".open_files_growth_step can not be negative.")
+	}
+
+	// OrphanGracePeriod
+	if n.OrphanGracePeriod == nil {
+		n.OrphanGracePeriod = &defaultOrphanGrace
+	} else if *n.OrphanGracePeriod < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".orphan_grace_period can not be negative.")
+	}
+
+	// ParallelCompress
+	if n.ParallelCompress != nil && *n.ParallelCompress && !*n.Compress {
+		errors = append(
+			errors,
+			"namespace."+name+".parallel_compress requires compress be "+
+				"true.")
+	} else if n.ParallelCompress == nil {
+		n.ParallelCompress = &defaultParallelCompress
+	}
+
+	// ParallelCompressWorkers
+	if n.ParallelCompressWorkers != nil && !*n.ParallelCompress {
+		errors = append(
+			errors,
+			"namespace."+name+".parallel_compress_workers requires "+
+				"parallel_compress be true.")
+	} else if n.ParallelCompressWorkers == nil {
+		n.ParallelCompressWorkers = &defaultParallelWorkers
+	} else if *n.ParallelCompressWorkers < 1 {
+		errors = append(
+			errors,
+			"namespace."+name+".parallel_compress_workers must be "+
+				"greater than 0.")
+	}
+
+	// PreallocateSize
+	if n.PreallocateSize.set {
+		if u, err := n.PreallocateSize.Bytes(); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".preallocate_size "+err.Error())
+		} else if u < 0 {
+			errors = append(
+				errors,
+				"namespace."+name+".preallocate_size can not be negative.")
+		} else {
+			n.preallocateSize = u
+		}
+	}
+
 	// PrimaryACL
 	if n.PrimaryACL != nil {
 		errors = append(
@@ -248,6 +1198,45 @@ func (n *nameSpace) validate(top *top, name string) []string {
 			n.ReadACL.validate(top, name+".read_acl")...)
 	}
 
+	// ReadCache
+	if n.ReadCache == nil {
+		n.ReadCache = &defaultReadCache
+	}
+
+	// ReadCacheMaxAge
+	if n.ReadCacheMaxAge == nil {
+		n.ReadCacheMaxAge = &defaultReadCacheMaxAge
+	} else if *n.ReadCacheMaxAge < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".read_cache_max_age can not be negative.")
+	}
+
+	// ReadCacheMaxSize
+	if !n.ReadCacheMaxSize.set {
+		n.readCacheMaxSize = defaultReadCacheMaxSize
+	} else if u, err := n.ReadCacheMaxSize.Bytes(); err != nil {
+		errors = append(
+			errors,
+			"namespace."+name+".read_cache_max_size "+err.Error())
+	} else if u < 1 {
+		errors = append(
+			errors,
+			"namespace."+name+".read_cache_max_size must be greater than 0.")
+	} else {
+		n.readCacheMaxSize = u
+	}
+
+	// ReadFromOpenFile
+	if n.ReadFromOpenFile == nil {
+		n.ReadFromOpenFile = &defaultReadOpenFile
+	}
+
+	// RecordCountMetadata
+	if n.RecordCountMetadata == nil {
+		n.RecordCountMetadata = &defaultRecordCountMeta
+	}
+
 	// Replicas
 	if n.Replicas == nil {
 		n.Replicas = &defaultReplicas
@@ -255,6 +1244,61 @@ func (n *nameSpace) validate(top *top, name string) []string {
 		errors = append(
 			errors,
 			"namespace."+name+".replicas can not be negative.")
+	} else if *n.Replicas > len(top.Remotes) {
+		errors = append(
+			errors,
+			fmt.Sprintf(
+				"namespace.%s.replicas can not be greater than the %d "+
+					"remotes configured.",
+				name,
+				len(top.Remotes)))
+	}
+
+	// ReplicaQuorum
+	if n.ReplicaQuorum == nil {
+		n.ReplicaQuorum = &defaultReplicaQuorum
+	} else if *n.ReplicaQuorum < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".replica_quorum can not be negative.")
+	} else if n.Replicas != nil && *n.ReplicaQuorum > *n.Replicas {
+		errors = append(
+			errors,
+			"namespace."+name+".replica_quorum can not be greater than "+
+				"replicas.")
+	}
+
+	// ReplicaMaxDiskUsage
+	if n.ReplicaMaxDiskUsage == nil {
+		n.ReplicaMaxDiskUsage = &defaultReplicaMaxDisk
+	} else if *n.ReplicaMaxDiskUsage < 0 || *n.ReplicaMaxDiskUsage > 1 {
+		errors = append(
+			errors,
+			"namespace."+name+".replica_max_disk_usage must be between 0 "+
+				"and 1.")
+	}
+
+	// RetainForReads
+	if n.RetainForReads == nil {
+		n.RetainForReads = &defaultRetainForReads
+	} else if *n.RetainForReads && *n.DelayDelete <= 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".retain_for_reads requires delay_delete be "+
+				"greater than zero.")
+	}
+
+	// RotateEvery
+	if n.RotateEvery == nil {
+		n.RotateEvery = &defaultRotateEvery
+	} else if *n.RotateEvery < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".rotate_every can not be negative.")
+	} else if *n.RotateEvery > 0 && *n.RotateEvery < time.Second {
+		errors = append(
+			errors,
+			"namespace."+name+".rotate_every must be at least 1 second.")
 	}
 
 	// S3Bucket
@@ -280,6 +1324,267 @@ func (n *nameSpace) validate(top *top, name string) []string {
 		}
 	}
 
+	// S3AdditionalKeyFormats
+	for _, format := range n.S3AdditionalKeyFormats {
+		f, err := fid.NewFormatter(format)
+		if err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".s3_additional_key_formats value '"+
+					format+"' is not valid ("+err.Error()+")")
+		} else {
+			n.additionalFormatters = append(n.additionalFormatters, f)
+		}
+	}
+
+	// S3KeyUploadFormat
+	if n.S3KeyUploadFormat != nil {
+		f, err := fid.NewFormatter(*n.S3KeyUploadFormat)
+		if err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".s3_key_upload_format is not valid ("+
+					err.Error()+")")
+		} else {
+			n.uploadFormatter = f
+		}
+	}
+
+	// S3PartSize
+	if !n.S3PartSize.set {
+		n.s3PartSize = defaultS3PartSize
+	} else if u, err := n.S3PartSize.Bytes(); err != nil {
+		errors = append(
+			errors,
+			"namespace."+name+".s3_part_size "+err.Error())
+	} else if u < 1024*1024*5 {
+		errors = append(
+			errors,
+			"namespace."+name+".s3_part_size can not be less than 5MB.")
+	} else {
+		n.s3PartSize = u
+	}
+
+	// S3Concurrency
+	if n.S3Concurrency == nil {
+		n.S3Concurrency = &defaultS3Concurrency
+	} else if *n.S3Concurrency < 1 {
+		errors = append(
+			errors,
+			"namespace."+name+".s3_concurrency must be greater than 0.")
+	}
+
+	// S3StorageClass
+	if n.S3StorageClass == nil {
+		n.S3StorageClass = &defaultS3StorageClass
+	} else {
+		valid := false
+		for _, class := range s3.StorageClass_Values() {
+			if class == *n.S3StorageClass {
+				valid = true
+			}
+		}
+		if !valid {
+			errors = append(
+				errors,
+				"namespace."+name+".s3_storage_class must be one of: "+
+					strings.Join(s3.StorageClass_Values(), ", "))
+		}
+	}
+
+	// S3SSE
+	if n.S3SSE == nil {
+		n.S3SSE = &defaultS3SSE
+	}
+	switch *n.S3SSE {
+	case "":
+	case s3.ServerSideEncryptionAes256:
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		errors = append(
+			errors,
+			"namespace."+name+".s3_sse must be 'AES256' or 'aws:kms'.")
+	}
+
+	// S3KMSKeyID
+	if n.S3KMSKeyID == nil {
+		n.S3KMSKeyID = &defaultS3KMSKeyID
+	} else if *n.S3SSE != s3.ServerSideEncryptionAwsKms {
+		errors = append(
+			errors,
+			"namespace."+name+".s3_kms_key_id requires s3_sse be "+
+				"'aws:kms'.")
+	}
+
+	// S3OperationTimeout
+	if n.S3OperationTimeout == nil {
+		n.S3OperationTimeout = &defaultS3OpTimeout
+	} else if *n.S3OperationTimeout < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".s3_operation_timeout can not be negative.")
+	}
+
+	// S3WarmConnections
+	if n.S3WarmConnections == nil {
+		n.S3WarmConnections = &defaultS3WarmConns
+	} else if *n.S3WarmConnections < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".s3_warm_connections can not be negative.")
+	} else if *n.S3WarmConnections > 100 {
+		errors = append(
+			errors,
+			"namespace."+name+".s3_warm_connections can not be more "+
+				"than 100.")
+	}
+
+	// ScrubInterval
+	if n.ScrubInterval == nil {
+		n.ScrubInterval = &defaultScrubInterval
+	} else if *n.ScrubInterval < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".scrub_interval can not be negative.")
+	}
+
+	// ScrubBytesPerSecond
+	if n.ScrubBytesPerSecond.set {
+		if u, err := n.ScrubBytesPerSecond.Bytes(); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".scrub_bytes_per_second "+err.Error())
+		} else if u < 0 {
+			errors = append(
+				errors,
+				"namespace."+name+".scrub_bytes_per_second can not be "+
+					"negative.")
+		} else {
+			n.scrubBytesPerSecond = u
+		}
+	}
+
+	// ScrubQuarantine
+	if n.ScrubQuarantine == nil {
+		n.ScrubQuarantine = &defaultScrubQuarantine
+	}
+
+	// ShardDirectories
+	if n.ShardDirectories == nil {
+		n.ShardDirectories = &defaultShardDirectories
+	} else if *n.ShardDirectories < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".shard_directories can not be negative.")
+	} else if *n.ShardDirectories > 256 {
+		errors = append(
+			errors,
+			"namespace."+name+".shard_directories can not be more than "+
+				"256.")
+	}
+
+	// StaleReadsOnS3Error
+	if n.StaleReadsOnS3Error == nil {
+		n.StaleReadsOnS3Error = &defaultStaleReads
+	}
+
+	// StatusUploadFailures
+	if n.StatusUploadFailures == nil {
+		n.StatusUploadFailures = &defaultStatusFailures
+	}
+
+	// SyncPolicy
+	if n.SyncPolicy == nil {
+		n.SyncPolicy = &defaultSyncPolicy
+	}
+	switch *n.SyncPolicy {
+	case storage.SyncPolicyNone:
+	case storage.SyncPolicyOnInsert:
+	case storage.SyncPolicyOnRotate:
+	default:
+		errors = append(
+			errors,
+			"namespace."+name+".sync_policy must be 'none', 'on-insert', "+
+				"or 'on-rotate'.")
+	}
+
+	// TrackReplicaLag
+	if n.TrackReplicaLag == nil {
+		n.TrackReplicaLag = &defaultTrackReplicaLag
+	}
+
+	// UnhealthyUploadFailures
+	if n.UnhealthyUploadFailures == nil {
+		n.UnhealthyUploadFailures = &defaultUnhealthyUploads
+	} else if *n.UnhealthyUploadFailures < 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".unhealthy_upload_failures can not be "+
+				"negative.")
+	}
+
+	// UploadAttempts
+	if n.UploadAttempts == nil {
+		n.UploadAttempts = &defaultUploadAttempts
+	} else if *n.UploadAttempts < 1 {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_attempts must be at least 1.")
+	}
+
+	// UploadRetryDelay
+	if n.UploadRetryDelay == nil {
+		n.UploadRetryDelay = &defaultUploadRetry
+	} else if *n.UploadRetryDelay <= 0 {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_retry_delay must be positive.")
+	}
+
+	// UploadRetryMaxDelay
+	if n.UploadRetryMaxDelay == nil {
+		n.UploadRetryMaxDelay = &defaultUploadRetryMax
+	} else if *n.UploadRetryMaxDelay < *n.UploadRetryDelay {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_retry_max_delay can not be less "+
+				"than upload_retry_delay.")
+	}
+
+	// UploadBytesPerSecond
+	if n.UploadBytesPerSecond.set {
+		if u, err := n.UploadBytesPerSecond.Bytes(); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".upload_bytes_per_second "+err.Error())
+		} else if u < 0 {
+			errors = append(
+				errors,
+				"namespace."+name+".upload_bytes_per_second can not be "+
+					"negative.")
+		} else {
+			n.uploadBytesPerSecond = u
+		}
+	}
+
+	// UploadWebhook
+	if n.UploadWebhook != nil {
+		if u, err := url.Parse(*n.UploadWebhook); err != nil {
+			errors = append(
+				errors,
+				"namespace."+name+".upload_webhook is not a valid url: "+
+					err.Error())
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errors = append(
+				errors,
+				"namespace."+name+".upload_webhook is not a http/https url.")
+		} else if u.Host == "" {
+			errors = append(
+				errors,
+				"namespace."+name+".upload_webhook requires a host.")
+		}
+	}
+
 	// UploadFileSize
 	if !n.UploadFileSize.set {
 		n.uploadFileSize = defaultUploadFileSize
@@ -295,6 +1600,38 @@ func (n *nameSpace) validate(top *top, name string) []string {
 		n.uploadFileSize = uint64(u)
 	}
 
+	// UploadFileSizeMinimum
+	if !n.UploadFileSizeMinimum.set {
+		n.uploadFileSizeMinimum = n.uploadFileSize
+	} else if u, err := n.UploadFileSizeMinimum.Bytes(); err != nil {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_file_size_minimum "+err.Error())
+	} else if u < 1 || uint64(u) > n.uploadFileSize {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_file_size_minimum must be greater "+
+				"than 0 and no larger than upload_file_size.")
+	} else {
+		n.uploadFileSizeMinimum = uint64(u)
+	}
+
+	// UploadFileSizeMaximum
+	if !n.UploadFileSizeMaximum.set {
+		n.uploadFileSizeMaximum = n.uploadFileSize
+	} else if u, err := n.UploadFileSizeMaximum.Bytes(); err != nil {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_file_size_maximum "+err.Error())
+	} else if uint64(u) < n.uploadFileSize {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_file_size_maximum can not be less "+
+				"than upload_file_size.")
+	} else {
+		n.uploadFileSizeMaximum = uint64(u)
+	}
+
 	// UploadOlder
 	if n.UploadOlder == nil {
 		n.UploadOlder = &defaultUploadOlder
@@ -304,6 +1641,46 @@ func (n *nameSpace) validate(top *top, name string) []string {
 			"namespace."+name+".upload_older must be at least 1 second.")
 	}
 
+	// UploadOlderMinimum
+	if n.UploadOlderMinimum == nil {
+		n.UploadOlderMinimum = n.UploadOlder
+	} else if *n.UploadOlderMinimum < time.Second ||
+		*n.UploadOlderMinimum > *n.UploadOlder {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_older_minimum must be at least 1 "+
+				"second and no longer than upload_older.")
+	}
+
+	// UploadOlderMaximum
+	if n.UploadOlderMaximum == nil {
+		n.UploadOlderMaximum = n.UploadOlder
+	} else if *n.UploadOlderMaximum < *n.UploadOlder {
+		errors = append(
+			errors,
+			"namespace."+name+".upload_older_maximum can not be less than "+
+				"upload_older.")
+	}
+
+	// VerifyBucketOnStart
+	if n.VerifyBucketOnStart == nil {
+		n.VerifyBucketOnStart = &defaultVerifyBucket
+	}
+
+	// VerifyCompression
+	if n.VerifyCompression == nil {
+		n.VerifyCompression = &defaultVerifyCompress
+	} else if *n.VerifyCompression && !*n.Compress {
+		errors = append(
+			errors,
+			"namespace."+name+".verify_compression requires compress be true.")
+	}
+
+	// VerifyUploadHash
+	if n.VerifyUploadHash == nil {
+		n.VerifyUploadHash = &defaultVerifyUpload
+	}
+
 	// Return any errors encountered.
 	return errors
 }
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/liquidgecka/blobby/httpserver"
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// The configuration keys that Reload() is able to apply to a running server.
+// A * matches any name space name, and every key below one of these is also
+// reloadable.
+var reloadableKeys = []string{
+	"namespace.*.blast_path_acl",
+	"namespace.*.delete_acl",
+	"namespace.*.insert_acl",
+	"namespace.*.primary_acl",
+	"namespace.*.read_acl",
+	"server.debug_paths_acl",
+	"server.health_check_acl",
+	"server.max_connection_lifetime",
+	"server.prometheus_tag_prefix",
+	"server.read_timeout",
+	"server.shut_down_acl",
+	"server.status_acl",
+	"server.write_timeout",
+}
+
+// Re-reads the configuration from the given file and applies the settings
+// that can be changed without a restart to the running server. These are
+// the server and name space ACLs, the read and write timeouts,
+// max_connection_lifetime, and prometheus_tag_prefix. Changes to anything
+// else are logged and ignored. If the new configuration is not valid then
+// an error is returned and nothing is changed.
+func (c *Config) Reload(ctx context.Context, filename string) error {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	n, err := Parse(filename)
+	if err != nil {
+		return err
+	}
+	log := c.top.Log.logger
+
+	// Log each of the changes that will not be applied. This is compared
+	// against the configuration that the server was started with so these
+	// will be logged on every reload until the server is restarted.
+	for _, key := range changedKeys("", c.raw, n.raw) {
+		if !isReloadable(key) {
+			log.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Configuration change ignored, requires restart.",
+				sloghelper.String("key", key))
+		}
+	}
+
+	// Gather all of the ACLs that will be replaced. Name spaces that do
+	// not exist in the running configuration are skipped since adding
+	// them requires a restart.
+	server := &n.top.Server
+	acls := map[string]*acl{
+		"server.debug_paths_acl":  server.DebugPathsACL,
+		"server.health_check_acl": server.HealthCheckACL,
+		"server.shut_down_acl":    server.ShutDownACL,
+		"server.status_acl":       server.StatusACL,
+	}
+	for name, ns := range n.top.NameSpace {
+		if _, ok := c.top.NameSpace[name]; !ok {
+			continue
+		}
+		prefix := "namespace." + name
+		acls[prefix+".blast_path_acl"] = ns.BlastPathACL
+		acls[prefix+".delete_acl"] = ns.DeleteACL
+		acls[prefix+".insert_acl"] = ns.InsertACL
+		acls[prefix+".primary_acl"] = ns.PrimaryACL
+		acls[prefix+".read_acl"] = ns.ReadACL
+	}
+	for name, a := range acls {
+		if err := a.prepareReload(ctx, c.top, name); err != nil {
+			return err
+		}
+	}
+
+	// Build the settings and swap them into the running server.
+	settings := &httpserver.Settings{
+		DebugPathsACL:         server.DebugPathsACL.access(),
+		HealthCheckACL:        server.HealthCheckACL.access(),
+		MaxConnectionLifetime: *server.MaxConnectionLifetime,
+		NameSpaces: make(
+			map[string]*httpserver.NameSpaceSettings,
+			len(n.top.NameSpace)),
+		PrometheusTagPrefix: *server.PrometheusTagPrefix,
+		ReadTimeout:         *server.ReadTimeout,
+		ShutDownACL:         server.ShutDownACL.access(),
+		StatusACL:           server.StatusACL.access(),
+		WriteTimeout:        *server.WriteTimeout,
+	}
+	for name, ns := range n.top.NameSpace {
+		if _, ok := c.top.NameSpace[name]; !ok {
+			continue
+		}
+		settings.NameSpaces[name] = &httpserver.NameSpaceSettings{
+			BlastPathACL: ns.BlastPathACL.access(),
+			DeleteACL:    ns.DeleteACL.access(),
+			InsertACL:    ns.InsertACL.access(),
+			PrimaryACL:   ns.PrimaryACL.access(),
+			ReadACL:      ns.ReadACL.access(),
+		}
+	}
+	if err := c.top.Server.Server().Reload(settings); err != nil {
+		return err
+	}
+
+	// Keep the secrets for the new ACLs up to date, and stop refreshing
+	// the ones from the previous reload since they are no longer used.
+	refreshCtx, cancel := context.WithCancel(ctx)
+	for _, a := range acls {
+		a.startRefresher(refreshCtx)
+	}
+	if c.reloadCancel != nil {
+		c.reloadCancel()
+	}
+	c.reloadCancel = cancel
+
+	log.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Configuration reloaded.",
+		sloghelper.String("file", filename))
+	return nil
+}
+
+// Returns the dotted path of every value that differs between the two parsed
+// configuration files, sorted so that they are logged in a stable order.
+func changedKeys(prefix string, a, b map[string]interface{}) []string {
+	var changed []string
+	for k, av := range a {
+		key := prefix + k
+		bv, ok := b[k]
+		am, aIsMap := av.(map[string]interface{})
+		bm, bIsMap := bv.(map[string]interface{})
+		switch {
+		case ok && aIsMap && bIsMap:
+			changed = append(changed, changedKeys(key+".", am, bm)...)
+		case !ok || !reflect.DeepEqual(av, bv):
+			changed = append(changed, key)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			changed = append(changed, prefix+k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Returns true if the given dotted key is at or below one of the keys in
+// reloadableKeys.
+func isReloadable(key string) bool {
+	parts := strings.Split(key, ".")
+	for _, r := range reloadableKeys {
+		pattern := strings.Split(r, ".")
+		if len(parts) < len(pattern) {
+			continue
+		}
+		match := true
+		for i, p := range pattern {
+			if p != "*" && p != parts[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -52,6 +52,13 @@ type remote struct {
 	// allowed. If not set this defaults to 100.
 	MaxIdleConns *int `toml:"max_idle_conns"`
 
+	// The failure domain, such as the rack or availability zone, that this
+	// remote is in. When set the replicas for each file are placed in
+	// different zones where possible so that losing a single zone does
+	// not lose every copy of the data. Remotes without a zone can be
+	// assigned alongside any other remote.
+	Zone *string `toml:"zone"`
+
 	// A reference to the top of the config file. Needed so we can get
 	// back to the list of all remotes configured.
 	top *top
@@ -81,11 +88,16 @@ func (r *remote) Remote() storage.Remote {
 	if *r.TLS {
 		useS = "s"
 	}
+	zone := ""
+	if r.Zone != nil {
+		zone = *r.Zone
+	}
 	return &remotes.Remote{
 		Client: client,
 		ID:     *r.ID,
 		Name:   *r.Name,
 		URL:    fmt.Sprintf("http%s://%s:%d", useS, *r.Host, r.port),
+		Zone:   zone,
 	}
 }
 
@@ -161,6 +173,11 @@ func (r *remote) validate(t *top) []string {
 			"remotes.max_idle_conns must be 0 or greater.")
 	}
 
+	// Zone
+	if r.Zone != nil && *r.Zone == "" {
+		errors = append(errors, "remotes.zone can not be empty.")
+	}
+
 	// Return any errors encountered.
 	return errors
 }
@@ -21,11 +21,13 @@ var (
 	defaultDebugPathsEnable    = false
 	defaultEnableTracing       = false
 	defaultIdleTimeout         = time.Minute * 5
+	defaultMaxConnLifetime     = time.Duration(0)
 	defaultMaxHeaderBytes      = int(1 << 20)
 	defaultPort                = 1091
 	defaultPrometheusTagPrefix = ""
 	defaultReadHeaderTimeout   = time.Minute
 	defaultReadTimeout         = time.Minute
+	defaultShutDownGracePeriod = time.Minute
 	defaultTLS                 = false
 	defaultWebAuthCookieName   = "ba"
 	defaultWebLoginDuration    = time.Hour * 24
@@ -66,6 +68,10 @@ type server struct {
 	Port value `toml:"port"`
 	port int
 
+	// Additional endpoints to listen on, for example an IPv6 address for
+	// replication or a Unix socket for local tooling.
+	Listeners []*listener `toml:"listener"`
+
 	// The Host name that this Blobby server will report back as. This is
 	// primarily used for any situation where a full return URL needs to
 	// be generated.
@@ -86,6 +92,18 @@ type server struct {
 	WriteTimeout      *time.Duration `toml:"write_timeout"`
 	IdleTimeout       *time.Duration `toml:"idle_timeout"`
 
+	// The maximum amount of time that a client connection will be kept open.
+	// Once a connection is older than this the server will add a
+	// "Connection: close" header to the next response, forcing the client
+	// to reconnect. Zero (the default) disables this.
+	MaxConnectionLifetime *time.Duration `toml:"max_connection_lifetime"`
+
+	// When the server receives a SIGTERM it drains every namespace and then
+	// waits up to this long for the pending files to be uploaded before it
+	// stops listening and exits. This should be shorter than the time the
+	// process supervisor waits before killing the process.
+	ShutDownGracePeriod *time.Duration `toml:"shut_down_grace_period"`
+
 	// The prefix for the namespace= tag; a value of blobby_ for this field
 	// would give blobby_namespace as the tag key in the rendered Prometheus
 	// metrics.
@@ -107,7 +125,8 @@ type server struct {
 	// Controls who has access to the /_status endpoint.
 	StatusACL *acl `toml:"status_acl"`
 
-	// Controls who has access to the /_shutdown endpoint.
+	// Controls who has access to the /_shutdown endpoint, as well as the
+	// /_flush, /_readonly and /_reupload endpoints.
 	ShutDownACL *acl `toml:"shut_down_acl"`
 
 	// The access log configuration.
@@ -222,24 +241,32 @@ func (s *server) Server() httpserver.Server {
 		logger := s.top.Log.logger.With(
 			sloghelper.String("component", "http-server"),
 		)
+		listeners := make([]httpserver.ListenerSettings, len(s.Listeners))
+		for i, l := range s.Listeners {
+			listeners[i] = l.settings()
+		}
 		settings := &httpserver.Settings{
-			Addr:                s.Addr.String(),
-			DebugPathsACL:       s.DebugPathsACL.access(),
-			EnableDebugPaths:    s.debugging(),
-			EnableTracing:       *s.EnableTracing,
-			HealthCheckACL:      s.HealthCheckACL.access(),
-			IdleTimeout:         *s.IdleTimeout,
-			Logger:              logger,
-			MaxHeaderBytes:      s.maxHeaderBytes,
-			NameSpaces:          nss,
-			Port:                s.port,
-			PrometheusTagPrefix: *s.PrometheusTagPrefix,
-			ReadTimeout:         *s.ReadTimeout,
-			SAMLAuth:            samlMap,
-			ShutDownACL:         s.ShutDownACL.access(),
-			StatusACL:           s.StatusACL.access(),
-			TLSCerts:            s.tlsCerts,
-			WriteTimeout:        *s.WriteTimeout,
+			Addr:                  s.Addr.String(),
+			DebugPathsACL:         s.DebugPathsACL.access(),
+			EnableDebugPaths:      s.debugging(),
+			EnableTracing:         *s.EnableTracing,
+			HealthCheckACL:        s.HealthCheckACL.access(),
+			IdleTimeout:           *s.IdleTimeout,
+			Listeners:             listeners,
+			Logger:                logger,
+			MachineID:             *s.top.MachineID,
+			MaxConnectionLifetime: *s.MaxConnectionLifetime,
+			MaxHeaderBytes:        s.maxHeaderBytes,
+			NameSpaces:            nss,
+			Port:                  s.port,
+			PrometheusTagPrefix:   *s.PrometheusTagPrefix,
+			ReadTimeout:           *s.ReadTimeout,
+			SAMLAuth:              samlMap,
+			ShutDownACL:           s.ShutDownACL.access(),
+			ShutDownGracePeriod:   *s.ShutDownGracePeriod,
+			StatusACL:             s.StatusACL.access(),
+			TLSCerts:              s.tlsCerts,
+			WriteTimeout:          *s.WriteTimeout,
 		}
 		if s.webUsersHTPasswd != nil {
 			settings.WebAuthProvider = s.WebAuthProvider()
@@ -397,6 +424,13 @@ func (s *server) validate(t *top) []string {
 		}
 	}
 
+	// Listeners
+	for i, l := range s.Listeners {
+		errors = append(
+			errors,
+			l.validate(t, fmt.Sprintf("server.listener[%d]", i))...)
+	}
+
 	// ReadTimeout
 	if s.ReadTimeout == nil {
 		s.ReadTimeout = &defaultReadTimeout
@@ -427,6 +461,29 @@ func (s *server) validate(t *top) []string {
 		errors = append(errors, "server.idle_timeout must be larger than 1s.")
 	}
 
+	// MaxConnectionLifetime
+	if s.MaxConnectionLifetime == nil {
+		s.MaxConnectionLifetime = &defaultMaxConnLifetime
+	} else if *s.MaxConnectionLifetime < 0 {
+		errors = append(
+			errors,
+			"server.max_connection_lifetime can not be negative.")
+	} else if *s.MaxConnectionLifetime != 0 &&
+		*s.MaxConnectionLifetime < time.Second {
+		errors = append(
+			errors,
+			"server.max_connection_lifetime must be larger than 1s.")
+	}
+
+	// ShutDownGracePeriod
+	if s.ShutDownGracePeriod == nil {
+		s.ShutDownGracePeriod = &defaultShutDownGracePeriod
+	} else if *s.ShutDownGracePeriod < 0 {
+		errors = append(
+			errors,
+			"server.shut_down_grace_period can not be negative.")
+	}
+
 	// MaxHeaderBytes
 	if !s.MaxHeaderBytes.set {
 		s.maxHeaderBytes = defaultMaxHeaderBytes
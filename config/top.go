@@ -8,15 +8,18 @@ import (
 	"github.com/liquidgecka/blobby/httpserver/remotes"
 	"github.com/liquidgecka/blobby/httpserver/secretloader"
 	"github.com/liquidgecka/blobby/internal/delayqueue"
+	"github.com/liquidgecka/blobby/internal/semaphore"
 	"github.com/liquidgecka/blobby/internal/workqueue"
 	"github.com/liquidgecka/blobby/storage"
 )
 
 var (
+	defaultMaxConcurrentUploads         = int(0)
 	defaultMaximumParallelCompressions  = int(10)
 	defaultMaximumParallelUploads       = int(10)
 	defaultMaximumParallelLocalDeletes  = int(10)
 	defaultMaximumParallelRemoteDeletes = int(10)
+	defaultMaximumParallelStarts        = int(1)
 )
 
 type top struct {
@@ -39,6 +42,20 @@ type top struct {
 	// The unique, system wide machine ID for this machine.
 	MachineID *uint32 `toml:"machine_id"`
 
+	// The failure domain, such as the rack or availability zone, that this
+	// machine is in. This is compared against the zone of each remote so
+	// that replicas are placed outside of this machine's zone where
+	// possible, since losing the zone would otherwise lose the primary copy
+	// and the replica together.
+	Zone *string `toml:"zone"`
+
+	// The maximum number of uploads to S3 that can be in progress at once
+	// across every name space. Unlike maximum_parallel_uploads this only
+	// covers the transfer itself, so a slot is not held while hashing or
+	// verifying a file or while backing off before a retry. Zero means
+	// there is no limit.
+	MaxConcurrentUploads *int `toml:"max_concurrent_uploads"`
+
 	// The maximum number of parallel compression operations that can be
 	// run at a single time. Setting this too low can cause file uploads
 	// to back log as compressions get run, but setting it to high might
@@ -55,6 +72,13 @@ type top struct {
 	// backlogged and may cause the disk to fill up.
 	MaximumParallelRemoteDeletes *int `toml:"maximum_parallel_remote_deletes"`
 
+	// The maximum number of name spaces that are allowed to perform their
+	// startup recovery (scanning the directory and queuing uploads for
+	// existing files) at the same time. The default of 1 starts them one at
+	// a time and zero means there is no limit. Either way no more name
+	// spaces are started once one has failed.
+	MaximumParallelStarts *int `toml:"maximum_parallel_starts"`
+
 	// Maximum number of parallel uploads that the process is allowed to
 	// perform regardless of which uploader initiates the upload.
 	MaximumParallelUploads *int `toml:"maximum_parallel_uploads"`
@@ -85,6 +109,10 @@ type top struct {
 	// A work queue used for processing upload events.
 	uploadWorkQueue *workqueue.WorkQueue
 
+	// Limits the number of uploads to S3 running at once across all name
+	// spaces.
+	uploadSemaphore *semaphore.Semaphore
+
 	// A work queue used for processing of deletes of remotes data.
 	deleteRemotesWorkQueue *workqueue.WorkQueue
 
@@ -153,6 +181,13 @@ func (t *top) getProfiles() secretloader.Profiles {
 	return t.profiles
 }
 
+func (t *top) getUploadSemaphore() *semaphore.Semaphore {
+	if t.uploadSemaphore == nil {
+		t.uploadSemaphore = semaphore.New(*t.MaxConcurrentUploads)
+	}
+	return t.uploadSemaphore
+}
+
 func (t *top) getUploadWorkQueue() *workqueue.WorkQueue {
 	if t.uploadWorkQueue == nil {
 		t.uploadWorkQueue = workqueue.New(*t.MaximumParallelUploads)
@@ -189,6 +224,17 @@ func (t *top) validate() []string {
 				minRemotes = *t.NameSpace[name].Replicas
 			}
 		}
+
+		// Every namespace needs a directory to itself, otherwise the files
+		// written by one would be recovered as replicas by the other when
+		// the server starts.
+		dirs := make(map[string]string, len(t.NameSpace))
+		for name, ns := range t.NameSpace {
+			if ns.Directory != nil {
+				dirs[name] = *ns.Directory
+			}
+		}
+		errors = append(errors, sharedDirectories(dirs)...)
 	}
 
 	// Ensure that a pool is setup and assigned. This will get referenced
@@ -228,6 +274,7 @@ func (t *top) validate() []string {
 						id,
 						*r.ID))
 			}
+			seen[*r.ID] = id
 		}
 	}
 
@@ -250,6 +297,29 @@ func (t *top) validate() []string {
 	// MachineID
 	if t.MachineID == nil {
 		errors = append(errors, "machine_id is a required value.")
+	} else {
+		for _, r := range t.Remotes {
+			switch {
+			case r.ID == nil || r.Name == nil:
+			case *r.ID == *t.MachineID:
+				errors = append(
+					errors,
+					fmt.Sprintf(""+
+						"remote %s can not share machine_id %d with "+
+						"this server.",
+						*r.Name,
+						*r.ID))
+			}
+		}
+	}
+
+	// MaxConcurrentUploads
+	if t.MaxConcurrentUploads == nil {
+		t.MaxConcurrentUploads = &defaultMaxConcurrentUploads
+	} else if *t.MaxConcurrentUploads < 0 {
+		errors = append(
+			errors,
+			"max_concurrent_uploads can not be negative.")
 	}
 
 	// MaximumParallelCompressions
@@ -288,6 +358,15 @@ func (t *top) validate() []string {
 			"maximum_parallel_remote_deletes can not be less than 1.")
 	}
 
+	// MaximumParallelStarts
+	if t.MaximumParallelStarts == nil {
+		t.MaximumParallelStarts = &defaultMaximumParallelStarts
+	} else if *t.MaximumParallelStarts < 0 {
+		errors = append(
+			errors,
+			"maximum_parallel_starts can not be negative.")
+	}
+
 	// Log
 	errors = append(errors, t.Log.validate(t, "log")...)
 
@@ -309,6 +388,15 @@ func (t *top) validate() []string {
 		}
 	}
 
+	// Zone
+	if t.Zone != nil {
+		if *t.Zone == "" {
+			errors = append(errors, "zone can not be empty.")
+		} else {
+			t.remotePool.Zone = *t.Zone
+		}
+	}
+
 	// Return any errors found.
 	return errors
 }
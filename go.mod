@@ -6,6 +6,7 @@ require (
 	bou.ke/monkey v1.0.2
 	github.com/aws/aws-sdk-go v1.49.23
 	github.com/crewjam/saml v0.4.5
+	github.com/klauspost/compress v1.17.4
 	github.com/liquidgecka/testlib v1.0.0
 	github.com/minio/highwayhash v1.0.2
 	github.com/pelletier/go-toml v1.9.5
@@ -27,6 +27,19 @@ type ACL struct {
 	// in order for a request to flow through this resource. If this is not
 	// defined then only Required will be used.
 	Any []Method
+
+	// The name of the ACL in the configuration. This is used to identify
+	// the ACL in metrics.
+	Name string
+
+	// If set then requests that pass the ACL are also rate limited.
+	RateLimit *RateLimit
+}
+
+// Methods that can identify the client that passed them implement this so
+// that rate limits can be applied per user rather than per IP.
+type identifier interface {
+	identity(*request.Request) string
 }
 
 // Checks a given Request and sees if it should be allowed.
@@ -36,10 +49,12 @@ func (a *ACL) Assert(ir *request.Request) {
 	}
 
 	// Walk the required checks and make sure that they all are valid.
+	var passed []Method
 	for _, r := range a.Required {
 		if !r.check(ir) {
 			r.assert(ir)
 		}
+		passed = append(passed, r)
 	}
 
 	// If there are 'Any' checks defined then we need to make sure that
@@ -48,12 +63,27 @@ func (a *ACL) Assert(ir *request.Request) {
 		func() {
 			for _, a := range a.Any {
 				if a.check(ir) {
+					passed = append(passed, a)
 					return
 				}
 			}
 			a.Any[0].assert(ir)
 		}()
 	}
+
+	// Apply the rate limit using the identity from the first method that
+	// can provide one.
+	if a.RateLimit != nil {
+		client := ""
+		for _, m := range passed {
+			if i, ok := m.(identifier); ok {
+				if client = i.identity(ir); client != "" {
+					break
+				}
+			}
+		}
+		a.RateLimit.assert(ir, client)
+	}
 }
 
 // When proxying a request forward to a different blobby server this
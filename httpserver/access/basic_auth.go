@@ -35,6 +35,14 @@ func (b *BasicAuth) check(ir *request.Request) bool {
 	}
 }
 
+// Returns the user name given, this is only called once check has passed.
+func (b *BasicAuth) identity(ir *request.Request) string {
+	if user, _, ok := ir.Request.BasicAuth(); ok {
+		return "user:" + user
+	}
+	return ""
+}
+
 func (b *BasicAuth) assert(ir *request.Request) {
 	realm := b.Realm
 	if len(realm) == 0 {
@@ -0,0 +1,129 @@
+package access
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liquidgecka/blobby/httpserver/request"
+)
+
+// The default for RateLimit.MaxClients.
+const defaultRateLimitMaxClients = 10000
+
+// Limits the rate at which each client can make requests that pass an ACL
+// using a token bucket per client. Clients are identified by the user name
+// if they authenticated with basic auth, otherwise by their IP address.
+// Requests over the limit are refused with a 429.
+type RateLimit struct {
+	// The number of requests per second that each client is allowed to
+	// make, and the number that can be made in a burst.
+	RequestsPerSecond float64
+	Burst             int
+
+	// The most clients that will be tracked at once. Clients that have not
+	// made a request recently enough to have used any of their burst are
+	// forgotten first, followed by the least recently seen. Defaults to
+	// 10000.
+	MaxClients int
+
+	// Allow the following IPs to set the client IP via the X-Forwarded-For
+	// header. This should match the list given to WhiteList.
+	AllowXForwardedForFrom []net.IPNet
+
+	// The number of requests that have been refused.
+	Throttled int64
+
+	lock    sync.Mutex
+	clients map[string]*rateLimitBucket
+}
+
+// The state kept for each client.
+type rateLimitBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refuses the request if the client has made too many requests.
+func (r *RateLimit) assert(ir *request.Request, client string) {
+	if client == "" {
+		client = "ip:" + remoteIP(ir.Request, r.AllowXForwardedForFrom)
+	}
+	wait, ok := r.allow(client, time.Now())
+	if ok {
+		return
+	}
+	atomic.AddInt64(&r.Throttled, 1)
+	ir.Header().Set(
+		"Retry-After",
+		strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	panic(&request.HTTPError{
+		Status:   http.StatusTooManyRequests,
+		Response: "Too many requests.",
+	})
+}
+
+// Takes a token from the bucket for client. If there are no tokens left
+// then this returns false along with how long it will be until the next
+// token is available.
+func (r *RateLimit) allow(client string, now time.Time) (time.Duration, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, ok := r.clients[client]
+	if !ok {
+		if r.clients == nil {
+			r.clients = make(map[string]*rateLimitBucket)
+		}
+		r.evict(now)
+		b = &rateLimitBucket{tokens: float64(r.Burst), last: now}
+		r.clients[client] = b
+	} else {
+		b.tokens = r.refill(b, now)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / r.RequestsPerSecond
+		return time.Duration(wait * float64(time.Second)), false
+	}
+	b.tokens -= 1
+	return 0, true
+}
+
+// Returns the number of tokens that b would have at now.
+func (r *RateLimit) refill(b *rateLimitBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*r.RequestsPerSecond
+	if tokens > float64(r.Burst) {
+		tokens = float64(r.Burst)
+	}
+	return tokens
+}
+
+// Makes room for a new client if MaxClients are already tracked. A client
+// whose bucket has refilled is no different from one that has never been
+// seen so those are all dropped, if that does not free up space then the
+// client that was seen the longest ago is dropped.
+func (r *RateLimit) evict(now time.Time) {
+	max := r.MaxClients
+	if max <= 0 {
+		max = defaultRateLimitMaxClients
+	}
+	if len(r.clients) < max {
+		return
+	}
+	oldest := ""
+	for client, b := range r.clients {
+		if r.refill(b, now) >= float64(r.Burst) {
+			delete(r.clients, client)
+		} else if oldest == "" || b.last.Before(r.clients[oldest].last) {
+			oldest = client
+		}
+	}
+	if len(r.clients) >= max {
+		delete(r.clients, oldest)
+	}
+}
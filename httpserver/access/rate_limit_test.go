@@ -0,0 +1,122 @@
+package access
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/httpserver/request"
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+func TestRateLimit_Allow(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := &RateLimit{RequestsPerSecond: 2, Burst: 3}
+	now := time.Now()
+
+	// The burst is available immediately, then the client has to wait for
+	// the bucket to refill.
+	for i := 0; i < 3; i++ {
+		_, ok := r.allow("a", now)
+		T.Equal(ok, true)
+	}
+	wait, ok := r.allow("a", now)
+	T.Equal(ok, false)
+	T.Equal(wait, time.Millisecond*500)
+
+	// Other clients are not effected.
+	_, ok = r.allow("b", now)
+	T.Equal(ok, true)
+
+	// Half a second later one more request is allowed.
+	now = now.Add(time.Millisecond * 500)
+	_, ok = r.allow("a", now)
+	T.Equal(ok, true)
+	_, ok = r.allow("a", now)
+	T.Equal(ok, false)
+}
+
+func TestRateLimit_Evict(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := &RateLimit{RequestsPerSecond: 1, Burst: 2, MaxClients: 2}
+	now := time.Now()
+	r.allow("a", now)
+	r.allow("b", now.Add(time.Millisecond))
+
+	// Neither bucket has refilled so the client seen the longest ago is
+	// dropped.
+	r.allow("c", now.Add(time.Millisecond*2))
+	T.Equal(len(r.clients), 2)
+	_, ok := r.clients["a"]
+	T.Equal(ok, false)
+
+	// Once the buckets refill they are all dropped.
+	r.allow("d", now.Add(time.Second*5))
+	T.Equal(len(r.clients), 1)
+	_, ok = r.clients["d"]
+	T.Equal(ok, true)
+}
+
+func TestACL_Assert_RateLimit(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	a := &ACL{
+		RateLimit: &RateLimit{
+			RequestsPerSecond: 0.5,
+			Burst:             1,
+			AllowXForwardedForFrom: []net.IPNet{
+				makeIPNet("10.0.0.0/8"),
+			},
+		},
+	}
+	newRequest := func(addr, xff string) *request.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		ir := request.New(
+			httptest.NewRecorder(),
+			req,
+			slog.New(sloghelper.DiscardHandler{}))
+		return &ir
+	}
+
+	// The second request from the same IP is refused.
+	a.Assert(newRequest("1.1.1.1:1000", ""))
+	ir := newRequest("1.1.1.1:1001", "")
+	T.ExpectPanic(
+		func() { a.Assert(ir) },
+		&request.HTTPError{
+			Status:   http.StatusTooManyRequests,
+			Response: "Too many requests.",
+		})
+	T.Equal(ir.Header().Get("Retry-After"), "2")
+	T.Equal(a.RateLimit.Throttled, int64(1))
+
+	// X-Forwarded-For is only trusted from the allowed CIDRs.
+	a.Assert(newRequest("10.0.0.1:1000", "2.2.2.2"))
+	T.ExpectPanic(
+		func() { a.Assert(newRequest("10.0.0.1:1000", "2.2.2.2")) },
+		&request.HTTPError{
+			Status:   http.StatusTooManyRequests,
+			Response: "Too many requests.",
+		})
+	T.ExpectPanic(
+		func() { a.Assert(newRequest("1.1.1.1:1000", "3.3.3.3")) },
+		&request.HTTPError{
+			Status:   http.StatusTooManyRequests,
+			Response: "Too many requests.",
+		})
+	T.Equal(a.RateLimit.Throttled, int64(3))
+}
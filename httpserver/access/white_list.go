@@ -22,23 +22,7 @@ type WhiteList struct {
 
 // Checks a given request and sees if it should be allowed.
 func (w *WhiteList) check(ir *request.Request) bool {
-	ipStr, _, err := net.SplitHostPort(ir.Request.RemoteAddr)
-	if err != nil {
-		// Any error returned from this function would be a code error or
-		// major change to the golang library since the http.Server
-		// implementation always set RemoteAddr to IP:Port.
-		panic(err)
-	}
-	ip := net.ParseIP(ipStr)
-	if xff := ir.Request.Header.Get("X-Forwarded-For"); xff != "" {
-		for _, ipnet := range w.AllowXForwardedForFrom {
-			if ipnet.Contains(ip) {
-				ipStr = xff
-				ip = net.ParseIP(xff)
-				break
-			}
-		}
-	}
+	ip := net.ParseIP(remoteIP(ir.Request, w.AllowXForwardedForFrom))
 	for _, ipnet := range w.CIDRs {
 		if ipnet.Contains(ip) {
 			return true
@@ -60,3 +44,25 @@ func (w *WhiteList) proxy(source, dest *http.Request) {
 		dest.Header.Set("X-Forwarded-For", ipStr)
 	}
 }
+
+// Returns the IP address of the client that made the request. If the request
+// came from an IP in allowXFF then the X-Forwarded-For header is used
+// instead.
+func remoteIP(r *http.Request, allowXFF []net.IPNet) string {
+	ipStr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Any error returned from this function would be a code error or
+		// major change to the golang library since the http.Server
+		// implementation always set RemoteAddr to IP:Port.
+		panic(err)
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		ip := net.ParseIP(ipStr)
+		for _, ipnet := range allowXFF {
+			if ipnet.Contains(ip) {
+				return xff
+			}
+		}
+	}
+	return ipStr
+}
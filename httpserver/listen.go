@@ -0,0 +1,72 @@
+package httpserver
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// A listener that the server is serving on along with whether or not
+// connections to it should be wrapped in TLS.
+type listener struct {
+	net.Listener
+	tls bool
+}
+
+// Starts listening on the given endpoint.
+func listen(endpoint ListenerSettings) (net.Listener, error) {
+	if endpoint.Network != "unix" {
+		return net.Listen(endpoint.Network, endpoint.Address)
+	}
+
+	// A socket left behind by a previous run would cause the listen to
+	// fail. Since the primary address has already been listened on by the
+	// time this is called no other instance can be using it so it is safe
+	// to remove. Anything that is not a socket is left alone.
+	if fi, err := os.Lstat(endpoint.Address); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, &net.OpError{
+				Op:  "listen",
+				Net: endpoint.Network,
+				Err: errors.New(endpoint.Address + " exists and is not a socket"),
+			}
+		} else if err := os.Remove(endpoint.Address); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen(endpoint.Network, endpoint.Address)
+	if err != nil {
+		return nil, err
+	}
+	return unixListener{Listener: l}, nil
+}
+
+// Unix sockets do not have a remote address that the ACLs can check, and
+// the http.Server would report an empty RemoteAddr. Since only processes on
+// the local machine can connect to them the connections are reported as
+// coming from the loopback address instead, allowing local admin tooling to
+// pass the default localhost only ACLs.
+type unixListener struct {
+	net.Listener
+}
+
+// The address that all unix socket connections are reported as coming from.
+var unixRemoteAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+func (u unixListener) Accept() (net.Conn, error) {
+	conn, err := u.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{Conn: conn}, nil
+}
+
+// A unix socket connection that reports its remote address as loopback.
+type unixConn struct {
+	net.Conn
+}
+
+func (u unixConn) RemoteAddr() net.Addr {
+	return unixRemoteAddr
+}
@@ -18,6 +18,8 @@ type readConfig struct {
 	length    uint32
 	machine   uint32
 	localOnly bool
+	durable   bool
+	gzip      bool
 	logger    *slog.Logger
 	acl       *access.ACL
 	request   *http.Request
@@ -55,6 +57,14 @@ func (r *readConfig) LocalOnly() bool {
 	return r.localOnly
 }
 
+func (r *readConfig) DurableOnly() bool {
+	return r.durable
+}
+
+func (r *readConfig) AcceptGzip() bool {
+	return r.gzip
+}
+
 func (r *readConfig) Logger() *slog.Logger {
 	return r.logger
 }
@@ -0,0 +1,41 @@
+package remotes
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Tracks the disk usage that a remote has reported for each name space in
+// the responses to INITIALIZE and HEARTBEAT requests. Reports never expire,
+// the last one is kept until the remote sends a newer one. A remote that is
+// too full to be assigned replicas stops receiving heart beats for the name
+// space so expiring its report would make it look empty and get it
+// assigned again.
+type diskUsages struct {
+	lock    sync.Mutex
+	reports map[string]float64
+}
+
+// Records the disk usage in the Disk-Used header of resp, if present.
+func (d *diskUsages) record(namespace string, resp *http.Response) {
+	used, err := strconv.ParseFloat(resp.Header.Get("Disk-Used"), 64)
+	if err != nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.reports == nil {
+		d.reports = make(map[string]float64)
+	}
+	d.reports[namespace] = used
+}
+
+// Returns the most recently reported disk usage for namespace. This returns
+// false if the remote has never reported it.
+func (d *diskUsages) get(namespace string) (float64, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	used, ok := d.reports[namespace]
+	return used, ok
+}
@@ -0,0 +1,33 @@
+package remotes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestDiskUsages(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	d := diskUsages{}
+	_, ok := d.get("ns")
+	T.Equal(ok, false)
+
+	// The last report is kept until a newer one replaces it, responses
+	// without one do not clear it.
+	resp := &http.Response{Header: http.Header{"Disk-Used": {"0.5"}}}
+	d.record("ns", resp)
+	d.record("ns", &http.Response{Header: http.Header{}})
+	used, ok := d.get("ns")
+	T.Equal(ok, true)
+	T.Equal(used, 0.5)
+	resp.Header.Set("Disk-Used", "0.75")
+	d.record("ns", resp)
+	used, ok = d.get("ns")
+	T.Equal(ok, true)
+	T.Equal(used, 0.75)
+	_, ok = d.get("other")
+	T.Equal(ok, false)
+}
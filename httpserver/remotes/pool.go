@@ -1,8 +1,11 @@
 package remotes
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/liquidgecka/blobby/storage"
@@ -25,11 +28,40 @@ type Pool struct {
 	NextRemote     int
 	NextRemoteLock sync.Mutex
 
+	// The failure domain that this server is in. This is treated as already
+	// used when spreading replicas across failure domains so that remotes
+	// in other domains are preferred over those sharing a domain with the
+	// primary.
+	Zone string
+
 	// FIXME: Add support for health checks?
 }
 
 // Picks a list of Remotes that should be used for a new master file.
 func (p *Pool) AssignRemotes(r int) ([]storage.Remote, error) {
+	return p.assignRemotes("", 0, r)
+}
+
+// Returns a function suitable for storage.Settings.AssignRemotes that
+// prefers remotes reporting the most free disk space for namespace. Remotes
+// that report using at least maxDiskUsage (a fraction from 0 to 1) of their
+// disk are not assigned at all, zero disables this check. If any remote has
+// not reported its usage then the remotes are assigned round robin as
+// AssignRemotes does.
+func (p *Pool) AssignRemotesFor(
+	namespace string,
+	maxDiskUsage float64,
+) func(int) ([]storage.Remote, error) {
+	return func(r int) ([]storage.Remote, error) {
+		return p.assignRemotes(namespace, maxDiskUsage, r)
+	}
+}
+
+func (p *Pool) assignRemotes(
+	namespace string,
+	maxDiskUsage float64,
+	r int,
+) ([]storage.Remote, error) {
 	// If r is zero then return nil, no point doing any work. If r is
 	// greater than 0 and there are no Remotes assigned then error out.
 	if r == 0 {
@@ -43,20 +75,89 @@ func (p *Pool) AssignRemotes(r int) ([]storage.Remote, error) {
 
 	// We need to pick remotes randomly. In order to do this efficiently
 	// we just sort the Remotes and then do a "round robin" approach to
-	// items, bubbling each item to the rear of the list.
-	remotes := make([]storage.Remote, 0, r)
+	// items, bubbling each item to the rear of the list. Every remote is
+	// gathered in that order so that full remotes can be skipped.
+	candidates := make([]storage.Remote, 0, len(p.Remotes))
 	func() {
 		p.NextRemoteLock.Lock()
 		defer p.NextRemoteLock.Unlock()
-		for i := 0; i < r; i++ {
-			remotes = append(remotes, p.Remotes[p.NextRemote])
-			p.NextRemote = (p.NextRemote + 1) % len(p.Remotes)
+		for i := range p.Remotes {
+			candidates = append(
+				candidates,
+				p.Remotes[(p.NextRemote+i)%len(p.Remotes)])
 		}
+		p.NextRemote = (p.NextRemote + r) % len(p.Remotes)
 	}()
+	if namespace == "" {
+		return spreadDomains(p.Zone, candidates, r), nil
+	}
+
+	// Drop the remotes that are too full, and if every remote reported
+	// its usage then order the rest by it. Usage is compared in whole
+	// percents so that remotes with about the same usage are still used
+	// round robin.
+	remotes := make([]storage.Remote, 0, len(candidates))
+	percents := make(map[storage.Remote]int, len(candidates))
+	known := true
+	for _, c := range candidates {
+		d, ok := c.(interface {
+			DiskUsage(string) (float64, bool)
+		})
+		var used float64
+		if ok {
+			used, ok = d.DiskUsage(namespace)
+		}
+		if !ok {
+			known = false
+		} else if maxDiskUsage > 0 && used >= maxDiskUsage {
+			continue
+		}
+		percents[c] = int(used * 100)
+		remotes = append(remotes, c)
+	}
+	if known {
+		sort.SliceStable(remotes, func(i, j int) bool {
+			return percents[remotes[i]] < percents[remotes[j]]
+		})
+	}
 	if len(remotes) < r {
-		return nil, fmt.Errorf("There are not enough replicas to assign.")
+		return nil, fmt.Errorf(
+			"There are not enough remotes with free disk space to assign "+
+				"%d replicas.",
+			r)
+	}
+	return spreadDomains(p.Zone, remotes, r), nil
+}
+
+// Picks r of the given remotes, preferring them in the order given, while
+// placing no more than one in each failure domain where possible. The
+// local zone counts as already used. If there are not enough failure
+// domains then the rest are filled in order. Remotes without a failure
+// domain never conflict with each other.
+func spreadDomains(
+	zone string,
+	remotes []storage.Remote,
+	r int,
+) []storage.Remote {
+	picked := make([]storage.Remote, 0, r)
+	used := make(map[string]bool, r+1)
+	if zone != "" {
+		used[zone] = true
 	}
-	return remotes, nil
+	skipped := make([]storage.Remote, 0, len(remotes))
+	for _, remote := range remotes {
+		if len(picked) == r {
+			break
+		}
+		domain := storage.FailureDomain(remote)
+		if domain != "" && used[domain] {
+			skipped = append(skipped, remote)
+			continue
+		}
+		used[domain] = true
+		picked = append(picked, remote)
+	}
+	return append(picked, skipped[:r-len(picked)]...)
 }
 
 // When a HTTP caller performs a GET against a token it will be processed
@@ -67,13 +168,90 @@ func (p *Pool) AssignRemotes(r int) ([]storage.Remote, error) {
 // look it up locally and if its not present return an 404 error. However
 // in order to do that properly we need to be able to pass context from the
 // HTTP request that started this operation.
-func (p *Pool) Read(rc storage.ReadConfig) (io.ReadCloser, error) {
+func (p *Pool) Read(
+	ctx context.Context,
+	rc storage.ReadConfig,
+) (
+	io.ReadCloser,
+	error,
+) {
 	// Check to see if the given machine id exists in the pool and if so
 	// attempts to call it to perform an operation, otherwise this will
 	// return an error.
 	if r, ok := p.RemotesByMachineID[rc.Machine()]; !ok {
 		return nil, fmt.Errorf("There is no machine with id %d", rc.Machine())
 	} else {
-		return r.Read(rc)
+		return r.Read(ctx, rc)
+	}
+}
+
+// Like Read except that the remote that created the file is only asked if
+// it still has the data, none of it is fetched.
+func (p *Pool) Head(ctx context.Context, rc storage.ReadConfig) error {
+	r, ok := p.RemotesByMachineID[rc.Machine()]
+	if !ok {
+		return fmt.Errorf("There is no machine with id %d", rc.Machine())
+	}
+	h, ok := r.(interface {
+		Head(context.Context, storage.ReadConfig) error
+	})
+	if !ok {
+		return fmt.Errorf("Remote can not check for data.")
+	}
+	return h.Head(ctx, rc)
+}
+
+// Returns every remote in the pool other than the one with the given machine
+// id. Replicas are only ever assigned from the pool so these are the only
+// machines that could be holding a replica of a file created by machine.
+func (p *Pool) ReplicaHolders(machine uint32) []storage.Remote {
+	creator := p.RemotesByMachineID[machine]
+	holders := make([]storage.Remote, 0, len(p.Remotes))
+	for _, r := range p.Remotes {
+		if r != creator {
+			holders = append(holders, r)
+		}
+	}
+	return holders
+}
+
+// Asks every remote in the pool for its machine ID and returns an error if
+// any of them report id, which is the ID of the local machine. Two servers
+// sharing an ID will generate colliding file IDs so this should be treated
+// as fatal. Remotes that can not be reached are ignored since they can not
+// be generating IDs right now.
+func (p *Pool) CheckMachineID(ctx context.Context, id uint32) error {
+	type result struct {
+		name string
+		id   uint32
+		err  error
+	}
+	results := make(chan result, len(p.Remotes))
+	for _, r := range p.Remotes {
+		go func(r storage.Remote) {
+			res := result{name: r.String()}
+			if m, ok := r.(interface {
+				MachineID(context.Context) (uint32, error)
+			}); ok {
+				res.id, res.err = m.MachineID(ctx)
+			} else {
+				res.err = fmt.Errorf("Remote can not report its machine id.")
+			}
+			results <- res
+		}(r)
+	}
+	var conflicts []string
+	for range p.Remotes {
+		if res := <-results; res.err == nil && res.id == id {
+			conflicts = append(conflicts, res.name)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf(
+			"Machine id %d is also used by: %s",
+			id,
+			strings.Join(conflicts, ", "))
 	}
+	return nil
 }
@@ -0,0 +1,146 @@
+package remotes
+
+import (
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/storage"
+)
+
+// A remote that reports a fixed disk usage. Only the methods used when
+// assigning remotes are implemented.
+type diskRemote struct {
+	storage.Remote
+	name  string
+	used  float64
+	known bool
+}
+
+func (d *diskRemote) DiskUsage(string) (float64, bool) {
+	return d.used, d.known
+}
+
+func (d *diskRemote) String() string {
+	return d.name
+}
+
+func TestPool_AssignRemotesFor(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	a := &diskRemote{name: "a", used: 0.5, known: true}
+	b := &diskRemote{name: "b", used: 0.2, known: true}
+	c := &diskRemote{name: "c", used: 0.96, known: true}
+	p := &Pool{Remotes: []storage.Remote{a, b, c}}
+	assign := p.AssignRemotesFor("test", 0.95)
+	names := func(r int) []string {
+		remotes, err := assign(r)
+		T.ExpectSuccess(err)
+		out := make([]string, len(remotes))
+		for i := range remotes {
+			out[i] = remotes[i].String()
+		}
+		return out
+	}
+
+	// The emptiest remotes are preferred and full remotes are skipped.
+	T.Equal(names(1), []string{"b"})
+	T.Equal(names(2), []string{"b", "a"})
+	_, err := assign(3)
+	T.ExpectErrorMessage(
+		err,
+		"There are not enough remotes with free disk space to assign 3 "+
+			"replicas.")
+
+	// Remotes with about the same usage are used round robin.
+	a.used = 0.201
+	p.NextRemote = 0
+	T.Equal(names(1), []string{"a"})
+	T.Equal(names(1), []string{"b"})
+
+	// If any remote has not reported its usage then the remotes are
+	// assigned round robin, though full remotes are still skipped.
+	b.known = false
+	p.NextRemote = 0
+	T.Equal(names(2), []string{"a", "b"})
+	T.Equal(names(2), []string{"a", "b"})
+	T.Equal(names(2), []string{"b", "a"})
+
+	// Without a name space the usage is ignored.
+	p.NextRemote = 0
+	remotes, err := p.AssignRemotes(3)
+	T.ExpectSuccess(err)
+	T.Equal(remotes, []storage.Remote{a, b, c})
+}
+
+// A remote that reports a fixed failure domain.
+type zoneRemote struct {
+	storage.Remote
+	name string
+	zone string
+}
+
+func (z *zoneRemote) FailureDomain() string {
+	return z.zone
+}
+
+func (z *zoneRemote) String() string {
+	return z.name
+}
+
+func TestPool_AssignRemotes_Zones(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	a1 := &zoneRemote{name: "a1", zone: "a"}
+	a2 := &zoneRemote{name: "a2", zone: "a"}
+	b1 := &zoneRemote{name: "b1", zone: "b"}
+	n1 := &zoneRemote{name: "n1"}
+	n2 := &zoneRemote{name: "n2"}
+	p := &Pool{Remotes: []storage.Remote{a1, a2, b1, n1, n2}}
+
+	// Replicas are spread across zones, skipping over remotes in a zone
+	// that is already used.
+	remotes, err := p.AssignRemotes(2)
+	T.ExpectSuccess(err)
+	T.Equal(remotes, []storage.Remote{a1, b1})
+
+	// Remotes without a zone never conflict.
+	p.NextRemote = 2
+	remotes, err = p.AssignRemotes(3)
+	T.ExpectSuccess(err)
+	T.Equal(remotes, []storage.Remote{b1, n1, n2})
+
+	// If there are not enough zones then the rest are filled in order.
+	p = &Pool{Remotes: []storage.Remote{a1, a2, b1}}
+	remotes, err = p.AssignRemotes(3)
+	T.ExpectSuccess(err)
+	T.Equal(remotes, []storage.Remote{a1, b1, a2})
+
+	// The local zone counts as used so remotes in other zones are picked
+	// ahead of it.
+	p = &Pool{Remotes: []storage.Remote{a1, a2, b1, n1}, Zone: "a"}
+	remotes, err = p.AssignRemotes(2)
+	T.ExpectSuccess(err)
+	T.Equal(remotes, []storage.Remote{b1, n1})
+}
+
+func TestPool_ReplicaHolders(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	a := &diskRemote{name: "a"}
+	b := &diskRemote{name: "b"}
+	c := &diskRemote{name: "c"}
+	p := &Pool{
+		Remotes:            []storage.Remote{a, b, c},
+		RemotesByMachineID: map[uint32]storage.Remote{1: a, 2: b, 3: c},
+	}
+
+	// The creator is never asked for a replica.
+	T.Equal(p.ReplicaHolders(2), []storage.Remote{a, c})
+
+	// An unknown creator leaves every remote as a candidate.
+	T.Equal(p.ReplicaHolders(9), []storage.Remote{a, b, c})
+}
@@ -1,11 +1,13 @@
 package remotes
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -30,6 +32,28 @@ type Remote struct {
 	// specific client. This is useful if you need to support sending TLS
 	// requests to a specific IP but still want to perform hostname validation.
 	Client *http.Client
+
+	// The failure domain, such as the rack or zone, that this remote is in.
+	// This is optional and is used to spread the replicas of each file
+	// across failure domains.
+	Zone string
+
+	// The disk usage that this remote has reported for each name space.
+	diskUsages diskUsages
+}
+
+// Returns the failure domain that this remote is in, or an empty string
+// if it was not configured with one.
+func (r *Remote) FailureDomain() string {
+	return r.Zone
+}
+
+// Returns the fraction of the disk used by the name space on this remote,
+// from 0 to 1, as reported in its most recent response to an INITIALIZE or
+// HEARTBEAT request. This returns false if the remote has never reported
+// it, for example because it is running an older version.
+func (r *Remote) DiskUsage(namespace string) (float64, bool) {
+	return r.diskUsages.get(namespace)
 }
 
 func (r *Remote) Delete(namespace, fn string) error {
@@ -107,6 +131,7 @@ func (r *Remote) HeartBeat(namespace, fn string) (bool, error) {
 	}
 
 	// Success!
+	r.diskUsages.record(namespace, resp)
 	return resp.Header.Get("Shutting-Down") == "true", nil
 }
 
@@ -146,16 +171,64 @@ func (r *Remote) Initialize(namespace, fn string) error {
 	}
 
 	// Success!
+	r.diskUsages.record(namespace, resp)
 	return nil
 }
 
+// Asks the remote server for the machine ID that it is configured with. This
+// uses a HEAD request against the health check endpoint since every response
+// includes the Machine-ID header, even if the request is refused by the ACL.
+func (r *Remote) MachineID(ctx context.Context) (uint32, error) {
+	// Generate the request.
+	request, err := http.NewRequestWithContext(
+		ctx,
+		"HEAD",
+		r.URL+"/_health",
+		nilReader{})
+	if err != nil {
+		return 0, errors.Wrap(
+			err,
+			"Error generating HEAD request: ",
+		)
+	}
+
+	// Perform the request.
+	resp, err := r.Client.Do(request)
+	if err != nil {
+		return 0, errors.Wrap(
+			err,
+			"Error sending a request to remote: ")
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Parse the header.
+	header := resp.Header.Get("Machine-ID")
+	if header == "" {
+		return 0, fmt.Errorf("The remote did not return a machine id.")
+	}
+	id, err := strconv.ParseUint(header, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid machine id: %s", header)
+	}
+	return uint32(id), nil
+}
+
 // When the storage.Storage object gets a Read() request for a file
 // id that was generated on another machine it will attempt to forward the
 // request to that machine so it can be processed locally on that machine
-// which is cheaper than going to S3.
-func (r *Remote) Read(rc storage.ReadConfig) (io.ReadCloser, error) {
+// which is cheaper than going to S3. The request is tied to ctx so that it
+// is aborted if the caller goes away.
+func (r *Remote) Read(
+	ctx context.Context,
+	rc storage.ReadConfig,
+) (
+	io.ReadCloser,
+	error,
+) {
 	// Generate the request.
-	request, err := http.NewRequest(
+	request, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
 		fmt.Sprintf("%s/%s/%s",
 			r.URL,
@@ -204,6 +277,56 @@ func (r *Remote) Read(rc storage.ReadConfig) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+// Like Read except that a HEAD request is sent so only the existence of the
+// data on the remote is checked. If the remote does not have the data
+// locally then storage.ErrNotFound is returned.
+func (r *Remote) Head(ctx context.Context, rc storage.ReadConfig) error {
+	// Generate the request.
+	request, err := http.NewRequestWithContext(
+		ctx,
+		"HEAD",
+		fmt.Sprintf("%s/%s/%s",
+			r.URL,
+			rc.NameSpace(),
+			rc.ID()),
+		nilReader{})
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"Error generating HEAD request: ",
+		)
+	}
+
+	f, ok := rc.Context().(func(r *http.Request))
+	if ok {
+		f(request)
+	}
+
+	// Only the copy stored on the remote itself is of interest.
+	request.Header.Set("Blobby-Local-Only", "true")
+
+	// Perform the request.
+	resp, err := r.Client.Do(request)
+	if err != nil {
+		return errors.Wrap(
+			err,
+			"Error sending a request to remote: ")
+	}
+	resp.Body.Close()
+
+	// Check the status code.
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return storage.ErrNotFound("")
+	default:
+		return fmt.Errorf(
+			"Invalid response code: %d",
+			resp.StatusCode)
+	}
+}
+
 // Replicates data that was written to the primary into the replica.
 // This takes a RemoteReplicateConfig object that contains a bunch of
 // parameters to establish what should be passed to the replica.
@@ -238,6 +361,13 @@ func (r *Remote) Replicate(
 	request.Header.Add("End", strconv.FormatUint(start+length, 10))
 	request.Header.Add("Hash", rc.Hash())
 
+	// If the primary is tracing this insert then ask the remote to trace
+	// its side of the replication as well.
+	trace := rc.Tracer()
+	if trace != nil {
+		request.Header.Add("Blobby-Trace", "true")
+	}
+
 	// Perform the request.
 	resp, err := r.Client.Do(request)
 	if err != nil {
@@ -249,13 +379,30 @@ func (r *Remote) Replicate(
 	// Ensure that the body of the request is fully read.
 	defer ioutil.ReadAll(resp.Body)
 
-	// Check the status code.
+	// Check the status code. A conflict means that the replica is missing
+	// data before this request, the offset it has data up to is returned
+	// so that the primary can resend from there.
+	if resp.StatusCode == http.StatusConflict {
+		offset, err := strconv.ParseUint(
+			resp.Header.Get("Replica-Offset"), 10, 64)
+		if err == nil {
+			return false, storage.ErrReplicaBehind(offset)
+		}
+	}
 	if resp.StatusCode != http.StatusNoContent {
 		return false, fmt.Errorf(
 			"Invalid response code: %d",
 			resp.StatusCode)
 	}
 
+	// Add the time the remote spent processing the request to the trace.
+	if trace != nil {
+		d, err := strconv.ParseInt(resp.Header.Get("Blobby-Trace-Duration"), 10, 64)
+		if err == nil {
+			trace.AddChild("remote("+r.Name+"):replicate", time.Duration(d))
+		}
+	}
+
 	// Success!
 	return resp.Header.Get("Shutting-Down") == "true", nil
 }
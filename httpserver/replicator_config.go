@@ -2,6 +2,8 @@ package httpserver
 
 import (
 	"io"
+
+	"github.com/liquidgecka/blobby/internal/tracing"
 )
 
 type remoteReplicatorConfig struct {
@@ -11,6 +13,7 @@ type remoteReplicatorConfig struct {
 	hash      string
 	namespace string
 	start     uint64
+	trace     *tracing.Trace
 }
 
 func (r *remoteReplicatorConfig) FileName() string {
@@ -36,3 +39,7 @@ func (r *remoteReplicatorConfig) Offset() uint64 {
 func (r *remoteReplicatorConfig) Size() uint64 {
 	return r.end - r.start
 }
+
+func (r *remoteReplicatorConfig) Tracer() *tracing.Trace {
+	return r.trace
+}
@@ -28,6 +28,9 @@ type Request struct {
 	response    http.ResponseWriter
 	statusCode  int
 	Log         *slog.Logger
+
+	// Additional attributes that are included in the access log line.
+	accessLogAttrs []slog.Attr
 }
 
 func New(
@@ -58,23 +61,32 @@ func New(
 // Logs the access log for this request to the given logger.
 func (r *Request) AccessLog(l *slog.Logger) {
 	duration := time.Now().Sub(r.start) / time.Millisecond
-	l.LogAttrs(
-		r.Context,
-		slog.LevelInfo,
-		"request complete.",
-		sloghelper.String("start", r.start.String()),
-		sloghelper.Uint64("request-id", r.ID),
-		sloghelper.Int("status", r.statusCode),
-		sloghelper.String("method", r.Request.Method),
-		sloghelper.String("url", r.Request.URL.String()),
-		sloghelper.Int64("bytes-read", r.bodyWrapper.size),
-		sloghelper.Duration("request-duration-ms", duration),
-	)
+	attrs := append(
+		[]slog.Attr{
+			sloghelper.String("start", r.start.String()),
+			sloghelper.Uint64("request-id", r.ID),
+			sloghelper.Int("status", r.statusCode),
+			sloghelper.String("method", r.Request.Method),
+			sloghelper.String("url", r.Request.URL.String()),
+			sloghelper.Int64("bytes-read", r.bodyWrapper.size),
+			sloghelper.Duration("request-duration-ms", duration),
+		},
+		r.accessLogAttrs...)
+	l.LogAttrs(r.Context, slog.LevelInfo, "request complete.", attrs...)
+}
+
+// Adds attributes that will be included in the access log line for this
+// request. This allows handlers to log details that are specific to the
+// type of request being processed.
+func (r *Request) AddAccessLogAttrs(attrs ...slog.Attr) {
+	r.accessLogAttrs = append(r.accessLogAttrs, attrs...)
 }
 
-// Enables tracing on this Request.
+// Enables tracing on this Request. The trace is also added to the requests
+// Context so that it can be continued by the layers below.
 func (r *Request) AddTracer() {
 	r.trace = tracing.New()
+	r.Context = tracing.NewContext(r.Context, r.trace)
 }
 
 // Returns a validated Hash header from the Request.
@@ -94,6 +106,18 @@ func (r *Request) HashHeader() string {
 	return headers[0]
 }
 
+// Sends any buffered response data to the caller. Responses that stream
+// data for a long time can pass a positive timeout to push the write
+// deadline of the connection that far into the future so the server's
+// write timeout does not cut the stream off.
+func (r *Request) Flush(timeout time.Duration) {
+	rc := http.NewResponseController(r.response)
+	if timeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	rc.Flush()
+}
+
 // Returns the underlying response headers to the caller.
 func (r *Request) Header() http.Header {
 	return r.response.Header()
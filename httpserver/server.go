@@ -1,14 +1,17 @@
 package httpserver
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -17,11 +20,14 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/liquidgecka/blobby/httpserver/request"
+	"github.com/liquidgecka/blobby/internal/buildinfo"
 	"github.com/liquidgecka/blobby/internal/compat"
 	"github.com/liquidgecka/blobby/internal/sloghelper"
 	"github.com/liquidgecka/blobby/storage"
+	"github.com/liquidgecka/blobby/storage/blastpath"
 	"github.com/liquidgecka/blobby/storage/fid"
 	"github.com/liquidgecka/blobby/storage/metrics"
 )
@@ -36,13 +42,54 @@ const (
 		"ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
 		"0123456789" +
 		"_-"
+
+	// The number of seconds that clients are asked to wait before retrying
+	// an insert into a read only namespace.
+	readOnlyRetryAfter = "30"
+
+	// The number of seconds that clients are asked to wait before retrying
+	// an insert that timed out waiting in the insert queue. This is kept
+	// short since the queue is expected to drain quickly.
+	queueTimeoutRetryAfter = "1"
+
+	// The largest body that will be read when parsing the list of ranges
+	// in a BLASTMULTIGET request.
+	blastPathMaxRangesBody = 1024 * 1024
+
+	// The size of the buffer used to copy data to a BLASTTAIL caller.
+	blastPathTailBuffer = 64 * 1024
+
+	// How often ShutDown checks for pending files while it waits for them
+	// to be uploaded.
+	shutDownPollInterval = time.Second * 5
+
+	// How long ShutDown waits for requests that are still in progress
+	// once the listeners have been closed.
+	shutDownCloseTimeout = time.Second * 30
+)
+
+// The type used as a key for storing values in the per connection context.
+type connContextKey int
+
+const (
+	// The key that stores the time that the connection was accepted.
+	connStartKey connContextKey = iota
 )
 
+// Called by the http.Server each time a new connection is accepted. This
+// stores the time that the connection was established so that requests can
+// later check how long the connection has been open.
+func connContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connStartKey, time.Now())
+}
+
 // An implementation of Server that exposes the public functions.
 type Server interface {
 	Addr() string
 	Listen() error
+	Reload(*Settings) error
 	Run() error
+	ShutDown(context.Context) error
 }
 
 // Creates a new Server that is capable of serving HTTP requests.
@@ -61,6 +108,25 @@ func New(settings *Settings) Server {
 		panic("settings.IdleTimeout is negative.")
 	} else if settings.MaxHeaderBytes < 0 {
 		panic("settings.MaxHeaderBytes is negative.")
+	} else if settings.MaxConnectionLifetime < 0 {
+		panic("settings.MaxConnectionLifetime is negative.")
+	} else if settings.ShutDownGracePeriod < 0 {
+		panic("settings.ShutDownGracePeriod is negative.")
+	}
+	for i, l := range settings.Listeners {
+		if l.Network != "tcp" && l.Network != "unix" {
+			panic(fmt.Sprintf(
+				"settings.Listeners[%d].Network must be tcp or unix.",
+				i))
+		} else if l.Address == "" {
+			panic(fmt.Sprintf(
+				"settings.Listeners[%d].Address can not be empty.",
+				i))
+		} else if l.TLS && settings.TLSCerts == nil {
+			panic(fmt.Sprintf(
+				"settings.Listeners[%d].TLS requires settings.TLSCerts.",
+				i))
+		}
 	}
 	for ns := range settings.NameSpaces {
 		if ns == "" {
@@ -77,19 +143,21 @@ func New(settings *Settings) Server {
 		}
 	}
 	s := &server{
-		context:  context.Background(), // FIXME
-		settings: *settings,
+		context: context.Background(), // FIXME
 		httpServer: compat.SetIdleTimeout(
 			&http.Server{
 				WriteTimeout:   settings.WriteTimeout,
 				ReadTimeout:    settings.ReadTimeout,
 				MaxHeaderBytes: settings.MaxHeaderBytes,
 				ErrorLog:       log.New(ioutil.Discard, "", 0),
+				ConnContext:    connContext,
 			},
 			settings.IdleTimeout,
 		),
 		log: settings.Logger,
 	}
+	copied := *settings
+	s.settings.Store(&copied)
 	s.httpServer.Handler = s
 	return s
 }
@@ -97,8 +165,9 @@ func New(settings *Settings) Server {
 type server struct {
 	// A copy of the settings defined when the server was created. This is
 	// a copy specifically so that the values can not be altered during
-	// the operation of the HTTP server.
-	settings Settings
+	// the operation of the HTTP server. Reload() replaces this with a new
+	// copy rather than modifying it so requests never see a partial update.
+	settings atomic.Pointer[Settings]
 
 	// If true then the contents of the errors will be written back to
 	// the caller. This is not safe in production environments as it
@@ -109,8 +178,9 @@ type server struct {
 	// to a caller.
 	httpServer *http.Server
 
-	// The listener that this http server will serve on.
-	listener net.Listener
+	// The listeners that this http server will serve on. The first is
+	// always the one for Settings.Addr and Settings.Port.
+	listeners []listener
 
 	// The context that the server is running within.
 	context context.Context
@@ -125,34 +195,193 @@ type server struct {
 	log *slog.Logger
 }
 
-// Returns the address that this server will listen on.
+// Returns the primary address that this server will listen on. Any
+// additional listeners are not included.
 func (s *server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.settings.Addr, s.settings.Port)
+	return net.JoinHostPort(
+		s.settings.Load().Addr,
+		strconv.Itoa(s.settings.Load().Port))
 }
 
-// Starts the listener.
+// Starts the listeners. The primary address is always listened on first
+// so that a second instance fails before it can touch anything else. If
+// any listener fails then the ones already started are closed.
 func (s *server) Listen() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d",
-		s.settings.Addr,
-		s.settings.Port))
-	if err != nil {
-		return err
+	settings := s.settings.Load()
+	endpoints := append(
+		[]ListenerSettings{{
+			Network: "tcp",
+			Address: s.Addr(),
+			TLS:     settings.TLSCerts != nil,
+		}},
+		settings.Listeners...)
+	listeners := make([]listener, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		l, err := listen(endpoint)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener{Listener: l, tls: endpoint.TLS})
+	}
+	s.listeners = listeners
+	return nil
+}
+
+// Replaces the ACLs, read and write timeouts, MaxConnectionLifetime and
+// PrometheusTagPrefix with the values from the given settings. All other
+// fields are ignored. Name spaces are matched by name and only have their
+// ACLs replaced, any that the server was not created with are ignored and
+// any that are missing keep their current ACLs.
+func (s *server) Reload(settings *Settings) error {
+	switch {
+	case settings.WriteTimeout < 0:
+		return fmt.Errorf("settings.WriteTimeout is negative.")
+	case settings.ReadTimeout < 0:
+		return fmt.Errorf("settings.ReadTimeout is negative.")
+	case settings.MaxConnectionLifetime < 0:
+		return fmt.Errorf("settings.MaxConnectionLifetime is negative.")
+	}
+
+	current := s.settings.Load()
+	n := *current
+	n.DebugPathsACL = settings.DebugPathsACL
+	n.HealthCheckACL = settings.HealthCheckACL
+	n.StatusACL = settings.StatusACL
+	n.ShutDownACL = settings.ShutDownACL
+	n.ReadTimeout = settings.ReadTimeout
+	n.WriteTimeout = settings.WriteTimeout
+	n.MaxConnectionLifetime = settings.MaxConnectionLifetime
+	n.PrometheusTagPrefix = settings.PrometheusTagPrefix
+	n.NameSpaces = make(map[string]*NameSpaceSettings, len(current.NameSpaces))
+	for name, ns := range current.NameSpaces {
+		if update, ok := settings.NameSpaces[name]; ok {
+			copied := *ns
+			copied.BlastPathACL = update.BlastPathACL
+			copied.DeleteACL = update.DeleteACL
+			copied.InsertACL = update.InsertACL
+			copied.PrimaryACL = update.PrimaryACL
+			copied.ReadACL = update.ReadACL
+			ns = &copied
+		}
+		n.NameSpaces[name] = ns
 	}
-	s.listener = listener
+	s.settings.Store(&n)
 	return nil
 }
 
-// Starts the HTTP server and runs it, returning an error only when it
-// has stopped.
+// Starts the HTTP server and runs it on every listener, returning an error
+// only when it has stopped. If serving any listener fails then all of the
+// listeners are closed and the first error is returned.
 func (s *server) Run() error {
-	l := s.listener
-	if s.settings.TLSCerts != nil {
-		tc := tls.Config{
-			GetCertificate: s.cert,
+	errs := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		var nl net.Listener = l
+		if l.tls {
+			tc := tls.Config{
+				GetCertificate: s.cert,
+			}
+			nl = tls.NewListener(l, &tc)
+		}
+		go func() {
+			errs <- s.httpServer.Serve(nl)
+		}()
+	}
+	// A graceful ShutDown() closes the listeners before the requests in
+	// flight have finished so the connections are only forced closed if
+	// serving failed.
+	err := <-errs
+	if err != http.ErrServerClosed {
+		s.httpServer.Close()
+	}
+	for i := 1; i < len(s.listeners); i++ {
+		<-errs
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shuts the server down gracefully. This puts the server into the same
+// shutting down mode as /_shutdown/start, drains every namespace so that no
+// new primaries are opened and the existing ones are uploaded, and then
+// waits up to Settings.ShutDownGracePeriod for the pending files to finish.
+// Once they have, or the grace period has passed, the listeners are closed
+// which causes Run() to return nil. Requests that are still in progress
+// are given a short time to finish before their connections are closed.
+func (s *server) ShutDown(ctx context.Context) error {
+	settings := s.settings.Load()
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	s.log.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Shutting down the server.",
+		sloghelper.Duration("grace-period", settings.ShutDownGracePeriod))
+	for _, ns := range settings.NameSpaces {
+		if ns.Storage != nil {
+			ns.Storage.Drain(ctx)
+		}
+	}
+
+	// Wait for the pending files to be uploaded.
+	deadline := time.Now().Add(settings.ShutDownGracePeriod)
+	for {
+		primaries, replicas := 0, 0
+		for _, ns := range settings.NameSpaces {
+			if ns.Storage != nil {
+				p, r := ns.Storage.Pending()
+				primaries += p
+				replicas += r
+			}
+		}
+		remaining := time.Until(deadline)
+		if primaries+replicas == 0 {
+			s.log.LogAttrs(
+				ctx,
+				slog.LevelInfo,
+				"All pending files have been uploaded.")
+			break
+		} else if remaining <= 0 {
+			s.log.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Shut down grace period expired with files still pending.",
+				sloghelper.Int("primaries", primaries),
+				sloghelper.Int("replicas", replicas))
+			break
+		}
+		s.log.LogAttrs(
+			ctx,
+			slog.LevelInfo,
+			"Waiting for pending files to be uploaded.",
+			sloghelper.Int("primaries", primaries),
+			sloghelper.Int("replicas", replicas),
+			sloghelper.Duration("remaining", remaining))
+		if remaining > shutDownPollInterval {
+			remaining = shutDownPollInterval
 		}
-		l = tls.NewListener(s.listener, &tc)
+		timer := time.NewTimer(remaining)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.httpServer.Close()
+			return ctx.Err()
+		}
+	}
+
+	// Stop accepting connections and let the requests in flight finish.
+	s.log.LogAttrs(ctx, slog.LevelInfo, "Closing the listeners.")
+	closeCtx, cancel := context.WithTimeout(ctx, shutDownCloseTimeout)
+	defer cancel()
+	if err := s.httpServer.Shutdown(closeCtx); err != nil {
+		s.httpServer.Close()
+		return err
 	}
-	return s.httpServer.Serve(l)
+	return nil
 }
 
 //
@@ -162,20 +391,42 @@ func (s *server) Run() error {
 // Internally exposed ServeHTTP method used as server implements the Muxer
 // interface.
 func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	settings := s.settings.Load()
+
+	// The http.Server can not be safely modified while it is serving so if
+	// Reload() has changed the timeouts then they are applied to the
+	// connection as each request starts.
+	if settings.ReadTimeout != s.httpServer.ReadTimeout {
+		rc := http.NewResponseController(w)
+		if settings.ReadTimeout == 0 {
+			rc.SetReadDeadline(time.Time{})
+		} else {
+			rc.SetReadDeadline(time.Now().Add(settings.ReadTimeout))
+		}
+	}
+	if settings.WriteTimeout != s.httpServer.WriteTimeout {
+		rc := http.NewResponseController(w)
+		if settings.WriteTimeout == 0 {
+			rc.SetWriteDeadline(time.Time{})
+		} else {
+			rc.SetWriteDeadline(time.Now().Add(settings.WriteTimeout))
+		}
+	}
+
 	// We want to capture the response in order to put it in the log. As
 	// such we actually wrap the ResponseWriter in an internal implementation
 	// that captures details.
 	ir := request.New(w, req, s.log)
-	if s.settings.EnableTracing {
+	if settings.EnableTracing {
 		ir.AddTracer()
 	}
 	w = &ir
 
 	// Use the above object to generate a log line at the end of the
 	// request.
-	if s.settings.AccessLogger != nil {
+	if settings.AccessLogger != nil {
 		defer func() {
-			ir.AccessLog(s.settings.AccessLogger)
+			ir.AccessLog(settings.AccessLogger)
 		}()
 	}
 
@@ -185,8 +436,11 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// over that path.
 	defer ir.PanicHandler(s.ReplyWithError)
 
-	// Make sure the trace ends.
-	defer ir.Tracer().End()
+	// Make sure the trace ends. The tracer may be added by the handler so
+	// it is not known until the request is done.
+	defer func() {
+		ir.Tracer().End()
+	}()
 
 	// Add a shutting down header so any caller that needs to know is aware
 	// that the server will terminate soon.
@@ -194,13 +448,27 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		ir.Header().Add("Shutting-Down", "true")
 	}
 
+	// Report the machine ID of this server so that peers can verify that
+	// it is not shared with another server.
+	ir.Header().Set("Machine-ID", strconv.FormatUint(
+		uint64(settings.MachineID),
+		10))
+
+	// If the connection has been open for longer than the configured
+	// maximum lifetime then we ask the client to close it once this request
+	// completes so that it reconnects, likely to a different server.
+	if s.connectionExpired(req) {
+		ir.Header().Set("Connection", "close")
+	}
+
 	// Mux to the right handled based on the method used.
 	switch req.Method {
 	// The following two functions are used by callers and are documented
 	// as part of the API. Both of these methods can end up in several
 	// different implementation paths as they also implement internal
-	// functionality like health checks.
-	case "GET":
+	// functionality like health checks. HEAD requests are routed the same
+	// way so that they match what a GET of the same URL would return.
+	case "GET", "HEAD":
 		s.httpGetMuxer(&ir)
 	case "POST":
 		s.httpPostMuxer(&ir)
@@ -210,7 +478,7 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// a REST like semantic. This is purely for simplicity and to prevent
 	// users from accidentally calling legitimate operations by accident.
 	case "DELETE":
-		s.httpDelete(&ir)
+		s.httpDeleteMuxer(&ir)
 	case "HEARTBEAT":
 		s.httpHeartBeat(&ir)
 	case "INITIALIZE":
@@ -228,8 +496,14 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// ranges out of the server before they get uploaded to S3.
 	case "BLASTSTATUS":
 		s.httpBlastStatus(&ir)
+	case "BLASTLIST":
+		s.httpBlastList(&ir)
 	case "BLASTGET":
 		s.httpBlastRead(&ir)
+	case "BLASTMULTIGET":
+		s.httpBlastReadRanges(&ir)
+	case "BLASTTAIL":
+		s.httpBlastTail(&ir)
 
 	// Otherwise its an unsupported method.
 	default:
@@ -239,6 +513,19 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Returns true if the connection that the request was received on has been
+// open for longer than the configured MaxConnectionLifetime.
+func (s *server) connectionExpired(req *http.Request) bool {
+	if s.settings.Load().MaxConnectionLifetime == 0 {
+		return false
+	}
+	start, ok := req.Context().Value(connStartKey).(time.Time)
+	if !ok {
+		return false
+	}
+	return time.Since(start) > s.settings.Load().MaxConnectionLifetime
+}
+
 // The GET handler must account for several internally provided GET URLs.
 func (s *server) httpGetMuxer(ir *request.Request) {
 	// We need to capture any internal or administrative URLS before
@@ -247,7 +534,7 @@ func (s *server) httpGetMuxer(ir *request.Request) {
 	if strings.HasPrefix(ir.Request.URL.Path, "/_") {
 		switch parts[1] {
 		case "_debug":
-			s.settings.DebugPathsACL.Assert(ir)
+			s.settings.Load().DebugPathsACL.Assert(ir)
 			switch ir.Request.URL.Path {
 			case "/_debug/allocs":
 				pprof.Handler("allocs").ServeHTTP(ir, ir.Request)
@@ -279,12 +566,12 @@ func (s *server) httpGetMuxer(ir *request.Request) {
 				})
 			}
 		case "_health":
-			s.settings.HealthCheckACL.Assert(ir)
+			s.settings.Load().HealthCheckACL.Assert(ir)
 			s.httpGetHealth(ir)
 		case "_login":
-			s.settings.WebAuthProvider.LoginGet(ir)
+			s.settings.Load().WebAuthProvider.LoginGet(ir)
 		case "_metrics":
-			s.settings.StatusACL.Assert(ir)
+			s.settings.Load().StatusACL.Assert(ir)
 			s.httpMetrics(ir)
 		case "_saml":
 			if len(parts) == 4 && parts[3] == "metadata" {
@@ -295,15 +582,32 @@ func (s *server) httpGetMuxer(ir *request.Request) {
 					Response: "The URL you are requesting does not exist.",
 				})
 			}
+		case "_readonly":
+			s.settings.Load().ShutDownACL.Assert(ir)
+			s.httpReadOnly(ir, parts)
+		case "_reupload":
+			s.settings.Load().ShutDownACL.Assert(ir)
+			s.httpReupload(ir, parts)
+		case "_scrub":
+			s.settings.Load().DebugPathsACL.Assert(ir)
+			s.httpScrub(ir, parts)
 		case "_shutdown":
-			s.settings.ShutDownACL.Assert(ir)
+			s.settings.Load().ShutDownACL.Assert(ir)
 			s.httpShutDown(ir, parts)
 		case "_status":
-			s.settings.StatusACL.Assert(ir)
+			s.settings.Load().StatusACL.Assert(ir)
 			s.httpStatus(ir)
+		case "_upload_thresholds":
+			s.settings.Load().ShutDownACL.Assert(ir)
+			s.httpUploadThresholds(ir, parts)
+		case "_version":
+			s.settings.Load().StatusACL.Assert(ir)
+			s.httpVersion(ir)
 		case "_id":
-			s.settings.DebugPathsACL.Assert(ir)
+			s.settings.Load().DebugPathsACL.Assert(ir)
 			s.httpID(ir)
+		case "_locate":
+			s.httpLocate(ir, parts)
 		default:
 			panic(&request.HTTPError{
 				Status:   http.StatusNotFound,
@@ -329,16 +633,22 @@ func (s *server) httpPostMuxer(ir *request.Request) {
 			if atomic.LoadInt32(&s.shuttingDown) != 0 {
 				ir.Header().Add("Connection", "close")
 			}
-			if s.settings.WebAuthProvider == nil {
+			if s.settings.Load().WebAuthProvider == nil {
 				panic(&request.HTTPError{
 					Status:   http.StatusNotFound,
 					Response: "Web logins are disabled on this server.",
 				})
 			}
 			// FIXME: permissions?
-			s.settings.WebAuthProvider.LoginPost(ir)
+			s.settings.Load().WebAuthProvider.LoginPost(ir)
+		case "_flush":
+			s.settings.Load().ShutDownACL.Assert(ir)
+			s.httpFlush(ir, parts)
 		case "_saml":
 			s.httpSAMLAuth(ir, parts)
+		case "_upload_thresholds":
+			s.settings.Load().ShutDownACL.Assert(ir)
+			s.httpUploadThresholds(ir, parts)
 		default:
 			panic(&request.HTTPError{
 				Status:   http.StatusNotFound,
@@ -380,7 +690,7 @@ func (s *server) httpBlastRead(r *request.Request) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -391,17 +701,28 @@ func (s *server) httpBlastRead(r *request.Request) {
 	// Verify that the caller is allowed to make this request.
 	ns.BlastPathACL.Assert(r)
 
+	// Make sure that the range requested is valid and within the limits
+	// configured for this name space.
+	if end < start {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "End byte is before the start byte.",
+		})
+	} else if ns.BlastPathMaxBytes > 0 && end-start > ns.BlastPathMaxBytes {
+		panic(&request.HTTPError{
+			Status: http.StatusBadRequest,
+			Response: fmt.Sprintf(
+				"Requested range is larger than the maximum of %d bytes, "+
+					"please paginate the request.",
+				ns.BlastPathMaxBytes),
+		})
+	}
+
 	// Fetch the data out of the Storage instance.
 	content, err := ns.Storage.BlastPathRead(parts[2], start, end)
 	if err != nil {
-		if _, ok := err.(storage.ErrNotPossible); ok {
-			r.Header().Add("Content-Type", "text/plain")
-			r.WriteHeader(http.StatusBadRequest)
-			r.Write([]byte("Can not fetch objects from a compressed source."))
-			return
-		} else {
-			panic(err)
-		}
+		blastPathReadError(r, err)
+		return
 	}
 	defer content.Close()
 
@@ -411,6 +732,183 @@ func (s *server) httpBlastRead(r *request.Request) {
 	io.Copy(r, content)
 }
 
+// BLASTMULTIGET requests are sent by a Blast Path server to get several
+// portions of a primary file in a single request. The body is a JSON list
+// of blastpath.Range objects and the response has a segment for each range
+// in the order requested, each being the length of the range as an 8 byte
+// big endian integer followed by the data.
+func (s *server) httpBlastReadRanges(r *request.Request) {
+	parts := strings.Split(r.Request.URL.Path, "/")
+	if len(parts) != 3 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid BLASTMULTIGET request.",
+		})
+	}
+
+	// Obtain the namespace for the given path.
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+
+	// Verify that the caller is allowed to make this request.
+	ns.BlastPathACL.Assert(r)
+
+	// Parse the list of ranges out of the body.
+	var ranges []blastpath.Range
+	body := io.LimitReader(r.Request.Body, blastPathMaxRangesBody)
+	if err := json.NewDecoder(body).Decode(&ranges); err != nil {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "The list of ranges is not valid.",
+		})
+	} else if len(ranges) == 0 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "No ranges were requested.",
+		})
+	}
+
+	// Make sure that every range is valid and that together they are
+	// within the limits configured for this name space.
+	total := uint64(0)
+	for _, rng := range ranges {
+		if rng.End < rng.Start {
+			panic(&request.HTTPError{
+				Status:   http.StatusBadRequest,
+				Response: "End byte is before the start byte.",
+			})
+		}
+		total += rng.End - rng.Start
+	}
+	if ns.BlastPathMaxBytes > 0 && total > ns.BlastPathMaxBytes {
+		panic(&request.HTTPError{
+			Status: http.StatusBadRequest,
+			Response: fmt.Sprintf(
+				"Requested ranges are larger than the maximum of %d "+
+					"bytes, please paginate the request.",
+				ns.BlastPathMaxBytes),
+		})
+	}
+
+	// Fetch the data out of the Storage instance.
+	content, err := ns.Storage.BlastPathReadRanges(parts[2], ranges)
+	if err != nil {
+		blastPathReadError(r, err)
+		return
+	}
+	defer content.Close()
+
+	// Success!
+	r.Header().Add("Content-type", "application/octet-stream")
+	r.WriteHeader(http.StatusOK)
+	io.Copy(r, content)
+}
+
+// BLASTTAIL requests are sent by a Blast Path server to follow a primary
+// file as it grows, like tail -f. The response starts with the data from
+// the requested offset and each insert is sent as it is written. Once the
+// primary stops accepting data the rest of it is sent and the response
+// ends with a Blast-Path-End trailer holding the final offset. A response
+// that ends without that trailer was cut short and can be resumed from the
+// last byte received.
+func (s *server) httpBlastTail(r *request.Request) {
+	parts := strings.Split(r.Request.URL.Path, "/")
+	if len(parts) != 4 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid BLASTTAIL request.",
+		})
+	}
+
+	// Convert the start byte string into an integer.
+	start, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Start byte is not valid.",
+		})
+	}
+
+	// Obtain the namespace for the given path.
+	settings := s.settings.Load()
+	ns, ok := settings.NameSpaces[parts[1]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+
+	// Verify that the caller is allowed to make this request.
+	ns.BlastPathACL.Assert(r)
+
+	// Start following the primary. The request's context is used so that
+	// the tail stops waiting if the caller goes away.
+	content, err := ns.Storage.BlastPathTail(
+		r.Request.Context(),
+		parts[2],
+		start)
+	if err != nil {
+		blastPathReadError(r, err)
+		return
+	}
+	defer content.Close()
+
+	// Stream the data to the caller, flushing after every read since the
+	// caller wants the data as soon as it is written. Writes block if the
+	// caller is slow, in which case the reader simply falls further behind
+	// the primary.
+	r.Header().Add("Content-type", "application/octet-stream")
+	r.Header().Set("Trailer", "Blast-Path-End")
+	r.WriteHeader(http.StatusOK)
+	r.Flush(settings.WriteTimeout)
+	offset := start
+	buffer := make([]byte, blastPathTailBuffer)
+	for {
+		n, err := content.Read(buffer)
+		if n > 0 {
+			if _, err := r.Write(buffer[:n]); err != nil {
+				return
+			}
+			offset += uint64(n)
+			r.Flush(settings.WriteTimeout)
+		}
+		if err == io.EOF {
+			r.Header().Set(
+				"Blast-Path-End",
+				strconv.FormatUint(offset, 10))
+			return
+		} else if err != nil {
+			if r.Request.Context().Err() == nil {
+				r.Log.LogAttrs(
+					r.Context,
+					slog.LevelError,
+					"Error reading the primary for a Blast Path tail.",
+					sloghelper.Error("error", err))
+			}
+			return
+		}
+	}
+}
+
+// Writes the response for an error returned from one of the Blast Path
+// read calls.
+func blastPathReadError(r *request.Request, err error) {
+	switch err.(type) {
+	case storage.ErrNotPossible, *storage.ErrNotPossible:
+		r.Header().Add("Content-Type", "text/plain")
+		r.WriteHeader(http.StatusBadRequest)
+		r.Write([]byte("Can not fetch objects from a compressed source."))
+	default:
+		panic(err)
+	}
+}
+
 // BLASTSTATUS requests are sent by a Blast Path server to get the current
 // list of supported files so that they can be fetched as needed.
 func (s *server) httpBlastStatus(r *request.Request) {
@@ -423,7 +921,7 @@ func (s *server) httpBlastStatus(r *request.Request) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -440,6 +938,48 @@ func (s *server) httpBlastStatus(r *request.Request) {
 	ns.Storage.BlastPathStatus(r)
 }
 
+// BLASTLIST requests are sent by systems that index what this server is
+// holding. Unlike BLASTSTATUS this includes replicas as well as primaries,
+// and the response is streamed as JSON Lines with one file per line.
+func (s *server) httpBlastList(r *request.Request) {
+	parts := strings.Split(r.Request.URL.Path, "/")
+	if len(parts) != 2 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid BLASTLIST path.",
+		})
+	}
+
+	// Obtain the namespace for the given path.
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+
+	// Verify that the caller is allowed to make this request.
+	ns.BlastPathACL.Assert(r)
+
+	// Stream the list. Once the headers are written there is no way to
+	// report an error so a failed write just ends the response early.
+	r.Header().Add("Content-Type", "application/x-ndjson")
+	r.WriteHeader(http.StatusOK)
+	ns.Storage.BlastPathList(r)
+}
+
+// The DELETE handler must separate user deletes from the replica deletes
+// that are sent between servers.
+func (s *server) httpDeleteMuxer(ir *request.Request) {
+	parts := strings.Split(ir.Request.URL.Path, "/")
+	if len(parts) > 1 && parts[1] == "_delete" {
+		s.httpUserDelete(ir, parts)
+	} else {
+		s.httpDelete(ir)
+	}
+}
+
 // DELETE requests are sent by a Blobby server to another Blobby server
 // in order to delete a replica file from disk.
 func (s *server) httpDelete(r *request.Request) {
@@ -452,7 +992,7 @@ func (s *server) httpDelete(r *request.Request) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -479,10 +1019,71 @@ func (s *server) httpDelete(r *request.Request) {
 	r.WriteHeader(http.StatusNoContent)
 }
 
+// DELETE requests to /_delete/<namespace>/<id> are sent by users in order to
+// remove uploaded data. IDs do not have files of their own so this deletes
+// the whole file that holds the ID, which removes the data for every other
+// ID in the file as well. Files that are still accepting writes or have not
+// been uploaded yet can not be deleted and return a 409. Deletes are only
+// allowed if the name space has a delete ACL.
+func (s *server) httpUserDelete(r *request.Request, parts []string) {
+	if len(parts) != 4 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid delete path.",
+		})
+	}
+
+	// Obtain the namespace for the given path.
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+
+	// Verify that the caller is allowed to make this request.
+	if ns.DeleteACL == nil {
+		panic(&request.HTTPError{
+			Status:   http.StatusForbidden,
+			Response: "Deletes are not enabled for this name space.",
+		})
+	}
+	ns.DeleteACL.Assert(r)
+
+	// Perform the delete.
+	if err := ns.Storage.Delete(r.Context, parts[3]); err != nil {
+		if _, ok := err.(storage.ErrInvalidID); ok {
+			panic(&request.HTTPError{
+				Status:   http.StatusBadRequest,
+				Response: "The given ID is not valid.",
+			})
+		} else if _, ok := err.(storage.ErrNotFound); ok {
+			panic(&request.HTTPError{
+				Status:   http.StatusNotFound,
+				Response: "The requested ID was not found.",
+			})
+		} else if _, ok := err.(storage.ErrFileInUse); ok {
+			panic(&request.HTTPError{
+				Status: http.StatusConflict,
+				Response: "The file holding the ID is still being written " +
+					"or uploaded.",
+			})
+		} else {
+			panic(err)
+		}
+	}
+
+	// Success!
+	r.WriteHeader(http.StatusNoContent)
+}
+
 // GET requests are used to fetch the contents of an ID from a given namespace.
 // This call may also be forwarded from another blobby server if it is
 // attempting to route the request back to the server that created it so that
-// it can be served locally.
+// it can be served locally. HEAD requests are processed the same way but
+// only check that the data exists, the data is never opened since the
+// length is already known from the ID.
 func (s *server) httpGet(r *request.Request, parts []string) {
 	// If the server is shutting down then we need to indicate to the client
 	// that they should close the TCP session once this request completes.
@@ -499,7 +1100,7 @@ func (s *server) httpGet(r *request.Request, parts []string) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -521,9 +1122,55 @@ func (s *server) httpGet(r *request.Request, parts []string) {
 		})
 	}
 
+	// The contents of an id never change so the id of the whole object
+	// makes a strong ETag. The gzip encoded response is a different
+	// representation so it gets its own ETag, and since the representation
+	// depends on Accept-Encoding caches are told to vary on it. If the
+	// client already has the object then there is no need to read it at all.
+	etag := `"` + f.ID(start, length) + `"`
+	gzipETag := `"` + f.ID(start, length) + `-gzip"`
+	r.Header().Set("Vary", "Accept-Encoding")
+	inm := r.Request.Header.Values("If-None-Match")
+	if etagMatches(inm, etag) {
+		r.Header().Set("ETag", etag)
+		r.WriteHeader(http.StatusNotModified)
+		return
+	} else if acceptsGzip(r.Request) && etagMatches(inm, gzipETag) {
+		r.Header().Set("ETag", gzipETag)
+		r.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// If the client asked for a single range of the object then the read is
+	// narrowed to that range. The id is regenerated for the narrowed range
+	// as well so that reads forwarded to a remote only fetch the range. The
+	// id is always regenerated in the original encoding so that remotes
+	// that do not understand other encodings can still serve it.
+	id := f.ID(start, length)
+	status := http.StatusOK
+	if header := r.Request.Header.Get("Range"); header != "" {
+		offset, rangeLength, ok := parseRange(header, length)
+		if !ok {
+			r.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+			panic(&request.HTTPError{
+				Status:   http.StatusRequestedRangeNotSatisfiable,
+				Response: "The requested range is not satisfiable.",
+			})
+		}
+		r.Header().Set("Content-Range", fmt.Sprintf(
+			"bytes %d-%d/%d",
+			offset,
+			offset+rangeLength-1,
+			length))
+		start += uint64(offset)
+		length = rangeLength
+		id = f.ID(start, length)
+		status = http.StatusPartialContent
+	}
+
 	// We need to setup the readConfig object that will pass information
 	// into the Read implementation.
-	log := s.settings.Logger.With(
+	log := s.settings.Load().Logger.With(
 		sloghelper.String("namespace", parts[1]),
 		sloghelper.String("id", parts[2]),
 		sloghelper.Uint64("start", start),
@@ -531,7 +1178,7 @@ func (s *server) httpGet(r *request.Request, parts []string) {
 	)
 	rc := readConfig{
 		nameSpace: parts[1],
-		id:        parts[2],
+		id:        id,
 		fid:       f,
 		fidStr:    f.String(),
 		start:     start,
@@ -550,17 +1197,56 @@ func (s *server) httpGet(r *request.Request, parts []string) {
 		rc.localOnly = true
 	}
 
-	// Attempt to fetch the data from the Storage server.
-	content, err := ns.Storage.Read(r.Context, &rc)
-	if err != nil {
-		if _, ok := err.(storage.ErrNotPossible); ok {
+	// If the request has the "Blobby-Durable-Only" header set to true then
+	// the data will only be returned if it has already been uploaded to S3.
+	rc.durable = durableOnly(r.Request)
+
+	// HEAD requests are answered without reading any of the data. Data
+	// that is not local is confirmed to exist by asking the remote that
+	// created it, or S3, for just its headers.
+	if r.Request.Method == "HEAD" {
+		location, err := ns.Storage.Stat(r.Context, &rc)
+		if _, ok := err.(storage.ErrNotFound); ok {
 			r.Header().Add("Content-Type", "text/plain")
-			r.WriteHeader(http.StatusBadRequest)
-			r.Write([]byte("Can not fetch objects from a compressed source."))
+			r.WriteHeader(http.StatusNotFound)
 			return
-		} else if _, ok := err.(storage.ErrInvalidID); ok {
-			r.Header().Add("Content-Type", "text/plain")
-			r.WriteHeader(http.StatusBadRequest)
+		} else if err != nil {
+			panic(err)
+		}
+		r.AddAccessLogAttrs(sloghelper.String("read-source", location.Source))
+		r.Header().Add("Content-type", "text/plain")
+		r.Header().Set("Accept-Ranges", "bytes")
+		r.Header().Set("ETag", etag)
+		r.Header().Set(
+			"Content-Length",
+			strconv.FormatUint(uint64(length), 10))
+		r.WriteHeader(status)
+		return
+	}
+
+	// If the client can decode gzip then a request for a whole compressed
+	// object can be served without decompressing it. This is not done for
+	// range requests since the lengths would not match.
+	if status == http.StatusOK {
+		rc.gzip = acceptsGzip(r.Request)
+	}
+
+	// Attempt to fetch the data from the Storage server. The ReadInfo is
+	// filled in as the read is served so that the access log can record
+	// where the data came from.
+	info := storage.ReadInfo{}
+	content, err := ns.Storage.Read(
+		storage.NewReadInfoContext(r.Context, &info),
+		&rc)
+	if err != nil {
+		if _, ok := err.(storage.ErrNotPossible); ok {
+			r.Header().Add("Content-Type", "text/plain")
+			r.WriteHeader(http.StatusBadRequest)
+			r.Write([]byte("Can not fetch objects from a compressed source."))
+			return
+		} else if _, ok := err.(storage.ErrInvalidID); ok {
+			r.Header().Add("Content-Type", "text/plain")
+			r.WriteHeader(http.StatusBadRequest)
 			r.Write([]byte("The provided ID is not valid."))
 			return
 		} else if _, ok := err.(storage.ErrNotFound); ok {
@@ -568,24 +1254,100 @@ func (s *server) httpGet(r *request.Request, parts []string) {
 			r.WriteHeader(http.StatusNotFound)
 			r.Write([]byte("The requested ID was not found."))
 			return
+		} else if _, ok := err.(storage.ErrNotDurable); ok {
+			r.Header().Add("Content-Type", "text/plain")
+			r.WriteHeader(http.StatusTooEarly)
+			r.Write([]byte("The requested ID is not yet durable."))
+			return
+		} else if _, ok := err.(storage.ErrS3Timeout); ok {
+			r.Header().Add("Content-Type", "text/plain")
+			r.WriteHeader(http.StatusGatewayTimeout)
+			r.Write([]byte(err.Error()))
+			return
 		} else {
 			panic(err)
 		}
 	}
 	defer content.Close()
+	defer func() {
+		r.AddAccessLogAttrs(
+			sloghelper.String("read-source", info.Source),
+			sloghelper.Int64("bytes-served", info.BytesServed))
+	}()
 
 	// Success!
 	r.Header().Add("Content-type", "text/plain")
-	r.WriteHeader(http.StatusOK)
+	r.Header().Set("Accept-Ranges", "bytes")
+	if encoded, ok := content.(*storage.EncodedReadCloser); ok {
+		r.Header().Set("Content-Encoding", encoded.ContentEncoding)
+		etag = gzipETag
+	}
+	r.Header().Set("ETag", etag)
+	r.WriteHeader(status)
 	io.Copy(r, content)
 }
 
+// Returns true if any of the entity tags in the given If-None-Match headers
+// match etag. Weak tags are compared as if they were strong as RFC 9110
+// requires for If-None-Match. A * is not treated as a match since that
+// would require checking that the object exists.
+func etagMatches(headers []string, etag string) bool {
+	for _, header := range headers {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parses the value of a Range header for an object of the given size and
+// returns the offset and length of the requested range within the object.
+// Only a single range in bytes is supported, ok will be false if the header
+// is not valid or the range can not be satisfied.
+func parseRange(header string, size uint32) (offset, length uint32, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		// A suffix range asks for the final bytes of the object.
+		n, err := strconv.ParseUint(last, 10, 64)
+		if err != nil || n == 0 || size == 0 {
+			return 0, 0, false
+		} else if n > uint64(size) {
+			n = uint64(size)
+		}
+		return size - uint32(n), uint32(n), true
+	}
+	start, err := strconv.ParseUint(first, 10, 64)
+	if err != nil || start >= uint64(size) {
+		return 0, 0, false
+	}
+	end := uint64(size) - 1
+	if last != "" {
+		e, err := strconv.ParseUint(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, false
+		} else if e < end {
+			end = e
+		}
+	}
+	return uint32(start), uint32(end - start + 1), true
+}
+
 // Returns health status of the server. This is useful for load balancing
 // and traffic management.
 func (s *server) httpGetHealth(r *request.Request) {
 	status := http.StatusOK
 	output := bytes.Buffer{}
-	for name, ns := range s.settings.NameSpaces {
+	for name, ns := range s.settings.Load().NameSpaces {
 		if ok, desc := ns.Storage.Health(); ok {
 			output.WriteString(name)
 			output.WriteString(": OK\n")
@@ -622,7 +1384,7 @@ func (s *server) httpHeartBeat(r *request.Request) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -651,9 +1413,18 @@ func (s *server) httpHeartBeat(r *request.Request) {
 	}
 
 	// Success!
+	setDiskUsage(r, ns)
 	r.WriteHeader(http.StatusNoContent)
 }
 
+// Lets the primary know how full the disk holding the name space is so
+// that it can avoid assigning new replicas to this server as it fills up.
+func setDiskUsage(r *request.Request, ns *NameSpaceSettings) {
+	if used, err := ns.Storage.DiskUsage(); err == nil {
+		r.Header().Set("Disk-Used", strconv.FormatFloat(used, 'f', 4, 64))
+	}
+}
+
 // The ID tool is a simple helper that will expose information about a specific
 // passed in ID. This can be used to show the server that generated it, the
 // status of the file (if local), the eventual S3 filename, etc.
@@ -673,7 +1444,7 @@ func (s *server) httpID(r *request.Request) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[2]]
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -681,12 +1452,143 @@ func (s *server) httpID(r *request.Request) {
 		})
 	}
 
+	// Scripts can ask for the information as JSON, otherwise the text
+	// output is returned.
+	if acceptsJSON(r.Request) {
+		info, err := ns.Storage.ExplainID(parts[3])
+		if err != nil {
+			panic(&request.HTTPError{
+				Status:   http.StatusBadRequest,
+				Response: "Invalid ID: " + err.Error(),
+			})
+		}
+		r.Header().Add("Content-Type", "application/json")
+		r.WriteHeader(http.StatusOK)
+		json.NewEncoder(r).Encode(info)
+		return
+	}
+
 	// Call the namespace looking for debug information about the ID given.
 	r.Header().Add("Content-Type", "text/plain")
 	r.WriteHeader(http.StatusOK)
 	ns.Storage.DebugID(r, parts[3])
 }
 
+// Reports where a GET for the given ID would be served from without reading
+// any of the data. The path is /_locate/<namespace>/<id> and the location is
+// returned as JSON. This is guarded by the read ACL of the namespace since
+// it is intended for clients deciding which reads to warm up.
+func (s *server) httpLocate(r *request.Request, parts []string) {
+	// If the server is shutting down then we need to indicate to the client
+	// that they should close the TCP session once this request completes.
+	if atomic.LoadInt32(&s.shuttingDown) != 0 {
+		r.Header().Add("Connection", "close")
+	}
+
+	if len(parts) != 4 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Expected path: /_locate/<namespace>/<id>",
+		})
+	}
+
+	// Obtain the namespace for the given path.
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+	ns.ReadACL.Assert(r)
+
+	f, start, length, err := fid.ParseID(parts[3])
+	if err != nil {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "The given ID is not valid.",
+		})
+	}
+	rc := readConfig{
+		nameSpace: parts[2],
+		id:        f.ID(start, length),
+		fid:       f,
+		fidStr:    f.String(),
+		start:     start,
+		length:    length,
+		machine:   f.Machine(),
+		acl:       ns.ReadACL,
+		request:   r.Request,
+		logger:    s.settings.Load().Logger,
+		localOnly: r.Request.Header.Get("Blobby-Local-Only") != "",
+		durable:   durableOnly(r.Request),
+	}
+
+	location, err := ns.Storage.Locate(&rc)
+	if _, ok := err.(storage.ErrNotFound); ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "The given ID is not stored locally.",
+		})
+	} else if err != nil {
+		panic(err)
+	}
+	r.Header().Add("Content-Type", "application/json")
+	r.WriteHeader(http.StatusOK)
+	json.NewEncoder(r).Encode(location)
+}
+
+// Returns true if the Blobby-Durable-Only header of the request is set to a
+// true value as accepted by strconv.ParseBool. A value that can not be
+// parsed is rejected rather than guessed at, since treating "false" as set
+// would silently turn away reads that should have been served.
+func durableOnly(r *http.Request) bool {
+	header := r.Header.Get("Blobby-Durable-Only")
+	if header == "" {
+		return false
+	}
+	durable, err := strconv.ParseBool(header)
+	if err != nil {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid Blobby-Durable-Only header.",
+		})
+	}
+	return durable
+}
+
+// Returns true if the Accept header of the request lists application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(part)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if the Accept-Encoding header of the request allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(accept, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			if strings.TrimSpace(coding) != "gzip" {
+				continue
+			}
+			q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !found {
+				return true
+			} else if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *server) httpInitialize(r *request.Request) {
 	// INITIALIZE requests are sent by a Blobby server to another Blobby
 	// server. In order to initialize a new replica file.
@@ -708,7 +1610,7 @@ func (s *server) httpInitialize(r *request.Request) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -725,9 +1627,16 @@ func (s *server) httpInitialize(r *request.Request) {
 	}
 
 	// Success!
+	setDiskUsage(r, ns)
 	r.WriteHeader(http.StatusNoContent)
 }
 
+// POST requests insert the body into the namespace and return the ID that
+// it was stored under. If the namespace has idempotency keys enabled then
+// the client can send an Idempotency-Key header and a retry with the same
+// key returns the original ID rather than storing the data again. This is
+// only guaranteed if the retry arrives within the namespace's TTL and is
+// sent to the same server.
 func (s *server) httpInsert(r *request.Request, parts []string) {
 	// If the server is shutting down then we need to indicate to the client
 	// that they should close the TCP session once this request completes.
@@ -746,7 +1655,7 @@ func (s *server) httpInsert(r *request.Request, parts []string) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -757,14 +1666,61 @@ func (s *server) httpInsert(r *request.Request, parts []string) {
 	// Verify that the caller is actually allowed to make this request.
 	ns.InsertACL.Assert(r)
 
-	// Attempt to insert the data into the Blobby instance.
+	// Batches of records are processed separately.
+	if r.Request.Header.Get("Blobby-Batch") != "" {
+		s.httpInsertBatch(r, ns)
+		return
+	}
+
+	// Attempt to insert the data into the Blobby instance. If the client
+	// supplied an idempotency key then a retry of an earlier insert will
+	// return the original ID instead.
 	data := storage.InsertData{
-		Source: r.Request.Body,
-		Length: r.Request.ContentLength,
-		Tracer: r.Tracer(),
+		Source:         r.Request.Body,
+		Length:         r.Request.ContentLength,
+		IdempotencyKey: r.Request.Header.Get("Idempotency-Key"),
+		Hash:           r.Request.Header.Get("Blobby-Hash"),
+		Tracer:         r.Tracer(),
 	}
 	id, err := ns.Storage.Insert(r.Context, &data)
-	if err != nil {
+	if _, ok := err.(storage.ErrDiskFull); ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusInsufficientStorage,
+			Response: err.Error(),
+		})
+	} else if _, ok := err.(storage.ErrDraining); ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusServiceUnavailable,
+			Response: err.Error(),
+		})
+	} else if _, ok := err.(storage.ErrReadOnly); ok {
+		r.Header().Set("Retry-After", readOnlyRetryAfter)
+		panic(&request.HTTPError{
+			Status:   http.StatusServiceUnavailable,
+			Response: err.Error(),
+		})
+	} else if _, ok := err.(storage.ErrRecordTooLarge); ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusRequestEntityTooLarge,
+			Response: err.Error(),
+		})
+	} else if _, ok := err.(storage.ErrInsertQueueTimeout); ok {
+		r.Header().Set("Retry-After", queueTimeoutRetryAfter)
+		panic(&request.HTTPError{
+			Status:   http.StatusServiceUnavailable,
+			Response: err.Error(),
+		})
+	} else if _, ok := err.(storage.ErrHashMismatch); ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: err.Error(),
+		})
+	} else if _, ok := err.(storage.ErrInvalidHash); ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: err.Error(),
+		})
+	} else if err != nil {
 		panic(err)
 	}
 
@@ -774,6 +1730,71 @@ func (s *server) httpInsert(r *request.Request, parts []string) {
 	r.Write([]byte(id))
 }
 
+// Inserts a batch of records sent in a single POST. Each record in the body
+// is framed as its length in bytes written in decimal followed by a newline
+// and then the data itself. Every record is inserted on its own so a batch
+// can span several primaries without holding any of them for the whole
+// batch.
+//
+// The response contains one line per record in the order that they were
+// sent. The line is the ID of the record if it was inserted, or "ERROR "
+// followed by the reason if it was not. If the framing of the body is
+// invalid then processing stops and a final ERROR line is written for the
+// record that could not be read, any records after that were not inserted
+// and have no line at all. The number of ERROR lines is returned in the
+// Blobby-Batch-Errors header.
+func (s *server) httpInsertBatch(r *request.Request, ns *NameSpaceSettings) {
+	body := bufio.NewReader(r.Request.Body)
+	output := bytes.Buffer{}
+	failed := 0
+	for {
+		line, err := body.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil {
+			output.WriteString("ERROR Error reading the record length.\n")
+			failed++
+			break
+		}
+		length, err := strconv.ParseUint(strings.TrimSpace(line), 10, 31)
+		if err != nil {
+			output.WriteString("ERROR Invalid record length.\n")
+			failed++
+			break
+		}
+
+		// Insert the record and then discard anything that was not consumed
+		// by the insert so the next record starts at the right place.
+		record := &io.LimitedReader{R: body, N: int64(length)}
+		id, err := ns.Storage.Insert(r.Context, &storage.InsertData{
+			Source: record,
+			Length: int64(length),
+			Tracer: r.Tracer(),
+		})
+		if err != nil {
+			output.WriteString("ERROR ")
+			output.WriteString(strings.ReplaceAll(err.Error(), "\n", " "))
+			output.WriteString("\n")
+			failed++
+		} else {
+			output.WriteString(id)
+			output.WriteString("\n")
+		}
+		if _, err := io.Copy(io.Discard, record); err != nil || record.N > 0 {
+			// The body failed or ended part way through the record. Insert
+			// never succeeds on a short read so an ERROR line has already
+			// been written for it.
+			break
+		}
+	}
+
+	// Success!
+	r.Header().Add("Content-type", "text/plain")
+	r.Header().Set("Blobby-Batch-Errors", strconv.Itoa(failed))
+	r.WriteHeader(http.StatusOK)
+	r.Write(output.Bytes())
+}
+
 func (s *server) httpReplicate(r *request.Request) {
 	// REPLICATE requests are sent by a Blobby server to another Blobby server.
 	// The append data into a replica file. As such the path will require
@@ -787,7 +1808,7 @@ func (s *server) httpReplicate(r *request.Request) {
 	}
 
 	// Obtain the namespace for the given path.
-	ns, ok := s.settings.NameSpaces[parts[1]]
+	ns, ok := s.settings.Load().NameSpaces[parts[1]]
 	if !ok {
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
@@ -798,6 +1819,13 @@ func (s *server) httpReplicate(r *request.Request) {
 	// Verify that the caller is allowed to make this request.
 	ns.PrimaryACL.Assert(r)
 
+	// A primary that is tracing its insert asks the replica to trace the
+	// replication too. This is only honored once the caller is known to be
+	// a primary so that other clients can not force tracing on.
+	if r.Tracer() == nil && r.Request.Header.Get("Blobby-Trace") != "" {
+		r.AddTracer()
+	}
+
 	// Create the replicator from the values provided in the request headers.
 	rc := remoteReplicatorConfig{
 		body:      r.Request.Body,
@@ -806,6 +1834,7 @@ func (s *server) httpReplicate(r *request.Request) {
 		hash:      r.HashHeader(),
 		namespace: parts[1],
 		start:     r.Uint64Header("Start"),
+		trace:     r.Tracer(),
 	}
 
 	// Perform the replicate call.
@@ -815,11 +1844,35 @@ func (s *server) httpReplicate(r *request.Request) {
 				Status:   http.StatusNotFound,
 				Response: "That replica does not exist.",
 			})
+		} else if _, ok := err.(storage.ErrRecordTooLarge); ok {
+			panic(&request.HTTPError{
+				Status:   http.StatusRequestEntityTooLarge,
+				Response: err.Error(),
+			})
+		} else if behind, ok := err.(storage.ErrReplicaBehind); ok {
+			// Let the primary know where the replica is so that it can
+			// resend the missing data.
+			r.Header().Set(
+				"Replica-Offset",
+				strconv.FormatUint(uint64(behind), 10))
+			panic(&request.HTTPError{
+				Status:   http.StatusConflict,
+				Response: err.Error(),
+			})
 		} else {
 			panic(err)
 		}
 	}
 
+	// If the primary is tracing this request then let it know how long
+	// the replica spent processing it so it can be included in the
+	// primaries trace.
+	if t := r.Tracer(); t != nil {
+		r.Header().Set(
+			"Blobby-Trace-Duration",
+			strconv.FormatInt(int64(t.Duration()), 10))
+	}
+
 	// Success.
 	r.WriteHeader(http.StatusNoContent)
 }
@@ -843,14 +1896,14 @@ func (s *server) httpSAMLAuth(r *request.Request, parts []string) {
 			Status:   http.StatusNotFound,
 			Response: "Invalid SAML authentication return path.",
 		})
-	} else if s.settings.SAMLAuth == nil {
+	} else if s.settings.Load().SAMLAuth == nil {
 		// If there is not any SAML endpoints even configured then we
 		// can just 404 here as well.
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
 			Response: "SAML Logins are not configured on this server.",
 		})
-	} else if saml, ok := s.settings.SAMLAuth[parts[2]]; !ok {
+	} else if saml, ok := s.settings.Load().SAMLAuth[parts[2]]; !ok {
 		// The given SAML destination is not configured, we can 404
 		// the request.
 		panic(&request.HTTPError{
@@ -881,14 +1934,14 @@ func (s *server) httpSAMLMetadata(r *request.Request, parts []string) {
 			Status:   http.StatusNotFound,
 			Response: "Invalid SAML meta data path.",
 		})
-	} else if s.settings.SAMLAuth == nil {
+	} else if s.settings.Load().SAMLAuth == nil {
 		// If there is not any SAML endpoints even configured then we
 		// can just 404 here as well.
 		panic(&request.HTTPError{
 			Status:   http.StatusNotFound,
 			Response: "SAML Logins are not configured on this server.",
 		})
-	} else if saml, ok := s.settings.SAMLAuth[parts[2]]; !ok {
+	} else if saml, ok := s.settings.Load().SAMLAuth[parts[2]]; !ok {
 		// The given SAML destination is not configured, we can 404
 		// the request.
 		panic(&request.HTTPError{
@@ -901,6 +1954,203 @@ func (s *server) httpSAMLMetadata(r *request.Request, parts []string) {
 	}
 }
 
+// Scrubs the local files of a name space, checking every insert against the
+// hash that was computed when it was written. The path is
+// /_scrub/<namespace> and the results are returned as JSON once the scrub
+// completes.
+func (s *server) httpScrub(r *request.Request, parts []string) {
+	if len(parts) != 3 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid scrub path.",
+		})
+	}
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+	result, err := ns.Storage.Scrub(r.Context)
+	if err != nil {
+		panic(err)
+	}
+	r.Header().Add("Content-Type", "application/json")
+	r.WriteHeader(http.StatusOK)
+	json.NewEncoder(r).Encode(result)
+}
+
+// Queues every local replica of a name space that is safe to upload for an
+// immediate upload, for example after an object store outage. The path is
+// /_reupload/<namespace> and a summary of the files that were requeued is
+// returned as JSON. Files that are already uploading are left alone so
+// calling this repeatedly is safe.
+func (s *server) httpReupload(r *request.Request, parts []string) {
+	if len(parts) != 3 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid reupload path.",
+		})
+	}
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+	result := ns.Storage.Reupload(r.Context)
+	r.Header().Add("Content-Type", "application/json")
+	r.WriteHeader(http.StatusOK)
+	json.NewEncoder(r).Encode(result)
+}
+
+// Starts uploading a single primary right away rather than waiting for it
+// to expire, which is useful when debugging. The path is
+// /_flush/<namespace>/<fid>. Primaries that are not waiting for inserts are
+// left alone and the response says so.
+func (s *server) httpFlush(r *request.Request, parts []string) {
+	if len(parts) != 4 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid flush path.",
+		})
+	}
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+	flushed, state, err := ns.Storage.Flush(r.Context, parts[3])
+	if _, ok := err.(storage.ErrNotFound); ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: parts[3] + " is not a primary on this server.",
+		})
+	} else if err != nil {
+		panic(err)
+	}
+	r.Header().Add("Content-Type", "text/plain")
+	r.WriteHeader(http.StatusOK)
+	if flushed {
+		fmt.Fprintf(r, "%s was flushed and is now %s.\n", parts[3], state)
+	} else {
+		fmt.Fprintf(
+			r,
+			"%s is %s and is not waiting for inserts, nothing was done.\n",
+			parts[3],
+			state)
+	}
+}
+
+// Enables or disables inserts into a namespace while leaving reads,
+// replication and uploads running, for example during maintenance. The path
+// is /_readonly/<namespace>/enable, /_readonly/<namespace>/disable or
+// /_readonly/<namespace>/status, with status being the default. The state
+// is not persisted so it is lost when the server restarts.
+func (s *server) httpReadOnly(r *request.Request, parts []string) {
+	if len(parts) != 3 && len(parts) != 4 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid read only path.",
+		})
+	}
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+	action := "status"
+	if len(parts) == 4 {
+		action = parts[3]
+	}
+	switch action {
+	case "enable":
+		ns.Storage.SetReadOnly(true)
+	case "disable":
+		ns.Storage.SetReadOnly(false)
+	case "status":
+	default:
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid read only path.",
+		})
+	}
+	r.Header().Add("Content-Type", "text/plain")
+	r.WriteHeader(http.StatusOK)
+	if ns.Storage.ReadOnly() {
+		fmt.Fprintf(r, "%s is read only.\n", parts[2])
+	} else {
+		fmt.Fprintf(r, "%s is accepting inserts.\n", parts[2])
+	}
+}
+
+// Reports or changes the size and age at which new primaries in a name space
+// are queued for upload. The path is /_upload_thresholds/<namespace>, a GET
+// returns the current thresholds and a POST changes them using the
+// larger_than (in bytes) and older (a Go duration) query parameters. Either
+// parameter can be left out to keep its current value. Primaries that are
+// already open keep the thresholds that they were opened with.
+func (s *server) httpUploadThresholds(r *request.Request, parts []string) {
+	if len(parts) != 3 {
+		panic(&request.HTTPError{
+			Status:   http.StatusBadRequest,
+			Response: "Invalid upload thresholds path.",
+		})
+	}
+	ns, ok := s.settings.Load().NameSpaces[parts[2]]
+	if !ok {
+		panic(&request.HTTPError{
+			Status:   http.StatusNotFound,
+			Response: "Name space does not exist.",
+		})
+	}
+	largerThan, older := ns.Storage.UploadThresholds()
+	if r.Request.Method == "POST" {
+		query := r.Request.URL.Query()
+		if raw := query.Get("larger_than"); raw != "" {
+			var err error
+			if largerThan, err = strconv.ParseUint(raw, 10, 64); err != nil {
+				panic(&request.HTTPError{
+					Status:   http.StatusBadRequest,
+					Response: "larger_than must be a number of bytes.",
+				})
+			}
+		}
+		if raw := query.Get("older"); raw != "" {
+			var err error
+			if older, err = time.ParseDuration(raw); err != nil {
+				panic(&request.HTTPError{
+					Status:   http.StatusBadRequest,
+					Response: "older must be a duration.",
+				})
+			}
+		}
+		err := ns.Storage.SetUploadThresholds(largerThan, older)
+		if _, ok := err.(storage.ErrOutOfRange); ok {
+			panic(&request.HTTPError{
+				Status:   http.StatusBadRequest,
+				Response: err.Error(),
+			})
+		} else if err != nil {
+			panic(err)
+		}
+	}
+	r.Header().Add("Content-Type", "text/plain")
+	r.WriteHeader(http.StatusOK)
+	fmt.Fprintf(
+		r,
+		"%s uploads new primaries larger than %d bytes or older than %s.\n",
+		parts[2],
+		largerThan,
+		older)
+}
+
 // Sets this server into shutting down mode which will attempt to push traffic
 // off the server so it can be safely restarted.
 func (s *server) httpShutDown(r *request.Request, parts []string) {
@@ -915,9 +2165,41 @@ func (s *server) httpShutDown(r *request.Request, parts []string) {
 			fmt.Fprintf(r, "server is shutting down.\n")
 		}
 		return
+	case len(parts) == 3 && parts[2] == "drain":
+		// Draining shuts down every primary so that all of the data is
+		// uploaded. This can be called repeatedly to poll until nothing
+		// is left pending, at which point the server can be stopped.
+		atomic.StoreInt32(&s.shuttingDown, 1)
+		nameSpaces := make([]string, 0, len(s.settings.Load().NameSpaces))
+		for name := range s.settings.Load().NameSpaces {
+			nameSpaces = append(nameSpaces, name)
+		}
+		sort.Strings(nameSpaces)
+		output := bytes.Buffer{}
+		total := 0
+		for _, name := range nameSpaces {
+			st := s.settings.Load().NameSpaces[name].Storage
+			st.Drain(r.Context)
+			primaries, replicas := st.Pending()
+			total += primaries + replicas
+			fmt.Fprintf(
+				&output,
+				"%s: %d primaries and %d replicas pending.\n",
+				name,
+				primaries,
+				replicas)
+		}
+		r.Header().Add("Content-Type", "text/plain")
+		r.WriteHeader(http.StatusOK)
+		r.Write(output.Bytes())
+		fmt.Fprintf(r, "pending: %d\n", total)
+		return
 	case len(parts) == 3 && parts[2] == "stop":
 		r.Header().Add("Content-Type", "text/plain")
 		r.WriteHeader(http.StatusOK)
+		for _, ns := range s.settings.Load().NameSpaces {
+			ns.Storage.Resume()
+		}
 		old := atomic.SwapInt32(&s.shuttingDown, 0)
 		if old == 0 {
 			fmt.Fprintf(r, "server was not shutting down.\n")
@@ -941,20 +2223,63 @@ func (s *server) httpShutDown(r *request.Request, parts []string) {
 	}
 }
 
-// Returns the current status of the Storage implementations.
+// Returns the details of the build that this server is running. Scripts can
+// ask for the details as JSON, otherwise they are returned as text.
+func (s *server) httpVersion(r *request.Request) {
+	info := buildinfo.Get()
+	if acceptsJSON(r.Request) {
+		r.Header().Add("Content-Type", "application/json")
+		r.WriteHeader(http.StatusOK)
+		json.NewEncoder(r).Encode(&info)
+		return
+	}
+	r.Header().Add("Content-Type", "text/plain")
+	r.WriteHeader(http.StatusOK)
+	fmt.Fprintf(r, "version: %s\n", info.Version)
+	fmt.Fprintf(r, "commit: %s\n", info.Commit)
+	fmt.Fprintf(r, "build_time: %s\n", info.TimeEpoch)
+	fmt.Fprintf(r, "go_version: %s\n", info.GoVersion)
+}
+
+// Returns the current status of the Storage implementations. Scripts can
+// ask for the status as JSON, otherwise a human readable text status is
+// returned.
 func (s *server) httpStatus(r *request.Request) {
+	settings := s.settings.Load()
+	nameSpaces := make([]string, 0, len(settings.NameSpaces))
+	for name := range settings.NameSpaces {
+		nameSpaces = append(nameSpaces, name)
+	}
+	sort.Strings(nameSpaces)
+
+	if acceptsJSON(r.Request) {
+		status := struct {
+			ShuttingDown bool                       `json:"shutting_down"`
+			NameSpaces   map[string]json.RawMessage `json:"namespaces"`
+		}{
+			ShuttingDown: atomic.LoadInt32(&s.shuttingDown) != 0,
+			NameSpaces:   make(map[string]json.RawMessage, len(nameSpaces)),
+		}
+		for _, name := range nameSpaces {
+			buffer := bytes.Buffer{}
+			settings.NameSpaces[name].Storage.Status(
+				&buffer,
+				storage.StatusFormatJSON)
+			status.NameSpaces[name] = buffer.Bytes()
+		}
+		r.Header().Add("Content-Type", "application/json")
+		r.WriteHeader(http.StatusOK)
+		json.NewEncoder(r).Encode(&status)
+		return
+	}
+
 	r.WriteHeader(http.StatusOK)
 	if atomic.LoadInt32(&s.shuttingDown) != 0 {
 		fmt.Fprintf(r, "This server is shutting down.\n\n")
 	}
-	nameSpaces := make([]string, 0, len(s.settings.NameSpaces))
-	for name := range s.settings.NameSpaces {
-		nameSpaces = append(nameSpaces, name)
-	}
-	sort.Strings(nameSpaces)
 	for _, name := range nameSpaces {
 		fmt.Fprintf(r, "%s:\n", name)
-		s.settings.NameSpaces[name].Storage.Status(r)
+		settings.NameSpaces[name].Storage.Status(r, storage.StatusFormatText)
 	}
 }
 
@@ -966,15 +2291,25 @@ func (s *server) httpMetrics(r *request.Request) {
 	// allNameSpaceMetrics holds the Metrics structs for every namespace:
 	allNameSpaceMetrics := make(
 		map[string]metrics.Metrics,
-		len(s.settings.NameSpaces))
+		len(s.settings.Load().NameSpaces))
 
 	fmt.Fprintf(r, "# TYPE shutting_down gauge\n")
 	fmt.Fprintf(r, "# HELP shutting_down Is blobby shutting down\n")
 	fmt.Fprintf(r, "shutting_down %d\n\n", atomic.LoadInt32(&s.shuttingDown))
 
+	info := buildinfo.Get()
+	fmt.Fprintf(r, "# TYPE build_info gauge\n")
+	fmt.Fprintf(r, "# HELP build_info The build of blobby that is running\n")
+	fmt.Fprintf(
+		r,
+		"build_info{version=%q,commit=%q,go_version=%q} 1\n\n",
+		info.Version,
+		info.Commit,
+		info.GoVersion)
+
 	fmt.Fprintf(r, "# TYPE namespaces_healthy gauge\n")
 	fmt.Fprintf(r, "# HELP namespaces_healthy Number of healhty namespaces\n")
-	for name, ns := range s.settings.NameSpaces {
+	for name, ns := range s.settings.Load().NameSpaces {
 		healthy := 0
 		if ok, _ := ns.Storage.Health(); ok {
 			healthy = 1
@@ -984,7 +2319,7 @@ func (s *server) httpMetrics(r *request.Request) {
 		fmt.Fprintf(
 			r,
 			`namespaces_healthy{%snamespace="%s"} %d`,
-			s.settings.PrometheusTagPrefix,
+			s.settings.Load().PrometheusTagPrefix,
 			name,
 			healthy)
 		r.Write([]byte{'\n'})
@@ -992,15 +2327,31 @@ func (s *server) httpMetrics(r *request.Request) {
 	}
 	r.Write([]byte{'\n'})
 
+	// Requests refused by ACL rate limits.
+	fmt.Fprintf(r, "# TYPE acl_throttled_requests counter\n")
+	fmt.Fprintf(r, "# HELP acl_throttled_requests Requests refused by an ACL rate limit\n")
+	for _, acl := range s.settings.Load().acls() {
+		if acl.RateLimit == nil {
+			continue
+		}
+		fmt.Fprintf(
+			r,
+			"acl_throttled_requests{%sacl=%q} %d\n",
+			s.settings.Load().PrometheusTagPrefix,
+			acl.Name,
+			atomic.LoadInt64(&acl.RateLimit.Throttled))
+	}
+	r.Write([]byte{'\n'})
+
 	// Generate all the storage specific prometheus metrics.
 	metrics.RenderPrometheus(
 		r,
-		s.settings.PrometheusTagPrefix,
+		s.settings.Load().PrometheusTagPrefix,
 		allNameSpaceMetrics)
 }
 
 // Gets the current certificate from the CertLoader and returns it to the
 // tls.Listen interface.
 func (s *server) cert(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-	return s.settings.TLSCerts.Cert(s.context)
+	return s.settings.Load().TLSCerts.Cert(s.context)
 }
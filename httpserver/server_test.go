@@ -0,0 +1,2200 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/httpserver/access"
+	"github.com/liquidgecka/blobby/httpserver/remotes"
+	"github.com/liquidgecka/blobby/internal/buildinfo"
+	"github.com/liquidgecka/blobby/internal/delayqueue"
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+	"github.com/liquidgecka/blobby/internal/workqueue"
+	"github.com/liquidgecka/blobby/storage"
+	"github.com/liquidgecka/blobby/storage/blastpath"
+	"github.com/liquidgecka/blobby/storage/fid"
+	"github.com/liquidgecka/blobby/storage/hasher"
+)
+
+func newTestServer(settings Settings) *server {
+	if settings.NameSpaces == nil {
+		settings.NameSpaces = map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{},
+		}
+	}
+	if settings.Logger == nil {
+		settings.Logger = slog.New(sloghelper.DiscardHandler{})
+	}
+	return New(&settings).(*server)
+}
+
+func TestServer_MaxConnectionLifetime(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newTestServer(Settings{MaxConnectionLifetime: time.Minute})
+
+	// Simulates a request arriving on a connection that was accepted at
+	// the given time.
+	serve := func(start time.Time) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("UNKNOWN", "/test", nil)
+		ctx := context.WithValue(req.Context(), connStartKey, start)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+
+	// A new connection should not be asked to close.
+	w := serve(time.Now())
+	T.Equal(w.Code, http.StatusMethodNotAllowed)
+	T.Equal(w.Header().Get("Connection"), "")
+
+	// A connection older than the limit should be.
+	w = serve(time.Now().Add(-time.Hour))
+	T.Equal(w.Code, http.StatusMethodNotAllowed)
+	T.Equal(w.Header().Get("Connection"), "close")
+
+	// And with the limit disabled nothing should be added.
+	s.settings.Load().MaxConnectionLifetime = 0
+	w = serve(time.Now().Add(-time.Hour))
+	T.Equal(w.Header().Get("Connection"), "")
+}
+
+func TestServer_Reload(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	localOnly := &access.ACL{
+		Required: []access.Method{
+			&access.WhiteList{
+				CIDRs: []net.IPNet{{
+					IP:   net.IPv4(127, 0, 0, 1),
+					Mask: net.IPv4Mask(255, 255, 255, 255),
+				}},
+			},
+		},
+	}
+	s := newTestServer(Settings{
+		Addr:          "127.0.0.1",
+		DebugPathsACL: localOnly,
+		ReadTimeout:   time.Minute,
+	})
+	debug := func() int {
+		req := httptest.NewRequest("GET", "/_debug/unknown", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The request does not come from localhost so it is rejected.
+	T.NotEqual(debug(), http.StatusNotFound)
+
+	// Once the ACL is removed the request makes it through to the handler.
+	T.ExpectSuccess(s.Reload(&Settings{
+		Addr:                "10.0.0.1",
+		PrometheusTagPrefix: "blobby_",
+		ReadTimeout:         time.Second,
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				DeleteACL: localOnly,
+				ReadACL:   localOnly,
+			},
+			"unknown": &NameSpaceSettings{ReadACL: localOnly},
+		},
+	}))
+	T.Equal(debug(), http.StatusNotFound)
+
+	// Only the reloadable fields should have been changed.
+	settings := s.settings.Load()
+	T.Equal(settings.Addr, "127.0.0.1")
+	T.Equal(settings.PrometheusTagPrefix, "blobby_")
+	T.Equal(settings.ReadTimeout, time.Second)
+	T.Equal(settings.NameSpaces["test"].DeleteACL, localOnly)
+	T.Equal(settings.NameSpaces["test"].ReadACL, localOnly)
+	T.Equal(len(settings.NameSpaces), 1)
+
+	// Invalid settings are rejected and leave the server untouched.
+	T.ExpectErrorMessage(
+		s.Reload(&Settings{ReadTimeout: -time.Second}),
+		"settings.ReadTimeout is negative.")
+	T.Equal(s.settings.Load(), settings)
+}
+
+func TestServer_BlastPathMaxBytes(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	dq := &delayqueue.DelayQueue{}
+	dq.Start()
+	defer dq.Stop()
+	st := storage.New(&storage.Settings{
+		AssignRemotes: func(int) ([]storage.Remote, error) {
+			return nil, nil
+		},
+		BaseDirectory:          T.TempDir(),
+		BaseLogger:             slog.New(sloghelper.DiscardHandler{}),
+		CompressWorkQueue:      workqueue.New(0),
+		DelayQueue:             dq,
+		DeleteLocalWorkQueue:   workqueue.New(0),
+		DeleteRemotesWorkQueue: workqueue.New(0),
+		Read: func(context.Context, storage.ReadConfig) (io.ReadCloser, error) {
+			return nil, fmt.Errorf("not implemented")
+		},
+		S3Bucket:        "bucket",
+		S3Client:        &s3.S3{},
+		UploadWorkQueue: workqueue.New(0),
+	})
+	T.ExpectSuccess(st.Start(context.Background()))
+
+	// Insert some data so there is a primary that can be read from.
+	data := []byte("0123456789abcdefghij")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	f, start, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				BlastPathMaxBytes: 10,
+				Storage:           st,
+			},
+		},
+	})
+	blastGet := func(start, end uint64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			"BLASTGET",
+			fmt.Sprintf("/test/%s/%d/%d", f.String(), start, end),
+			nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// A range larger than the limit should be rejected.
+	w := blastGet(start, start+uint64(len(data)))
+	T.Equal(w.Code, http.StatusBadRequest)
+
+	// A range within the limit should be served.
+	w = blastGet(start, start+10)
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), string(data[:10]))
+}
+
+func TestServer_BlastPathReadRanges(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	data := []byte("0123456789abcdefghij")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	f, start, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				BlastPathMaxBytes: 10,
+				Storage:           st,
+			},
+		},
+	})
+	blastMultiGet := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			"BLASTMULTIGET",
+			"/test/"+f.String(),
+			strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Each range is returned as a length prefixed segment.
+	w := blastMultiGet(fmt.Sprintf(
+		`[{"start":%d,"end":%d},{"start":%d,"end":%d}]`,
+		start+10, start+15,
+		start, start+3))
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/octet-stream")
+	body := w.Body.Bytes()
+	for _, want := range []string{"abcde", "012"} {
+		T.Equal(binary.BigEndian.Uint64(body), uint64(len(want)))
+		T.Equal(string(body[8:8+len(want)]), want)
+		body = body[8+len(want):]
+	}
+	T.Equal(len(body), 0)
+
+	// The limit applies to the total of all the ranges.
+	w = blastMultiGet(fmt.Sprintf(
+		`[{"start":%d,"end":%d},{"start":%d,"end":%d}]`,
+		start, start+6,
+		start+10, start+16))
+	T.Equal(w.Code, http.StatusBadRequest)
+
+	// Invalid bodies are rejected.
+	w = blastMultiGet(`not json`)
+	T.Equal(w.Code, http.StatusBadRequest)
+	w = blastMultiGet(`[]`)
+	T.Equal(w.Code, http.StatusBadRequest)
+	w = blastMultiGet(`[{"start":5,"end":2}]`)
+	T.Equal(w.Code, http.StatusBadRequest)
+
+	// Ranges past the end of the data can not be served.
+	w = blastMultiGet(fmt.Sprintf(
+		`[{"start":%d,"end":%d}]`,
+		start+15, start+uint64(len(data))+1))
+	T.Equal(w.Code, http.StatusBadRequest)
+	T.Equal(
+		w.Body.String(),
+		"Can not fetch objects from a compressed source.")
+}
+
+func TestServer_BlastPathList(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	data := []byte("0123456789")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	f, _, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	blastList := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("BLASTLIST", path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Each file is written on its own line.
+	w := blastList("/test")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/x-ndjson")
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	T.Equal(len(lines), 1)
+	file := blastpath.File{}
+	T.ExpectSuccess(json.Unmarshal([]byte(lines[0]), &file))
+	T.Equal(file.FID, f.String())
+	T.Equal(file.Type, "primary")
+	T.Equal(file.Size, uint64(len(data)))
+	T.Equal(file.Records, 1)
+
+	// Invalid paths and unknown name spaces are rejected.
+	T.Equal(blastList("/test/extra").Code, http.StatusBadRequest)
+	T.Equal(blastList("/unknown").Code, http.StatusNotFound)
+}
+
+func TestServer_BlastPathTail(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The insert is larger than UploadLargerThan so the primary stops
+	// accepting data right away and the tail ends.
+	st := newTestStorageWithSettings(T, storage.Settings{
+		UploadLargerThan: 10,
+	})
+	data := []byte("0123456789abcdefghij")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	f, start, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	blastTail := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("BLASTTAIL", path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	w := blastTail(fmt.Sprintf("/test/%s/%d", f.String(), start+5))
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), string(data[5:]))
+	T.Equal(
+		w.Result().Trailer.Get("Blast-Path-End"),
+		fmt.Sprintf("%d", start+uint64(len(data))))
+
+	// Starting past the end of the file is not possible.
+	w = blastTail(fmt.Sprintf(
+		"/test/%s/%d",
+		f.String(),
+		start+uint64(len(data))+1))
+	T.Equal(w.Code, http.StatusBadRequest)
+
+	// Invalid requests.
+	w = blastTail("/test/" + f.String())
+	T.Equal(w.Code, http.StatusBadRequest)
+	w = blastTail("/test/" + f.String() + "/abc")
+	T.Equal(w.Code, http.StatusBadRequest)
+	w = blastTail("/unknown/" + f.String() + "/0")
+	T.Equal(w.Code, http.StatusNotFound)
+}
+
+// Returns a started Storage that reads only from local files.
+func newTestStorage(T *testlib.T) *storage.Storage {
+	return newTestStorageWithSettings(T, storage.Settings{})
+}
+
+// Like newTestStorage but allows the caller to set extra fields in the
+// settings.
+func newTestStorageWithSettings(
+	T *testlib.T,
+	settings storage.Settings,
+) *storage.Storage {
+	dq := &delayqueue.DelayQueue{}
+	dq.Start()
+	T.AddFinalizer(dq.Stop)
+	settings.AssignRemotes = func(int) ([]storage.Remote, error) {
+		return nil, nil
+	}
+	settings.BaseDirectory = T.TempDir()
+	settings.BaseLogger = slog.New(sloghelper.DiscardHandler{})
+	settings.CompressWorkQueue = workqueue.New(0)
+	settings.DelayQueue = dq
+	settings.DeleteLocalWorkQueue = workqueue.New(0)
+	settings.DeleteRemotesWorkQueue = workqueue.New(0)
+	settings.Read = func(context.Context, storage.ReadConfig) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("not implemented")
+	}
+	settings.S3Bucket = "bucket"
+	settings.S3Client = &s3.S3{}
+	settings.UploadWorkQueue = workqueue.New(0)
+	st := storage.New(&settings)
+	T.ExpectSuccess(st.Start(context.Background()))
+	return st
+}
+
+func TestServer_GetRange(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	data := []byte("0123456789abcdefghij")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	get := func(header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/test/"+id, nil)
+		if header != "" {
+			req.Header.Set("Range", header)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Without a range the whole object is returned.
+	w := get("")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), string(data))
+	T.Equal(w.Header().Get("Accept-Ranges"), "bytes")
+	T.Equal(w.Header().Get("Content-Range"), "")
+
+	// A range within the object returns just that range.
+	w = get("bytes=5-9")
+	T.Equal(w.Code, http.StatusPartialContent)
+	T.Equal(w.Body.String(), "56789")
+	T.Equal(w.Header().Get("Content-Range"), "bytes 5-9/20")
+
+	// A range past the end of the object is clamped.
+	w = get("bytes=15-100")
+	T.Equal(w.Code, http.StatusPartialContent)
+	T.Equal(w.Body.String(), "fghij")
+	T.Equal(w.Header().Get("Content-Range"), "bytes 15-19/20")
+
+	// A range that starts past the end of the object can not be served.
+	w = get("bytes=20-")
+	T.Equal(w.Code, http.StatusRequestedRangeNotSatisfiable)
+	T.Equal(w.Header().Get("Content-Range"), "bytes */20")
+}
+
+func TestServer_GetAccessLog(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	data := []byte("0123456789abcdefghij")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+
+	buffer := bytes.Buffer{}
+	s := newTestServer(Settings{
+		AccessLogger: slog.New(slog.NewTextHandler(&buffer, nil)),
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+
+	// The access log records where a read was served from and how much
+	// data was returned.
+	req := httptest.NewRequest("GET", "/test/"+id, nil)
+	req.Header.Set("Range", "bytes=5-9")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusPartialContent)
+	T.Equal(strings.Contains(buffer.String(), "read-source=local"), true)
+	T.Equal(strings.Contains(buffer.String(), "bytes-served=5"), true)
+}
+
+func TestServer_GetBase62(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	data := []byte("0123456789")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	f, start, length, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+
+	// The same data can be read using either encoding of the ID.
+	for _, e := range []fid.IDEncoding{
+		fid.IDEncodingBase64,
+		fid.IDEncodingBase62,
+	} {
+		req := httptest.NewRequest(
+			"GET",
+			"/test/"+f.EncodedID(start, length, e),
+			nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		T.Equal(w.Code, http.StatusOK)
+		T.Equal(w.Body.String(), string(data))
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	for header, want := range map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, gzip;q=0.5":  true,
+		"br, gzip; q=0":        false,
+		"identity":             false,
+		"x-gzip, gzip ;q=1.0":  true,
+		"gzip;q=invalid, br":   false,
+		"deflate,gzip,br,zstd": true,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			req.Header.Set("Accept-Encoding", header)
+		}
+		T.Equal(acceptsGzip(req), want, header)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	tests := []struct {
+		header string
+		offset uint32
+		length uint32
+		ok     bool
+	}{
+		{"bytes=0-9", 0, 10, true},
+		{"bytes=5-", 5, 15, true},
+		{"bytes=5-5", 5, 1, true},
+		{"bytes=10-100", 10, 10, true},
+		{"bytes=-5", 15, 5, true},
+		{"bytes=-100", 0, 20, true},
+		{"bytes=20-", 0, 0, false},
+		{"bytes=9-5", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=0-1,3-4", 0, 0, false},
+		{"bytes=a-b", 0, 0, false},
+		{"bytes=5", 0, 0, false},
+		{"items=0-5", 0, 0, false},
+	}
+	for _, test := range tests {
+		offset, length, ok := parseRange(test.header, 20)
+		T.Equal(ok, test.ok, test.header)
+		T.Equal(offset, test.offset, test.header)
+		T.Equal(length, test.length, test.header)
+	}
+}
+
+func TestServer_Head(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	data := []byte("0123456789abcdefghij")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	_, start, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	head := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "/test/"+id, nil)
+		req.Header.Set("Blobby-Local-Only", "true")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// An existing ID returns its length without a body, and without the
+	// data being read.
+	w := head(id)
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Length"), "20")
+	T.Equal(w.Body.Len(), 0)
+	T.Equal(st.GetMetrics().ReadSources.Local, int64(0))
+
+	// An ID in a file that does not exist is not found.
+	other := fid.FID{}
+	other.Generate(1)
+	w = head(other.ID(start, 10))
+	T.Equal(w.Code, http.StatusNotFound)
+
+	// An invalid ID is rejected.
+	w = head("invalid")
+	T.Equal(w.Code, http.StatusBadRequest)
+
+	// Internal URLs are routed the same way as a GET.
+	req := httptest.NewRequest("HEAD", "/_locate/test/"+id, nil)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/json")
+}
+
+// An ObjectStore that only knows which keys exist, used to check that HEAD
+// requests never read any data.
+type keysObjectStore map[string]bool
+
+func (k keysObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (k keysObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (
+	io.ReadCloser,
+	error,
+) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (k keysObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (
+	*storage.ObjectInfo,
+	error,
+) {
+	if !k[key] {
+		return nil, storage.ErrNotFound(key)
+	}
+	return &storage.ObjectInfo{}, nil
+}
+
+func (k keysObjectStore) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func TestServer_Head_NotLocal(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Machine 1 is up and has its file, machine 2 has dropped its local
+	// copies and only one of its files was uploaded.
+	remote := fid.FID{}
+	remote.Generate(1)
+	uploaded := fid.FID{}
+	uploaded.Generate(2)
+	missing := fid.FID{}
+	missing.Generate(2)
+	st := newTestStorageWithSettings(T, storage.Settings{
+		Head: func(ctx context.Context, rc storage.ReadConfig) error {
+			if rc.Machine() == 1 {
+				return nil
+			}
+			return storage.ErrNotFound(rc.ID())
+		},
+		ObjectStore: keysObjectStore{uploaded.String(): true},
+	})
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	head := func(f fid.FID) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "/test/"+f.ID(0, 10), nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Data the remote has, or that is in S3, exists.
+	w := head(remote)
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Length"), "10")
+	w = head(uploaded)
+	T.Equal(w.Code, http.StatusOK)
+
+	// Data that is on neither is not found.
+	w = head(missing)
+	T.Equal(w.Code, http.StatusNotFound)
+}
+
+func TestServer_GetETag(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	data := []byte("0123456789")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	get := func(id, match string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/test/"+id, nil)
+		if match != "" {
+			req.Header.Set("If-None-Match", match)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// The id is returned as the ETag.
+	w := get(id, "")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("ETag"), `"`+id+`"`)
+	T.Equal(w.Header().Get("Vary"), "Accept-Encoding")
+	T.Equal(w.Body.String(), "0123456789")
+
+	// A matching If-None-Match returns a 304 without a body, including
+	// when the tag is weak or one of several.
+	for _, match := range []string{
+		`"` + id + `"`,
+		`W/"` + id + `"`,
+		`"other", "` + id + `"`,
+	} {
+		w = get(id, match)
+		T.Equal(w.Code, http.StatusNotModified)
+		T.Equal(w.Header().Get("ETag"), `"`+id+`"`)
+		T.Equal(w.Body.Len(), 0)
+	}
+
+	// Anything else returns the object.
+	w = get(id, `"other"`)
+	T.Equal(w.Code, http.StatusOK)
+	w = get(id, `*`)
+	T.Equal(w.Code, http.StatusOK)
+
+	// The ETag of the gzip encoded object only matches if the client would
+	// accept that encoding.
+	gzipTag := `"` + id + `-gzip"`
+	T.Equal(get(id, gzipTag).Code, http.StatusOK)
+	req := httptest.NewRequest("GET", "/test/"+id, nil)
+	req.Header.Set("If-None-Match", gzipTag)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusNotModified)
+	T.Equal(w.Header().Get("ETag"), gzipTag)
+	T.Equal(w.Header().Get("Vary"), "Accept-Encoding")
+
+	// The 304 is returned without reading the object, even if it does not
+	// exist.
+	f, start, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+	f.Generate(1)
+	missing := f.ID(start, 10)
+	T.Equal(get(missing, `"`+missing+`"`).Code, http.StatusNotModified)
+
+	// The connection is still closed if the server is shutting down.
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	w = get(id, `"`+id+`"`)
+	T.Equal(w.Code, http.StatusNotModified)
+	T.Equal(w.Header().Get("Connection"), "close")
+}
+
+func TestServer_MachineID(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newTestServer(Settings{MachineID: 7})
+	server := httptest.NewServer(s)
+	defer server.Close()
+	remote := &remotes.Remote{
+		Name:   "remote",
+		URL:    server.URL,
+		ID:     7,
+		Client: server.Client(),
+	}
+
+	// Every response reports the machine id.
+	id, err := remote.MachineID(context.Background())
+	T.ExpectSuccess(err)
+	T.Equal(id, uint32(7))
+
+	// The pool refuses ids that a remote is using, but ignores remotes
+	// that can not be reached.
+	pool := &remotes.Pool{
+		Remotes: []storage.Remote{
+			remote,
+			&remotes.Remote{
+				Name:   "down",
+				URL:    "http://127.0.0.1:1",
+				ID:     8,
+				Client: server.Client(),
+			},
+		},
+	}
+	T.ExpectSuccess(pool.CheckMachineID(context.Background(), 1))
+	T.ExpectErrorMessage(
+		pool.CheckMachineID(context.Background(), 7),
+		"Machine id 7 is also used by: remote")
+}
+
+// An ObjectStore that returns the same gzip compressed object for every
+// key.
+type gzipObjectStore struct {
+	data   []byte
+	length int
+}
+
+func (g *gzipObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (g *gzipObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (
+	io.ReadCloser,
+	error,
+) {
+	return io.NopCloser(bytes.NewReader(g.data)), nil
+}
+
+func (g *gzipObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (
+	*storage.ObjectInfo,
+	error,
+) {
+	return &storage.ObjectInfo{
+		ETag: "etag",
+		Metadata: map[string]string{
+			"Blobby-Uncompressed-Length": strconv.Itoa(g.length),
+		},
+		Size: int64(len(g.data)),
+	}, nil
+}
+
+func (g *gzipObjectStore) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+func TestServer_GetETag_Gzip(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	buffer := bytes.Buffer{}
+	gz := gzip.NewWriter(&buffer)
+	_, err := gz.Write([]byte("0123456789"))
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(gz.Close())
+	st := newTestStorageWithSettings(T, storage.Settings{
+		Compress:    true,
+		ObjectStore: &gzipObjectStore{data: buffer.Bytes(), length: 10},
+	})
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	f := fid.FID{}
+	f.Generate(1)
+	id := f.ID(0, 10)
+
+	// Clients that accept gzip are sent the compressed object which has
+	// an ETag of its own.
+	req := httptest.NewRequest("GET", "/test/"+id, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Encoding"), "gzip")
+	T.Equal(w.Header().Get("ETag"), `"`+id+`-gzip"`)
+	T.Equal(w.Header().Get("Vary"), "Accept-Encoding")
+	T.Equal(w.Body.Bytes(), buffer.Bytes())
+}
+
+func TestServer_ReplicateBehind(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	server := httptest.NewServer(s)
+	defer server.Close()
+	remote := &remotes.Remote{
+		Name:   "remote",
+		URL:    server.URL,
+		Client: server.Client(),
+	}
+	f := fid.FID{}
+	f.Generate(1)
+	T.ExpectSuccess(remote.Initialize("test", f.String()))
+	replicate := func(start uint64, data string) error {
+		h, err := hasher.Computer("hh", io.Discard)
+		T.ExpectSuccess(err)
+		_, err = h.Write([]byte(data))
+		T.ExpectSuccess(err)
+		_, err = remote.Replicate(&remoteReplicatorConfig{
+			body:      io.NopCloser(strings.NewReader(data)),
+			end:       start + uint64(len(data)),
+			fid:       f.String(),
+			hash:      h.Hash(),
+			namespace: "test",
+			start:     start,
+		})
+		return err
+	}
+
+	// Data that starts past the end of the replica is refused with the
+	// offset that the replica has data up to.
+	T.Equal(replicate(4, "efgh"), storage.ErrReplicaBehind(0))
+
+	// Once the missing data is sent the replica accepts the rest.
+	T.ExpectSuccess(replicate(0, "abcd"))
+	T.ExpectSuccess(replicate(4, "efgh"))
+	T.Equal(st.GetMetrics().ReplicaBytes, uint64(8))
+}
+
+func TestServer_ReplicateTrace(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	f := fid.FID{}
+	f.Generate(1)
+	T.ExpectSuccess(st.ReplicaInitialize(context.Background(), f.String()))
+	replicate := func(start uint64, data string, trace bool) http.Header {
+		h, err := hasher.Computer("hh", io.Discard)
+		T.ExpectSuccess(err)
+		_, err = h.Write([]byte(data))
+		T.ExpectSuccess(err)
+		req := httptest.NewRequest(
+			"REPLICATE",
+			"/test/"+f.String(),
+			strings.NewReader(data))
+		req.Header.Set("Start", strconv.FormatUint(start, 10))
+		req.Header.Set("End", strconv.FormatUint(start+uint64(len(data)), 10))
+		req.Header.Set("Hash", h.Hash())
+		if trace {
+			req.Header.Set("Blobby-Trace", "true")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		T.Equal(w.Code, http.StatusNoContent)
+		return w.Header()
+	}
+
+	// The primary can ask the replica to trace the replication.
+	T.NotEqual(replicate(0, "abcd", true).Get("Blobby-Trace-Duration"), "")
+	T.Equal(replicate(4, "efgh", false).Get("Blobby-Trace-Duration"), "")
+}
+
+func TestServer_DiskUsage(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	server := httptest.NewServer(s)
+	defer server.Close()
+	remote := &remotes.Remote{
+		Name:   "remote",
+		URL:    server.URL,
+		Client: server.Client(),
+	}
+
+	// Nothing is known until the remote has been sent a request for the
+	// name space.
+	_, ok := remote.DiskUsage("test")
+	T.Equal(ok, false)
+
+	// Initializing a replica reports the usage of the disk.
+	f := fid.FID{}
+	f.Generate(1)
+	T.ExpectSuccess(remote.Initialize("test", f.String()))
+	used, ok := remote.DiskUsage("test")
+	T.Equal(ok, true)
+	want, err := st.DiskUsage()
+	T.ExpectSuccess(err)
+	T.Equal(used > want-0.01 && used < want+0.01, true)
+	_, ok = remote.DiskUsage("other")
+	T.Equal(ok, false)
+}
+
+func TestServer_ID(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	f := fid.FID{}
+	f.Generate(7)
+	get := func(id, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/_id/test/"+id, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Text is returned by default.
+	w := get(f.ID(10, 20), "")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "text/plain")
+	T.Equal(strings.Contains(w.Body.String(), "Machine ID: 7\n"), true)
+
+	// JSON is returned if the client asks for it.
+	w = get(f.ID(10, 20), "text/html, application/json;q=0.9")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/json")
+	info := storage.IDInfo{}
+	T.ExpectSuccess(json.Unmarshal(w.Body.Bytes(), &info))
+	T.Equal(info.FID, f.String())
+	T.Equal(info.Machine, uint32(7))
+	T.Equal(info.Created.Equal(f.Time()), true)
+	T.Equal(info.Start, uint64(10))
+	T.Equal(info.Length, uint32(20))
+	T.Equal(info.PrimaryState, "")
+
+	// Invalid IDs are rejected in JSON mode.
+	w = get("invalid", "application/json")
+	T.Equal(w.Code, http.StatusBadRequest)
+}
+
+func TestServer_Locate(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	locate := func(path string, localOnly bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if localOnly {
+			req.Header.Set("Blobby-Local-Only", "true")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+	id := strings.TrimSpace(w.Body.String())
+
+	// Data that was just inserted is served from the local primary.
+	w = locate("/_locate/test/"+id, false)
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/json")
+	T.Equal(w.Body.String(), `{"source":"primary"}`+"\n")
+
+	// Data created on another server is read from that server.
+	f := fid.FID{}
+	f.Generate(7)
+	w = locate("/_locate/test/"+f.ID(0, 4), false)
+	T.Equal(w.Code, http.StatusOK)
+	location := storage.Location{}
+	T.ExpectSuccess(json.Unmarshal(w.Body.Bytes(), &location))
+	T.Equal(location, storage.Location{
+		Source:  storage.LocationRemote,
+		Machine: 7,
+	})
+	w = locate("/_locate/test/"+f.ID(0, 4), true)
+	T.Equal(w.Code, http.StatusNotFound)
+
+	// Invalid requests.
+	T.Equal(locate("/_locate/test", false).Code, http.StatusBadRequest)
+	T.Equal(locate("/_locate/other/"+id, false).Code, http.StatusNotFound)
+	T.Equal(locate("/_locate/test/invalid", false).Code, http.StatusBadRequest)
+}
+
+func TestServer_DurableOnlyHeader(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	serve := func(path, durable string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Blobby-Durable-Only", durable)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+	id := strings.TrimSpace(w.Body.String())
+
+	// The header is parsed as a boolean, so a false value does not make
+	// the read durable only.
+	w = serve("/_locate/test/"+id, "true")
+	T.Equal(w.Body.String(), `{"source":"s3"}`+"\n")
+	w = serve("/_locate/test/"+id, "false")
+	T.Equal(w.Body.String(), `{"source":"primary"}`+"\n")
+	w = serve("/test/"+id, "0")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), "data")
+
+	// Values that can not be parsed are rejected.
+	T.Equal(serve("/_locate/test/"+id, "yes").Code, http.StatusBadRequest)
+	T.Equal(serve("/test/"+id, "yes").Code, http.StatusBadRequest)
+}
+
+func TestServer_Status(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	data := []byte("0123456789")
+	id, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	f, _, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/_status", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Text is returned by default.
+	w := get("")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(strings.HasPrefix(w.Body.String(), "test:\n"), true)
+	T.Equal(strings.Contains(w.Body.String(), f.String()+" state="), true)
+
+	// JSON is returned if the client asks for it.
+	w = get("application/json")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/json")
+	status := struct {
+		ShuttingDown bool                               `json:"shutting_down"`
+		NameSpaces   map[string]storage.NameSpaceStatus `json:"namespaces"`
+	}{}
+	T.ExpectSuccess(json.Unmarshal(w.Body.Bytes(), &status))
+	T.Equal(status.ShuttingDown, false)
+	T.Equal(len(status.NameSpaces), 1)
+	found := false
+	for _, p := range status.NameSpaces["test"].Primaries {
+		if p.FID == f.String() {
+			found = true
+			T.Equal(p.Size, uint64(len(data)))
+		}
+	}
+	T.Equal(found, true)
+}
+
+func TestServer_Version(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	defer func(version, commit string) {
+		buildinfo.Version = version
+		buildinfo.Commit = commit
+	}(buildinfo.Version, buildinfo.Commit)
+	buildinfo.Version = "v1.2.3"
+	buildinfo.Commit = "abcdef"
+
+	s := newTestServer(Settings{})
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Text is returned by default.
+	w := get("/_version", "")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(strings.HasPrefix(
+		w.Body.String(),
+		"version: v1.2.3\ncommit: abcdef\n"), true)
+
+	// JSON is returned if the client asks for it.
+	w = get("/_version", "application/json")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/json")
+	info := buildinfo.Info{}
+	T.ExpectSuccess(json.Unmarshal(w.Body.Bytes(), &info))
+	T.Equal(info, buildinfo.Get())
+
+	// The build is also exported as a metric.
+	w = get("/_metrics", "")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(strings.Contains(
+		w.Body.String(),
+		fmt.Sprintf(
+			"build_info{version=\"v1.2.3\",commit=\"abcdef\",go_version=%q} 1\n",
+			runtime.Version())), true)
+}
+
+func TestServer_ACLRateLimit(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: newTestStorage(T),
+			},
+		},
+		StatusACL: &access.ACL{
+			Name: "server.status_acl",
+			RateLimit: &access.RateLimit{
+				RequestsPerSecond: 0.001,
+				Burst:             2,
+			},
+		},
+	})
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/_metrics", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Requests over the limit get a 429 and are counted.
+	T.Equal(get().Code, http.StatusOK)
+	w := get()
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(strings.Contains(
+		w.Body.String(),
+		"acl_throttled_requests{acl=\"server.status_acl\"} 0\n"), true)
+	w = get()
+	T.Equal(w.Code, http.StatusTooManyRequests)
+	T.NotEqual(w.Header().Get("Retry-After"), "")
+	T.Equal(
+		s.settings.Load().StatusACL.RateLimit.Throttled,
+		int64(1))
+}
+
+func TestServer_Insert_IdempotencyKey(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorageWithSettings(T, storage.Settings{
+		IdempotencyKeyTTL: time.Hour,
+	})
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	insert := func(key, body string) string {
+		req := httptest.NewRequest("POST", "/test", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		T.Equal(w.Code, http.StatusOK)
+		return w.Body.String()
+	}
+
+	// Concurrent submits of the same key all get the same ID.
+	ids := make([]string, 10)
+	wg := sync.WaitGroup{}
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i] = insert("key1", "data")
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		T.Equal(id, ids[0])
+	}
+
+	// Only one copy of the data was written.
+	metrics := st.GetMetrics()
+	T.Equal(metrics.PrimaryBytes, uint64(4))
+
+	// Different keys, or no key at all, are inserted as normal.
+	T.NotEqual(insert("key2", "data"), ids[0])
+	T.NotEqual(insert("", "data"), ids[0])
+	T.NotEqual(insert("", "data"), insert("", "data"))
+}
+
+func TestServer_Insert_Hash(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	insert := func(hash, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/test", strings.NewReader(body))
+		req.Header.Set("Blobby-Hash", hash)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	hash := func(typ, body string) string {
+		h, err := hasher.Computer(typ, io.Discard)
+		T.ExpectSuccess(err)
+		h.Write([]byte(body))
+		return h.Hash()
+	}
+
+	// Data that matches the hash is inserted, either hash type works.
+	T.Equal(insert(hash("hh", "data"), "data").Code, http.StatusOK)
+	T.Equal(insert(hash("md5", "data"), "data").Code, http.StatusOK)
+	T.Equal(insert("", "data").Code, http.StatusOK)
+	T.Equal(st.GetMetrics().PrimaryBytes, uint64(12))
+
+	// Data that was corrupted is rejected and removed from disk.
+	w := insert(hash("md5", "data"), "dada")
+	T.Equal(w.Code, http.StatusBadRequest)
+	T.Equal(
+		strings.Contains(w.Body.String(), "does not match the hash"),
+		true)
+	T.Equal(st.GetMetrics().PrimaryBytes, uint64(12))
+
+	// Hashes that can not be parsed are rejected.
+	T.Equal(insert("bogus", "data").Code, http.StatusBadRequest)
+	T.Equal(insert("sha=AAAA", "data").Code, http.StatusBadRequest)
+	T.Equal(st.GetMetrics().PrimaryBytes, uint64(12))
+}
+
+func TestServer_Insert_MaxRecordBytes(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorageWithSettings(T, storage.Settings{
+		MaxRecordBytes: 4,
+	})
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// Data up to the limit is accepted.
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	T.Equal(serve(req).Code, http.StatusOK)
+
+	// A larger Content-Length is rejected without reading the body.
+	body := strings.NewReader("too much data")
+	req = httptest.NewRequest("POST", "/test", body)
+	w := serve(req)
+	T.Equal(w.Code, http.StatusRequestEntityTooLarge)
+	T.Equal(w.Body.String(), "The data is larger than the 4 byte limit.\n")
+	T.Equal(body.Len(), len("too much data"))
+
+	// Data without a length is rolled back once it passes the limit.
+	req = httptest.NewRequest("POST", "/test", strings.NewReader("more data"))
+	req.ContentLength = -1
+	T.Equal(serve(req).Code, http.StatusRequestEntityTooLarge)
+	T.Equal(st.GetMetrics().PrimaryBytes, uint64(4))
+	req = httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	T.Equal(serve(req).Code, http.StatusOK)
+	T.Equal(st.GetMetrics().PrimaryBytes, uint64(8))
+
+	// Replicate calls are checked against the limit as well.
+	req = httptest.NewRequest("REPLICATE", "/test/fid", strings.NewReader(""))
+	req.Header.Set("Start", "0")
+	req.Header.Set("End", "5")
+	req.Header.Set("Hash", "hh=AAAA")
+	T.Equal(serve(req).Code, http.StatusRequestEntityTooLarge)
+}
+
+func TestServer_Insert_Chunked(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorageWithSettings(T, storage.Settings{
+		MaxRecordBytes: 16,
+	})
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	insert := func(data string) *httptest.ResponseRecorder {
+		body := iotest.OneByteReader(strings.NewReader(data))
+		req := httptest.NewRequest("POST", "/test", body)
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// A chunked body is read until it ends and can be read back.
+	w := insert("chunked data")
+	T.Equal(w.Code, http.StatusOK)
+	_, start, length, err := fid.ParseID(w.Body.String())
+	T.ExpectSuccess(err)
+	T.Equal(start, uint64(0))
+	T.Equal(length, uint32(12))
+	req := httptest.NewRequest("GET", "/test/"+w.Body.String(), nil)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), "chunked data")
+
+	// The size limit still applies and the next record starts where the
+	// first one ended.
+	w = insert("far too much chunked data")
+	T.Equal(w.Code, http.StatusRequestEntityTooLarge)
+	w = insert("more")
+	T.Equal(w.Code, http.StatusOK)
+	_, start, length, err = fid.ParseID(w.Body.String())
+	T.ExpectSuccess(err)
+	T.Equal(start, uint64(12))
+	T.Equal(length, uint32(4))
+	T.Equal(st.GetMetrics().PrimaryBytes, uint64(16))
+}
+
+func TestServer_ReadOnly(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	w := serve("POST", "/test", "data")
+	T.Equal(w.Code, http.StatusOK)
+	id := w.Body.String()
+
+	// Inserts are refused with a retryable error while reads continue.
+	w = serve("GET", "/_readonly/test/enable", "")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), "test is read only.\n")
+	w = serve("POST", "/test", "data")
+	T.Equal(w.Code, http.StatusServiceUnavailable)
+	T.Equal(w.Header().Get("Retry-After"), readOnlyRetryAfter)
+	w = serve("GET", "/test/"+id, "")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), "data")
+	w = serve("GET", "/_readonly/test", "")
+	T.Equal(w.Body.String(), "test is read only.\n")
+	w = serve("GET", "/_status", "")
+	T.Equal(
+		strings.Contains(w.Body.String(), "Read only, inserts are disabled."),
+		true)
+
+	// Disabling it allows inserts again.
+	w = serve("GET", "/_readonly/test/disable", "")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), "test is accepting inserts.\n")
+	T.Equal(serve("POST", "/test", "data").Code, http.StatusOK)
+
+	// Invalid requests.
+	T.Equal(serve("GET", "/_readonly", "").Code, http.StatusBadRequest)
+	T.Equal(serve("GET", "/_readonly/test/bad", "").Code, http.StatusBadRequest)
+	T.Equal(serve("GET", "/_readonly/other", "").Code, http.StatusNotFound)
+}
+
+func TestServer_Reupload(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+
+	// The primary is still accepting data so it is not requeued.
+	w = serve("/_reupload/test")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Content-Type"), "application/json")
+	var result storage.ReuploadResult
+	T.ExpectSuccess(json.Unmarshal(w.Body.Bytes(), &result))
+	T.Equal(len(result.Requeued), 0)
+	T.Equal(len(result.InProgress), 0)
+	T.Equal(len(result.Skipped), 1)
+
+	// Invalid requests.
+	T.Equal(serve("/_reupload").Code, http.StatusBadRequest)
+	T.Equal(serve("/_reupload/other").Code, http.StatusNotFound)
+}
+
+func TestServer_Flush(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+	f, _, _, err := fid.ParseID(strings.TrimSpace(w.Body.String()))
+	T.ExpectSuccess(err)
+
+	// The waiting primary is queued for upload.
+	w = serve("/_flush/test/" + f.String())
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(
+		w.Body.String(),
+		f.String()+" was flushed and is now pending-upload.\n")
+
+	// Flushing it again does nothing.
+	w = serve("/_flush/test/" + f.String())
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(
+		w.Body.String(),
+		f.String()+" is pending-upload and is not waiting for inserts, "+
+			"nothing was done.\n")
+
+	// Invalid requests.
+	T.Equal(serve("/_flush/test").Code, http.StatusBadRequest)
+	T.Equal(serve("/_flush/other/"+f.String()).Code, http.StatusNotFound)
+	T.Equal(serve("/_flush/test/unknown").Code, http.StatusNotFound)
+}
+
+func TestServer_UploadThresholds(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorageWithSettings(T, storage.Settings{
+		UploadLargerThan:        100,
+		UploadLargerThanMaximum: 1000,
+		UploadOlder:             time.Hour,
+		UploadOlderMinimum:      time.Minute,
+	})
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// The current thresholds are reported.
+	w := serve("GET", "/_upload_thresholds/test")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(
+		w.Body.String(),
+		"test uploads new primaries larger than 100 bytes or older than "+
+			"1h0m0s.\n")
+
+	// Each threshold can be changed on its own.
+	w = serve("POST", "/_upload_thresholds/test?larger_than=500")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(
+		w.Body.String(),
+		"test uploads new primaries larger than 500 bytes or older than "+
+			"1h0m0s.\n")
+	w = serve("POST", "/_upload_thresholds/test?older=5m")
+	T.Equal(w.Code, http.StatusOK)
+	largerThan, older := st.UploadThresholds()
+	T.Equal(largerThan, uint64(500))
+	T.Equal(older, time.Minute*5)
+
+	// Values outside of the configured limits are rejected.
+	w = serve("POST", "/_upload_thresholds/test?larger_than=50")
+	T.Equal(w.Code, http.StatusBadRequest)
+	T.Equal(
+		w.Body.String(),
+		"The upload size must be between 100 and 1000 bytes.\n")
+	w = serve("POST", "/_upload_thresholds/test?older=2h")
+	T.Equal(w.Code, http.StatusBadRequest)
+	largerThan, older = st.UploadThresholds()
+	T.Equal(largerThan, uint64(500))
+	T.Equal(older, time.Minute*5)
+
+	// Invalid requests.
+	w = serve("POST", "/_upload_thresholds/test?larger_than=big")
+	T.Equal(w.Code, http.StatusBadRequest)
+	w = serve("POST", "/_upload_thresholds/test?older=later")
+	T.Equal(w.Code, http.StatusBadRequest)
+	T.Equal(serve("GET", "/_upload_thresholds").Code, http.StatusBadRequest)
+	w = serve("GET", "/_upload_thresholds/other")
+	T.Equal(w.Code, http.StatusNotFound)
+}
+
+func TestServer_Insert_QueueTimeout(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorageWithSettings(T, storage.Settings{
+		InsertQueueTimeout: time.Millisecond * 50,
+		OpenFilesMaximum:   1,
+	})
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+
+	// Hold the only primary with an insert whose body has not arrived yet.
+	pr, pw := io.Pipe()
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest("POST", "/test", pr)
+		req.ContentLength = 4
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		done <- w.Code
+	}()
+	T.TryUntil(func() bool {
+		return st.GetMetrics().PrimaryInsertQueueLatency.Count == 1
+	}, time.Second)
+
+	// The next insert gives up waiting and asks the client to retry.
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusServiceUnavailable)
+	T.Equal(w.Header().Get("Retry-After"), queueTimeoutRetryAfter)
+	T.Equal(st.GetMetrics().InsertQueueTimeouts, int64(1))
+
+	// Once the first insert finishes inserts succeed again.
+	pw.Write([]byte("data"))
+	pw.Close()
+	T.Equal(<-done, http.StatusOK)
+	req = httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+}
+
+func TestServer_UserDelete(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	ns := &NameSpaceSettings{Storage: st}
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{"test": ns},
+	})
+	del := func(path string) int {
+		req := httptest.NewRequest("DELETE", path, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Insert some data so there is a file to try and delete.
+	req := httptest.NewRequest("POST", "/test", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+	id := w.Body.String()
+
+	// Deletes are refused unless the name space has a delete ACL.
+	T.Equal(del("/_delete/test/"+id), http.StatusForbidden)
+
+	// Bad paths, name spaces and IDs are rejected.
+	ns.DeleteACL = &access.ACL{}
+	T.Equal(del("/_delete/test"), http.StatusBadRequest)
+	T.Equal(del("/_delete/missing/"+id), http.StatusNotFound)
+	T.Equal(del("/_delete/test/invalid"), http.StatusBadRequest)
+
+	// The file is still open for writes so it can not be deleted yet.
+	T.Equal(del("/_delete/test/"+id), http.StatusConflict)
+}
+
+func TestServer_InsertBatch(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	batch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/test", strings.NewReader(body))
+		req.Header.Set("Blobby-Batch", "true")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+	get := func(id string) string {
+		req := httptest.NewRequest("GET", "/test/"+id, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		T.Equal(w.Code, http.StatusOK)
+		return w.Body.String()
+	}
+
+	// Every record gets its own ID, in order.
+	w := batch("5\nhello1\n!6\nworld!")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Blobby-Batch-Errors"), "0")
+	ids := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	T.Equal(len(ids), 3)
+	T.Equal(get(ids[0]), "hello")
+	T.Equal(get(ids[1]), "!")
+	T.Equal(get(ids[2]), "world!")
+
+	// Records before invalid framing are inserted, the rest are not.
+	w = batch("5\nhellofive\nworld")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Header().Get("Blobby-Batch-Errors"), "1")
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	T.Equal(len(lines), 2)
+	T.Equal(get(lines[0]), "hello")
+	T.Equal(lines[1], "ERROR Invalid record length.")
+
+	// A truncated record is reported as an error.
+	w = batch("5\nhello10\nworld")
+	T.Equal(w.Header().Get("Blobby-Batch-Errors"), "1")
+	lines = strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	T.Equal(len(lines), 2)
+	T.Equal(get(lines[0]), "hello")
+	T.Equal(strings.HasPrefix(lines[1], "ERROR "), true)
+
+	// A body that fails part way through a record only gets one ERROR
+	// line for it.
+	req := httptest.NewRequest("POST", "/test", io.MultiReader(
+		strings.NewReader("5\nhello10\nwor"),
+		iotest.ErrReader(fmt.Errorf("read failed"))))
+	req.Header.Set("Blobby-Batch", "true")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Header().Get("Blobby-Batch-Errors"), "1")
+	lines = strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	T.Equal(len(lines), 2)
+	T.Equal(get(lines[0]), "hello")
+	T.Equal(strings.HasPrefix(lines[1], "ERROR "), true)
+}
+
+func TestServer_ShutDownDrain(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: st,
+			},
+		},
+	})
+	data := []byte("data")
+	_, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	shutdown := func(command string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/_shutdown/"+command, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	// The primary can not be uploaded by the test storage so it remains
+	// pending after the drain starts.
+	w := shutdown("drain")
+	T.Equal(w.Code, http.StatusOK)
+	T.Equal(w.Body.String(), ""+
+		"test: 1 primaries and 0 replicas pending.\n"+
+		"pending: 1\n")
+	T.Equal(atomic.LoadInt32(&s.shuttingDown), int32(1))
+
+	// Inserts are rejected while draining.
+	req := httptest.NewRequest("POST", "/test", bytes.NewReader(data))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusServiceUnavailable)
+
+	// Stopping the shutdown allows inserts again.
+	w = shutdown("stop")
+	T.Equal(w.Code, http.StatusOK)
+	req = httptest.NewRequest("POST", "/test", bytes.NewReader(data))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	T.Equal(w.Code, http.StatusOK)
+}
+
+func TestServer_ShutDown(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	empty := newTestStorage(T)
+	s := newTestServer(Settings{
+		Addr: "127.0.0.1",
+		NameSpaces: map[string]*NameSpaceSettings{
+			"empty": &NameSpaceSettings{Storage: empty},
+			"test":  &NameSpaceSettings{Storage: st},
+		},
+		ShutDownGracePeriod: time.Millisecond * 50,
+	})
+	data := []byte("data")
+	_, err := st.Insert(context.Background(), &storage.InsertData{
+		Source: bytes.NewReader(data),
+		Length: int64(len(data)),
+	})
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(s.Listen())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Run()
+	}()
+
+	// The primary can not be uploaded by the test storage so the grace
+	// period expires, after which the listeners are closed and Run()
+	// returns without an error.
+	start := time.Now()
+	T.ExpectSuccess(s.ShutDown(context.Background()))
+	T.Equal(time.Since(start) >= time.Millisecond*50, true)
+	select {
+	case err := <-errs:
+		T.ExpectSuccess(err)
+	case <-time.After(5 * time.Second):
+		T.Fatalf("Run() did not return.")
+	}
+	T.Equal(atomic.LoadInt32(&s.shuttingDown), int32(1))
+	_, err = net.Dial("tcp", s.listeners[0].Addr().String())
+	T.NotEqual(err, nil)
+
+	// Both namespaces were drained so no new data is accepted.
+	for _, ns := range []*storage.Storage{st, empty} {
+		_, err = ns.Insert(context.Background(), &storage.InsertData{
+			Source: bytes.NewReader(data),
+			Length: int64(len(data)),
+		})
+		T.NotEqual(err, nil)
+	}
+}
+
+func TestServer_ShutDown_NothingPending(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newTestServer(Settings{
+		Addr: "127.0.0.1",
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{Storage: newTestStorage(T)},
+		},
+		ShutDownGracePeriod: time.Hour,
+	})
+	T.ExpectSuccess(s.Listen())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Run()
+	}()
+
+	// With nothing to upload the server stops without waiting for the
+	// grace period.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ShutDown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		T.ExpectSuccess(err)
+	case <-time.After(5 * time.Second):
+		T.Fatalf("ShutDown() waited for the grace period.")
+	}
+	T.ExpectSuccess(<-errs)
+}
+
+func TestServer_ShutDown_InFlight(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	st := newTestStorage(T)
+	s := newTestServer(Settings{
+		Addr: "127.0.0.1",
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{Storage: st},
+		},
+		ShutDownGracePeriod: time.Millisecond * 50,
+	})
+	T.ExpectSuccess(s.Listen())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Run()
+	}()
+
+	// Start an insert whose body is only partially sent so that it is
+	// still in flight when the server is shut down.
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(
+		"POST",
+		"http://"+s.listeners[0].Addr().String()+"/test",
+		pr)
+	T.ExpectSuccess(err)
+	req.ContentLength = 8
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		T.ExpectSuccess(err)
+		responses <- resp
+	}()
+	_, err = pw.Write([]byte("data"))
+	T.ExpectSuccess(err)
+	T.TryUntil(func() bool {
+		return st.GetMetrics().PrimaryInsertQueueLatency.Count == 1
+	}, time.Second)
+
+	// Run() returns once the listeners are closed, but the request that
+	// is in flight is allowed to finish.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ShutDown(context.Background())
+	}()
+	select {
+	case err := <-errs:
+		T.ExpectSuccess(err)
+	case <-time.After(5 * time.Second):
+		T.Fatalf("Run() did not return.")
+	}
+	_, err = pw.Write([]byte("more"))
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(pw.Close())
+	select {
+	case resp := <-responses:
+		defer resp.Body.Close()
+		T.Equal(resp.StatusCode, http.StatusOK)
+	case <-time.After(5 * time.Second):
+		T.Fatalf("The request in flight did not complete.")
+	}
+	T.ExpectSuccess(<-done)
+}
+
+func TestServer_Listeners(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	localOnly := &access.ACL{
+		Required: []access.Method{
+			&access.WhiteList{
+				CIDRs: []net.IPNet{{
+					IP:   net.IPv4(127, 0, 0, 1),
+					Mask: net.IPv4Mask(255, 255, 255, 255),
+				}},
+			},
+		},
+	}
+	dir := T.TempDir()
+	socket := filepath.Join(dir, "blobby.sock")
+	s := newTestServer(Settings{
+		Addr: "127.0.0.1",
+		Listeners: []ListenerSettings{
+			{Network: "tcp", Address: "127.0.0.1:0"},
+			{Network: "unix", Address: socket},
+		},
+		HealthCheckACL: localOnly,
+		NameSpaces: map[string]*NameSpaceSettings{
+			"test": &NameSpaceSettings{
+				Storage: newTestStorage(T),
+			},
+		},
+	})
+
+	// A stale socket from a previous run is replaced.
+	stale, err := net.Listen("unix", socket)
+	T.ExpectSuccess(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	T.ExpectSuccess(s.Listen())
+	T.Equal(len(s.listeners), 3)
+	T.Equal(s.Addr(), "127.0.0.1:0")
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Run()
+	}()
+
+	// Every listener is served by the same handler, and connections to the
+	// unix socket pass the localhost only ACL.
+	get := func(client *http.Client, host string) int {
+		resp, err := client.Get("http://" + host + "/_health")
+		T.ExpectSuccess(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, l := range s.listeners[:2] {
+		T.Equal(get(http.DefaultClient, l.Addr().String()), http.StatusOK)
+	}
+	unixClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(
+				ctx context.Context,
+				_, _ string,
+			) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	T.Equal(get(unixClient, "blobby"), http.StatusOK)
+
+	// If one listener fails then all of them are closed.
+	s.listeners[1].Close()
+	select {
+	case err := <-errs:
+		T.NotEqual(err, nil)
+	case <-time.After(5 * time.Second):
+		T.Fatalf("Run() did not return.")
+	}
+	_, err = net.Dial("tcp", s.listeners[0].Addr().String())
+	T.NotEqual(err, nil)
+	_, err = os.Stat(socket)
+	T.Equal(os.IsNotExist(err), true)
+
+	// Something that is not a socket is never removed.
+	file := filepath.Join(dir, "file")
+	T.ExpectSuccess(os.WriteFile(file, nil, 0644))
+	s = newTestServer(Settings{
+		Addr:      "127.0.0.1",
+		Listeners: []ListenerSettings{{Network: "unix", Address: file}},
+	})
+	T.NotEqual(s.Listen(), nil)
+	_, err = os.Stat(file)
+	T.ExpectSuccess(err)
+}
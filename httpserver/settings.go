@@ -14,6 +14,11 @@ type Settings struct {
 	Addr string
 	Port int
 
+	// Additional endpoints that the server should listen on along side
+	// Addr and Port. Requests from every endpoint are served by the same
+	// handler.
+	Listeners []ListenerSettings
+
 	// A list of namespaces, mapped by name, that should be served
 	// by this HTTP server.
 	NameSpaces map[string]*NameSpaceSettings
@@ -54,6 +59,23 @@ type Settings struct {
 	IdleTimeout    time.Duration
 	MaxHeaderBytes int
 
+	// If non zero then any connection that has been open for longer than
+	// this will be sent a "Connection: close" header on the next response
+	// which forces the client to reconnect. This is useful for ensuring
+	// that long lived keep-alive connections get rebalanced across servers
+	// behind a load balancer.
+	MaxConnectionLifetime time.Duration
+
+	// The longest that ShutDown() will wait for pending files to be
+	// uploaded before it closes the listeners. If zero then the listeners
+	// are closed as soon as the namespaces start draining.
+	ShutDownGracePeriod time.Duration
+
+	// The machine ID of this server. This is returned in the Machine-ID
+	// header of every response so that other servers can detect when two
+	// machines have been configured with the same ID.
+	MachineID uint32
+
 	// The prefix for the namespace= tag; a value of blobby_ for this field
 	// would give blobby_namespace as the tag key in the rendered Prometheus
 	// metrics:
@@ -70,6 +92,20 @@ type Settings struct {
 	SAMLAuth map[string]*access.SAML
 }
 
+// An additional endpoint that the server will listen on.
+type ListenerSettings struct {
+	// The network to listen on, this is either "tcp" or "unix".
+	Network string
+
+	// The address to listen on. For tcp this is a host:port pair and for
+	// unix it is the path of the socket.
+	Address string
+
+	// If true then connections to this endpoint will be served with TLS
+	// using the certificates from Settings.TLSCerts.
+	TLS bool
+}
+
 // Each name space is given a specific security ACL configuration that allows
 // it to be protected.
 type NameSpaceSettings struct {
@@ -81,6 +117,17 @@ type NameSpaceSettings struct {
 	// name space.
 	BlastPathACL *access.ACL
 
+	// The maximum number of bytes that can be requested in a single
+	// BLASTGET request, or across all of the ranges in a BLASTMULTIGET
+	// request. Larger requests are rejected and the caller is expected to
+	// paginate. Zero means there is no limit.
+	BlastPathMaxBytes uint64
+
+	// Protections around deleting uploaded files from this name space. If
+	// this is nil then deletes are refused rather than being open to
+	// everyone like the other ACLs.
+	DeleteACL *access.ACL
+
 	// Protections around replica related operations. Servers in this Access
 	// Control List will be able to create, update, and destroy replicas
 	// on this server.
@@ -92,3 +139,29 @@ type NameSpaceSettings struct {
 	// Protections around insert access for this specific name space.
 	InsertACL *access.ACL
 }
+
+// Returns every ACL configured in the settings. Nil ACLs are skipped.
+func (s *Settings) acls() []*access.ACL {
+	all := []*access.ACL{
+		s.DebugPathsACL,
+		s.HealthCheckACL,
+		s.StatusACL,
+		s.ShutDownACL,
+	}
+	for _, ns := range s.NameSpaces {
+		all = append(
+			all,
+			ns.BlastPathACL,
+			ns.DeleteACL,
+			ns.PrimaryACL,
+			ns.ReadACL,
+			ns.InsertACL)
+	}
+	acls := make([]*access.ACL, 0, len(all))
+	for _, acl := range all {
+		if acl != nil {
+			acls = append(acls, acl)
+		}
+	}
+	return acls
+}
@@ -0,0 +1,36 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Calculates how long to wait between attempts of an operation that is
+// being retried. The delay doubles with each retry starting from Base and
+// is limited to Max. A random jitter is applied so that operations that
+// failed at the same time do not all retry at the same time.
+type Exponential struct {
+	// The delay before the first retry.
+	Base time.Duration
+
+	// The largest delay that will be returned.
+	Max time.Duration
+}
+
+// Returns the delay to wait before the given retry, where 1 is the first
+// retry. The returned value is chosen at random between half of the
+// exponential delay and the full delay.
+func (e *Exponential) Delay(retry int) time.Duration {
+	delay := e.Base
+	for i := 1; i < retry && delay < e.Max; i++ {
+		delay *= 2
+	}
+	if delay > e.Max {
+		delay = e.Max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
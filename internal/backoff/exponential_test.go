@@ -0,0 +1,44 @@
+package backoff
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestExponential_Delay(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	e := Exponential{
+		Base: time.Second,
+		Max:  time.Second * 10,
+	}
+
+	// Each retry should be between half and all of the exponential delay,
+	// limited to the maximum.
+	want := []time.Duration{
+		time.Second,
+		time.Second * 2,
+		time.Second * 4,
+		time.Second * 8,
+		time.Second * 10,
+		time.Second * 10,
+	}
+	for i, max := range want {
+		for j := 0; j < 100; j++ {
+			d := e.Delay(i + 1)
+			msg := fmt.Sprintf("retry %d: %s", i+1, d)
+			T.Equal(d >= max/2, true, msg)
+			T.Equal(d <= max, true, msg)
+		}
+	}
+
+	// Very large retry counts should not overflow.
+	T.Equal(e.Delay(1000) <= e.Max, true)
+
+	// A zero value never waits.
+	T.Equal((&Exponential{}).Delay(3), time.Duration(0))
+}
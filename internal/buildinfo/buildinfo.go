@@ -0,0 +1,31 @@
+package buildinfo
+
+import (
+	"runtime"
+)
+
+// Details about the build that are expected to be set via -ldflags/-X by
+// the linker. See scripts/build.
+var (
+	Version   = "unknown"
+	Commit    = "unknown"
+	TimeEpoch = "unknown"
+)
+
+// The build details in a form that can be returned to callers.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	TimeEpoch string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Returns the details of the running build.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		TimeEpoch: TimeEpoch,
+		GoVersion: runtime.Version(),
+	}
+}
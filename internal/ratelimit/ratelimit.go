@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limits the rate at which bytes can be consumed using a token bucket. A
+// single Limiter can be shared by many readers in order to limit their
+// combined throughput. A nil Limiter, or one with BytesPerSecond set to
+// zero, does not limit anything.
+type Limiter struct {
+	// The number of bytes per second that are allowed through the limiter.
+	BytesPerSecond int64
+
+	// The number of tokens currently available. This is allowed to go
+	// negative which indicates that callers have reserved tokens that
+	// have not been generated yet.
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// Returns the largest number of bytes that can be requested by a single
+// call to Wait(). This is a tenth of a second worth of data so that bursts
+// are kept short.
+func (l *Limiter) burst() int64 {
+	if b := l.BytesPerSecond / 10; b > 0 {
+		return b
+	}
+	return 1
+}
+
+// Blocks until n bytes are allowed through the limiter, or until the
+// context is canceled. n must not be larger than burst().
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || l.BytesPerSecond <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(l.burst())
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.BytesPerSecond)
+		if max := float64(l.burst()); l.tokens > max {
+			l.tokens = max
+		}
+	}
+	l.last = now
+
+	// Reserve the tokens even if they are not available yet so that
+	// callers are served in the order they arrived, then sleep until
+	// the tokens would have been generated.
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(
+			-l.tokens / float64(l.BytesPerSecond) * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wraps the given ReadSeeker so that reads from it are limited by l. If l
+// does not limit anything then r is returned as is.
+func (l *Limiter) ReadSeeker(ctx context.Context, r io.ReadSeeker) io.ReadSeeker {
+	if l == nil || l.BytesPerSecond <= 0 {
+		return r
+	}
+	return &readSeeker{ReadSeeker: r, ctx: ctx, limiter: l}
+}
+
+// Limits reads from a ReadSeeker. Seeks are passed through as is.
+type readSeeker struct {
+	io.ReadSeeker
+	ctx     context.Context
+	limiter *Limiter
+}
+
+func (r *readSeeker) Read(p []byte) (int, error) {
+	if burst := r.limiter.burst(); int64(len(p)) > burst {
+		p = p[:burst]
+	}
+	if err := r.limiter.Wait(r.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return r.ReadSeeker.Read(p)
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestLimiter_ReadSeeker(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A Limiter that does not limit anything returns the reader as is.
+	r := bytes.NewReader(make([]byte, 10))
+	T.Equal((*Limiter)(nil).ReadSeeker(context.Background(), r), r)
+	T.Equal((&Limiter{}).ReadSeeker(context.Background(), r), r)
+
+	// Reading 500KB at 1MB/s should take roughly 0.4s since the first
+	// 100KB is available immediately.
+	l := &Limiter{BytesPerSecond: 1000 * 1000}
+	data := make([]byte, 500*1000)
+	start := time.Now()
+	n, err := io.Copy(
+		io.Discard,
+		l.ReadSeeker(context.Background(), bytes.NewReader(data)))
+	elapsed := time.Since(start)
+	T.ExpectSuccess(err)
+	T.Equal(n, int64(len(data)))
+	T.Equal(elapsed > time.Millisecond*350, true, elapsed.String())
+	T.Equal(elapsed < time.Millisecond*800, true, elapsed.String())
+
+	// Two readers sharing the limiter split the throughput between them.
+	start = time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := io.Copy(
+				io.Discard,
+				l.ReadSeeker(
+					context.Background(),
+					bytes.NewReader(data[:200*1000])))
+			done <- err
+		}()
+	}
+	T.ExpectSuccess(<-done)
+	T.ExpectSuccess(<-done)
+	elapsed = time.Since(start)
+	T.Equal(elapsed > time.Millisecond*300, true, elapsed.String())
+	T.Equal(elapsed < time.Millisecond*800, true, elapsed.String())
+}
+
+func TestLimiter_Wait_Canceled(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Once the burst is used up a canceled context stops the wait.
+	l := &Limiter{BytesPerSecond: 10}
+	T.ExpectSuccess(l.Wait(context.Background(), 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	T.ExpectErrorMessage(l.Wait(ctx, 1), "context canceled")
+}
@@ -0,0 +1,45 @@
+package semaphore
+
+import (
+	"context"
+)
+
+// Limits the number of callers that can hold a slot at any given time. A
+// single Semaphore can be shared by many users in order to limit their
+// combined concurrency. A nil Semaphore does not limit anything.
+type Semaphore struct {
+	// A buffered channel with one entry per slot that is currently held.
+	slots chan struct{}
+}
+
+// Returns a new Semaphore that allows size slots to be held at once. If
+// size is less than 1 then nil is returned which does not limit anything.
+func New(size int) *Semaphore {
+	if size < 1 {
+		return nil
+	}
+	return &Semaphore{slots: make(chan struct{}, size)}
+}
+
+// Blocks until a slot is available, or until the context is canceled. Every
+// successful call must be paired with a call to Release() once the caller
+// is done with the slot.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Releases a slot that was obtained with Acquire().
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
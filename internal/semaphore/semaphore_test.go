@@ -0,0 +1,56 @@
+package semaphore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestSemaphore(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A Semaphore that does not limit anything never blocks.
+	T.Equal(New(0), (*Semaphore)(nil))
+	var s *Semaphore
+	T.ExpectSuccess(s.Acquire(context.Background()))
+	s.Release()
+
+	// Only size callers can hold a slot at once.
+	s = New(2)
+	held := int32(0)
+	max := int32(0)
+	done := make(chan struct{}, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			T.ExpectSuccess(s.Acquire(context.Background()))
+			n := atomic.AddInt32(&held, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&held, -1)
+			s.Release()
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	T.Equal(atomic.LoadInt32(&max), int32(2))
+
+	// Waiting for a slot stops once the context is canceled.
+	T.ExpectSuccess(s.Acquire(context.Background()))
+	T.ExpectSuccess(s.Acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Millisecond)
+	defer cancel()
+	T.Equal(s.Acquire(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,25 @@
+package tracing
+
+import (
+	"context"
+)
+
+// The type used as a key when storing a Trace in a context.
+type contextKey struct{}
+
+// Returns a copy of the given context that carries the given Trace. This
+// allows traces to be passed through layers that only accept a context.
+func NewContext(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// Returns the Trace that was stored in the context via NewContext. If there
+// is no Trace in the context then nil is returned, which is safe to use with
+// all of the Trace functions.
+func FromContext(ctx context.Context) *Trace {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(contextKey{}).(*Trace)
+	return t
+}
@@ -0,0 +1,22 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestContext(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A context without a trace returns nil.
+	ctx := context.Background()
+	T.Equal(FromContext(ctx), (*Trace)(nil))
+
+	// And one with a trace returns it.
+	top := New()
+	ctx = NewContext(ctx, top)
+	T.Equal(FromContext(ctx) == top, true)
+}
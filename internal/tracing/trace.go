@@ -65,6 +65,52 @@ func (t *Trace) free() {
 	t.lastChild = nil
 }
 
+// Adds a child to this trace that has already completed and took the given
+// duration. This is used when the timing was measured elsewhere, like on a
+// remote server.
+func (t *Trace) AddChild(name string, d time.Duration) *Trace {
+	if t == nil {
+		return nil
+	}
+	nt := t.NewChild(name)
+	nt.end = nt.start
+	nt.start = nt.end.Add(-d)
+	return nt
+}
+
+// Returns a list of all of the children of this trace in the order that
+// they were created.
+func (t *Trace) Children() []*Trace {
+	if t == nil {
+		return nil
+	}
+	var children []*Trace
+	for n := t.children; n != nil; n = n.next {
+		children = append(children, n)
+	}
+	return children
+}
+
+// Returns the amount of time between the start of this trace and when it
+// ended. If the trace has not ended yet then this returns the time that has
+// passed since it started.
+func (t *Trace) Duration() time.Duration {
+	if t == nil {
+		return 0
+	} else if t.end.IsZero() {
+		return time.Since(t.start)
+	}
+	return t.end.Sub(t.start)
+}
+
+// Returns the name given to this trace.
+func (t *Trace) Name() string {
+	if t == nil {
+		return ""
+	}
+	return t.name
+}
+
 func (t *Trace) NewChild(name string) *Trace {
 	if t == nil {
 		return nil
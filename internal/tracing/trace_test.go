@@ -34,3 +34,22 @@ func TestTrace_String(t *testing.T) {
 	fix(top.NewChild("c2"))
 	T.Equal(top.String(), expected)
 }
+
+func TestTrace_AddChild(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	top := New()
+	c := top.AddChild("remote", time.Second)
+	T.Equal(c.Name(), "remote")
+	T.Equal(c.Duration(), time.Second)
+	T.Equal(len(top.Children()), 1)
+	T.Equal(top.Children()[0] == c, true)
+
+	// Nil traces are safe.
+	var n *Trace
+	T.Equal(n.AddChild("nil", time.Second), (*Trace)(nil))
+	T.Equal(len(n.Children()), 0)
+	T.Equal(n.Name(), "")
+	T.Equal(n.Duration(), time.Duration(0))
+}
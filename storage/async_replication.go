@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Queues the data described by rc to be replicated in the background. If
+// Settings.AsyncReplicationMaxPending inserts are already waiting to be
+// replicated then this will block until there is room in the queue. This
+// returns true if a previous background replication failed, or a replica
+// indicated that it is shutting down, in which case the primary should stop
+// accepting new data.
+func (p *primary) queueReplication(rc replicatorConfig) bool {
+	p.asyncStart.Do(func() {
+		p.asyncQueue = make(
+			chan replicatorConfig,
+			p.settings.AsyncReplicationMaxPending)
+		go p.asyncReplicator()
+	})
+	p.asyncPending.Add(1)
+	p.asyncQueue <- rc
+	return atomic.LoadInt32(&p.asyncFailed) != 0 ||
+		atomic.LoadInt32(&p.asyncShutdown) != 0
+}
+
+// Runs in a goroutine replicating queued inserts one at a time so that the
+// replicas receive them in the same order that they were written locally.
+func (p *primary) asyncReplicator() {
+	ctx := context.Background()
+	for rc := range p.asyncQueue {
+		// Once a replication has failed the replicas will no longer be in
+		// sync with the primary so there is no point in sending them any
+		// more data. Even the remotes that accepted this insert will miss
+		// the ones queued after it, so every remote is failed and deleted
+		// rather than left to be orphaned with partial data.
+		if atomic.LoadInt32(&p.asyncFailed) == 0 {
+			shuttingDown, err := p.replicate(ctx, nil, rc)
+			if err != nil {
+				atomic.StoreInt32(&p.asyncFailed, 1)
+				for i := range p.remotes {
+					p.failRemote(ctx, i)
+				}
+			} else if shuttingDown {
+				atomic.StoreInt32(&p.asyncShutdown, 1)
+			}
+		}
+		p.asyncPending.Done()
+	}
+}
+
+// Blocks until all of the inserts queued for background replication have
+// been replicated and then stops the background replicator. This must be
+// called before the file is compressed, uploaded or its remotes are
+// deleted.
+func (p *primary) waitForReplication() {
+	if !p.settings.AsyncReplication {
+		return
+	}
+	p.asyncPending.Wait()
+	p.asyncStop.Do(func() {
+		if p.asyncQueue != nil {
+			close(p.asyncQueue)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestPrimary_AsyncReplication_Failure(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// One remote refuses the data so the replication as a whole fails.
+	deleted := int32(0)
+	del := func(namespace, fn string) error {
+		atomic.AddInt32(&deleted, 1)
+		return nil
+	}
+	good := testRemote{
+		name: "good",
+		del:  del,
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			return false, nil
+		},
+	}
+	bad := testRemote{
+		name: "bad",
+		del:  del,
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			return false, fmt.Errorf("EXPECTED")
+		},
+	}
+	fd := T.TempFile()
+	_, err := fd.WriteString("0123456789")
+	T.ExpectSuccess(err)
+	p := primary{
+		fd:            fd,
+		fidStr:        "fidTest",
+		log:           NewTestLogger(),
+		storage:       &Storage{},
+		remotes:       []Remote{&good, &bad},
+		failedRemotes: make([]int32, 2),
+		settings: &Settings{
+			AsyncReplication:           true,
+			AsyncReplicationMaxPending: 1,
+		},
+	}
+	p.queueReplication(replicatorConfig{fd: fd, start: 0, end: 4})
+	p.waitForReplication()
+
+	// Every remote is failed and deleted, even the one that accepted the
+	// data, since none of them will receive the inserts that follow.
+	T.Equal(atomic.LoadInt32(&p.asyncFailed), int32(1))
+	T.Equal(p.remoteFailed(0), true)
+	T.Equal(p.remoteFailed(1), true)
+	T.TryUntil(func() bool {
+		return atomic.LoadInt32(&deleted) == 2
+	}, time.Second)
+}
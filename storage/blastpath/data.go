@@ -8,3 +8,25 @@ type Record struct {
 	S3Bucket string `json:"s3_bucket,omitempty"`
 	S3Key    string `json:"s3_key,omitempty"`
 }
+
+// The output of the BLASTLIST call is written as JSON Lines with one of
+// these per line. Each describes a primary or replica file that is held
+// locally in the given namespace.
+type File struct {
+	FID      string `json:"fid"`
+	Type     string `json:"type"`
+	State    string `json:"state"`
+	Size     uint64 `json:"size"`
+	Records  int    `json:"records"`
+	S3Bucket string `json:"s3_bucket"`
+	S3Key    string `json:"s3_key"`
+}
+
+// A range of a primary file requested in a BLASTMULTIGET call. The body of
+// the request is a JSON array of these. The response contains a segment
+// for each range in the order requested, each being the length of the data
+// as an 8 byte big endian integer followed by the data itself.
+type Range struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// Store the compress index as a compact binary file. This is the
+	// default if no format is configured.
+	CompressIndexFormatBinary = "binary"
+
+	// Store the compress index as JSON, which is larger but can be easily
+	// inspected by other tools.
+	CompressIndexFormatJSON = "json"
+
+	// The suffix added to the S3 key of a compressed object in order to
+	// get the key that its compress index is stored under.
+	compressIndexSuffix = ".index"
+)
+
+// The first bytes of a binary compress index. Indexes are always decoded
+// by looking at the content rather than the configured format so that
+// changing the format does not break reads of previously uploaded objects.
+var compressIndexMagic = []byte("BLBYIDX1")
+
+// Maps offsets in the uncompressed data to offsets in the compressed file.
+// When an index is being generated the compressed file is written as a
+// series of independent compressed streams, each starting at a checkpoint,
+// so decompression can start at any checkpoint without needing any of the
+// data that came before it.
+type compressIndex struct {
+	// The number of uncompressed bytes between each checkpoint.
+	Interval uint64 `json:"interval"`
+
+	// The checkpoints, in order of offset.
+	Checkpoints []compressCheckpoint `json:"checkpoints"`
+}
+
+// A single point in the compressed file where a new compressed stream
+// starts.
+type compressCheckpoint struct {
+	Uncompressed uint64 `json:"uncompressed"`
+	Compressed   uint64 `json:"compressed"`
+}
+
+// Returns the checkpoint that a read starting at the given uncompressed
+// offset must start decompressing from.
+func (c *compressIndex) find(offset uint64) compressCheckpoint {
+	i := sort.Search(len(c.Checkpoints), func(i int) bool {
+		return c.Checkpoints[i].Uncompressed > offset
+	})
+	if i == 0 {
+		return compressCheckpoint{}
+	}
+	return c.Checkpoints[i-1]
+}
+
+// Returns the compressed offset that a read ending at the given uncompressed
+// offset is guaranteed to be complete by, or zero if the read must continue
+// to the end of the compressed file.
+func (c *compressIndex) end(offset uint64) uint64 {
+	i := sort.Search(len(c.Checkpoints), func(i int) bool {
+		return c.Checkpoints[i].Uncompressed >= offset
+	})
+	if i == len(c.Checkpoints) {
+		return 0
+	}
+	return c.Checkpoints[i].Compressed
+}
+
+// Encodes the index in the given format.
+func (c *compressIndex) encode(format string) ([]byte, error) {
+	switch format {
+	case "", CompressIndexFormatBinary:
+		buffer := bytes.Buffer{}
+		buffer.Write(compressIndexMagic)
+		binary.Write(&buffer, binary.BigEndian, c.Interval)
+		binary.Write(&buffer, binary.BigEndian, uint64(len(c.Checkpoints)))
+		binary.Write(&buffer, binary.BigEndian, c.Checkpoints)
+		return buffer.Bytes(), nil
+	case CompressIndexFormatJSON:
+		return json.Marshal(c)
+	default:
+		return nil, fmt.Errorf("Unknown compress index format: %s", format)
+	}
+}
+
+// Decodes an index that was encoded in any of the supported formats.
+func decodeCompressIndex(data []byte) (*compressIndex, error) {
+	c := &compressIndex{}
+	if !bytes.HasPrefix(data, compressIndexMagic) {
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	r := bytes.NewReader(data[len(compressIndexMagic):])
+	count := uint64(0)
+	if err := binary.Read(r, binary.BigEndian, &c.Interval); err != nil {
+		return nil, err
+	} else if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	} else if count > uint64(r.Len())/16 {
+		return nil, fmt.Errorf("Compress index is truncated.")
+	}
+	c.Checkpoints = make([]compressCheckpoint, count)
+	if err := binary.Read(r, binary.BigEndian, c.Checkpoints); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Tracks the number of bytes written to the underlying Writer.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += uint64(n)
+	return
+}
+
+// Compresses length bytes from src into dst. If interval is greater than
+// zero then a new compressed stream is started every interval bytes and
+// the index of where each stream starts is returned, otherwise the data is
+// written as a single stream and the returned index is nil.
+func compressData(
+	dst io.Writer,
+	src io.Reader,
+	c compressor,
+	level int,
+	length uint64,
+	interval uint64,
+) (*compressIndex, error) {
+	indexed := interval > 0
+	if !indexed {
+		interval = length
+	}
+	counter := countingWriter{w: dst}
+	index := &compressIndex{Interval: interval}
+	buffer := [4096]byte{}
+	for offset := uint64(0); offset == 0 || offset < length; {
+		index.Checkpoints = append(index.Checkpoints, compressCheckpoint{
+			Uncompressed: offset,
+			Compressed:   counter.n,
+		})
+		zipper, err := c.NewWriter(&counter, level)
+		if err != nil {
+			return nil, err
+		}
+		size := interval
+		if size > length-offset {
+			size = length - offset
+		}
+		n, err := io.CopyBuffer(
+			zipper,
+			io.LimitReader(src, int64(size)),
+			buffer[:])
+		if err != nil {
+			return nil, err
+		} else if uint64(n) != size {
+			return nil, fmt.Errorf(
+				"Short read while compressing, copied %d of %d bytes.",
+				n,
+				size)
+		} else if err := zipper.Close(); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			break
+		}
+		offset += size
+	}
+	if !indexed {
+		return nil, nil
+	}
+	return index, nil
+}
+
+// Reads decompressed data while making sure that both the decompressor and
+// the underlying source are closed when finished.
+type compressedReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (c *compressedReadCloser) Close() (err error) {
+	for _, closer := range c.closers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	lrulist "container/list"
+	"sync"
+)
+
+// The number of compress indexes that are kept in memory by each Storage.
+// Indexes only hold a couple of offsets per checkpoint so this stays small
+// even for large objects.
+const compressIndexCacheEntries = 1024
+
+// Keeps the compress indexes of objects in S3 after they have been fetched
+// once so that every read of a compressed object does not need to fetch its
+// index again. Uploaded objects never change so entries only need to be
+// removed when the object is deleted. Once there are more than
+// compressIndexCacheEntries indexes the least recently used are evicted.
+// The zero value is ready to use.
+type compressIndexCache struct {
+	lock    sync.Mutex
+	entries map[string]*lrulist.Element
+	lru     lrulist.List
+}
+
+// A single index in the cache.
+type compressIndexCacheEntry struct {
+	key   string
+	index *compressIndex
+}
+
+// Returns the cached index for the object at the given key, or nil if it
+// is not cached.
+func (c *compressIndexCache) get(key string) *compressIndex {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elm, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elm)
+	return elm.Value.(*compressIndexCacheEntry).index
+}
+
+// Adds the index for the object at the given key, evicting the least
+// recently used index if the cache is full.
+func (c *compressIndexCache) add(key string, index *compressIndex) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*lrulist.Element)
+	}
+	if elm, ok := c.entries[key]; ok {
+		elm.Value.(*compressIndexCacheEntry).index = index
+		c.lru.MoveToFront(elm)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&compressIndexCacheEntry{
+		key:   key,
+		index: index,
+	})
+	for c.lru.Len() > compressIndexCacheEntries {
+		elm := c.lru.Back()
+		c.lru.Remove(elm)
+		delete(c.entries, elm.Value.(*compressIndexCacheEntry).key)
+	}
+}
+
+// Forgets the index for the object at the given key.
+func (c *compressIndexCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elm, ok := c.entries[key]; ok {
+		c.lru.Remove(elm)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestCompressIndexCache(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	c := compressIndexCache{}
+	first := &compressIndex{Interval: 1}
+	second := &compressIndex{Interval: 2}
+
+	// Indexes are returned once added, until they are removed.
+	T.Equal(c.get("first"), (*compressIndex)(nil))
+	c.add("first", first)
+	c.add("second", second)
+	T.Equal(c.get("first"), first)
+	T.Equal(c.get("second"), second)
+	c.remove("second")
+	T.Equal(c.get("second"), (*compressIndex)(nil))
+
+	// Once full the least recently used index is evicted. Reading the
+	// first index keeps it from being the oldest.
+	c.add("second", second)
+	for i := 0; i < compressIndexCacheEntries-2; i++ {
+		c.add(strconv.Itoa(i), &compressIndex{})
+	}
+	T.Equal(c.get("first"), first)
+	c.add("last", &compressIndex{})
+	T.Equal(c.lru.Len(), compressIndexCacheEntries)
+	T.Equal(c.get("second"), (*compressIndex)(nil))
+	T.Equal(c.get("first"), first)
+}
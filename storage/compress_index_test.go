@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestCompressData(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	data := "0123456789"
+	for name, c := range compressors {
+		// Without an interval the data is written as a single stream and
+		// no index is returned.
+		buffer := bytes.Buffer{}
+		index, err := compressData(
+			&buffer,
+			strings.NewReader(data),
+			c,
+			c.Level(0),
+			uint64(len(data)),
+			0)
+		T.ExpectSuccess(err, name)
+		T.Equal(index, (*compressIndex)(nil), name)
+		r, err := c.NewReader(bytes.NewReader(buffer.Bytes()))
+		T.ExpectSuccess(err, name)
+		out, err := io.ReadAll(r)
+		T.ExpectSuccess(err, name)
+		T.Equal(string(out), data, name)
+
+		// With an interval each checkpoint must be able to be decompressed
+		// without any of the data that came before it.
+		buffer.Reset()
+		index, err = compressData(
+			&buffer,
+			strings.NewReader(data),
+			c,
+			c.Level(0),
+			uint64(len(data)),
+			3)
+		T.ExpectSuccess(err, name)
+		T.Equal(index.Interval, uint64(3), name)
+		T.Equal(len(index.Checkpoints), 4, name)
+		for i, cp := range index.Checkpoints {
+			T.Equal(cp.Uncompressed, uint64(i*3), name)
+			r, err := c.NewReader(
+				bytes.NewReader(buffer.Bytes()[cp.Compressed:]))
+			T.ExpectSuccess(err, name)
+			out, err := io.ReadAll(r)
+			T.ExpectSuccess(err, name)
+			T.Equal(string(out), data[cp.Uncompressed:], name)
+		}
+
+		// The source being shorter than the length is an error.
+		buffer.Reset()
+		_, err = compressData(
+			&buffer,
+			strings.NewReader(data),
+			c,
+			c.Level(0),
+			uint64(len(data)+1),
+			3)
+		T.ExpectErrorMessage(
+			err,
+			"Short read while compressing, copied 1 of 2 bytes.",
+			name)
+	}
+}
+
+func TestCompressIndex_Find(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	index := compressIndex{
+		Interval: 10,
+		Checkpoints: []compressCheckpoint{
+			{Uncompressed: 0, Compressed: 0},
+			{Uncompressed: 10, Compressed: 7},
+			{Uncompressed: 20, Compressed: 15},
+		},
+	}
+	T.Equal(index.find(0), index.Checkpoints[0])
+	T.Equal(index.find(9), index.Checkpoints[0])
+	T.Equal(index.find(10), index.Checkpoints[1])
+	T.Equal(index.find(25), index.Checkpoints[2])
+	T.Equal(index.end(5), uint64(7))
+	T.Equal(index.end(10), uint64(7))
+	T.Equal(index.end(11), uint64(15))
+	T.Equal(index.end(21), uint64(0))
+}
+
+func TestCompressIndex_Encode(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	index := &compressIndex{
+		Interval: 10,
+		Checkpoints: []compressCheckpoint{
+			{Uncompressed: 0, Compressed: 0},
+			{Uncompressed: 10, Compressed: 7},
+		},
+	}
+	for _, format := range []string{
+		"",
+		CompressIndexFormatBinary,
+		CompressIndexFormatJSON,
+	} {
+		data, err := index.encode(format)
+		T.ExpectSuccess(err, format)
+		decoded, err := decodeCompressIndex(data)
+		T.ExpectSuccess(err, format)
+		T.Equal(decoded, index, format)
+	}
+
+	// Unknown formats can not be encoded.
+	_, err := index.encode("unknown")
+	T.ExpectErrorMessage(err, "Unknown compress index format: unknown")
+
+	// A truncated binary index can not be decoded.
+	data, err := index.encode(CompressIndexFormatBinary)
+	T.ExpectSuccess(err)
+	_, err = decodeCompressIndex(data[:len(data)-1])
+	T.ExpectErrorMessage(err, "Compress index is truncated.")
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The default for Settings.CompressAdaptiveTarget.
+	defaultCompressAdaptiveTarget = time.Minute
+
+	// How much weight each new observation carries in the running averages
+	// kept by the compressTuner.
+	compressTunerWeight = 0.25
+)
+
+// Picks the level used to compress each file when Settings.CompressAdaptive
+// is enabled. After each file is compressed the time it would take to work
+// through the files still waiting in the compress queue is estimated from
+// the recent throughput. If that is longer than the target the level is
+// stepped down toward the fastest level, and if nothing is waiting it is
+// stepped back up. Throughput falls when the machine is short on CPU so
+// this trades compression ratio for keeping up with inserts.
+type compressTuner struct {
+	// The level that will be used for the next file. This is accessed
+	// atomically so that it can be read without the lock.
+	level int32
+
+	// The range that level is kept within.
+	min int
+	max int
+
+	// The longest that the compress queue should take to drain.
+	target time.Duration
+
+	// Running averages of the compression throughput in bytes per second,
+	// and of the size of the files compressed.
+	lock       sync.Mutex
+	throughput float64
+	size       float64
+}
+
+// Returns the level that should be used for the next file.
+func (c *compressTuner) current() int {
+	return int(atomic.LoadInt32(&c.level))
+}
+
+// Records that compressing size bytes took elapsed and that queued files
+// are still waiting to be compressed, then adjusts the level. This returns
+// the level before and after the adjustment.
+func (c *compressTuner) observe(
+	size uint64,
+	elapsed time.Duration,
+	queued int,
+) (
+	int,
+	int,
+) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Update the running averages.
+	if elapsed > 0 {
+		rate := float64(size) / elapsed.Seconds()
+		if c.throughput == 0 {
+			c.throughput = rate
+		} else {
+			c.throughput += (rate - c.throughput) * compressTunerWeight
+		}
+	}
+	if c.size == 0 {
+		c.size = float64(size)
+	} else {
+		c.size += (float64(size) - c.size) * compressTunerWeight
+	}
+
+	old := c.current()
+	level := old
+	if queued == 0 {
+		level += 1
+	} else if c.throughput > 0 {
+		drain := time.Duration(
+			float64(queued) * c.size / c.throughput * float64(time.Second))
+		if drain > c.target {
+			level -= 1
+		}
+	}
+	if level < c.min {
+		level = c.min
+	} else if level > c.max {
+		level = c.max
+	}
+	atomic.StoreInt32(&c.level, int32(level))
+	return old, level
+}
+
+// Returns the level that the next file should be compressed at.
+func (s *Settings) compressLevel() int {
+	if s.compressTuner == nil {
+		return s.CompressLevel
+	}
+	return s.compressTuner.current()
+}
+
+// Called once a file of the given size has been compressed in elapsed so
+// that the level can be adjusted if Settings.CompressAdaptive is enabled.
+// This returns the level before and after the adjustment.
+func (s *Settings) compressed(size uint64, elapsed time.Duration) (int, int) {
+	if s.compressTuner == nil {
+		return s.CompressLevel, s.CompressLevel
+	}
+	queued := 0
+	if s.CompressWorkQueue != nil {
+		queued = s.CompressWorkQueue.Len()
+	}
+	return s.compressTuner.observe(size, elapsed, queued)
+}
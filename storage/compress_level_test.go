@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/internal/workqueue"
+)
+
+func TestCompressTuner_Observe(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	c := &compressTuner{
+		level:  5,
+		min:    2,
+		max:    6,
+		target: time.Second * 10,
+	}
+
+	// 1MB/s with 1MB files means that 5 queued files can be compressed
+	// within the target so the level is left alone.
+	old, level := c.observe(1024*1024, time.Second, 5)
+	T.Equal(old, 5)
+	T.Equal(level, 5)
+
+	// 20 queued files would take too long.
+	old, level = c.observe(1024*1024, time.Second, 20)
+	T.Equal(old, 5)
+	T.Equal(level, 4)
+
+	// Slower compression lowers the level further and it stops at the
+	// minimum.
+	for i := 0; i < 5; i++ {
+		c.observe(1024*1024, time.Second*4, 5)
+	}
+	T.Equal(c.current(), 2)
+
+	// An empty queue raises the level up to the maximum.
+	for i := 0; i < 10; i++ {
+		c.observe(1024*1024, time.Second, 0)
+	}
+	T.Equal(c.current(), 6)
+}
+
+func TestSettings_CompressLevel(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Without a tuner the configured level is always used.
+	s := &Settings{CompressLevel: 3}
+	T.Equal(s.compressLevel(), 3)
+	old, level := s.compressed(100, time.Second)
+	T.Equal(old, 3)
+	T.Equal(level, 3)
+
+	// With a tuner the level follows the depth of the compress queue.
+	s.CompressWorkQueue = workqueue.New(0)
+	s.compressTuner = &compressTuner{
+		level:  3,
+		min:    1,
+		max:    9,
+		target: time.Second,
+	}
+	T.Equal(s.compressLevel(), 3)
+	old, level = s.compressed(100, time.Second)
+	T.Equal(old, 3)
+	T.Equal(level, 4)
+	for i := 0; i < 10; i++ {
+		s.CompressWorkQueue.Insert(func(context.Context) {})
+	}
+	old, level = s.compressed(100, time.Second)
+	T.Equal(old, 4)
+	T.Equal(level, 3)
+	T.Equal(s.compressLevel(), 3)
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// The number of uncompressed bytes that each worker compresses at a
+	// time when Settings.ParallelCompress is enabled.
+	parallelCompressChunkSize = 1024 * 1024 * 4
+
+	// Files smaller than this are always compressed serially since
+	// splitting them up would not save enough time to be worth the extra
+	// streams.
+	parallelCompressMinBytes = parallelCompressChunkSize * 2
+)
+
+// Compresses length bytes from src into dst, building an index every
+// CompressIndexInterval bytes if configured. If ParallelCompress is enabled
+// and the data is large enough then the work is split across
+// ParallelCompressWorkers goroutines.
+func (s *Settings) compressData(
+	dst io.Writer,
+	src io.Reader,
+	c compressor,
+	level int,
+	length uint64,
+) (*compressIndex, error) {
+	if s.ParallelCompress &&
+		s.ParallelCompressWorkers > 1 &&
+		length >= parallelCompressMinBytes {
+		return compressDataParallel(
+			dst,
+			src,
+			c,
+			level,
+			length,
+			s.CompressIndexInterval,
+			s.ParallelCompressWorkers)
+	}
+	return compressData(dst, src, c, level, length, s.CompressIndexInterval)
+}
+
+// A chunk of data that is compressed on its own by compressDataParallel.
+type compressChunk struct {
+	offset uint64
+	data   []byte
+	out    bytes.Buffer
+	err    error
+}
+
+// Like compressData except that the data is split into chunks which are
+// compressed by up to workers goroutines at once. Every chunk is written as
+// its own compressed stream and the streams are written to dst in order.
+// Both gzip and zstd decoders read a series of streams as if it were one so
+// the result can be decompressed by standard tools. Chunks never span a
+// multiple of interval so the index returned is the same as the one
+// returned by compressData.
+func compressDataParallel(
+	dst io.Writer,
+	src io.Reader,
+	c compressor,
+	level int,
+	length uint64,
+	interval uint64,
+	workers int,
+) (*compressIndex, error) {
+	counter := countingWriter{w: dst}
+	index := &compressIndex{Interval: interval}
+	chunks := make([]compressChunk, workers)
+	for offset := uint64(0); offset < length; {
+		// Read the next batch of chunks from the source.
+		batch := chunks[:0]
+		for offset < length && len(batch) < workers {
+			size := uint64(parallelCompressChunkSize)
+			if interval > 0 && interval-offset%interval < size {
+				size = interval - offset%interval
+			}
+			if size > length-offset {
+				size = length - offset
+			}
+			batch = batch[:len(batch)+1]
+			chunk := &batch[len(batch)-1]
+			chunk.offset = offset
+			if uint64(cap(chunk.data)) < size {
+				chunk.data = make([]byte, size)
+			}
+			chunk.data = chunk.data[:size]
+			n, err := io.ReadFull(src, chunk.data)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, err
+			} else if err != nil {
+				return nil, fmt.Errorf(
+					"Short read while compressing, copied %d of %d bytes.",
+					n,
+					size)
+			}
+			offset += size
+		}
+
+		// Compress the batch.
+		wg := sync.WaitGroup{}
+		for i := range batch {
+			wg.Add(1)
+			go func(chunk *compressChunk) {
+				defer wg.Done()
+				chunk.out.Reset()
+				zipper, err := c.NewWriter(&chunk.out, level)
+				if err != nil {
+					chunk.err = err
+				} else if _, err = zipper.Write(chunk.data); err != nil {
+					chunk.err = err
+				} else {
+					chunk.err = zipper.Close()
+				}
+			}(&batch[i])
+		}
+		wg.Wait()
+
+		// And write the results out in order.
+		for i := range batch {
+			chunk := &batch[i]
+			if chunk.err != nil {
+				return nil, chunk.err
+			}
+			if interval > 0 && chunk.offset%interval == 0 {
+				index.Checkpoints = append(
+					index.Checkpoints,
+					compressCheckpoint{
+						Uncompressed: chunk.offset,
+						Compressed:   counter.n,
+					})
+			}
+			if _, err := counter.Write(chunk.out.Bytes()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if interval == 0 {
+		return nil, nil
+	}
+	return index, nil
+}
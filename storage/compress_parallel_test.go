@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestCompressDataParallel(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Enough data for several chunks that ends part way through one.
+	data := &bytes.Buffer{}
+	r := rand.New(rand.NewSource(1))
+	for data.Len() < parallelCompressChunkSize*2+12345 {
+		fmt.Fprintf(data, "line %d\n", r.Int63())
+	}
+	length := uint64(data.Len())
+
+	for name, c := range compressors {
+		// Without an interval no index is returned and the streams read
+		// back as the original data.
+		buffer := bytes.Buffer{}
+		index, err := compressDataParallel(
+			&buffer,
+			bytes.NewReader(data.Bytes()),
+			c,
+			c.Level(0),
+			length,
+			0,
+			2)
+		T.ExpectSuccess(err, name)
+		T.Equal(index, (*compressIndex)(nil), name)
+		zr, err := c.NewReader(bytes.NewReader(buffer.Bytes()))
+		T.ExpectSuccess(err, name)
+		out, err := io.ReadAll(zr)
+		T.ExpectSuccess(err, name)
+		T.Equal(bytes.Equal(out, data.Bytes()), true, name)
+
+		// With an interval that does not line up with the chunks the
+		// checkpoints match the ones made by compressData, and each can be
+		// decompressed on its own.
+		interval := uint64(parallelCompressChunkSize + 1024)
+		buffer.Reset()
+		index, err = compressDataParallel(
+			&buffer,
+			bytes.NewReader(data.Bytes()),
+			c,
+			c.Level(0),
+			length,
+			interval,
+			3)
+		T.ExpectSuccess(err, name)
+		T.Equal(index.Interval, interval, name)
+		T.Equal(len(index.Checkpoints), 3, name)
+		for i, cp := range index.Checkpoints {
+			T.Equal(cp.Uncompressed, uint64(i)*interval, name)
+			zr, err := c.NewReader(
+				bytes.NewReader(buffer.Bytes()[cp.Compressed:]))
+			T.ExpectSuccess(err, name)
+			out, err := io.ReadAll(zr)
+			T.ExpectSuccess(err, name)
+			T.Equal(
+				bytes.Equal(out, data.Bytes()[cp.Uncompressed:]),
+				true,
+				name)
+		}
+
+		// The source being shorter than the length is an error.
+		buffer.Reset()
+		_, err = compressDataParallel(
+			&buffer,
+			bytes.NewReader(data.Bytes()),
+			c,
+			c.Level(0),
+			length+1,
+			0,
+			2)
+		last := length % parallelCompressChunkSize
+		T.ExpectErrorMessage(
+			err,
+			fmt.Sprintf(
+				"Short read while compressing, copied %d of %d bytes.",
+				last,
+				last+1),
+			name)
+	}
+}
+
+func TestSettings_CompressData(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Small files are compressed serially so they are a single stream.
+	s := &Settings{
+		ParallelCompress:        true,
+		ParallelCompressWorkers: 4,
+	}
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	buffer := bytes.Buffer{}
+	_, err := s.compressData(
+		&buffer,
+		bytes.NewReader(data),
+		gzipCompressor{},
+		gzip.DefaultCompression,
+		uint64(len(data)))
+	T.ExpectSuccess(err)
+	zr, err := gzip.NewReader(&buffer)
+	T.ExpectSuccess(err)
+	zr.Multistream(false)
+	out, err := io.ReadAll(zr)
+	T.ExpectSuccess(err)
+	T.Equal(bytes.Equal(out, data), true)
+	T.Equal(zr.Reset(&buffer), io.EOF)
+
+	// Large files are split into several streams.
+	data = bytes.Repeat(data, parallelCompressMinBytes/len(data)+1)
+	buffer.Reset()
+	_, err = s.compressData(
+		&buffer,
+		bytes.NewReader(data),
+		gzipCompressor{},
+		gzip.DefaultCompression,
+		uint64(len(data)))
+	T.ExpectSuccess(err)
+	zr, err = gzip.NewReader(&buffer)
+	T.ExpectSuccess(err)
+	zr.Multistream(false)
+	out, err = io.ReadAll(zr)
+	T.ExpectSuccess(err)
+	T.Equal(bytes.Equal(out, data[:parallelCompressChunkSize]), true)
+	T.ExpectSuccess(zr.Reset(&buffer))
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Compress files with gzip. This is the default if no algorithm is
+	// configured.
+	CompressAlgorithmGzip = "gzip"
+
+	// Compress files with zstd.
+	CompressAlgorithmZstd = "zstd"
+)
+
+// An algorithm that can be used to compress files before they are uploaded
+// to S3.
+type compressor interface {
+	// The extension (including the leading dot) that is added to the name
+	// of the data file when writing the compressed copy to disk.
+	Extension() string
+
+	// The range of levels that can be configured for this algorithm. A
+	// level of zero always selects the algorithm's default level.
+	Levels() (min, max int)
+
+	// Converts a configured level into the level that will be passed to
+	// NewWriter().
+	Level(configured int) int
+
+	// Returns a WriteCloser that compresses all data written to it into w
+	// at the given level, as returned from Level(). Closing the returned writer flushes any buffered
+	// data but does not close w.
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+
+	// Returns a ReadCloser that decompresses data read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// All of the supported compression algorithms, keyed by the name used in
+// Settings.CompressAlgorithm.
+var compressors = map[string]compressor{
+	CompressAlgorithmGzip: gzipCompressor{},
+	CompressAlgorithmZstd: zstdCompressor{},
+}
+
+// Returns the compressor for the given algorithm name, or nil if the name is
+// not known. An empty name will return the gzip compressor.
+func getCompressor(name string) compressor {
+	if name == "" {
+		name = CompressAlgorithmGzip
+	}
+	return compressors[name]
+}
+
+// Returns true if the file name ends with the extension of any of the
+// supported compression algorithms.
+func isCompressedFileName(name string) bool {
+	for _, c := range compressors {
+		ext := c.Extension()
+		if len(name) > len(ext) && name[len(name)-len(ext):] == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Compression via compress/gzip.
+type gzipCompressor struct{}
+
+func (g gzipCompressor) Extension() string {
+	return ".gz"
+}
+
+func (g gzipCompressor) Levels() (min, max int) {
+	return -1, gzip.BestCompression
+}
+
+// Since zero is used to select the default level, -1 is used to indicate
+// that no compression should be performed.
+func (g gzipCompressor) Level(configured int) int {
+	switch configured {
+	case 0:
+		return gzip.DefaultCompression
+	case -1:
+		return gzip.NoCompression
+	}
+	return configured
+}
+
+func (g gzipCompressor) NewWriter(w io.Writer, l int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, l)
+}
+
+func (g gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Compression via zstd. Levels match those used by the zstd command line
+// tool and are mapped to the closest level supported by the encoder.
+type zstdCompressor struct{}
+
+func (z zstdCompressor) Extension() string {
+	return ".zst"
+}
+
+func (z zstdCompressor) Levels() (min, max int) {
+	return 0, 22
+}
+
+func (z zstdCompressor) Level(configured int) int {
+	if configured == 0 {
+		return 3
+	}
+	return configured
+}
+
+func (z zstdCompressor) NewWriter(w io.Writer, l int) (io.WriteCloser, error) {
+	return zstd.NewWriter(
+		w,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(l)))
+}
+
+func (z zstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// Returns the compressor for the algorithm configured in these Settings.
+func (s *Settings) compressor() compressor {
+	return getCompressor(s.CompressAlgorithm)
+}
+
+// Returns the lowest compression level allowed for the algorithm configured
+// in the given Settings.
+func minCompressLevel(s *Settings) int {
+	min, _ := s.compressor().Levels()
+	return min
+}
+
+// Returns the highest compression level allowed for the algorithm
+// configured in the given Settings.
+func maxCompressLevel(s *Settings) int {
+	_, max := s.compressor().Levels()
+	return max
+}
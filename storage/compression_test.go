@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestCompressors(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	data := bytes.Repeat([]byte("test data "), 1000)
+	for name, c := range compressors {
+		min, max := c.Levels()
+		for _, level := range []int{0, min, max} {
+			// Compress the data.
+			buffer := bytes.Buffer{}
+			w, err := c.NewWriter(&buffer, c.Level(level))
+			T.ExpectSuccessf(err, "%s level %d", name, level)
+			_, err = w.Write(data)
+			T.ExpectSuccess(err)
+			T.ExpectSuccess(w.Close())
+
+			// And make sure that it decompresses to the same thing.
+			r, err := c.NewReader(&buffer)
+			T.ExpectSuccess(err)
+			out, err := io.ReadAll(r)
+			T.ExpectSuccess(err)
+			T.ExpectSuccess(r.Close())
+			T.Equalf(out, data, "%s level %d", name, level)
+		}
+	}
+}
+
+func TestGetCompressor(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	T.Equal(getCompressor(""), compressor(gzipCompressor{}))
+	T.Equal(getCompressor("gzip"), compressor(gzipCompressor{}))
+	T.Equal(getCompressor("zstd"), compressor(zstdCompressor{}))
+	T.Equal(getCompressor("unknown"), nil)
+}
+
+func TestIsCompressedFileName(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	T.Equal(isCompressedFileName("file.gz"), true)
+	T.Equal(isCompressedFileName("file.zst"), true)
+	T.Equal(isCompressedFileName("file"), false)
+	T.Equal(isCompressedFileName(".gz"), false)
+}
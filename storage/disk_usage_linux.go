@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Returns the fraction of the file system holding dir that is in use, from
+// 0 to 1. Space reserved for the root user is counted as used since Blobby
+// can not write to it.
+func diskUsage(dir string) (float64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	} else if st.Blocks == 0 {
+		return 0, fmt.Errorf("The file system holding %s has no blocks.", dir)
+	}
+	return 1 - float64(st.Bavail)/float64(st.Blocks), nil
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestDiskUsage(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	used, err := diskUsage(T.TempDir())
+	T.ExpectSuccess(err)
+	if used < 0 || used > 1 {
+		T.Fatalf("Disk usage %f is out of range.", used)
+	}
+
+	_, err = diskUsage("/does/not/exist")
+	T.ExpectError(err)
+}
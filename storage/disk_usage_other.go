@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+// Disk usage is only supported on Linux.
+func diskUsage(dir string) (float64, error) {
+	return 0, ErrNotPossible{}
+}
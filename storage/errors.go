@@ -4,6 +4,50 @@ import (
 	"fmt"
 )
 
+type ErrBucketNotFound string
+
+func (e ErrBucketNotFound) Error() string {
+	return fmt.Sprintf("The bucket %s does not exist.", string(e))
+}
+
+type ErrDiskFull struct{}
+
+func (e ErrDiskFull) Error() string {
+	return "There is not enough disk space to accept the data."
+}
+
+type ErrDraining struct{}
+
+func (e ErrDraining) Error() string {
+	return "The namespace is draining and not accepting new data."
+}
+
+type ErrFileInUse string
+
+func (e ErrFileInUse) Error() string {
+	return fmt.Sprintf(
+		"%s is still being written or uploaded and can not be deleted.",
+		string(e))
+}
+
+type ErrHashMismatch string
+
+func (e ErrHashMismatch) Error() string {
+	return fmt.Sprintf("The data received does not match the hash %s.", string(e))
+}
+
+type ErrInsertQueueTimeout struct{}
+
+func (e ErrInsertQueueTimeout) Error() string {
+	return "Timed out waiting for a file to insert the data into."
+}
+
+type ErrInvalidHash string
+
+func (e ErrInvalidHash) Error() string {
+	return fmt.Sprintf("%s is not a valid hash.", string(e))
+}
+
 type ErrInvalidID struct{}
 
 func (e ErrInvalidID) Error() string {
@@ -16,12 +60,53 @@ func (e ErrNotFound) Error() string {
 	return fmt.Sprintf("%s was not found.", string(e))
 }
 
+type ErrNotDurable string
+
+func (e ErrNotDurable) Error() string {
+	return fmt.Sprintf("%s is not yet durably stored.", string(e))
+}
+
 type ErrNotPossible struct{}
 
 func (ErrNotPossible) Error() string {
 	return "The requested operation is not possible."
 }
 
+type ErrS3Timeout struct{}
+
+func (e ErrS3Timeout) Error() string {
+	return "Timed out waiting for S3 to respond."
+}
+
+// Returned when a runtime setting is changed to a value outside of the range
+// allowed by Settings. The value describes the allowed range.
+type ErrOutOfRange string
+
+func (e ErrOutOfRange) Error() string {
+	return string(e)
+}
+
+type ErrReadOnly struct{}
+
+func (e ErrReadOnly) Error() string {
+	return "The namespace is read only and not accepting new data."
+}
+
+type ErrRecordTooLarge int64
+
+func (e ErrRecordTooLarge) Error() string {
+	return fmt.Sprintf("The data is larger than the %d byte limit.", int64(e))
+}
+
+// Returned when a primary replicates data past the end of a replica. The
+// value is the offset that the replica has data up to, the primary can send
+// the data from that offset to bring the replica back in sync.
+type ErrReplicaBehind uint64
+
+func (e ErrReplicaBehind) Error() string {
+	return fmt.Sprintf("The replica is behind, it only has %d bytes.", uint64(e))
+}
+
 type ErrReplicaNotFound string
 
 func (e ErrReplicaNotFound) Error() string {
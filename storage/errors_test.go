@@ -6,6 +6,48 @@ import (
 	"github.com/liquidgecka/testlib"
 )
 
+func TestErrBucketNotFound_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrBucketNotFound("test")
+	T.Equal(r.Error(), "The bucket test does not exist.")
+}
+
+func TestErrFileInUse_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrFileInUse("test")
+	T.Equal(
+		r.Error(),
+		"test is still being written or uploaded and can not be deleted.")
+}
+
+func TestErrHashMismatch_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrHashMismatch("hh=test")
+	T.Equal(r.Error(), "The data received does not match the hash hh=test.")
+}
+
+func TestErrInsertQueueTimeout_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrInsertQueueTimeout{}
+	T.Equal(r.Error(), "Timed out waiting for a file to insert the data into.")
+}
+
+func TestErrInvalidHash_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrInvalidHash("test")
+	T.Equal(r.Error(), "test is not a valid hash.")
+}
+
 func TestErrInvalidID_Error(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -30,6 +72,46 @@ func TestErrNotPossible_Error(t *testing.T) {
 	T.Equal(r.Error(), "The requested operation is not possible.")
 }
 
+func TestErrS3Timeout_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrS3Timeout{}
+	T.Equal(r.Error(), "Timed out waiting for S3 to respond.")
+}
+
+func TestErrOutOfRange_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrOutOfRange("test")
+	T.Equal(r.Error(), "test")
+}
+
+func TestErrReadOnly_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrReadOnly{}
+	T.Equal(r.Error(), "The namespace is read only and not accepting new data.")
+}
+
+func TestErrRecordTooLarge_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrRecordTooLarge(100)
+	T.Equal(r.Error(), "The data is larger than the 100 byte limit.")
+}
+
+func TestErrReplicaBehind_Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := ErrReplicaBehind(100)
+	T.Equal(r.Error(), "The replica is behind, it only has 100 bytes.")
+}
+
 func TestErrReplicaNotFound_Error(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
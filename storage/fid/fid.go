@@ -3,28 +3,129 @@ package fid
 import (
 	"encoding/base64"
 	"fmt"
+	"math/big"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 var fidID uint32
 
+// The largest unix time that has been used when generating a FID. This is
+// used to detect the clock moving backwards.
+var fidLastTime int64
+
+// Like fidLastTime except in milliseconds, for FIDs generated via
+// GenerateMilliseconds.
+var fidLastMillis int64
+
+// The time and sequence number of the most recent FID generated via
+// GenerateMilliseconds, packed as milliseconds<<6 | sequence.
+var fidMillisSequence int64
+
+const (
+	// Set in the first byte of FIDs that use the millisecond layout. The
+	// seconds layout stores the unix time in the first 32 bits which will not
+	// set this bit until 2038, so all existing FIDs decode as seconds.
+	millisecondFlag = 0x80
+
+	// Millisecond FIDs store the time as milliseconds since the start of
+	// 2020 (UTC) which lets 41 bits cover until 2089.
+	millisecondEpoch = int64(1577836800000)
+)
+
+// Controls how Generate handles the system clock moving backwards, which
+// can happen during NTP corrections. Since the time is the first field in
+// a FID a backwards jump would cause new FIDs to sort before older ones
+// and their time based S3 keys to land in past partitions.
+type ClockSkewPolicy int
+
+const (
+	// Use the current time even if it is before a previously generated
+	// FID.
+	ClockSkewIgnore ClockSkewPolicy = iota
+
+	// Use the time of the most recently generated FID if the clock has
+	// moved backwards, keeping FID times monotonic.
+	ClockSkewClamp
+
+	// Refuse to generate a FID if the clock has moved backwards.
+	ClockSkewRefuse
+)
+
+// Returned from GenerateWithPolicy when the ClockSkewRefuse policy is in use
+// and the clock has moved backwards.
+type ErrClockSkew struct {
+	Last int64
+	Now  int64
+
+	// If true then Last and Now are in milliseconds rather than seconds.
+	Milliseconds bool
+}
+
+func (e ErrClockSkew) Error() string {
+	unit := "s"
+	if e.Milliseconds {
+		unit = "ms"
+	}
+	return fmt.Sprintf(
+		"The clock has moved backwards by %d%s, refusing to generate a FID.",
+		e.Last-e.Now,
+		unit)
+}
+
+// The encodings that an ID can be generated in. ParseID accepts IDs in any
+// of these encodings.
+type IDEncoding int
+
+const (
+	// URL safe base64, which is what IDs have always been encoded in.
+	IDEncodingBase64 IDEncoding = iota
+
+	// Base62 which only uses letters and numbers so that IDs can not be
+	// mangled by tools that treat '-' or '_' specially, like word selection
+	// in terminals and log viewers.
+	IDEncodingBase62
+)
+
+// Base62 IDs are always padded to these lengths. The long length is one
+// more than is needed so that it can not be confused with a long base64 ID,
+// and since neither length is a valid raw base64 length the encoding of any
+// ID can be determined from its length alone.
+const (
+	base62ShortLen = 25
+	base62LongLen  = 31
+)
+
 // A unique identifier used to track individual files generated by the storage
 // implementation.
 //
-// FID's are currently comprised of two parts (all big endian):
+// FID's are comprised of three parts (all big endian):
 // 32 bites of a timestamp
 // 16 bit globally auto incrementing number.
 // 32 bit machine id.
+//
+// FIDs generated via GenerateMilliseconds instead use the first 48 bits for:
+// 1 bit that is always set, marking the millisecond layout.
+// 41 bits of milliseconds since millisecondEpoch.
+// 6 bit sequence number that restarts every millisecond.
+// The machine id is in the same place in both layouts.
 type FID [10]byte
 
 // Parses a full ID string into a FID, start and length values. This will
-// automatically account for short and long ID names.
+// automatically account for short and long ID names. Both the seconds and
+// milliseconds FID layouts are accepted since the FID is just copied.
 func ParseID(s string) (FID, uint64, uint32, error) {
 	raw := [22]byte{}
 	start := uint64(0)
 	length := uint32(0)
-	n, err := base64.RawURLEncoding.Decode(raw[:], []byte(s))
+	n := 0
+	var err error
+	if len(s) == base62ShortLen || len(s) == base62LongLen {
+		n, err = decodeBase62(raw[:], s)
+	} else {
+		n, err = base64.RawURLEncoding.Decode(raw[:], []byte(s))
+	}
 	if err != nil {
 		return FID{}, 0, 0, err
 	} else if n == 18 {
@@ -69,6 +170,24 @@ func ParseID(s string) (FID, uint64, uint32, error) {
 	return f, start, length, nil
 }
 
+// Decodes an ID into all of its components. This is ParseID along with the
+// machine and creation time stored in the FID, which is useful for tools
+// that need to know where an ID came from.
+func Explain(id string) (
+	f FID,
+	machine uint32,
+	created time.Time,
+	start uint64,
+	length uint32,
+	err error,
+) {
+	f, start, length, err = ParseID(id)
+	if err != nil {
+		return FID{}, 0, time.Time{}, 0, 0, err
+	}
+	return f, f.Machine(), f.Time(), start, length, nil
+}
+
 func (f *FID) String() string {
 	return base64.RawURLEncoding.EncodeToString(f[:])
 }
@@ -76,8 +195,18 @@ func (f *FID) String() string {
 // Generates a new file id and populates the values inside of the passed
 // FID. This will overwrite any existing data.
 func (f *FID) Generate(machID uint32) {
+	f.GenerateWithPolicy(machID, ClockSkewIgnore)
+}
+
+// Like Generate except that the given policy is used if the clock has moved
+// backwards since the last FID was generated. This only returns an error
+// when using ClockSkewRefuse.
+func (f *FID) GenerateWithPolicy(machID uint32, p ClockSkewPolicy) error {
+	now, err := checkClockSkew(&fidLastTime, time.Now().Unix(), p)
+	if err != nil {
+		return err
+	}
 	id := uint16(atomic.AddUint32(&fidID, 1))
-	now := time.Now().Unix()
 	f[0] = byte((now >> 24) & 0xFF)
 	f[1] = byte((now >> 16) & 0xFF)
 	f[2] = byte((now >> 8) & 0xFF)
@@ -88,19 +217,146 @@ func (f *FID) Generate(machID uint32) {
 	f[7] = byte((machID >> 16) & 0xFF)
 	f[8] = byte((machID >> 8) & 0xFF)
 	f[9] = byte((machID >> 0) & 0xFF)
+	return nil
+}
+
+// Like GenerateWithPolicy except that the FID uses the millisecond layout so
+// files created in the same second have distinct times. The time is
+// clamped or refused with millisecond precision. The time in this layout
+// never moves backwards, even with ClockSkewIgnore, since that is what keeps
+// the per millisecond sequence unique.
+func (f *FID) GenerateMilliseconds(machID uint32, p ClockSkewPolicy) error {
+	now, err := checkClockSkew(&fidLastMillis, time.Now().UnixMilli(), p)
+	if err != nil {
+		err := err.(ErrClockSkew)
+		err.Milliseconds = true
+		return err
+	}
+	ms, id := nextMillisecond(now)
+	f.setMilliseconds(ms, id, machID)
+	return nil
+}
+
+// Returns the time and sequence number to use for a millisecond FID
+// generated at now. Once all 64 sequence numbers in a millisecond have been
+// used the time is moved forward by a millisecond rather than reusing one,
+// so FIDs stay unique when generated faster than that or while the time is
+// being clamped.
+func nextMillisecond(now int64) (int64, uint16) {
+	for {
+		last := atomic.LoadInt64(&fidMillisSequence)
+		next := now << 6
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&fidMillisSequence, last, next) {
+			return next >> 6, uint16(next & 0x3F)
+		}
+	}
+}
+
+// Packs the given unix time in milliseconds, sequence number and machine id
+// into f using the millisecond layout. Only the low 6 bits of id are used.
+func (f *FID) setMilliseconds(ms int64, id uint16, machID uint32) {
+	v := uint64(ms-millisecondEpoch)&(1<<41-1)<<6 | uint64(id&0x3F)
+	f[0] = millisecondFlag | byte((v>>40)&0x7F)
+	f[1] = byte((v >> 32) & 0xFF)
+	f[2] = byte((v >> 24) & 0xFF)
+	f[3] = byte((v >> 16) & 0xFF)
+	f[4] = byte((v >> 8) & 0xFF)
+	f[5] = byte((v >> 0) & 0xFF)
+	f[6] = byte((machID >> 24) & 0xFF)
+	f[7] = byte((machID >> 16) & 0xFF)
+	f[8] = byte((machID >> 8) & 0xFF)
+	f[9] = byte((machID >> 0) & 0xFF)
+}
+
+// Checks now against the last time stored in last, applying the given
+// policy if the clock has moved backwards. On success the time that should
+// be used is returned.
+func checkClockSkew(last *int64, now int64, p ClockSkewPolicy) (int64, error) {
+	for {
+		l := atomic.LoadInt64(last)
+		if now >= l {
+			if atomic.CompareAndSwapInt64(last, l, now) {
+				return now, nil
+			}
+			continue
+		}
+		switch p {
+		case ClockSkewClamp:
+			return l, nil
+		case ClockSkewRefuse:
+			return 0, ErrClockSkew{Last: l, Now: now}
+		}
+		return now, nil
+	}
 }
 
 // Generates a new unique positional id for an object stored within this
 // file.
 func (f *FID) ID(start uint64, length uint32) string {
+	return f.EncodedID(start, length, IDEncodingBase64)
+}
+
+// Like ID except that the id is generated in the given encoding.
+func (f *FID) EncodedID(start uint64, length uint32, e IDEncoding) string {
+	var raw []byte
 	if start < 1<<32 {
-		return f.shortID(start, length)
+		raw = f.shortID(start, length)
 	} else {
-		return f.longID(start, length)
+		raw = f.longID(start, length)
+	}
+	switch e {
+	case IDEncodingBase62:
+		width := base62ShortLen
+		if len(raw) != 18 {
+			width = base62LongLen
+		}
+		out := new(big.Int).SetBytes(raw).Text(62)
+		return strings.Repeat("0", width-len(out)) + out
+	default:
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+}
+
+// Returns true if this FID uses the millisecond layout.
+func (f *FID) Milliseconds() bool {
+	return f[0]&millisecondFlag != 0
+}
+
+// Returns the time that this FID was generated in UTC. FIDs that use the
+// seconds layout will always be on a whole second.
+func (f *FID) Time() time.Time {
+	if f.Milliseconds() {
+		ms := (0 +
+			int64(f[0]&^millisecondFlag)<<34 +
+			int64(f[1])<<26 +
+			int64(f[2])<<18 +
+			int64(f[3])<<10 +
+			int64(f[4])<<2 +
+			int64(f[5])>>6)
+		return time.UnixMilli(millisecondEpoch + ms).In(time.UTC)
+	}
+	epoch := (0 +
+		int64(f[0])<<24 +
+		int64(f[1])<<16 +
+		int64(f[2])<<8 +
+		int64(f[3]))
+	return time.Unix(epoch, 0).In(time.UTC)
+}
+
+// Returns the auto incrementing number that was assigned to this FID when
+// it was generated. In the millisecond layout this is only 6 bits.
+func (f *FID) Sequence() uint16 {
+	if f.Milliseconds() {
+		return uint16(f[5] & 0x3F)
 	}
+	return uint16(f[4])<<8 + uint16(f[5])
 }
 
-// Returns the machine that generated this fid.
+// Returns the machine that generated this fid. The machine id is stored in
+// the same place in both layouts.
 func (f *FID) Machine() uint32 {
 	return (0 +
 		(uint32(f[6]) << 24) +
@@ -122,7 +378,7 @@ func (f *FID) Parse(s string) error {
 }
 
 // Generates a "short" id. These are used when start is less than 4G.
-func (f *FID) shortID(start uint64, length uint32) string {
+func (f *FID) shortID(start uint64, length uint32) []byte {
 	// The underlying raw data is 24 bytes:
 	//  10 bytes for the fid
 	//   4 bytes for the start position
@@ -147,10 +403,10 @@ func (f *FID) shortID(start uint64, length uint32) string {
 		byte((length >> 8) & 0xFF),
 		byte((length >> 0) & 0xFF),
 	}
-	return base64.RawURLEncoding.EncodeToString(raw[:])
+	return raw[:]
 }
 
-func (f *FID) longID(start uint64, length uint32) string {
+func (f *FID) longID(start uint64, length uint32) []byte {
 	// The underlying raw data is 24 bytes:
 	//  10 bytes for the fid
 	//   8 bytes for the start position
@@ -179,5 +435,20 @@ func (f *FID) longID(start uint64, length uint32) string {
 		byte((length >> 8) & 0xFF),
 		byte((length >> 0) & 0xFF),
 	}
-	return base64.RawURLEncoding.EncodeToString(raw[:])
+	return raw[:]
+}
+
+// Decodes a base62 ID into raw, returning the number of bytes that the ID
+// contains.
+func decodeBase62(raw []byte, s string) (int, error) {
+	n := 18
+	if len(s) == base62LongLen {
+		n = 22
+	}
+	v, ok := new(big.Int).SetString(s, 62)
+	if !ok || v.BitLen() > n*8 {
+		return 0, fmt.Errorf("Not a valid ID token.")
+	}
+	v.FillBytes(raw[:n])
+	return n, nil
 }
@@ -59,6 +59,156 @@ func TestFID_Generate(t *testing.T) {
 	T.Equal(f.String(), "Xk3omv_______w")
 }
 
+func TestFID_GenerateWithPolicy(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Mock out time.Now so that we can move the clock backwards.
+	mockTime := time.Date(2020, time.February, 20, 2, 2, 2, 2, time.UTC)
+	patch := monkey.Patch(time.Now, func() time.Time {
+		return mockTime
+	})
+	defer patch.Unpatch()
+	fidLastTime = 0
+	f := FID{}
+
+	// The first generation works normally regardless of policy.
+	fidID = 0
+	T.ExpectSuccess(f.GenerateWithPolicy(2, ClockSkewRefuse))
+	T.Equal(f, FID{94, 77, 232, 154, 0, 1, 0, 0, 0, 2})
+
+	// Jump the clock backwards by 10 seconds.
+	mockTime = mockTime.Add(-10 * time.Second)
+
+	// Refuse should return an error and leave the FID untouched.
+	err := f.GenerateWithPolicy(2, ClockSkewRefuse)
+	T.ExpectErrorMessage(
+		err,
+		"The clock has moved backwards by 10s, refusing to generate a FID.")
+	T.Equal(f, FID{94, 77, 232, 154, 0, 1, 0, 0, 0, 2})
+
+	// Clamp should use the last time that was generated.
+	T.ExpectSuccess(f.GenerateWithPolicy(2, ClockSkewClamp))
+	T.Equal(f, FID{94, 77, 232, 154, 0, 2, 0, 0, 0, 2})
+
+	// Ignore will use the current time even though its in the past.
+	T.ExpectSuccess(f.GenerateWithPolicy(2, ClockSkewIgnore))
+	T.Equal(f, FID{94, 77, 232, 144, 0, 3, 0, 0, 0, 2})
+
+	// Once the clock moves forward again all policies use it.
+	mockTime = mockTime.Add(time.Minute)
+	T.ExpectSuccess(f.GenerateWithPolicy(2, ClockSkewRefuse))
+	T.Equal(f, FID{94, 77, 232, 204, 0, 4, 0, 0, 0, 2})
+}
+
+func TestFID_GenerateMilliseconds(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Mock out time.Now so that the generated values are stable.
+	mockTime := time.Date(2020, time.February, 20, 2, 2, 2, 2000000, time.UTC)
+	patch := monkey.Patch(time.Now, func() time.Time {
+		return mockTime
+	})
+	defer patch.Unpatch()
+	fidLastMillis = 0
+	fidMillisSequence = 0
+	f := FID{}
+
+	// 48 bits = flag, milliseconds and a 6 bit sequence, 4 = machine id.
+	T.ExpectSuccess(f.GenerateMilliseconds(2, ClockSkewRefuse))
+	T.Equal(f, FID{128, 64, 123, 108, 100, 128, 0, 0, 0, 2})
+	T.Equal(f.Milliseconds(), true)
+	T.Equal(f.Time(), mockTime.Truncate(time.Millisecond))
+
+	// Moving the clock backwards is handled with millisecond precision.
+	mockTime = mockTime.Add(-10 * time.Second)
+	err := f.GenerateMilliseconds(2, ClockSkewRefuse)
+	T.ExpectErrorMessage(
+		err,
+		"The clock has moved backwards by 10000ms, refusing to generate a "+
+			"FID.")
+	T.ExpectSuccess(f.GenerateMilliseconds(2, ClockSkewClamp))
+	T.Equal(f, FID{128, 64, 123, 108, 100, 129, 0, 0, 0, 2})
+}
+
+func TestFID_GenerateMilliseconds_Unique(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Generating more FIDs than the sequence can hold at the same time, as
+	// happens when the clock is clamped, moves the time forward rather than
+	// reusing a sequence number.
+	fidMillisSequence = 0
+	now := time.Date(2020, time.February, 20, 2, 2, 2, 0, time.UTC)
+	seen := map[FID]bool{}
+	for i := 0; i < 200; i++ {
+		ms, id := nextMillisecond(now.UnixMilli())
+		f := FID{}
+		f.setMilliseconds(ms, id, 2)
+		T.Equal(seen[f], false)
+		seen[f] = true
+		T.Equal(f.Sequence(), uint16(i%64))
+		T.Equal(f.Time(), now.Add(time.Duration(i/64)*time.Millisecond))
+	}
+
+	// Once the clock passes the bumped time the sequence restarts.
+	ms, id := nextMillisecond(now.Add(time.Second).UnixMilli())
+	T.Equal(ms, now.Add(time.Second).UnixMilli())
+	T.Equal(id, uint16(0))
+}
+
+func TestFID_Time(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// FIDs using the seconds layout decode exactly as they always have.
+	f := FID{94, 77, 232, 154, 0, 1, 0, 0, 0, 2}
+	T.Equal(f.Milliseconds(), false)
+	T.Equal(f.Time(), time.Date(2020, time.February, 20, 2, 2, 2, 0, time.UTC))
+	T.Equal(f.Sequence(), uint16(1))
+	T.Equal(f.Machine(), uint32(2))
+
+	// Millisecond FIDs round trip through an ID.
+	now := time.Date(2031, time.July, 4, 12, 30, 15, 123000000, time.UTC)
+	f = FID{}
+	f.setMilliseconds(now.UnixMilli(), 0x1FF, 0xDEADBEEF)
+	T.Equal(f.Milliseconds(), true)
+	T.Equal(f.Time(), now)
+	T.Equal(f.Sequence(), uint16(0x3F))
+	T.Equal(f.Machine(), uint32(0xDEADBEEF))
+	parsed, start, length, err := ParseID(f.ID(100, 200))
+	T.ExpectSuccess(err)
+	T.Equal(parsed, f)
+	T.Equal(start, uint64(100))
+	T.Equal(length, uint32(200))
+	T.Equal(parsed.Time(), now)
+
+	// Generating with the real clock gives a time close to now.
+	T.ExpectSuccess(f.GenerateMilliseconds(7, ClockSkewIgnore))
+	T.Equal(f.Milliseconds(), true)
+	T.Equal(time.Since(f.Time()) < time.Second, true)
+	T.Equal(f.Machine(), uint32(7))
+}
+
+func TestExplain(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	f := FID{94, 77, 232, 154, 0, 1, 0, 0, 0, 2}
+	fid, machine, created, start, length, err := Explain(f.ID(1<<33, 10))
+	T.ExpectSuccess(err)
+	T.Equal(fid, f)
+	T.Equal(machine, uint32(2))
+	T.Equal(created, time.Date(2020, time.February, 20, 2, 2, 2, 0, time.UTC))
+	T.Equal(start, uint64(1<<33))
+	T.Equal(length, uint32(10))
+
+	// Invalid IDs return an error.
+	_, _, _, _, _, err = Explain("invalid")
+	T.ExpectErrorMessage(err, "Not a valid ID token.")
+}
+
 func TestFID_ID(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -75,6 +225,48 @@ func TestFID_ID(t *testing.T) {
 		"AAECAwQFBgcICv_______________w")
 }
 
+func TestFID_EncodedID(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Base64 is the same as ID().
+	f := FID{0, 1, 2, 3, 4, 5, 6, 7, 8, 10}
+	T.Equal(f.EncodedID(0, 0, IDEncodingBase64), f.ID(0, 0))
+
+	// Base62 ids are padded to a fixed length that never matches a base64
+	// id.
+	T.Equal(f.EncodedID(0, 0, IDEncodingBase62), "0007QRoHZJvMdcaioZC7DT6p2")
+	T.Equal(len(f.EncodedID(0, 0, IDEncodingBase62)), 25)
+	T.Equal(len(f.EncodedID(1<<32, 0, IDEncodingBase62)), 31)
+	zero := FID{}
+	T.Equal(
+		zero.EncodedID(0, 0, IDEncodingBase62),
+		"0000000000000000000000000")
+
+	// Random ids in both encodings round trip through ParseID.
+	for i := 0; i < 1000; i++ {
+		rand.Read(f[:])
+		start := rand.Uint64() >> uint(rand.Intn(64))
+		length := rand.Uint32()
+		for _, e := range []IDEncoding{IDEncodingBase64, IDEncodingBase62} {
+			id := f.EncodedID(start, length, e)
+			msg := fmt.Sprintf("id=%s", id)
+			pf, pstart, plength, err := ParseID(id)
+			T.ExpectSuccess(err, msg)
+			T.Equal(pf, f, msg)
+			T.Equal(pstart, start, msg)
+			T.Equal(plength, length, msg)
+		}
+	}
+
+	// Base62 ids that are too large or contain invalid characters are
+	// rejected.
+	_, _, _, err := ParseID("zzzzzzzzzzzzzzzzzzzzzzzzz")
+	T.ExpectErrorMessage(err, "Not a valid ID token.")
+	_, _, _, err = ParseID("000000000000000000000000-")
+	T.ExpectErrorMessage(err, "Not a valid ID token.")
+}
+
 func TestFID_Machine(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -2,9 +2,29 @@ package fid
 
 import (
 	"fmt"
+	"hash/fnv"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+)
+
+const (
+	// The largest width that can be given to a directive, like %10d.
+	maxFormatWidth = 1024
+
+	// The most hex characters that %h can render, which is all of the
+	// 64 bit hash.
+	maxHashLength = 16
+
+	// Directives that have an unpadded form available via %-. When a width
+	// is given these are rendered unpadded and then padded to the width.
+	unpaddedDirectives = "dHIjKLmMSY"
+
+	// Directives that render names rather than numbers. When a width is
+	// given without a fill character these are padded with spaces rather
+	// than zeros.
+	nameDirectives = "aAbBpP"
 )
 
 type Formatter struct {
@@ -15,6 +35,7 @@ type Formatter struct {
 	requiresMachine bool
 	requiresID      bool
 	requiresString  bool
+	requiresHash    bool
 
 	// The maximal size of the string that will be generated. This is just
 	// a guess so we can preallocate space in the strings.Builder.
@@ -31,24 +52,34 @@ func (f *Formatter) Format(fid FID) string {
 	if f == nil || f.funcs == nil {
 		return fid.String()
 	}
+	return f.format(fid, fid.Time())
+}
+
+// Like Format except that the time based directives are rendered using the
+// given time rather than the time that the FID was created. The machine and
+// ID directives still use the values from the FID.
+func (f *Formatter) FormatTime(fid FID, t time.Time) string {
+	if f == nil || f.funcs == nil {
+		return fid.String()
+	}
+	return f.format(fid, t)
+}
+
+func (f *Formatter) format(fid FID, t time.Time) string {
 	data := fmtData{}
 	if f.requiresTime {
-		epoch := (0 +
-			int64(fid[0])<<24 +
-			int64(fid[1])<<16 +
-			int64(fid[2])<<8 +
-			int64(fid[3]))
-		data.created = time.Unix(epoch, 0).In(time.UTC)
+		data.created = t
 	}
 	if f.requiresMachine {
-		data.machine = (0 +
-			uint32(fid[6])<<24 +
-			uint32(fid[7])<<16 +
-			uint32(fid[8])<<8 +
-			uint32(fid[9]))
+		data.machine = fid.Machine()
 	}
 	if f.requiresID {
-		data.id = (uint16(fid[4])<<8 + uint16(fid[5]))
+		data.id = fid.Sequence()
+	}
+	if f.requiresHash {
+		h := fnv.New64a()
+		h.Write(fid[:])
+		data.hash = h.Sum64()
 	}
 	b := strings.Builder{}
 	b.Grow(f.maxSize)
@@ -60,6 +91,23 @@ func (f *Formatter) Format(fid FID) string {
 
 // Creates a new formatter from the given format string. If the string is
 // not a valid format syntax then this will return an error.
+//
+// Any directive can be given a width between the % and the directive, like
+// %6L, which pads the output to at least that many characters. Directives
+// with an unpadded form (%-d, %-L, etc) are rendered unpadded first. The
+// padding is zeros for numbers and spaces for names unless a fill is given:
+// %_6L pads with spaces, %06L pads with zeros, and %-6L left aligns the
+// output and pads it with spaces on the right.
+//
+// Text outside of a directive is copied as is. The escapes %% (a percent
+// sign), %n (a newline) and %t (a tab) are supported, and any text can be
+// quoted with %{text} which copies everything up to the next } without
+// interpreting it, so %{%Y} renders as %Y.
+//
+// %h followed by a length, like %h4, renders that many hex characters of a
+// hash of the fid. S3 partitions a bucket by key prefix so starting keys
+// with this spreads uploads evenly across partitions rather than having
+// every upload in a given hour land on the same one.
 func NewFormatter(s string) (*Formatter, error) {
 	f := &Formatter{}
 	p := parser{
@@ -79,6 +127,14 @@ func NewFormatter(s string) (*Formatter, error) {
 		}
 	}
 
+	// A %h at the very end of the string is only complete once we know
+	// that no more digits are coming.
+	if p.hashing {
+		if err := p.finishHash(len(s)); err != nil {
+			return nil, err
+		}
+	}
+
 	// If p.next is not nil then we ended in an escape sequence which
 	// is not valid.
 	if p.next != nil {
@@ -101,6 +157,18 @@ type parser struct {
 	static  strings.Builder
 	next    func(int, rune) error
 	maxSize int
+
+	// If a width was given for the current directive (like %6L) then this
+	// stores the width, the character used to fill, whether the result is
+	// left aligned, and the index in f.funcs that the directive starts at.
+	width     int
+	fill      rune
+	left      bool
+	widthFunc int
+
+	// Set while the length following a %h is being read.
+	hashing    bool
+	hashLength int
 }
 
 // Adds all of the buffered static data to the function list as a static
@@ -116,6 +184,78 @@ func (p *parser) addStatic() {
 	p.static.Reset()
 }
 
+// Called once a directive has been fully processed. If a width was given
+// then the functions added for the directive are wrapped so that their
+// output is padded.
+func (p *parser) done() error {
+	p.next = nil
+	if p.width == 0 {
+		return nil
+	}
+	funcs := append(
+		[]func(*fmtData, *strings.Builder){},
+		p.f.funcs[p.widthFunc:]...)
+	pad := padded{
+		funcs: funcs,
+		width: p.width,
+		fill:  p.fill,
+		left:  p.left,
+	}
+	p.f.funcs = append(p.f.funcs[:p.widthFunc], pad.Format)
+	p.maxSize += p.width
+	p.width = 0
+	p.fill = 0
+	p.left = false
+	return nil
+}
+
+// Starts parsing a width for the current directive. r is the first
+// character of the width.
+func (p *parser) startWidth(i int, r rune) error {
+	p.widthFunc = len(p.f.funcs)
+	p.next = p.parseWidth
+	return p.parseWidth(i, r)
+}
+
+// The state that consumes the digits of a width, like the 10 in %10d, and
+// then dispatches the directive that follows it.
+func (p *parser) parseWidth(i int, r rune) error {
+	if r >= '0' && r <= '9' {
+		p.width = p.width*10 + int(r-'0')
+		if p.width > maxFormatWidth {
+			return fmt.Errorf(
+				"Width is larger than %d at %d",
+				maxFormatWidth,
+				i)
+		}
+		return nil
+	} else if p.width == 0 {
+		return fmt.Errorf("Missing or zero width before %c at %d", r, i)
+	}
+	if p.fill == 0 {
+		if strings.ContainsRune(nameDirectives, r) || r == '.' {
+			p.fill = ' '
+		} else {
+			p.fill = '0'
+		}
+	}
+	switch {
+	case r == '.':
+		p.next = p.period
+		return nil
+	case strings.ContainsRune("%nt{_-", r):
+		return fmt.Errorf(
+			"Unknown or unsupported escape sequence %%%d%c at %d",
+			p.width,
+			r,
+			i)
+	case strings.ContainsRune(unpaddedDirectives, r):
+		return p.hyphen(i, r)
+	default:
+		return p.escaped(i, r)
+	}
+}
+
 // The state that handles all escape sequences at the top level (immediately
 // after a % sign.)
 func (p *parser) escaped(i int, r rune) error {
@@ -132,6 +272,9 @@ func (p *parser) escaped(i int, r rune) error {
 		p.static.WriteRune('\t')
 		p.next = nil
 		return nil
+	case '{':
+		p.next = p.quoted
+		return nil
 	}
 	p.addStatic()
 	switch r {
@@ -144,6 +287,11 @@ func (p *parser) escaped(i int, r rune) error {
 	case '-':
 		p.next = p.hyphen
 		return nil
+	case '0':
+		p.fill = '0'
+		return p.startWidth(i, r)
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return p.startWidth(i, r)
 	case 'a':
 		p.maxSize += 3
 		p.f.requiresTime = true
@@ -176,6 +324,20 @@ func (p *parser) escaped(i int, r rune) error {
 		p.f.funcs = append(p.f.funcs, formatMonthZero)
 		p.f.funcs = append(p.f.funcs, staticString("-").Format)
 		p.f.funcs = append(p.f.funcs, formatDayZero)
+	case 'G':
+		p.maxSize += 4
+		p.f.requiresTime = true
+		p.f.funcs = append(p.f.funcs, formatISOWeekYear)
+	case 'h':
+		if p.width != 0 {
+			return fmt.Errorf(
+				"Unknown or unsupported escape sequence %%%dh at %d",
+				p.width,
+				i)
+		}
+		p.hashing = true
+		p.next = p.hash
+		return nil
 	case 'H':
 		p.maxSize += 2
 		p.f.requiresTime = true
@@ -252,6 +414,10 @@ func (p *parser) escaped(i int, r rune) error {
 		p.maxSize += 1
 		p.f.requiresTime = true
 		p.f.funcs = append(p.f.funcs, formatWeekdayNumber)
+	case 'V':
+		p.maxSize += 2
+		p.f.requiresTime = true
+		p.f.funcs = append(p.f.funcs, formatISOWeekNumber)
 	case 'w':
 		p.maxSize += 1
 		p.f.requiresTime = true
@@ -270,13 +436,16 @@ func (p *parser) escaped(i int, r rune) error {
 			r,
 			i)
 	}
-	p.next = nil
-	return nil
+	return p.done()
 }
 
 // The state called for the character following a %-.
 func (p *parser) hyphen(i int, r rune) error {
 	switch r {
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		p.fill = ' '
+		p.left = true
+		return p.startWidth(i, r)
 	case 'd':
 		p.maxSize += 2
 		p.f.requiresTime = true
@@ -323,8 +492,7 @@ func (p *parser) hyphen(i int, r rune) error {
 			r,
 			i)
 	}
-	p.next = nil
-	return nil
+	return p.done()
 }
 
 func (p *parser) period(i int, r rune) error {
@@ -339,13 +507,15 @@ func (p *parser) period(i int, r rune) error {
 			r,
 			i)
 	}
-	p.next = nil
-	return nil
+	return p.done()
 }
 
 // Processes an escape sequence that has followed a '%_' sequence.
 func (p *parser) underscore(i int, r rune) error {
 	switch r {
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		p.fill = ' '
+		return p.startWidth(i, r)
 	case 'd':
 		p.maxSize += 2
 		p.f.requiresTime = true
@@ -392,10 +562,59 @@ func (p *parser) underscore(i int, r rune) error {
 			r,
 			i)
 	}
+	return p.done()
+}
+
+// The state that reads the length following a %h. Since the length has no
+// terminator the first character that is not a digit completes the
+// directive and is then processed as normal.
+func (p *parser) hash(i int, r rune) error {
+	if r >= '0' && r <= '9' {
+		p.hashLength = p.hashLength*10 + int(r-'0')
+		if p.hashLength > maxHashLength {
+			return fmt.Errorf(
+				"Hash length is larger than %d at %d",
+				maxHashLength,
+				i)
+		}
+		return nil
+	}
+	if err := p.finishHash(i); err != nil {
+		return err
+	}
+	if r == '%' {
+		p.next = p.escaped
+	} else {
+		p.static.WriteRune(r)
+	}
+	return nil
+}
+
+// Adds the %h directive once its length has been read.
+func (p *parser) finishHash(i int) error {
+	if p.hashLength == 0 {
+		return fmt.Errorf("Missing or zero hash length at %d", i)
+	}
+	p.maxSize += p.hashLength
+	p.f.requiresHash = true
+	p.f.funcs = append(p.f.funcs, formatHash(p.hashLength).Format)
+	p.hashing = false
+	p.hashLength = 0
 	p.next = nil
 	return nil
 }
 
+// The state that handles the text inside of a %{} quote. Everything up to
+// the closing } is treated as static text.
+func (p *parser) quoted(i int, r rune) error {
+	if r == '}' {
+		p.next = nil
+	} else {
+		p.static.WriteRune(r)
+	}
+	return nil
+}
+
 // Used for writing a static string into a format.
 type staticString string
 
@@ -403,12 +622,49 @@ func (s staticString) Format(d *fmtData, out *strings.Builder) {
 	out.WriteString(string(s))
 }
 
+// Pads the output of a directive that was given a width.
+type padded struct {
+	funcs []func(*fmtData, *strings.Builder)
+	width int
+	fill  rune
+	left  bool
+}
+
+func (p padded) Format(d *fmtData, out *strings.Builder) {
+	b := strings.Builder{}
+	for _, fun := range p.funcs {
+		fun(d, &b)
+	}
+	value := b.String()
+	if p.left {
+		out.WriteString(value)
+	}
+	for i := utf8.RuneCountInString(value); i < p.width; i++ {
+		out.WriteRune(p.fill)
+	}
+	if !p.left {
+		out.WriteString(value)
+	}
+}
+
+// Appends the given number of hex characters from the hash of the fid.
+type formatHash int
+
+func (f formatHash) Format(d *fmtData, out *strings.Builder) {
+	hex := strconv.FormatUint(d.hash, 16)
+	for i := len(hex); i < maxHashLength; i++ {
+		hex = "0" + hex
+	}
+	out.WriteString(hex[:f])
+}
+
 // Stores a copy of the data that can be used for generating string data
 // about the fid.
 type fmtData struct {
 	created time.Time
 	machine uint32
 	id      uint16
+	hash    uint64
 }
 
 // Appends either AM or PM depending on the time.
@@ -541,6 +797,22 @@ func formatIDZero(d *fmtData, out *strings.Builder) {
 	out.WriteString(id)
 }
 
+// Appends the ISO 8601 week-numbering year, which differs from the calendar
+// year for the first and last few days of some years.
+func formatISOWeekYear(d *fmtData, out *strings.Builder) {
+	year, _ := d.created.ISOWeek()
+	out.WriteString(strconv.Itoa(year))
+}
+
+// Appends the ISO 8601 week number zero padded (01 .. 53).
+func formatISOWeekNumber(d *fmtData, out *strings.Builder) {
+	_, week := d.created.ISOWeek()
+	if week < 10 {
+		out.WriteRune('0')
+	}
+	out.WriteString(strconv.Itoa(week))
+}
+
 // Appends the machine as a raw number.
 func formatMachine(d *fmtData, out *strings.Builder) {
 	out.WriteString(strconv.FormatUint(uint64(d.machine), 10))
@@ -2,6 +2,7 @@ package fid
 
 import (
 	"testing"
+	"time"
 
 	"github.com/liquidgecka/testlib"
 )
@@ -49,6 +50,22 @@ func TestFormatter_StaticEscapes(t *testing.T) {
 	T.Equal(f.Format(epoch), "static%\n\tstring")
 }
 
+func TestFormatter_Quoted(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Quoted text is never treated as a directive.
+	f, err := NewFormatter(`%{%Y/%m}/%Y/%{}%{{a}b}/%{100%}`)
+	T.ExpectSuccess(err)
+	T.Equal(f.Format(epoch), "%Y/%m/70/{ab}/100%")
+
+	// Quoted text must be terminated and can not be given a width.
+	_, err = NewFormatter(`%{abc`)
+	T.ExpectErrorMessage(err, "Unterminated escape")
+	_, err = NewFormatter(`%6{abc}`)
+	T.ExpectErrorMessage(err, "%6{")
+}
+
 func TestFormatter_AMPM(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -105,6 +122,81 @@ func TestFormater_Errors(t *testing.T) {
 	T.ExpectErrorMessage(err, "%.*")
 	_, err = NewFormatter("%")
 	T.ExpectErrorMessage(err, "Unterminated escape")
+	_, err = NewFormatter("%6")
+	T.ExpectErrorMessage(err, "Unterminated escape")
+	_, err = NewFormatter("%0d")
+	T.ExpectErrorMessage(err, "Missing or zero width before d at 2")
+	_, err = NewFormatter("%_00d")
+	T.ExpectErrorMessage(err, "Missing or zero width before d at 4")
+	_, err = NewFormatter("%99999d")
+	T.ExpectErrorMessage(err, "Width is larger than 1024 at 4")
+	_, err = NewFormatter("%6%")
+	T.ExpectErrorMessage(err, "%6%")
+	_, err = NewFormatter("%6-d")
+	T.ExpectErrorMessage(err, "%6-")
+	_, err = NewFormatter("%6*")
+	T.ExpectErrorMessage(err, "%*")
+	_, err = NewFormatter("%6.*")
+	T.ExpectErrorMessage(err, "%.*")
+}
+
+func TestFormatter_Width(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Numbers are zero padded and names are space padded by default.
+	f, err := NewFormatter(`'%4d' '%3K' '%12L' '%5a' '%15.L'`)
+	T.ExpectSuccess(err)
+	T.Equal(
+		f.Format(localhost),
+		"'0001' '65535' '002130706433' '  Thu' '      127.0.0.1'")
+
+	// The fill can be given explicitly.
+	f, err = NewFormatter(`'%_4d' '%04d' '%-4d' '%-6L' '%06a'`)
+	T.ExpectSuccess(err)
+	T.Equal(f.Format(day10), "'  10' '0010' '10  ' '0     ' '000Sat'")
+
+	// Composite directives are padded as a whole and widths smaller than
+	// the output are ignored.
+	f, err = NewFormatter(`static %12F %2Y %1L`)
+	T.ExpectSuccess(err)
+	T.Equal(f.Format(epoch), "static 001970-01-01 70 0")
+}
+
+func TestFormatter_Hash(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The output is always the same for a given fid.
+	f, err := NewFormatter(`%h4/%L/%h16%%%h2`)
+	T.ExpectSuccess(err)
+	T.Equal(f.Format(epoch), "69d3/0000000000/69d307cc20f6ef8d%69")
+	T.Equal(f.Format(localhost), "0269/2130706433/026959de47c9413f%02")
+
+	// The prefixes spread evenly across every hex character.
+	f, err = NewFormatter(`%h1`)
+	T.ExpectSuccess(err)
+	seen := make(map[string]int)
+	for i := 0; i < 1600; i++ {
+		id := FID{0, 0, 0, 0, byte(i >> 8), byte(i), 0, 0, 0, 1}
+		seen[f.Format(id)]++
+	}
+	T.Equal(len(seen), 16)
+	for prefix, count := range seen {
+		if count < 50 {
+			T.Fatalf("Prefix %s was only used %d times.", prefix, count)
+		}
+	}
+
+	// Invalid lengths.
+	_, err = NewFormatter(`%h`)
+	T.ExpectErrorMessage(err, "Missing or zero hash length at 2")
+	_, err = NewFormatter(`%h0/`)
+	T.ExpectErrorMessage(err, "Missing or zero hash length at 3")
+	_, err = NewFormatter(`%h17`)
+	T.ExpectErrorMessage(err, "Hash length is larger than 16 at 3")
+	_, err = NewFormatter(`%4h2`)
+	T.ExpectErrorMessage(err, "%4h")
 }
 
 func TestFormatter_Hour(t *testing.T) {
@@ -120,6 +212,17 @@ func TestFormatter_Hour(t *testing.T) {
 	T.Equal(f.Format(hour1), "'01' '1' ' 1'")
 }
 
+func TestFormatter_Milliseconds(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	f, err := NewFormatter(`%F %T %s %K %L`)
+	T.ExpectSuccess(err)
+	fid := FID{}
+	fid.setMilliseconds(1582164122002, 5, 2)
+	T.Equal(fid.Milliseconds(), true)
+	T.Equal(f.Format(fid), "2020-02-20 02:02:02 1582164122 00005 0000000002")
+}
+
 func TestFormatter_ID(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -129,6 +232,28 @@ func TestFormatter_ID(t *testing.T) {
 	T.Equal(f.Format(localhost), "'65535' '65535' '65535'")
 }
 
+func TestFormatter_ISOWeek(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	f, err := NewFormatter(`%G-W%V`)
+	T.ExpectSuccess(err)
+	for _, test := range []struct {
+		name string
+		fid  FID
+		want string
+	}{
+		{"1970/1/1", epoch, "1970-W01"},
+		{"2015/12/31", FID{86, 132, 112, 0, 0, 0, 0, 0}, "2015-W53"},
+		{"2016/1/3", FID{86, 136, 100, 128, 0, 0, 0, 0}, "2015-W53"},
+		{"2016/1/4", FID{86, 137, 182, 0, 0, 0, 0, 0}, "2016-W01"},
+		{"2019/12/30", FID{94, 9, 62, 0, 0, 0, 0, 0}, "2020-W01"},
+		{"2020/12/31", FID{95, 237, 20, 128, 0, 0, 0, 0}, "2020-W53"},
+		{"2021/1/1", FID{95, 238, 102, 0, 0, 0, 0, 0}, "2020-W53"},
+	} {
+		T.Equal(f.Format(test.fid), test.want, test.name)
+	}
+}
+
 func TestFormatter_Minute(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -243,3 +368,17 @@ func TestFormatter_YearDay(t *testing.T) {
 	T.Equal(f.Format(epoch), "001 '001' '  1' '1'")
 	T.Equal(f.Format(day10), "010 '010' ' 10' '10'")
 }
+
+func TestFormatter_FormatTime(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+	f, err := NewFormatter(`%F/%L`)
+	T.ExpectSuccess(err)
+	when := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	T.Equal(f.Format(localhost), "1970-01-01/2130706433")
+	T.Equal(f.FormatTime(localhost, when), "2000-01-02/2130706433")
+
+	// A nil formatter always returns the FID string.
+	f = nil
+	T.Equal(f.FormatTime(localhost, when), localhost.String())
+}
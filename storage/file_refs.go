@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Tracks the readers that are using the open file descriptor of a primary
+// or replica so that the descriptor is not closed while a read is still in
+// progress. When the owner closes the file while readers are active the
+// close is deferred until the last reader has finished.
+type fileRefs struct {
+	lock    sync.Mutex
+	readers int
+	closed  bool
+}
+
+// Returns a ReadCloser for length bytes starting at start within fd. This
+// returns nil if the file has already been closed or if it does not contain
+// the requested range. The caller must close the returned ReadCloser in
+// order to release the reference.
+func (f *fileRefs) reader(fd *os.File, start, length int64) io.ReadCloser {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed || fd == nil {
+		return nil
+	} else if stat, err := fd.Stat(); err != nil {
+		return nil
+	} else if stat.Size() < start+length {
+		return nil
+	}
+	f.readers += 1
+	return &fileRefsReader{
+		SectionReader: io.NewSectionReader(fd, start, length),
+		fd:            fd,
+		refs:          f,
+	}
+}
+
+// Closes the given file descriptor once all readers have finished with it.
+// If there are no active readers then it is closed immediately.
+func (f *fileRefs) close(fd *os.File) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	if f.readers > 0 {
+		return nil
+	}
+	return fd.Close()
+}
+
+// Releases a reference, closing the file descriptor if the owner has
+// already attempted to close it.
+func (f *fileRefs) release(fd *os.File) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.readers -= 1
+	if f.closed && f.readers == 0 {
+		return fd.Close()
+	}
+	return nil
+}
+
+// A ReadCloser returned from fileRefs.reader(). Reads use ReadAt so they do
+// not interfere with the file offset used by the owner of the descriptor.
+type fileRefsReader struct {
+	*io.SectionReader
+	fd   *os.File
+	refs *fileRefs
+	once sync.Once
+}
+
+func (r *fileRefsReader) Close() (err error) {
+	r.once.Do(func() {
+		err = r.refs.release(r.fd)
+	})
+	return
+}
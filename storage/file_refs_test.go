@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"io"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestFileRefs(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := fd.WriteString("0123456789")
+	T.ExpectSuccess(err)
+	refs := fileRefs{}
+
+	// Ranges that are not in the file can not be read.
+	T.Equal(refs.reader(fd, 8, 4), nil)
+
+	// Closing the file while a reader is active is deferred until the
+	// reader is closed.
+	rcloser := refs.reader(fd, 2, 4)
+	T.NotEqual(rcloser, nil)
+	T.ExpectSuccess(refs.close(fd))
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+	_, err = fd.Stat()
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(rcloser.Close())
+	_, err = fd.Stat()
+	T.ExpectError(err)
+
+	// Closing the reader a second time is a no-op.
+	T.ExpectSuccess(rcloser.Close())
+	T.Equal(refs.readers, 0)
+
+	// Once closed no new readers can be created.
+	T.Equal(refs.reader(fd, 2, 4), nil)
+}
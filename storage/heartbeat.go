@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Returns the time that a primary should wait before sending the next heart
+// beat to its replicas. This is half of HeartBeatTime, moved by a random
+// amount of up to HeartBeatJitter in either direction.
+func (s *Settings) heartBeatInterval() time.Duration {
+	interval := s.HeartBeatTime / 2
+	if s.HeartBeatJitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(s.HeartBeatJitter)*2 + 1))
+		interval += jitter - s.HeartBeatJitter
+	}
+	return interval
+}
+
+// Returns the time that a replica waits for a heart beat before it
+// considers itself orphaned. This allows for a primary whose heart beats
+// were delayed by the full jitter.
+func (s *Settings) heartBeatTimeout() time.Duration {
+	return s.HeartBeatTime + s.HeartBeatJitter
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestSettings_HeartBeatInterval(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Without jitter the interval is always half of the heart beat time.
+	s := Settings{HeartBeatTime: time.Minute}
+	T.Equal(s.heartBeatInterval(), time.Second*30)
+	T.Equal(s.heartBeatTimeout(), time.Minute)
+
+	// With jitter the interval stays within the jitter of the midpoint and
+	// the replicas wait long enough for the latest possible heart beat.
+	s.HeartBeatJitter = time.Second * 5
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		interval := s.heartBeatInterval()
+		if interval < time.Second*25 || interval > time.Second*35 {
+			T.Fatalf("Interval %s is outside of the jitter.", interval)
+		}
+		seen[interval] = true
+	}
+	T.NotEqual(len(seen), 1)
+	T.Equal(s.heartBeatTimeout(), time.Minute+time.Second*5)
+}
@@ -2,12 +2,17 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/liquidgecka/testlib"
 
+	"github.com/liquidgecka/blobby/internal/delayqueue"
 	"github.com/liquidgecka/blobby/internal/sloghelper"
+	"github.com/liquidgecka/blobby/internal/workqueue"
+	"github.com/liquidgecka/blobby/storage/fid"
 )
 
 func NewTestLogger() *slog.Logger {
@@ -23,6 +28,62 @@ func InitializeTestableStorage(T *testlib.T) *Storage {
 	return s
 }
 
+// Creates and starts a Storage with settings, filling in everything that
+// was left unset with values that work for a test: no remotes, a temporary
+// directory, work queues that never run and a delay queue that is stopped
+// when T finishes.
+func newStartedTestStorage(T *testlib.T, settings Settings) *Storage {
+	if settings.AssignRemotes == nil {
+		settings.AssignRemotes = func(int) ([]Remote, error) {
+			return nil, nil
+		}
+	}
+	if settings.BaseDirectory == "" {
+		settings.BaseDirectory = T.TempDir()
+	}
+	if settings.BaseLogger == nil {
+		settings.BaseLogger = NewTestLogger()
+	}
+	if settings.CompressWorkQueue == nil {
+		settings.CompressWorkQueue = workqueue.New(0)
+	}
+	if settings.DelayQueue == nil {
+		dq := &delayqueue.DelayQueue{}
+		dq.Start()
+		T.AddFinalizer(dq.Stop)
+		settings.DelayQueue = dq
+	}
+	if settings.DeleteLocalWorkQueue == nil {
+		settings.DeleteLocalWorkQueue = workqueue.New(0)
+	}
+	if settings.DeleteRemotesWorkQueue == nil {
+		settings.DeleteRemotesWorkQueue = workqueue.New(0)
+	}
+	if settings.Read == nil {
+		settings.Read = func(
+			context.Context,
+			ReadConfig,
+		) (
+			io.ReadCloser,
+			error,
+		) {
+			return nil, fmt.Errorf("not implemented")
+		}
+	}
+	if settings.S3Bucket == "" {
+		settings.S3Bucket = "bucket"
+	}
+	if settings.S3Client == nil && settings.ObjectStore == nil {
+		settings.S3Client = &s3.S3{}
+	}
+	if settings.UploadWorkQueue == nil {
+		settings.UploadWorkQueue = workqueue.New(0)
+	}
+	s := New(&settings)
+	T.ExpectSuccess(s.Start(context.Background()))
+	return s
+}
+
 type testReader struct {
 	read func([]byte) (int, error)
 }
@@ -36,7 +97,7 @@ type testRemote struct {
 	heartBeat  func(namespace, fn string) (bool, error)
 	initialize func(namespace, fn string) error
 	name       string
-	read       func(rc ReadConfig) (io.ReadCloser, error)
+	read       func(ctx context.Context, rc ReadConfig) (io.ReadCloser, error)
 	replicate  func(rc RemoteReplicateConfig) (bool, error)
 }
 
@@ -64,9 +125,15 @@ func (t *testRemote) Initialize(namespace, fn string) error {
 	}
 }
 
-func (t *testRemote) Read(rc ReadConfig) (io.ReadCloser, error) {
+func (t *testRemote) Read(
+	ctx context.Context,
+	rc ReadConfig,
+) (
+	io.ReadCloser,
+	error,
+) {
 	if t.read != nil {
-		return t.read(rc)
+		return t.read(ctx, rc)
 	} else {
 		panic("NOT IMPLEMTNED")
 	}
@@ -83,3 +150,27 @@ func (t *testRemote) Replicate(rc RemoteReplicateConfig) (bool, error) {
 func (t *testRemote) String() string {
 	return t.name
 }
+
+type testReadConfig struct {
+	nameSpace string
+	id        string
+	fid       fid.FID
+	start     uint64
+	length    uint32
+	localOnly bool
+	durable   bool
+	gzip      bool
+}
+
+func (t *testReadConfig) NameSpace() string    { return t.nameSpace }
+func (t *testReadConfig) ID() string           { return t.id }
+func (t *testReadConfig) FID() fid.FID         { return t.fid }
+func (t *testReadConfig) FIDString() string    { return t.fid.String() }
+func (t *testReadConfig) Machine() uint32      { return t.fid.Machine() }
+func (t *testReadConfig) Start() uint64        { return t.start }
+func (t *testReadConfig) Length() uint32       { return t.length }
+func (t *testReadConfig) LocalOnly() bool      { return t.localOnly }
+func (t *testReadConfig) DurableOnly() bool    { return t.durable }
+func (t *testReadConfig) AcceptGzip() bool     { return t.gzip }
+func (t *testReadConfig) Logger() *slog.Logger { return nil }
+func (t *testReadConfig) Context() interface{} { return nil }
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bufio"
+	lrulist "container/list"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// The name of the directory within the base directory that idempotency keys
+// are persisted in when Settings.IdempotencyKeyPersist is enabled. Start()
+// ignores anything in the base directory that is not a regular file so this
+// can never be mistaken for a primary or replica.
+const idempotencyDirectory = "idempotency"
+
+// The name of the file within idempotencyDirectory that keys are appended
+// to as inserts complete.
+const idempotencyFile = "keys"
+
+// Remembers the ID that was returned for each idempotency key supplied with
+// an insert so that a retried insert returns the original ID rather than
+// writing the data a second time. Keys are forgotten once they are older
+// than ttl, and once there are more than maxEntries keys the least recently
+// used are evicted. This is only a best effort guarantee, a retry that
+// arrives after the key has expired or been evicted, or that is sent to a
+// different server, will be written again.
+//
+// Inserts using a key that is still being written wait for that insert to
+// finish so that concurrent duplicates do not both write data. If the
+// first insert fails then one of the waiters will perform the insert
+// instead.
+type idempotencyCache struct {
+	ttl        time.Duration
+	maxEntries int
+	log        *slog.Logger
+
+	// If not empty then completed keys are appended to this file and
+	// loaded back from it by load().
+	dir  string
+	fd   *os.File
+	mode os.FileMode
+
+	lock    sync.Mutex
+	entries map[string]*lrulist.Element
+	pending map[string]*idempotencyEntry
+	lru     lrulist.List
+}
+
+// A single idempotency key and the ID that was returned for it.
+type idempotencyEntry struct {
+	Key     string    `json:"key"`
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+
+	// Closed once the insert using this key has finished. This is only
+	// used while the entry is pending.
+	done chan struct{}
+}
+
+// Looks up the given key. If an insert using the key has already completed
+// then its ID is returned. Otherwise the key is reserved for the caller and
+// a non nil entry is returned which must be passed to finish() once the
+// insert is done. If another insert using the key is in progress then this
+// waits for it, returning an error if ctx is canceled first.
+func (c *idempotencyCache) begin(
+	ctx context.Context,
+	key string,
+) (
+	string,
+	*idempotencyEntry,
+	error,
+) {
+	for {
+		c.lock.Lock()
+		if elm, ok := c.entries[key]; ok {
+			entry := elm.Value.(*idempotencyEntry)
+			if time.Since(entry.Created) <= c.ttl {
+				c.lru.MoveToFront(elm)
+				c.lock.Unlock()
+				return entry.ID, nil, nil
+			}
+			c.lru.Remove(elm)
+			delete(c.entries, key)
+		}
+		pending, ok := c.pending[key]
+		if !ok {
+			entry := &idempotencyEntry{
+				Key:  key,
+				done: make(chan struct{}),
+			}
+			c.pending[key] = entry
+			c.lock.Unlock()
+			return "", entry, nil
+		}
+		c.lock.Unlock()
+
+		// Wait for the insert that is already using this key and then
+		// check again.
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+	}
+}
+
+// Records the result of an insert that was started with begin(). If err is
+// nil then id will be returned for any later insert using the same key,
+// otherwise the key is released so that it can be tried again. An empty id
+// is treated as a failure since it means the insert panicked.
+func (c *idempotencyCache) finish(
+	entry *idempotencyEntry,
+	id string,
+	err error,
+) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, entry.Key)
+	defer close(entry.done)
+	if err != nil || id == "" {
+		return
+	}
+	entry.ID = id
+	entry.Created = time.Now()
+	c.add(entry)
+	if c.fd != nil {
+		data, _ := json.Marshal(entry)
+		if _, err := c.fd.Write(append(data, '\n')); err != nil {
+			c.log.Warn(
+				"Error persisting an idempotency key.",
+				sloghelper.String("file", c.fd.Name()),
+				sloghelper.Error("error", err))
+		}
+	}
+}
+
+// Adds a completed entry to the cache, evicting the least recently used
+// entries if there are now too many. This must be called with the lock
+// held.
+func (c *idempotencyCache) add(entry *idempotencyEntry) {
+	if elm, ok := c.entries[entry.Key]; ok {
+		c.lru.Remove(elm)
+	}
+	c.entries[entry.Key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		elm := c.lru.Back()
+		c.lru.Remove(elm)
+		delete(c.entries, elm.Value.(*idempotencyEntry).Key)
+	}
+}
+
+// Loads the keys persisted by a previous run, discarding any that have
+// expired, and then rewrites the file so that it only contains the keys
+// that are still valid. If the cache is not persisted then this does
+// nothing.
+func (c *idempotencyCache) load() error {
+	if c.dir == "" {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	fn := filepath.Join(c.dir, idempotencyFile)
+	if fd, err := os.Open(fn); err == nil {
+		scanner := bufio.NewScanner(fd)
+		for scanner.Scan() {
+			entry := &idempotencyEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				c.log.Warn(
+					"Ignoring a corrupt idempotency key.",
+					sloghelper.String("file", fn),
+					sloghelper.Error("error", err))
+				continue
+			} else if time.Since(entry.Created) <= c.ttl {
+				c.add(entry)
+			}
+		}
+		err = scanner.Err()
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Write out the remaining keys oldest first so that they are loaded
+	// back in the same order.
+	tmp := fn + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.mode)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(fd)
+	for elm := c.lru.Back(); elm != nil; elm = elm.Prev() {
+		data, _ := json.Marshal(elm.Value)
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		fd.Close()
+		return err
+	} else if err := fd.Close(); err != nil {
+		return err
+	} else if err := os.Rename(tmp, fn); err != nil {
+		return err
+	}
+	if c.fd != nil {
+		c.fd.Close()
+	}
+	c.fd, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, c.mode)
+	return err
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	lrulist "container/list"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func newTestIdempotencyCache(
+	ttl time.Duration,
+	maxEntries int,
+	dir string,
+) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		log:        NewTestLogger(),
+		dir:        dir,
+		mode:       0644,
+		entries:    make(map[string]*lrulist.Element),
+		pending:    make(map[string]*idempotencyEntry),
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	c := newTestIdempotencyCache(time.Hour, 2, "")
+	ctx := context.Background()
+
+	// An unknown key is reserved for the caller.
+	id, entry, err := c.begin(ctx, "a")
+	T.ExpectSuccess(err)
+	T.Equal(id, "")
+	T.NotEqual(entry, nil)
+
+	// A failed insert releases the key so it can be tried again.
+	c.finish(entry, "", fmt.Errorf("expected"))
+	id, entry, err = c.begin(ctx, "a")
+	T.ExpectSuccess(err)
+	T.NotEqual(entry, nil)
+
+	// Once the insert succeeds the ID is returned for the key.
+	c.finish(entry, "id-a", nil)
+	id, entry, err = c.begin(ctx, "a")
+	T.ExpectSuccess(err)
+	T.Equal(id, "id-a")
+	T.Equal(entry, (*idempotencyEntry)(nil))
+
+	// Adding more keys than maxEntries evicts the least recently used.
+	_, entry, _ = c.begin(ctx, "b")
+	c.finish(entry, "id-b", nil)
+	id, _, _ = c.begin(ctx, "a")
+	T.Equal(id, "id-a")
+	_, entry, _ = c.begin(ctx, "c")
+	c.finish(entry, "id-c", nil)
+	T.Equal(len(c.entries), 2)
+	_, entry, _ = c.begin(ctx, "b")
+	T.NotEqual(entry, nil)
+	c.finish(entry, "id-b2", nil)
+
+	// Expired keys are forgotten.
+	c.entries["c"].Value.(*idempotencyEntry).Created = time.Now().Add(
+		-2 * time.Hour)
+	_, entry, _ = c.begin(ctx, "c")
+	T.NotEqual(entry, nil)
+}
+
+func TestIdempotencyCache_ConcurrentDuplicates(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	c := newTestIdempotencyCache(time.Hour, 10, "")
+	ctx := context.Background()
+
+	// Many inserts with the same key arrive at once. Only one of them may
+	// perform the insert and the rest must return its ID. The first
+	// insert fails so one of the waiters has to take over.
+	lock := sync.Mutex{}
+	inserts := 0
+	ids := make([]string, 20)
+	wg := sync.WaitGroup{}
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, entry, err := c.begin(ctx, "key")
+			T.ExpectSuccess(err)
+			if entry != nil {
+				lock.Lock()
+				inserts++
+				n := inserts
+				lock.Unlock()
+				time.Sleep(time.Millisecond)
+				if n == 1 {
+					c.finish(entry, "", fmt.Errorf("expected"))
+					id = "failed"
+				} else {
+					id = fmt.Sprintf("id-%d", n)
+					c.finish(entry, id, nil)
+				}
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+	T.Equal(inserts, 2)
+	counts := map[string]int{}
+	for _, id := range ids {
+		counts[id]++
+	}
+	T.Equal(counts, map[string]int{"failed": 1, "id-2": 19})
+	T.Equal(len(c.pending), 0)
+
+	// A waiter gives up if its context is canceled.
+	_, entry, err := c.begin(ctx, "other")
+	T.ExpectSuccess(err)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = c.begin(cctx, "other")
+	T.Equal(err, context.Canceled)
+	c.finish(entry, "id-other", nil)
+}
+
+func TestIdempotencyCache_Persist(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	dir := filepath.Join(T.TempDir(), idempotencyDirectory)
+	c := newTestIdempotencyCache(time.Hour, 10, dir)
+	T.ExpectSuccess(c.load())
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c"} {
+		_, entry, err := c.begin(ctx, key)
+		T.ExpectSuccess(err)
+		c.finish(entry, "id-"+key, nil)
+	}
+
+	// Keys written by a previous run are loaded back.
+	c2 := newTestIdempotencyCache(time.Hour, 10, dir)
+	T.ExpectSuccess(c2.load())
+	T.Equal(len(c2.entries), 3)
+	id, _, _ := c2.begin(ctx, "c")
+	T.Equal(id, "id-c")
+
+	// Expired keys are dropped when loading.
+	c3 := newTestIdempotencyCache(time.Nanosecond, 10, dir)
+	time.Sleep(time.Millisecond)
+	T.ExpectSuccess(c3.load())
+	T.Equal(len(c3.entries), 0)
+
+	// Nothing is persisted without a directory.
+	c4 := newTestIdempotencyCache(time.Hour, 10, "")
+	T.ExpectSuccess(c4.load())
+	T.Equal(c4.fd, (*os.File)(nil))
+}
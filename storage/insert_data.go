@@ -14,11 +14,26 @@ type InsertData struct {
 	Source io.Reader
 
 	// If provided then this will ensure that the data received from the
-	// client is at least this long. If this is zero then it is assumed
-	// that the expected length of the data is unknown and therefor should
-	// be read until EOF.
+	// client is at least this long. If this is zero or negative, as
+	// http.Request.ContentLength is for a chunked request, then it is
+	// assumed that the expected length of the data is unknown and
+	// therefor should be read until EOF. Data of an unknown length is
+	// still limited by Settings.MaxRecordBytes and its integrity relies on
+	// Hash, if given, and the hash that is checked by every replica.
 	Length int64
 
+	// If not empty then this is a client supplied key that identifies the
+	// insert. If Settings.IdempotencyKeyTTL is set and an earlier insert
+	// used the same key then its ID is returned and no data is written.
+	IdempotencyKey string
+
+	// If not empty then this is the hash of the data that the client
+	// sent, in the format used by the hasher package (for example
+	// "hh=..." or "md5=..."). If the data received does not match then the
+	// insert fails with ErrHashMismatch before it is replicated. A value
+	// that can not be parsed fails with ErrInvalidHash.
+	Hash string
+
 	// If this is defined then tracing will be used at various points during
 	// the insertion process. If this is nil then no tracing will be performed.
 	Tracer *tracing.Trace
@@ -5,6 +5,9 @@ import "io"
 type limitReadCloser struct {
 	RC io.ReadCloser
 	N  int64
+
+	// If not nil then the number of bytes read is added to this.
+	Served *int64
 }
 
 func (l *limitReadCloser) Close() error {
@@ -21,5 +24,17 @@ func (l *limitReadCloser) Read(p []byte) (n int, err error) {
 	}
 	n, err = l.RC.Read(p)
 	l.N -= int64(n)
+	if l.Served != nil {
+		*l.Served += int64(n)
+	}
 	return
 }
+
+// Returned from Storage.Read() when the data is being returned in an
+// encoding that the caller must decode, such as the raw gzip object from
+// S3. ContentEncoding is the name of the encoding as used by the HTTP
+// Content-Encoding header.
+type EncodedReadCloser struct {
+	io.ReadCloser
+	ContentEncoding string
+}
@@ -18,12 +18,19 @@ type list struct {
 
 // Obtain the next idle file and return it. This supports passing in a
 // check function that will be run (holding the lock) to ensure that
-// there are objects available if needed.
-func (l *list) Get(check func()) *primary {
+// there are objects available if needed. If abort is not nil then it is
+// also run before each wait and if it returns true the caller stops
+// waiting and nil is returned. wakeAll() can be used to make every waiting
+// caller run abort again.
+func (l *list) Get(check func(), abort func() bool) *primary {
 	l.lock.Lock()
 	defer l.lock.Unlock()
 	l.waiting += 1
 	for l.head == nil {
+		if abort != nil && abort() {
+			l.waiting -= 1
+			return nil
+		}
 		if check != nil {
 			check()
 		}
@@ -99,6 +106,16 @@ func (l *list) Waiting() int {
 	return l.waiting
 }
 
+// Wakes every caller that is waiting in Get().
+func (l *list) wakeAll() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.cond.L == nil {
+		l.cond.L = &l.lock
+	}
+	l.cond.Broadcast()
+}
+
 // Signals the list to indicate that it should check for updates.
 func (l *list) signal() {
 	if l.cond.L == nil {
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"math/rand"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/liquidgecka/testlib"
 )
@@ -20,7 +22,7 @@ func TestList_Get(t *testing.T) {
 		head: &sentinal,
 	}
 	l.cond.L = &l.lock
-	T.Equal(l.Get(nil), &sentinal)
+	T.Equal(l.Get(nil, nil), &sentinal)
 
 	// Try again using a check function that sets a value to ensure that
 	// the check was run. The check function will also trigger a goroutine
@@ -32,8 +34,23 @@ func TestList_Get(t *testing.T) {
 		go func() {
 			l.Put(&sentinal)
 		}()
-	}), &sentinal)
+	}, nil), &sentinal)
 	T.Equal(checkRan, true)
+
+	// Callers stop waiting once abort returns true.
+	abort := int32(0)
+	l = list{head: nil}
+	result := make(chan *primary)
+	go func() {
+		result <- l.Get(nil, func() bool {
+			return atomic.LoadInt32(&abort) != 0
+		})
+	}()
+	T.TryUntil(func() bool { return l.Waiting() == 1 }, time.Second)
+	atomic.StoreInt32(&abort, 1)
+	l.wakeAll()
+	T.Equal(<-result, (*primary)(nil))
+	T.Equal(l.Waiting(), 0)
 }
 
 func TestList_Put(t *testing.T) {
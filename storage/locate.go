@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+	"github.com/liquidgecka/blobby/storage/fid"
+)
+
+// The places that Locate() can report a read being served from.
+const (
+	LocationPrimary = "primary"
+	LocationReplica = "replica"
+	LocationCache   = "cache"
+	LocationRemote  = "remote"
+	LocationS3      = "s3"
+)
+
+// Where a read would be served from, as returned by Locate().
+type Location struct {
+	// One of the Location constants.
+	Source string `json:"source"`
+
+	// If Source is LocationRemote then this is the machine id of the
+	// server that created the file, which is asked for the data first.
+	Machine uint32 `json:"machine,omitempty"`
+
+	// If Source is LocationRemote and this server created the file then
+	// these are the remotes that it replicated the file to.
+	Remotes []string `json:"remotes,omitempty"`
+}
+
+// Reports where a Read() with the given ReadConfig would be served from
+// without reading any of the data. This follows the same order as Read()
+// but only checks the state that is known locally, so remotes and S3 are
+// never contacted. A remote that is reported here may have already removed
+// its copy, in which case the read would fall back to S3. If rc is LocalOnly
+// and the data is not on this server then ErrNotFound is returned.
+func (s *Storage) Locate(rc ReadConfig) (*Location, error) {
+	fidStr := rc.FIDString()
+
+	// Durable reads skip any copy of the data that may not be in S3 yet.
+	if s.settings.DurableReadsOnly || rc.DurableOnly() {
+		if fn, source := s.retainedFile(fidStr); fn != "" && localHas(fn, rc) {
+			return &Location{Source: source}, nil
+		} else if s.readCache != nil && s.readCache.has(rc) {
+			return &Location{Source: LocationCache}, nil
+		}
+		return &Location{Source: LocationS3}, nil
+	}
+
+	// Local copies of the file, compressed or not, are used first.
+	if fn, source := s.localFile(fidStr); fn != "" && localHas(fn, rc) {
+		return &Location{Source: source}, nil
+	}
+	if s.settings.Compress {
+		if fn, _, source := s.localCompressed(fidStr); fn != "" {
+			return &Location{Source: source}, nil
+		}
+	}
+	if rc.LocalOnly() {
+		return nil, ErrNotFound(rc.ID())
+	}
+
+	// Then the server that created the file, or the replicas of files that
+	// were created here.
+	if s.settings.MachineID != rc.Machine() {
+		return &Location{
+			Source:  LocationRemote,
+			Machine: rc.Machine(),
+		}, nil
+	} else if remotes := s.replicaLocations.get(fidStr); len(remotes) > 0 {
+		names := make([]string, len(remotes))
+		for i, remote := range remotes {
+			names[i] = remote.String()
+		}
+		return &Location{
+			Source:  LocationRemote,
+			Machine: rc.Machine(),
+			Remotes: names,
+		}, nil
+	}
+
+	// Lastly the read cache in front of S3.
+	if s.readCache != nil && s.readCache.has(rc) {
+		return &Location{Source: LocationCache}, nil
+	}
+	return &Location{Source: LocationS3}, nil
+}
+
+// Like Locate except that data which is not held locally is confirmed to
+// exist without reading any of it. Data created on another machine is
+// checked for on that machine first and then in S3, and data that Locate
+// reports as being in S3 is checked for there. If the data does not exist
+// then ErrNotFound is returned.
+func (s *Storage) Stat(ctx context.Context, rc ReadConfig) (*Location, error) {
+	location, err := s.Locate(rc)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case location.Source == LocationRemote && len(location.Remotes) > 0:
+		// The replicas recorded for files created here are removed once
+		// the file is uploaded, so they are known to hold the data.
+		return location, nil
+	case location.Source == LocationRemote && s.settings.Head != nil:
+		err := s.settings.Head(ctx, rc)
+		if err == nil {
+			return location, nil
+		} else if _, ok := err.(ErrNotFound); !ok {
+			s.settings.BaseLogger.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Error checking a remote Blobby instance for data, "+
+					"Falling back to S3.",
+				sloghelper.Uint32("machine-id", rc.Machine()),
+				sloghelper.Error("error", err))
+		}
+	case location.Source != LocationRemote && location.Source != LocationS3:
+		return location, nil
+	}
+
+	// The data is not held by a remote so it needs to be in S3 under one
+	// of the key formats.
+	formats := append(
+		[]*fid.Formatter{s.settings.S3KeyFormat},
+		s.settings.S3AdditionalKeyFormats...)
+	for _, format := range formats {
+		key := filepath.Join(s.settings.S3BasePath, format.Format(rc.FID()))
+		log := s.settings.BaseLogger.With(
+			sloghelper.String("bucket", s.settings.S3Bucket),
+			sloghelper.String("key", key))
+		_, err := s.settings.objectStore().Head(ctx, key)
+		if err == nil {
+			return &Location{Source: LocationS3}, nil
+		} else if err = s3GetError(ctx, rc, err, log); err != nil {
+			if _, ok := err.(ErrNotFound); !ok {
+				return nil, err
+			}
+		}
+	}
+	return nil, ErrNotFound(rc.ID())
+}
+
+// Returns the name of the local primary or replica file for the given fid
+// if there is one that can be read from, along with LocationPrimary or
+// LocationReplica depending on which it is. The name is empty if there is
+// no such file.
+func (s *Storage) localFile(fidStr string) (string, string) {
+	fn := func() string {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		p, ok := s.primaries[fidStr]
+		if !ok || p.fd == nil || atomic.LoadInt32(&p.quarantined) != 0 {
+			return ""
+		}
+		return p.fd.Name()
+	}()
+	if fn != "" {
+		return fn, LocationPrimary
+	}
+	s.replicasLock.Lock()
+	defer s.replicasLock.Unlock()
+	r, ok := s.replicas[fidStr]
+	if !ok || r.fd == nil || atomic.LoadInt32(&r.quarantined) != 0 {
+		return "", ""
+	}
+	return r.fd.Name(), LocationReplica
+}
+
+// Returns true if the file with the given name still exists and is large
+// enough to hold the data requested by rc.
+func localHas(fn string, rc ReadConfig) bool {
+	info, err := os.Stat(fn)
+	return err == nil &&
+		uint64(info.Size()) >= rc.Start()+uint64(rc.Length())
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	lrulist "container/list"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/storage/fid"
+)
+
+func TestStorage_Locate(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The source is taken from which map the file is in, not its name.
+	dir := T.TempDir()
+	pfd, err := os.Create(filepath.Join(dir, "r-primary"))
+	T.ExpectSuccess(err)
+	defer pfd.Close()
+	_, err = pfd.WriteString("0123456789")
+	T.ExpectSuccess(err)
+	rfd, err := os.Create(filepath.Join(dir, "replica"))
+	T.ExpectSuccess(err)
+	defer rfd.Close()
+	_, err = rfd.WriteString("0123456789")
+	T.ExpectSuccess(err)
+
+	local := fid.FID{}
+	local.Generate(1)
+	replicated := fid.FID{}
+	replicated.Generate(2)
+	remote := fid.FID{}
+	remote.Generate(3)
+	s := &Storage{
+		primaries: map[string]*primary{
+			local.String(): &primary{fd: pfd, fidStr: local.String()},
+		},
+		replicas: map[string]*replica{
+			replicated.String(): &replica{fd: rfd, fidStr: replicated.String()},
+		},
+		readCache: &readCache{
+			dir:      filepath.Join(dir, readCacheDirectory),
+			maxBytes: 100,
+			log:      NewTestLogger(),
+			entries:  make(map[string]*lrulist.Element),
+		},
+		settings: Settings{MachineID: 1},
+	}
+	T.ExpectSuccess(s.readCache.reset())
+
+	// Files on this server are served locally, as long as they hold all
+	// of the requested data.
+	loc, err := s.Locate(&testReadConfig{fid: local, start: 2, length: 8})
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{Source: LocationPrimary})
+	loc, err = s.Locate(&testReadConfig{fid: replicated, length: 4})
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{Source: LocationReplica})
+	loc, err = s.Locate(&testReadConfig{fid: local, start: 2, length: 9})
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{Source: LocationS3})
+
+	// Files created on other servers are read from that server first.
+	loc, err = s.Locate(&testReadConfig{fid: remote, length: 4})
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{Source: LocationRemote, Machine: 3})
+
+	// Local only reads that can not be served locally are not found.
+	rc := &testReadConfig{id: "id", fid: remote, length: 4, localOnly: true}
+	_, err = s.Locate(rc)
+	T.Equal(err, ErrNotFound("id"))
+
+	// Files created here that are no longer local are read from the
+	// remotes that they were replicated to.
+	gone := fid.FID{}
+	gone.Generate(1)
+	s.replicaLocations.add(gone.String(), []Remote{
+		&testRemote{name: "r1"},
+		&testRemote{name: "r2"},
+	})
+	loc, err = s.Locate(&testReadConfig{fid: gone, length: 4})
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{
+		Source:  LocationRemote,
+		Machine: 1,
+		Remotes: []string{"r1", "r2"},
+	})
+	s.replicaLocations.remove(gone.String())
+
+	// Otherwise the read cache is used before falling back to S3.
+	rc = &testReadConfig{fid: gone, length: 4}
+	loc, err = s.Locate(rc)
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{Source: LocationS3})
+	s.readCache.entries[readCacheKey(rc)] = s.readCache.lru.PushFront(
+		&readCacheEntry{key: readCacheKey(rc), created: time.Now()})
+	loc, err = s.Locate(rc)
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{Source: LocationCache})
+
+	// Durable reads never use files that may not have been uploaded yet.
+	loc, err = s.Locate(&testReadConfig{fid: local, length: 4, durable: true})
+	T.ExpectSuccess(err)
+	T.Equal(loc, &Location{Source: LocationS3})
+}
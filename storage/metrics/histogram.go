@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds of the buckets used by DurationHistogram. These are
+// tuned for operations like S3 uploads which can take anywhere from
+// milliseconds to several minutes.
+var DurationHistogramBuckets = [...]time.Duration{
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 2,
+	time.Second * 5,
+	time.Second * 10,
+	time.Second * 30,
+	time.Minute,
+	time.Minute * 5,
+}
+
+// Tracks the distribution of the durations of an operation. Buckets are
+// stored non cumulatively, the final bucket counts all observations that
+// are larger than the highest bound in DurationHistogramBuckets.
+type DurationHistogram struct {
+	// The count of observations that fell into each bucket.
+	Buckets [len(DurationHistogramBuckets) + 1]int64
+
+	// The total number of observations.
+	Count int64
+
+	// The sum of all observed durations in nanoseconds.
+	Nanoseconds uint64
+}
+
+// Adds a single observation to the histogram.
+func (d *DurationHistogram) Observe(v time.Duration) {
+	i := 0
+	for ; i < len(DurationHistogramBuckets); i++ {
+		if v <= DurationHistogramBuckets[i] {
+			break
+		}
+	}
+	atomic.AddInt64(&d.Buckets[i], 1)
+	atomic.AddInt64(&d.Count, 1)
+	atomic.AddUint64(&d.Nanoseconds, uint64(v))
+}
+
+// Copies the data in the given object into the current object.
+func (d *DurationHistogram) CopyFrom(d2 *DurationHistogram) {
+	for i := range d.Buckets {
+		d.Buckets[i] = atomic.LoadInt64(&d2.Buckets[i])
+	}
+	d.Count = atomic.LoadInt64(&d2.Count)
+	d.Nanoseconds = atomic.LoadUint64(&d2.Nanoseconds)
+}
+
+// The default upper bounds of the buckets used by the insert latency
+// histograms. Inserts are expected to be far faster than uploads so these
+// range from a millisecond to several seconds.
+var DefaultLatencyHistogramBuckets = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 5,
+}
+
+// Like DurationHistogram, except that the bucket bounds are set when the
+// histogram is created rather than at compile time. A zero value histogram
+// has no buckets and only tracks the count and sum of observations.
+type LatencyHistogram struct {
+	// The upper bounds of each bucket in increasing order. This must not
+	// be modified after the histogram is created.
+	Bounds []time.Duration
+
+	// The count of observations that fell into each bucket. This has one
+	// more element than Bounds, the final bucket counts all observations
+	// that are larger than the highest bound.
+	Buckets []int64
+
+	// The total number of observations.
+	Count int64
+
+	// The sum of all observed durations in nanoseconds.
+	Nanoseconds uint64
+}
+
+// Returns a new LatencyHistogram that uses the given bucket bounds, which
+// must be in increasing order.
+func NewLatencyHistogram(bounds []time.Duration) LatencyHistogram {
+	return LatencyHistogram{
+		Bounds:  bounds,
+		Buckets: make([]int64, len(bounds)+1),
+	}
+}
+
+// Adds a single observation to the histogram. This is safe to call from
+// multiple goroutines at the same time.
+func (l *LatencyHistogram) Observe(v time.Duration) {
+	i := 0
+	for ; i < len(l.Bounds); i++ {
+		if v <= l.Bounds[i] {
+			break
+		}
+	}
+	if i < len(l.Buckets) {
+		atomic.AddInt64(&l.Buckets[i], 1)
+	}
+	atomic.AddInt64(&l.Count, 1)
+	atomic.AddUint64(&l.Nanoseconds, uint64(v))
+}
+
+// Copies the data in the given object into the current object.
+func (l *LatencyHistogram) CopyFrom(l2 *LatencyHistogram) {
+	l.Bounds = l2.Bounds
+	l.Buckets = make([]int64, len(l2.Buckets))
+	for i := range l.Buckets {
+		l.Buckets[i] = atomic.LoadInt64(&l2.Buckets[i])
+	}
+	l.Count = atomic.LoadInt64(&l2.Count)
+	l.Nanoseconds = atomic.LoadUint64(&l2.Nanoseconds)
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestDurationHistogram_Observe(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	d := DurationHistogram{}
+	d.Observe(time.Millisecond)
+	T.Equal(d.Buckets[0], int64(1))
+	T.Equal(d.Count, int64(1))
+	T.Equal(d.Nanoseconds, uint64(time.Millisecond))
+
+	// Values that land exactly on a bound belong to that bucket.
+	d.Observe(time.Second)
+	T.Equal(d.Buckets[3], int64(1))
+	T.Equal(d.Count, int64(2))
+
+	// And anything larger than the last bound goes into the overflow.
+	d.Observe(time.Hour)
+	T.Equal(d.Buckets[len(DurationHistogramBuckets)], int64(1))
+	T.Equal(d.Count, int64(3))
+	T.Equal(
+		d.Nanoseconds,
+		uint64(time.Millisecond+time.Second+time.Hour))
+}
+
+func TestLatencyHistogram_Observe(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	l := NewLatencyHistogram([]time.Duration{time.Millisecond, time.Second})
+	T.Equal(len(l.Buckets), 3)
+	l.Observe(time.Microsecond)
+	l.Observe(time.Second)
+	l.Observe(time.Hour)
+	T.Equal(l.Buckets, []int64{1, 1, 1})
+	T.Equal(l.Count, int64(3))
+	T.Equal(
+		l.Nanoseconds,
+		uint64(time.Microsecond+time.Second+time.Hour))
+
+	// A zero value histogram has no buckets but still tracks the count
+	// and sum.
+	z := LatencyHistogram{}
+	z.Observe(time.Second)
+	T.Equal(z.Count, int64(1))
+	T.Equal(z.Nanoseconds, uint64(time.Second))
+}
@@ -12,10 +12,33 @@ type Metrics struct {
 	// into Primaries hosted by this storage instance.
 	BytesInserted int64
 
+	// The number of inserts that were accepted even though some of the
+	// replicas failed because enough replicas accepted the data to meet
+	// the configured quorum.
+	DegradedInserts int64
+
+	// The level that the next file will be compressed at. This changes over
+	// time if adaptive compression is enabled.
+	CompressLevel int64
+
+	// The number of bytes of data written to the primary and replica files
+	// of this name space that are still on disk. Space reserved by
+	// Settings.PreallocateBytes but not yet written to is not included, so
+	// the space actually used on disk may be larger than this.
+	DiskBytes int64
+
 	// Counts of files deleted on disk. This includes primaries and
 	// replicas.
 	FilesDeleted MetricFailedSuccessTotal
 
+	// Counts the inserts that were rejected because they waited longer
+	// than Settings.InsertQueueTimeout for a primary.
+	InsertQueueTimeouts int64
+
+	// Counts the inserts that were dropped because the caller went away,
+	// usually by disconnecting, while waiting for a primary.
+	InsertsCanceled int64
+
 	// We also have a special set of metrics for tracking internally
 	// generated and completely unexpected errors. Unlike Insert and
 	// replication related metrics, which can return errors in cases
@@ -24,6 +47,11 @@ type Metrics struct {
 	// be generated by local system failures.
 	InternalInsertErrors int64
 
+	// The unix time (in seconds) of the last successful upload to S3 for
+	// either a primary or a replica. This is zero if nothing has been
+	// uploaded since the process started.
+	LastSuccessfulUpload int64
+
 	// Amount of time the oldest file has been queued for uploading (including
 	// the time it takes to actually upload).
 	OldestQueuedUpload float64
@@ -31,9 +59,32 @@ type Metrics struct {
 	// Age of oldest file that has not been uploaded to S3, in seconds:
 	OldestUnUploadedData float64
 
+	// The number of seconds that the oldest primary and replica in each
+	// state has been in it. Every known state is included, in the order
+	// that files move through them, and states with no files are zero.
+	// This shows where files are piling up when something downstream is
+	// stuck.
+	PrimaryStateAges []StateAge
+	ReplicaStateAges []StateAge
+
+	// The number of primaries and replicas that have not finished being
+	// processed. When draining a server this will reach zero once all of
+	// the data has been uploaded and the files removed.
+	PendingPrimaries int64
+	PendingReplicas  int64
+
+	// The number of primaries currently on this node and the number of
+	// bytes of data that they hold.
+	Primaries    int64
+	PrimaryBytes uint64
+
 	// Count of primaries that have been deleted.
 	PrimaryDeletes MetricFailedSuccessTotal
 
+	// Tracks how long heart beats sent from primaries to their replicas
+	// take to complete.
+	PrimaryHeartBeatLatency LatencyHistogram
+
 	// Counts the total number of Insert operations.
 	PrimaryInserts MetricFailedSuccessTotal
 
@@ -42,23 +93,59 @@ type Metrics struct {
 	// include the time it took to actually perform the insert.
 	PrimaryInsertQueueNanoseconds uint64
 
+	// Tracks the distribution of the time that requests were queued for
+	// before finding a primary file to insert into.
+	PrimaryInsertQueueLatency LatencyHistogram
+
 	// Counts the total number of nanoseconds that requests have spent
 	// replicating to other instances.
 	PrimaryInsertReplicateNanoseconds uint64
 
+	// Tracks the distribution of the time that requests have spent
+	// replicating to other instances.
+	PrimaryInsertReplicateLatency LatencyHistogram
+
 	// Counts the total number of nanoseconds that requests have spent
 	// writing to local disk.
 	PrimaryInsertWriteNanoseconds uint64
 
+	// Tracks the distribution of the time that requests have spent
+	// writing to local disk.
+	PrimaryInsertWriteLatency LatencyHistogram
+
 	// Counts of the primary open operations.
 	PrimaryOpens MetricFailedSuccessTotal
 
+	// The number of primaries that are currently open for appending and
+	// the configured maximum (OpenFilesMaximum). Callers waiting for a
+	// primary are tracked in QueuedInserts.
+	PrimaryPoolAppendable int64
+	PrimaryPoolMaximum    int64
+
+	// The number of times that a caller had to wait for a primary while
+	// the pool was already at its maximum size, meaning that no new
+	// primary could be opened for it.
+	PrimaryPoolExhausted int64
+
+	// The largest number of bytes that any replica of an active primary
+	// has been observed to be behind the primary. This is only tracked if
+	// the namespace is configured to track replica lag.
+	PrimaryReplicaLag uint64
+
 	// Count of primaries that have been uploaded.
 	PrimaryUploads MetricFailedSuccessTotal
 
+	// Tracks how long S3 uploads of primaries have taken.
+	PrimaryUploadDuration DurationHistogram
+
 	// The number of queued inserts.
 	QueuedInserts int64
 
+	// The number of replicas currently on this node and the number of
+	// bytes of data that they hold.
+	Replicas     int64
+	ReplicaBytes uint64
+
 	// A pure count of replicas that have been queued for deleting.
 	ReplicaDeletes MetricFailedSuccessTotal
 
@@ -68,6 +155,10 @@ type Metrics struct {
 	// Counts of replica Initialize requests.
 	ReplicaInitializes MetricFailedSuccessTotal
 
+	// The largest number of bytes that any replica on this node is behind
+	// its primary, as seen by the replicate calls that it has received.
+	ReplicaLag uint64
+
 	// A pure count of the number of replicas that have been marked as
 	// orphaned and therefor have moved into an uploading state.
 	ReplicaOrphaned int64
@@ -80,29 +171,114 @@ type Metrics struct {
 
 	// Counts of replicas that have been Uploaded.
 	ReplicaUploads MetricFailedSuccessTotal
+
+	// Tracks how long S3 uploads of replicas have taken.
+	ReplicaUploadDuration DurationHistogram
+
+	// Counts the number of reads that were served from each source.
+	ReadSources MetricReadSources
+
+	// The number of bytes held by files that have been uploaded and are
+	// being kept on the local disk to serve reads.
+	RetainedBytes uint64
+
+	// Counts the bytes read back by Scrub(), and the number of records
+	// that it found did not match their hash.
+	ScrubbedBytes    int64
+	ScrubCorruptions int64
+
+	// The number of inserts into primaries whose replicas could not be
+	// spread across distinct failure domains, usually because there are
+	// not enough remotes with capacity in the other domains.
+	UnspreadInserts int64
+
+	// Counts the number of times that the canary read performed after an
+	// upload returned data that did not match the local file.
+	UploadCanaryFailures int64
+
+	// Counts the number of times that an uploaded object did not have the
+	// size or hash that was computed locally when it was verified.
+	UploadHashMismatches int64
+
+	// Counts the number of times that a single part of a multipart upload
+	// had to be retried.
+	UploadPartRetries int64
+
+	// Counts the number of times that an upload to S3 failed and was
+	// attempted again after backing off.
+	UploadRetries int64
+
+	// Counts the notifications sent to Settings.OnUpload that were
+	// delivered, and those that were dropped after failing or because the
+	// queue was full.
+	UploadNotificationsDelivered int64
+	UploadNotificationsFailed    int64
+
+	// The number of uploads to S3 that are currently in progress, and the
+	// number that are waiting for a slot in Settings.UploadSemaphore.
+	UploadsInFlight int64
+	UploadsWaiting  int64
 }
 
 func (m *Metrics) CopyFrom(m2 *Metrics) {
 	m.BytesInserted = atomic.LoadInt64(&m2.BytesInserted)
+	m.CompressLevel = atomic.LoadInt64(&m2.CompressLevel)
+	m.DegradedInserts = atomic.LoadInt64(&m2.DegradedInserts)
+	m.DiskBytes = atomic.LoadInt64(&m2.DiskBytes)
 	m.FilesDeleted.CopyFrom(&m2.FilesDeleted)
+	m.InsertQueueTimeouts = atomic.LoadInt64(&m2.InsertQueueTimeouts)
+	m.InsertsCanceled = atomic.LoadInt64(&m2.InsertsCanceled)
 	m.InternalInsertErrors = atomic.LoadInt64(&m2.InternalInsertErrors)
+	m.LastSuccessfulUpload = atomic.LoadInt64(&m2.LastSuccessfulUpload)
 	m.OldestQueuedUpload = m2.OldestQueuedUpload
 	m.OldestUnUploadedData = m2.OldestUnUploadedData
+	m.PrimaryStateAges = append([]StateAge(nil), m2.PrimaryStateAges...)
+	m.ReplicaStateAges = append([]StateAge(nil), m2.ReplicaStateAges...)
+	m.PendingPrimaries = atomic.LoadInt64(&m2.PendingPrimaries)
+	m.PendingReplicas = atomic.LoadInt64(&m2.PendingReplicas)
+	m.Primaries = atomic.LoadInt64(&m2.Primaries)
+	m.PrimaryBytes = atomic.LoadUint64(&m2.PrimaryBytes)
 	m.PrimaryDeletes.CopyFrom(&m2.PrimaryDeletes)
+	m.PrimaryHeartBeatLatency.CopyFrom(&m2.PrimaryHeartBeatLatency)
 	m.PrimaryInserts.CopyFrom(&m2.PrimaryInserts)
 	m.PrimaryInsertQueueNanoseconds = atomic.LoadUint64(&m2.PrimaryInsertQueueNanoseconds)
 	m.PrimaryInsertWriteNanoseconds = atomic.LoadUint64(&m2.PrimaryInsertWriteNanoseconds)
 	m.PrimaryInsertReplicateNanoseconds = atomic.LoadUint64(&m2.PrimaryInsertReplicateNanoseconds)
+	m.PrimaryInsertQueueLatency.CopyFrom(&m2.PrimaryInsertQueueLatency)
+	m.PrimaryInsertReplicateLatency.CopyFrom(&m2.PrimaryInsertReplicateLatency)
+	m.PrimaryInsertWriteLatency.CopyFrom(&m2.PrimaryInsertWriteLatency)
 	m.PrimaryOpens.CopyFrom(&m2.PrimaryOpens)
+	m.PrimaryPoolAppendable = atomic.LoadInt64(&m2.PrimaryPoolAppendable)
+	m.PrimaryPoolExhausted = atomic.LoadInt64(&m2.PrimaryPoolExhausted)
+	m.PrimaryPoolMaximum = atomic.LoadInt64(&m2.PrimaryPoolMaximum)
+	m.PrimaryReplicaLag = atomic.LoadUint64(&m2.PrimaryReplicaLag)
 	m.PrimaryUploads.CopyFrom(&m2.PrimaryUploads)
+	m.PrimaryUploadDuration.CopyFrom(&m2.PrimaryUploadDuration)
 	m.QueuedInserts = atomic.LoadInt64(&m2.QueuedInserts)
+	m.Replicas = atomic.LoadInt64(&m2.Replicas)
+	m.ReplicaBytes = atomic.LoadUint64(&m2.ReplicaBytes)
 	m.ReplicaDeletes.CopyFrom(&m2.ReplicaDeletes)
 	m.ReplicaHeartBeats.CopyFrom(&m2.ReplicaHeartBeats)
 	m.ReplicaInitializes.CopyFrom(&m2.ReplicaInitializes)
+	m.ReplicaLag = atomic.LoadUint64(&m2.ReplicaLag)
 	m.ReplicaOrphaned = atomic.LoadInt64(&m2.ReplicaOrphaned)
 	m.ReplicaQueueDeletes.CopyFrom(&m2.ReplicaQueueDeletes)
 	m.ReplicaReplicates.CopyFrom(&m2.ReplicaReplicates)
 	m.ReplicaUploads.CopyFrom(&m2.ReplicaUploads)
+	m.ReplicaUploadDuration.CopyFrom(&m2.ReplicaUploadDuration)
+	m.ReadSources.CopyFrom(&m2.ReadSources)
+	m.RetainedBytes = atomic.LoadUint64(&m2.RetainedBytes)
+	m.ScrubbedBytes = atomic.LoadInt64(&m2.ScrubbedBytes)
+	m.ScrubCorruptions = atomic.LoadInt64(&m2.ScrubCorruptions)
+	m.UnspreadInserts = atomic.LoadInt64(&m2.UnspreadInserts)
+	m.UploadCanaryFailures = atomic.LoadInt64(&m2.UploadCanaryFailures)
+	m.UploadHashMismatches = atomic.LoadInt64(&m2.UploadHashMismatches)
+	m.UploadNotificationsDelivered = atomic.LoadInt64(&m2.UploadNotificationsDelivered)
+	m.UploadNotificationsFailed = atomic.LoadInt64(&m2.UploadNotificationsFailed)
+	m.UploadPartRetries = atomic.LoadInt64(&m2.UploadPartRetries)
+	m.UploadRetries = atomic.LoadInt64(&m2.UploadRetries)
+	m.UploadsInFlight = atomic.LoadInt64(&m2.UploadsInFlight)
+	m.UploadsWaiting = atomic.LoadInt64(&m2.UploadsWaiting)
 }
 
 // Several metric types have a concept of a counter of total attempts,
@@ -130,3 +306,53 @@ func (m *MetricFailedSuccessTotal) IncSuccesses() {
 func (m *MetricFailedSuccessTotal) IncTotal() {
 	atomic.AddInt64(&m.Total, 1)
 }
+
+// Counts where successful reads were served from. Local reads come from a
+// primary or replica file on this machine, remote reads from another Blobby
+// instance, and cache reads from the local copy of data that was previously
+// read from S3. RemoteErrors counts the reads where the remote returned an
+// error (rather than simply not having the data) and the read fell back to
+// S3, which is useful for spotting flaky remotes.
+type MetricReadSources struct {
+	Cache        int64
+	Local        int64
+	Remote       int64
+	RemoteErrors int64
+	S3           int64
+}
+
+// Copies the data in the given object into the current object.
+func (m *MetricReadSources) CopyFrom(m2 *MetricReadSources) {
+	m.Cache = atomic.LoadInt64(&m2.Cache)
+	m.Local = atomic.LoadInt64(&m2.Local)
+	m.Remote = atomic.LoadInt64(&m2.Remote)
+	m.RemoteErrors = atomic.LoadInt64(&m2.RemoteErrors)
+	m.S3 = atomic.LoadInt64(&m2.S3)
+}
+
+func (m *MetricReadSources) IncCache() {
+	atomic.AddInt64(&m.Cache, 1)
+}
+
+func (m *MetricReadSources) IncLocal() {
+	atomic.AddInt64(&m.Local, 1)
+}
+
+func (m *MetricReadSources) IncRemote() {
+	atomic.AddInt64(&m.Remote, 1)
+}
+
+func (m *MetricReadSources) IncRemoteErrors() {
+	atomic.AddInt64(&m.RemoteErrors, 1)
+}
+
+func (m *MetricReadSources) IncS3() {
+	atomic.AddInt64(&m.S3, 1)
+}
+
+// The age of the oldest file in a single state. State is the same string
+// that is shown on the status page.
+type StateAge struct {
+	State   string
+	Seconds float64
+}
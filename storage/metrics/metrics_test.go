@@ -4,6 +4,7 @@ import (
 	"math/rand"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/liquidgecka/testlib"
 )
@@ -21,7 +22,7 @@ func fuzzValue(T *testlib.T, v reflect.Value) {
 	case reflect.Int32:
 		v.Set(reflect.ValueOf(rand.Int31()))
 	case reflect.Int64:
-		v.Set(reflect.ValueOf(rand.Int63()))
+		v.SetInt(rand.Int63())
 	case reflect.Uint:
 		v.Set(reflect.ValueOf(uint(rand.Uint32())))
 	case reflect.Uint8:
@@ -33,6 +34,10 @@ func fuzzValue(T *testlib.T, v reflect.Value) {
 	case reflect.Uint64:
 		v.Set(reflect.ValueOf(rand.Uint64()))
 
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			fuzzValue(T, v.Index(i))
+		}
 	case reflect.Struct:
 		for i := 0; i < v.NumField(); i++ {
 			fuzzValue(T, v.Field(i))
@@ -51,7 +56,12 @@ func TestMetrics_CopyFrom(t *testing.T) {
 	// field is getting missed. Note that we make a copy of the want
 	// value before copying just in case the copy alters the source rather
 	// than the destination.
-	want := Metrics{}
+	want := Metrics{
+		PrimaryHeartBeatLatency:       NewLatencyHistogram(make([]time.Duration, 2)),
+		PrimaryInsertQueueLatency:     NewLatencyHistogram(make([]time.Duration, 2)),
+		PrimaryInsertReplicateLatency: NewLatencyHistogram(make([]time.Duration, 2)),
+		PrimaryInsertWriteLatency:     NewLatencyHistogram(make([]time.Duration, 2)),
+	}
 	fuzzValue(T, reflect.Indirect(reflect.ValueOf(&want)))
 	source := want
 	have := Metrics{}
@@ -91,3 +101,23 @@ func TestMetricFailedSuccessTotal_IncTotal(t *testing.T) {
 	m.IncTotal()
 	T.Equal(m.Total, int64(2))
 }
+
+func TestMetricReadSources_Inc(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	m := MetricReadSources{}
+	m.IncCache()
+	m.IncLocal()
+	m.IncLocal()
+	m.IncRemote()
+	m.IncRemoteErrors()
+	m.IncS3()
+	T.Equal(m, MetricReadSources{
+		Cache:        1,
+		Local:        2,
+		Remote:       1,
+		RemoteErrors: 1,
+		S3:           1,
+	})
+}
@@ -3,6 +3,8 @@ package metrics
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"time"
 )
 
 // Renders the various metrics into a prometheus 0.0.4 compatible output.
@@ -15,6 +17,40 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE compress_level gauge\n")
+	fmt.Fprintf(w, "# HELP compress_level The level that the next file will be compressed at.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `compress_level{%snamespace="%s"} %d`, prefix, namespace, m.CompressLevel)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE degraded_inserts counter\n")
+	fmt.Fprintf(w, "# HELP degraded_inserts Inserts accepted after some replicas failed because the replica quorum was still met.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `degraded_inserts{%snamespace="%s"} %d`, prefix, namespace, m.DegradedInserts)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE disk_bytes gauge\n")
+	fmt.Fprintf(w, "# HELP disk_bytes Bytes written to the data files of primaries and replicas in the namespace, excluding preallocated space.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `disk_bytes{%snamespace="%s"} %d`, prefix, namespace, m.DiskBytes)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE file_bytes gauge\n")
+	fmt.Fprintf(w, "# HELP file_bytes Bytes of data held by the primaries and replicas currently on this node.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `file_bytes{%snamespace="%s",%stype="primary"} %d`, prefix, namespace, prefix, m.PrimaryBytes)
+		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `file_bytes{%snamespace="%s",%stype="replica"} %d`, prefix, namespace, prefix, m.ReplicaBytes)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE file_deletion_failures counter\n")
 	fmt.Fprintf(w, "# HELP file_deletion_failures Number of failed file deletes\n")
 	for namespace, m := range metrics {
@@ -39,6 +75,46 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE file_state_age_seconds gauge\n")
+	fmt.Fprintf(w, "# HELP file_state_age_seconds The amount of time the oldest file in each state has been in it.\n")
+	for namespace, m := range metrics {
+		for _, age := range m.PrimaryStateAges {
+			fmt.Fprintf(w, `file_state_age_seconds{%snamespace="%s",%sstate="%s",%stype="primary"} %f`, prefix, namespace, prefix, age.State, prefix, age.Seconds)
+			w.Write([]byte{'\n'})
+		}
+		for _, age := range m.ReplicaStateAges {
+			fmt.Fprintf(w, `file_state_age_seconds{%snamespace="%s",%sstate="%s",%stype="replica"} %f`, prefix, namespace, prefix, age.State, prefix, age.Seconds)
+			w.Write([]byte{'\n'})
+		}
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE files gauge\n")
+	fmt.Fprintf(w, "# HELP files The number of primaries and replicas currently on this node.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `files{%snamespace="%s",%stype="primary"} %d`, prefix, namespace, prefix, m.Primaries)
+		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `files{%snamespace="%s",%stype="replica"} %d`, prefix, namespace, prefix, m.Replicas)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE insert_queue_timeouts counter\n")
+	fmt.Fprintf(w, "# HELP insert_queue_timeouts Count of inserts rejected because they waited too long for a file to write to.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `insert_queue_timeouts{%snamespace="%s"} %d`, prefix, namespace, m.InsertQueueTimeouts)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE inserts_canceled counter\n")
+	fmt.Fprintf(w, "# HELP inserts_canceled Count of inserts dropped because the client went away while waiting for a file to write to.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `inserts_canceled{%snamespace="%s"} %d`, prefix, namespace, m.InsertsCanceled)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE internal_errors counter\n")
 	fmt.Fprintf(w, "# HELP internal_errors The number of internally generated errors encountered.\n")
 	for namespace, m := range metrics {
@@ -47,6 +123,14 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE last_successful_upload_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "# HELP last_successful_upload_timestamp_seconds Unix time of the last successful upload to S3.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `last_successful_upload_timestamp_seconds{%snamespace="%s"} %d`, prefix, namespace, m.LastSuccessfulUpload)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE oldest_queued_upload_seconds gauge\n")
 	fmt.Fprintf(w, "# HELP oldest_queued_upload_seconds The amount of time the oldest file has been queued for upload.\n")
 	for namespace, m := range metrics {
@@ -55,6 +139,16 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE pending_files gauge\n")
+	fmt.Fprintf(w, "# HELP pending_files The number of files that have not finished being uploaded and removed.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `pending_files{%snamespace="%s",%stype="primary"} %d`, prefix, namespace, prefix, m.PendingPrimaries)
+		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `pending_files{%snamespace="%s",%stype="replica"} %d`, prefix, namespace, prefix, m.PendingReplicas)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE primary_delete_failures counter\n")
 	fmt.Fprintf(w, "# HELP primary_delete_failures Number of failed primary deletes\n")
 	for namespace, m := range metrics {
@@ -79,6 +173,22 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE primary_heartbeat_duration_seconds histogram\n")
+	fmt.Fprintf(w, "# HELP primary_heartbeat_duration_seconds The round trip time of heart beats sent from primaries to their replicas.\n")
+	for namespace, m := range metrics {
+		renderLatencyHistogram(w, "primary_heartbeat_duration_seconds", prefix, namespace, "round_trip", &m.PrimaryHeartBeatLatency)
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE primary_insert_duration_seconds histogram\n")
+	fmt.Fprintf(w, "# HELP primary_insert_duration_seconds The amount of time inserts spent queued, writing to disk, and replicating.\n")
+	for namespace, m := range metrics {
+		renderLatencyHistogram(w, "primary_insert_duration_seconds", prefix, namespace, "queue", &m.PrimaryInsertQueueLatency)
+		renderLatencyHistogram(w, "primary_insert_duration_seconds", prefix, namespace, "replicate", &m.PrimaryInsertReplicateLatency)
+		renderLatencyHistogram(w, "primary_insert_duration_seconds", prefix, namespace, "write", &m.PrimaryInsertWriteLatency)
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE primary_insert_failures counter\n")
 	fmt.Fprintf(w, "# HELP primary_insert_failures Number of failed primary inserts\n")
 	for namespace, m := range metrics {
@@ -135,6 +245,38 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE primary_pool_appendable gauge\n")
+	fmt.Fprintf(w, "# HELP primary_pool_appendable Number of primaries currently open for appending.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `primary_pool_appendable{%snamespace="%s"} %d`, prefix, namespace, m.PrimaryPoolAppendable)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE primary_pool_exhausted counter\n")
+	fmt.Fprintf(w, "# HELP primary_pool_exhausted Number of times a caller waited for a primary while the pool was at its maximum size.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `primary_pool_exhausted{%snamespace="%s"} %d`, prefix, namespace, m.PrimaryPoolExhausted)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE primary_pool_maximum gauge\n")
+	fmt.Fprintf(w, "# HELP primary_pool_maximum The maximum number of primaries that can be open for appending.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `primary_pool_maximum{%snamespace="%s"} %d`, prefix, namespace, m.PrimaryPoolMaximum)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE primary_replica_lag_bytes gauge\n")
+	fmt.Fprintf(w, "# HELP primary_replica_lag_bytes The largest number of bytes a replica of an active primary has been behind.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `primary_replica_lag_bytes{%snamespace="%s"} %d`, prefix, namespace, m.PrimaryReplicaLag)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE primary_upload_failures counter\n")
 	fmt.Fprintf(w, "# HELP primary_upload_failures Number of failed primary uploads\n")
 	for namespace, m := range metrics {
@@ -167,6 +309,28 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE read_remote_errors counter\n")
+	fmt.Fprintf(w, "# HELP read_remote_errors Number of reads where a remote Blobby server returned an error and the read fell back to S3.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `read_remote_errors{%snamespace="%s"} %d`, prefix, namespace, m.ReadSources.RemoteErrors)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE reads_total counter\n")
+	fmt.Fprintf(w, "# HELP reads_total Number of reads served from each source.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `reads_total{%snamespace="%s",%sread_source="cache"} %d`, prefix, namespace, prefix, m.ReadSources.Cache)
+		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `reads_total{%snamespace="%s",%sread_source="local"} %d`, prefix, namespace, prefix, m.ReadSources.Local)
+		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `reads_total{%snamespace="%s",%sread_source="remote"} %d`, prefix, namespace, prefix, m.ReadSources.Remote)
+		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `reads_total{%snamespace="%s",%sread_source="s3"} %d`, prefix, namespace, prefix, m.ReadSources.S3)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE replica_delete_failures counter\n")
 	fmt.Fprintf(w, "# HELP replica_delete_failures Number of failed replica deletes\n")
 	for namespace, m := range metrics {
@@ -239,6 +403,14 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE replica_lag_bytes gauge\n")
+	fmt.Fprintf(w, "# HELP replica_lag_bytes The largest number of bytes a replica on this node is behind its primary.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `replica_lag_bytes{%snamespace="%s"} %d`, prefix, namespace, m.ReplicaLag)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE replica_queuedelete_failures counter\n")
 	fmt.Fprintf(w, "# HELP replica_queuedelete_failures Number of failed replica queue deletes\n")
 	for namespace, m := range metrics {
@@ -319,6 +491,86 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 	}
 	w.Write([]byte{'\n'})
 
+	fmt.Fprintf(w, "# TYPE retained_bytes gauge\n")
+	fmt.Fprintf(w, "# HELP retained_bytes Bytes of uploaded data that is being kept on the local disk to serve reads.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `retained_bytes{%snamespace="%s"} %d`, prefix, namespace, m.RetainedBytes)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE s3_upload_canary_failures counter\n")
+	fmt.Fprintf(w, "# HELP s3_upload_canary_failures Count of uploads where the data read back from S3 did not match the local file.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `s3_upload_canary_failures{%snamespace="%s"} %d`, prefix, namespace, m.UploadCanaryFailures)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE s3_upload_duration_seconds histogram\n")
+	fmt.Fprintf(w, "# HELP s3_upload_duration_seconds The amount of time spent uploading files to S3.\n")
+	for namespace, m := range metrics {
+		renderDurationHistogram(w, "s3_upload_duration_seconds", prefix, namespace, "primary", &m.PrimaryUploadDuration)
+		renderDurationHistogram(w, "s3_upload_duration_seconds", prefix, namespace, "replica", &m.ReplicaUploadDuration)
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE s3_upload_hash_mismatches counter\n")
+	fmt.Fprintf(w, "# HELP s3_upload_hash_mismatches Count of uploaded objects whose size or hash did not match the local file.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `s3_upload_hash_mismatches{%snamespace="%s"} %d`, prefix, namespace, m.UploadHashMismatches)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE s3_upload_part_retries counter\n")
+	fmt.Fprintf(w, "# HELP s3_upload_part_retries Count of multipart upload parts that had to be retried.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `s3_upload_part_retries{%snamespace="%s"} %d`, prefix, namespace, m.UploadPartRetries)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE s3_upload_retries counter\n")
+	fmt.Fprintf(w, "# HELP s3_upload_retries Count of uploads to S3 that were attempted again after failing.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `s3_upload_retries{%snamespace="%s"} %d`, prefix, namespace, m.UploadRetries)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE s3_uploads_in_flight gauge\n")
+	fmt.Fprintf(w, "# HELP s3_uploads_in_flight Uploads to S3 that are currently in progress.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `s3_uploads_in_flight{%snamespace="%s"} %d`, prefix, namespace, m.UploadsInFlight)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE s3_uploads_waiting gauge\n")
+	fmt.Fprintf(w, "# HELP s3_uploads_waiting Uploads to S3 that are waiting for a slot under max_concurrent_uploads.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `s3_uploads_waiting{%snamespace="%s"} %d`, prefix, namespace, m.UploadsWaiting)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE scrub_bytes counter\n")
+	fmt.Fprintf(w, "# HELP scrub_bytes Bytes read back from local files and checked against their hashes.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `scrub_bytes{%snamespace="%s"} %d`, prefix, namespace, m.ScrubbedBytes)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE scrub_corruptions counter\n")
+	fmt.Fprintf(w, "# HELP scrub_corruptions Records in local files that did not match their hash when scrubbed.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `scrub_corruptions{%snamespace="%s"} %d`, prefix, namespace, m.ScrubCorruptions)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
 	fmt.Fprintf(w, "# TYPE timing_data_nanoseconds counter\n")
 	fmt.Fprintf(w, "# HELP timing_data_nanoseconds The amount of time various operations have taken in aggregate since server startup.\n")
 	for namespace, m := range metrics {
@@ -328,5 +580,66 @@ func RenderPrometheus(w io.Writer, prefix string, metrics map[string]Metrics) {
 		w.Write([]byte{'\n'})
 		fmt.Fprintf(w, `timing_data_nanoseconds{%snamespace="%s",%stype="primary_insert_write"} %d`, prefix, namespace, prefix, m.PrimaryInsertWriteNanoseconds)
 		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `timing_data_nanoseconds{%snamespace="%s",%stype="primary_upload"} %d`, prefix, namespace, prefix, m.PrimaryUploadDuration.Nanoseconds)
+		w.Write([]byte{'\n'})
+		fmt.Fprintf(w, `timing_data_nanoseconds{%snamespace="%s",%stype="replica_upload"} %d`, prefix, namespace, prefix, m.ReplicaUploadDuration.Nanoseconds)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE unspread_inserts counter\n")
+	fmt.Fprintf(w, "# HELP unspread_inserts Inserts into files whose replicas share a failure domain.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `unspread_inserts{%snamespace="%s"} %d`, prefix, namespace, m.UnspreadInserts)
+		w.Write([]byte{'\n'})
 	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE upload_notifications_delivered counter\n")
+	fmt.Fprintf(w, "# HELP upload_notifications_delivered Count of upload notifications that were delivered.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `upload_notifications_delivered{%snamespace="%s"} %d`, prefix, namespace, m.UploadNotificationsDelivered)
+		w.Write([]byte{'\n'})
+	}
+	w.Write([]byte{'\n'})
+
+	fmt.Fprintf(w, "# TYPE upload_notifications_failed counter\n")
+	fmt.Fprintf(w, "# HELP upload_notifications_failed Count of upload notifications that were dropped after failing or because the queue was full.\n")
+	for namespace, m := range metrics {
+		fmt.Fprintf(w, `upload_notifications_failed{%snamespace="%s"} %d`, prefix, namespace, m.UploadNotificationsFailed)
+		w.Write([]byte{'\n'})
+	}
+}
+
+// Renders a DurationHistogram as a prometheus histogram.
+func renderDurationHistogram(w io.Writer, name, prefix, namespace, typ string, h *DurationHistogram) {
+	renderHistogram(w, name, prefix, namespace, typ, DurationHistogramBuckets[:], h.Buckets[:], h.Count, h.Nanoseconds)
+}
+
+// Renders a LatencyHistogram as a prometheus histogram.
+func renderLatencyHistogram(w io.Writer, name, prefix, namespace, typ string, h *LatencyHistogram) {
+	renderHistogram(w, name, prefix, namespace, typ, h.Bounds, h.Buckets, h.Count, h.Nanoseconds)
+}
+
+// Renders the buckets of a histogram with the given upper bounds. Prometheus
+// expects buckets to be cumulative so they are summed as they are written.
+func renderHistogram(w io.Writer, name, prefix, namespace, typ string, bounds []time.Duration, buckets []int64, count int64, nanoseconds uint64) {
+	var cumulative int64
+	for i, bound := range bounds {
+		if i < len(buckets) {
+			cumulative += buckets[i]
+		}
+		le := strconv.FormatFloat(bound.Seconds(), 'f', -1, 64)
+		fmt.Fprintf(w, `%s_bucket{%snamespace="%s",%stype="%s",le="%s"} %d`, name, prefix, namespace, prefix, typ, le, cumulative)
+		w.Write([]byte{'\n'})
+	}
+	if len(buckets) > len(bounds) {
+		cumulative += buckets[len(bounds)]
+	}
+	fmt.Fprintf(w, `%s_bucket{%snamespace="%s",%stype="%s",le="+Inf"} %d`, name, prefix, namespace, prefix, typ, cumulative)
+	w.Write([]byte{'\n'})
+	fmt.Fprintf(w, `%s_sum{%snamespace="%s",%stype="%s"} %f`, name, prefix, namespace, prefix, typ, float64(nanoseconds)/1e9)
+	w.Write([]byte{'\n'})
+	fmt.Fprintf(w, `%s_count{%snamespace="%s",%stype="%s"} %d`, name, prefix, namespace, prefix, typ, count)
+	w.Write([]byte{'\n'})
 }
@@ -6,6 +6,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/liquidgecka/testlib"
 )
@@ -23,7 +24,7 @@ func setValue(T *testlib.T, v reflect.Value, s int64) {
 	case reflect.Int32:
 		v.Set(reflect.ValueOf(int32(s)))
 	case reflect.Int64:
-		v.Set(reflect.ValueOf(int64(s)))
+		v.SetInt(s)
 	case reflect.Uint:
 		v.Set(reflect.ValueOf(uint(s)))
 	case reflect.Uint8:
@@ -36,6 +37,10 @@ func setValue(T *testlib.T, v reflect.Value, s int64) {
 		v.Set(reflect.ValueOf(uint64(s)))
 	case reflect.String:
 		v.Set(reflect.ValueOf(""))
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			setValue(T, v.Index(i), s)
+		}
 	case reflect.Struct:
 		for i := 0; i < v.NumField(); i++ {
 			setValue(T, v.Field(i), s)
@@ -52,12 +57,25 @@ func TestPrometheus(t *testing.T) {
 	// Create a set of metrics objects (3) that we can use for metric
 	// generation. Each will have every single field populated with the
 	// number of its iteration.
-	m1 := Metrics{}
-	setValue(T, reflect.Indirect(reflect.ValueOf(&m1)), 1)
-	m2 := Metrics{}
-	setValue(T, reflect.Indirect(reflect.ValueOf(&m2)), 2)
-	m3 := Metrics{}
-	setValue(T, reflect.Indirect(reflect.ValueOf(&m3)), 3)
+	// The latency histograms need their buckets allocated before they
+	// can be populated, and their bounds need to be set back afterwards
+	// since setValue will have overwritten them too.
+	newMetrics := func(s int64) (m Metrics) {
+		bounds := []time.Duration{time.Millisecond * 10, time.Second}
+		m.PrimaryHeartBeatLatency = NewLatencyHistogram(bounds)
+		m.PrimaryInsertQueueLatency = NewLatencyHistogram(bounds)
+		m.PrimaryInsertReplicateLatency = NewLatencyHistogram(bounds)
+		m.PrimaryInsertWriteLatency = NewLatencyHistogram(bounds)
+		setValue(T, reflect.Indirect(reflect.ValueOf(&m)), s)
+		bounds[0] = time.Millisecond * 10
+		bounds[1] = time.Second
+		m.PrimaryStateAges = []StateAge{{"waiting", float64(s)}}
+		m.ReplicaStateAges = []StateAge{{"waiting", float64(s)}}
+		return
+	}
+	m1 := newMetrics(1)
+	m2 := newMetrics(2)
+	m3 := newMetrics(3)
 	metrics := map[string]Metrics{
 		"test1": m1,
 		"test2": m2,
@@ -94,6 +112,33 @@ bytes_inserted{namespace="test1"} 1
 bytes_inserted{namespace="test2"} 2
 bytes_inserted{namespace="test3"} 3
 
+# TYPE compress_level gauge
+# HELP compress_level The level that the next file will be compressed at.
+compress_level{namespace="test1"} 1
+compress_level{namespace="test2"} 2
+compress_level{namespace="test3"} 3
+
+# TYPE degraded_inserts counter
+# HELP degraded_inserts Inserts accepted after some replicas failed because the replica quorum was still met.
+degraded_inserts{namespace="test1"} 1
+degraded_inserts{namespace="test2"} 2
+degraded_inserts{namespace="test3"} 3
+
+# TYPE disk_bytes gauge
+# HELP disk_bytes Bytes written to the data files of primaries and replicas in the namespace, excluding preallocated space.
+disk_bytes{namespace="test1"} 1
+disk_bytes{namespace="test2"} 2
+disk_bytes{namespace="test3"} 3
+
+# TYPE file_bytes gauge
+# HELP file_bytes Bytes of data held by the primaries and replicas currently on this node.
+file_bytes{namespace="test1",type="primary"} 1
+file_bytes{namespace="test1",type="replica"} 1
+file_bytes{namespace="test2",type="primary"} 2
+file_bytes{namespace="test2",type="replica"} 2
+file_bytes{namespace="test3",type="primary"} 3
+file_bytes{namespace="test3",type="replica"} 3
+
 # TYPE file_deletion_failures counter
 # HELP file_deletion_failures Number of failed file deletes
 file_deletion_failures{namespace="test1"} 1
@@ -112,18 +157,63 @@ file_deletion_total{namespace="test1"} 1
 file_deletion_total{namespace="test2"} 2
 file_deletion_total{namespace="test3"} 3
 
+# TYPE file_state_age_seconds gauge
+# HELP file_state_age_seconds The amount of time the oldest file in each state has been in it.
+file_state_age_seconds{namespace="test1",state="waiting",type="primary"} 1.000000
+file_state_age_seconds{namespace="test1",state="waiting",type="replica"} 1.000000
+file_state_age_seconds{namespace="test2",state="waiting",type="primary"} 2.000000
+file_state_age_seconds{namespace="test2",state="waiting",type="replica"} 2.000000
+file_state_age_seconds{namespace="test3",state="waiting",type="primary"} 3.000000
+file_state_age_seconds{namespace="test3",state="waiting",type="replica"} 3.000000
+
+# TYPE files gauge
+# HELP files The number of primaries and replicas currently on this node.
+files{namespace="test1",type="primary"} 1
+files{namespace="test1",type="replica"} 1
+files{namespace="test2",type="primary"} 2
+files{namespace="test2",type="replica"} 2
+files{namespace="test3",type="primary"} 3
+files{namespace="test3",type="replica"} 3
+
+# TYPE insert_queue_timeouts counter
+# HELP insert_queue_timeouts Count of inserts rejected because they waited too long for a file to write to.
+insert_queue_timeouts{namespace="test1"} 1
+insert_queue_timeouts{namespace="test2"} 2
+insert_queue_timeouts{namespace="test3"} 3
+
+# TYPE inserts_canceled counter
+# HELP inserts_canceled Count of inserts dropped because the client went away while waiting for a file to write to.
+inserts_canceled{namespace="test1"} 1
+inserts_canceled{namespace="test2"} 2
+inserts_canceled{namespace="test3"} 3
+
 # TYPE internal_errors counter
 # HELP internal_errors The number of internally generated errors encountered.
 internal_errors{namespace="test1",type="insert"} 1
 internal_errors{namespace="test2",type="insert"} 2
 internal_errors{namespace="test3",type="insert"} 3
 
+# TYPE last_successful_upload_timestamp_seconds gauge
+# HELP last_successful_upload_timestamp_seconds Unix time of the last successful upload to S3.
+last_successful_upload_timestamp_seconds{namespace="test1"} 1
+last_successful_upload_timestamp_seconds{namespace="test2"} 2
+last_successful_upload_timestamp_seconds{namespace="test3"} 3
+
 # TYPE oldest_queued_upload_seconds gauge
 # HELP oldest_queued_upload_seconds The amount of time the oldest file has been queued for upload.
 oldest_queued_upload_seconds{namespace="test1"} 1.000000
 oldest_queued_upload_seconds{namespace="test2"} 2.000000
 oldest_queued_upload_seconds{namespace="test3"} 3.000000
 
+# TYPE pending_files gauge
+# HELP pending_files The number of files that have not finished being uploaded and removed.
+pending_files{namespace="test1",type="primary"} 1
+pending_files{namespace="test1",type="replica"} 1
+pending_files{namespace="test2",type="primary"} 2
+pending_files{namespace="test2",type="replica"} 2
+pending_files{namespace="test3",type="primary"} 3
+pending_files{namespace="test3",type="replica"} 3
+
 # TYPE primary_delete_failures counter
 # HELP primary_delete_failures Number of failed primary deletes
 primary_delete_failures{namespace="test1"} 1
@@ -142,6 +232,72 @@ primary_delete_total{namespace="test1"} 1
 primary_delete_total{namespace="test2"} 2
 primary_delete_total{namespace="test3"} 3
 
+# TYPE primary_heartbeat_duration_seconds histogram
+# HELP primary_heartbeat_duration_seconds The round trip time of heart beats sent from primaries to their replicas.
+primary_heartbeat_duration_seconds_bucket{namespace="test1",type="round_trip",le="+Inf"} 3
+primary_heartbeat_duration_seconds_bucket{namespace="test1",type="round_trip",le="0.01"} 1
+primary_heartbeat_duration_seconds_bucket{namespace="test1",type="round_trip",le="1"} 2
+primary_heartbeat_duration_seconds_bucket{namespace="test2",type="round_trip",le="+Inf"} 6
+primary_heartbeat_duration_seconds_bucket{namespace="test2",type="round_trip",le="0.01"} 2
+primary_heartbeat_duration_seconds_bucket{namespace="test2",type="round_trip",le="1"} 4
+primary_heartbeat_duration_seconds_bucket{namespace="test3",type="round_trip",le="+Inf"} 9
+primary_heartbeat_duration_seconds_bucket{namespace="test3",type="round_trip",le="0.01"} 3
+primary_heartbeat_duration_seconds_bucket{namespace="test3",type="round_trip",le="1"} 6
+primary_heartbeat_duration_seconds_count{namespace="test1",type="round_trip"} 1
+primary_heartbeat_duration_seconds_count{namespace="test2",type="round_trip"} 2
+primary_heartbeat_duration_seconds_count{namespace="test3",type="round_trip"} 3
+primary_heartbeat_duration_seconds_sum{namespace="test1",type="round_trip"} 0.000000
+primary_heartbeat_duration_seconds_sum{namespace="test2",type="round_trip"} 0.000000
+primary_heartbeat_duration_seconds_sum{namespace="test3",type="round_trip"} 0.000000
+
+# TYPE primary_insert_duration_seconds histogram
+# HELP primary_insert_duration_seconds The amount of time inserts spent queued, writing to disk, and replicating.
+primary_insert_duration_seconds_bucket{namespace="test1",type="queue",le="+Inf"} 3
+primary_insert_duration_seconds_bucket{namespace="test1",type="queue",le="0.01"} 1
+primary_insert_duration_seconds_bucket{namespace="test1",type="queue",le="1"} 2
+primary_insert_duration_seconds_bucket{namespace="test1",type="replicate",le="+Inf"} 3
+primary_insert_duration_seconds_bucket{namespace="test1",type="replicate",le="0.01"} 1
+primary_insert_duration_seconds_bucket{namespace="test1",type="replicate",le="1"} 2
+primary_insert_duration_seconds_bucket{namespace="test1",type="write",le="+Inf"} 3
+primary_insert_duration_seconds_bucket{namespace="test1",type="write",le="0.01"} 1
+primary_insert_duration_seconds_bucket{namespace="test1",type="write",le="1"} 2
+primary_insert_duration_seconds_bucket{namespace="test2",type="queue",le="+Inf"} 6
+primary_insert_duration_seconds_bucket{namespace="test2",type="queue",le="0.01"} 2
+primary_insert_duration_seconds_bucket{namespace="test2",type="queue",le="1"} 4
+primary_insert_duration_seconds_bucket{namespace="test2",type="replicate",le="+Inf"} 6
+primary_insert_duration_seconds_bucket{namespace="test2",type="replicate",le="0.01"} 2
+primary_insert_duration_seconds_bucket{namespace="test2",type="replicate",le="1"} 4
+primary_insert_duration_seconds_bucket{namespace="test2",type="write",le="+Inf"} 6
+primary_insert_duration_seconds_bucket{namespace="test2",type="write",le="0.01"} 2
+primary_insert_duration_seconds_bucket{namespace="test2",type="write",le="1"} 4
+primary_insert_duration_seconds_bucket{namespace="test3",type="queue",le="+Inf"} 9
+primary_insert_duration_seconds_bucket{namespace="test3",type="queue",le="0.01"} 3
+primary_insert_duration_seconds_bucket{namespace="test3",type="queue",le="1"} 6
+primary_insert_duration_seconds_bucket{namespace="test3",type="replicate",le="+Inf"} 9
+primary_insert_duration_seconds_bucket{namespace="test3",type="replicate",le="0.01"} 3
+primary_insert_duration_seconds_bucket{namespace="test3",type="replicate",le="1"} 6
+primary_insert_duration_seconds_bucket{namespace="test3",type="write",le="+Inf"} 9
+primary_insert_duration_seconds_bucket{namespace="test3",type="write",le="0.01"} 3
+primary_insert_duration_seconds_bucket{namespace="test3",type="write",le="1"} 6
+primary_insert_duration_seconds_count{namespace="test1",type="queue"} 1
+primary_insert_duration_seconds_count{namespace="test1",type="replicate"} 1
+primary_insert_duration_seconds_count{namespace="test1",type="write"} 1
+primary_insert_duration_seconds_count{namespace="test2",type="queue"} 2
+primary_insert_duration_seconds_count{namespace="test2",type="replicate"} 2
+primary_insert_duration_seconds_count{namespace="test2",type="write"} 2
+primary_insert_duration_seconds_count{namespace="test3",type="queue"} 3
+primary_insert_duration_seconds_count{namespace="test3",type="replicate"} 3
+primary_insert_duration_seconds_count{namespace="test3",type="write"} 3
+primary_insert_duration_seconds_sum{namespace="test1",type="queue"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test1",type="replicate"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test1",type="write"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test2",type="queue"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test2",type="replicate"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test2",type="write"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test3",type="queue"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test3",type="replicate"} 0.000000
+primary_insert_duration_seconds_sum{namespace="test3",type="write"} 0.000000
+
 # TYPE primary_insert_failures counter
 # HELP primary_insert_failures Number of failed primary inserts
 primary_insert_failures{namespace="test1"} 1
@@ -184,6 +340,30 @@ primary_open_total{namespace="test1"} 1
 primary_open_total{namespace="test2"} 2
 primary_open_total{namespace="test3"} 3
 
+# TYPE primary_pool_appendable gauge
+# HELP primary_pool_appendable Number of primaries currently open for appending.
+primary_pool_appendable{namespace="test1"} 1
+primary_pool_appendable{namespace="test2"} 2
+primary_pool_appendable{namespace="test3"} 3
+
+# TYPE primary_pool_exhausted counter
+# HELP primary_pool_exhausted Number of times a caller waited for a primary while the pool was at its maximum size.
+primary_pool_exhausted{namespace="test1"} 1
+primary_pool_exhausted{namespace="test2"} 2
+primary_pool_exhausted{namespace="test3"} 3
+
+# TYPE primary_pool_maximum gauge
+# HELP primary_pool_maximum The maximum number of primaries that can be open for appending.
+primary_pool_maximum{namespace="test1"} 1
+primary_pool_maximum{namespace="test2"} 2
+primary_pool_maximum{namespace="test3"} 3
+
+# TYPE primary_replica_lag_bytes gauge
+# HELP primary_replica_lag_bytes The largest number of bytes a replica of an active primary has been behind.
+primary_replica_lag_bytes{namespace="test1"} 1
+primary_replica_lag_bytes{namespace="test2"} 2
+primary_replica_lag_bytes{namespace="test3"} 3
+
 # TYPE primary_upload_failures counter
 # HELP primary_upload_failures Number of failed primary uploads
 primary_upload_failures{namespace="test1"} 1
@@ -208,6 +388,27 @@ queued_inserts{namespace="test1"} 1
 queued_inserts{namespace="test2"} 2
 queued_inserts{namespace="test3"} 3
 
+# TYPE read_remote_errors counter
+# HELP read_remote_errors Number of reads where a remote Blobby server returned an error and the read fell back to S3.
+read_remote_errors{namespace="test1"} 1
+read_remote_errors{namespace="test2"} 2
+read_remote_errors{namespace="test3"} 3
+
+# TYPE reads_total counter
+# HELP reads_total Number of reads served from each source.
+reads_total{namespace="test1",read_source="cache"} 1
+reads_total{namespace="test1",read_source="local"} 1
+reads_total{namespace="test1",read_source="remote"} 1
+reads_total{namespace="test1",read_source="s3"} 1
+reads_total{namespace="test2",read_source="cache"} 2
+reads_total{namespace="test2",read_source="local"} 2
+reads_total{namespace="test2",read_source="remote"} 2
+reads_total{namespace="test2",read_source="s3"} 2
+reads_total{namespace="test3",read_source="cache"} 3
+reads_total{namespace="test3",read_source="local"} 3
+reads_total{namespace="test3",read_source="remote"} 3
+reads_total{namespace="test3",read_source="s3"} 3
+
 # TYPE replica_delete_failures counter
 # HELP replica_delete_failures Number of failed replica deletes
 replica_delete_failures{namespace="test1"} 1
@@ -262,6 +463,12 @@ replica_initialize_total{namespace="test1"} 1
 replica_initialize_total{namespace="test2"} 2
 replica_initialize_total{namespace="test3"} 3
 
+# TYPE replica_lag_bytes gauge
+# HELP replica_lag_bytes The largest number of bytes a replica on this node is behind its primary.
+replica_lag_bytes{namespace="test1"} 1
+replica_lag_bytes{namespace="test2"} 2
+replica_lag_bytes{namespace="test3"} 3
+
 # TYPE replica_queuedelete_failures counter
 # HELP replica_queuedelete_failures Number of failed replica queue deletes
 replica_queuedelete_failures{namespace="test1"} 1
@@ -322,17 +529,176 @@ replicas_orphaned{namespace="test1"} 1
 replicas_orphaned{namespace="test2"} 2
 replicas_orphaned{namespace="test3"} 3
 
+# TYPE retained_bytes gauge
+# HELP retained_bytes Bytes of uploaded data that is being kept on the local disk to serve reads.
+retained_bytes{namespace="test1"} 1
+retained_bytes{namespace="test2"} 2
+retained_bytes{namespace="test3"} 3
+
+# TYPE s3_upload_canary_failures counter
+# HELP s3_upload_canary_failures Count of uploads where the data read back from S3 did not match the local file.
+s3_upload_canary_failures{namespace="test1"} 1
+s3_upload_canary_failures{namespace="test2"} 2
+s3_upload_canary_failures{namespace="test3"} 3
+
+# TYPE s3_upload_duration_seconds histogram
+# HELP s3_upload_duration_seconds The amount of time spent uploading files to S3.
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="+Inf"} 11
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="0.1"} 1
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="0.25"} 2
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="0.5"} 3
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="1"} 4
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="10"} 7
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="2"} 5
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="30"} 8
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="300"} 10
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="5"} 6
+s3_upload_duration_seconds_bucket{namespace="test1",type="primary",le="60"} 9
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="+Inf"} 11
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="0.1"} 1
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="0.25"} 2
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="0.5"} 3
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="1"} 4
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="10"} 7
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="2"} 5
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="30"} 8
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="300"} 10
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="5"} 6
+s3_upload_duration_seconds_bucket{namespace="test1",type="replica",le="60"} 9
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="+Inf"} 22
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="0.1"} 2
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="0.25"} 4
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="0.5"} 6
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="1"} 8
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="10"} 14
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="2"} 10
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="30"} 16
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="300"} 20
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="5"} 12
+s3_upload_duration_seconds_bucket{namespace="test2",type="primary",le="60"} 18
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="+Inf"} 22
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="0.1"} 2
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="0.25"} 4
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="0.5"} 6
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="1"} 8
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="10"} 14
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="2"} 10
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="30"} 16
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="300"} 20
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="5"} 12
+s3_upload_duration_seconds_bucket{namespace="test2",type="replica",le="60"} 18
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="+Inf"} 33
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="0.1"} 3
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="0.25"} 6
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="0.5"} 9
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="1"} 12
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="10"} 21
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="2"} 15
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="30"} 24
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="300"} 30
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="5"} 18
+s3_upload_duration_seconds_bucket{namespace="test3",type="primary",le="60"} 27
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="+Inf"} 33
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="0.1"} 3
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="0.25"} 6
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="0.5"} 9
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="1"} 12
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="10"} 21
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="2"} 15
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="30"} 24
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="300"} 30
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="5"} 18
+s3_upload_duration_seconds_bucket{namespace="test3",type="replica",le="60"} 27
+s3_upload_duration_seconds_count{namespace="test1",type="primary"} 1
+s3_upload_duration_seconds_count{namespace="test1",type="replica"} 1
+s3_upload_duration_seconds_count{namespace="test2",type="primary"} 2
+s3_upload_duration_seconds_count{namespace="test2",type="replica"} 2
+s3_upload_duration_seconds_count{namespace="test3",type="primary"} 3
+s3_upload_duration_seconds_count{namespace="test3",type="replica"} 3
+s3_upload_duration_seconds_sum{namespace="test1",type="primary"} 0.000000
+s3_upload_duration_seconds_sum{namespace="test1",type="replica"} 0.000000
+s3_upload_duration_seconds_sum{namespace="test2",type="primary"} 0.000000
+s3_upload_duration_seconds_sum{namespace="test2",type="replica"} 0.000000
+s3_upload_duration_seconds_sum{namespace="test3",type="primary"} 0.000000
+s3_upload_duration_seconds_sum{namespace="test3",type="replica"} 0.000000
+
+# TYPE s3_upload_hash_mismatches counter
+# HELP s3_upload_hash_mismatches Count of uploaded objects whose size or hash did not match the local file.
+s3_upload_hash_mismatches{namespace="test1"} 1
+s3_upload_hash_mismatches{namespace="test2"} 2
+s3_upload_hash_mismatches{namespace="test3"} 3
+
+# TYPE s3_upload_part_retries counter
+# HELP s3_upload_part_retries Count of multipart upload parts that had to be retried.
+s3_upload_part_retries{namespace="test1"} 1
+s3_upload_part_retries{namespace="test2"} 2
+s3_upload_part_retries{namespace="test3"} 3
+
+# TYPE s3_upload_retries counter
+# HELP s3_upload_retries Count of uploads to S3 that were attempted again after failing.
+s3_upload_retries{namespace="test1"} 1
+s3_upload_retries{namespace="test2"} 2
+s3_upload_retries{namespace="test3"} 3
+
+# TYPE s3_uploads_in_flight gauge
+# HELP s3_uploads_in_flight Uploads to S3 that are currently in progress.
+s3_uploads_in_flight{namespace="test1"} 1
+s3_uploads_in_flight{namespace="test2"} 2
+s3_uploads_in_flight{namespace="test3"} 3
+
+# TYPE s3_uploads_waiting gauge
+# HELP s3_uploads_waiting Uploads to S3 that are waiting for a slot under max_concurrent_uploads.
+s3_uploads_waiting{namespace="test1"} 1
+s3_uploads_waiting{namespace="test2"} 2
+s3_uploads_waiting{namespace="test3"} 3
+
+# TYPE scrub_bytes counter
+# HELP scrub_bytes Bytes read back from local files and checked against their hashes.
+scrub_bytes{namespace="test1"} 1
+scrub_bytes{namespace="test2"} 2
+scrub_bytes{namespace="test3"} 3
+
+# TYPE scrub_corruptions counter
+# HELP scrub_corruptions Records in local files that did not match their hash when scrubbed.
+scrub_corruptions{namespace="test1"} 1
+scrub_corruptions{namespace="test2"} 2
+scrub_corruptions{namespace="test3"} 3
+
 # TYPE timing_data_nanoseconds counter
 # HELP timing_data_nanoseconds The amount of time various operations have taken in aggregate since server startup.
 timing_data_nanoseconds{namespace="test1",type="primary_insert_queue"} 1
 timing_data_nanoseconds{namespace="test1",type="primary_insert_replicate"} 1
 timing_data_nanoseconds{namespace="test1",type="primary_insert_write"} 1
+timing_data_nanoseconds{namespace="test1",type="primary_upload"} 1
+timing_data_nanoseconds{namespace="test1",type="replica_upload"} 1
 timing_data_nanoseconds{namespace="test2",type="primary_insert_queue"} 2
 timing_data_nanoseconds{namespace="test2",type="primary_insert_replicate"} 2
 timing_data_nanoseconds{namespace="test2",type="primary_insert_write"} 2
+timing_data_nanoseconds{namespace="test2",type="primary_upload"} 2
+timing_data_nanoseconds{namespace="test2",type="replica_upload"} 2
 timing_data_nanoseconds{namespace="test3",type="primary_insert_queue"} 3
 timing_data_nanoseconds{namespace="test3",type="primary_insert_replicate"} 3
 timing_data_nanoseconds{namespace="test3",type="primary_insert_write"} 3
+timing_data_nanoseconds{namespace="test3",type="primary_upload"} 3
+timing_data_nanoseconds{namespace="test3",type="replica_upload"} 3
+
+# TYPE unspread_inserts counter
+# HELP unspread_inserts Inserts into files whose replicas share a failure domain.
+unspread_inserts{namespace="test1"} 1
+unspread_inserts{namespace="test2"} 2
+unspread_inserts{namespace="test3"} 3
+
+# TYPE upload_notifications_delivered counter
+# HELP upload_notifications_delivered Count of upload notifications that were delivered.
+upload_notifications_delivered{namespace="test1"} 1
+upload_notifications_delivered{namespace="test2"} 2
+upload_notifications_delivered{namespace="test3"} 3
+
+# TYPE upload_notifications_failed counter
+# HELP upload_notifications_failed Count of upload notifications that were dropped after failing or because the queue was full.
+upload_notifications_failed{namespace="test1"} 1
+upload_notifications_failed{namespace="test2"} 2
+upload_notifications_failed{namespace="test3"} 3
 `
 
 	// We run this test with both an empty prefix (default) and with a
@@ -344,6 +710,8 @@ timing_data_nanoseconds{namespace="test3",type="primary_insert_write"} 3
 	buffer.Truncate(0)
 	want = strings.ReplaceAll(want, "namespace=", "prefix_namespace=")
 	want = strings.ReplaceAll(want, "type=", "prefix_type=")
+	want = strings.ReplaceAll(want, "read_source=", "prefix_read_source=")
+	want = strings.ReplaceAll(want, ",state=", ",prefix_state=")
 	RenderPrometheus(buffer, "prefix_", metrics)
 	T.Equal(strings.Split(have(), "\n"), strings.Split(want, "\n"))
 }
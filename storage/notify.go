@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liquidgecka/blobby/internal/backoff"
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+const (
+	// The number of upload notifications that can be waiting to be
+	// delivered. Notifications made while the queue is full are dropped
+	// and counted as failed.
+	uploadNotifyQueueSize = 100
+
+	// The number of times that delivering a notification is attempted
+	// before it is given up on, and the delay between the attempts.
+	uploadNotifyAttempts   = 3
+	uploadNotifyRetryDelay = time.Second
+	uploadNotifyMaxDelay   = time.Second * 10
+)
+
+// Describes a file that was successfully uploaded. This is passed to
+// Settings.OnUpload.
+type UploadEvent struct {
+	// The name space that the file belongs to.
+	NameSpace string `json:"namespace"`
+
+	// The FID of the file and whether it was uploaded by the "primary" or a
+	// "replica".
+	FID  string `json:"fid"`
+	Type string `json:"type"`
+
+	// The bucket and key that the file was uploaded to.
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+
+	// The number of bytes in the uploaded object, which is the compressed
+	// size if compression is enabled.
+	Size int64 `json:"size"`
+
+	// The number of inserts in the file. This only counts inserts made
+	// since the process started so files recovered from a previous run
+	// report zero.
+	Records int `json:"records"`
+
+	// The unix time that the upload completed.
+	Time int64 `json:"time"`
+}
+
+// Returns a function suitable for Settings.OnUpload that POSTs each event
+// as JSON to the given URL using client. Any response other than a 2xx is
+// treated as a failure.
+func UploadWebhook(
+	url string,
+	client *http.Client,
+) func(context.Context, UploadEvent) error {
+	return func(ctx context.Context, event UploadEvent) error {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodPost,
+			url,
+			bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf(
+				"Upload webhook returned status %d.",
+				resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Delivers upload notifications to Settings.OnUpload from a background
+// goroutine so that a slow or failing receiver never holds up an upload.
+type uploadNotifier struct {
+	queue chan UploadEvent
+	start sync.Once
+}
+
+// Queues a notification that the file in fd was uploaded to key, if
+// Settings.OnUpload is set. This never blocks, if the queue is full the
+// notification is dropped.
+func (s *Storage) notifyUpload(
+	ctx context.Context,
+	fd *os.File,
+	fidStr string,
+	typ string,
+	key string,
+	records int,
+	l *slog.Logger,
+) {
+	if s.settings.OnUpload == nil {
+		return
+	}
+	event := UploadEvent{
+		NameSpace: s.settings.NameSpace,
+		FID:       fidStr,
+		Type:      typ,
+		Bucket:    s.settings.S3Bucket,
+		Key:       key,
+		Records:   records,
+		Time:      time.Now().Unix(),
+	}
+	if stat, err := fd.Stat(); err == nil {
+		event.Size = stat.Size()
+	}
+	s.notifier.start.Do(func() {
+		s.notifier.queue = make(chan UploadEvent, uploadNotifyQueueSize)
+		go s.uploadNotifier()
+	})
+	select {
+	case s.notifier.queue <- event:
+	default:
+		atomic.AddInt64(&s.metrics.UploadNotificationsFailed, 1)
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"The upload notification queue is full, dropping the notification.",
+			sloghelper.String("key", key))
+	}
+}
+
+// Runs in a goroutine delivering queued notifications one at a time.
+func (s *Storage) uploadNotifier() {
+	ctx := context.Background()
+	b := backoff.Exponential{
+		Base: uploadNotifyRetryDelay,
+		Max:  uploadNotifyMaxDelay,
+	}
+	for event := range s.notifier.queue {
+		for attempt := 1; ; attempt++ {
+			err := s.settings.OnUpload(ctx, event)
+			if err == nil {
+				atomic.AddInt64(&s.metrics.UploadNotificationsDelivered, 1)
+				break
+			}
+			s.settings.BaseLogger.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Error delivering an upload notification.",
+				sloghelper.String("fid", event.FID),
+				sloghelper.String("key", event.Key),
+				sloghelper.Int("attempt", attempt),
+				sloghelper.Error("error", err))
+			if attempt >= uploadNotifyAttempts {
+				atomic.AddInt64(&s.metrics.UploadNotificationsFailed, 1)
+				break
+			}
+			time.Sleep(b.Delay(attempt))
+		}
+	}
+}
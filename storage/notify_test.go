@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestStorage_NotifyUpload(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := fd.WriteString("0123456789")
+	T.ExpectSuccess(err)
+
+	// The first delivery fails and is retried.
+	events := make(chan UploadEvent, 2)
+	calls := 0
+	s := &Storage{
+		settings: Settings{
+			BaseLogger: NewTestLogger(),
+			NameSpace:  "test",
+			OnUpload: func(ctx context.Context, event UploadEvent) error {
+				calls++
+				events <- event
+				if calls == 1 {
+					return errors.New("expected")
+				}
+				return nil
+			},
+			S3Bucket: "bucket",
+		},
+	}
+	s.notifyUpload(
+		context.Background(),
+		fd,
+		"fid",
+		"primary",
+		"path/fid",
+		3,
+		s.settings.BaseLogger)
+	first := <-events
+	T.Equal(first.NameSpace, "test")
+	T.Equal(first.FID, "fid")
+	T.Equal(first.Type, "primary")
+	T.Equal(first.Bucket, "bucket")
+	T.Equal(first.Key, "path/fid")
+	T.Equal(first.Size, int64(10))
+	T.Equal(first.Records, 3)
+	T.Equal(<-events, first)
+	T.TryUntil(func() bool {
+		return s.GetMetrics().UploadNotificationsDelivered == 1
+	}, time.Second*5)
+	T.Equal(s.GetMetrics().UploadNotificationsFailed, int64(0))
+}
+
+func TestStorage_NotifyUpload_QueueFull(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Delivery blocks until released so the queue fills up.
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := &Storage{
+		settings: Settings{
+			BaseLogger: NewTestLogger(),
+			OnUpload: func(ctx context.Context, event UploadEvent) error {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-release
+				return nil
+			},
+		},
+	}
+	fd := T.TempFile()
+	notify := func() {
+		s.notifyUpload(
+			context.Background(),
+			fd,
+			"fid",
+			"replica",
+			"fid",
+			0,
+			s.settings.BaseLogger)
+	}
+	notify()
+	<-started
+	for i := 0; i < uploadNotifyQueueSize; i++ {
+		notify()
+	}
+	T.Equal(s.GetMetrics().UploadNotificationsFailed, int64(0))
+
+	// The next notification is dropped rather than blocking.
+	notify()
+	T.Equal(s.GetMetrics().UploadNotificationsFailed, int64(1))
+	close(release)
+	T.TryUntil(func() bool {
+		return s.GetMetrics().UploadNotificationsDelivered ==
+			uploadNotifyQueueSize+1
+	}, time.Second*5)
+}
+
+func TestUploadWebhook(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	status := http.StatusOK
+	var have UploadEvent
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			T.Equal(r.Method, http.MethodPost)
+			T.Equal(r.Header.Get("Content-Type"), "application/json")
+			T.ExpectSuccess(json.NewDecoder(r.Body).Decode(&have))
+			w.WriteHeader(status)
+		}))
+	defer server.Close()
+
+	want := UploadEvent{
+		NameSpace: "test",
+		FID:       "fid",
+		Type:      "replica",
+		Bucket:    "bucket",
+		Key:       "key",
+		Size:      100,
+		Records:   2,
+		Time:      1234,
+	}
+	hook := UploadWebhook(server.URL, server.Client())
+	T.ExpectSuccess(hook(context.Background(), want))
+	T.Equal(have, want)
+
+	// Non 2xx responses are failures.
+	status = http.StatusInternalServerError
+	T.ExpectErrorMessage(
+		hook(context.Background(), want),
+		"Upload webhook returned status 500.")
+}
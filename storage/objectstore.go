@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// Details about an object stored in an ObjectStore.
+type ObjectInfo struct {
+	// The entity tag of the object. This can be passed to GetRange in order
+	// to ensure that the object has not changed since Head was called.
+	ETag string
+
+	// The user supplied metadata that was stored with the object.
+	Metadata map[string]string
+
+	// The size of the object in bytes.
+	Size int64
+}
+
+// An interface that the Storage object uses to read and write objects in
+// the durable object store that files are uploaded to. This allows
+// namespaces to be backed by services other than S3 without the upload and
+// read logic needing to know which one is in use.
+//
+// Implementations should return ErrNotFound if an object does not exist and
+// ErrBucketNotFound if the bucket that objects are stored in does not exist.
+type ObjectStore interface {
+	// Writes size bytes read from body to the given key. The contentType
+	// and metadata are stored with the object. This must only return nil
+	// if the data was stored intact.
+	Put(
+		ctx context.Context,
+		key string,
+		body io.ReadSeeker,
+		size int64,
+		contentType string,
+		metadata map[string]string,
+	) error
+
+	// Returns length bytes of the object at key starting at offset. If
+	// length is negative then everything from offset to the end of the
+	// object is returned. If etag is not empty then the read fails unless
+	// the object still has that ETag.
+	GetRange(
+		ctx context.Context,
+		key string,
+		offset int64,
+		length int64,
+		etag string,
+	) (io.ReadCloser, error)
+
+	// Returns the details of the object at key without fetching it.
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// Removes the object at key. Deleting an object that does not exist is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Returns the ObjectStore that should be used with these settings. If
+// ObjectStore was not set then S3 is used via S3Client.
+func (s *Settings) objectStore() ObjectStore {
+	store := s.ObjectStore
+	if store == nil {
+		log := s.BaseLogger
+		if log == nil {
+			log = slog.Default()
+		}
+		store = &s3ObjectStore{settings: s, log: log}
+	}
+	if s.S3OperationTimeout > 0 {
+		store = &timeoutObjectStore{
+			ObjectStore: store,
+			timeout:     s.S3OperationTimeout,
+			partSize:    s.S3PartSize,
+		}
+	}
+	return store
+}
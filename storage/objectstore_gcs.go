@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// An ObjectStore that keeps objects in a Google Cloud Storage bucket.
+//
+// This is currently a stub that allows namespaces to be configured with the
+// GCS backend ahead of the client being added. Every call fails, so uploads
+// will be retried until a real implementation is in place.
+type GCSObjectStore struct {
+	// The name of the bucket that objects are stored in.
+	Bucket string
+}
+
+// Returns the error that is returned by every call to this store.
+func (g *GCSObjectStore) notImplemented() error {
+	return fmt.Errorf(
+		"The GCS object store for bucket %s is not implemented.",
+		g.Bucket)
+}
+
+func (g *GCSObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	return g.notImplemented()
+}
+
+func (g *GCSObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (
+	io.ReadCloser,
+	error,
+) {
+	return nil, g.notImplemented()
+}
+
+func (g *GCSObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (
+	*ObjectInfo,
+	error,
+) {
+	return nil, g.notImplemented()
+}
+
+func (g *GCSObjectStore) Delete(ctx context.Context, key string) error {
+	return g.notImplemented()
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestGCSObjectStore(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Every call fails until the store is implemented.
+	store := ObjectStore(&GCSObjectStore{Bucket: "bucket"})
+	err := store.Put(
+		context.Background(),
+		"key",
+		bytes.NewReader(nil),
+		0,
+		"application/octet-stream",
+		nil)
+	T.ExpectErrorMessage(err, "The GCS object store for bucket bucket is not implemented.")
+	_, err = store.GetRange(context.Background(), "key", 0, -1, "")
+	T.ExpectErrorMessage(err, "The GCS object store for bucket bucket is not implemented.")
+	_, err = store.Head(context.Background(), "key")
+	T.ExpectErrorMessage(err, "The GCS object store for bucket bucket is not implemented.")
+	err = store.Delete(context.Background(), "key")
+	T.ExpectErrorMessage(err, "The GCS object store for bucket bucket is not implemented.")
+}
@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// An ObjectStore that keeps objects in AWS S3 using Settings.S3Client. The
+// bucket, part size, storage class and encryption are all taken from the
+// Settings. Note that this does NOT use the upload manager provided by AWS
+// because it was found to cause data loss on uploads in rare cases.
+type s3ObjectStore struct {
+	settings *Settings
+	log      *slog.Logger
+
+	// Each part of a multipart upload that has to be retried is counted
+	// here. This may be nil.
+	partRetries *int64
+}
+
+// Uploads the object using a single PutObject call, or a multipart upload
+// if it is larger than Settings.S3PartSize. The MD5 of the data is sent so
+// that S3 rejects corrupted uploads, and the returned ETag is checked
+// against it where S3 provides one.
+func (o *s3ObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	s := o.settings
+
+	// Files that are larger than a single part are uploaded as a multipart
+	// upload so that a failure only requires the failed part to be sent
+	// again, and so that files larger than the PutObject limit can be
+	// uploaded at all.
+	if ra, ok := body.(io.ReaderAt); ok &&
+		s.S3PartSize > 0 &&
+		size > s.S3PartSize {
+		return o.putMultipart(ctx, ra, key, contentType, metadata, size)
+	}
+
+	// Get the MD5 of the content which lets S3 validate the upload so that
+	// it is only accepted if the data is correct.
+	m := md5.New()
+	buffer := [1024]byte{}
+	if n, err := io.CopyBuffer(m, body, buffer[:]); err != nil {
+		return err
+	} else if n != size {
+		return fmt.Errorf(
+			"Short copy when calculating MD5 hash, expected %d bytes, "+
+				"copied %d.",
+			size,
+			n)
+	}
+	hash := m.Sum(nil)
+	base64Hash := base64.StdEncoding.EncodeToString(hash)
+	hexHash := hex.EncodeToString(hash)
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	poi := s3.PutObjectInput{
+		Body:          s.uploadLimiter.ReadSeeker(ctx, body),
+		Bucket:        &s.S3Bucket,
+		ContentLength: &size,
+		ContentMD5:    &base64Hash,
+		ContentType:   &contentType,
+		Key:           &key,
+	}
+	if metadata != nil {
+		poi.Metadata = aws.StringMap(metadata)
+	}
+	poi.StorageClass, poi.ServerSideEncryption, poi.SSEKMSKeyId =
+		s3ObjectOptions(s)
+	poo, err := s.S3Client.PutObjectWithContext(ctx, &poi)
+	if err != nil {
+		return err
+	} else if etagIsMD5(s) && strings.Trim(*poo.ETag, `"`) != hexHash {
+		return fmt.Errorf(
+			"Uploaded data has a different MD5 hash, expected %s, got %s.",
+			base64Hash,
+			*poo.ETag)
+	}
+	return nil
+}
+
+// Fetches the requested range of the object with s3:GetObject. Since the
+// returned data is served directly to clients the Content-Length is
+// checked so that a short or long response is never accepted.
+func (o *s3ObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (
+	io.ReadCloser,
+	error,
+) {
+	s := o.settings
+	goi := s3.GetObjectInput{
+		Bucket: &s.S3Bucket,
+		Key:    &key,
+	}
+	if length >= 0 {
+		rng := fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+		goi.Range = &rng
+	} else if offset > 0 {
+		rng := fmt.Sprintf("bytes=%d-", offset)
+		goi.Range = &rng
+	}
+	if etag != "" {
+		goi.IfMatch = &etag
+	}
+	goo, err := s.S3Client.GetObjectWithContext(ctx, &goi)
+	if err != nil {
+		return nil, o.translateError(key, err)
+	} else if length < 0 {
+		return goo.Body, nil
+	} else if goo.ContentLength == nil {
+		// There was no length returned which means we can not be sure
+		// that this is the right data.
+		goo.Body.Close()
+		return nil, fmt.Errorf("Missing content-length")
+	} else if *goo.ContentLength != length {
+		goo.Body.Close()
+		return nil, fmt.Errorf(
+			"Invalid content-length, expected %d, got %d.",
+			length,
+			*goo.ContentLength)
+	}
+	return goo.Body, nil
+}
+
+// Fetches the details of the object with s3:HeadObject.
+func (o *s3ObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (
+	*ObjectInfo,
+	error,
+) {
+	hoo, err := o.settings.S3Client.HeadObjectWithContext(
+		ctx,
+		&s3.HeadObjectInput{
+			Bucket: &o.settings.S3Bucket,
+			Key:    &key,
+		})
+	if err != nil {
+		return nil, o.translateError(key, err)
+	}
+	info := ObjectInfo{
+		Metadata: aws.StringValueMap(hoo.Metadata),
+	}
+	if hoo.ETag != nil {
+		info.ETag = *hoo.ETag
+	}
+	if hoo.ContentLength != nil {
+		info.Size = *hoo.ContentLength
+	}
+	return &info, nil
+}
+
+// Removes the object with s3:DeleteObject.
+func (o *s3ObjectStore) Delete(ctx context.Context, key string) error {
+	_, err := o.settings.S3Client.DeleteObjectWithContext(
+		ctx,
+		&s3.DeleteObjectInput{
+			Bucket: &o.settings.S3Bucket,
+			Key:    &key,
+		})
+	if err != nil {
+		return o.translateError(key, err)
+	}
+	return nil
+}
+
+// Converts the errors S3 returns for missing buckets and keys into the
+// errors expected from an ObjectStore. Responses to HEAD requests have no
+// body so S3 reports a missing key with only the NotFound code.
+func (o *s3ObjectStore) translateError(key string, err error) error {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchBucket:
+			return ErrBucketNotFound(o.settings.S3Bucket)
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrNotFound(key)
+		}
+	}
+	return err
+}
+
+// Uploads size bytes from body to key using the S3 multipart API. Every
+// part is sent with its own MD5 so that S3 rejects corrupted parts, and the
+// ETag of the completed object is checked against the MD5s of the local
+// data. A part that fails is retried on its own, up to s3PartAttempts
+// times. If the upload can not be completed then it is aborted so that the
+// uploaded parts do not linger in the bucket.
+func (o *s3ObjectStore) putMultipart(
+	ctx context.Context,
+	body io.ReaderAt,
+	key string,
+	contentType string,
+	metadata map[string]string,
+	size int64,
+) error {
+	s := o.settings
+
+	// S3 limits the number of parts in an upload so the part size is
+	// increased for files that would otherwise need too many.
+	partSize := s.S3PartSize
+	if min := (size + s3MaxParts - 1) / s3MaxParts; partSize < min {
+		partSize = min
+	}
+	parts := int((size + partSize - 1) / partSize)
+
+	cmui := s3.CreateMultipartUploadInput{
+		Bucket:      &s.S3Bucket,
+		ContentType: &contentType,
+		Key:         &key,
+	}
+	if metadata != nil {
+		cmui.Metadata = aws.StringMap(metadata)
+	}
+	cmui.StorageClass, cmui.ServerSideEncryption, cmui.SSEKMSKeyId =
+		s3ObjectOptions(s)
+	cmuo, err := s.S3Client.CreateMultipartUploadWithContext(ctx, &cmui)
+	if err != nil {
+		return err
+	}
+
+	// Parts are uploaded by S3Concurrency workers. The MD5 of each part is
+	// kept since the ETag of the final object is derived from all of them.
+	completed := make([]*s3.CompletedPart, parts)
+	sums := make([][]byte, parts)
+	errs := make([]error, parts)
+	work := make(chan int, parts)
+	for i := 0; i < parts; i++ {
+		work <- i
+	}
+	close(work)
+	concurrency := s.S3Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	failed := int32(0)
+	wg := sync.WaitGroup{}
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if atomic.LoadInt32(&failed) != 0 {
+					return
+				}
+				offset := int64(i) * partSize
+				length := partSize
+				if length > size-offset {
+					length = size - offset
+				}
+				completed[i], sums[i], errs[i] = o.putPart(
+					ctx,
+					io.NewSectionReader(body, offset, length),
+					key,
+					cmuo.UploadId,
+					int64(i+1))
+				if errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if failed != 0 {
+		o.abortMultipart(ctx, key, cmuo.UploadId)
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cmuo2, err := s.S3Client.CompleteMultipartUploadWithContext(
+		ctx,
+		&s3.CompleteMultipartUploadInput{
+			Bucket:          &s.S3Bucket,
+			Key:             &key,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+			UploadId:        cmuo.UploadId,
+		})
+	if err != nil {
+		o.abortMultipart(ctx, key, cmuo.UploadId)
+		return err
+	}
+
+	// The ETag of a multipart object is the MD5 of the concatenated part
+	// MD5s followed by the number of parts.
+	m := md5.New()
+	for _, sum := range sums {
+		m.Write(sum)
+	}
+	expected := fmt.Sprintf("%s-%d", hex.EncodeToString(m.Sum(nil)), parts)
+	if etag := strings.Trim(*cmuo2.ETag, `"`); etagIsMD5(s) && etag != expected {
+		return fmt.Errorf(
+			"Uploaded data has a different ETag, expected %s, got %s.",
+			expected,
+			etag)
+	}
+	return nil
+}
+
+// Uploads a single part of a multipart upload, retrying it if it fails.
+// On success this returns the completed part along with the MD5 of the
+// data in it.
+func (o *s3ObjectStore) putPart(
+	ctx context.Context,
+	section *io.SectionReader,
+	key string,
+	uploadID *string,
+	number int64,
+) (*s3.CompletedPart, []byte, error) {
+	s := o.settings
+	m := md5.New()
+	buffer := [1024 * 32]byte{}
+	if _, err := io.CopyBuffer(m, section, buffer[:]); err != nil {
+		return nil, nil, err
+	}
+	sum := m.Sum(nil)
+	base64Hash := base64.StdEncoding.EncodeToString(sum)
+	hexHash := hex.EncodeToString(sum)
+	length := section.Size()
+	for attempt := 1; ; attempt++ {
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		upo, err := s.S3Client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Body:          s.uploadLimiter.ReadSeeker(ctx, section),
+			Bucket:        &s.S3Bucket,
+			ContentLength: &length,
+			ContentMD5:    &base64Hash,
+			Key:           &key,
+			PartNumber:    &number,
+			UploadId:      uploadID,
+		})
+		if err == nil && etagIsMD5(s) && strings.Trim(*upo.ETag, `"`) != hexHash {
+			err = fmt.Errorf(
+				"Uploaded part %d has a different MD5 hash, expected %s, "+
+					"got %s.",
+				number,
+				hexHash,
+				*upo.ETag)
+		}
+		if err == nil {
+			return &s3.CompletedPart{
+				ETag:       upo.ETag,
+				PartNumber: &number,
+			}, sum, nil
+		} else if attempt >= s3PartAttempts || ctx.Err() != nil {
+			return nil, nil, err
+		}
+		if o.partRetries != nil {
+			atomic.AddInt64(o.partRetries, 1)
+		}
+		o.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error uploading a part to S3. The part will be retried.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", key),
+			sloghelper.Int64("part", number),
+			sloghelper.Error("error", err))
+	}
+}
+
+// Aborts a multipart upload so that S3 discards any parts that have been
+// uploaded. Errors are logged but otherwise ignored. The abort is sent even
+// if ctx has been canceled since that is often why the upload failed.
+func (o *s3ObjectStore) abortMultipart(
+	ctx context.Context,
+	key string,
+	uploadID *string,
+) {
+	_, err := o.settings.S3Client.AbortMultipartUploadWithContext(
+		context.WithoutCancel(ctx),
+		&s3.AbortMultipartUploadInput{
+			Bucket:   &o.settings.S3Bucket,
+			Key:      &key,
+			UploadId: uploadID,
+		})
+	if err != nil {
+		o.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error aborting a multipart upload.",
+			sloghelper.String("bucket", o.settings.S3Bucket),
+			sloghelper.String("key", key),
+			sloghelper.Error("error", err))
+	}
+}
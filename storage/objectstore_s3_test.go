@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/liquidgecka/testlib"
+)
+
+func TestS3ObjectStore_GetRange(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Patch out GetObject so that it records the requested range and
+	// returns the contents with the configured length.
+	contents := []byte("0123456789")
+	rng := ""
+	length := int64(len(contents))
+	defer monkey.Patch(
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			T.Equal(*goi.Bucket, "bucket")
+			switch *goi.Key {
+			case "missing":
+				return nil, awserr.New(s3.ErrCodeNoSuchKey, "missing", nil)
+			case "nobucket":
+				return nil, awserr.New(s3.ErrCodeNoSuchBucket, "gone", nil)
+			}
+			rng = ""
+			if goi.Range != nil {
+				rng = *goi.Range
+			}
+			return &s3.GetObjectOutput{
+				Body:          io.NopCloser(bytes.NewReader(contents)),
+				ContentLength: &length,
+			}, nil
+		},
+	).Unpatch()
+
+	settings := Settings{
+		S3Bucket: "bucket",
+		S3Client: &s3.S3{},
+	}
+	store := settings.objectStore()
+
+	// A full read sends no range.
+	body, err := store.GetRange(context.Background(), "key", 0, -1, "")
+	T.ExpectSuccess(err)
+	body.Close()
+	T.Equal(rng, "")
+
+	// Reads to the end of the object use an open ended range.
+	body, err = store.GetRange(context.Background(), "key", 5, -1, "")
+	T.ExpectSuccess(err)
+	body.Close()
+	T.Equal(rng, "bytes=5-")
+
+	// Exact ranges must return exactly the requested length.
+	body, err = store.GetRange(context.Background(), "key", 0, 10, "")
+	T.ExpectSuccess(err)
+	body.Close()
+	T.Equal(rng, "bytes=0-9")
+	_, err = store.GetRange(context.Background(), "key", 2, 4, "")
+	T.Equal(err, fmt.Errorf("Invalid content-length, expected 4, got 10."))
+
+	// S3 errors are converted into the ObjectStore errors.
+	_, err = store.GetRange(context.Background(), "missing", 0, -1, "")
+	T.Equal(err, ErrNotFound("missing"))
+	_, err = store.GetRange(context.Background(), "nobucket", 0, -1, "")
+	T.Equal(err, ErrBucketNotFound("bucket"))
+}
+
+func TestS3ObjectStore_GetRange_Canceled(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A fake S3 endpoint that sends the headers and part of the body and
+	// then waits for the client to go away.
+	aborted := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "10")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("01234"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				close(aborted)
+			case <-release:
+			}
+		}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "key", ""),
+		Endpoint:         aws.String(server.URL),
+		MaxRetries:       aws.Int(0),
+		Region:           aws.String("us-west-2"),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	T.ExpectSuccess(err)
+	settings := Settings{
+		S3Bucket: "bucket",
+		S3Client: s3.New(sess),
+	}
+	store := settings.objectStore()
+
+	// Canceling the context mid read aborts the request to S3.
+	ctx, cancel := context.WithCancel(context.Background())
+	body, err := store.GetRange(ctx, "key", 0, 10, "")
+	T.ExpectSuccess(err)
+	data := make([]byte, 5)
+	_, err = io.ReadFull(body, data)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "01234")
+	cancel()
+	_, err = io.ReadAll(body)
+	T.NotEqual(err, nil)
+	body.Close()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		T.Fatalf("The request to S3 was not aborted.")
+	}
+
+	// A context that is already canceled never makes the request.
+	_, err = store.GetRange(ctx, "key", 0, 10, "")
+	T.NotEqual(err, nil)
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Wraps an ObjectStore so that every call must finish within timeout.
+// A GetRange call only has timeout to return, after that each read of the
+// returned body must receive data within timeout so a read that stalls part
+// way through is abandoned without limiting how long a large body that is
+// still making progress can take. Calls that run out of time return
+// ErrS3Timeout. Uploads are given timeout for every
+// partSize bytes so that a large file is not held to the deadline of a
+// single request.
+type timeoutObjectStore struct {
+	ObjectStore
+	timeout  time.Duration
+	partSize int64
+}
+
+func (t *timeoutObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	timeout := t.timeout
+	if t.partSize > 0 && size > t.partSize {
+		timeout *= time.Duration((size + t.partSize - 1) / t.partSize)
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, ErrS3Timeout{})
+	defer cancel()
+	err := t.ObjectStore.Put(ctx, key, body, size, contentType, metadata)
+	return timeoutError(ctx, err)
+}
+
+func (t *timeoutObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(t.timeout, func() { cancel(ErrS3Timeout{}) })
+	body, err := t.ObjectStore.GetRange(ctx, key, offset, length, etag)
+	timer.Stop()
+	if err != nil {
+		cancel(nil)
+		return nil, timeoutError(ctx, err)
+	}
+	return &timeoutReadCloser{
+		ReadCloser: body,
+		ctx:        ctx,
+		cancel:     cancel,
+		timer:      timer,
+		timeout:    t.timeout,
+	}, nil
+}
+
+func (t *timeoutObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (*ObjectInfo, error) {
+	ctx, cancel := context.WithTimeoutCause(ctx, t.timeout, ErrS3Timeout{})
+	defer cancel()
+	info, err := t.ObjectStore.Head(ctx, key)
+	return info, timeoutError(ctx, err)
+}
+
+func (t *timeoutObjectStore) Delete(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, t.timeout, ErrS3Timeout{})
+	defer cancel()
+	return timeoutError(ctx, t.ObjectStore.Delete(ctx, key))
+}
+
+// Returns ErrS3Timeout in place of err if ctx ran out of time, otherwise
+// err is returned as is. This includes nil so that a call which finished
+// just as the deadline passed is still successful.
+func timeoutError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	} else if _, ok := context.Cause(ctx).(ErrS3Timeout); ok {
+		return ErrS3Timeout{}
+	}
+	return err
+}
+
+// The body returned from timeoutObjectStore.GetRange. The timer only runs
+// while a Read is waiting on data, so time spent by the caller between reads
+// does not count against it.
+type timeoutReadCloser struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (t *timeoutReadCloser) Read(data []byte) (int, error) {
+	t.timer.Reset(t.timeout)
+	n, err := t.ReadCloser.Read(data)
+	t.timer.Stop()
+	if err != nil && err != io.EOF {
+		err = timeoutError(t.ctx, err)
+	}
+	return n, err
+}
+
+func (t *timeoutReadCloser) Close() error {
+	t.timer.Stop()
+	defer t.cancel(nil)
+	return t.ReadCloser.Close()
+}
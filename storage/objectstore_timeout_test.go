@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// An ObjectStore that waits for delay before every call, giving up early
+// if the context is canceled the way the S3 client does.
+type slowObjectStore struct {
+	memoryObjectStore
+	delay time.Duration
+}
+
+func (s *slowObjectStore) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *slowObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.memoryObjectStore[key] = data
+	return nil
+}
+
+func (s *slowObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (io.ReadCloser, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.memoryObjectStore.GetRange(ctx, key, offset, length, etag)
+}
+
+func (s *slowObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (*ObjectInfo, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.memoryObjectStore.Head(ctx, key)
+}
+
+func (s *slowObjectStore) Delete(ctx context.Context, key string) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.memoryObjectStore.Delete(ctx, key)
+}
+
+// A body that never returns data until its context is canceled.
+type stalledReadCloser struct {
+	ctx context.Context
+}
+
+func (s stalledReadCloser) Read(data []byte) (int, error) {
+	<-s.ctx.Done()
+	return 0, s.ctx.Err()
+}
+
+func (s stalledReadCloser) Close() error {
+	return nil
+}
+
+// A body that returns one byte of data after every delay.
+type tricklingReadCloser struct {
+	ctx   context.Context
+	data  []byte
+	delay time.Duration
+}
+
+func (t *tricklingReadCloser) Read(data []byte) (int, error) {
+	if len(t.data) == 0 {
+		return 0, io.EOF
+	}
+	select {
+	case <-time.After(t.delay):
+	case <-t.ctx.Done():
+		return 0, t.ctx.Err()
+	}
+	data[0] = t.data[0]
+	t.data = t.data[1:]
+	return 1, nil
+}
+
+func (t *tricklingReadCloser) Close() error {
+	return nil
+}
+
+// An ObjectStore whose bodies stall after the call itself returns. If
+// delay is set then the bodies instead return the data stored in the
+// memoryObjectStore one byte at a time, waiting delay before each.
+type stalledObjectStore struct {
+	memoryObjectStore
+	delay time.Duration
+}
+
+func (s stalledObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (io.ReadCloser, error) {
+	if s.delay > 0 {
+		return &tricklingReadCloser{
+			ctx:   ctx,
+			data:  s.memoryObjectStore[key],
+			delay: s.delay,
+		}, nil
+	}
+	return stalledReadCloser{ctx: ctx}, nil
+}
+
+func TestTimeoutObjectStore(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	ctx := context.Background()
+	slow := &slowObjectStore{
+		memoryObjectStore: memoryObjectStore{"key": []byte("data")},
+		delay:             time.Second,
+	}
+	store := ObjectStore(&timeoutObjectStore{
+		ObjectStore: slow,
+		timeout:     time.Millisecond * 10,
+	})
+
+	// Every call that takes too long fails with ErrS3Timeout.
+	err := store.Put(ctx, "new", bytes.NewReader(nil), 0, "", nil)
+	T.Equal(err, ErrS3Timeout{})
+	_, err = store.GetRange(ctx, "key", 0, -1, "")
+	T.Equal(err, ErrS3Timeout{})
+	_, err = store.Head(ctx, "key")
+	T.Equal(err, ErrS3Timeout{})
+	T.Equal(store.Delete(ctx, "key"), ErrS3Timeout{})
+
+	// Cancellation by the caller is not reported as a timeout.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = store.Head(canceled, "key")
+	T.Equal(err, context.Canceled)
+
+	// Calls that finish in time are passed through.
+	slow.delay = 0
+	body := bytes.NewReader([]byte("x"))
+	T.ExpectSuccess(store.Put(ctx, "new", body, 1, "", nil))
+	info, err := store.Head(ctx, "new")
+	T.ExpectSuccess(err)
+	T.Equal(info.Size, int64(1))
+	rc, err := store.GetRange(ctx, "key", 1, 2, "")
+	T.ExpectSuccess(err)
+	data, err := io.ReadAll(rc)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "at")
+	T.ExpectSuccess(rc.Close())
+	_, err = store.GetRange(ctx, "missing", 0, -1, "")
+	T.Equal(err, ErrNotFound("missing"))
+	T.ExpectSuccess(store.Delete(ctx, "key"))
+}
+
+func TestTimeoutObjectStore_PutParts(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	ctx := context.Background()
+	store := &timeoutObjectStore{
+		ObjectStore: &slowObjectStore{
+			memoryObjectStore: memoryObjectStore{},
+			delay:             time.Millisecond * 50,
+		},
+		timeout:  time.Millisecond * 20,
+		partSize: 2,
+	}
+
+	// A single part must finish within the timeout.
+	body := bytes.NewReader([]byte("xx"))
+	T.Equal(store.Put(ctx, "small", body, 2, "", nil), ErrS3Timeout{})
+
+	// Larger uploads are given the timeout for every part.
+	body = bytes.NewReader([]byte("xxxxxxxxxx"))
+	T.ExpectSuccess(store.Put(ctx, "large", body, 10, "", nil))
+}
+
+func TestTimeoutObjectStore_StalledBody(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	store := &timeoutObjectStore{
+		ObjectStore: stalledObjectStore{},
+		timeout:     time.Millisecond * 10,
+	}
+	body, err := store.GetRange(context.Background(), "key", 0, -1, "")
+	T.ExpectSuccess(err)
+	defer body.Close()
+	_, err = body.Read(make([]byte, 10))
+	T.Equal(err, ErrS3Timeout{})
+
+	// A body that keeps receiving data can take far longer than the
+	// timeout in total, as can the caller between reads.
+	store = &timeoutObjectStore{
+		ObjectStore: stalledObjectStore{
+			memoryObjectStore: memoryObjectStore{
+				"key": []byte("0123456789abcdefghij"),
+			},
+			delay: time.Millisecond * 5,
+		},
+		timeout: time.Millisecond * 40,
+	}
+	body, err = store.GetRange(context.Background(), "key", 0, -1, "")
+	T.ExpectSuccess(err)
+	defer body.Close()
+	time.Sleep(time.Millisecond * 60)
+	data, err := io.ReadAll(body)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "0123456789abcdefghij")
+}
+
+func TestSettings_ObjectStore_Timeout(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	store := memoryObjectStore{}
+	settings := Settings{ObjectStore: store}
+	T.Equal(settings.objectStore(), ObjectStore(store))
+
+	settings.S3OperationTimeout = time.Second
+	settings.S3PartSize = 1024
+	T.Equal(settings.objectStore(), ObjectStore(&timeoutObjectStore{
+		ObjectStore: store,
+		timeout:     time.Second,
+		partSize:    1024,
+	}))
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE from linux/falloc.h, which the syscall package does
+// not export. This reserves the blocks without changing the size of the
+// file so that stat and reads only ever see the data actually written.
+const fallocKeepSize = 0x01
+
+// Reserves size bytes of disk space for fd without changing its size.
+func preallocate(fd *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	for {
+		err := syscall.Fallocate(int(fd.Fd()), fallocKeepSize, 0, size)
+		if err == syscall.EINTR {
+			continue
+		} else if err == syscall.EOPNOTSUPP {
+			// The file system does not support preallocation.
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestPreallocate(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Nothing is reserved if the size is not set.
+	fd := T.TempFile()
+	T.ExpectSuccess(preallocate(fd, 0))
+	stat := syscall.Stat_t{}
+	T.ExpectSuccess(syscall.Fstat(int(fd.Fd()), &stat))
+	T.Equal(stat.Blocks, int64(0))
+
+	// Space is reserved without changing the size of the file so only the
+	// data that is written is visible.
+	T.ExpectSuccess(preallocate(fd, 1024*1024))
+	T.ExpectSuccess(syscall.Fstat(int(fd.Fd()), &stat))
+	T.Equal(stat.Size, int64(0))
+	_, err := fd.Write([]byte("data"))
+	T.ExpectSuccess(err)
+	info, err := fd.Stat()
+	T.ExpectSuccess(err)
+	T.Equal(info.Size(), int64(4))
+}
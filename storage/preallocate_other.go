@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+// Preallocation is only supported on Linux so this does nothing.
+func preallocate(fd *os.File, size int64) error {
+	return nil
+}
@@ -1,13 +1,11 @@
 package storage
 
 import (
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
-	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -84,6 +82,12 @@ type primary struct {
 	// upload phase.
 	s3key string
 
+	// If S3KeyUploadFormat is configured then this is the key that a copy
+	// of the primary is written to after it has been uploaded to s3key.
+	// This is set the first time that an upload is attempted so that
+	// retries will write to the same key.
+	uploadKey string
+
 	// Settings associated with this storage namespace and the storage
 	// object that created this primary.
 	settings *Settings
@@ -92,16 +96,42 @@ type primary struct {
 	// The file descriptor to the open file on disk.
 	fd *os.File
 
+	// If Settings.VerifyUploadHash is enabled then inserts are written
+	// through this hasher so that it holds the HighwayHash of the whole
+	// file. If an insert has to be truncated then the hash no longer
+	// matches the file so this is set to nil and the hash is computed from
+	// the file when it is uploaded instead.
+	fileHash *hasher.Hasher
+
+	// The hash of each insert into the file so that it can be checked by
+	// Scrub(), and set to 1 if a scrub found that the file no longer
+	// matches and Settings.ScrubQuarantine is enabled.
+	records     recordHashes
+	quarantined int32
+
+	// Tracks readers that are reading directly from fd so that it is not
+	// closed while they are still using it.
+	fdRefs fileRefs
+
 	// If the file was compressed for uploading then this will hold
 	// on to the open file descriptor for that file.
 	compressFd *os.File
 
-	// Tracks the current state of this file.
-	state int32
+	// The index of the compressed file if Settings.CompressIndexInterval
+	// is set, this is uploaded along with the compressed file.
+	compressIndex *compressIndex
+
+	// Tracks the current state of this file, and the time (in unix
+	// nanoseconds) that it moved into that state.
+	state        int32
+	stateChanged int64
 
 	// When delaying the file delete this is the Token used with the
-	// DelayQueue.
+	// DelayQueue. Since a user delete can cut the delay short
+	// delayDeleteDone is used to make sure that the file is only moved on
+	// once.
 	delayDeleteToken delayqueue.Token
+	delayDeleteDone  int32
 
 	// Each primary file is allowed to exist for a limited amount of time
 	// after which it is supposed to be expired and automatically uploaded.
@@ -122,13 +152,50 @@ type primary struct {
 	// The current write offset within the file.
 	offset uint64
 
+	// Wakes Blast Path readers that are following the file as it grows.
+	tail tailNotifier
+
+	// The number of times that uploading this file has failed.
+	uploadFailures int32
+
+	// Once the file grows beyond this size it is queued for upload. This
+	// is fixed when the primary is opened, see SetUploadThresholds().
+	uploadLargerThan uint64
+
+	// If Settings.RotateEvery is set then this is the wall clock boundary
+	// at which this file must stop accepting new data.
+	rotateAt time.Time
+
 	// A list of all Blobby instances that also contain a copy of this
 	// file. This is used during recovery to find the instance with the
 	// most complete dataset. We also keep a list that is a 1:1 mapping
-	// of the Remote implementation to a bool that defines if the given
-	// remote has failed.
+	// of the Remote implementation to a flag that is set to 1 once the
+	// given remote has failed, which must be accessed atomically.
 	remotes       []Remote
-	failedRemotes []bool
+	failedRemotes []int32
+
+	// True if two or more of the remotes are in the same failure domain,
+	// meaning that losing that domain loses more than one copy of the
+	// data.
+	unspread bool
+
+	// If Settings.TrackReplicaLag is enabled then these track the offset
+	// that each remote has confirmed receiving, and the largest number of
+	// bytes that each remote has been observed to be behind the primary.
+	// Both are 1:1 with remotes and must be accessed atomically.
+	replicaOffsets []uint64
+	replicaLag     []uint64
+
+	// When Settings.AsyncReplication is enabled inserts are queued here
+	// and replicated in order by a background goroutine. asyncPending
+	// tracks the inserts that have not finished replicating so that the
+	// file is not uploaded before its replicas are up to date.
+	asyncQueue    chan replicatorConfig
+	asyncStart    sync.Once
+	asyncStop     sync.Once
+	asyncPending  sync.WaitGroup
+	asyncFailed   int32
+	asyncShutdown int32
 
 	// If this primary has had an error of any sort then this will be set
 	// to true to indicate that it is now unhealthy.
@@ -170,14 +237,30 @@ func (p *primary) Insert(ctx context.Context, data *InsertData) (string, error)
 	p.setState(ctx, primaryStateInserting)
 
 	// Setup a hasher that we can use to get the Highway hash of the data
-	// that was written to disk.
-	hsum, err := hasher.Computer("hh", io.Writer(p.fd))
+	// that was written to disk. If the whole file is being hashed then the
+	// data is written through that hasher as well.
+	dest := io.Writer(p.fd)
+	if p.fileHash != nil {
+		dest = p.fileHash
+	}
+	hsum, err := hasher.Computer("hh", dest)
 	if err != nil {
 		// This shouldn't ever happen, as such its ALWAYS a panic.
 		atomic.AddInt64(&p.storage.metrics.InternalInsertErrors, 1)
 		panic(err)
 	}
 
+	// If the client sent the hash of the data then it is checked as the
+	// data is written. Storage.Insert() has already validated the format.
+	var check *hasher.Hasher
+	source := io.Writer(hsum)
+	if data.Hash != "" {
+		if check, err = hasher.Validator(data.Hash, hsum); err != nil {
+			panic(err)
+		}
+		source = check
+	}
+
 	// Keep the starting offset of the data that is being written to
 	// disk. This is used to set the start maker and to roll back to
 	// if needed.
@@ -189,6 +272,9 @@ func (p *primary) Insert(ctx context.Context, data *InsertData) (string, error)
 		// Track truncation time in the tracer.
 		defer trace.NewChild("storage/(primary.Insert):truncating").End()
 
+		// The whole file hash has already seen the data being removed.
+		p.fileHash = nil
+
 		// Attempt to truncate the file back to where it was prior to the
 		// start of this operation. If that is successful then we can
 		// return this file to the Inserting state, otherwise we need
@@ -214,17 +300,26 @@ func (p *primary) Insert(ctx context.Context, data *InsertData) (string, error)
 		p.shutdown(ctx)
 	}
 
+	// At most one byte more than the size limit is read so that oversized
+	// data can be detected without writing all of it. This matters most
+	// for data of an unknown length, such as a chunked HTTP request, as
+	// nothing else bounds how much is read.
+	max := p.settings.maxRecordBytes()
+	body := io.LimitReader(data.Source, max+1)
+
 	// Copy the data from the reader into the file. Note that if a gzipper
 	// is used then length will be incorrect as it will represent the number
 	// of bytes read from the client.
 	writeStart := time.Now()
 	copyTrace := trace.NewChild("storage/(primary.Insert):copying")
 	buffer := [1024 * 32]byte{}
-	length, derr, rerr := iohelp.CopyBuffer(hsum, data.Source, buffer[:])
+	length, derr, rerr := iohelp.CopyBuffer(source, body, buffer[:])
 	copyTrace.End()
+	written := time.Since(writeStart)
 	atomic.AddUint64(
 		&p.storage.metrics.PrimaryInsertWriteNanoseconds,
-		uint64(time.Since(writeStart)))
+		uint64(written))
+	p.storage.metrics.PrimaryInsertWriteLatency.Observe(written)
 	if rerr != nil {
 		// Errors on read typically indicate that there was a problem with
 		// the HTTP connection or request in some way. These are not internal
@@ -248,6 +343,15 @@ func (p *primary) Insert(ctx context.Context, data *InsertData) (string, error)
 			sloghelper.Error("error", derr))
 		truncate(true)
 		return "", derr
+	} else if length > max {
+		// The data was larger than allowed so it is rolled back.
+		p.log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Data from the client was larger than the record limit.",
+			sloghelper.Int64("limit-bytes", max))
+		truncate(true)
+		return "", ErrRecordTooLarge(max)
 	} else if data.Length != length && data.Length > 0 {
 		// The data written to the local disk was not as long as the data
 		// the client was expected to send us.
@@ -259,12 +363,41 @@ func (p *primary) Insert(ctx context.Context, data *InsertData) (string, error)
 			sloghelper.Int64("received-bytes", length))
 		truncate(true)
 		return "", errors.New("Short read from client.")
+	} else if check != nil && !check.Check() {
+		// The data was corrupted somewhere between the client and here so
+		// it is removed before it is replicated.
+		p.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Data received from the client does not match its hash.",
+			sloghelper.String("expected-hash", data.Hash),
+			sloghelper.String("found-hash", check.Hash()))
+		truncate(true)
+		return "", ErrHashMismatch(data.Hash)
 	} else if p.log.Enabled(ctx, slog.LevelDebug) {
 		p.log.Debug(
 			"Copied data from source.",
 			sloghelper.Int64("bytes", length))
 	}
 
+	// If configured then make sure that the data is on stable storage
+	// before it is replicated and acknowledged. If the sync fails then the
+	// state of the file on disk is unknown so it is not used for any more
+	// inserts.
+	if p.settings.SyncPolicy == SyncPolicyOnInsert {
+		syncTrace := trace.NewChild("storage/(primary.Insert):syncing")
+		err := p.fd.Sync()
+		syncTrace.End()
+		if err != nil {
+			atomic.AddInt64(&p.storage.metrics.InternalInsertErrors, 1)
+			p.log.Error(
+				"Error syncing data to disk.",
+				sloghelper.Error("error", err))
+			truncate(false)
+			return "", err
+		}
+	}
+
 	// Update the primary file state.
 	p.setState(ctx, primaryStateReplicating)
 
@@ -288,18 +421,105 @@ func (p *primary) Insert(ctx context.Context, data *InsertData) (string, error)
 		namespace: p.settings.NameSpace,
 		start:     start,
 	}
+	var shuttingDown bool
+	if len(p.remotes) == 0 {
+		// There are no replicas so the data is complete once it is on
+		// the local disk.
+	} else if p.settings.AsyncReplication {
+		// The client does not need to wait on the replicas, the data will
+		// be replicated in the background in the order it was written.
+		shuttingDown = p.queueReplication(rc)
+	} else if shuttingDown, err = p.replicate(ctx, trace, rc); err != nil {
+		// Since we have committed to disk already we can not roll back
+		// here, as such we need to truncate and immediately move to the
+		// Uploading state.
+		truncate(false)
+		return "", err
+	}
+
+	// Set the new offset for the next write to the file.
+	p.records.add(start, uint64(length), rc.hash)
+	p.offset += uint64(length)
+	if p.settings.RecordCountMetadata {
+		saveRecordCount(ctx, p.fd, &p.records, p.log)
+	}
+	atomic.AddInt64(&p.storage.metrics.DiskBytes, length)
+	p.log.Debug("Insertion successful.")
+
+	// If there have been no inserts in the primary yet then set the first
+	// insert time.
+	if p.firstInsert == (time.Time{}) {
+		p.firstInsert = time.Now()
+	}
+
+	// Return the id for the data generated.
+	atomic.AddInt64(&p.storage.metrics.BytesInserted, length)
+	fid := p.fid.EncodedID(start, uint32(length), p.settings.IDEncoding)
+	if p.log.Enabled(ctx, slog.LevelDebug) {
+		p.log.Debug(
+			"Insertion completed.",
+			sloghelper.Uint64("start-offset", start),
+			sloghelper.Int64("length", length),
+			sloghelper.String("fid", fid))
+	}
+
+	// If the file is larger than is allowed via our settings then
+	// we need to transition into uploading here, otherwise we need
+	// to transition back into the waiting state to signal that we
+	// are able to accept more data.
+	if shuttingDown {
+		p.log.Debug(
+			"At least one replica is shutting down. Queuing for upload.")
+		if p.settings.Compress {
+			p.setState(ctx, primaryStatePendingCompression)
+		} else {
+			p.setState(ctx, primaryStatePendingUpload)
+		}
+	} else if p.offset > p.uploadLargerThan {
+		p.log.Debug("File is too large, queuing for upload.")
+		if p.settings.Compress {
+			p.setState(ctx, primaryStatePendingCompression)
+		} else {
+			p.setState(ctx, primaryStatePendingUpload)
+		}
+	} else if !p.rotateAt.IsZero() && !time.Now().Before(p.rotateAt) {
+		// The rotation boundary passed while this insert was running so
+		// the expire event was not able to shut the file down.
+		p.log.Debug("Rotation boundary has passed, queuing for upload.")
+		if p.settings.Compress {
+			p.setState(ctx, primaryStatePendingCompression)
+		} else {
+			p.setState(ctx, primaryStatePendingUpload)
+		}
+	} else {
+		p.log.Debug("File can still be grown.")
+		p.setState(ctx, primaryStateWaiting)
+	}
+
+	return fid, nil
+}
+
+// Replicates the data described by rc to all of the remotes, waiting for
+// them to complete. This returns true if any of the remotes indicated that
+// they are shutting down, or an error if any of the remotes failed.
+func (p *primary) replicate(
+	ctx context.Context,
+	trace *tracing.Trace,
+	rc replicatorConfig,
+) (bool, error) {
 	wg := sync.WaitGroup{}
 	attrs := make([]slog.Attr, len(p.remotes))
 	errs := make([]error, len(p.remotes))
 	errCount := int32(0)
+	confirmed := make([]bool, len(p.remotes))
 	replicaTrace := trace.NewChild("storage/(primary.Insert):replicate")
 	replicateStart := time.Now()
 	shuttingDown := int32(0)
 	for i, remote := range p.remotes {
-		if remote == nil {
+		if remote == nil || p.remoteFailed(i) {
 			// The remote was previously marked as failed and as such
 			// we need to basically automatically mark its slot as failed
-			// so the insert fails.
+			// so the insert fails unless a quorum is allowed.
 			ei := atomic.AddInt32(&errCount, 1) - 1
 			errs[ei] = fmt.Errorf("Remote failed on a previous step.")
 			attrs[int(ei)] = sloghelper.Error(
@@ -315,89 +535,184 @@ func (p *primary) Insert(ctx context.Context, data *InsertData) (string, error)
 		go func(i int, is string, remote Remote, trace *tracing.Trace) {
 			defer wg.Done()
 			defer trace.End()
-			if shutDown, err := remote.Replicate(&rc); err != nil {
+			rrc := rc
+			rrc.trace = trace
+			if shutDown, err := p.replicateTo(ctx, remote, &rrc); err != nil {
 				ei := atomic.AddInt32(&errCount, 1) - 1
 				errs[ei] = fmt.Errorf("%s: %s", remote.String(), err.Error())
 				attrs[int(ei)] = sloghelper.Error(
 					"replica-"+is+"-error",
 					err)
-			} else if shutDown {
-				atomic.AddInt32(&shuttingDown, 1)
+			} else {
+				confirmed[i] = true
+				if shutDown {
+					atomic.AddInt32(&shuttingDown, 1)
+				}
 			}
 		}(i, is, remote, t)
 	}
 	wg.Wait()
+	if p.replicaLag != nil {
+		p.updateReplicaLag(rc.end, confirmed)
+	}
 	replicaTrace.End()
+	replicated := time.Since(replicateStart)
 	atomic.AddUint64(
 		&p.storage.metrics.PrimaryInsertReplicateNanoseconds,
-		uint64(time.Since(replicateStart)))
+		uint64(replicated))
+	p.storage.metrics.PrimaryInsertReplicateLatency.Observe(replicated)
+
+	// The remotes that did not accept the data no longer match the primary
+	// so they are marked as failed and deleted.
+	for i := range confirmed {
+		if !confirmed[i] {
+			p.failRemote(ctx, i)
+		}
+	}
+
+	// If enough of the remotes accepted the data to meet the quorum then
+	// the insert can succeed.
+	if errCount > 0 && len(p.remotes)-int(errCount) >= p.replicaQuorum() {
+		atomic.AddInt64(&p.storage.metrics.DegradedInserts, 1)
+		p.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Replication failed on some replicas but met the quorum.",
+			attrs[0:errCount]...)
+		return shuttingDown > 0, nil
+	}
 
 	// If replication failed to a host then we need to handle that.
 	if errCount > 0 {
 		// Log that the replication failed for tracking. This is not a normal
-		// case so this can be logged at the Warning level. Since we have
-		// committed to disk already we can not roll back here, as such we
-		// need to truncate and immediately move to the Uploading state.
+		// case so this can be logged at the Warning level.
 		atomic.AddInt64(&p.storage.metrics.InternalInsertErrors, 1)
 		p.log.LogAttrs(
 			ctx,
 			slog.LevelWarn,
 			"Replication failed.",
 			attrs[0:errCount]...)
-		truncate(false)
-		return "", errors.NewMultipleError(
+		return false, errors.NewMultipleError(
 			"Replication failed",
 			errs[0:errCount])
 	} else {
 		p.log.Debug("Replicas accepted the update.")
 	}
+	return shuttingDown > 0, nil
+}
 
-	// Set the new offset for the next write to the file.
-	p.offset += uint64(length)
-	p.log.Debug("Insertion successful.")
+// Replicates rc to a single remote. If the remote reports that it is
+// missing data from before rc then the missing records are resent one at a
+// time, exactly as they were originally replicated, and rc is attempted
+// once more. Resending each record on its own keeps every request within
+// the replica's record size limit and its record count in step with the
+// primary. If the missing data does not line up with the records that the
+// primary knows about then the original error is returned.
+func (p *primary) replicateTo(
+	ctx context.Context,
+	remote Remote,
+	rc *replicatorConfig,
+) (bool, error) {
+	shutDown, err := remote.Replicate(rc)
+	behind, ok := err.(ErrReplicaBehind)
+	if !ok || uint64(behind) >= rc.start {
+		return shutDown, err
+	}
+	p.log.LogAttrs(
+		ctx,
+		slog.LevelWarn,
+		"Replica is behind, resending the missing data.",
+		sloghelper.String("replica", remote.String()),
+		sloghelper.Uint64("replica-offset", uint64(behind)),
+		sloghelper.Uint64("offset", rc.start))
+	next := uint64(behind)
+	for _, record := range p.records.get() {
+		if record.start < next {
+			continue
+		} else if record.start != next || record.start >= rc.start {
+			break
+		}
+		resync := *rc
+		resync.start = record.start
+		resync.end = record.start + record.length
+		resync.hash = record.hash
+		if _, err := remote.Replicate(&resync); err != nil {
+			return false, err
+		}
+		next = resync.end
+	}
+	if next != rc.start {
+		return shutDown, err
+	}
+	return remote.Replicate(rc)
+}
 
-	// If there have been no inserts in the primary yet then set the first
-	// insert time.
-	if p.firstInsert == (time.Time{}) {
-		p.firstInsert = time.Now()
+// Returns the number of remotes that must accept data for an insert to
+// succeed.
+func (p *primary) replicaQuorum() int {
+	if q := p.settings.ReplicaQuorum; q > 0 && q < len(p.remotes) {
+		return q
 	}
+	return len(p.remotes)
+}
 
-	// Return the id for the data generated.
-	atomic.AddInt64(&p.storage.metrics.BytesInserted, length)
-	fid := p.fid.ID(start, uint32(length))
-	if p.log.Enabled(ctx, slog.LevelDebug) {
-		p.log.Debug(
-			"Insertion completed.",
-			sloghelper.Uint64("start-offset", start),
-			sloghelper.Int64("length", length),
-			sloghelper.String("fid", fid))
+// Returns true if the remote at index i has been marked as failed.
+func (p *primary) remoteFailed(i int) bool {
+	return i < len(p.failedRemotes) &&
+		atomic.LoadInt32(&p.failedRemotes[i]) != 0
+}
+
+// Marks the remote at index i as failed so that it is not sent any more
+// data. Its copy of the file no longer matches the primary so it is deleted
+// right away, otherwise it could be orphaned and upload the incomplete data
+// over the object uploaded by the primary. If the delete fails then the
+// remote is still sent heart beats so that it does not upload, and it is
+// deleted again along with the other remotes once the file is complete.
+func (p *primary) failRemote(ctx context.Context, i int) {
+	if i >= len(p.failedRemotes) ||
+		!atomic.CompareAndSwapInt32(&p.failedRemotes[i], 0, 1) {
+		return
 	}
+	remote := p.remotes[i]
+	if remote == nil {
+		return
+	}
+	go func() {
+		err := remote.Delete(p.settings.NameSpace, p.fidStr)
+		if err != nil {
+			p.log.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Error deleting a failed remote.",
+				sloghelper.String("replica", remote.String()),
+				sloghelper.Error("error", err))
+		}
+	}()
+}
 
-	// If the file is larger than is allowed via our settings then
-	// we need to transition into uploading here, otherwise we need
-	// to transition back into the waiting state to signal that we
-	// are able to accept more data.
-	if shuttingDown > 0 {
-		p.log.Debug(
-			"At least one replica is shutting down. Queuing for upload.")
-		if p.settings.Compress {
-			p.setState(ctx, primaryStatePendingCompression)
-		} else {
-			p.setState(ctx, primaryStatePendingUpload)
+// Records the offset that each remote has confirmed receiving after data
+// ending at end was replicated, and updates the largest lag observed for
+// any remote that did not confirm it.
+func (p *primary) updateReplicaLag(end uint64, confirmed []bool) {
+	for i := range p.replicaLag {
+		if confirmed[i] {
+			atomic.StoreUint64(&p.replicaOffsets[i], end)
 		}
-	} else if p.offset > p.settings.UploadLargerThan {
-		p.log.Debug("File is too large, queuing for upload.")
-		if p.settings.Compress {
-			p.setState(ctx, primaryStatePendingCompression)
-		} else {
-			p.setState(ctx, primaryStatePendingUpload)
+		lag := end - atomic.LoadUint64(&p.replicaOffsets[i])
+		if lag > atomic.LoadUint64(&p.replicaLag[i]) {
+			atomic.StoreUint64(&p.replicaLag[i], lag)
 		}
-	} else {
-		p.log.Debug("File can still be grown.")
-		p.setState(ctx, primaryStateWaiting)
 	}
+}
 
-	return fid, nil
+// Returns the largest lag observed for any of the remotes of this primary.
+func (p *primary) maxReplicaLag() (max uint64) {
+	for i := range p.replicaLag {
+		if lag := atomic.LoadUint64(&p.replicaLag[i]); lag > max {
+			max = lag
+		}
+	}
+	return
 }
 
 // Opens the file on disk, and finds remotes to start replicating too.
@@ -405,13 +720,20 @@ func (p *primary) Open(ctx context.Context) bool {
 	// Setup the failedRemotes array. This is used for tracking which
 	// remotes must receive the Delete() operation in order for a file
 	// delete to be considered successful.
-	p.failedRemotes = make([]bool, len(p.remotes))
+	p.failedRemotes = make([]int32, len(p.remotes))
+
+	// If configured then setup the tracking for how far behind the primary
+	// each remote is.
+	if p.settings.TrackReplicaLag {
+		p.replicaOffsets = make([]uint64, len(p.remotes))
+		p.replicaLag = make([]uint64, len(p.remotes))
+	}
 
 	// Open the file on disk so we have a workable file descriptor.
 	p.setState(ctx, primaryStateOpening)
-	fpath := filepath.Join(p.settings.BaseDirectory, p.fidStr)
+	fpath := p.settings.dataPath(p.fidStr, p.fidStr)
 	flags := os.O_CREATE | os.O_RDWR | os.O_APPEND
-	mode := os.FileMode(0644)
+	mode := p.settings.fileMode()
 	var err error
 	if p.fd, err = os.OpenFile(fpath, flags, mode); err != nil {
 		// Log the error and then set the state to complete since the
@@ -423,6 +745,13 @@ func (p *primary) Open(ctx context.Context) bool {
 		return false
 	}
 
+	// If uploads are verified then setup the hasher that tracks the hash
+	// of the whole file. Should this fail the hash is simply computed from
+	// the file at upload time.
+	if p.settings.VerifyUploadHash {
+		p.fileHash, _ = hasher.Computer("hh", p.fd)
+	}
+
 	// Initialize the heart beat timer before making the call so that we
 	// ensure that the follow up happens before the timer expires on
 	// the replica.
@@ -443,7 +772,7 @@ func (p *primary) Open(ctx context.Context) bool {
 				attrs[i] = sloghelper.Error(
 					"replica-"+strconv.FormatInt(int64(i), 10)+"-error",
 					err)
-				p.failedRemotes[i] = true
+				atomic.StoreInt32(&p.failedRemotes[i], 1)
 				p.remotes[i] = nil
 			}
 		}(i, r)
@@ -469,14 +798,30 @@ func (p *primary) Open(ctx context.Context) bool {
 		return false
 	}
 
+	// Record where the replicas live so that reads can be served by them
+	// if the local file is not available.
+	if len(p.remotes) > 0 {
+		p.storage.replicaLocations.add(p.fidStr, p.remotes)
+	}
+
 	// Setup the expiration token so that the file is eventually uploaded
-	// to S3 once it becomes too old to accept new inserts.
+	// to S3 once it becomes too old to accept new inserts, or once the
+	// rotation boundary has been reached.
 	p.settings.DelayQueue.Alter(
 		&p.expireToken,
-		time.Now().Add(p.settings.UploadOlder),
+		time.Unix(0, p.expires),
 		p.expire)
 
-	// TODO: Falloc support?
+	// Reserve space for the file so that it is not fragmented as inserts
+	// are appended to it. Failing to do so is not fatal, the file will
+	// simply be allocated as it grows.
+	if err := preallocate(p.fd, p.settings.PreallocateBytes); err != nil {
+		p.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error preallocating space for the file.",
+			sloghelper.Error("error", err))
+	}
 
 	// Success.
 	p.log.Debug("Primary file successfully opened.")
@@ -495,12 +840,31 @@ func (p *primary) Status() string {
 	b.WriteString(primaryStateStrings[state])
 	b.WriteString(" size=")
 	b.WriteString(human.Bytes(p.offset))
+	b.WriteString(" records=")
+	b.WriteString(strconv.Itoa(p.records.count()))
 
 	if p.firstInsert != (time.Time{}) {
 		b.WriteString(" oldest=")
 		b.WriteString(time.Now().Sub(p.firstInsert).String())
 	}
 
+	failures := atomic.LoadInt32(&p.uploadFailures)
+	if failures > 0 && p.settings.StatusUploadFailures {
+		b.WriteString(" upload-failures=")
+		b.WriteString(strconv.FormatInt(int64(failures), 10))
+	}
+
+	if len(p.replicaLag) > 0 {
+		b.WriteString(" replica-lag=")
+		for i := range p.replicaLag {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			lag := atomic.LoadUint64(&p.replicaLag[i])
+			b.WriteString(strconv.FormatUint(lag, 10))
+		}
+	}
+
 	if len(p.remotes) > 0 {
 		b.WriteString(" remotes=")
 		b.WriteString(p.remotes[0].String())
@@ -512,17 +876,67 @@ func (p *primary) Status() string {
 	return b.String()
 }
 
+// Like Status() but returns the status as a structure that can be encoded
+// for tooling.
+func (p *primary) FileStatus() FileStatus {
+	fs := FileStatus{
+		FID:     p.fidStr,
+		State:   primaryStateStrings[atomic.LoadInt32(&p.state)],
+		Size:    p.offset,
+		Records: p.records.count(),
+	}
+	if p.firstInsert != (time.Time{}) {
+		fs.OldestInsertAge = time.Now().Sub(p.firstInsert).Seconds()
+	}
+	failures := atomic.LoadInt32(&p.uploadFailures)
+	if failures > 0 && p.settings.StatusUploadFailures {
+		fs.UploadFailures = failures
+	}
+	if len(p.replicaLag) > 0 {
+		fs.ReplicaLag = make([]uint64, len(p.replicaLag))
+		for i := range p.replicaLag {
+			fs.ReplicaLag[i] = atomic.LoadUint64(&p.replicaLag[i])
+		}
+	}
+	if len(p.remotes) > 0 {
+		fs.Remotes = make([]string, len(p.remotes))
+		for i, remote := range p.remotes {
+			fs.Remotes[i] = remote.String()
+		}
+	}
+	return fs
+}
+
 // Called by the CompressWorkQueue to initiate compression on the underlying
 // file.
 func (p *primary) compress(ctx context.Context) {
 	// Set the state.
 	p.setState(ctx, primaryStateCompressing)
+
+	// Make sure that any background replication has finished so that the
+	// replicas are up to date before the file leaves the primary.
+	p.waitForReplication()
 	p.log.Debug("Compressing the file.")
 
+	// If configured then sync the file now that it is no longer accepting
+	// new data.
+	if p.settings.SyncPolicy == SyncPolicyOnRotate {
+		if err := p.fd.Sync(); err != nil {
+			p.log.Error(
+				"Error syncing the data file.",
+				sloghelper.String("file", p.fd.Name()),
+				sloghelper.Error("error", err))
+			p.setState(ctx, primaryStatePendingCompression)
+			return
+		}
+	}
+
 	// Open the file that will store the compressed data long term.
-	fpath := filepath.Join(p.settings.BaseDirectory, p.fidStr) + ".gz"
+	compressor := p.settings.compressor()
+	fpath := p.settings.dataPath(p.fidStr, p.fidStr) +
+		compressor.Extension()
 	flags := os.O_CREATE | os.O_RDWR | os.O_APPEND | os.O_TRUNC
-	mode := os.FileMode(0644)
+	mode := p.settings.fileMode()
 	var err error
 	if p.compressFd, err = os.OpenFile(fpath, flags, mode); err != nil {
 		// Log the error and then set the state to complete since the
@@ -545,16 +959,17 @@ func (p *primary) compress(ctx context.Context) {
 		return
 	}
 
-	// Create a gzip writer. Note that any error here is going to purely
-	// be related to the compression level so its okay to just panic.
-	zipper, err := gzip.NewWriterLevel(p.compressFd, p.settings.CompressLevel)
+	// Copy data from the source file into the compressor. If a compress
+	// index interval is configured then this also builds the index that
+	// will be uploaded alongside the compressed object.
+	start := time.Now()
+	p.compressIndex, err = p.settings.compressData(
+		p.compressFd,
+		p.fd,
+		compressor,
+		p.settings.compressLevel(),
+		p.offset)
 	if err != nil {
-		panic(err)
-	}
-
-	// Copy data from the source file into the gzipper.
-	buffer := [4096]byte{}
-	if _, err = io.CopyBuffer(zipper, p.fd, buffer[:]); err != nil {
 		p.log.Error(
 			"Error generating the compressed data file.",
 			sloghelper.String("source-file", p.fd.Name()),
@@ -564,24 +979,45 @@ func (p *primary) compress(ctx context.Context) {
 		return
 	}
 
-	// Close out the gzip routine.
-	if err = zipper.Close(); err != nil {
-		p.log.Error(
-			"Error closing the compressed file.",
-			sloghelper.String("file", p.compressFd.Name()),
-			sloghelper.Error("error", err))
-		p.setState(ctx, primaryStatePendingCompression)
-		return
+	// If configured then read the compressed file back to ensure that it
+	// inflates to the original data before it gets uploaded. If it doesn't
+	// then the bad file is removed and compression is attempted again.
+	if p.settings.VerifyCompression {
+		if err = verifyCompressed(p.compressFd, compressor, p.offset); err != nil {
+			p.log.Error(
+				"Compressed file failed verification.",
+				sloghelper.String("file", p.compressFd.Name()),
+				sloghelper.Error("error", err))
+			if err := removeCompressed(p.compressFd); err != nil {
+				p.log.Error(
+					"Error removing the bad compressed file.",
+					sloghelper.String("file", p.compressFd.Name()),
+					sloghelper.Error("error", err))
+			}
+			p.compressFd = nil
+			p.setState(ctx, primaryStatePendingCompression)
+			return
+		}
 	}
 
 	// Success.
 	p.log.Info("Successfully compressed the data file.")
+	old, level := p.settings.compressed(p.offset, time.Since(start))
+	if old != level {
+		p.log.Info(
+			"Adjusted the compression level.",
+			sloghelper.Int("old-level", old),
+			sloghelper.Int("level", level))
+	}
 	p.setState(ctx, primaryStatePendingUpload)
 }
 
 // Called by the DelayQueue to indicate that the delete delay has expired and
 // now the file can be moved into the deleting phase.
 func (p *primary) delayDelete(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&p.delayDeleteDone, 0, 1) {
+		return
+	}
 	p.log.Info("Delete delay has passed.")
 	p.setState(ctx, primaryStatePendingDeleteLocal)
 }
@@ -607,11 +1043,13 @@ func (p *primary) deleteLocal(ctx context.Context) {
 			return
 		} else {
 			p.storage.metrics.FilesDeleted.IncSuccesses()
+			atomic.AddInt64(&p.storage.metrics.DiskBytes, -int64(p.offset))
 		}
 
 		// Close the open file handle. If there is an error log it, but there
-		// is not much more we can do so move on anyway.
-		if err := p.fd.Close(); err != nil {
+		// is not much more we can do so move on anyway. If readers are still
+		// using the file then it will be closed once they have finished.
+		if err := p.fdRefs.close(p.fd); err != nil {
 			p.log.LogAttrs(
 				ctx,
 				slog.LevelWarn,
@@ -672,6 +1110,11 @@ func (p *primary) deleteRemotes(ctx context.Context) {
 	// Set the state on the primary.
 	p.setState(ctx, primaryStateDeletingRemotes)
 
+	// A primary that never made it to the upload still needs to let the
+	// background replicator finish, otherwise it could replicate to a
+	// remote after that remote has been deleted.
+	p.waitForReplication()
+
 	// Contact each remote in parallel and request its deletion.
 	p.log.Debug("Triggering a delete on all remotes.")
 	wg := sync.WaitGroup{}
@@ -687,7 +1130,7 @@ func (p *primary) deleteRemotes(ctx context.Context) {
 		go func(i int, remote Remote) {
 			defer wg.Done()
 			err := remote.Delete(p.settings.NameSpace, p.fidStr)
-			if err != nil && !p.failedRemotes[i] {
+			if err != nil {
 				ei := atomic.AddInt32(&errCount, 1) - 1
 				attrs[int(ei)] = sloghelper.Error(
 					"replica-"+strconv.FormatInt(int64(i), 10)+"-error",
@@ -762,7 +1205,18 @@ func (p *primary) heartBeatEvent(ctx context.Context) {
 		go func(i int, remote Remote) {
 			defer wg.Done()
 			ns := p.settings.NameSpace
-			if shutDown, err := remote.HeartBeat(ns, p.fidStr); err != nil {
+			start := time.Now()
+			shutDown, err := remote.HeartBeat(ns, p.fidStr)
+			if err == nil {
+				p.storage.metrics.PrimaryHeartBeatLatency.Observe(
+					time.Since(start))
+			}
+			if p.remoteFailed(i) {
+				// Remotes that fell out of the quorum are still sent heart
+				// beats so they do not upload their incomplete copy before
+				// being deleted, but they can not fail the file.
+				return
+			} else if err != nil {
 				ei := atomic.AddInt32(&errCount, 1) - 1
 				attrs[int(ei)] = sloghelper.Error(
 					"replica-"+strconv.FormatInt(int64(i), 10)+"-error",
@@ -802,7 +1256,11 @@ func (p *primary) heartBeatEvent(ctx context.Context) {
 
 // Resets the heart beat token to the next expected heart beat time.
 func (p *primary) resetHeartBeatTimer() {
-	hbTime := p.settings.HeartBeatTime / 2
+	// Without any replicas there is nothing to keep alive.
+	if len(p.remotes) == 0 {
+		return
+	}
+	hbTime := p.settings.heartBeatInterval()
 	p.log.Debug(
 		"Setting heart beat timer",
 		sloghelper.String("timer", hbTime.String()))
@@ -823,6 +1281,7 @@ func (p *primary) setState(ctx context.Context, n int32) {
 
 	// Swap the old and new states so that we can log them both.
 	oldN := atomic.SwapInt32(&p.state, n)
+	atomic.StoreInt64(&p.stateChanged, time.Now().UnixNano())
 	if p.log.Enabled(ctx, slog.LevelDebug) {
 		p.log.Debug(
 			"State changed.",
@@ -832,6 +1291,20 @@ func (p *primary) setState(ctx context.Context, n int32) {
 	}
 	p.storage.primaryStateChange(p, oldN, n)
 
+	// Let any Blast Path tail readers know about new data, and that the
+	// file is done once it leaves the states that accept inserts.
+	switch n {
+	case primaryStateNew,
+		primaryStateOpening,
+		primaryStateInitializingRepls,
+		primaryStateWaiting,
+		primaryStateInserting,
+		primaryStateReplicating:
+		p.tail.publish(p.offset, false)
+	default:
+		p.tail.publish(p.offset, true)
+	}
+
 	// We need to cancel the heart beat timer in any state that is not
 	// one where we expect it to be running in the background. From
 	// the point of initializing the replicas, to deleting the replicas
@@ -922,6 +1395,16 @@ func (p *primary) shutdown(ctx context.Context) {
 	}
 }
 
+// Returns the HighwayHash of the data in the file. This is tracked as data
+// is inserted, unless an insert had to be truncated in which case it is
+// computed by reading the file.
+func (p *primary) uploadHash() (string, error) {
+	if p.fileHash != nil {
+		return p.fileHash.Hash(), nil
+	}
+	return hashFile(p.fd, p.offset)
+}
+
 // Called by the uploader to trigger a Upload of the underlying file.
 func (p *primary) upload(ctx context.Context) {
 	// Set the state
@@ -929,21 +1412,131 @@ func (p *primary) upload(ctx context.Context) {
 	p.setState(ctx, primaryStateUploading)
 	p.log.Debug("Starting upload.")
 
+	// Make sure that any background replication has finished so that the
+	// replicas are up to date before the file leaves the primary.
+	p.waitForReplication()
+
+	// If configured then sync the file now that it is no longer accepting
+	// new data. Compressed files were already synced before compression.
+	if p.settings.SyncPolicy == SyncPolicyOnRotate && !p.settings.Compress {
+		if err := p.fd.Sync(); err != nil {
+			p.log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error syncing the data file, requeuing for upload.",
+				sloghelper.String("file", p.fd.Name()),
+				sloghelper.Error("error", err))
+			p.setState(ctx, primaryStatePendingUpload)
+			p.storage.metrics.PrimaryUploads.IncFailures()
+			return
+		}
+	}
+
+	// Work out the key that the upload time copy is written to. This is
+	// fixed on the first attempt so that every retry writes to the same
+	// object.
+	if p.uploadKey == "" {
+		p.uploadKey = s3UploadTimeKey(p.settings, p.fid, time.Now())
+	}
+
+	// If configured then get the hash of the data so that it can be stored
+	// with the object and checked once the upload is complete.
+	var hash string
+	if p.settings.VerifyUploadHash {
+		var err error
+		if hash, err = p.uploadHash(); err != nil {
+			p.log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error hashing the data file, requeuing for upload.",
+				sloghelper.String("file", p.fd.Name()),
+				sloghelper.Error("error", err))
+			p.setState(ctx, primaryStatePendingUpload)
+			p.storage.metrics.PrimaryUploads.IncFailures()
+			return
+		}
+	}
+
 	// Attempt the upload.
 	fd := p.fd
 	if p.settings.Compress {
 		fd = p.compressFd
 	}
-	if !uploadToS3(ctx, fd, p.fid, p.s3key, p.settings, p.log) {
+	metadata := recordsMetadata(
+		p.settings,
+		hashMetadata(
+			p.settings,
+			compressedMetadata(p.settings, p.offset),
+			hash),
+		p.records.count())
+
+	// The compress index is uploaded before the object so that a read can
+	// never find the object without being able to seek within it.
+	if !uploadCompressIndex(
+		ctx,
+		p.compressIndex,
+		p.s3key,
+		p.settings,
+		p.log,
+	) || !retryUpload(
+		ctx,
+		p.settings,
+		p.log,
+		nil,
+		&p.storage.metrics.UploadRetries,
+		func() bool {
+			return uploadToS3(
+				ctx,
+				fd,
+				p.fid,
+				p.s3key,
+				metadata,
+				p.settings,
+				p.log,
+				&p.storage.metrics.PrimaryUploadDuration,
+				&p.storage.metrics.LastSuccessfulUpload,
+				&p.storage.metrics.UploadsInFlight,
+				&p.storage.metrics.UploadsWaiting)
+		},
+	) || !canaryRead(
+		ctx,
+		fd,
+		p.s3key,
+		p.settings,
+		p.log,
+		&p.storage.metrics.UploadCanaryFailures,
+	) || !verifyUpload(
+		ctx,
+		fd,
+		p.s3key,
+		hash,
+		p.settings,
+		p.log,
+		&p.storage.metrics.UploadHashMismatches,
+	) {
 		p.log.LogAttrs(
 			ctx,
 			slog.LevelWarn,
 			"Requeuing for upload.")
+		atomic.AddInt32(&p.uploadFailures, 1)
+		atomic.AddInt32(&p.storage.uploadFailures, 1)
 		p.setState(ctx, primaryStatePendingUpload)
 		p.storage.metrics.PrimaryUploads.IncFailures()
 		return
 	} else {
+		atomic.StoreInt32(&p.storage.uploadFailures, 0)
 		p.storage.metrics.PrimaryUploads.IncSuccesses()
+		if p.uploadKey != "" {
+			uploadTimeCopy(ctx, fd, p.uploadKey, metadata, p.settings, p.log)
+		}
+		p.storage.notifyUpload(
+			ctx,
+			fd,
+			p.fidStr,
+			"primary",
+			p.s3key,
+			p.records.count(),
+			p.log)
 	}
 
 	// Once the upload is successful we can branch in several directions
@@ -5,7 +5,10 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"math/rand"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,6 +17,8 @@ import (
 
 	"github.com/liquidgecka/blobby/internal/delayqueue"
 	"github.com/liquidgecka/blobby/internal/workqueue"
+	"github.com/liquidgecka/blobby/storage/fid"
+	"github.com/liquidgecka/blobby/storage/metrics"
 )
 
 func TestPrimary_Insert(t *testing.T) {
@@ -72,15 +77,15 @@ func TestPrimary_Insert(t *testing.T) {
 
 	// Setup an ephemeral primary to work with.
 	p := primary{
-		fd:      T.TempFile(),
-		log:     NewTestLogger(),
-		state:   primaryStateWaiting,
-		offset:  1000,
-		storage: &Storage{},
-		remotes: []Remote{&remote},
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		offset:           1000,
+		storage:          &Storage{},
+		remotes:          []Remote{&remote},
+		uploadLargerThan: 1024 * 1024 * 1024,
 		settings: &Settings{
-			UploadLargerThan: 1024 * 1024 * 1024,
-			Compress:         false,
+			Compress: false,
 		},
 	}
 	p.fd.Write(make([]byte, int(p.offset)))
@@ -113,6 +118,91 @@ func TestPrimary_Insert(t *testing.T) {
 	T.Equal(contents, expected)
 }
 
+func TestPrimary_Insert_AsyncReplication(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Mock out storage.primaryStateChange to do nothing.
+	defer monkey.Patch(
+		(*Storage).primaryStateChange,
+		func(s *Storage, p *primary, o, n int32) {},
+	).Unpatch()
+
+	// Mock out the DelayQueue.Alter function so no alteration is
+	// actually attempted.
+	defer monkey.Patch(
+		(*delayqueue.DelayQueue).Alter,
+		func(
+			queue *delayqueue.DelayQueue,
+			token *delayqueue.Token,
+			t time.Time,
+			f func(context.Context),
+		) {
+			return
+		},
+	).Unpatch()
+
+	// Setup a "remote" that will not complete replication until it is
+	// released by the test.
+	release := make(chan struct{})
+	replicated := int32(0)
+	remote := testRemote{
+		name: "test_remote",
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			<-release
+			atomic.StoreInt32(&replicated, 1)
+			return false, nil
+		},
+	}
+
+	// Setup an ephemeral primary to work with.
+	p := primary{
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		storage:          &Storage{},
+		remotes:          []Remote{&remote},
+		uploadLargerThan: 1024 * 1024 * 1024,
+		settings: &Settings{
+			AsyncReplication:           true,
+			AsyncReplicationMaxPending: 1,
+		},
+	}
+
+	// Perform the insert, this must return while the remote is still
+	// blocked.
+	raw := make([]byte, 1024)
+	rand.Read(raw)
+	insertData := InsertData{
+		Source: bytes.NewBuffer(raw),
+		Length: int64(len(raw)),
+	}
+	id, err := p.Insert(context.Background(), &insertData)
+	T.ExpectSuccess(err)
+	T.NotEqual(id, "")
+	T.Equal(p.offset, uint64(len(raw)))
+	T.Equal(atomic.LoadInt32(&replicated), int32(0))
+
+	// Waiting for replication must block until the remote completes.
+	done := make(chan struct{})
+	go func() {
+		p.waitForReplication()
+		close(done)
+	}()
+	select {
+	case <-done:
+		T.Fatalf("waitForReplication returned before replication completed.")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		T.Fatalf("waitForReplication never returned.")
+	}
+	T.Equal(atomic.LoadInt32(&replicated), int32(1))
+}
+
 func TestPrimary_Insert_ReadError(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -166,15 +256,15 @@ func TestPrimary_Insert_ReadError(t *testing.T) {
 
 	// Setup an ephemeral primary to work with.
 	p := primary{
-		fd:      T.TempFile(),
-		log:     NewTestLogger(),
-		state:   primaryStateWaiting,
-		offset:  1000,
-		storage: &Storage{},
-		remotes: []Remote{&remote},
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		offset:           1000,
+		storage:          &Storage{},
+		remotes:          []Remote{&remote},
+		uploadLargerThan: 1024 * 1024 * 1024,
 		settings: &Settings{
-			UploadLargerThan: 1024 * 1024 * 1024,
-			Compress:         false,
+			Compress: false,
 		},
 	}
 	p.fd.Write(make([]byte, int(p.offset)))
@@ -263,15 +353,15 @@ func TestPrimary_Insert_RemoteIsNil(t *testing.T) {
 
 	// Setup an ephemeral primary to work with.
 	p := primary{
-		fd:      T.TempFile(),
-		log:     NewTestLogger(),
-		state:   primaryStateWaiting,
-		offset:  1000,
-		storage: &Storage{},
-		remotes: []Remote{nil},
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		offset:           1000,
+		storage:          &Storage{},
+		remotes:          []Remote{nil},
+		uploadLargerThan: 1024 * 1024 * 1024,
 		settings: &Settings{
-			UploadLargerThan: 1024 * 1024 * 1024,
-			Compress:         false,
+			Compress: false,
 		},
 	}
 	p.fd.Write(make([]byte, int(p.offset)))
@@ -368,15 +458,15 @@ func TestPrimary_Insert_ReplicationFails(t *testing.T) {
 
 	// Setup an ephemeral primary to work with.
 	p := primary{
-		fd:      T.TempFile(),
-		log:     NewTestLogger(),
-		state:   primaryStateWaiting,
-		offset:  1000,
-		storage: &Storage{},
-		remotes: []Remote{&remote},
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		offset:           1000,
+		storage:          &Storage{},
+		remotes:          []Remote{&remote},
+		uploadLargerThan: 1024 * 1024 * 1024,
 		settings: &Settings{
-			UploadLargerThan: 1024 * 1024 * 1024,
-			Compress:         false,
+			Compress: false,
 		},
 	}
 	p.fd.Write(make([]byte, int(p.offset)))
@@ -459,15 +549,15 @@ func TestPrimary_Insert_ShortRead(t *testing.T) {
 
 	// Setup an ephemeral primary to work with.
 	p := primary{
-		fd:      T.TempFile(),
-		log:     NewTestLogger(),
-		state:   primaryStateWaiting,
-		offset:  1000,
-		storage: &Storage{},
-		remotes: []Remote{&remote},
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		offset:           1000,
+		storage:          &Storage{},
+		remotes:          []Remote{&remote},
+		uploadLargerThan: 1024 * 1024 * 1024,
 		settings: &Settings{
-			UploadLargerThan: 1024 * 1024 * 1024,
-			Compress:         false,
+			Compress: false,
 		},
 	}
 	p.fd.Write(make([]byte, int(p.offset)))
@@ -559,15 +649,15 @@ func TestPrimary_Insert_WriteError(t *testing.T) {
 
 	// Setup an ephemeral primary to work with.
 	p := primary{
-		fd:      T.TempFile(),
-		log:     NewTestLogger(),
-		state:   primaryStateWaiting,
-		offset:  1000,
-		storage: &Storage{},
-		remotes: []Remote{&remote},
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		offset:           1000,
+		storage:          &Storage{},
+		remotes:          []Remote{&remote},
+		uploadLargerThan: 1024 * 1024 * 1024,
 		settings: &Settings{
-			UploadLargerThan: 1024 * 1024 * 1024,
-			Compress:         false,
+			Compress: false,
 		},
 	}
 	p.fd.Write(make([]byte, int(p.offset)))
@@ -600,6 +690,91 @@ func TestPrimary_Insert_WriteError(t *testing.T) {
 	T.Equal(contents, expected)
 }
 
+func TestPrimary_Insert_SyncError(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Mock out storage.primaryStateChange to do nothing.
+	stateChange := 0
+	defer monkey.Patch(
+		(*Storage).primaryStateChange,
+		func(s *Storage, p *primary, o, n int32) {
+			switch stateChange {
+			case 0:
+				T.Equal(o, primaryStateWaiting)
+				T.Equal(n, primaryStateInserting)
+			case 1:
+				T.Equal(o, primaryStateInserting)
+				T.Equal(n, primaryStatePendingUpload)
+			default:
+				T.Fatalf("Unexpected state change.")
+			}
+			stateChange += 1
+		},
+	).Unpatch()
+
+	// Mock out the insert function to prevent new work from being
+	// scheduled.
+	defer monkey.Patch(
+		(*workqueue.WorkQueue).Insert,
+		func(q *workqueue.WorkQueue, f func(context.Context)) {
+			return
+		},
+	).Unpatch()
+
+	// Make every sync fail.
+	defer monkey.Patch(
+		(*os.File).Sync,
+		func(f *os.File) error {
+			return fmt.Errorf("EXPECTED")
+		},
+	).Unpatch()
+
+	// Setup a "remote" that should never be replicated too since the
+	// data was never synced.
+	remote := testRemote{
+		name: "test_remote",
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			T.Fatalf("Data should not be replicated.")
+			return false, nil
+		},
+	}
+
+	// Setup an ephemeral primary to work with.
+	p := primary{
+		fd:               T.TempFile(),
+		log:              NewTestLogger(),
+		state:            primaryStateWaiting,
+		offset:           1000,
+		storage:          &Storage{},
+		remotes:          []Remote{&remote},
+		uploadLargerThan: 1024 * 1024 * 1024,
+		settings: &Settings{
+			SyncPolicy: SyncPolicyOnInsert,
+		},
+	}
+	p.fd.Write(make([]byte, int(p.offset)))
+
+	// Perform the insert.
+	raw := make([]byte, 1024)
+	rand.Read(raw)
+	insertData := InsertData{
+		Source: bytes.NewBuffer(raw),
+		Length: int64(len(raw)),
+	}
+	id, err := p.Insert(context.Background(), &insertData)
+	T.ExpectErrorMessage(err, "EXPECTED")
+	T.Equal(id, "")
+
+	// The data should have been truncated away and the file queued for
+	// upload.
+	T.Equal(p.offset, uint64(1000))
+	T.Equal(p.storage.metrics.InternalInsertErrors, int64(1))
+	contents, err := ioutil.ReadFile(p.fd.Name())
+	T.ExpectSuccess(err)
+	T.Equal(contents, make([]byte, 1000))
+}
+
 func TestPrimary_State(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -621,5 +796,261 @@ func TestPrimary_State(t *testing.T) {
 	}
 	T.Equal(
 		p.Status(),
-		"fidTest state=opening size=10kB oldest=1m1s remotes=rem1,rem2")
+		"fidTest state=opening size=10kB records=0 oldest=1m1s "+
+			"remotes=rem1,rem2")
+}
+
+func TestPrimary_ReplicaLag(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a primary with one healthy remote and one remote that is
+	// lagging behind because its replication calls are failing.
+	healthy := testRemote{
+		name: "healthy",
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			return false, nil
+		},
+	}
+	lagging := testRemote{
+		name: "lagging",
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			return false, fmt.Errorf("EXPECTED")
+		},
+	}
+	p := primary{
+		fidStr:         "fidTest",
+		log:            NewTestLogger(),
+		storage:        &Storage{},
+		remotes:        []Remote{&healthy, &lagging},
+		replicaOffsets: make([]uint64, 2),
+		replicaLag:     make([]uint64, 2),
+		settings: &Settings{
+			TrackReplicaLag: true,
+		},
+	}
+
+	// Each failed replication grows the gap between the primary and the
+	// lagging remote while the healthy remote stays in sync.
+	_, err := p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{start: 0, end: 100})
+	T.ExpectErrorMessage(err, "Replication failed")
+	T.Equal(p.replicaLag, []uint64{0, 100})
+	_, err = p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{start: 100, end: 150})
+	T.ExpectErrorMessage(err, "Replication failed")
+	T.Equal(p.replicaLag, []uint64{0, 150})
+	T.Equal(p.maxReplicaLag(), uint64(150))
+
+	// Once the remote catches up the largest observed lag is still
+	// reported.
+	lagging.replicate = healthy.replicate
+	_, err = p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{start: 150, end: 200})
+	T.ExpectSuccess(err)
+	T.Equal(p.replicaOffsets, []uint64{200, 200})
+	T.Equal(p.replicaLag, []uint64{0, 150})
+	T.Equal(
+		p.Status(),
+		"fidTest state=new size=0B records=0 replica-lag=0,150 "+
+			"remotes=healthy,lagging")
+}
+
+func TestPrimary_Replicate_Quorum(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a primary with three remotes where one fails to replicate and
+	// a quorum of two is required.
+	calls := int32(0)
+	deletes := int32(0)
+	healthy := testRemote{
+		name: "healthy",
+		del: func(namespace, fn string) error {
+			return nil
+		},
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			return false, nil
+		},
+	}
+	failing := testRemote{
+		name: "failing",
+		del: func(namespace, fn string) error {
+			atomic.AddInt32(&deletes, 1)
+			return nil
+		},
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			atomic.AddInt32(&calls, 1)
+			return false, fmt.Errorf("EXPECTED")
+		},
+	}
+	p := primary{
+		fidStr:        "fidTest",
+		log:           NewTestLogger(),
+		storage:       &Storage{},
+		remotes:       []Remote{&healthy, &failing, &healthy},
+		failedRemotes: make([]int32, 3),
+		settings: &Settings{
+			ReplicaQuorum: 2,
+		},
+	}
+
+	// The insert succeeds and the failing remote is marked as failed so
+	// that it is not sent any more data, and its copy is deleted so that
+	// it can not be uploaded.
+	_, err := p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{start: 0, end: 100})
+	T.ExpectSuccess(err)
+	T.Equal(p.failedRemotes, []int32{0, 1, 0})
+	T.TryUntil(
+		func() bool { return atomic.LoadInt32(&deletes) == 1 },
+		time.Second)
+	T.Equal(p.remotes[1], Remote(&failing))
+	T.Equal(p.storage.metrics.DegradedInserts, int64(1))
+	_, err = p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{start: 100, end: 150})
+	T.ExpectSuccess(err)
+	T.Equal(atomic.LoadInt32(&calls), int32(1))
+	T.Equal(p.storage.metrics.DegradedInserts, int64(2))
+
+	// Once fewer remotes than the quorum accept the data the insert fails.
+	healthy.replicate = failing.replicate
+	_, err = p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{start: 150, end: 200})
+	T.ExpectErrorMessage(err, "Replication failed")
+}
+
+func TestPrimary_Replicate_Resync(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The remote has lost the first two inserts so it asks for them to be
+	// sent again before accepting the third.
+	fd := T.TempFile()
+	_, err := fd.WriteString("0123456789")
+	T.ExpectSuccess(err)
+	offset := uint64(0)
+	var hashes []string
+	remote := testRemote{
+		name: "remote",
+		del: func(namespace, fn string) error {
+			return nil
+		},
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			if rc.Offset() != offset {
+				return false, ErrReplicaBehind(offset)
+			}
+			offset += rc.Size()
+			hashes = append(hashes, rc.Hash())
+			return false, nil
+		},
+	}
+	p := primary{
+		fd:            fd,
+		fidStr:        "fidTest",
+		log:           NewTestLogger(),
+		storage:       &Storage{},
+		remotes:       []Remote{&remote},
+		failedRemotes: make([]int32, 1),
+		settings:      &Settings{},
+	}
+	p.records.add(0, 2, "hh=first")
+	p.records.add(2, 2, "hh=second")
+	_, err = p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{fd: fd, start: 4, end: 10, hash: "hh=third"})
+	T.ExpectSuccess(err)
+	T.Equal(offset, uint64(10))
+	T.Equal(hashes, []string{"hh=first", "hh=second", "hh=third"})
+
+	// If the missing data does not line up with the known records then
+	// it can not be resent.
+	offset = 1
+	hashes = nil
+	_, err = p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{fd: fd, start: 10, end: 12})
+	T.ExpectErrorMessage(err, "Replication failed")
+	T.Equal(len(hashes), 0)
+
+	// Other errors are not retried.
+	remote.replicate = func(rc RemoteReplicateConfig) (bool, error) {
+		return false, fmt.Errorf("EXPECTED")
+	}
+	_, err = p.replicate(
+		context.Background(),
+		nil,
+		replicatorConfig{fd: fd, start: 10, end: 12})
+	T.ExpectErrorMessage(err, "Replication failed")
+}
+
+func TestPrimary_Upload_FailureStatus(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	p := primary{
+		fd:      T.TempFile(),
+		fidStr:  "fidTest",
+		log:     NewTestLogger(),
+		offset:  10,
+		storage: &Storage{},
+		settings: &Settings{
+			StatusUploadFailures: true,
+			UploadWorkQueue:      workqueue.New(0),
+		},
+	}
+
+	// State changes will attempt to open new primaries which is not
+	// wanted here.
+	defer monkey.Patch(
+		(*Storage).checkIdleFiles,
+		func(*Storage) {},
+	).Unpatch()
+
+	// Patch out the upload so that it always fails.
+	defer monkey.Patch(
+		uploadToS3,
+		func(
+			ctx context.Context,
+			fd *os.File,
+			id fid.FID,
+			key string,
+			metadata map[string]string,
+			s *Settings,
+			l *slog.Logger,
+			h *metrics.DurationHistogram,
+			last *int64,
+		) bool {
+			return false
+		},
+	).Unpatch()
+
+	// Nothing is displayed before the first failure.
+	T.Equal(p.Status(), "fidTest state=new size=10B records=0")
+
+	// Each failure should increment the displayed count.
+	p.upload(context.Background())
+	T.Equal(p.state, primaryStatePendingUpload)
+	T.Equal(p.storage.metrics.PrimaryUploads.Failures, int64(1))
+	T.Equal(
+		p.Status(),
+		"fidTest state=pending-upload size=10B records=0 upload-failures=1")
+	p.upload(context.Background())
+	T.Equal(
+		p.Status(),
+		"fidTest state=pending-upload size=10B records=0 upload-failures=2")
 }
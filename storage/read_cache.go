@@ -0,0 +1,260 @@
+package storage
+
+import (
+	lrulist "container/list"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// The name of the directory within the base directory that the read cache
+// stores its files in. Start() ignores anything in the base directory that
+// is not a regular file so this can never be mistaken for a primary or
+// replica.
+const readCacheDirectory = "read-cache"
+
+// Keeps copies of data that was read from S3 on local disk so that reads of
+// the same data can be served without going back to S3. Each cached read is
+// stored in its own file named after the fid and the range within it.
+// Entries are evicted least recently used first once the cache grows larger
+// than maxBytes, and entries older than maxAge (if set) are evicted when
+// they are next accessed. The cache does not survive restarts, any files
+// left by a previous run are removed by reset().
+type readCache struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	log      *slog.Logger
+
+	lock    sync.Mutex
+	entries map[string]*lrulist.Element
+	lru     lrulist.List
+	size    int64
+
+	// Every removeFID() call starts a new generation. Fids that are removed
+	// while reads are being added to the cache are kept in deleted along
+	// with the generation they were removed in so that reads which started
+	// before then are not added back, these are cleared once no reads are
+	// pending.
+	generation uint64
+	pending    int
+	deleted    map[string]uint64
+}
+
+// A single file in the read cache.
+type readCacheEntry struct {
+	key     string
+	size    int64
+	created time.Time
+}
+
+// Returns the key used to store the data for the given ReadConfig.
+func readCacheKey(rc ReadConfig) string {
+	return fmt.Sprintf("%s-%d-%d", rc.FIDString(), rc.Start(), rc.Length())
+}
+
+// Removes any files left in the cache directory and ensures that the
+// directory exists.
+func (r *readCache) reset() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries = make(map[string]*lrulist.Element)
+	r.lru.Init()
+	r.size = 0
+	if err := os.RemoveAll(r.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(r.dir, 0755)
+}
+
+// Returns a ReadCloser for the cached copy of the data for the given
+// ReadConfig, or nil if the data is not in the cache.
+func (r *readCache) get(rc ReadConfig) io.ReadCloser {
+	key := readCacheKey(rc)
+	r.lock.Lock()
+	elm, ok := r.entries[key]
+	if ok {
+		entry := elm.Value.(*readCacheEntry)
+		if r.maxAge > 0 && time.Since(entry.created) > r.maxAge {
+			r.remove(elm)
+			ok = false
+		} else {
+			r.lru.MoveToFront(elm)
+		}
+	}
+	r.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// The file may have been evicted between releasing the lock and the
+	// open, in which case this is simply a cache miss.
+	fd, err := os.Open(filepath.Join(r.dir, key))
+	if err != nil {
+		return nil
+	}
+	return &limitReadCloser{RC: fd, N: int64(rc.Length())}
+}
+
+// Returns true if the data for rc is in the cache. Unlike get() this does
+// not count as a use of the entry.
+func (r *readCache) has(rc ReadConfig) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	elm, ok := r.entries[readCacheKey(rc)]
+	if !ok {
+		return false
+	}
+	entry := elm.Value.(*readCacheEntry)
+	return r.maxAge == 0 || time.Since(entry.created) <= r.maxAge
+}
+
+// Wraps a ReadCloser returning data for rc so that everything read from it
+// is also written into the cache. The data is only added to the cache if
+// the caller reads all of it successfully before closing. If the cache file
+// can not be created then the original ReadCloser is returned.
+func (r *readCache) tee(
+	ctx context.Context,
+	rc ReadConfig,
+	source io.ReadCloser,
+) io.ReadCloser {
+	fd, err := os.CreateTemp(r.dir, ".tmp-")
+	if err != nil {
+		r.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error creating a read cache file.",
+			sloghelper.Error("error", err))
+		return source
+	}
+	r.lock.Lock()
+	r.pending++
+	generation := r.generation
+	r.lock.Unlock()
+	return &readCacheWriter{
+		ctx:        ctx,
+		cache:      r,
+		fd:         fd,
+		fidStr:     rc.FIDString(),
+		key:        readCacheKey(rc),
+		generation: generation,
+		source:     source,
+		want:       int64(rc.Length()),
+	}
+}
+
+// Adds the data written by w to the cache if ok is true, otherwise the file
+// is discarded. The file is also discarded if its fid was removed after the
+// read started since the data may no longer exist.
+func (r *readCache) commit(w *readCacheWriter, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pending--
+	if r.deleted[w.fidStr] > w.generation {
+		ok = false
+	}
+	if r.pending == 0 {
+		r.deleted = nil
+	}
+	if err := w.fd.Close(); err != nil || !ok {
+		os.Remove(w.fd.Name())
+		return
+	}
+	err := os.Rename(w.fd.Name(), filepath.Join(r.dir, w.key))
+	if err != nil {
+		r.log.LogAttrs(
+			w.ctx,
+			slog.LevelWarn,
+			"Error adding a file to the read cache.",
+			sloghelper.String("file", w.key),
+			sloghelper.Error("error", err))
+		os.Remove(w.fd.Name())
+		return
+	}
+
+	// If two reads of the same data raced then the rename above replaced
+	// the older file so only the accounting needs to be updated.
+	if elm, ok := r.entries[w.key]; ok {
+		r.size -= elm.Value.(*readCacheEntry).size
+		r.lru.Remove(elm)
+	}
+	r.entries[w.key] = r.lru.PushFront(&readCacheEntry{
+		key:     w.key,
+		size:    w.n,
+		created: time.Now(),
+	})
+	r.size += w.n
+	for r.size > r.maxBytes && r.lru.Len() > 0 {
+		r.remove(r.lru.Back())
+	}
+}
+
+// Removes every cached read of the given fid, including any that are still
+// being read.
+func (r *readCache) removeFID(fidStr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.generation++
+	if r.pending > 0 {
+		if r.deleted == nil {
+			r.deleted = make(map[string]uint64)
+		}
+		r.deleted[fidStr] = r.generation
+	}
+	prefix := fidStr + "-"
+	for key, elm := range r.entries {
+		if strings.HasPrefix(key, prefix) {
+			r.remove(elm)
+		}
+	}
+}
+
+// Removes the given element from the cache. This must be called with the
+// lock held.
+func (r *readCache) remove(elm *lrulist.Element) {
+	entry := elm.Value.(*readCacheEntry)
+	r.lru.Remove(elm)
+	delete(r.entries, entry.key)
+	r.size -= entry.size
+	os.Remove(filepath.Join(r.dir, entry.key))
+}
+
+// Copies data read from the source into a cache file as it is read.
+type readCacheWriter struct {
+	ctx        context.Context
+	cache      *readCache
+	fd         *os.File
+	fidStr     string
+	key        string
+	generation uint64
+	source     io.ReadCloser
+	want       int64
+	n          int64
+	err        error
+}
+
+func (r *readCacheWriter) Read(p []byte) (n int, err error) {
+	n, err = r.source.Read(p)
+	if n > 0 && r.err == nil {
+		_, r.err = r.fd.Write(p[:n])
+		r.n += int64(n)
+	}
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return
+}
+
+func (r *readCacheWriter) Close() error {
+	err := r.source.Close()
+	r.cache.commit(r, r.err == nil && r.n == r.want)
+	return err
+}
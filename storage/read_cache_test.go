@@ -0,0 +1,155 @@
+package storage
+
+import (
+	lrulist "container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/storage/fid"
+)
+
+func TestReadCache(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	f := fid.FID{}
+	f.Generate(1)
+	r := readCache{
+		dir:      filepath.Join(T.TempDir(), readCacheDirectory),
+		maxBytes: 10,
+		log:      NewTestLogger(),
+		entries:  make(map[string]*lrulist.Element),
+	}
+	T.ExpectSuccess(r.reset())
+	rc1 := &testReadConfig{fid: f, start: 0, length: 6}
+	rc2 := &testReadConfig{fid: f, start: 6, length: 6}
+
+	// Nothing is cached at first.
+	T.Equal(r.get(rc1), nil)
+
+	// A partial read is not added to the cache.
+	w := r.tee(
+		context.Background(),
+		rc1,
+		ioutil.NopCloser(strings.NewReader("abcdef")))
+	buffer := make([]byte, 3)
+	_, err := io.ReadFull(w, buffer)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(w.Close())
+	T.Equal(r.get(rc1), nil)
+
+	// A full read is added and can then be served from the cache.
+	w = r.tee(
+		context.Background(),
+		rc1,
+		ioutil.NopCloser(strings.NewReader("abcdef")))
+	data, err := ioutil.ReadAll(w)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "abcdef")
+	T.ExpectSuccess(w.Close())
+	cached := r.get(rc1)
+	T.NotEqual(cached, nil)
+	data, err = ioutil.ReadAll(cached)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "abcdef")
+	T.ExpectSuccess(cached.Close())
+
+	// Adding a second entry pushes the cache over its size so the least
+	// recently used entry is evicted.
+	w = r.tee(
+		context.Background(),
+		rc2,
+		ioutil.NopCloser(strings.NewReader("ghijkl")))
+	_, err = ioutil.ReadAll(w)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(w.Close())
+	T.Equal(r.get(rc1), nil)
+	T.Equal(r.size, int64(6))
+	_, err = os.Stat(filepath.Join(r.dir, readCacheKey(rc1)))
+	T.Equal(os.IsNotExist(err), true)
+	cached = r.get(rc2)
+	T.NotEqual(cached, nil)
+	T.ExpectSuccess(cached.Close())
+
+	// Entries older than the maximum age are not served.
+	r.maxAge = time.Millisecond
+	time.Sleep(time.Millisecond * 2)
+	T.Equal(r.get(rc2), nil)
+	T.Equal(r.size, int64(0))
+
+	// Resetting removes anything left in the directory.
+	T.ExpectSuccess(ioutil.WriteFile(
+		filepath.Join(r.dir, "left-over"),
+		[]byte("data"),
+		0644))
+	T.ExpectSuccess(r.reset())
+	files, err := ioutil.ReadDir(r.dir)
+	T.ExpectSuccess(err)
+	T.Equal(len(files), 0)
+}
+
+func TestReadCache_RemoveFIDDuringRead(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	f := fid.FID{}
+	f.Generate(1)
+	other := fid.FID{}
+	other.Generate(1)
+	r := readCache{
+		dir:      filepath.Join(T.TempDir(), readCacheDirectory),
+		maxBytes: 100,
+		log:      NewTestLogger(),
+		entries:  make(map[string]*lrulist.Element),
+	}
+	T.ExpectSuccess(r.reset())
+	rc := &testReadConfig{fid: f, start: 0, length: 6}
+	otherRC := &testReadConfig{fid: other, start: 0, length: 6}
+
+	// The fid is deleted while a read of it is in flight, so the read is
+	// not added to the cache once it completes. Reads of other fids are.
+	w := r.tee(
+		context.Background(),
+		rc,
+		ioutil.NopCloser(strings.NewReader("abcdef")))
+	otherW := r.tee(
+		context.Background(),
+		otherRC,
+		ioutil.NopCloser(strings.NewReader("ghijkl")))
+	_, err := io.ReadFull(w, make([]byte, 3))
+	T.ExpectSuccess(err)
+	r.removeFID(f.String())
+	_, err = ioutil.ReadAll(w)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(w.Close())
+	T.Equal(r.get(rc), nil)
+	_, err = ioutil.ReadAll(otherW)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(otherW.Close())
+	T.Equal(r.has(otherRC), true)
+	files, err := ioutil.ReadDir(r.dir)
+	T.ExpectSuccess(err)
+	T.Equal(len(files), 1)
+
+	// Once no reads are pending the tombstone is cleared, and reads that
+	// start after the delete are cached as normal.
+	T.Equal(len(r.deleted), 0)
+	w = r.tee(
+		context.Background(),
+		rc,
+		ioutil.NopCloser(strings.NewReader("abcdef")))
+	_, err = ioutil.ReadAll(w)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(w.Close())
+	cached := r.get(rc)
+	T.NotEqual(cached, nil)
+	T.ExpectSuccess(cached.Close())
+}
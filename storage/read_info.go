@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+)
+
+// The sources that a read can be served from. These match the read_source
+// label of the reads_total metric.
+const (
+	ReadSourceCache  = "cache"
+	ReadSourceLocal  = "local"
+	ReadSourceRemote = "remote"
+	ReadSourceS3     = "s3"
+)
+
+type readInfoKey struct{}
+
+// Describes how a call to Read() was served. If a ReadInfo is attached to
+// the context given to Read() using NewReadInfoContext() then it will be
+// filled in as the read is processed, allowing the caller to record where
+// the data came from in places like the access log.
+type ReadInfo struct {
+	// The source that served the read, one of the ReadSource constants
+	// above. This is empty if the read failed.
+	Source string
+
+	// The number of bytes that have been read from the io.ReadCloser
+	// returned by Read(). If the data was returned encoded then this
+	// counts the encoded bytes.
+	BytesServed int64
+}
+
+// Returns a copy of the given context that carries the given ReadInfo.
+func NewReadInfoContext(ctx context.Context, info *ReadInfo) context.Context {
+	return context.WithValue(ctx, readInfoKey{}, info)
+}
+
+// Returns the ReadInfo that was stored in the context via
+// NewReadInfoContext(), or nil if there is not one.
+func readInfoFromContext(ctx context.Context) *ReadInfo {
+	if ctx == nil {
+		return nil
+	}
+	info, _ := ctx.Value(readInfoKey{}).(*ReadInfo)
+	return info
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// The extended attribute that the number of records in a file is kept in
+// so that it can be recovered if Blobby restarts before the file is
+// uploaded.
+const recordCountXattr = "user.blobby.records"
+
+// Stores the number of records in records with the file so that it can be
+// recovered at startup. This is best effort, if the file system does not
+// support it then recovered files simply have an unknown record count. It
+// costs a system call per insert so it is only called when
+// Settings.RecordCountMetadata needs the count to survive a restart.
+func saveRecordCount(
+	ctx context.Context,
+	fd *os.File,
+	records *recordHashes,
+	log *slog.Logger,
+) {
+	count := records.count()
+	if count < 0 {
+		return
+	}
+	if err := setRecordCount(fd, count); err != nil {
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Unable to save the record count.",
+			sloghelper.Error("error", err))
+	}
+}
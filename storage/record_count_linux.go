@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Stores count in the record count extended attribute of fd.
+func setRecordCount(fd *os.File, count int) error {
+	return syscall.Setxattr(
+		fd.Name(),
+		recordCountXattr,
+		[]byte(strconv.Itoa(count)),
+		0)
+}
+
+// Returns the count stored by setRecordCount for the file at fn.
+func getRecordCount(fn string) (int, error) {
+	buffer := make([]byte, 20)
+	n, err := syscall.Getxattr(fn, recordCountXattr, buffer)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(buffer[:n]))
+}
@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/storage/fid"
+)
+
+func TestRecordCount(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := getRecordCount(fd.Name())
+	T.ExpectError(err)
+	T.ExpectSuccess(setRecordCount(fd, 12))
+	count, err := getRecordCount(fd.Name())
+	T.ExpectSuccess(err)
+	T.Equal(count, 12)
+}
+
+func TestStorage_RecordCount(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a directory with a replica that has its record count stored,
+	// one that does not, and one that is empty.
+	dir := T.TempDir()
+	fids := make([]string, 3)
+	for i := range fids {
+		f := fid.FID{}
+		f.Generate(uint32(i))
+		fids[i] = f.String()
+		fd, err := os.Create(filepath.Join(dir, "r-"+fids[i]))
+		T.ExpectSuccess(err)
+		if i < 2 {
+			_, err = fd.WriteString("data")
+			T.ExpectSuccess(err)
+		}
+		if i == 0 {
+			T.ExpectSuccess(setRecordCount(fd, 3))
+		}
+		T.ExpectSuccess(fd.Close())
+	}
+
+	s := newStartedTestStorage(T, Settings{
+		BaseDirectory:       dir,
+		RecordCountMetadata: true,
+	})
+
+	// The record counts are recovered where possible.
+	T.Equal(s.replicas[fids[0]].records.count(), 3)
+	T.Equal(s.replicas[fids[1]].records.count(), -1)
+	T.Equal(s.replicas[fids[2]].records.count(), 0)
+	T.Equal(s.replicas[fids[1]].FileStatus().Records, -1)
+
+	// Inserts store the count with the file.
+	for i := 0; i < 2; i++ {
+		_, err := s.Insert(context.Background(), &InsertData{
+			Source: strings.NewReader("data"),
+			Length: 4,
+		})
+		T.ExpectSuccess(err)
+	}
+	s.primariesLock.Lock()
+	T.Equal(len(s.primaries), 1)
+	for _, p := range s.primaries {
+		T.Equal(p.records.count(), 2)
+		T.Equal(p.FileStatus().Records, 2)
+		count, err := getRecordCount(p.fd.Name())
+		T.ExpectSuccess(err)
+		T.Equal(count, 2)
+	}
+	s.primariesLock.Unlock()
+
+	// The count is only stored when it will be uploaded.
+	s.settings.RecordCountMetadata = false
+	_, err := s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.ExpectSuccess(err)
+	s.primariesLock.Lock()
+	defer s.primariesLock.Unlock()
+	for _, p := range s.primaries {
+		T.Equal(p.records.count(), 3)
+		count, err := getRecordCount(p.fd.Name())
+		T.ExpectSuccess(err)
+		T.Equal(count, 2)
+	}
+}
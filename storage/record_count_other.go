@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+// Record counts are only stored on Linux.
+func setRecordCount(fd *os.File, count int) error {
+	return ErrNotPossible{}
+}
+
+// Record counts are only stored on Linux.
+func getRecordCount(fn string) (int, error) {
+	return 0, ErrNotPossible{}
+}
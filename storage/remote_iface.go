@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"io"
 	"log/slog"
 
+	"github.com/liquidgecka/blobby/internal/tracing"
 	"github.com/liquidgecka/blobby/storage/fid"
 )
 
@@ -29,6 +31,17 @@ type ReadConfig interface {
 	// local cache and return 404 if its not found locally.
 	LocalOnly() bool
 
+	// If this returns true then the read will only be served from S3. Local
+	// files and remotes will not be consulted, and if the data has not been
+	// uploaded yet then ErrNotDurable will be returned.
+	DurableOnly() bool
+
+	// If this returns true then the caller is able to accept the data
+	// still gzip compressed. If the ID covers an entire compressed object
+	// in S3 then Read may return an *EncodedReadCloser for the raw object
+	// rather than decompressing it.
+	AcceptGzip() bool
+
 	// Returns the Logger that is associated with this Read operation. If
 	// this returns nil then a logger will be created from the BAseLogger
 	// in the Storage object.
@@ -51,6 +64,10 @@ type RemoteReplicateConfig interface {
 	NameSpace() string
 	Offset() uint64
 	Size() uint64
+
+	// Returns the Trace that the replication should be recorded within.
+	// This will be nil if tracing is not enabled for the request.
+	Tracer() *tracing.Trace
 }
 
 // An interface that the Storage object will use when interfacing with remote
@@ -60,7 +77,36 @@ type Remote interface {
 	Delete(namespace, fn string) error
 	HeartBeat(namespace, fn string) (bool, error)
 	Initialize(namespace, fn string) error
-	Read(rc ReadConfig) (io.ReadCloser, error)
+	Read(ctx context.Context, rc ReadConfig) (io.ReadCloser, error)
 	Replicate(rc RemoteReplicateConfig) (bool, error)
 	String() string
 }
+
+// Returns the failure domain (such as a rack or zone) that the remote is
+// in if it implements a FailureDomain() method, otherwise an empty string.
+func FailureDomain(r Remote) string {
+	if d, ok := r.(interface{ FailureDomain() string }); ok {
+		return d.FailureDomain()
+	}
+	return ""
+}
+
+// Returns true if no two of the given remotes are in the same failure
+// domain, and none are in the local zone if one is given. Remotes that do
+// not report a failure domain are ignored.
+func domainsSpread(zone string, remotes []Remote) bool {
+	seen := make(map[string]bool, len(remotes)+1)
+	if zone != "" {
+		seen[zone] = true
+	}
+	for _, r := range remotes {
+		if domain := FailureDomain(r); domain == "" {
+			continue
+		} else if seen[domain] {
+			return false
+		} else {
+			seen[domain] = true
+		}
+	}
+	return true
+}
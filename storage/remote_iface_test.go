@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+// A Remote that reports a fixed failure domain.
+type zoneRemote struct {
+	Remote
+	zone string
+}
+
+func (z *zoneRemote) FailureDomain() string {
+	return z.zone
+}
+
+func TestDomainsSpread(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	a := &zoneRemote{zone: "a"}
+	b := &zoneRemote{zone: "b"}
+	none := &zoneRemote{}
+	T.Equal(domainsSpread("", nil), true)
+	T.Equal(domainsSpread("", []Remote{a, b}), true)
+	T.Equal(domainsSpread("", []Remote{a, none, none}), true)
+	T.Equal(domainsSpread("", []Remote{a, b, &zoneRemote{zone: "a"}}), false)
+
+	// A remote in the local zone is not spread.
+	T.Equal(domainsSpread("c", []Remote{a, b}), true)
+	T.Equal(domainsSpread("a", []Remote{a, none}), false)
+
+	// Remotes that can not report a failure domain are ignored.
+	T.Equal(domainsSpread("", []Remote{&testRemote{}, &testRemote{}}), true)
+}
@@ -1,13 +1,11 @@
 package storage
 
 import (
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
-	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -17,20 +15,28 @@ import (
 	"github.com/liquidgecka/blobby/internal/delayqueue"
 	"github.com/liquidgecka/blobby/internal/human"
 	"github.com/liquidgecka/blobby/internal/sloghelper"
+	"github.com/liquidgecka/blobby/internal/tracing"
 	"github.com/liquidgecka/blobby/storage/fid"
 	"github.com/liquidgecka/blobby/storage/hasher"
 )
 
+// If a primary replicates data that starts no more than this many bytes
+// past the end of a replica then the replica asks the primary to resend the
+// missing data rather than failing. Larger gaps fail the replica.
+const replicaResyncMaxBytes = 1024 * 1024 * 16
+
 const (
 	replicaStateNew = int32(iota)
 	replicaStateOpening
 	replicaStateWaiting
 	replicaStateAppending
+	replicaStateOrphaned
 	replicaStateFailed
 	replicaStatePendingCompression
 	replicaStateCompressing
 	replicaStatePendingUpload
 	replicaStateUploading
+	replicaStateRetained
 	replicaStatePendingDelete
 	replicaStateDeletingCompressed
 	replicaStateClosingCompressed
@@ -44,11 +50,13 @@ var replicaStateStrings = map[int32]string{
 	replicaStateOpening:            "opening",
 	replicaStateWaiting:            "waiting",
 	replicaStateAppending:          "appending",
+	replicaStateOrphaned:           "orphaned",
 	replicaStateFailed:             "failed",
 	replicaStatePendingCompression: "pending-compression",
 	replicaStateCompressing:        "compressing",
 	replicaStatePendingUpload:      "pending-upload",
 	replicaStateUploading:          "uploading",
+	replicaStateRetained:           "retained",
 	replicaStatePendingDelete:      "pending-delete",
 	replicaStateDeletingCompressed: "deleting-compressed",
 	replicaStateClosingCompressed:  "closing-compressed",
@@ -70,23 +78,45 @@ type replica struct {
 	// Tracks where this fid will end up in S3.
 	s3key string
 
+	// The key that a copy of the replica is written to if
+	// S3KeyUploadFormat is configured, set on the first upload attempt.
+	uploadKey string
+
 	// Unlike primaries the Replicas can be talked with in parallel and
 	// as such they need locking to project that condition.
 	lock sync.Mutex
 
-	// The state of this replica.
-	state int32
+	// The state of this replica, and the time (in unix nanoseconds) that
+	// it moved into that state.
+	state        int32
+	stateChanged int64
 
 	// The file descriptor to the open file on disk.
 	fd *os.File
 
+	// Tracks readers that are reading directly from fd so that it is not
+	// closed while they are still using it.
+	fdRefs fileRefs
+
 	// If the file needs to be compressed then this will be a pointer to the
 	// compressed file descriptor.
 	compressFd *os.File
 
+	// The index of the compressed file if Settings.CompressIndexInterval
+	// is set, this is uploaded along with the compressed file.
+	compressIndex *compressIndex
+
 	// The current write offset within the file.
 	offset uint64
 
+	// The largest number of bytes that the primary has been seen to be
+	// ahead of this replica since the replica last caught up. This is only
+	// tracked while the replica is waiting for or appending data.
+	lag uint64
+
+	// The number of times that uploading this file has failed.
+	uploadFailures int32
+
 	// Tracks the amount of time that the replica has been in an uploadable
 	// state for monitoring of upload failures.
 	queuedForUpload time.Time
@@ -101,6 +131,16 @@ type replica struct {
 	heartBeatLast  time.Time
 	heartBeatToken delayqueue.Token
 
+	// If Settings.RetainForReads is enabled then this Token is used to
+	// delete the replica once it has been retained for DelayDelete.
+	retainToken delayqueue.Token
+
+	// The hash of each insert into the file so that it can be checked by
+	// Scrub(), and set to 1 if a scrub found that the file no longer
+	// matches and Settings.ScrubQuarantine is enabled.
+	records     recordHashes
+	quarantined int32
+
 	// All logging will be routed through this logger.
 	log *slog.Logger
 }
@@ -123,10 +163,27 @@ func (r *replica) Compress(ctx context.Context) {
 	r.setState(ctx, replicaStateCompressing)
 	r.log.Debug("Compressing the file.")
 
+	// If configured then sync the file now that it is no longer accepting
+	// new data.
+	if r.settings.SyncPolicy == SyncPolicyOnRotate {
+		if err := r.fd.Sync(); err != nil {
+			r.log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error syncing the data file.",
+				sloghelper.String("file", r.fd.Name()),
+				sloghelper.Error("error", err))
+			r.setState(ctx, replicaStatePendingCompression)
+			return
+		}
+	}
+
 	// Open the file that will store the compressed data long term.
-	fpath := filepath.Join(r.settings.BaseDirectory, r.fidStr) + ".gz"
+	compressor := r.settings.compressor()
+	fpath := r.settings.dataPath(r.fidStr, r.fidStr) +
+		compressor.Extension()
 	flags := os.O_CREATE | os.O_RDWR | os.O_APPEND | os.O_TRUNC
-	mode := os.FileMode(0644)
+	mode := r.settings.fileMode()
 	var err error
 	if r.compressFd, err = os.OpenFile(fpath, flags, mode); err != nil {
 		// Log the error and then set the state to complete since the
@@ -153,16 +210,17 @@ func (r *replica) Compress(ctx context.Context) {
 		return
 	}
 
-	// Create a gzip writer. Note that any error here is going to purely
-	// be related to the compression level so its okay to just panic.
-	zipper, err := gzip.NewWriterLevel(r.compressFd, r.settings.CompressLevel)
+	// Copy data from the source file into the compressor. If a compress
+	// index interval is configured then this also builds the index that
+	// will be uploaded alongside the compressed object.
+	start := time.Now()
+	r.compressIndex, err = r.settings.compressData(
+		r.compressFd,
+		r.fd,
+		compressor,
+		r.settings.compressLevel(),
+		r.offset)
 	if err != nil {
-		panic(err)
-	}
-
-	// Copy data from the source file into the gzipper.
-	buffer := [4096]byte{}
-	if _, err = io.CopyBuffer(zipper, r.fd, buffer[:]); err != nil {
 		r.log.LogAttrs(
 			ctx,
 			slog.LevelError,
@@ -174,20 +232,42 @@ func (r *replica) Compress(ctx context.Context) {
 		return
 	}
 
-	// Close out the gzip routine.
-	if err = zipper.Close(); err != nil {
-		r.log.LogAttrs(
-			ctx,
-			slog.LevelError,
-			"Error closing the compressed file.",
-			sloghelper.String("file", r.compressFd.Name()),
-			sloghelper.Error("error", err))
-		r.setState(ctx, replicaStatePendingCompression)
-		return
+	// If configured then read the compressed file back to ensure that it
+	// inflates to the original data before it gets uploaded. If it doesn't
+	// then the bad file is removed and compression is attempted again.
+	if r.settings.VerifyCompression {
+		if err = verifyCompressed(r.compressFd, compressor, r.offset); err != nil {
+			r.log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Compressed file failed verification.",
+				sloghelper.String("file", r.compressFd.Name()),
+				sloghelper.Error("error", err))
+			if err := removeCompressed(r.compressFd); err != nil {
+				r.log.LogAttrs(
+					ctx,
+					slog.LevelError,
+					"Error removing the bad compressed file.",
+					sloghelper.String("file", r.compressFd.Name()),
+					sloghelper.Error("error", err))
+			}
+			r.compressFd = nil
+			r.setState(ctx, replicaStatePendingCompression)
+			return
+		}
 	}
 
 	// Success.
 	r.log.Info("Successfully compressed the data file.")
+	old, level := r.settings.compressed(r.offset, time.Since(start))
+	if old != level {
+		r.log.LogAttrs(
+			ctx,
+			slog.LevelInfo,
+			"Adjusted the compression level.",
+			sloghelper.Int("old-level", old),
+			sloghelper.Int("level", level))
+	}
 	r.setState(ctx, replicaStatePendingUpload)
 }
 
@@ -258,12 +338,13 @@ func (r *replica) Delete(ctx context.Context) {
 		} else {
 			// Success
 			r.storage.metrics.FilesDeleted.IncSuccesses()
+			atomic.AddInt64(&r.storage.metrics.DiskBytes, -int64(r.offset))
 			r.log.Info("File removed from disk.")
 		}
 
 		// Close the file descriptor.
 		r.setState(ctx, replicaStateClosing)
-		if err := r.fd.Close(); err != nil {
+		if err := r.fdRefs.close(r.fd); err != nil {
 			// Not much we can do here besides log.
 			r.log.LogAttrs(
 				ctx,
@@ -284,6 +365,7 @@ func (r *replica) Delete(ctx context.Context) {
 // then this return nil, otherwise this will return an error
 // explaining the problem.
 func (r *replica) HeartBeat(ctx context.Context) error {
+	defer tracing.FromContext(ctx).NewChild("storage/(replica.HeartBeat)").End()
 	r.heartBeatLock.Lock()
 	defer r.heartBeatLock.Unlock()
 	r.log.LogAttrs(
@@ -299,6 +381,12 @@ func (r *replica) HeartBeat(ctx context.Context) error {
 	case replicaStateOpening:
 	case replicaStateWaiting:
 	case replicaStateAppending:
+	case replicaStateOrphaned:
+		// The primary has come back during the orphan grace period so
+		// the replica can go back to waiting for updates.
+		if !r.resume(ctx) {
+			return ErrWrongReplicaState{}
+		}
 	default:
 		// Any other state is not valid and should return an error.
 		return ErrWrongReplicaState{}
@@ -306,7 +394,32 @@ func (r *replica) HeartBeat(ctx context.Context) error {
 	r.heartBeatLast = time.Now()
 	r.settings.DelayQueue.Alter(
 		&r.heartBeatToken,
-		time.Now().Add(r.settings.HeartBeatTime),
+		time.Now().Add(r.settings.heartBeatTimeout()),
+		r.event)
+	return nil
+}
+
+// Called when a primary attempts to initialize a replica that already
+// exists, typically because it retried an initialize call that failed in
+// transit. If the replica is still able to accept data then this is treated
+// like a heart beat, otherwise ErrWrongReplicaState is returned.
+func (r *replica) Reinitialize(ctx context.Context) error {
+	r.heartBeatLock.Lock()
+	defer r.heartBeatLock.Unlock()
+	switch r.state {
+	case replicaStateWaiting:
+	case replicaStateAppending:
+	default:
+		return ErrWrongReplicaState{}
+	}
+	r.log.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Replica was initialized again by the primary.")
+	r.heartBeatLast = time.Now()
+	r.settings.DelayQueue.Alter(
+		&r.heartBeatToken,
+		time.Now().Add(r.settings.heartBeatTimeout()),
 		r.event)
 	return nil
 }
@@ -317,9 +430,9 @@ func (r *replica) Open(ctx context.Context) error {
 	r.setState(ctx, replicaStateOpening)
 
 	// Open the actual file on disk.
-	fpath := filepath.Join(r.settings.BaseDirectory, "r-"+r.fidStr)
+	fpath := r.settings.dataPath(r.fidStr, "r-"+r.fidStr)
 	flags := os.O_CREATE | os.O_RDWR | os.O_APPEND
-	mode := os.FileMode(0644)
+	mode := r.settings.fileMode()
 	var err error
 	r.log.Debug("Opening file")
 	if r.fd, err = os.OpenFile(fpath, flags, mode); err != nil {
@@ -332,13 +445,21 @@ func (r *replica) Open(ctx context.Context) error {
 		return err
 	}
 
-	// TODO: Falloc support on linux?
+	// Reserve space for the file so that it is not fragmented as data is
+	// replicated into it. Failing to do so is not fatal.
+	if err := preallocate(r.fd, r.settings.PreallocateBytes); err != nil {
+		r.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error preallocating space for the file.",
+			sloghelper.Error("error", err))
+	}
 
 	// Setup the DelayQueue Token that will be used to managing heart beat
 	// timeouts and such.
 	r.settings.DelayQueue.Alter(
 		&r.heartBeatToken,
-		time.Now().Add(r.settings.HeartBeatTime),
+		time.Now().Add(r.settings.heartBeatTimeout()),
 		r.event)
 
 	// Set the replica state to Waiting which should automatically
@@ -355,11 +476,24 @@ func (r *replica) Replicate(
 	ctx context.Context,
 	rc RemoteReplicateConfig,
 ) error {
+	// Setup a tracer that will track the time taken inside of the
+	// Replicate() call. This continues any trace that was propagated
+	// from the primary via the context.
+	trace := tracing.FromContext(ctx).NewChild("storage/(replica.Replicate)")
+	defer trace.End()
+
 	// Lock to ensure that we only process one operation at a time
 	// in this replica.
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
+	// A replicate call from a primary that was thought to be lost counts
+	// as the primary resuming, so an orphaned replica goes back to
+	// waiting for updates.
+	if r.state == replicaStateOrphaned {
+		r.resumeLocked(ctx)
+	}
+
 	// If the replica is not in the waiting state then we can not
 	// progress forward.
 	if r.state != replicaStateWaiting {
@@ -374,6 +508,17 @@ func (r *replica) Replicate(
 			replicaStateStrings[r.state])
 	}
 
+	// Track how far behind the primary this replica is, which is the data
+	// that the primary has written before this call that the replica is
+	// missing. The data in this call is not counted since a replica that
+	// is keeping up always receives it at its current offset. This is
+	// cleared once the replica has caught up.
+	if start := rc.Offset(); start > r.offset {
+		if gap := start - r.offset; gap > atomic.LoadUint64(&r.lag) {
+			atomic.StoreUint64(&r.lag, gap)
+		}
+	}
+
 	// Set the state to appending.
 	r.setState(ctx, replicaStateAppending)
 
@@ -393,6 +538,19 @@ func (r *replica) Replicate(
 					"request-offset",
 					strconv.FormatUint(rcOffset, 10)))
 		}
+		// If the primary is only a little ahead then a replicate call was
+		// likely lost or reordered in transit. The primary is told how
+		// much data the replica has so it can resend the rest.
+		if rcOffset > r.offset && rcOffset-r.offset <= replicaResyncMaxBytes {
+			r.log.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"The replica is behind the primary, requesting a resync.",
+				sloghelper.Uint64("current-offset", r.offset),
+				sloghelper.Uint64("request-offset", rcOffset))
+			r.setState(ctx, replicaStateWaiting)
+			return ErrReplicaBehind(r.offset)
+		}
 		r.setState(ctx, replicaStateFailed)
 		return fmt.Errorf(""+
 			"Attempt to replicate to a replica where the offsets do not "+
@@ -418,7 +576,10 @@ func (r *replica) Replicate(
 
 	// Copy the data into the file.
 	buffer := [32 * 1024]byte{}
-	if n, err := io.CopyBuffer(hsum, rc.GetBody(), buffer[:]); err != nil {
+	copyTrace := trace.NewChild("storage/(replica.Replicate):copying")
+	n, err := io.CopyBuffer(hsum, rc.GetBody(), buffer[:])
+	copyTrace.End()
+	if err != nil {
 		r.log.LogAttrs(
 			ctx,
 			slog.LevelError,
@@ -457,14 +618,35 @@ func (r *replica) Replicate(
 			"the one we expected. (%s)",
 			hsum.Hash(),
 			rc.Hash())
-	} else {
-		r.offset += uint64(n)
+	} else if r.settings.SyncPolicy == SyncPolicyOnInsert {
+		// Make sure the data is on stable storage before acknowledging it
+		// to the primary. The offset is not advanced if this fails, and the
+		// replica is failed so that the primary stops using it.
+		syncTrace := trace.NewChild("storage/(replica.Replicate):syncing")
+		err := r.fd.Sync()
+		syncTrace.End()
+		if err != nil {
+			r.log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error syncing replicated data to disk.",
+				sloghelper.Error("error", err))
+			r.setState(ctx, replicaStateFailed)
+			return fmt.Errorf("Error syncing replica: %s", err.Error())
+		}
+	}
+	r.records.add(r.offset, uint64(n), rc.Hash())
+	r.offset += uint64(n)
+	atomic.StoreUint64(&r.lag, 0)
+	if r.settings.RecordCountMetadata {
+		saveRecordCount(ctx, r.fd, &r.records, r.log)
 	}
+	atomic.AddInt64(&r.storage.metrics.DiskBytes, n)
 
 	// Reset the heart beat timer since inserts count as a heart beat.
 	r.settings.DelayQueue.Alter(
 		&r.heartBeatToken,
-		time.Now().Add(r.settings.HeartBeatTime),
+		time.Now().Add(r.settings.heartBeatTimeout()),
 		r.event)
 
 	// Put the file back in the Waiting state.
@@ -483,13 +665,39 @@ func (r *replica) Status() string {
 	b.WriteString(replicaStateStrings[state])
 	b.WriteString(" size=")
 	b.WriteString(human.Bytes(r.offset))
+	if records := r.records.count(); records >= 0 {
+		b.WriteString(" records=")
+		b.WriteString(strconv.Itoa(records))
+	}
+	failures := atomic.LoadInt32(&r.uploadFailures)
+	if failures > 0 && r.settings.StatusUploadFailures {
+		b.WriteString(" upload-failures=")
+		b.WriteString(strconv.FormatInt(int64(failures), 10))
+	}
 	return b.String()
 }
 
+// Like Status() but returns the status as a structure that can be encoded
+// for tooling.
+func (r *replica) FileStatus() FileStatus {
+	fs := FileStatus{
+		FID:     r.fidStr,
+		State:   replicaStateStrings[atomic.LoadInt32(&r.state)],
+		Size:    r.offset,
+		Records: r.records.count(),
+	}
+	failures := atomic.LoadInt32(&r.uploadFailures)
+	if failures > 0 && r.settings.StatusUploadFailures {
+		fs.UploadFailures = failures
+	}
+	return fs
+}
+
 // Called by the http interface in order to trigger the deletion process.
 // This doesn't actually delete the file, it just gets the replica into
 // the delete queue in the storage interface.
 func (r *replica) QueueDelete(ctx context.Context) error {
+	defer tracing.FromContext(ctx).NewChild("storage/(replica.QueueDelete)").End()
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
@@ -497,11 +705,14 @@ func (r *replica) QueueDelete(ctx context.Context) error {
 	// from a few key places in the flow.
 	switch r.state {
 	case replicaStateWaiting:
+	case replicaStateOrphaned:
 	case replicaStateFailed:
 
 	// There are a few places where its actually okay to attempt to queue
 	// a delete as well. In these states the file is already deleting so
 	// there is no danger accepting the call.
+	case replicaStateRetained:
+		fallthrough
 	case replicaStatePendingDelete:
 		fallthrough
 	case replicaStateClosingCompressed:
@@ -550,25 +761,147 @@ func (r *replica) Upload(ctx context.Context) {
 	r.setState(ctx, replicaStateUploading)
 	r.log.Debug("Starting upload.")
 
+	// If configured then sync the file now that it is no longer accepting
+	// new data. Compressed files were already synced before compression.
+	if r.settings.SyncPolicy == SyncPolicyOnRotate && !r.settings.Compress {
+		if err := r.fd.Sync(); err != nil {
+			r.log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error syncing the data file, requeuing for upload.",
+				sloghelper.String("file", r.fd.Name()),
+				sloghelper.Error("error", err))
+			r.setState(ctx, replicaStatePendingUpload)
+			r.storage.metrics.ReplicaUploads.IncFailures()
+			return
+		}
+	}
+
+	// Work out the key that the upload time copy is written to. This is
+	// fixed on the first attempt so that every retry writes to the same
+	// object.
+	if r.uploadKey == "" {
+		r.uploadKey = s3UploadTimeKey(r.settings, r.fid, time.Now())
+	}
+
+	// If configured then get the hash of the data so that it can be stored
+	// with the object and checked once the upload is complete. Replicas do
+	// not track the hash as data arrives so the file is read to compute it.
+	var hash string
+	if r.settings.VerifyUploadHash {
+		var err error
+		if hash, err = hashFile(r.fd, r.offset); err != nil {
+			r.log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error hashing the data file, requeuing for upload.",
+				sloghelper.String("file", r.fd.Name()),
+				sloghelper.Error("error", err))
+			r.setState(ctx, replicaStatePendingUpload)
+			r.storage.metrics.ReplicaUploads.IncFailures()
+			return
+		}
+	}
+
 	// Attempt the upload.
 	fd := r.fd
 	if r.settings.Compress {
 		fd = r.compressFd
 	}
-	if !uploadToS3(ctx, fd, r.fid, r.s3key, r.settings, r.log) {
+	metadata := recordsMetadata(
+		r.settings,
+		hashMetadata(
+			r.settings,
+			compressedMetadata(r.settings, r.offset),
+			hash),
+		r.records.count())
+
+	// The compress index is uploaded before the object so that a read can
+	// never find the object without being able to seek within it.
+	if !uploadCompressIndex(
+		ctx,
+		r.compressIndex,
+		r.s3key,
+		r.settings,
+		r.log,
+	) || !retryUpload(
+		ctx,
+		r.settings,
+		r.log,
+		&r.lock,
+		&r.storage.metrics.UploadRetries,
+		func() bool {
+			return uploadToS3(
+				ctx,
+				fd,
+				r.fid,
+				r.s3key,
+				metadata,
+				r.settings,
+				r.log,
+				&r.storage.metrics.ReplicaUploadDuration,
+				&r.storage.metrics.LastSuccessfulUpload,
+				&r.storage.metrics.UploadsInFlight,
+				&r.storage.metrics.UploadsWaiting)
+		},
+	) || !canaryRead(
+		ctx,
+		fd,
+		r.s3key,
+		r.settings,
+		r.log,
+		&r.storage.metrics.UploadCanaryFailures,
+	) || !verifyUpload(
+		ctx,
+		fd,
+		r.s3key,
+		hash,
+		r.settings,
+		r.log,
+		&r.storage.metrics.UploadHashMismatches,
+	) {
 		r.log.LogAttrs(
 			ctx,
 			slog.LevelWarn,
 			"Requeuing for upload.")
+		atomic.AddInt32(&r.uploadFailures, 1)
+		atomic.AddInt32(&r.storage.uploadFailures, 1)
 		r.setState(ctx, replicaStatePendingUpload)
 		r.storage.metrics.ReplicaUploads.IncFailures()
 		return
+	}
+	atomic.StoreInt32(&r.storage.uploadFailures, 0)
+	if r.uploadKey != "" {
+		uploadTimeCopy(ctx, fd, r.uploadKey, metadata, r.settings, r.log)
+	}
+	r.storage.notifyUpload(
+		ctx,
+		fd,
+		r.fidStr,
+		"replica",
+		r.s3key,
+		r.records.count(),
+		r.log)
+	if r.settings.RetainForReads && r.settings.DelayDelete > 0 {
+		r.setState(ctx, replicaStateRetained)
+		r.storage.metrics.ReplicaUploads.IncSuccesses()
 	} else {
 		r.setState(ctx, replicaStatePendingDelete)
 		r.storage.metrics.ReplicaUploads.IncSuccesses()
 	}
 }
 
+// Called by the DelayQueue once an uploaded replica has been retained for
+// Settings.DelayDelete. This queues the replica for deletion.
+func (r *replica) retainExpired(ctx context.Context) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state == replicaStateRetained {
+		r.log.Debug("Retention period is over, queuing for delete.")
+		r.setState(ctx, replicaStatePendingDelete)
+	}
+}
+
 // Called when the DelayQueue event is triggered. This can only really happen
 // if the primary has not properly sent a heart beat in a reasonable amount of
 // time. This gets called in a goroutine via the DelayQueue worker.
@@ -588,6 +921,40 @@ func (r *replica) event(ctx context.Context) {
 		return
 	}
 
+	// If there is a grace period configured then the upload is deferred
+	// for a while in case the primary was only briefly unreachable. A
+	// replica that has failed can not accept more data so there is no
+	// point in waiting for it.
+	if r.state == replicaStateWaiting && r.settings.OrphanGracePeriod > 0 {
+		r.log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"The replica may have been orphaned, waiting before uploading.",
+			sloghelper.Duration("grace-period", r.settings.OrphanGracePeriod))
+		r.setState(ctx, replicaStateOrphaned)
+		r.settings.DelayQueue.Alter(
+			&r.heartBeatToken,
+			time.Now().Add(r.settings.OrphanGracePeriod),
+			r.graceExpired)
+		return
+	}
+	r.orphaned(ctx)
+}
+
+// Called via the DelayQueue when the orphan grace period has expired without
+// the primary resuming heart beats.
+func (r *replica) graceExpired(ctx context.Context) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state != replicaStateOrphaned {
+		return
+	}
+	r.orphaned(ctx)
+}
+
+// Moves an orphaned replica into the upload process. This must be called
+// with the lock held.
+func (r *replica) orphaned(ctx context.Context) {
 	// Metrics
 	atomic.AddInt64(&r.storage.metrics.ReplicaOrphaned, 1)
 
@@ -609,10 +976,38 @@ func (r *replica) event(ctx context.Context) {
 	}
 }
 
+// Returns an orphaned replica to the waiting state. This returns false if
+// the replica is no longer orphaned, which happens if the grace period
+// expired before the lock could be obtained.
+func (r *replica) resume(ctx context.Context) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state != replicaStateOrphaned {
+		return false
+	}
+	r.resumeLocked(ctx)
+	return true
+}
+
+// Like resume() except that the lock must already be held and the state
+// must already be known to be orphaned.
+func (r *replica) resumeLocked(ctx context.Context) {
+	r.log.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"The primary has resumed, the replica is no longer orphaned.")
+	r.setState(ctx, replicaStateWaiting)
+	r.settings.DelayQueue.Alter(
+		&r.heartBeatToken,
+		time.Now().Add(r.settings.heartBeatTimeout()),
+		r.event)
+}
+
 // Sets the state of the replica in an atomic way.
 func (r *replica) setState(ctx context.Context, n int32) {
 	// Change the state locally.
 	oldN := atomic.SwapInt32(&r.state, n)
+	atomic.StoreInt64(&r.stateChanged, time.Now().UnixNano())
 	if r.log.Enabled(ctx, slog.LevelDebug) {
 		r.log.Debug(
 			"state changed.",
@@ -626,11 +1021,17 @@ func (r *replica) setState(ctx context.Context, n int32) {
 	switch n {
 	case replicaStateWaiting:
 	case replicaStateAppending:
+	case replicaStateOrphaned:
 	case replicaStateFailed:
 	default:
 		r.settings.DelayQueue.Cancel(&r.heartBeatToken)
 	}
 
+	// Lag is only meaningful while the replica is following the primary.
+	if n != replicaStateWaiting && n != replicaStateAppending {
+		atomic.StoreUint64(&r.lag, 0)
+	}
+
 	// If the file has moved into an uploadable state then we need to track
 	// it, and if its been uploaded then we need to remove that tracking.
 	switch n {
@@ -638,7 +1039,7 @@ func (r *replica) setState(ctx context.Context, n int32) {
 		if r.queuedForUpload == (time.Time{}) {
 			r.queuedForUpload = time.Now()
 		}
-	case replicaStatePendingDelete:
+	case replicaStateRetained, replicaStatePendingDelete:
 		r.queuedForUpload = time.Time{}
 	}
 
@@ -648,6 +1049,14 @@ func (r *replica) setState(ctx context.Context, n int32) {
 		r.settings.CompressWorkQueue.Insert(r.Compress)
 	case replicaStatePendingUpload:
 		r.settings.UploadWorkQueue.Insert(r.Upload)
+	case replicaStateRetained:
+		r.log.Info(
+			"Retaining the uploaded file for reads.",
+			sloghelper.String("time", r.settings.DelayDelete.String()))
+		r.settings.DelayQueue.Alter(
+			&r.retainToken,
+			time.Now().Add(r.settings.DelayDelete),
+			r.retainExpired)
 	case replicaStatePendingDelete:
 		r.settings.DeleteLocalWorkQueue.Insert(r.Delete)
 	case replicaStateCompleted:
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"sync"
+)
+
+// Tracks which remotes hold replicas of the primaries created by this
+// Storage so that reads for those files that can not be served from the
+// local file, for example because the primary was quarantined, can be tried
+// against the replicas before falling back to S3. This is only kept in
+// memory on the machine that created the file, so it is lost on restart.
+// Other machines instead ask every remote returned by
+// Settings.ReplicaHolders when the creator can not be reached. Entries are
+// added once a primary has initialized its replicas and removed when the
+// primary completes, at which point the data is in S3 and the replicas have
+// been deleted.
+type replicaLocations struct {
+	lock    sync.Mutex
+	remotes map[string][]Remote
+}
+
+// Records the remotes that hold replicas of the given fid. Remotes that
+// are nil (because they failed to initialize) are skipped.
+func (r *replicaLocations) add(fid string, remotes []Remote) {
+	holders := make([]Remote, 0, len(remotes))
+	for _, remote := range remotes {
+		if remote != nil {
+			holders = append(holders, remote)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.remotes == nil {
+		r.remotes = make(map[string][]Remote)
+	}
+	r.remotes[fid] = holders
+}
+
+// Returns the remotes that are known to hold replicas of the given fid, in
+// the order they were assigned.
+func (r *replicaLocations) get(fid string) []Remote {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.remotes[fid]
+}
+
+// Forgets the replicas of the given fid.
+func (r *replicaLocations) remove(fid string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.remotes, fid)
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/storage/fid"
+)
+
+func TestReplicaLocations(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r1 := &testRemote{name: "r1"}
+	r2 := &testRemote{name: "r2"}
+	l := replicaLocations{}
+	T.Equal(len(l.get("fid")), 0)
+
+	// Remotes that failed to initialize are not recorded.
+	l.add("fid", []Remote{r1, nil, r2})
+	T.Equal(l.get("fid"), []Remote{r1, r2})
+	l.remove("fid")
+	T.Equal(len(l.get("fid")), 0)
+}
+
+func TestStorage_ReadReplicas(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	f := fid.FID{}
+	f.Generate(1)
+	rc := &testReadConfig{fid: f, length: 4}
+	s := &Storage{}
+	closed := int32(0)
+	reader := func(data string, err error) *testRemote {
+		return &testRemote{
+			name: data,
+			read: func(context.Context, ReadConfig) (io.ReadCloser, error) {
+				if err != nil {
+					return nil, err
+				}
+				return &countingCloser{
+					Reader: strings.NewReader(data),
+					closed: &closed,
+				}, nil
+			},
+		}
+	}
+
+	// With no remotes nothing is read.
+	T.Equal(s.readReplicas(context.Background(), rc, nil, NewTestLogger()), nil)
+
+	// Remotes that fail or do not have the data are skipped, only errors
+	// other than ErrNotFound are counted.
+	failing := reader("failing", fmt.Errorf("expected"))
+	missing := reader("missing", ErrNotFound(rc.ID()))
+	remotes := []Remote{failing, missing}
+	T.Equal(s.readReplicas(context.Background(), rc, remotes, NewTestLogger()), nil)
+	T.Equal(s.metrics.ReadSources.RemoteErrors, int64(1))
+
+	// The first remote to return data is used, the reader from any other
+	// remote that also has it is closed.
+	first := reader("data", nil)
+	second := reader("data", nil)
+	remotes = []Remote{missing, first, second}
+	rcloser := s.readReplicas(context.Background(), rc, remotes, NewTestLogger())
+	T.NotEqual(rcloser, nil)
+	data, err := ioutil.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "data")
+	T.Equal(s.metrics.ReadSources.Remote, int64(1))
+	T.ExpectSuccess(rcloser.Close())
+	T.TryUntil(func() bool {
+		return atomic.LoadInt32(&closed) == 2
+	}, time.Second, "Both replica readers were not closed.")
+}
+
+func TestStorage_Read_ReplicaHolders(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// The file was created on machine 1, which can not be reached. Machine
+	// 2 has already dropped its replica and machine 4 still holds one.
+	f := fid.FID{}
+	f.Generate(1)
+	holderCalls := 0
+	missing := &testRemote{
+		name: "missing",
+		read: func(ctx context.Context, rc ReadConfig) (io.ReadCloser, error) {
+			return nil, ErrNotFound(rc.ID())
+		},
+	}
+	holder := &testRemote{
+		name: "holder",
+		read: func(ctx context.Context, rc ReadConfig) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("data")), nil
+		},
+	}
+	creatorErr := fmt.Errorf("connection refused")
+	s := newStartedTestStorage(T, Settings{
+		MachineID:   3,
+		ObjectStore: memoryObjectStore{},
+		Read: func(context.Context, ReadConfig) (io.ReadCloser, error) {
+			return nil, creatorErr
+		},
+		ReplicaHolders: func(machine uint32) []Remote {
+			T.Equal(machine, uint32(1))
+			holderCalls++
+			return []Remote{missing, holder}
+		},
+	})
+
+	rc := &testReadConfig{fid: f, length: 4}
+	rcloser, err := s.Read(context.Background(), rc)
+	T.ExpectSuccess(err)
+	data, err := ioutil.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "data")
+	T.Equal(holderCalls, 1)
+	T.Equal(s.metrics.ReadSources.Remote, int64(1))
+	T.Equal(s.metrics.ReadSources.RemoteErrors, int64(1))
+
+	// If the creator answers that it does not have the data then the
+	// replicas are gone too so the holders are not asked.
+	creatorErr = ErrNotFound(rc.ID())
+	_, err = s.Read(context.Background(), rc)
+	T.ExpectError(err)
+	T.Equal(holderCalls, 1)
+}
+
+// A reader that counts how many times it has been closed.
+type countingCloser struct {
+	io.Reader
+	closed *int32
+}
+
+func (c *countingCloser) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return nil
+}
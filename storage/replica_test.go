@@ -9,15 +9,23 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"bou.ke/monkey"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/liquidgecka/testlib"
 
 	"github.com/liquidgecka/blobby/internal/delayqueue"
+	"github.com/liquidgecka/blobby/internal/tracing"
 	"github.com/liquidgecka/blobby/internal/workqueue"
 	"github.com/liquidgecka/blobby/storage/fid"
+	"github.com/liquidgecka/blobby/storage/hasher"
+	"github.com/liquidgecka/blobby/storage/metrics"
 )
 
 func TestReplica_Compress(t *testing.T) {
@@ -230,6 +238,100 @@ func TestReplica_Compress_ZipperCloseFails(t *testing.T) {
 	T.Equal(setStateRun, 2)
 }
 
+func TestReplica_Compress_Verify(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := &replica{
+		settings: &Settings{
+			BaseDirectory:     T.TempDir(),
+			VerifyCompression: true,
+		},
+		fd:     T.TempFile(),
+		fidStr: "not_exist",
+		offset: uint64(len("test data")),
+		log:    NewTestLogger(),
+	}
+	_, err := r.fd.WriteString("test data")
+	T.ExpectSuccess(err)
+	setStateRun := 0
+	defer monkey.Patch(
+		(*replica).setState,
+		func(r *replica, ctx context.Context, n int32) {
+			switch setStateRun {
+			case 0:
+				T.Equal(n, replicaStateCompressing)
+			case 1:
+				T.Equal(n, replicaStatePendingUpload)
+			default:
+				T.Fatalf("r.setState called too many times.")
+			}
+			setStateRun += 1
+		},
+	).Unpatch()
+	r.Compress(context.Background())
+	T.Equal(setStateRun, 2)
+	T.NotEqual(r.compressFd, nil)
+}
+
+func TestReplica_Compress_VerifyFails(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := &replica{
+		settings: &Settings{
+			BaseDirectory:     T.TempDir(),
+			VerifyCompression: true,
+		},
+		fd:     T.TempFile(),
+		fidStr: "not_exist",
+		offset: uint64(len("test data")),
+		log:    NewTestLogger(),
+	}
+	_, err := r.fd.WriteString("test data")
+	T.ExpectSuccess(err)
+	setStateRun := 0
+	defer monkey.Patch(
+		(*replica).setState,
+		func(r *replica, ctx context.Context, n int32) {
+			switch setStateRun {
+			case 0, 2:
+				T.Equal(n, replicaStateCompressing)
+			case 1:
+				T.Equal(n, replicaStatePendingCompression)
+			case 3:
+				T.Equal(n, replicaStatePendingUpload)
+			default:
+				T.Fatalf("r.setState called too many times.")
+			}
+			setStateRun += 1
+		},
+	).Unpatch()
+	verifyRun := 0
+	guard := monkey.Patch(
+		verifyCompressed,
+		func(fd *os.File, c compressor, length uint64) error {
+			verifyRun += 1
+			return fmt.Errorf("EXPECTED")
+		})
+	defer guard.Unpatch()
+
+	// The first attempt fails verification so the compressed file should
+	// be removed and the replica put back into the compression queue.
+	r.Compress(context.Background())
+	T.Equal(setStateRun, 2)
+	T.Equal(verifyRun, 1)
+	T.Equal(r.compressFd, (*os.File)(nil))
+	_, err = os.Stat(filepath.Join(r.settings.BaseDirectory, "not_exist.gz"))
+	T.Equal(os.IsNotExist(err), true)
+
+	// The retry succeeds once verification is working again.
+	guard.Unpatch()
+	r.Compress(context.Background())
+	T.Equal(setStateRun, 4)
+	T.NotEqual(r.compressFd, nil)
+}
+
 func TestReplica_HeartBeat(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -400,6 +502,255 @@ func TestReplica_Replicate_WrongState(t *testing.T) {
 	)
 }
 
+func TestReplica_Replicate_Behind(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := replica{
+		fd:     T.TempFile(),
+		log:    NewTestLogger(),
+		offset: 10,
+		state:  replicaStateWaiting,
+		settings: &Settings{
+			DelayQueue:           &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue: workqueue.New(0),
+			HeartBeatTime:        time.Minute,
+		},
+	}
+	r.settings.DelayQueue.Start()
+	defer r.settings.DelayQueue.Stop()
+
+	// A primary that is slightly ahead is told where the replica is and
+	// the replica keeps waiting for data.
+	rc := replicatorConfig{start: 20, end: 30}
+	T.Equal(r.Replicate(context.Background(), &rc), ErrReplicaBehind(10))
+	T.Equal(r.state, replicaStateWaiting)
+	T.Equal(r.lag, uint64(10))
+
+	// A primary that is too far ahead, or behind the replica, fails it.
+	rc = replicatorConfig{
+		start: 10 + replicaResyncMaxBytes + 1,
+		end:   10 + replicaResyncMaxBytes + 2,
+	}
+	T.ExpectErrorMessage(
+		r.Replicate(context.Background(), &rc),
+		"Attempt to replicate to a replica where the offsets do not match.")
+	T.Equal(r.state, replicaStateFailed)
+	T.Equal(r.lag, uint64(0))
+	r.state = replicaStateWaiting
+	rc = replicatorConfig{start: 5, end: 15}
+	T.ExpectErrorMessage(
+		r.Replicate(context.Background(), &rc),
+		"Attempt to replicate to a replica where the offsets do not match.")
+	T.Equal(r.state, replicaStateFailed)
+}
+
+func TestReplica_Replicate_Tracing(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := replica{
+		fd:      T.TempFile(),
+		log:     NewTestLogger(),
+		state:   replicaStateWaiting,
+		storage: &Storage{},
+		settings: &Settings{
+			DelayQueue:           &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue: workqueue.New(0),
+			HeartBeatTime:        time.Minute,
+		},
+	}
+	r.settings.DelayQueue.Start()
+	defer r.settings.DelayQueue.Stop()
+
+	// Setup the source data that will be replicated.
+	source := T.TempFile()
+	hsum, err := hasher.Computer("hh", source)
+	T.ExpectSuccess(err)
+	_, err = hsum.Write([]byte("replicated data"))
+	T.ExpectSuccess(err)
+	rc := replicatorConfig{
+		end:   15,
+		fd:    source,
+		hash:  hsum.Hash(),
+		start: 0,
+	}
+
+	// Replicate and heart beat using a context that carries a trace, as
+	// would be the case when the primary propagated its trace.
+	top := tracing.New()
+	ctx := tracing.NewContext(context.Background(), top)
+	T.ExpectSuccess(r.Replicate(ctx, &rc))
+	T.Equal(r.lag, uint64(0))
+	T.ExpectSuccess(r.HeartBeat(ctx))
+	T.ExpectSuccess(r.QueueDelete(ctx))
+	top.End()
+
+	// Each operation should have created a span under the propagated
+	// trace.
+	children := top.Children()
+	T.Equal(len(children), 3)
+	T.Equal(children[0].Name(), "storage/(replica.Replicate)")
+	T.Equal(children[1].Name(), "storage/(replica.HeartBeat)")
+	T.Equal(children[2].Name(), "storage/(replica.QueueDelete)")
+	copying := children[0].Children()
+	T.Equal(len(copying), 1)
+	T.Equal(copying[0].Name(), "storage/(replica.Replicate):copying")
+}
+
+func TestReplica_Replicate_SyncOnInsert(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := replica{
+		fd:      T.TempFile(),
+		log:     NewTestLogger(),
+		state:   replicaStateWaiting,
+		storage: &Storage{},
+		settings: &Settings{
+			DelayQueue:           &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue: workqueue.New(0),
+			HeartBeatTime:        time.Minute,
+			SyncPolicy:           SyncPolicyOnInsert,
+		},
+	}
+	r.settings.DelayQueue.Start()
+	defer r.settings.DelayQueue.Stop()
+
+	// Setup the source data that will be replicated.
+	source := T.TempFile()
+	hsum, err := hasher.Computer("hh", source)
+	T.ExpectSuccess(err)
+	_, err = hsum.Write([]byte("replicated data"))
+	T.ExpectSuccess(err)
+	rc := replicatorConfig{
+		end:   15,
+		fd:    source,
+		hash:  hsum.Hash(),
+		start: 0,
+	}
+
+	// A successful replication syncs the data before returning.
+	top := tracing.New()
+	ctx := tracing.NewContext(context.Background(), top)
+	T.ExpectSuccess(r.Replicate(ctx, &rc))
+	top.End()
+	T.Equal(r.offset, uint64(15))
+	steps := top.Children()[0].Children()
+	T.Equal(len(steps), 2)
+	T.Equal(steps[0].Name(), "storage/(replica.Replicate):copying")
+	T.Equal(steps[1].Name(), "storage/(replica.Replicate):syncing")
+
+	// If the sync fails then the replica is failed and the offset is not
+	// advanced.
+	defer monkey.Patch(
+		(*os.File).Sync,
+		func(f *os.File) error {
+			return fmt.Errorf("EXPECTED")
+		},
+	).Unpatch()
+	hsum, err = hasher.Computer("hh", source)
+	T.ExpectSuccess(err)
+	_, err = hsum.Write([]byte("replicated data"))
+	T.ExpectSuccess(err)
+	rc = replicatorConfig{
+		end:   30,
+		fd:    source,
+		hash:  hsum.Hash(),
+		start: 15,
+	}
+	T.ExpectErrorMessage(
+		r.Replicate(context.Background(), &rc),
+		"Error syncing replica: EXPECTED")
+	T.Equal(r.state, replicaStateFailed)
+	T.Equal(r.offset, uint64(15))
+}
+
+func TestReplica_Upload_CanaryRead(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a replica with data that is ready to upload.
+	r := replica{
+		fd:      T.TempFile(),
+		log:     NewTestLogger(),
+		state:   replicaStateCompleted,
+		fidStr:  "test",
+		storage: &Storage{},
+		s3key:   "test_s3_key",
+		offset:  9,
+		settings: &Settings{
+			CanaryReadAfterUpload: true,
+			DelayQueue:            &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue:  workqueue.New(0),
+			S3Bucket:              "bucket",
+			S3Client:              &s3.S3{},
+			UploadWorkQueue:       workqueue.New(0),
+		},
+	}
+	r.settings.DelayQueue.Start()
+	r.storage.replicas = map[string]*replica{
+		"test": &r,
+	}
+	defer r.settings.DelayQueue.Stop()
+	_, err := r.fd.WriteString("test data")
+	T.ExpectSuccess(err)
+
+	// The upload itself always works.
+	defer monkey.Patch(
+		uploadToS3,
+		func(
+			ctx context.Context,
+			fd *os.File,
+			id fid.FID,
+			key string,
+			metadata map[string]string,
+			s *Settings,
+			l *slog.Logger,
+			h *metrics.DurationHistogram,
+			last *int64,
+		) bool {
+			return true
+		},
+	).Unpatch()
+
+	// S3 returns the requested range of either the correct or the wrong
+	// data.
+	stored := "test data"
+	defer monkey.Patch(
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			T.Equal(*goi.Key, "test_s3_key")
+			T.Equal(*goi.Range, "bytes=0-8")
+			length := int64(len(stored))
+			return &s3.GetObjectOutput{
+				Body:          io.NopCloser(strings.NewReader(stored)),
+				ContentLength: &length,
+			}, nil
+		},
+	).Unpatch()
+
+	// If the canary does not match then the upload is retried.
+	stored = "test DATA"
+	r.Upload(context.Background())
+	T.Equal(r.state, replicaStatePendingUpload)
+	T.Equal(r.uploadFailures, int32(1))
+	T.Equal(r.storage.metrics.UploadCanaryFailures, int64(1))
+	T.Equal(r.storage.metrics.ReplicaUploads.Failures, int64(1))
+
+	// Once the canary matches the replica proceeds to being deleted.
+	stored = "test data"
+	r.Upload(context.Background())
+	T.Equal(r.state, replicaStatePendingDelete)
+	T.Equal(r.storage.metrics.UploadCanaryFailures, int64(1))
+	T.Equal(r.storage.metrics.ReplicaUploads.Successes, int64(1))
+}
+
 func TestReplica_Upload(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -410,6 +761,7 @@ func TestReplica_Upload(t *testing.T) {
 		compressFd: T.TempFile(),
 		log:        NewTestLogger(),
 		state:      replicaStateCompleted,
+		fidStr:     "test",
 		storage:    &Storage{},
 		s3key:      "test_s3_key",
 		settings: &Settings{
@@ -440,10 +792,14 @@ func TestReplica_Upload(t *testing.T) {
 			fd *os.File,
 			id fid.FID,
 			key string,
+			metadata map[string]string,
 			s *Settings,
 			l *slog.Logger,
+			h *metrics.DurationHistogram,
+			last *int64,
 		) bool {
 			T.NotEqual(l, nil)
+			T.Equal(h, &r.storage.metrics.ReplicaUploadDuration)
 			T.Equal(s, r.settings)
 			T.Equal(id, r.fid)
 			T.Equal(key, r.s3key)
@@ -470,6 +826,21 @@ func TestReplica_Upload(t *testing.T) {
 	T.Equal(r.state, replicaStatePendingUpload)
 	T.Equal(r.storage.metrics.ReplicaUploads.Total, int64(2))
 	T.Equal(r.storage.metrics.ReplicaUploads.Successes, int64(1))
+	T.Equal(r.uploadFailures, int32(1))
+	T.Equal(r.storage.uploadFailures, int32(1))
+
+	// The failure count is only included in the status when enabled.
+	T.Equal(r.Status(), "test state=pending-upload size=1B records=0")
+	r.settings.StatusUploadFailures = true
+	T.Equal(
+		r.Status(),
+		"test state=pending-upload size=1B records=0 upload-failures=1")
+
+	// Each additional failure increments the displayed count.
+	r.Upload(context.Background())
+	T.Equal(
+		r.Status(),
+		"test state=pending-upload size=1B records=0 upload-failures=2")
 }
 
 func TestReplica_Event(t *testing.T) {
@@ -500,6 +871,7 @@ func TestReplica_Event(t *testing.T) {
 		replicaStateNew,
 		replicaStateOpening,
 		replicaStateAppending,
+		replicaStateOrphaned,
 		replicaStatePendingCompression,
 		replicaStateCompressing,
 		replicaStatePendingUpload,
@@ -543,6 +915,81 @@ func TestReplica_Event(t *testing.T) {
 	T.Equal(r.state, replicaStatePendingDelete)
 }
 
+func TestReplica_Event_GracePeriodResumed(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := replica{
+		log:     NewTestLogger(),
+		offset:  1,
+		state:   replicaStateWaiting,
+		storage: &Storage{},
+		settings: &Settings{
+			CompressWorkQueue:    workqueue.New(0),
+			DelayQueue:           &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue: workqueue.New(0),
+			HeartBeatTime:        time.Minute,
+			OrphanGracePeriod:    time.Minute,
+			UploadWorkQueue:      workqueue.New(0),
+		},
+	}
+	r.settings.DelayQueue.Start()
+	defer r.settings.DelayQueue.Stop()
+
+	// The event should put the replica into the orphaned state without
+	// starting the upload.
+	r.event(context.Background())
+	T.Equal(r.state, replicaStateOrphaned)
+	T.Equal(r.heartBeatToken.InList(), true)
+	T.Equal(r.storage.metrics.ReplicaOrphaned, int64(0))
+	T.Equal(r.settings.UploadWorkQueue.Len(), 0)
+
+	// A heart beat from the primary should put it back to waiting.
+	T.ExpectSuccess(r.HeartBeat(context.Background()))
+	T.Equal(r.state, replicaStateWaiting)
+	T.Equal(r.heartBeatToken.InList(), true)
+
+	// The grace period expiring after the primary resumed should do
+	// nothing.
+	r.graceExpired(context.Background())
+	T.Equal(r.state, replicaStateWaiting)
+	T.Equal(r.storage.metrics.ReplicaOrphaned, int64(0))
+	T.Equal(r.settings.UploadWorkQueue.Len(), 0)
+}
+
+func TestReplica_Event_GracePeriodExpired(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := replica{
+		log:     NewTestLogger(),
+		offset:  1,
+		state:   replicaStateWaiting,
+		storage: &Storage{},
+		settings: &Settings{
+			CompressWorkQueue:    workqueue.New(0),
+			DelayQueue:           &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue: workqueue.New(0),
+			HeartBeatTime:        time.Minute,
+			OrphanGracePeriod:    time.Millisecond * 10,
+			UploadWorkQueue:      workqueue.New(0),
+		},
+	}
+	r.settings.DelayQueue.Start()
+	defer r.settings.DelayQueue.Stop()
+
+	// Once the grace period passes the upload should start.
+	r.event(context.Background())
+	T.TryUntil(
+		func() bool { return r.settings.UploadWorkQueue.Len() == 1 },
+		time.Second)
+	T.Equal(atomic.LoadInt32(&r.state), replicaStatePendingUpload)
+	T.Equal(atomic.LoadInt64(&r.storage.metrics.ReplicaOrphaned), int64(1))
+
+	// Heart beats are no longer accepted.
+	T.Equal(r.HeartBeat(context.Background()), ErrWrongReplicaState{})
+}
+
 func TestReplica_SetState(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -707,6 +1154,23 @@ func TestReplica_SetState(t *testing.T) {
 	T.Equal(r.settings.UploadWorkQueue.Len(), 1)
 	T.Equal(len(r.storage.replicas), 1)
 
+	// replicaStateRetained
+	r.settings.DelayDelete = time.Hour
+	r.settings.DelayQueue.Alter(
+		&r.heartBeatToken,
+		future,
+		func(context.Context) {},
+	)
+	r.setState(context.Background(), replicaStateRetained)
+	T.Equal(r.state, replicaStateRetained)
+	T.Equal(r.queuedForUpload, time.Time{})
+	T.Equal(r.heartBeatToken.InList(), false)
+	T.Equal(r.retainToken.InList(), true)
+	T.Equal(r.settings.CompressWorkQueue.Len(), 1)
+	T.Equal(r.settings.DeleteLocalWorkQueue.Len(), 0)
+	T.Equal(r.settings.UploadWorkQueue.Len(), 1)
+	T.Equal(len(r.storage.replicas), 1)
+
 	// replicaStatePendingDelete
 	r.settings.DelayQueue.Alter(
 		&r.heartBeatToken,
@@ -797,3 +1261,42 @@ func TestReplica_SetState(t *testing.T) {
 	T.Equal(r.settings.UploadWorkQueue.Len(), 1)
 	T.Equal(len(r.storage.replicas), 0)
 }
+
+func TestReplica_RetainExpired(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := replica{
+		fidStr:  "test",
+		log:     NewTestLogger(),
+		storage: &Storage{},
+		settings: &Settings{
+			DelayDelete:          time.Millisecond,
+			DelayQueue:           &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue: workqueue.New(0),
+		},
+	}
+	r.settings.DelayQueue.Start()
+	defer r.settings.DelayQueue.Stop()
+
+	// A retained replica is queued for delete once DelayDelete passes.
+	r.lock.Lock()
+	r.setState(context.Background(), replicaStateRetained)
+	r.lock.Unlock()
+	T.TryUntil(
+		func() bool { return r.settings.DeleteLocalWorkQueue.Len() == 1 },
+		time.Second)
+	T.Equal(atomic.LoadInt32(&r.state), replicaStatePendingDelete)
+
+	// If the replica has already moved on then nothing is changed.
+	r.state = replicaStateDeleting
+	r.retainExpired(context.Background())
+	T.Equal(r.state, replicaStateDeleting)
+	T.Equal(r.settings.DeleteLocalWorkQueue.Len(), 1)
+
+	// A replica that is being retained accepts a delete from the primary
+	// without being deleted early.
+	r.state = replicaStateRetained
+	T.ExpectSuccess(r.QueueDelete(context.Background()))
+	T.Equal(r.state, replicaStateRetained)
+}
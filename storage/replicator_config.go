@@ -3,6 +3,8 @@ package storage
 import (
 	"io"
 	"os"
+
+	"github.com/liquidgecka/blobby/internal/tracing"
 )
 
 type replicatorConfig struct {
@@ -12,6 +14,7 @@ type replicatorConfig struct {
 	hash      string
 	namespace string
 	start     uint64
+	trace     *tracing.Trace
 }
 
 func (r *replicatorConfig) FileName() string {
@@ -42,6 +45,10 @@ func (r *replicatorConfig) Size() uint64 {
 	return r.end - r.start
 }
 
+func (r *replicatorConfig) Tracer() *tracing.Trace {
+	return r.trace
+}
+
 type reader struct {
 	source *os.File
 	offset uint64
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// The results of a call to Reupload().
+type ReuploadResult struct {
+	// Files that were queued to be uploaded again.
+	Requeued []string `json:"requeued"`
+
+	// Files that are already waiting for, or in the middle of, compression
+	// or upload. These are left alone so they are not uploaded twice.
+	InProgress []string `json:"in_progress"`
+
+	// Files that can not be requeued right now, such as primaries and
+	// replicas that are still accepting data or are being deleted.
+	Skipped []string `json:"skipped"`
+}
+
+// Queues replicas on local disk for upload immediately. This is intended
+// for recovering after an object store outage: replicas that are being
+// retained for reads are uploaded again in case the original upload did not
+// persist, and orphaned replicas whose grace period has expired are queued
+// without waiting on the DelayQueue. Orphaned replicas that are still within
+// their grace period are skipped since the primary may resume, and failed
+// replicas are never uploaded since their contents can not be trusted.
+// Files that are already queued or uploading are reported but not touched
+// so repeated calls are safe. Primaries manage their own uploads and files
+// that have already been deleted locally can not be recovered so neither is
+// requeued.
+func (s *Storage) Reupload(ctx context.Context) *ReuploadResult {
+	result := &ReuploadResult{
+		Requeued:   []string{},
+		InProgress: []string{},
+		Skipped:    []string{},
+	}
+
+	// Primaries are never requeued, they are only reported.
+	func() {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		for fidStr, p := range s.primaries {
+			switch atomic.LoadInt32(&p.state) {
+			case primaryStatePendingCompression,
+				primaryStateCompressing,
+				primaryStatePendingUpload,
+				primaryStateUploading:
+				result.InProgress = append(result.InProgress, fidStr)
+			default:
+				result.Skipped = append(result.Skipped, fidStr)
+			}
+		}
+	}()
+
+	// Take a snapshot of the replicas so that the map lock is not held
+	// while waiting on each replica.
+	replicas := func() []*replica {
+		s.replicasLock.Lock()
+		defer s.replicasLock.Unlock()
+		replicas := make([]*replica, 0, len(s.replicas))
+		for _, r := range s.replicas {
+			replicas = append(replicas, r)
+		}
+		return replicas
+	}()
+	for _, r := range replicas {
+		switch r.reupload(ctx) {
+		case reuploadRequeued:
+			result.Requeued = append(result.Requeued, r.fidStr)
+		case reuploadInProgress:
+			result.InProgress = append(result.InProgress, r.fidStr)
+		default:
+			result.Skipped = append(result.Skipped, r.fidStr)
+		}
+	}
+
+	sort.Strings(result.Requeued)
+	sort.Strings(result.InProgress)
+	sort.Strings(result.Skipped)
+	s.settings.BaseLogger.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Requeued files for upload.",
+		sloghelper.Int("requeued", len(result.Requeued)),
+		sloghelper.Int("in-progress", len(result.InProgress)),
+		sloghelper.Int("skipped", len(result.Skipped)))
+	return result
+}
+
+// The outcome of requeuing a single replica.
+const (
+	reuploadSkipped = iota
+	reuploadRequeued
+	reuploadInProgress
+)
+
+// Moves the replica into the upload process if it is in a state where
+// that is safe. Replicas that are already compressing or uploading are
+// checked without the lock since an upload holds it for the duration.
+func (r *replica) reupload(ctx context.Context) int {
+	switch atomic.LoadInt32(&r.state) {
+	case replicaStateOrphaned:
+	case replicaStateRetained:
+	case replicaStatePendingCompression,
+		replicaStateCompressing,
+		replicaStatePendingUpload,
+		replicaStateUploading:
+		return reuploadInProgress
+	default:
+		return reuploadSkipped
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch r.state {
+	case replicaStateOrphaned:
+		// The replica entered the orphaned state when its grace period
+		// started so the state change time tells us when it expires.
+		changed := time.Unix(0, atomic.LoadInt64(&r.stateChanged))
+		if time.Since(changed) < r.settings.OrphanGracePeriod {
+			return reuploadSkipped
+		}
+		r.orphaned(ctx)
+	case replicaStateRetained:
+		// The file has already been compressed so it goes straight back
+		// to the upload queue.
+		r.settings.DelayQueue.Cancel(&r.retainToken)
+		r.setState(ctx, replicaStatePendingUpload)
+	case replicaStatePendingCompression,
+		replicaStateCompressing,
+		replicaStatePendingUpload,
+		replicaStateUploading:
+		return reuploadInProgress
+	default:
+		return reuploadSkipped
+	}
+	return reuploadRequeued
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/internal/delayqueue"
+	"github.com/liquidgecka/blobby/internal/workqueue"
+)
+
+func TestStorage_Reupload(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := &Storage{
+		settings: Settings{
+			BaseLogger:           NewTestLogger(),
+			CompressWorkQueue:    workqueue.New(0),
+			DelayDelete:          time.Hour,
+			DelayQueue:           &delayqueue.DelayQueue{},
+			DeleteLocalWorkQueue: workqueue.New(0),
+			OrphanGracePeriod:    time.Minute,
+			UploadWorkQueue:      workqueue.New(0),
+		},
+	}
+	s.settings.DelayQueue.Start()
+	defer s.settings.DelayQueue.Stop()
+	newReplica := func(fidStr string, state int32) *replica {
+		return &replica{
+			fidStr:   fidStr,
+			log:      NewTestLogger(),
+			offset:   10,
+			state:    state,
+			storage:  s,
+			settings: &s.settings,
+		}
+	}
+	retained := newReplica("retained", replicaStateNew)
+	retained.lock.Lock()
+	retained.setState(context.Background(), replicaStateRetained)
+	retained.lock.Unlock()
+	orphaned := newReplica("orphaned", replicaStateOrphaned)
+	orphaned.stateChanged = time.Now().Add(-time.Hour).UnixNano()
+	grace := newReplica("grace", replicaStateOrphaned)
+	grace.stateChanged = time.Now().UnixNano()
+	s.replicas = map[string]*replica{
+		"appending": newReplica("appending", replicaStateAppending),
+		"failed":    newReplica("failed", replicaStateFailed),
+		"grace":     grace,
+		"orphaned":  orphaned,
+		"retained":  retained,
+		"uploading": newReplica("uploading", replicaStateUploading),
+		"waiting":   newReplica("waiting", replicaStateWaiting),
+	}
+	s.primaries = map[string]*primary{
+		"compressing": {state: primaryStateCompressing},
+		"primary":     {state: primaryStateWaiting},
+	}
+
+	// Failed replicas and orphans that are still within their grace period
+	// are left alone.
+	T.Equal(s.Reupload(context.Background()), &ReuploadResult{
+		Requeued:   []string{"orphaned", "retained"},
+		InProgress: []string{"compressing", "uploading"},
+		Skipped: []string{
+			"appending",
+			"failed",
+			"grace",
+			"primary",
+			"waiting",
+		},
+	})
+	T.Equal(s.settings.UploadWorkQueue.Len(), 2)
+	T.Equal(s.replicas["retained"].state, replicaStatePendingUpload)
+	T.Equal(s.replicas["orphaned"].state, replicaStatePendingUpload)
+	T.Equal(s.replicas["failed"].state, replicaStateFailed)
+	T.Equal(s.replicas["grace"].state, replicaStateOrphaned)
+
+	// Calling again does not queue the files a second time.
+	T.Equal(s.Reupload(context.Background()), &ReuploadResult{
+		Requeued:   []string{},
+		InProgress: []string{"compressing", "orphaned", "retained", "uploading"},
+		Skipped: []string{
+			"appending",
+			"failed",
+			"grace",
+			"primary",
+			"waiting",
+		},
+	})
+	T.Equal(s.settings.UploadWorkQueue.Len(), 2)
+}
@@ -1,31 +1,95 @@
 package storage
 
 import (
+	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/base64"
-	"encoding/hex"
 	"io"
 	"log/slog"
+	"math/rand"
 	"os"
-	"strings"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
 
+	"github.com/liquidgecka/blobby/internal/backoff"
 	"github.com/liquidgecka/blobby/internal/sloghelper"
 	"github.com/liquidgecka/blobby/storage/fid"
+	"github.com/liquidgecka/blobby/storage/hasher"
+	"github.com/liquidgecka/blobby/storage/metrics"
 )
 
-// Uploads a file to S3, performing all necessary operations to get it into
-// the right place and right encoding.
+const (
+	// The S3 metadata key that the uncompressed length of a compressed
+	// object is stored under.
+	uncompressedLengthMetadata = "Blobby-Uncompressed-Length"
+
+	// The S3 metadata key that the HighwayHash of the uncompressed data is
+	// stored under when Settings.VerifyUploadHash is enabled.
+	uploadHashMetadata = "Blobby-Hash"
+
+	// The S3 metadata key that the number of records in an object is
+	// stored under when Settings.RecordCountMetadata is enabled.
+	recordCountMetadata = "Blobby-Records"
+
+	// The number of bytes that are read back from S3 in order to verify an
+	// upload when Settings.CanaryReadAfterUpload is enabled.
+	canaryReadLength = 4096
+
+	// The smallest part size that S3 will accept for a multipart upload.
+	minS3PartSize = int64(1024 * 1024 * 5)
+
+	// The largest number of parts that S3 allows in a multipart upload.
+	s3MaxParts = int64(10000)
+
+	// The number of times that a single part of a multipart upload will be
+	// attempted before the upload as a whole is failed.
+	s3PartAttempts = 3
+)
+
+// Uploads a file to the object store, performing all necessary operations
+// to get it into the right place and right encoding. The time spent in the
+// upload is recorded in the given histogram and on success the current unix
+// time is stored in last. If metadata is not nil then it is stored with the
+// object.
+//
+// A slot in Settings.UploadSemaphore is held for the duration of the call.
+// The number of calls waiting for a slot is tracked in waiting, and the
+// number holding one in inFlight.
 func uploadToS3(
 	ctx context.Context,
 	fd *os.File,
 	f fid.FID,
 	s3key string,
+	metadata map[string]string,
 	s *Settings,
 	l *slog.Logger,
+	h *metrics.DurationHistogram,
+	last *int64,
+	inFlight *int64,
+	waiting *int64,
 ) bool {
+	// Wait for a slot so that this does not exceed the number of uploads
+	// that are allowed to run at once.
+	atomic.AddInt64(waiting, 1)
+	err := s.UploadSemaphore.Acquire(ctx)
+	atomic.AddInt64(waiting, -1)
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Gave up waiting for an upload slot.",
+			sloghelper.String("file", fd.Name()),
+			sloghelper.Error("error", err))
+		return false
+	}
+	defer s.UploadSemaphore.Release()
+	atomic.AddInt64(inFlight, 1)
+	defer atomic.AddInt64(inFlight, -1)
+
 	// Seek to the start of the file.
 	if _, err := fd.Seek(0, io.SeekStart); err != nil {
 		l.LogAttrs(
@@ -37,24 +101,377 @@ func uploadToS3(
 		return false
 	}
 
-	// Perform the actual file upload to S3 using a single PutObject
-	// call. Ideally later we can make this multi part for better
-	// performance but for now this is specifically a singular
-	// write. Note that this does NOT use the upload manager provided
-	// by AWS because it was found to cause data loss on uploads in
-	// rare cases.
-	poi := s3.PutObjectInput{
-		Bucket: &s.S3Bucket,
-		Body:   fd,
-		Key:    &s3key,
+	// Stat the file to get its size for use with the upload.
+	stat, err := fd.Stat()
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"Error stating the file.",
+			sloghelper.String("file", fd.Name()),
+			sloghelper.Error("error", err))
+		return false
 	}
+	size := stat.Size()
 
 	// Set the Content-Type of the object to binary since we
 	// do not know the type of data being stored in the file.
 	ct := "application/octet-stream"
-	poi.ContentType = &ct
 
-	// Stat the file to get its size for use with the PutObject request.
+	// Next we need to actually initiate the transfer. The object store is
+	// responsible for validating that the data arrived intact.
+	store := s.objectStore()
+	uploadStart := time.Now()
+	err = store.Put(ctx, s3key, fd, size, ct, metadata)
+	h.Observe(time.Since(uploadStart))
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error uploading to S3. The request will be retried.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", s3key),
+			sloghelper.String("local-file", fd.Name()),
+			sloghelper.Error("error", err))
+		return false
+	}
+
+	// Record the time of this upload so that upload liveness can be
+	// monitored.
+	atomic.StoreInt64(last, time.Now().Unix())
+
+	// Log something so its clear that something got uploaded.
+	l.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Successfully uploaded to S3.",
+		sloghelper.String("bucket", s.S3Bucket),
+		sloghelper.String("key", s3key))
+
+	// If configured then the object is also written under each of the
+	// additional key formats. These writes are best effort so a failure
+	// here will not cause the upload as a whole to be retried.
+	for _, format := range s.S3AdditionalKeyFormats {
+		uploadAdditionalKey(
+			ctx,
+			fd,
+			filepath.Join(s.S3BasePath, format.Format(f)),
+			size,
+			ct,
+			metadata,
+			s,
+			l)
+	}
+
+	// Success!
+	return true
+}
+
+// Calls upload until it returns true, making at most UploadAttempts attempts
+// and backing off exponentially (with jitter) between them. Each retry is
+// counted in retries. If locker is not nil then it is unlocked while waiting
+// so that a lock held by the caller is not held across the sleep. This
+// returns false if every attempt failed or if ctx is canceled.
+func retryUpload(
+	ctx context.Context,
+	s *Settings,
+	l *slog.Logger,
+	locker sync.Locker,
+	retries *int64,
+	upload func() bool,
+) bool {
+	b := backoff.Exponential{
+		Base: s.UploadRetryDelay,
+		Max:  s.UploadRetryMaxDelay,
+	}
+	for attempt := 1; ; attempt++ {
+		if upload() {
+			return true
+		} else if attempt >= s.UploadAttempts {
+			return false
+		}
+		delay := b.Delay(attempt)
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Upload to S3 failed, retrying.",
+			sloghelper.Int("attempt", attempt),
+			sloghelper.Duration("delay", delay))
+		atomic.AddInt64(retries, 1)
+		if locker != nil {
+			locker.Unlock()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		if locker != nil {
+			locker.Lock()
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+}
+
+// Returns the key that a copy of the file with the given FID is written to
+// if the upload starts at the given time, or "" if S3KeyUploadFormat is not
+// configured.
+func s3UploadTimeKey(s *Settings, f fid.FID, now time.Time) string {
+	if s.S3KeyUploadFormat == nil {
+		return ""
+	}
+	return filepath.Join(
+		s.S3BasePath,
+		s.S3KeyUploadFormat.FormatTime(f, now.In(time.UTC)),
+		s.S3KeyFormat.Format(f))
+}
+
+// Returns the metadata that is stored with an uploaded object whose data is
+// length bytes before compression, or nil if objects are not compressed.
+// The uncompressed length lets reads tell if an ID covers the whole object.
+func compressedMetadata(s *Settings, length uint64) map[string]string {
+	if !s.Compress {
+		return nil
+	}
+	return map[string]string{
+		uncompressedLengthMetadata: strconv.FormatUint(length, 10),
+	}
+}
+
+// Returns a copy of metadata with the hash of the file added if uploads are
+// verified, otherwise metadata is returned unchanged.
+func hashMetadata(
+	s *Settings,
+	metadata map[string]string,
+	hash string,
+) map[string]string {
+	if !s.VerifyUploadHash {
+		return metadata
+	}
+	m := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m[uploadHashMetadata] = hash
+	return m
+}
+
+// Returns a copy of metadata with the number of records in the file added
+// if that is enabled and the count is known, otherwise metadata is returned
+// unchanged.
+func recordsMetadata(
+	s *Settings,
+	metadata map[string]string,
+	records int,
+) map[string]string {
+	if !s.RecordCountMetadata || records < 0 {
+		return metadata
+	}
+	m := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m[recordCountMetadata] = strconv.Itoa(records)
+	return m
+}
+
+// Returns the HighwayHash of the first length bytes of fd in the same form
+// that is generated while inserting into a primary.
+func hashFile(fd *os.File, length uint64) (string, error) {
+	return hashFileRange(fd, 0, length)
+}
+
+// Like hashFile except that only the data between start and end is hashed.
+func hashFileRange(fd *os.File, start, end uint64) (string, error) {
+	h, err := hasher.Computer("hh", io.Discard)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(
+		h,
+		io.NewSectionReader(fd, int64(start), int64(end-start)))
+	if err != nil {
+		return "", err
+	}
+	return h.Hash(), nil
+}
+
+// Returns the storage class, server side encryption, and KMS key ID that
+// should be set on uploaded objects. Each is nil if not configured so that
+// the bucket defaults apply.
+func s3ObjectOptions(s *Settings) (class, sse, kmsKeyID *string) {
+	if s.S3StorageClass != "" {
+		class = &s.S3StorageClass
+	}
+	if s.S3SSE != "" {
+		sse = &s.S3SSE
+	}
+	if s.S3KMSKeyID != "" {
+		kmsKeyID = &s.S3KMSKeyID
+	}
+	return
+}
+
+// Returns true if the given storage class is one that S3 supports.
+func validS3StorageClass(class string) bool {
+	for _, c := range s3.StorageClass_Values() {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if S3 will return the MD5 of uploaded data as its ETag. This
+// is not the case for objects encrypted with SSE-KMS, so for those the
+// ETag can not be checked and the integrity of the upload relies on S3
+// validating the Content-MD5 that is sent with the data.
+func etagIsMD5(s *Settings) bool {
+	return s.S3SSE != s3.ServerSideEncryptionAwsKms
+}
+
+// Writes a copy of an already uploaded object under an additional key.
+// Errors are logged but otherwise ignored.
+func uploadAdditionalKey(
+	ctx context.Context,
+	fd *os.File,
+	key string,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+	s *Settings,
+	l *slog.Logger,
+) {
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error seeking to the start of the file.",
+			sloghelper.String("file", fd.Name()),
+			sloghelper.Error("error", err))
+		return
+	}
+	err := s.objectStore().Put(ctx, key, fd, size, contentType, metadata)
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error writing the object under an additional key.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", key),
+			sloghelper.Error("error", err))
+	} else {
+		l.LogAttrs(
+			ctx,
+			slog.LevelInfo,
+			"Successfully uploaded to S3 under an additional key.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", key))
+	}
+}
+
+// Writes a copy of a file that has been uploaded to its canonical key under
+// the key from s3UploadTimeKey. Like the additional key formats this is
+// best effort so errors are logged but otherwise ignored.
+func uploadTimeCopy(
+	ctx context.Context,
+	fd *os.File,
+	key string,
+	metadata map[string]string,
+	s *Settings,
+	l *slog.Logger,
+) {
+	stat, err := fd.Stat()
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error stating the file.",
+			sloghelper.String("file", fd.Name()),
+			sloghelper.Error("error", err))
+		return
+	}
+	uploadAdditionalKey(
+		ctx,
+		fd,
+		key,
+		stat.Size(),
+		"application/octet-stream",
+		metadata,
+		s,
+		l)
+}
+
+// Uploads the compress index for the object stored at s3key. If index is nil
+// then there is nothing to upload and this returns true.
+func uploadCompressIndex(
+	ctx context.Context,
+	index *compressIndex,
+	s3key string,
+	s *Settings,
+	l *slog.Logger,
+) bool {
+	if index == nil {
+		return true
+	}
+	data, err := index.encode(s.CompressIndexFormat)
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"Error encoding the compress index.",
+			sloghelper.Error("error", err))
+		return false
+	}
+	ct := "application/octet-stream"
+	if s.CompressIndexFormat == CompressIndexFormatJSON {
+		ct = "application/json"
+	}
+	key := s3key + compressIndexSuffix
+	err = s.objectStore().Put(
+		ctx,
+		key,
+		bytes.NewReader(data),
+		int64(len(data)),
+		ct,
+		nil)
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error uploading the compress index. The upload will be retried.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", key),
+			sloghelper.Error("error", err))
+		return false
+	}
+	l.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Successfully uploaded the compress index to S3.",
+		sloghelper.String("bucket", s.S3Bucket),
+		sloghelper.String("key", key))
+	return true
+}
+
+// If Settings.CanaryReadAfterUpload is enabled then this reads a small
+// random range of the object at s3key back from S3 and compares it to the
+// same range in fd. This returns true if the data matched, or if canary
+// reads are disabled. Mismatches are counted in failures.
+func canaryRead(
+	ctx context.Context,
+	fd *os.File,
+	s3key string,
+	s *Settings,
+	l *slog.Logger,
+	failures *int64,
+) bool {
+	if !s.CanaryReadAfterUpload {
+		return true
+	}
 	stat, err := fd.Stat()
 	if err != nil {
 		l.LogAttrs(
@@ -66,83 +483,179 @@ func uploadToS3(
 		return false
 	}
 	size := stat.Size()
+	if size == 0 {
+		return true
+	}
 
-	// We also can get the MD5 of the content which helps validate
-	// the upload to ensure the file is only accepted if the data
-	// is correct. We can also get the file length here which helps
-	// with validation as well.
-	m := md5.New()
-	buffer := [1024]byte{}
-	if n, err := io.CopyBuffer(m, fd, buffer[:]); err != nil {
+	// Pick a random range of the file and read it locally.
+	length := int64(canaryReadLength)
+	if length > size {
+		length = size
+	}
+	start := rand.Int63n(size - length + 1)
+	local := make([]byte, length)
+	if _, err := fd.ReadAt(local, start); err != nil {
 		l.LogAttrs(
 			ctx,
 			slog.LevelError,
-			"Error reading from the file.",
+			"Error reading the canary range from the file.",
 			sloghelper.String("file", fd.Name()),
 			sloghelper.Error("error", err))
 		return false
-	} else if n != size {
+	}
+
+	// Then fetch the same range from S3.
+	body, err := s.objectStore().GetRange(ctx, s3key, start, length, "")
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error fetching the canary range from S3. The upload will be "+
+				"retried.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", s3key),
+			sloghelper.Error("error", err))
+		return false
+	}
+	defer body.Close()
+	remote, err := io.ReadAll(io.LimitReader(body, length+1))
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error reading the canary range from S3. The upload will be "+
+				"retried.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", s3key),
+			sloghelper.Error("error", err))
+		return false
+	} else if !bytes.Equal(local, remote) {
+		atomic.AddInt64(failures, 1)
 		l.LogAttrs(
 			ctx,
 			slog.LevelError,
-			"Short copy when calculating MD5 hash.",
-			sloghelper.Int64("expected-bytes", size),
-			sloghelper.Int64("copied-bytes", n))
+			"Data read back from S3 does not match the local file. The "+
+				"upload will be retried.",
+			sloghelper.String("bucket", s.S3Bucket),
+			sloghelper.String("key", s3key),
+			sloghelper.Int64("start", start),
+			sloghelper.Int64("length", length))
 		return false
 	}
-	poi.ContentLength = &size
-	hash := m.Sum(nil)
-	base64Hash := base64.StdEncoding.EncodeToString(hash)
-	hexHash := hex.EncodeToString(hash)
-	poi.ContentMD5 = &base64Hash
+	return true
+}
 
-	// And lastly we need to seek back to the start again.
-	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+// If Settings.VerifyUploadHash is enabled then this checks that the size of
+// the object at s3key matches fd, and then reads the object back from S3 and
+// checks that the hash of its uncompressed data matches hash, which was
+// computed locally. The hash stored with the object is only what was sent
+// so it can not be trusted to describe what S3 actually stored. This
+// returns true if the object matched, or if verification is disabled.
+// Mismatches are counted in mismatches.
+func verifyUpload(
+	ctx context.Context,
+	fd *os.File,
+	s3key string,
+	hash string,
+	s *Settings,
+	l *slog.Logger,
+	mismatches *int64,
+) bool {
+	if !s.VerifyUploadHash {
+		return true
+	}
+	l = l.With(
+		sloghelper.String("bucket", s.S3Bucket),
+		sloghelper.String("key", s3key))
+	stat, err := fd.Stat()
+	if err != nil {
 		l.LogAttrs(
 			ctx,
 			slog.LevelError,
-			"Error seeking to the start of the file.",
+			"Error stating the file.",
 			sloghelper.String("file", fd.Name()),
 			sloghelper.Error("error", err))
 		return false
 	}
-
-	// Next we need to actually initiate the transfer.
-	poo, err := s.S3Client.PutObject(&poi)
+	store := s.objectStore()
+	info, err := store.Head(ctx, s3key)
 	if err != nil {
 		l.LogAttrs(
 			ctx,
 			slog.LevelWarn,
-			"Error calling s3:PutObject. The request will be retried.",
-			sloghelper.String("bucket", *poi.Bucket),
-			sloghelper.String("key", *poi.Key),
+			"Error fetching the uploaded object's metadata from S3. The "+
+				"upload will be retried.",
 			sloghelper.Error("error", err))
 		return false
+	} else if info.Size != stat.Size() {
+		atomic.AddInt64(mismatches, 1)
+		l.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"The uploaded object is not the same size as the local file. "+
+				"The upload will be retried.",
+			sloghelper.Int64("expected-size", stat.Size()),
+			sloghelper.Int64("size", info.Size))
+		return false
 	}
 
-	// Validate that the uploaded content matches the expected validation
-	// sums.
-	if strings.Trim(*poo.ETag, `"`) != hexHash {
+	// Read the object back, using the ETag to make sure that it is the
+	// same object that was checked above, and hash it as it arrives.
+	body, err := store.GetRange(ctx, s3key, 0, -1, info.ETag)
+	if err != nil {
 		l.LogAttrs(
 			ctx,
 			slog.LevelWarn,
-			"Uploaded data has a different MD5 hash.",
-			sloghelper.String("bucket", *poi.Bucket),
-			sloghelper.String("key", *poi.Key),
-			sloghelper.String("local-file", fd.Name()),
-			sloghelper.String("expected-md5", *poi.ContentMD5),
-			sloghelper.String("returned-md5", *poo.ETag))
+			"Error reading the uploaded object back from S3. The upload "+
+				"will be retried.",
+			sloghelper.Error("error", err))
+		return false
+	}
+	defer body.Close()
+	var data io.Reader = body
+	if s.Compress {
+		unzipper, err := s.compressor().NewReader(body)
+		if err != nil {
+			atomic.AddInt64(mismatches, 1)
+			l.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"The uploaded object could not be decompressed. The upload "+
+					"will be retried.",
+				sloghelper.Error("error", err))
+			return false
+		}
+		defer unzipper.Close()
+		data = unzipper
+	}
+	h, err := hasher.Computer("hh", io.Discard)
+	if err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"Error creating the hasher.",
+			sloghelper.Error("error", err))
+		return false
+	}
+	if _, err := io.Copy(h, data); err != nil {
+		l.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error reading the uploaded object back from S3. The upload "+
+				"will be retried.",
+			sloghelper.Error("error", err))
+		return false
+	}
+	if remote := h.Hash(); remote != hash {
+		atomic.AddInt64(mismatches, 1)
+		l.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"The uploaded object does not match the local file. The upload "+
+				"will be retried.",
+			sloghelper.String("expected-hash", hash),
+			sloghelper.String("hash", remote))
 		return false
 	}
-
-	// Log something so its clear that something got uploaded.
-	l.LogAttrs(
-		ctx,
-		slog.LevelInfo,
-		"Successfully uploaded to S3.",
-		sloghelper.String("bucket", *poi.Bucket),
-		sloghelper.String("key", *poi.Key))
-
-	// Success!
 	return true
 }
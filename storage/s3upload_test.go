@@ -0,0 +1,772 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/internal/semaphore"
+	"github.com/liquidgecka/blobby/storage/fid"
+	"github.com/liquidgecka/blobby/storage/hasher"
+	"github.com/liquidgecka/blobby/storage/metrics"
+)
+
+func TestUploadToS3(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	contents := []byte("test file contents")
+	fd := T.TempFile()
+	_, err := fd.Write(contents)
+	T.ExpectSuccess(err)
+
+	// Patch out PutObject so that it validates the request and returns
+	// the expected ETag after a small delay.
+	sum := md5.Sum(contents)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+	defer monkey.Patch(
+		(*s3.S3).PutObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			poi *s3.PutObjectInput,
+			_ ...request.Option,
+		) (*s3.PutObjectOutput, error) {
+			T.Equal(*poi.Bucket, "bucket")
+			T.Equal(*poi.Key, "key")
+			data, err := ioutil.ReadAll(poi.Body)
+			T.ExpectSuccess(err)
+			T.Equal(data, contents)
+			time.Sleep(time.Millisecond)
+			return &s3.PutObjectOutput{ETag: &etag}, nil
+		},
+	).Unpatch()
+
+	settings := Settings{
+		S3Bucket: "bucket",
+		S3Client: &s3.S3{},
+	}
+	h := metrics.DurationHistogram{}
+	last := int64(0)
+	inFlight, waiting := int64(0), int64(0)
+	start := time.Now()
+	ok := uploadToS3(
+		context.Background(),
+		fd,
+		fid.FID{},
+		"key",
+		nil,
+		&settings,
+		NewTestLogger(),
+		&h,
+		&last,
+		&inFlight,
+		&waiting)
+	T.Equal(ok, true)
+	T.Equal(h.Count, int64(1))
+	T.Equal(h.Nanoseconds >= uint64(time.Millisecond), true)
+	T.Equal(last >= start.Unix(), true)
+
+	// A second upload should advance the metric again.
+	ok = uploadToS3(
+		context.Background(),
+		fd,
+		fid.FID{},
+		"key",
+		nil,
+		&settings,
+		NewTestLogger(),
+		&h,
+		&last,
+		&inFlight,
+		&waiting)
+	T.Equal(ok, true)
+	T.Equal(h.Count, int64(2))
+}
+
+func TestUploadToS3_AdditionalKeyFormats(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	contents := []byte("test file contents")
+	fd := T.TempFile()
+	_, err := fd.Write(contents)
+	T.ExpectSuccess(err)
+
+	// Patch out PutObject so that it records every key written along with
+	// the data that was uploaded to it.
+	sum := md5.Sum(contents)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+	written := map[string][]byte{}
+	defer monkey.Patch(
+		(*s3.S3).PutObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			poi *s3.PutObjectInput,
+			_ ...request.Option,
+		) (*s3.PutObjectOutput, error) {
+			T.Equal(*poi.Bucket, "bucket")
+			data, err := ioutil.ReadAll(poi.Body)
+			T.ExpectSuccess(err)
+			written[*poi.Key] = data
+			return &s3.PutObjectOutput{ETag: &etag}, nil
+		},
+	).Unpatch()
+
+	f := fid.FID{}
+	f.Generate(1)
+	additional, err := fid.NewFormatter("new/%L-%K")
+	T.ExpectSuccess(err)
+	settings := Settings{
+		S3AdditionalKeyFormats: []*fid.Formatter{additional},
+		S3BasePath:             "base",
+		S3Bucket:               "bucket",
+		S3Client:               &s3.S3{},
+	}
+	h := metrics.DurationHistogram{}
+	last := int64(0)
+	inFlight, waiting := int64(0), int64(0)
+	ok := uploadToS3(
+		context.Background(),
+		fd,
+		f,
+		"base/"+f.String(),
+		nil,
+		&settings,
+		NewTestLogger(),
+		&h,
+		&last,
+		&inFlight,
+		&waiting)
+	T.Equal(ok, true)
+	T.Equal(written, map[string][]byte{
+		"base/" + f.String():           contents,
+		"base/" + additional.Format(f): contents,
+	})
+}
+
+func TestUploadToS3_Multipart(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	contents := make([]byte, minS3PartSize*2+100)
+	rand.Read(contents)
+	fd := T.TempFile()
+	_, err := fd.Write(contents)
+	T.ExpectSuccess(err)
+
+	// Patch out the multipart calls so that they store each part, failing
+	// the first attempt at uploading the second part, or every attempt if
+	// failAll is set.
+	lock := sync.Mutex{}
+	parts := map[int64][]byte{}
+	attempts := map[int64]int{}
+	aborted := 0
+	failAll := false
+	defer monkey.Patch(
+		(*s3.S3).CreateMultipartUploadWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			cmui *s3.CreateMultipartUploadInput,
+			_ ...request.Option,
+		) (*s3.CreateMultipartUploadOutput, error) {
+			T.Equal(*cmui.Bucket, "bucket")
+			T.Equal(*cmui.Key, "key")
+			id := "upload"
+			return &s3.CreateMultipartUploadOutput{UploadId: &id}, nil
+		},
+	).Unpatch()
+	defer monkey.Patch(
+		(*s3.S3).UploadPartWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			upi *s3.UploadPartInput,
+			_ ...request.Option,
+		) (*s3.UploadPartOutput, error) {
+			T.Equal(*upi.UploadId, "upload")
+			data, err := ioutil.ReadAll(upi.Body)
+			T.ExpectSuccess(err)
+			lock.Lock()
+			defer lock.Unlock()
+			attempts[*upi.PartNumber] += 1
+			if *upi.PartNumber == 2 && (attempts[2] == 1 || failAll) {
+				return nil, fmt.Errorf("expected")
+			}
+			parts[*upi.PartNumber] = data
+			sum := md5.Sum(data)
+			etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+			return &s3.UploadPartOutput{ETag: &etag}, nil
+		},
+	).Unpatch()
+	defer monkey.Patch(
+		(*s3.S3).CompleteMultipartUploadWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			cmui *s3.CompleteMultipartUploadInput,
+			_ ...request.Option,
+		) (*s3.CompleteMultipartUploadOutput, error) {
+			T.Equal(len(cmui.MultipartUpload.Parts), 3)
+			m := md5.New()
+			for i, part := range cmui.MultipartUpload.Parts {
+				T.Equal(*part.PartNumber, int64(i+1))
+				sum := md5.Sum(parts[*part.PartNumber])
+				m.Write(sum[:])
+			}
+			etag := fmt.Sprintf(`"%s-3"`, hex.EncodeToString(m.Sum(nil)))
+			return &s3.CompleteMultipartUploadOutput{ETag: &etag}, nil
+		},
+	).Unpatch()
+	defer monkey.Patch(
+		(*s3.S3).AbortMultipartUploadWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			amui *s3.AbortMultipartUploadInput,
+			_ ...request.Option,
+		) (*s3.AbortMultipartUploadOutput, error) {
+			aborted += 1
+			return &s3.AbortMultipartUploadOutput{}, nil
+		},
+	).Unpatch()
+
+	settings := Settings{
+		S3Bucket:      "bucket",
+		S3Client:      &s3.S3{},
+		S3Concurrency: 2,
+		S3PartSize:    minS3PartSize,
+	}
+	retries := int64(0)
+	settings.ObjectStore = &s3ObjectStore{
+		settings:    &settings,
+		log:         NewTestLogger(),
+		partRetries: &retries,
+	}
+	h := metrics.DurationHistogram{}
+	last := int64(0)
+	inFlight, waiting := int64(0), int64(0)
+	ok := uploadToS3(
+		context.Background(),
+		fd,
+		fid.FID{},
+		"key",
+		nil,
+		&settings,
+		NewTestLogger(),
+		&h,
+		&last,
+		&inFlight,
+		&waiting)
+	T.Equal(ok, true)
+	T.Equal(retries, int64(1))
+	T.Equal(aborted, 0)
+	T.Equal(
+		append(append(parts[1], parts[2]...), parts[3]...),
+		contents)
+
+	// If a part fails every attempt then the upload is aborted.
+	failAll = true
+	ok = uploadToS3(
+		context.Background(),
+		fd,
+		fid.FID{},
+		"key",
+		nil,
+		&settings,
+		NewTestLogger(),
+		&h,
+		&last,
+		&inFlight,
+		&waiting)
+	T.Equal(ok, false)
+	T.Equal(aborted, 1)
+}
+
+// An ObjectStore whose uploads block until a value is sent on release.
+type blockingObjectStore struct {
+	memoryObjectStore
+	release chan struct{}
+}
+
+func (b *blockingObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	<-b.release
+	return nil
+}
+
+func TestUploadToS3_Semaphore(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	store := &blockingObjectStore{release: make(chan struct{})}
+	settings := Settings{
+		ObjectStore:     store,
+		S3Bucket:        "bucket",
+		UploadSemaphore: semaphore.New(1),
+	}
+	h := metrics.DurationHistogram{}
+	last := int64(0)
+	inFlight, waiting := int64(0), int64(0)
+	upload := func(ctx context.Context) bool {
+		return uploadToS3(
+			ctx,
+			fd,
+			fid.FID{},
+			"key",
+			nil,
+			&settings,
+			NewTestLogger(),
+			&h,
+			&last,
+			&inFlight,
+			&waiting)
+	}
+
+	// Only one upload runs at a time, the second waits for a slot.
+	results := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- upload(context.Background()) }()
+	}
+	T.TryUntil(
+		func() bool {
+			return atomic.LoadInt64(&inFlight) == 1 &&
+				atomic.LoadInt64(&waiting) == 1
+		},
+		time.Second)
+
+	// An upload that gives up waiting fails without ever starting.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	T.Equal(upload(ctx), false)
+
+	// Once the first finishes the second is allowed to run.
+	store.release <- struct{}{}
+	T.Equal(<-results, true)
+	T.TryUntil(
+		func() bool {
+			return atomic.LoadInt64(&inFlight) == 1 &&
+				atomic.LoadInt64(&waiting) == 0
+		},
+		time.Second)
+	store.release <- struct{}{}
+	T.Equal(<-results, true)
+	T.Equal(atomic.LoadInt64(&inFlight), int64(0))
+	T.Equal(h.Count, int64(2))
+}
+
+func TestS3ObjectOptions(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Nothing is set by default so the bucket defaults apply.
+	settings := Settings{}
+	class, sse, kmsKeyID := s3ObjectOptions(&settings)
+	T.Equal(class, (*string)(nil))
+	T.Equal(sse, (*string)(nil))
+	T.Equal(kmsKeyID, (*string)(nil))
+	T.Equal(etagIsMD5(&settings), true)
+
+	settings.S3StorageClass = s3.StorageClassStandardIa
+	settings.S3SSE = s3.ServerSideEncryptionAwsKms
+	settings.S3KMSKeyID = "key-id"
+	class, sse, kmsKeyID = s3ObjectOptions(&settings)
+	T.Equal(*class, "STANDARD_IA")
+	T.Equal(*sse, "aws:kms")
+	T.Equal(*kmsKeyID, "key-id")
+	T.Equal(etagIsMD5(&settings), false)
+
+	// AES256 encrypted objects still have an MD5 ETag.
+	settings.S3SSE = s3.ServerSideEncryptionAes256
+	T.Equal(etagIsMD5(&settings), true)
+}
+
+func TestCanaryRead(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	contents := make([]byte, canaryReadLength*4)
+	rand.Read(contents)
+	fd := T.TempFile()
+	_, err := fd.Write(contents)
+	T.ExpectSuccess(err)
+
+	// Patch out GetObject so that it serves the requested range of the
+	// object, optionally corrupting it.
+	corrupt := false
+	calls := 0
+	defer monkey.Patch(
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			calls += 1
+			T.Equal(*goi.Bucket, "bucket")
+			T.Equal(*goi.Key, "key")
+			start, end := 0, 0
+			_, err := fmt.Sscanf(*goi.Range, "bytes=%d-%d", &start, &end)
+			T.ExpectSuccess(err)
+			T.Equal(end-start+1, canaryReadLength)
+			data := append([]byte{}, contents[start:end+1]...)
+			if corrupt {
+				data[0] ^= 0xff
+			}
+			length := int64(len(data))
+			return &s3.GetObjectOutput{
+				Body:          io.NopCloser(bytes.NewReader(data)),
+				ContentLength: &length,
+			}, nil
+		},
+	).Unpatch()
+
+	// Nothing is read if canary reads are not enabled.
+	settings := Settings{
+		S3Bucket: "bucket",
+		S3Client: &s3.S3{},
+	}
+	failures := int64(0)
+	ok := canaryRead(
+		context.Background(),
+		fd,
+		"key",
+		&settings,
+		NewTestLogger(),
+		&failures)
+	T.Equal(ok, true)
+	T.Equal(calls, 0)
+
+	// Matching data passes.
+	settings.CanaryReadAfterUpload = true
+	ok = canaryRead(
+		context.Background(),
+		fd,
+		"key",
+		&settings,
+		NewTestLogger(),
+		&failures)
+	T.Equal(ok, true)
+	T.Equal(calls, 1)
+	T.Equal(failures, int64(0))
+
+	// Corrupt data fails and is counted.
+	corrupt = true
+	ok = canaryRead(
+		context.Background(),
+		fd,
+		"key",
+		&settings,
+		NewTestLogger(),
+		&failures)
+	T.Equal(ok, false)
+	T.Equal(calls, 2)
+	T.Equal(failures, int64(1))
+}
+
+func TestS3UploadTimeKey(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	f := fid.FID{56, 109, 67, 128, 0, 0, 127, 0, 0, 1}
+	now := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	settings := Settings{S3BasePath: "base"}
+
+	// By default no copy is written.
+	T.Equal(s3UploadTimeKey(&settings, f, now), "")
+
+	// With an upload format the upload time is added in front of the key
+	// from S3KeyFormat.
+	var err error
+	settings.S3KeyFormat, err = fid.NewFormatter("created=%F/%L-%K")
+	T.ExpectSuccess(err)
+	settings.S3KeyUploadFormat, err = fid.NewFormatter("uploaded=%F")
+	T.ExpectSuccess(err)
+	T.Equal(
+		s3UploadTimeKey(&settings, f, now),
+		"base/uploaded=2020-02-03/created=2000-01-01/2130706433-00000")
+}
+
+func TestUploadTimeCopy(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := fd.WriteString("data")
+	T.ExpectSuccess(err)
+	objects := memoryObjectStore{}
+	settings := Settings{ObjectStore: objects}
+	uploadTimeCopy(
+		context.Background(),
+		fd,
+		"uploaded/key",
+		nil,
+		&settings,
+		NewTestLogger())
+	T.Equal(objects, memoryObjectStore{"uploaded/key": []byte("data")})
+}
+
+func TestRetryUpload(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	settings := Settings{
+		UploadAttempts:      3,
+		UploadRetryDelay:    time.Millisecond,
+		UploadRetryMaxDelay: time.Millisecond * 2,
+	}
+	lock := sync.Mutex{}
+	lock.Lock()
+	retries := int64(0)
+	calls := 0
+	failures := 0
+	upload := func() bool {
+		calls++
+		// The lock must always be held while uploading.
+		T.Equal(lock.TryLock(), false)
+		return calls > failures
+	}
+
+	// An upload that works the first time is not retried.
+	ctx := context.Background()
+	l := NewTestLogger()
+	T.Equal(retryUpload(ctx, &settings, l, &lock, &retries, upload), true)
+	T.Equal(calls, 1)
+	T.Equal(retries, int64(0))
+
+	// An upload that works on the last attempt.
+	calls = 0
+	failures = 2
+	T.Equal(retryUpload(ctx, &settings, l, &lock, &retries, upload), true)
+	T.Equal(calls, 3)
+	T.Equal(retries, int64(2))
+
+	// An upload that never works gives up after UploadAttempts.
+	calls = 0
+	failures = 10
+	T.Equal(retryUpload(ctx, &settings, l, &lock, &retries, upload), false)
+	T.Equal(calls, 3)
+	T.Equal(retries, int64(4))
+
+	// A canceled context stops retrying.
+	calls = 0
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	T.Equal(
+		retryUpload(canceled, &settings, l, &lock, &retries, upload),
+		false)
+	T.Equal(calls, 1)
+	T.Equal(retries, int64(5))
+}
+
+// An ObjectStore that returns a fixed result from Head and fails everything
+// else.
+type headObjectStore struct {
+	info *ObjectInfo
+	err  error
+}
+
+func (h *headObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (h *headObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (
+	io.ReadCloser,
+	error,
+) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (h *headObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (
+	*ObjectInfo,
+	error,
+) {
+	return h.info, h.err
+}
+
+func (h *headObjectStore) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("not implemented")
+}
+
+func TestHashFile(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Data written through a whole file hasher must hash the same as the
+	// file read back from disk.
+	fd := T.TempFile()
+	h, err := hasher.Computer("hh", fd)
+	T.ExpectSuccess(err)
+	_, err = h.Write([]byte("first insert"))
+	T.ExpectSuccess(err)
+	_, err = h.Write([]byte("second insert"))
+	T.ExpectSuccess(err)
+	hash, err := hashFile(fd, 25)
+	T.ExpectSuccess(err)
+	T.Equal(hash, h.Hash())
+
+	// Only the requested length is hashed.
+	hash, err = hashFile(fd, 12)
+	T.ExpectSuccess(err)
+	T.NotEqual(hash, h.Hash())
+}
+
+func TestHashMetadata(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	settings := Settings{}
+	T.Equal(hashMetadata(&settings, nil, "hh=x"), (map[string]string)(nil))
+	settings.VerifyUploadHash = true
+	T.Equal(
+		hashMetadata(&settings, nil, "hh=x"),
+		map[string]string{uploadHashMetadata: "hh=x"})
+	metadata := map[string]string{"a": "b"}
+	T.Equal(
+		hashMetadata(&settings, metadata, "hh=x"),
+		map[string]string{"a": "b", uploadHashMetadata: "hh=x"})
+	T.Equal(metadata, map[string]string{"a": "b"})
+}
+
+func TestRecordsMetadata(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	settings := Settings{}
+	T.Equal(recordsMetadata(&settings, nil, 5), (map[string]string)(nil))
+	settings.RecordCountMetadata = true
+	T.Equal(
+		recordsMetadata(&settings, nil, 5),
+		map[string]string{recordCountMetadata: "5"})
+	metadata := map[string]string{"a": "b"}
+	T.Equal(
+		recordsMetadata(&settings, metadata, 5),
+		map[string]string{"a": "b", recordCountMetadata: "5"})
+	T.Equal(metadata, map[string]string{"a": "b"})
+
+	// Unknown counts are left out.
+	T.Equal(recordsMetadata(&settings, metadata, -1), metadata)
+}
+
+func TestVerifyUpload(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	contents := []byte("test file contents")
+	fd := T.TempFile()
+	_, err := fd.Write(contents)
+	T.ExpectSuccess(err)
+	hash, err := hashFile(fd, uint64(len(contents)))
+	T.ExpectSuccess(err)
+
+	objects := memoryObjectStore{}
+	settings := Settings{
+		S3Bucket:    "bucket",
+		ObjectStore: objects,
+	}
+	mismatches := int64(0)
+	verify := func() bool {
+		return verifyUpload(
+			context.Background(),
+			fd,
+			"key",
+			hash,
+			&settings,
+			NewTestLogger(),
+			&mismatches)
+	}
+
+	// Nothing is checked if verification is disabled.
+	T.Equal(verify(), true)
+	settings.VerifyUploadHash = true
+
+	// A matching object passes.
+	objects["key"] = contents
+	T.Equal(verify(), true)
+	T.Equal(mismatches, int64(0))
+
+	// A truncated object fails.
+	objects["key"] = contents[:10]
+	T.Equal(verify(), false)
+	T.Equal(mismatches, int64(1))
+
+	// As does an object that is the right size but was corrupted, even
+	// though the hash stored with it would still match.
+	corrupt := append([]byte{}, contents...)
+	corrupt[0] = 'T'
+	objects["key"] = corrupt
+	T.Equal(verify(), false)
+	T.Equal(mismatches, int64(2))
+
+	// Compressed objects are hashed after being decompressed.
+	buffer := bytes.Buffer{}
+	gz := gzip.NewWriter(&buffer)
+	_, err = gz.Write(contents)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(gz.Close())
+	compressed := T.TempFile()
+	_, err = compressed.Write(buffer.Bytes())
+	T.ExpectSuccess(err)
+	objects["key"] = buffer.Bytes()
+	settings.Compress = true
+	T.Equal(
+		verifyUpload(
+			context.Background(),
+			compressed,
+			"key",
+			hash,
+			&settings,
+			NewTestLogger(),
+			&mismatches),
+		true)
+	T.Equal(mismatches, int64(2))
+	settings.Compress = false
+
+	// Errors fetching the object fail the upload but are not counted as
+	// mismatches.
+	delete(objects, "key")
+	T.Equal(verify(), false)
+	T.Equal(mismatches, int64(2))
+}
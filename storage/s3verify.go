@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Checks that the configured bucket exists and can be accessed by calling
+// s3:HeadBucket. Responses to HEAD requests have no body so S3 reports
+// errors using only the HTTP status which the SDK turns into the NotFound
+// and Forbidden codes, these are treated the same as NoSuchBucket and
+// AccessDenied. Other object stores are not checked.
+func verifyBucket(s *Settings) error {
+	if s.S3Client == nil {
+		return nil
+	}
+	hbi := s3.HeadBucketInput{
+		Bucket: &s.S3Bucket,
+	}
+	_, err := s.S3Client.HeadBucket(&hbi)
+	if err == nil {
+		return nil
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchBucket, "NotFound":
+			return fmt.Errorf("S3 bucket %s does not exist.", s.S3Bucket)
+		case "AccessDenied", "Forbidden":
+			return fmt.Errorf("Access denied to S3 bucket %s.", s.S3Bucket)
+		}
+	}
+	return fmt.Errorf("Error accessing S3 bucket %s: %s", s.S3Bucket, err)
+}
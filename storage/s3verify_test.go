@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/liquidgecka/testlib"
+)
+
+func TestVerifyBucket(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Patch out HeadBucket so that it returns the configured error.
+	var headErr error
+	defer monkey.Patch(
+		(*s3.S3).HeadBucket,
+		func(_ *s3.S3, hbi *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+			T.Equal(*hbi.Bucket, "bucket")
+			return &s3.HeadBucketOutput{}, headErr
+		},
+	).Unpatch()
+
+	settings := Settings{
+		S3Bucket: "bucket",
+		S3Client: &s3.S3{},
+	}
+
+	// A bucket that can be accessed.
+	T.ExpectSuccess(verifyBucket(&settings))
+
+	// A bucket that does not exist.
+	headErr = awserr.New("NotFound", "Not Found", nil)
+	T.ExpectErrorMessage(
+		verifyBucket(&settings),
+		"S3 bucket bucket does not exist.")
+
+	// A bucket that can not be accessed.
+	headErr = awserr.New("Forbidden", "Forbidden", nil)
+	T.ExpectErrorMessage(
+		verifyBucket(&settings),
+		"Access denied to S3 bucket bucket.")
+
+	// Any other error.
+	headErr = fmt.Errorf("expected error")
+	T.ExpectErrorMessage(
+		verifyBucket(&settings),
+		"Error accessing S3 bucket bucket: expected error")
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+)
+
+// Opens connections to S3 ahead of time so the first uploads after startup
+// do not have to pay the cost of establishing TLS sessions. This is done by
+// issuing S3WarmConnections HeadBucket calls in parallel which forces the
+// HTTP client to open that many connections and keep them in its idle pool.
+// Failures are logged but otherwise ignored since this is purely an
+// optimization.
+func warmS3(ctx context.Context, s *Settings, l *slog.Logger) {
+	if s.S3WarmConnections < 1 || s.S3Client == nil {
+		return
+	}
+	hbi := s3.HeadBucketInput{
+		Bucket: &s.S3Bucket,
+	}
+	failures := int32(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < s.S3WarmConnections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.S3Client.HeadBucket(&hbi); err != nil {
+				atomic.AddInt32(&failures, 1)
+				l.LogAttrs(
+					ctx,
+					slog.LevelWarn,
+					"Error calling s3:HeadBucket while warming connections.",
+					sloghelper.String("bucket", s.S3Bucket),
+					sloghelper.Error("error", err))
+			}
+		}()
+	}
+	wg.Wait()
+	l.LogAttrs(
+		ctx,
+		slog.LevelDebug,
+		"Finished warming S3 connections.",
+		sloghelper.Int("connections", s.S3WarmConnections),
+		sloghelper.Int32("failures", failures))
+}
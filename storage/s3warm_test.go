@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/liquidgecka/testlib"
+)
+
+func TestWarmS3(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Patch out HeadBucket so we can count the calls made.
+	calls := int32(0)
+	fail := false
+	defer monkey.Patch(
+		(*s3.S3).HeadBucket,
+		func(_ *s3.S3, hbi *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+			T.Equal(*hbi.Bucket, "bucket")
+			atomic.AddInt32(&calls, 1)
+			if fail {
+				return nil, fmt.Errorf("expected error")
+			}
+			return &s3.HeadBucketOutput{}, nil
+		},
+	).Unpatch()
+
+	settings := Settings{
+		S3Bucket: "bucket",
+		S3Client: &s3.S3{},
+	}
+
+	// When disabled no calls should be made.
+	warmS3(context.Background(), &settings, NewTestLogger())
+	T.Equal(calls, int32(0))
+
+	// When enabled the configured number of calls are made.
+	settings.S3WarmConnections = 4
+	warmS3(context.Background(), &settings, NewTestLogger())
+	T.Equal(calls, int32(4))
+
+	// Failures do not cause any problems.
+	fail = true
+	warmS3(context.Background(), &settings, NewTestLogger())
+	T.Equal(calls, int32(8))
+}
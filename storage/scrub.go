@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liquidgecka/blobby/internal/sloghelper"
+	"github.com/liquidgecka/blobby/storage/hasher"
+)
+
+// The location and HighwayHash of a single insert into a primary or
+// replica. These are recorded as data is written so that Scrub() can check
+// that the data on disk has not changed since.
+type recordHash struct {
+	start  uint64
+	length uint64
+	hash   string
+}
+
+// The records that have been written to a file. Inserts add records while
+// Scrub() may be reading them so access is protected by a lock.
+type recordHashes struct {
+	lock    sync.Mutex
+	records []recordHash
+
+	// The number of records that were written to the file before this
+	// process started. Their hashes are not known so they are not in
+	// records. This is -1 if the number could not be determined.
+	recovered int
+}
+
+// Adds a record to the list.
+func (r *recordHashes) add(start, length uint64, hash string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, recordHash{
+		start:  start,
+		length: length,
+		hash:   hash,
+	})
+}
+
+// Returns the records that have been added so far. Records are never
+// modified once added so the returned slice is safe to use without the
+// lock.
+func (r *recordHashes) get() []recordHash {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.records
+}
+
+// Returns the number of records in the file, or -1 if it is not known.
+func (r *recordHashes) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.recovered < 0 {
+		return -1
+	}
+	return r.recovered + len(r.records)
+}
+
+// A record that did not match its hash when it was scrubbed.
+type ScrubCorruption struct {
+	FID    string `json:"fid"`
+	Start  uint64 `json:"start"`
+	Length uint64 `json:"length"`
+}
+
+// The results of a call to Scrub().
+type ScrubResult struct {
+	// The number of files, records and bytes that were checked.
+	Files   int   `json:"files"`
+	Records int   `json:"records"`
+	Bytes   int64 `json:"bytes"`
+
+	// The records that did not match their hash.
+	Corruptions []ScrubCorruption `json:"corruptions"`
+}
+
+// A file that is to be checked by Scrub().
+type scrubFile struct {
+	fidStr      string
+	fileName    string
+	records     *recordHashes
+	quarantined *int32
+}
+
+// Reads back every insert written to the primaries and replicas on this
+// server and checks it against the hash computed when it was written. Any
+// mismatches are logged, counted and returned, and if
+// Settings.ScrubQuarantine is enabled the file is no longer used to serve
+// reads. Files are checked one at a time with reads limited to
+// Settings.ScrubBytesPerSecond. Only one scrub runs at a time, a call made
+// while another scrub is running waits for it to finish first. An error is
+// only returned if ctx is canceled.
+func (s *Storage) Scrub(ctx context.Context) (*ScrubResult, error) {
+	s.scrubLock.Lock()
+	defer s.scrubLock.Unlock()
+
+	// Take a snapshot of the files to check so that the locks are not held
+	// while reading.
+	var files []scrubFile
+	func() {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		for fidStr, p := range s.primaries {
+			if p.fd != nil {
+				files = append(files, scrubFile{
+					fidStr:      fidStr,
+					fileName:    p.fd.Name(),
+					records:     &p.records,
+					quarantined: &p.quarantined,
+				})
+			}
+		}
+	}()
+	func() {
+		s.replicasLock.Lock()
+		defer s.replicasLock.Unlock()
+		for fidStr, r := range s.replicas {
+			if r.fd != nil {
+				files = append(files, scrubFile{
+					fidStr:      fidStr,
+					fileName:    r.fd.Name(),
+					records:     &r.records,
+					quarantined: &r.quarantined,
+				})
+			}
+		}
+	}()
+
+	result := &ScrubResult{}
+	for _, file := range files {
+		if err := s.scrubFile(ctx, file, result); err != nil {
+			return result, err
+		}
+	}
+	s.settings.BaseLogger.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"Scrub complete.",
+		sloghelper.Int("files", result.Files),
+		sloghelper.Int("records", result.Records),
+		sloghelper.Int64("bytes", result.Bytes),
+		sloghelper.Int("corruptions", len(result.Corruptions)))
+	return result, nil
+}
+
+// Checks the records in a single file, adding the results to result.
+func (s *Storage) scrubFile(
+	ctx context.Context,
+	file scrubFile,
+	result *ScrubResult,
+) error {
+	records := file.records.get()
+	if len(records) == 0 {
+		return nil
+	}
+	log := s.settings.BaseLogger.With(
+		sloghelper.String("fid", file.fidStr),
+		sloghelper.String("file", file.fileName))
+
+	// The file is opened by name so that a file that has been deleted
+	// since the snapshot was taken is simply skipped.
+	fd, err := os.Open(file.fileName)
+	if err != nil {
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Unable to open the file for scrubbing, skipping it.",
+			sloghelper.Error("error", err))
+		return nil
+	}
+	defer fd.Close()
+	result.Files++
+
+	for _, record := range records {
+		hsum, err := hasher.Validator(record.hash, io.Discard)
+		if err != nil {
+			// This shouldn't ever happen since the hash was either
+			// generated or validated by this server.
+			log.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Unable to parse the hash of a record.",
+				sloghelper.String("hash-str", record.hash),
+				sloghelper.Error("error", err))
+			continue
+		}
+		section := io.NewSectionReader(
+			fd,
+			int64(record.start),
+			int64(record.length))
+		n, err := io.Copy(hsum, s.scrubLimiter.ReadSeeker(ctx, section))
+		result.Bytes += n
+		atomic.AddInt64(&s.metrics.ScrubbedBytes, n)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Error reading the file for scrubbing, skipping it.",
+				sloghelper.Error("error", err))
+			return nil
+		}
+		result.Records++
+		if uint64(n) == record.length && hsum.Check() {
+			continue
+		}
+
+		// The data on disk no longer matches what was written.
+		atomic.AddInt64(&s.metrics.ScrubCorruptions, 1)
+		result.Corruptions = append(result.Corruptions, ScrubCorruption{
+			FID:    file.fidStr,
+			Start:  record.start,
+			Length: record.length,
+		})
+		log.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"Scrub found data that does not match its hash.",
+			sloghelper.Uint64("start", record.start),
+			sloghelper.Uint64("length", record.length),
+			sloghelper.Int64("read-length", n),
+			sloghelper.String("expected-hash", record.hash),
+			sloghelper.String("found-hash", hsum.Hash()))
+		if s.settings.ScrubQuarantine &&
+			atomic.CompareAndSwapInt32(file.quarantined, 0, 1) {
+			log.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Quarantined the file, it will no longer serve reads.")
+		}
+	}
+	return nil
+}
+
+// Schedules the next background scrub if Settings.ScrubInterval is set.
+func (s *Storage) scheduleScrub() {
+	if s.settings.ScrubInterval <= 0 {
+		return
+	}
+	s.settings.DelayQueue.Alter(
+		&s.scrubToken,
+		time.Now().Add(s.settings.ScrubInterval),
+		s.backgroundScrub)
+}
+
+// Called from the DelayQueue to run a scrub and then schedule the next
+// one. The interval is measured from the end of the scrub so that a slow
+// scrub never overlaps with the next one.
+func (s *Storage) backgroundScrub(ctx context.Context) {
+	s.Scrub(ctx)
+	s.scheduleScrub()
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+
+	"github.com/liquidgecka/blobby/storage/fid"
+	"github.com/liquidgecka/blobby/storage/hasher"
+)
+
+func TestStorage_Scrub(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Returns the hash of the given data.
+	hash := func(data string) string {
+		h, err := hasher.Computer("hh", io.Discard)
+		T.ExpectSuccess(err)
+		_, err = io.Copy(h, strings.NewReader(data))
+		T.ExpectSuccess(err)
+		return h.Hash()
+	}
+
+	// Setup a storage with a primary and a replica that have each had two
+	// inserts.
+	pf := fid.FID{}
+	pf.Generate(1)
+	rf := fid.FID{}
+	rf.Generate(2)
+	pfd := T.TempFile()
+	_, err := pfd.Write([]byte("0123456789"))
+	T.ExpectSuccess(err)
+	rfd := T.TempFile()
+	_, err = rfd.Write([]byte("abcdefghij"))
+	T.ExpectSuccess(err)
+	prim := &primary{fd: pfd, offset: 10}
+	prim.records.add(0, 4, hash("0123"))
+	prim.records.add(4, 6, hash("456789"))
+	repl := &replica{fd: rfd, offset: 10}
+	repl.records.add(0, 5, hash("abcde"))
+	repl.records.add(5, 5, hash("fghij"))
+	s := Storage{
+		primaries: map[string]*primary{pf.String(): prim},
+		replicas:  map[string]*replica{rf.String(): repl},
+		settings: Settings{
+			BaseLogger: NewTestLogger(),
+		},
+	}
+
+	// Clean files report no corruptions.
+	result, err := s.Scrub(context.Background())
+	T.ExpectSuccess(err)
+	T.Equal(result, &ScrubResult{Files: 2, Records: 4, Bytes: 20})
+	T.Equal(s.GetMetrics().ScrubbedBytes, int64(20))
+
+	// Damaged records are reported but the file is still used for reads
+	// unless quarantine is enabled.
+	_, err = pfd.WriteAt([]byte("X"), 5)
+	T.ExpectSuccess(err)
+	result, err = s.Scrub(context.Background())
+	T.ExpectSuccess(err)
+	T.Equal(result.Corruptions, []ScrubCorruption{
+		{FID: pf.String(), Start: 4, Length: 6},
+	})
+	T.Equal(prim.quarantined, int32(0))
+	T.Equal(s.GetMetrics().ScrubCorruptions, int64(1))
+
+	// Truncated files are corrupt as well, and are quarantined when
+	// enabled.
+	s.settings.ScrubQuarantine = true
+	T.ExpectSuccess(rfd.Truncate(7))
+	result, err = s.Scrub(context.Background())
+	T.ExpectSuccess(err)
+	T.Equal(len(result.Corruptions), 2)
+	T.Equal(prim.quarantined, int32(1))
+	T.Equal(repl.quarantined, int32(1))
+	T.Equal(s.GetMetrics().ScrubCorruptions, int64(3))
+
+	// Quarantined files no longer serve reads.
+	rc := testReadConfig{id: "test-id", fid: pf, start: 0, length: 4}
+	s.settings.ObjectStore = memoryObjectStore{}
+	s.settings.MachineID = 1
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotFound("test-id"))
+
+}
+
+func TestRecordHashes_Count(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	r := recordHashes{}
+	T.Equal(r.count(), 0)
+	r.add(0, 10, "a")
+	r.add(10, 5, "b")
+	T.Equal(r.count(), 2)
+
+	// Records from before a restart are included when known.
+	r.recovered = 3
+	T.Equal(r.count(), 5)
+	r.recovered = -1
+	T.Equal(r.count(), -1)
+}
@@ -1,14 +1,20 @@
 package storage
 
 import (
+	"context"
+	"hash/fnv"
 	"io"
 	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/liquidgecka/blobby/internal/delayqueue"
+	"github.com/liquidgecka/blobby/internal/ratelimit"
+	"github.com/liquidgecka/blobby/internal/semaphore"
 	"github.com/liquidgecka/blobby/internal/workqueue"
 	"github.com/liquidgecka/blobby/storage/fid"
 )
@@ -17,40 +23,146 @@ const (
 	// The default heart beat interval.
 	defaultHeartBeatTime = time.Minute
 
+	// The default FileMode.
+	defaultFileMode = os.FileMode(0644)
+
+	// The largest record that can be stored since IDs encode the length
+	// of the record in 32 bits. This applies even if MaxRecordBytes is not
+	// set so that inserts of an unknown length can not overflow the ID.
+	maxRecordLength = int64(math.MaxUint32)
+
 	// Default OpenFilesMaximum is 32
 	defaultOpenFilesMaximum = int32(32)
 
 	// Default OpenFilesMinimum is 1
 	defaultOpenFilesMinimum = int32(1)
 
+	// Default OpenFilesGrowthFactor is 2, which along with the default
+	// OpenFilesGrowthStep of zero opens a new primary once more than 2^n
+	// callers are waiting with n primaries open.
+	defaultOpenFilesGrowthFactor = float64(2)
+
 	// Default UploadLargerThan is 100MB.
 	defaultUploadLargerThan = uint64(1024 * 1024 * 100)
 
+	// Default AsyncReplicationMaxPending is 16.
+	defaultAsyncReplicationMaxPending = 16
+
 	// Default UploadOlder is 30 minutes.
 	defaultUploadOlder = time.Minute * 30
+
+	// Default S3PartSize is 64MB.
+	defaultS3PartSize = int64(1024 * 1024 * 64)
+
+	// Default S3Concurrency is 4.
+	defaultS3Concurrency = 4
+
+	// Default IdempotencyKeyMaxEntries is 100,000.
+	defaultIdempotencyKeyMaxEntries = 100000
+
+	// Default ReadCacheMaxBytes is 1GB.
+	defaultReadCacheMaxBytes = int64(1024 * 1024 * 1024)
+
+	// Default UploadAttempts is 3, backing off from 1 second up to 30
+	// seconds between them.
+	defaultUploadAttempts      = 3
+	defaultUploadRetryDelay    = time.Second
+	defaultUploadRetryMaxDelay = time.Second * 30
+)
+
+const (
+	// Never explicitly sync data to disk, leaving it to the operating
+	// system. This is the default if no policy is configured.
+	SyncPolicyNone = "none"
+
+	// Sync each insert (or replication) to disk before it is acknowledged.
+	SyncPolicyOnInsert = "on-insert"
+
+	// Sync the file to disk once it stops accepting new data, before it is
+	// compressed or uploaded.
+	SyncPolicyOnRotate = "on-rotate"
 )
 
 type Settings struct {
-	// User to perform uploads from this namespace.
-	AWSUploader *s3manager.Uploader
+	// If true then reads from compressed objects that were uploaded
+	// without a compress index are served by downloading the object and
+	// decompressing it from the start until the requested data is reached.
+	// This is expensive for large objects so by default these reads fail
+	// with ErrNotPossible. The index is always used when it exists.
+	AllowFullDecompressReads bool
 
 	// A function that will return a pool of Blobby remotes that
 	// should be used for a new Replica.
 	AssignRemotes func(int) ([]Remote, error)
 
+	// If true then inserts will return to the client as soon as the data
+	// has been written to the local disk rather than waiting for the
+	// replicas. Replication happens in the background, in order, and the
+	// file will not be compressed or uploaded until it has completed.
+	// AsyncReplicationMaxPending limits how many inserts per primary can be
+	// waiting on replication before new inserts block.
+	AsyncReplication           bool
+	AsyncReplicationMaxPending int
+
 	// The base directory that files will be stored in for this namespace.
 	BaseDirectory string
 
+	// If greater than zero then data files are spread across this many
+	// subdirectories of BaseDirectory, picked by hashing the fid, rather
+	// than all being stored directly in it. This keeps any one directory
+	// from growing large on busy nodes. Files in either layout are
+	// recovered at startup so this can be changed on an existing
+	// directory. This can not be more than 256.
+	ShardDirectories int
+
 	// If this is set to something other than nil then logging will be
 	// written to this output.
 	BaseLogger *slog.Logger
 
+	// If true then after each upload a small random range of the object is
+	// read back from S3 and compared against the local file. If the data
+	// does not match then the upload is retried. This catches gross
+	// corruption at the cost of one small S3 read per upload.
+	CanaryReadAfterUpload bool
+
+	// Controls how new primary files handle the system clock moving
+	// backwards when generating their FID.
+	ClockSkewPolicy fid.ClockSkewPolicy
+
 	// When set to true then the file will be compressed before its uploaded
 	// to S3. This will break the ability to fetch identifiers not found in
 	// the local file system cache to use accordingly.
 	Compress      bool
 	CompressLevel int
 
+	// If true then rather than always using CompressLevel the level is
+	// adjusted between CompressLevelMin and CompressLevelMax depending on
+	// how well compression is keeping up. When the files waiting in
+	// CompressWorkQueue would take longer than CompressAdaptiveTarget to
+	// compress at the recently observed throughput the level is lowered,
+	// and when nothing is waiting it is raised again. The levels default to
+	// 1 and the highest level supported by CompressAlgorithm, and the
+	// target defaults to one minute.
+	CompressAdaptive       bool
+	CompressAdaptiveTarget time.Duration
+	CompressLevelMin       int
+	CompressLevelMax       int
+
+	// The algorithm used when Compress is true. This must be one of the
+	// CompressAlgorithm constants, and if empty gzip will be used. The
+	// valid values for CompressLevel depend on the algorithm chosen.
+	CompressAlgorithm string
+
+	// If greater than zero then compressed files are written as a series of
+	// independent compressed streams, one every CompressIndexInterval
+	// uncompressed bytes, and an index of where each stream starts is
+	// uploaded to S3 alongside the object. This allows reads to be served
+	// from compressed objects in S3 using ranged requests. The index is
+	// encoded using CompressIndexFormat which must be one of the
+	// CompressIndexFormat constants, if empty the binary format is used.
+	CompressIndexInterval uint64
+	CompressIndexFormat   string
+
 	// A work queue for Compression related activities.
 	CompressWorkQueue *workqueue.WorkQueue
 
@@ -59,6 +171,16 @@ type Settings struct {
 	// local file rather than fetching from S3.
 	DelayDelete time.Duration
 
+	// If true then Read() will only serve data that has been durably
+	// uploaded to S3. Reads of data that only exists locally or on remotes
+	// will be rejected with ErrNotDurable.
+	DurableReadsOnly bool
+
+	// The permissions that data files, compressed files and the persisted
+	// idempotency keys are created with. The process umask still applies.
+	// If this is zero then files are created with 0644.
+	FileMode os.FileMode
+
 	// The DelayQueue that will be used to schedule events like heart beat
 	// timers, replica timeouts, etc.
 	DelayQueue *delayqueue.DelayQueue
@@ -69,15 +191,87 @@ type Settings struct {
 	// A WorkQueue for processing remote replica delete requests.
 	DeleteRemotesWorkQueue *workqueue.WorkQueue
 
+	// A function that checks if a remote has the data for a ReadConfig
+	// stored locally without fetching it, returning ErrNotFound if it does
+	// not. This is used by Storage.Stat(). If nil then Stat() checks S3
+	// for data that was created on another machine.
+	Head func(context.Context, ReadConfig) error
+
 	// After this amount of time a replica will be considered "orphaned" and
 	// will trigger an upload of the data. This ensures that a primary being
 	// lost won't cause data loss.
 	HeartBeatTime time.Duration
 
+	// Primaries send heart beats every HeartBeatTime/2, moved earlier or
+	// later by a random amount of up to HeartBeatJitter so that the heart
+	// beats of many primaries do not all arrive at the same time. Replicas
+	// wait an extra HeartBeatJitter before considering themselves orphaned.
+	// This must be less than HeartBeatTime/2.
+	HeartBeatJitter time.Duration
+
+	// The encoding that IDs returned from Insert are generated in. IDs in
+	// every encoding can always be read regardless of this setting.
+	IDEncoding fid.IDEncoding
+
+	// If IdempotencyKeyTTL is greater than zero then an insert that
+	// supplies an idempotency key returns the ID generated by an earlier
+	// insert with the same key, if that insert happened within the TTL,
+	// rather than writing the data again. At most IdempotencyKeyMaxEntries
+	// keys are remembered (100,000 by default) with the least recently used
+	// keys evicted first. Keys are only known to this Storage, and unless
+	// IdempotencyKeyPersist is set they are forgotten on restart.
+	IdempotencyKeyTTL        time.Duration
+	IdempotencyKeyMaxEntries int
+	IdempotencyKeyPersist    bool
+
+	// If true then a request to initialize a replica that already exists
+	// and is still accepting data will succeed rather than returning an
+	// error. This makes it safe for a primary to retry an initialize call
+	// that failed in transit. Replicas in any other state will still
+	// return an error.
+	IdempotentReplicaInitialize bool
+
+	// The upper bounds of the buckets used by the insert queue, replicate,
+	// and write latency histograms, in increasing order. If empty then
+	// metrics.DefaultLatencyHistogramBuckets is used.
+	InsertLatencyBuckets []time.Duration
+
+	// If greater than zero then an insert that has waited this long for a
+	// primary to become available is rejected with ErrInsertQueueTimeout
+	// rather than waiting indefinitely. This lets clients back off and
+	// retry elsewhere when the namespace is overloaded.
+	InsertQueueTimeout time.Duration
+
+	// If greater than zero then a replica that has been orphaned will wait
+	// this long before it starts uploading. If the primary resumes sending
+	// heart beats during this window then the replica goes back to waiting
+	// for updates rather than uploading data the primary will upload anyway.
+	OrphanGracePeriod time.Duration
+
 	// The machine ID that is serving this name space. This must be unique
 	// within all of the instances in the list of remotes.
 	MachineID uint32
 
+	// If greater than zero then Insert will reject data with ErrDiskFull
+	// once the data written to the primaries and replicas of this name
+	// space would take more than this many bytes. Other name spaces,
+	// compressed copies, the read cache and space preallocated but not yet
+	// written are not counted.
+	MaxDiskBytes int64
+
+	// If greater than zero then a single insert larger than this many
+	// bytes is rejected with ErrRecordTooLarge. Inserts that declare a
+	// larger length are rejected before any data is read, and inserts of
+	// an unknown length are rolled back once they pass the limit. Replicate
+	// calls larger than this are rejected as well. Inserts are never
+	// allowed to be larger than 4GB since that is the largest length that
+	// an ID can hold.
+	MaxRecordBytes int64
+
+	// If true then new primaries are given FIDs that use the millisecond
+	// layout rather than whole seconds.
+	MillisecondFIDs bool
+
 	// The name of the napespace that this Storage implementation will
 	// be serving.
 	NameSpace string
@@ -87,18 +281,107 @@ type Settings struct {
 	// metrics.
 	NamespaceTagKeyPrefix string
 
+	// The object store that files are uploaded to and read back from. If
+	// this is nil then objects are stored in S3 using S3Client.
+	ObjectStore ObjectStore
+
+	// If set then this is called after each primary or replica has been
+	// successfully uploaded. Calls are made one at a time from a background
+	// goroutine so they never delay the upload, and a call that returns an
+	// error is retried a few times before the notification is dropped.
+	// UploadWebhook() returns a function that POSTs the event to a URL.
+	OnUpload func(context.Context, UploadEvent) error
+
+	// Controls how eagerly new primaries are opened when callers are
+	// waiting for one. With n primaries open a new one is opened once more
+	// than OpenFilesGrowthStep*n + OpenFilesGrowthFactor^n callers are
+	// waiting, up to OpenFilesMaximum. A larger factor makes the curve
+	// steeper so fewer files are opened during spikes while a factor of 1
+	// makes it purely linear. The factor defaults to 2 and can not be less
+	// than 1, the step defaults to zero.
+	OpenFilesGrowthFactor float64
+	OpenFilesGrowthStep   float64
+
 	// The minimum and maximum number of open master files that are allowed
 	// to be open.
 	OpenFilesMaximum int32
 	OpenFilesMinimum int32
 
-	// A function that fetches data from a remote.
-	Read func(ReadConfig) (io.ReadCloser, error)
+	// If true then large files are compressed by splitting them into chunks
+	// that are compressed by up to ParallelCompressWorkers goroutines at
+	// once, each chunk being written as its own compressed stream. The
+	// result is still a valid file for the algorithm and works with
+	// CompressIndexInterval. Small files are always compressed serially.
+	// The number of workers defaults to the number of CPUs.
+	ParallelCompress        bool
+	ParallelCompressWorkers int
+
+	// If greater than zero then this many bytes of disk space are reserved
+	// for each primary and replica file when it is opened so that appending
+	// small inserts does not fragment the file. The space is reserved
+	// without changing the size of the file so uploads and recovery only
+	// ever see the data that was actually written. This is only supported
+	// on Linux and is ignored on other platforms.
+	PreallocateBytes int64
+
+	// A function that fetches data from a remote. The context is the one
+	// passed to Storage.Read() so canceling it aborts the remote request.
+	Read func(context.Context, ReadConfig) (io.ReadCloser, error)
 
-	// The number of replicas that each master file should be assigned.
+	// If true then Read() will serve local data from the file descriptor
+	// that the primary or replica already has open rather than opening the
+	// file by name. A reference is held on the descriptor until the read
+	// finishes so a file that is deleted or rotated mid read can still be
+	// served without falling back to a remote or S3.
+	ReadFromOpenFile bool
+
+	// If true then data that is read from S3 is also written to a cache on
+	// local disk and later reads of the same data are served from the
+	// cache rather than S3. The cache is kept below ReadCacheMaxBytes by
+	// evicting the least recently used data, and if ReadCacheMaxAge is
+	// greater than zero data older than that is not served. If
+	// ReadCacheMaxBytes is not set it defaults to 1GB.
+	ReadCache         bool
+	ReadCacheMaxBytes int64
+	ReadCacheMaxAge   time.Duration
+
+	// If true then the number of records in each file is stored with the
+	// uploaded object under the Blobby-Records metadata key so that
+	// consumers can size batches without reading the object. Files whose
+	// record count is not known, such as replicas recovered from a file
+	// system that could not store it, are uploaded without it. Enabling
+	// this also stores the count with each file on every insert so that it
+	// survives a restart.
+	RecordCountMetadata bool
+
+	// The number of replicas that each master file should be assigned. If
+	// this is zero then data is only stored locally until it is uploaded
+	// to S3 and none of the replication, heart beat or remote delete steps
+	// are performed.
 	Replicas int
 
-	// S3 client used for downloading objects from S3.
+	// If greater than zero and less than Replicas then an insert succeeds
+	// once this many replicas have accepted the data rather than requiring
+	// all of them to. Replicas that fail are not sent any more data for
+	// the file but are still deleted once it has been uploaded.
+	ReplicaQuorum int
+
+	// Returns the remotes that may hold a replica of a file created by the
+	// given machine. If that machine can not be reached when reading then
+	// these are asked for their local copy before falling back to S3. If
+	// this is nil then reads go straight to S3 instead.
+	ReplicaHolders func(machine uint32) []Remote
+
+	// If true then files that have been uploaded are kept readable on the
+	// local disk for DelayDelete so that reads of recently inserted data do
+	// not need to go to S3. Replicas are retained as well rather than being
+	// deleted as soon as they are uploaded, and since retained files are
+	// known to be in S3 they are also used to serve durable reads. This has
+	// no effect unless DelayDelete is set.
+	RetainForReads bool
+
+	// S3 client used for uploading objects to and downloading objects from
+	// S3. This is only required if ObjectStore is not set.
 	S3Client *s3.S3
 
 	// The S3 bucket and base path used for uploads as well as an optional
@@ -108,6 +391,106 @@ type Settings struct {
 	S3BasePath  string
 	S3KeyFormat *fid.Formatter
 
+	// If set then once an object has been uploaded under S3KeyFormat a copy
+	// is also written under a key that is prefixed with this format rendered
+	// against the time of the upload, followed by the key from S3KeyFormat.
+	// This allows objects to be partitioned by the time that they landed in
+	// S3 rather than when they were created. Like S3AdditionalKeyFormats the
+	// copy is best effort, and since the upload time can not be derived from
+	// an ID reads never use it.
+	S3KeyUploadFormat *fid.Formatter
+
+	// If set then uploaded objects will also be written under each of
+	// these key formats. Writes to these keys are best effort, though
+	// Read() will try each of them in order if the object is not found
+	// under S3KeyFormat. This allows migrating from one key format to
+	// another without breaking consumers of either.
+	S3AdditionalKeyFormats []*fid.Formatter
+
+	// Files larger than S3PartSize are uploaded using a multipart upload
+	// made of parts of this size, uploading S3Concurrency parts at a time.
+	// A part that fails to upload is retried on its own rather than
+	// restarting the whole transfer. The part size is increased if needed
+	// to keep within the S3 limit on the number of parts. If not set these
+	// default to 64MB and 4.
+	S3PartSize    int64
+	S3Concurrency int
+
+	// The storage class and server side encryption that uploaded objects
+	// are written with. S3SSE can be "AES256" or "aws:kms", and S3KMSKeyID
+	// can only be set when using "aws:kms". If left empty the bucket
+	// defaults are used. Objects encrypted with "aws:kms" do not have an
+	// MD5 ETag so uploads rely on S3 validating the Content-MD5 instead.
+	S3StorageClass string
+	S3SSE          string
+	S3KMSKeyID     string
+
+	// If greater than zero then this many connections to S3 will be opened
+	// when the Storage is started so that the first uploads do not need
+	// to wait for new connections to be established.
+	S3WarmConnections int
+
+	// If greater than zero then every call to the object store, including
+	// reading the body returned from a read, must finish within this
+	// amount of time. Uploads larger than S3PartSize are allowed this much
+	// time for each part. Reads that take longer fail with ErrS3Timeout and
+	// uploads are requeued. If zero then only the defaults of the client
+	// apply.
+	S3OperationTimeout time.Duration
+
+	// If greater than zero then every primary will be shut down and
+	// uploaded at the next wall clock boundary that is a multiple of this
+	// duration (measured in UTC), regardless of its size or age. Setting
+	// this to an hour for example will rotate all primaries at the top of
+	// every hour. UploadOlder still applies, so files can be rotated
+	// earlier than the boundary if UploadOlder is shorter.
+	RotateEvery time.Duration
+
+	// If greater than zero then every primary and replica on disk will be
+	// scrubbed in the background this often. Scrubbing reads back each
+	// insert and checks it against the HighwayHash that was computed when
+	// it was written in order to catch bit rot and partial writes. Only
+	// data written since the server started can be scrubbed since the
+	// hashes are not stored on disk. Reads done by the scrub are limited
+	// to ScrubBytesPerSecond so that it does not starve other disk IO, if
+	// zero then they are not limited.
+	ScrubInterval       time.Duration
+	ScrubBytesPerSecond int64
+
+	// If true then files that fail a scrub are quarantined, they are no
+	// longer used to serve reads so that reads fall back to the replicas
+	// or S3. Otherwise mismatches are only logged and counted.
+	ScrubQuarantine bool
+
+	// If true then the Status() output for primaries and replicas will
+	// include the number of times that the file has failed to upload.
+	StatusUploadFailures bool
+
+	// If true then a read that fails because S3 returned an error (other
+	// than the object not existing) will be served from any local copy of
+	// the file that is still on disk, such as one waiting on DelayDelete.
+	StaleReadsOnS3Error bool
+
+	// If true then primaries track how far behind the primary each of its
+	// replicas has fallen. The largest gap observed is included in the
+	// Status() output and exposed as the PrimaryReplicaLag metric.
+	TrackReplicaLag bool
+
+	// The number of uploads to S3 that must fail in a row before Health()
+	// reports the storage as unhealthy. Any successful upload resets the
+	// count. If zero then upload failures never make the storage unhealthy.
+	UnhealthyUploadFailures int
+
+	// Controls when data written to primary and replica files is synced to
+	// stable storage, and must be one of the SyncPolicy constants. Without
+	// syncing an operating system crash can lose data that was already
+	// acknowledged to the client. SyncPolicyOnInsert closes that gap but
+	// adds the latency of an fsync() call to every insert and replication,
+	// which can be significant on busy or slow disks. SyncPolicyOnRotate
+	// only pays that cost once per file, but data in files that are still
+	// accepting inserts can be lost. If empty SyncPolicyNone is used.
+	SyncPolicy string
+
 	// If a file grows beyond this size then it will be moved into an
 	// uploading state.
 	UploadLargerThan uint64
@@ -115,6 +498,105 @@ type Settings struct {
 	// Upload files after this much time regardless of size.
 	UploadOlder time.Duration
 
+	// The ranges that SetUploadThresholds() can move UploadLargerThan and
+	// UploadOlder within at runtime. Any limit that is not set defaults to
+	// the configured value, so by default the thresholds can not be
+	// changed.
+	UploadLargerThanMinimum uint64
+	UploadLargerThanMaximum uint64
+	UploadOlderMinimum      time.Duration
+	UploadOlderMaximum      time.Duration
+
+	// The maximum number of bytes per second that will be sent to S3 by
+	// all of the uploads for this namespace combined. If zero then uploads
+	// are not limited.
+	UploadBytesPerSecond int64
+
+	// The number of times that uploading a file to S3 is attempted before
+	// giving up and requeuing it. Between attempts the upload backs off
+	// exponentially, with jitter, starting at UploadRetryDelay and never
+	// waiting longer than UploadRetryMaxDelay. Replicas do not hold their
+	// lock while waiting. If not set these default to 3, 1s and 30s.
+	UploadAttempts      int
+	UploadRetryDelay    time.Duration
+	UploadRetryMaxDelay time.Duration
+
+	// Limits the number of uploads to S3 that can be in progress at once.
+	// This is expected to be shared by every namespace on the server so
+	// that a burst of uploads across many namespaces does not saturate the
+	// host's bandwidth. Uploads that can not get a slot wait for one
+	// without holding it across retries. If nil then uploads are only
+	// limited by UploadWorkQueue.
+	UploadSemaphore *semaphore.Semaphore
+
 	// A WorkQueue for processing Upload requests.
 	UploadWorkQueue *workqueue.WorkQueue
+
+	// If true then Start() will call s3:HeadBucket against S3Bucket and
+	// fail if the bucket does not exist or can not be accessed. Without
+	// this a bad bucket or missing credentials are only noticed once the
+	// first upload fails.
+	VerifyBucketOnStart bool
+
+	// If true then compressed files will be read back and inflated after
+	// they are written in order to verify that they contain the original
+	// data. Files that fail verification are removed and compressed again.
+	// This doubles the IO cost of compression so it is off by default.
+	VerifyCompression bool
+
+	// If true then the HighwayHash of the data in each file is stored with
+	// the uploaded object, and after the upload the object is read back
+	// from S3, decompressing it if needed, and its size and hash are
+	// compared against the local file. A mismatch fails the upload so that
+	// it is retried. This catches objects that were silently truncated or
+	// corrupted on the way to S3 at the cost of reading every uploaded
+	// object back.
+	VerifyUploadHash bool
+
+	// The failure domain that this machine is in. When set, primaries
+	// with a replica in the same zone are counted in
+	// metrics.UnspreadInserts.
+	Zone string
+
+	// Picks the compression level when CompressAdaptive is enabled. This is
+	// setup in New().
+	compressTuner *compressTuner
+
+	// Shared by all uploads for this namespace in order to enforce
+	// UploadBytesPerSecond. This is setup in New().
+	uploadLimiter *ratelimit.Limiter
+}
+
+// Returns the permissions that new files should be created with.
+func (s *Settings) fileMode() os.FileMode {
+	if s.FileMode == 0 {
+		return defaultFileMode
+	}
+	return s.FileMode
+}
+
+// Returns the largest number of bytes that a single insert can contain.
+func (s *Settings) maxRecordBytes() int64 {
+	if s.MaxRecordBytes <= 0 || s.MaxRecordBytes > maxRecordLength {
+		return maxRecordLength
+	}
+	return s.MaxRecordBytes
+}
+
+// Returns the directory that files for the given fid are stored in.
+func (s *Settings) dataDirectory(fidStr string) string {
+	if s.ShardDirectories <= 0 {
+		return s.BaseDirectory
+	}
+	h := fnv.New32a()
+	h.Write([]byte(fidStr))
+	return filepath.Join(
+		s.BaseDirectory,
+		shardDirectoryName(int(h.Sum32()%uint32(s.ShardDirectories))))
+}
+
+// Returns the path to the file with the given name that stores data for
+// the given fid.
+func (s *Settings) dataPath(fidStr, name string) string {
+	return filepath.Join(s.dataDirectory(fidStr), name)
 }
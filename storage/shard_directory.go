@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The most shard directories that can be configured, which keeps their
+// names to two hex characters.
+const maxShardDirectories = 256
+
+// Returns the name of the shard directory with the given index.
+func shardDirectoryName(i int) string {
+	return fmt.Sprintf("%02x", i)
+}
+
+// Returns true if the given name could be a shard directory. This does not
+// depend on the current ShardDirectories setting so that files are found
+// even if it has been lowered since they were written.
+func isShardDirectoryName(name string) bool {
+	if len(name) != 2 || name != strings.ToLower(name) {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// A file found in the base directory, or in one of its shard directories.
+type dataFile struct {
+	os.FileInfo
+
+	// The directory that the file was found in.
+	dir string
+}
+
+// Lists the files in the base directory along with those in any shard
+// directories within it so that files are found in both the flat and the
+// sharded layouts. Other directories, like the read cache, are returned
+// as is and not descended into.
+func dataFiles(base string) ([]dataFile, error) {
+	infos, err := ioutil.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]dataFile, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() || !isShardDirectoryName(info.Name()) {
+			files = append(files, dataFile{FileInfo: info, dir: base})
+			continue
+		}
+		dir := filepath.Join(base, info.Name())
+		shard, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range shard {
+			files = append(files, dataFile{FileInfo: info, dir: dir})
+		}
+	}
+	return files, nil
+}
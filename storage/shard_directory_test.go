@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestSettings_DataPath(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := Settings{BaseDirectory: "/base"}
+	T.Equal(s.dataPath("fid", "r-fid"), "/base/r-fid")
+
+	// Primaries, replicas and compressed files for the same fid all land
+	// in the same shard, and every shard is used.
+	s.ShardDirectories = 4
+	T.Equal(
+		filepath.Dir(s.dataPath("fid", "r-fid")),
+		filepath.Dir(s.dataPath("fid", "fid.gz")))
+	seen := map[string]bool{}
+	for _, fidStr := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		dir := s.dataDirectory(fidStr)
+		T.Equal(filepath.Dir(dir), "/base")
+		T.Equal(isShardDirectoryName(filepath.Base(dir)), true)
+		seen[filepath.Base(dir)] = true
+	}
+	T.Equal(seen, map[string]bool{
+		"00": true,
+		"01": true,
+		"02": true,
+		"03": true,
+	})
+}
+
+func TestIsShardDirectoryName(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	T.Equal(isShardDirectoryName(shardDirectoryName(0)), true)
+	T.Equal(isShardDirectoryName(shardDirectoryName(255)), true)
+	T.Equal(isShardDirectoryName("FF"), false)
+	T.Equal(isShardDirectoryName("0"), false)
+	T.Equal(isShardDirectoryName("zz"), false)
+	T.Equal(isShardDirectoryName(readCacheDirectory), false)
+	T.Equal(isShardDirectoryName(idempotencyDirectory), false)
+}
+
+func TestDataFiles(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	dir := T.TempDir()
+	create := func(name string) {
+		fd, err := os.Create(filepath.Join(dir, name))
+		T.ExpectSuccess(err)
+		T.ExpectSuccess(fd.Close())
+	}
+	T.ExpectSuccess(os.Mkdir(filepath.Join(dir, "00"), 0755))
+	T.ExpectSuccess(os.Mkdir(filepath.Join(dir, "1f"), 0755))
+	T.ExpectSuccess(os.Mkdir(filepath.Join(dir, readCacheDirectory), 0755))
+	create("flat")
+	create("00/sharded")
+	create("1f/r-sharded")
+	create(readCacheDirectory + "/cached")
+
+	files, err := dataFiles(dir)
+	T.ExpectSuccess(err)
+	found := []string{}
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, filepath.Join(file.dir, file.Name()))
+		T.ExpectSuccess(err)
+		found = append(found, rel)
+	}
+	sort.Strings(found)
+	T.Equal(found, []string{
+		"00/sharded",
+		"1f/r-sharded",
+		"flat",
+		readCacheDirectory,
+	})
+
+	_, err = dataFiles(filepath.Join(dir, "missing"))
+	T.ExpectErrorMessage(err, "no such file or directory")
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Starts all of the given Storage objects in name order, allowing at most
+// limit of them to be running their Start() recovery at any given time.
+// This keeps a server with a lot of name spaces from scanning every
+// directory and queuing every upload all at once. A limit of zero or less
+// allows every Storage to start at the same time. Once any Storage fails to
+// start no more are started, though those already running are allowed to
+// finish. The returned map contains the error for each Storage that failed
+// to start, keyed by the same name given in the storages map.
+func StartAll(
+	ctx context.Context,
+	storages map[string]*Storage,
+	limit int,
+) map[string]error {
+	if limit <= 0 || limit > len(storages) {
+		limit = len(storages)
+	}
+	names := make([]string, 0, len(storages))
+	for name := range storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	slots := make(chan struct{}, limit)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	var errs map[string]error
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return errs != nil
+	}
+	for _, name := range names {
+		slots <- struct{}{}
+		if failed() {
+			break
+		}
+		wg.Add(1)
+		go func(name string, s *Storage) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := s.Start(ctx); err != nil {
+				lock.Lock()
+				defer lock.Unlock()
+				if errs == nil {
+					errs = make(map[string]error, len(storages))
+				}
+				errs[name] = err
+			}
+		}(name, storages[name])
+	}
+	wg.Wait()
+	return errs
+}
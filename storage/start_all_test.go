@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/liquidgecka/testlib"
+)
+
+func TestStartAll(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Patch out Start() so that it tracks how many calls are running at
+	// the same time, and fails for one specific Storage.
+	lock := sync.Mutex{}
+	running := 0
+	maxRunning := 0
+	started := 0
+	failing := &Storage{}
+	defer monkey.Patch(
+		(*Storage).Start,
+		func(s *Storage, ctx context.Context) error {
+			lock.Lock()
+			running += 1
+			started += 1
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			time.Sleep(time.Millisecond * 10)
+			lock.Lock()
+			running -= 1
+			lock.Unlock()
+			if s == failing {
+				return fmt.Errorf("EXPECTED")
+			}
+			return nil
+		},
+	).Unpatch()
+
+	storages := map[string]*Storage{}
+	for i := 0; i < 10; i++ {
+		storages[fmt.Sprintf("ns%d", i)] = &Storage{}
+	}
+
+	// With a limit of 3 no more than 3 should ever be recovering at once.
+	errs := StartAll(context.Background(), storages, 3)
+	T.Equal(started, 10)
+	T.Equal(maxRunning, 3)
+	T.Equal(len(errs), 0)
+
+	// With no limit they should all be allowed to start at the same time.
+	started = 0
+	maxRunning = 0
+	errs = StartAll(context.Background(), storages, 0)
+	T.Equal(started, 10)
+	T.Equal(maxRunning, 10)
+	T.Equal(len(errs), 0)
+
+	// Name spaces are started in name order and once one fails no more
+	// are started.
+	storages["failing"] = failing
+	started = 0
+	errs = StartAll(context.Background(), storages, 1)
+	T.Equal(started, 1)
+	T.Equal(len(errs), 1)
+	T.ExpectErrorMessage(errs["failing"], "EXPECTED")
+}
@@ -1,15 +1,19 @@
 package storage
 
 import (
-	"compress/gzip"
+	"bytes"
+	lrulist "container/list"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,14 +21,17 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/liquidgecka/blobby/internal/backoff"
 	"github.com/liquidgecka/blobby/internal/compat"
+	"github.com/liquidgecka/blobby/internal/delayqueue"
+	"github.com/liquidgecka/blobby/internal/human"
+	"github.com/liquidgecka/blobby/internal/ratelimit"
 	"github.com/liquidgecka/blobby/internal/sloghelper"
 	"github.com/liquidgecka/blobby/storage/blastpath"
 	"github.com/liquidgecka/blobby/storage/fid"
+	"github.com/liquidgecka/blobby/storage/hasher"
 	"github.com/liquidgecka/blobby/storage/metrics"
 )
 
@@ -35,6 +42,19 @@ type Storage struct {
 	// needs to be opened.
 	appendablePrimaries int32
 
+	// The compress indexes of objects in S3 that have already been
+	// fetched by reads.
+	compressIndexes compressIndexCache
+
+	// Set to 1 while the Storage is being drained via Drain(). While
+	// draining no new primaries are opened and every primary that becomes
+	// idle is shut down so that it gets uploaded.
+	draining int32
+
+	// The keys supplied with inserts and the IDs that were returned for
+	// them, if Settings.IdempotencyKeyTTL is set.
+	idempotency *idempotencyCache
+
 	// We track metrics via the metrics object. This specifically
 	// allows us to keep the code for generating and aggregating those
 	// metrics all in a single place.
@@ -45,6 +65,9 @@ type Storage struct {
 	// file creation on the file system and in the logs.
 	newFileBackOff backoff.BackOff
 
+	// Delivers notifications to Settings.OnUpload.
+	notifier uploadNotifier
+
 	// A mapping of each primaries "FID" string to the primary object
 	// associated with it.
 	primaries     map[string]*primary
@@ -55,9 +78,37 @@ type Storage struct {
 	replicas     map[string]*replica
 	replicasLock sync.Mutex
 
+	// The cache of data read from S3, if Settings.ReadCache is enabled.
+	readCache *readCache
+
+	// Set to 1 while inserts are disabled via SetReadOnly(). Unlike
+	// draining this leaves the primaries alone so that inserts can resume
+	// into them once read only mode is turned off.
+	readOnly int32
+
+	// The remotes holding replicas of each primary created by this Storage.
+	// This is in memory only and never shared with other machines.
+	replicaLocations replicaLocations
+
+	// Serializes calls to Scrub(), limits the rate that it reads data and
+	// schedules the background scrub if Settings.ScrubInterval is set.
+	scrubLock    sync.Mutex
+	scrubLimiter *ratelimit.Limiter
+	scrubToken   delayqueue.Token
+
 	// Settings associated with this Storage object.
 	settings Settings
 
+	// The number of uploads to S3 that have failed in a row across all of
+	// the primaries and replicas. This is reset by any successful upload.
+	uploadFailures int32
+
+	// The thresholds applied to newly opened primaries. These start as
+	// Settings.UploadLargerThan and Settings.UploadOlder and can be
+	// changed with SetUploadThresholds().
+	uploadLargerThan uint64
+	uploadOlder      int64
+
 	// A list of primary objects that are waiting to be appended into.
 	waiting list
 }
@@ -68,24 +119,115 @@ func New(settings *Settings) *Storage {
 	switch {
 	case settings.AssignRemotes == nil:
 		panic("settings.AssignRemotes is required.")
-	case settings.AWSUploader == nil:
-		panic("settings.AWSUploader is required.")
 	case settings.BaseDirectory == "":
 		panic("settings.BaseDirectory is required.")
-	case settings.Compress && settings.CompressLevel < -1:
-		panic("settings.CompressLevel can not be less than -1.")
-	case settings.Compress && settings.CompressLevel > gzip.BestCompression:
+	case settings.Compress && settings.compressor() == nil:
+		panic(fmt.Sprintf(
+			"settings.CompressAlgorithm '%s' is not supported.",
+			settings.CompressAlgorithm))
+	case settings.Compress && settings.CompressLevel < minCompressLevel(settings):
+		panic(fmt.Sprintf(
+			"settings.CompressLevel can not be less than %d.",
+			minCompressLevel(settings)))
+	case settings.Compress && settings.CompressLevel > maxCompressLevel(settings):
 		panic(fmt.Sprintf(
 			"settings.CompressLevel can not be greater than %d.",
-			gzip.BestCompression))
+			maxCompressLevel(settings)))
+	case settings.CompressAdaptiveTarget < 0:
+		panic("settings.CompressAdaptiveTarget can not be negative.")
+	case settings.CompressLevelMin < 0:
+		panic("settings.CompressLevelMin can not be negative.")
+	case settings.Compress && settings.CompressLevelMax > maxCompressLevel(settings):
+		panic(fmt.Sprintf(
+			"settings.CompressLevelMax can not be greater than %d.",
+			maxCompressLevel(settings)))
+	case settings.CompressLevelMax != 0 &&
+		settings.CompressLevelMax < settings.CompressLevelMin:
+		panic("settings.CompressLevelMax can not be less than settings.CompressLevelMin.")
+	case settings.CompressIndexFormat != "" &&
+		settings.CompressIndexFormat != CompressIndexFormatBinary &&
+		settings.CompressIndexFormat != CompressIndexFormatJSON:
+		panic(fmt.Sprintf(
+			"settings.CompressIndexFormat '%s' is not supported.",
+			settings.CompressIndexFormat))
 	case settings.DelayQueue == nil:
 		panic("settings.DelayQueue is required.")
+	case settings.IdempotencyKeyTTL < 0:
+		panic("settings.IdempotencyKeyTTL can not be negative.")
+	case settings.IdempotencyKeyMaxEntries < 0:
+		panic("settings.IdempotencyKeyMaxEntries can not be negative.")
+	case settings.FileMode&^os.ModePerm != 0:
+		panic("settings.FileMode can only contain permission bits.")
+	case settings.ShardDirectories < 0:
+		panic("settings.ShardDirectories can not be negative.")
+	case settings.ShardDirectories > maxShardDirectories:
+		panic(fmt.Sprintf(
+			"settings.ShardDirectories can not be more than %d.",
+			maxShardDirectories))
+	case settings.SyncPolicy != "" &&
+		settings.SyncPolicy != SyncPolicyNone &&
+		settings.SyncPolicy != SyncPolicyOnInsert &&
+		settings.SyncPolicy != SyncPolicyOnRotate:
+		panic(fmt.Sprintf(
+			"settings.SyncPolicy '%s' is not supported.",
+			settings.SyncPolicy))
 	case settings.Read == nil:
 		panic("settings.Read is required.")
-	case settings.S3Client == nil:
+	case settings.OpenFilesGrowthFactor != 0 &&
+		settings.OpenFilesGrowthFactor < 1:
+		panic("settings.OpenFilesGrowthFactor can not be less than 1.")
+	case settings.OpenFilesGrowthStep < 0:
+		panic("settings.OpenFilesGrowthStep can not be negative.")
+	case settings.InsertQueueTimeout < 0:
+		panic("settings.InsertQueueTimeout can not be negative.")
+	case settings.S3OperationTimeout < 0:
+		panic("settings.S3OperationTimeout can not be negative.")
+	case settings.ParallelCompressWorkers < 0:
+		panic("settings.ParallelCompressWorkers can not be negative.")
+	case settings.MaxRecordBytes < 0:
+		panic("settings.MaxRecordBytes can not be negative.")
+	case settings.ReplicaQuorum < 0:
+		panic("settings.ReplicaQuorum can not be negative.")
+	case settings.ReplicaQuorum > settings.Replicas:
+		panic("settings.ReplicaQuorum can not be greater than settings.Replicas.")
+	case settings.ObjectStore == nil && settings.S3Client == nil:
 		panic("settings.S3Client is required.")
 	case settings.S3Bucket == "":
 		panic("settings.S3Bucket is required.")
+	case settings.S3PartSize != 0 && settings.S3PartSize < minS3PartSize:
+		panic(fmt.Sprintf(
+			"settings.S3PartSize can not be less than %d.",
+			minS3PartSize))
+	case settings.S3Concurrency < 0:
+		panic("settings.S3Concurrency can not be negative.")
+	case settings.S3StorageClass != "" &&
+		!validS3StorageClass(settings.S3StorageClass):
+		panic(fmt.Sprintf(
+			"settings.S3StorageClass '%s' is not supported.",
+			settings.S3StorageClass))
+	case settings.S3SSE != "" &&
+		settings.S3SSE != s3.ServerSideEncryptionAes256 &&
+		settings.S3SSE != s3.ServerSideEncryptionAwsKms:
+		panic(fmt.Sprintf(
+			"settings.S3SSE '%s' is not supported.",
+			settings.S3SSE))
+	case settings.S3KMSKeyID != "" &&
+		settings.S3SSE != s3.ServerSideEncryptionAwsKms:
+		panic("settings.S3KMSKeyID requires settings.S3SSE be 'aws:kms'.")
+	case settings.UploadBytesPerSecond < 0:
+		panic("settings.UploadBytesPerSecond can not be negative.")
+	case settings.UnhealthyUploadFailures < 0:
+		panic("settings.UnhealthyUploadFailures can not be negative.")
+	case settings.UploadAttempts < 0:
+		panic("settings.UploadAttempts can not be negative.")
+	case settings.UploadRetryDelay < 0:
+		panic("settings.UploadRetryDelay can not be negative.")
+	case settings.UploadRetryMaxDelay < 0:
+		panic("settings.UploadRetryMaxDelay can not be negative.")
+	case settings.UploadOlderMinimum < 0:
+		panic("settings.UploadOlderMinimum can not be negative.")
+	case settings.UploadOlderMaximum < 0:
+		panic("settings.UploadOlderMaximum can not be negative.")
 	}
 
 	// Make a copy of the settings object so that it can't be modified after
@@ -101,30 +243,137 @@ func New(settings *Settings) *Storage {
 		replicas:  make(map[string]*replica, 10),
 		settings:  *settings,
 	}
+	if s.settings.AsyncReplicationMaxPending == 0 {
+		s.settings.AsyncReplicationMaxPending = defaultAsyncReplicationMaxPending
+	}
 	if s.settings.HeartBeatTime == 0 {
 		s.settings.HeartBeatTime = defaultHeartBeatTime
 	}
 	if s.settings.NameSpace == "" {
 		s.settings.NameSpace = "default"
 	}
+	if s.settings.OpenFilesGrowthFactor == 0 {
+		s.settings.OpenFilesGrowthFactor = defaultOpenFilesGrowthFactor
+	}
 	if s.settings.OpenFilesMaximum == 0 {
 		s.settings.OpenFilesMaximum = defaultOpenFilesMaximum
 	}
 	if s.settings.OpenFilesMinimum == 0 {
 		s.settings.OpenFilesMinimum = defaultOpenFilesMinimum
 	}
+	if s.settings.ParallelCompressWorkers == 0 {
+		s.settings.ParallelCompressWorkers = runtime.NumCPU()
+	}
+	if s.settings.ReadCacheMaxBytes == 0 {
+		s.settings.ReadCacheMaxBytes = defaultReadCacheMaxBytes
+	}
+	if s.settings.S3Concurrency == 0 {
+		s.settings.S3Concurrency = defaultS3Concurrency
+	}
+	if s.settings.S3PartSize == 0 {
+		s.settings.S3PartSize = defaultS3PartSize
+	}
+	if s.settings.UploadAttempts == 0 {
+		s.settings.UploadAttempts = defaultUploadAttempts
+	}
+	if s.settings.UploadRetryDelay == 0 {
+		s.settings.UploadRetryDelay = defaultUploadRetryDelay
+	}
+	if s.settings.UploadRetryMaxDelay == 0 {
+		s.settings.UploadRetryMaxDelay = defaultUploadRetryMaxDelay
+	}
 	if s.settings.UploadLargerThan == 0 {
 		s.settings.UploadLargerThan = defaultUploadLargerThan
 	}
 	if s.settings.UploadOlder == 0 {
 		s.settings.UploadOlder = defaultUploadOlder
 	}
+	if s.settings.UploadLargerThanMinimum == 0 {
+		s.settings.UploadLargerThanMinimum = s.settings.UploadLargerThan
+	}
+	if s.settings.UploadLargerThanMaximum == 0 {
+		s.settings.UploadLargerThanMaximum = s.settings.UploadLargerThan
+	}
+	if s.settings.UploadOlderMinimum == 0 {
+		s.settings.UploadOlderMinimum = s.settings.UploadOlder
+	}
+	if s.settings.UploadOlderMaximum == 0 {
+		s.settings.UploadOlderMaximum = s.settings.UploadOlder
+	}
+	s.uploadLargerThan = s.settings.UploadLargerThan
+	s.uploadOlder = int64(s.settings.UploadOlder)
+	s.settings.uploadLimiter = &ratelimit.Limiter{
+		BytesPerSecond: s.settings.UploadBytesPerSecond,
+	}
+	s.scrubLimiter = &ratelimit.Limiter{
+		BytesPerSecond: s.settings.ScrubBytesPerSecond,
+	}
+	if s.settings.ObjectStore == nil {
+		s.settings.ObjectStore = &s3ObjectStore{
+			settings:    &s.settings,
+			log:         s.settings.BaseLogger,
+			partRetries: &s.metrics.UploadPartRetries,
+		}
+	}
+	if len(s.settings.InsertLatencyBuckets) == 0 {
+		s.settings.InsertLatencyBuckets = metrics.DefaultLatencyHistogramBuckets
+	}
+	s.metrics.PrimaryHeartBeatLatency = metrics.NewLatencyHistogram(
+		metrics.DefaultLatencyHistogramBuckets)
+	s.metrics.PrimaryInsertQueueLatency = metrics.NewLatencyHistogram(
+		s.settings.InsertLatencyBuckets)
+	s.metrics.PrimaryInsertReplicateLatency = metrics.NewLatencyHistogram(
+		s.settings.InsertLatencyBuckets)
+	s.metrics.PrimaryInsertWriteLatency = metrics.NewLatencyHistogram(
+		s.settings.InsertLatencyBuckets)
 	if s.settings.Compress {
-		switch s.settings.CompressLevel {
-		case 0:
-			s.settings.CompressLevel = gzip.DefaultCompression
-		case -1:
-			s.settings.CompressLevel = gzip.NoCompression
+		c := s.settings.compressor()
+		s.settings.CompressLevel = c.Level(s.settings.CompressLevel)
+		if s.settings.CompressAdaptive {
+			if s.settings.CompressAdaptiveTarget == 0 {
+				s.settings.CompressAdaptiveTarget = defaultCompressAdaptiveTarget
+			}
+			if s.settings.CompressLevelMin == 0 {
+				s.settings.CompressLevelMin = 1
+			}
+			if s.settings.CompressLevelMax == 0 {
+				_, s.settings.CompressLevelMax = c.Levels()
+			}
+			s.settings.compressTuner = &compressTuner{
+				level:  int32(s.settings.CompressLevelMax),
+				min:    s.settings.CompressLevelMin,
+				max:    s.settings.CompressLevelMax,
+				target: s.settings.CompressAdaptiveTarget,
+			}
+		}
+	}
+	if s.settings.ReadCache {
+		s.readCache = &readCache{
+			dir: filepath.Join(
+				s.settings.BaseDirectory,
+				readCacheDirectory),
+			maxBytes: s.settings.ReadCacheMaxBytes,
+			maxAge:   s.settings.ReadCacheMaxAge,
+			log:      s.settings.BaseLogger,
+			entries:  make(map[string]*lrulist.Element),
+		}
+	}
+	if s.settings.IdempotencyKeyTTL > 0 {
+		if s.settings.IdempotencyKeyMaxEntries == 0 {
+			s.settings.IdempotencyKeyMaxEntries = defaultIdempotencyKeyMaxEntries
+		}
+		s.idempotency = &idempotencyCache{
+			ttl:        s.settings.IdempotencyKeyTTL,
+			maxEntries: s.settings.IdempotencyKeyMaxEntries,
+			log:        s.settings.BaseLogger,
+			entries:    make(map[string]*lrulist.Element),
+			pending:    make(map[string]*idempotencyEntry),
+		}
+		if s.settings.IdempotencyKeyPersist {
+			s.idempotency.dir = filepath.Join(
+				s.settings.BaseDirectory,
+				idempotencyDirectory)
+			s.idempotency.mode = s.settings.fileMode()
 		}
 	}
 
@@ -141,6 +390,97 @@ func (s *Storage) BlastPathRead(
 ) (
 	io.ReadCloser,
 	error,
+) {
+	_, fd, err := s.blastPathOpen(fid, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seek to the start position in the file, then do a relative seek to the
+	// same position in order to get an accurate offset of where the next
+	// read will come from. This protects us from the seek managing to walk
+	// of the end of the file since that is not technically an error.
+	if _, err := fd.Seek(int64(start), io.SeekCurrent); err != nil {
+		fd.Close()
+		return nil, err
+	} else if n, err := fd.Seek(0, io.SeekCurrent); err != nil {
+		fd.Close()
+		return nil, err
+	} else if uint64(n) != start {
+		fd.Close()
+		return nil, fmt.Errorf("Short seek.")
+	}
+
+	// Success. We can return the resulting data to the caller
+	// wrapped up in a data limiter.
+	return &limitReadCloser{
+		RC: fd,
+		N:  int64(end - start),
+	}, nil
+}
+
+// Like BlastPathRead except that several ranges are read from the primary
+// using a single open file. The returned data is a segment for each range,
+// in order, each being the length of the range as an 8 byte big endian
+// integer followed by the data.
+func (s *Storage) BlastPathReadRanges(
+	fid string,
+	ranges []blastpath.Range,
+) (
+	io.ReadCloser,
+	error,
+) {
+	var max uint64
+	for _, r := range ranges {
+		if r.End < r.Start {
+			return nil, fmt.Errorf(
+				"The range %d-%d ends before it starts.",
+				r.Start,
+				r.End)
+		} else if r.End > max {
+			max = r.End
+		}
+	}
+	_, fd, err := s.blastPathOpen(fid, max)
+	if err != nil {
+		return nil, err
+	}
+	readers := make([]io.Reader, 0, len(ranges)*2)
+	for _, r := range ranges {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint64(header, r.End-r.Start)
+		readers = append(
+			readers,
+			bytes.NewReader(header),
+			io.NewSectionReader(fd, int64(r.Start), int64(r.End-r.Start)))
+	}
+	return &blastPathRanges{
+		Reader: io.MultiReader(readers...),
+		fd:     fd,
+	}, nil
+}
+
+// The io.ReadCloser returned from BlastPathReadRanges.
+type blastPathRanges struct {
+	io.Reader
+	fd *os.File
+}
+
+func (b *blastPathRanges) Close() error {
+	return b.fd.Close()
+}
+
+// Opens a new file descriptor for the primary with the given fid so that
+// Blast Path reads can be served from it, checking that the primary has at
+// least end bytes written to it. The primary is returned along with the
+// file.
+func (s *Storage) blastPathOpen(
+	fid string,
+	end uint64,
+) (
+	*primary,
+	*os.File,
+	error,
 ) {
 	// Start by getting the primary associated with this fid. If it doesn't
 	// exist then bail out quickly.
@@ -150,7 +490,7 @@ func (s *Storage) BlastPathRead(
 		return s.primaries[fid]
 	}()
 	if primary == nil {
-		return nil, ErrNotFound(fid)
+		return nil, nil, ErrNotFound(fid)
 	}
 
 	// We are working with the primary out of its normal controlling method
@@ -158,14 +498,14 @@ func (s *Storage) BlastPathRead(
 	// quickly check to see if the end is large enough to accommodate
 	// the request.
 	if primary.offset < end {
-		return nil, &ErrNotPossible{}
+		return nil, nil, &ErrNotPossible{}
 	}
 
 	// If the fd value is nil then the file has been deleted and we need
 	// to pretend like it wasn't found.
 	pFd := primary.fd
 	if pFd == nil {
-		return nil, ErrNotFound(fid)
+		return nil, nil, ErrNotFound(fid)
 	}
 
 	// Next we attempt to open the file on disk so we have a second
@@ -173,33 +513,12 @@ func (s *Storage) BlastPathRead(
 	fd, err := os.Open(pFd.Name())
 	if err != nil {
 		if _, ok := err.(ErrNotFound); ok {
-			return nil, ErrNotFound(fid)
+			return nil, nil, ErrNotFound(fid)
 		} else {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-
-	// Seek to the start position in the file, then do a relative seek to the
-	// same position in order to get an accurate offset of where the next
-	// read will come from. This protects us from the seek managing to walk
-	// of the end of the file since that is not technically an error.
-	if _, err := fd.Seek(int64(start), io.SeekCurrent); err != nil {
-		fd.Close()
-		return nil, err
-	} else if n, err := fd.Seek(0, io.SeekCurrent); err != nil {
-		fd.Close()
-		return nil, err
-	} else if uint64(n) != start {
-		fd.Close()
-		return nil, fmt.Errorf("Short seek.")
-	}
-
-	// Success. We can return the resulting data to the caller
-	// wrapped up in a data limiter.
-	return &limitReadCloser{
-		RC: fd,
-		N:  int64(end - start),
-	}, nil
+	return primary, fd, nil
 }
 
 // "Blast Path" status output for this Storage Name Space. This will output
@@ -227,54 +546,357 @@ func (s *Storage) BlastPathStatus(out io.Writer) {
 	json.NewEncoder(out).Encode(array)
 }
 
-// Writes debugging information about the given ID to the writer given.
-func (s *Storage) DebugID(out io.Writer, id string) {
-	// Start off by parsing the ID into a fid, start and length.
-	fid, start, length, err := fid.ParseID(id)
+// Writes a blastpath.File for every primary and replica held by this
+// Storage Name Space to out as JSON Lines, ordered by fid within each type.
+// Only the list of files is gathered while holding the locks, each line is
+// then generated and written as it goes so the output is never buffered as
+// a whole. This stops at the first error writing to out.
+func (s *Storage) BlastPathList(out io.Writer) error {
+	primaries := func() primarySlice {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		primaries := make(primarySlice, 0, len(s.primaries))
+		for _, p := range s.primaries {
+			primaries = append(primaries, p)
+		}
+		return primaries
+	}()
+	sort.Sort(primaries)
+	replicas := func() replicaSlice {
+		s.replicasLock.Lock()
+		defer s.replicasLock.Unlock()
+		replicas := make(replicaSlice, 0, len(s.replicas))
+		for _, r := range s.replicas {
+			replicas = append(replicas, r)
+		}
+		return replicas
+	}()
+	sort.Sort(replicas)
+
+	encoder := json.NewEncoder(out)
+	for _, p := range primaries {
+		err := encoder.Encode(&blastpath.File{
+			FID:      p.fidStr,
+			Type:     "primary",
+			State:    primaryStateStrings[atomic.LoadInt32(&p.state)],
+			Size:     p.offset,
+			Records:  p.records.count(),
+			S3Bucket: s.settings.S3Bucket,
+			S3Key:    p.s3key,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range replicas {
+		err := encoder.Encode(&blastpath.File{
+			FID:      r.fidStr,
+			Type:     "replica",
+			State:    replicaStateStrings[atomic.LoadInt32(&r.state)],
+			Size:     r.offset,
+			Records:  r.records.count(),
+			S3Bucket: s.settings.S3Bucket,
+			S3Key:    r.s3key,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Information about a specific ID as returned by ExplainID.
+type IDInfo struct {
+	NameSpace     string    `json:"namespace"`
+	FID           string    `json:"fid"`
+	Machine       uint32    `json:"machine"`
+	Created       time.Time `json:"created"`
+	Start         uint64    `json:"start"`
+	Length        uint32    `json:"length"`
+	S3Destination string    `json:"s3_destination"`
+
+	// The state of the local primary or replica for this ID. These are
+	// empty if the file is not currently stored locally.
+	PrimaryState string `json:"primary_state,omitempty"`
+	ReplicaState string `json:"replica_state,omitempty"`
+}
+
+// Decodes the given ID and returns information about it, including the
+// state of the file if it is currently stored locally.
+func (s *Storage) ExplainID(id string) (*IDInfo, error) {
+	f, machine, created, start, length, err := fid.Explain(id)
 	if err != nil {
-		fmt.Fprintf(out, "Invalid ID: %s\n", err.Error())
-		return
+		return nil, err
+	}
+	info := &IDInfo{
+		NameSpace: s.settings.NameSpace,
+		FID:       f.String(),
+		Machine:   machine,
+		Created:   created,
+		Start:     start,
+		Length:    length,
+		S3Destination: fmt.Sprintf(
+			"s3://%s/%s",
+			s.settings.S3BasePath,
+			s.settings.S3KeyFormat.Format(f)),
 	}
-	fidStr := fid.String()
-	fmt.Fprintf(out, "Name space: %s\n", s.settings.NameSpace)
-	fmt.Fprintf(out, "File ID: %s\n", fidStr)
-	fmt.Fprintf(out, "Machine ID: %d\n", fid.Machine())
-	fmt.Fprintf(out, "Start offset: %d\n", start)
-	fmt.Fprintf(out, "Length: %d\n", length)
-	fmt.Fprintf(
-		out,
-		"S3 destination: s3://%s/%s",
-		s.settings.S3BasePath,
-		s.settings.S3KeyFormat.Format(fid))
 
 	// Lastly we check the status of this fid to see if its currently doing
 	// anything locally.
-	ps, ok := func() (int32, bool) {
+	func() {
 		s.primariesLock.Lock()
 		defer s.primariesLock.Unlock()
-		if p, ok := s.primaries[fidStr]; ok {
-			return p.state, true
-		} else {
-			return -1, false
+		if p, ok := s.primaries[info.FID]; ok {
+			info.PrimaryState = primaryStateStrings[p.state]
 		}
 	}()
-	if ok {
+	func() {
+		s.replicasLock.Lock()
+		defer s.replicasLock.Unlock()
+		if r, ok := s.replicas[info.FID]; ok {
+			info.ReplicaState = replicaStateStrings[r.state]
+		}
+	}()
+	return info, nil
+}
+
+// Writes debugging information about the given ID to the writer given.
+func (s *Storage) DebugID(out io.Writer, id string) {
+	info, err := s.ExplainID(id)
+	if err != nil {
+		fmt.Fprintf(out, "Invalid ID: %s\n", err.Error())
+		return
+	}
+	fmt.Fprintf(out, "Name space: %s\n", info.NameSpace)
+	fmt.Fprintf(out, "File ID: %s\n", info.FID)
+	fmt.Fprintf(out, "Machine ID: %d\n", info.Machine)
+	fmt.Fprintf(out, "Start offset: %d\n", info.Start)
+	fmt.Fprintf(out, "Length: %d\n", info.Length)
+	fmt.Fprintf(out, "S3 destination: %s", info.S3Destination)
+	if info.PrimaryState != "" {
 		fmt.Fprintf(out, "\nThis ID is served locally by a primary that is\n")
-		fmt.Fprintf(out, "in the %s state.\n", primaryStateStrings[ps])
+		fmt.Fprintf(out, "in the %s state.\n", info.PrimaryState)
+	}
+	if info.ReplicaState != "" {
+		fmt.Fprintf(out, "\nThis ID is server locally by a replica that is\n")
+		fmt.Fprintf(out, "in the %s state.\n", info.ReplicaState)
+	}
+}
+
+// Deletes the file that holds the given ID. Since many IDs share a single
+// file this removes the data for every ID in the file, not just the one
+// given. The object is removed from S3 under each key it may have been
+// written to, and if a primary or replica for the file is still on this
+// server then it is removed from disk without waiting for DelayDelete.
+//
+// Files can only be deleted once they have been uploaded. If this server
+// holds the file and it is still accepting writes or waiting to be
+// uploaded then ErrFileInUse is returned. A file that is held by another
+// server is only removed from S3, that server will continue to serve reads
+// from its local copy until it would normally have been deleted.
+func (s *Storage) Delete(ctx context.Context, id string) error {
+	f, _, _, err := fid.ParseID(id)
+	if err != nil {
+		return ErrInvalidID{}
+	}
+	fidStr := f.String()
+	keys := []string{}
+
+	// Check that any local copy of the file is done with, and collect the
+	// key of its upload time copy since that can not be derived from the
+	// ID.
+	prim := func() *primary {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		return s.primaries[fidStr]
+	}()
+	if prim != nil {
+		switch atomic.LoadInt32(&prim.state) {
+		case primaryStatePendingDeleteCompressed:
+		case primaryStateDeletingCompressed:
+		case primaryStatePendingDeleteRemotes:
+		case primaryStateDeletingRemotes:
+		case primaryStateDelayLocalDelete:
+		case primaryStatePendingDeleteLocal:
+		case primaryStateDeletingLocal:
+		case primaryStateComplete:
+		default:
+			return ErrFileInUse(fidStr)
+		}
+		if prim.uploadKey != "" {
+			keys = append(keys, prim.uploadKey)
+		}
 	}
-	rs, ok := func() (int32, bool) {
+	repl := func() *replica {
 		s.replicasLock.Lock()
 		defer s.replicasLock.Unlock()
-		if r, ok := s.replicas[fidStr]; ok {
-			return r.state, true
-		} else {
-			return -1, false
+		return s.replicas[fidStr]
+	}()
+	if repl != nil {
+		if err := func() error {
+			repl.lock.Lock()
+			defer repl.lock.Unlock()
+			switch repl.state {
+			case replicaStateRetained:
+			case replicaStatePendingDelete:
+			case replicaStateDeletingCompressed:
+			case replicaStateClosingCompressed:
+			case replicaStateDeleting:
+			case replicaStateClosing:
+			case replicaStateCompleted:
+			default:
+				return ErrFileInUse(fidStr)
+			}
+			if repl.uploadKey != "" {
+				keys = append(keys, repl.uploadKey)
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	// Remove the object from every key that it exists under, along with
+	// its compress index.
+	formats := append(
+		[]*fid.Formatter{s.settings.S3KeyFormat},
+		s.settings.S3AdditionalKeyFormats...)
+	for _, format := range formats {
+		key := filepath.Join(s.settings.S3BasePath, format.Format(f))
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	store := s.settings.objectStore()
+	found := false
+	for _, key := range keys {
+		klog := s.settings.BaseLogger.With(
+			sloghelper.String("bucket", s.settings.S3Bucket),
+			sloghelper.String("key", key))
+		if _, err := store.Head(ctx, key); err != nil {
+			if _, ok := err.(ErrNotFound); ok {
+				continue
+			}
+			klog.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error checking for the object to delete.",
+				sloghelper.Error("error", err))
+			return err
+		}
+		found = true
+		if err := store.Delete(ctx, key); err != nil {
+			klog.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"Error deleting the object.",
+				sloghelper.Error("error", err))
+			return err
+		}
+		if s.settings.Compress {
+			s.compressIndexes.remove(key)
+			err := store.Delete(ctx, key+compressIndexSuffix)
+			if err != nil {
+				klog.LogAttrs(
+					ctx,
+					slog.LevelError,
+					"Error deleting the compress index.",
+					sloghelper.Error("error", err))
+				return err
+			}
+		}
+		klog.LogAttrs(ctx, slog.LevelInfo, "Deleted the object.")
+	}
+	if !found {
+		return ErrNotFound(id)
+	}
+
+	// Cached reads of the file must not outlive it.
+	if s.readCache != nil {
+		s.readCache.removeFID(fidStr)
+	}
+
+	// Local copies that are only being kept to serve reads can be removed
+	// now rather than waiting out the rest of the delay.
+	if prim != nil {
+		if atomic.LoadInt32(&prim.state) == primaryStateDelayLocalDelete {
+			s.settings.DelayQueue.Alter(
+				&prim.delayDeleteToken,
+				time.Now(),
+				prim.delayDelete)
 		}
+	}
+	if repl != nil {
+		repl.lock.Lock()
+		defer repl.lock.Unlock()
+		if repl.state == replicaStateRetained {
+			s.settings.DelayQueue.Cancel(&repl.retainToken)
+			repl.setState(ctx, replicaStatePendingDelete)
+		}
+	}
+	return nil
+}
+
+// Stops the Storage from accepting new data and shuts down every primary
+// that is not currently being written to so that they are all uploaded.
+// Primaries that are in the middle of an insert are shut down once the
+// insert completes. Pending() can be used to track when all of the files
+// have finished processing. Draining is stopped by calling Resume().
+func (s *Storage) Drain(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+	s.settings.BaseLogger.Info("Draining the namespace.")
+	primaries := func() []*primary {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		primaries := make([]*primary, 0, len(s.primaries))
+		for _, p := range s.primaries {
+			primaries = append(primaries, p)
+		}
+		return primaries
 	}()
-	if ok {
-		fmt.Fprintf(out, "\nThis ID is server locally by a replica that is\n")
-		fmt.Fprintf(out, "in the %s state.\n", replicaStateStrings[rs])
+	for _, p := range primaries {
+		p.expire(ctx)
+	}
+}
+
+// Starts uploading the primary with the given fid right away rather than
+// waiting for it to expire or fill up. Like expiring, this only does
+// anything if the primary is waiting for inserts, so the returned bool is
+// false if it was in the middle of an insert or is already being uploaded.
+// Either way the state of the primary after the call is returned. If there
+// is no primary with the fid on this server then ErrNotFound is returned.
+func (s *Storage) Flush(
+	ctx context.Context,
+	fidStr string,
+) (
+	bool,
+	string,
+	error,
+) {
+	p := func() *primary {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		return s.primaries[fidStr]
+	}()
+	if p == nil {
+		return false, "", ErrNotFound(fidStr)
+	}
+	flushed := false
+	if s.waiting.Remove(p) {
+		p.log.Info("Flushing the primary by request.")
+		p.shutdown(ctx)
+		flushed = true
 	}
+	return flushed, primaryStateStrings[atomic.LoadInt32(&p.state)], nil
+}
+
+// Returns the fraction of the disk holding the name space's directory that
+// is in use, from 0 to 1. This returns an error if the usage can not be
+// determined on this platform.
+func (s *Storage) DiskUsage() (float64, error) {
+	return diskUsage(s.settings.BaseDirectory)
 }
 
 // Returns a copy of the metrics associated with this Storage object.
@@ -283,10 +905,23 @@ func (s *Storage) GetMetrics() (m metrics.Metrics) {
 	oldestPrimary := time.Now()
 	queuedForUpload := time.Now()
 	m.QueuedInserts = int64(s.waiting.Waiting())
+	m.PrimaryPoolAppendable = int64(atomic.LoadInt32(&s.appendablePrimaries))
+	m.PrimaryPoolMaximum = int64(s.settings.OpenFilesMaximum)
+	m.CompressLevel = int64(s.settings.compressLevel())
+	primaries, replicas := s.Pending()
+	m.PendingPrimaries = int64(primaries)
+	m.PendingReplicas = int64(replicas)
+	primaryStates := make([]int64, len(primaryStateStrings))
+	replicaStates := make([]int64, len(replicaStateStrings))
 	func() {
 		s.primariesLock.Lock()
 		defer s.primariesLock.Unlock()
+		m.Primaries = int64(len(s.primaries))
 		for _, p := range s.primaries {
+			m.PrimaryBytes += p.offset
+			if atomic.LoadInt32(&p.state) == primaryStateDelayLocalDelete {
+				m.RetainedBytes += p.offset
+			}
 			switch {
 			case p.firstInsert == (time.Time{}):
 			case p.firstInsert.Before(oldestPrimary):
@@ -297,25 +932,71 @@ func (s *Storage) GetMetrics() (m metrics.Metrics) {
 			case p.queuedForUpload.Before(queuedForUpload):
 				queuedForUpload = p.queuedForUpload
 			}
+			if lag := p.maxReplicaLag(); lag > m.PrimaryReplicaLag {
+				m.PrimaryReplicaLag = lag
+			}
+			oldestInState(
+				primaryStates,
+				atomic.LoadInt32(&p.state),
+				atomic.LoadInt64(&p.stateChanged))
 		}
 	}()
 	func() {
 		s.replicasLock.Lock()
 		defer s.replicasLock.Unlock()
+		m.Replicas = int64(len(s.replicas))
 		for _, r := range s.replicas {
+			m.ReplicaBytes += r.offset
+			if lag := atomic.LoadUint64(&r.lag); lag > m.ReplicaLag {
+				m.ReplicaLag = lag
+			}
+			if atomic.LoadInt32(&r.state) == replicaStateRetained {
+				m.RetainedBytes += r.offset
+			}
 			switch {
 			case r.queuedForUpload == (time.Time{}):
 			case r.queuedForUpload.Before(queuedForUpload):
 				queuedForUpload = r.queuedForUpload
 			}
+			oldestInState(
+				replicaStates,
+				atomic.LoadInt32(&r.state),
+				atomic.LoadInt64(&r.stateChanged))
 		}
 	}()
 	m.OldestUnUploadedData = time.Since(oldestPrimary).Seconds()
 	m.OldestQueuedUpload = time.Since(queuedForUpload).Seconds()
+	m.PrimaryStateAges = stateAges(primaryStates, primaryStateStrings)
+	m.ReplicaStateAges = stateAges(replicaStates, replicaStateStrings)
 
 	return
 }
 
+// Records changed in oldest[state] if it is earlier than the value already
+// there. Files that have never changed state are ignored.
+func oldestInState(oldest []int64, state int32, changed int64) {
+	switch {
+	case changed == 0:
+	case state < 0 || int(state) >= len(oldest):
+	case oldest[state] == 0 || changed < oldest[state]:
+		oldest[state] = changed
+	}
+}
+
+// Converts the times gathered by oldestInState into a StateAge for every
+// state in names.
+func stateAges(oldest []int64, names map[int32]string) []metrics.StateAge {
+	now := time.Now().UnixNano()
+	ages := make([]metrics.StateAge, len(oldest))
+	for state, changed := range oldest {
+		ages[state].State = names[int32(state)]
+		if changed != 0 {
+			ages[state].Seconds = time.Duration(now - changed).Seconds()
+		}
+	}
+	return ages
+}
+
 // Returns true if this Storage is healthy and a string representing the
 // reason why this Storage implementation is healthy.
 func (s *Storage) Health() (bool, string) {
@@ -331,6 +1012,18 @@ func (s *Storage) Health() (bool, string) {
 		output.WriteString("New file creation: SUCCEEDED\n")
 	}
 
+	// Check that uploads to S3 have not been failing repeatedly, otherwise
+	// data is piling up locally without being stored durably.
+	if s.settings.UnhealthyUploadFailures > 0 {
+		failures := atomic.LoadInt32(&s.uploadFailures)
+		if int(failures) >= s.settings.UnhealthyUploadFailures {
+			output.WriteString("S3 uploads: FAILED\n")
+			healthy = false
+		} else {
+			output.WriteString("S3 uploads: SUCCEEDED\n")
+		}
+	}
+
 	// And finally return the results.
 	return healthy, output.String()
 }
@@ -349,16 +1042,112 @@ func (s *Storage) Insert(
 	// Metrics
 	s.metrics.PrimaryInserts.IncTotal()
 
+	// If the caller supplied an idempotency key that was already used then
+	// the ID from that insert is returned rather than writing the data a
+	// second time. Otherwise the result of this insert is recorded against
+	// the key once it finishes.
+	if data.IdempotencyKey != "" && s.idempotency != nil {
+		prevID, entry, berr := s.idempotency.begin(ctx, data.IdempotencyKey)
+		if berr != nil {
+			s.metrics.PrimaryInserts.IncFailures()
+			return "", berr
+		} else if entry == nil {
+			s.metrics.PrimaryInserts.IncSuccesses()
+			return prevID, nil
+		}
+		defer func() {
+			s.idempotency.finish(entry, id, err)
+		}()
+	}
+
+	// Data that is known to be too large is rejected before any of it is
+	// read.
+	if max := s.settings.maxRecordBytes(); data.Length > max {
+		s.metrics.PrimaryInserts.IncFailures()
+		return "", ErrRecordTooLarge(max)
+	}
+
+	// Make sure that the hash can be checked before waiting on a primary.
+	if data.Hash != "" {
+		if _, err := hasher.Validator(data.Hash, io.Discard); err != nil {
+			s.metrics.PrimaryInserts.IncFailures()
+			return "", ErrInvalidHash(data.Hash)
+		}
+	}
+
+	// No new data is accepted while the namespace is read only.
+	if atomic.LoadInt32(&s.readOnly) != 0 {
+		s.metrics.PrimaryInserts.IncFailures()
+		return "", ErrReadOnly{}
+	}
+
+	// Once draining has started no new data is accepted.
+	if atomic.LoadInt32(&s.draining) != 0 {
+		s.metrics.PrimaryInserts.IncFailures()
+		return "", ErrDraining{}
+	}
+
+	// If the data files on disk have grown past the configured limit then
+	// the insert is rejected rather than risking filling the disk, which
+	// would break every namespace on the machine.
+	// Inserts of an unknown length only count the data already on disk.
+	if s.settings.MaxDiskBytes > 0 {
+		used := atomic.LoadInt64(&s.metrics.DiskBytes)
+		if data.Length > 0 {
+			used += data.Length
+		}
+		if used > s.settings.MaxDiskBytes {
+			s.metrics.PrimaryInserts.IncFailures()
+			return "", ErrDiskFull{}
+		}
+	}
+
 	// Get the next available primary, blocking until one becomes
 	// available. The given call will call the check function before
 	// sleeping each time in order to ensure that new primaries will
 	// be opened if there are not currently enough given the waiting
-	// callers.
+	// callers. If the namespace is made read only, the caller goes away or
+	// Settings.InsertQueueTimeout passes while waiting then the wait is
+	// abandoned without taking a primary.
+	waitCtx := ctx
+	if s.settings.InsertQueueTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(
+			ctx,
+			s.settings.InsertQueueTimeout)
+		defer cancel()
+	}
+	stopWake := context.AfterFunc(waitCtx, s.waiting.wakeAll)
 	start := time.Now()
-	prim := s.waiting.Get(s.checkIdleFiles)
+	prim := s.waiting.Get(s.checkIdleFiles, func() bool {
+		return s.ReadOnly() || waitCtx.Err() != nil
+	})
+	queued := time.Since(start)
+	stopWake()
 	atomic.AddUint64(
 		&s.metrics.PrimaryInsertQueueNanoseconds,
-		uint64(time.Since(start)))
+		uint64(queued))
+	s.metrics.PrimaryInsertQueueLatency.Observe(queued)
+	if prim != nil && ctx.Err() != nil {
+		// The caller went away just as the primary was handed over. The
+		// primary has not been touched yet so it is still in the waiting
+		// state and can be put straight back for the next caller.
+		s.waiting.Put(prim)
+		prim = nil
+	}
+	if prim == nil {
+		s.metrics.PrimaryInserts.IncFailures()
+		switch {
+		case s.ReadOnly():
+			return "", ErrReadOnly{}
+		case ctx.Err() != nil:
+			atomic.AddInt64(&s.metrics.InsertsCanceled, 1)
+			return "", ctx.Err()
+		default:
+			atomic.AddInt64(&s.metrics.InsertQueueTimeouts, 1)
+			return "", ErrInsertQueueTimeout{}
+		}
+	}
 
 	// With the primary in hand we can now call Insert to add the data that
 	// was passed into us. Errors encountered during the insertion
@@ -376,6 +1165,9 @@ func (s *Storage) Insert(
 		s.metrics.PrimaryInserts.IncFailures()
 	} else {
 		s.metrics.PrimaryInserts.IncSuccesses()
+		if prim.unspread {
+			atomic.AddInt64(&s.metrics.UnspreadInserts, 1)
+		}
 	}
 
 	// If the primary is no longer waiting then we need to signal an existing
@@ -389,13 +1181,60 @@ func (s *Storage) Insert(
 }
 
 // Reads an individual ID (provided via rc). This may involve directly talking
-// to S3, or talking to the remote machine that is serving the given ID.
+// to S3, or talking to the remote machine that is serving the given ID. If
+// ctx carries a ReadInfo then it is filled in with the source that served
+// the read and the number of bytes read from the returned io.ReadCloser.
 func (s *Storage) Read(
 	ctx context.Context,
 	rc ReadConfig,
 ) (
 	io.ReadCloser,
 	error,
+) {
+	rcloser, err := s.read(ctx, rc)
+	if info := readInfoFromContext(ctx); info != nil && err == nil {
+		if encoded, ok := rcloser.(*EncodedReadCloser); ok {
+			encoded.ReadCloser = &limitReadCloser{
+				RC:     encoded.ReadCloser,
+				N:      math.MaxInt64,
+				Served: &info.BytesServed,
+			}
+		} else {
+			rcloser = &limitReadCloser{
+				RC:     rcloser,
+				N:      int64(rc.Length()),
+				Served: &info.BytesServed,
+			}
+		}
+	}
+	return rcloser, err
+}
+
+// Records that a read was served from the given source.
+func (s *Storage) readServed(ctx context.Context, source string) {
+	switch source {
+	case ReadSourceCache:
+		s.metrics.ReadSources.IncCache()
+	case ReadSourceLocal:
+		s.metrics.ReadSources.IncLocal()
+	case ReadSourceRemote:
+		s.metrics.ReadSources.IncRemote()
+	case ReadSourceS3:
+		s.metrics.ReadSources.IncS3()
+	}
+	if info := readInfoFromContext(ctx); info != nil {
+		info.Source = source
+	}
+}
+
+// Implements Read(), returning the io.ReadCloser for whichever source was
+// able to serve the read.
+func (s *Storage) read(
+	ctx context.Context,
+	rc ReadConfig,
+) (
+	io.ReadCloser,
+	error,
 ) {
 	// Debug logging so we know where to start.
 	log := rc.Logger()
@@ -409,6 +1248,24 @@ func (s *Storage) Read(
 	}
 	log.LogAttrs(ctx, slog.LevelDebug, "starting request processing.")
 
+	// If only durable data can be served then local files and remotes are
+	// not consulted at all since the data they hold may not have been
+	// uploaded yet.
+	if s.settings.DurableReadsOnly || rc.DurableOnly() {
+		return s.readDurable(ctx, rc, log)
+	}
+
+	// If configured then the read is served from the file descriptor that
+	// the primary or replica already has open. This holds a reference to
+	// the descriptor so a file that is deleted while the read is in
+	// progress can still be served.
+	if s.settings.ReadFromOpenFile {
+		if rcloser := s.readOpenFile(ctx, rc, log); rcloser != nil {
+			s.readServed(ctx, ReadSourceLocal)
+			return rcloser, nil
+		}
+	}
+
 	// First of all we can check to see if we have a copy of this fid
 	// stored locally. If we do then hurray we can serve this request
 	// directly.
@@ -416,7 +1273,8 @@ func (s *Storage) Read(
 		fn, ok := func() (string, bool) {
 			s.primariesLock.Lock()
 			defer s.primariesLock.Unlock()
-			if p, ok := s.primaries[rc.FIDString()]; ok {
+			p, ok := s.primaries[rc.FIDString()]
+			if ok && atomic.LoadInt32(&p.quarantined) == 0 {
 				return p.fd.Name(), true
 			} else {
 				return "", false
@@ -428,7 +1286,8 @@ func (s *Storage) Read(
 		fn, ok = func() (string, bool) {
 			s.replicasLock.Lock()
 			defer s.replicasLock.Unlock()
-			if r, ok := s.replicas[rc.FIDString()]; ok {
+			r, ok := s.replicas[rc.FIDString()]
+			if ok && atomic.LoadInt32(&r.quarantined) == 0 {
 				return r.fd.Name(), true
 			} else {
 				return "", false
@@ -440,71 +1299,20 @@ func (s *Storage) Read(
 		return "", false
 	}()
 	if ok {
-		// We have a primary with this fid! Try opening the file and seeking
-		// to the starting position of the data we need.
-		fd, err := os.Open(fn)
-		if err != nil {
-			// The file must have been removed before we were able to open
-			// it, in this case we need to just continue on.
-			log.LogAttrs(
-				ctx,
-				slog.LevelDebug,
-				"Attempt at a file open failed, falling back to "+
-					"alternate options.",
-				sloghelper.String("file", fn),
-				sloghelper.Error("error", err))
-		} else if _, err := fd.Seek(int64(rc.Start()), io.SeekStart); err != nil {
-			// There was an error seeking in the file. This is not expected
-			// but we can continue on pretending that the file was not
-			// able to be processed at all.
-			log.LogAttrs(
-				ctx,
-				slog.LevelDebug,
-				"Attempt at a file seek failed, falling back to "+
-					"alternate options.",
-				sloghelper.String("file", fn),
-				sloghelper.Error("error", err))
-		} else if n, err := fd.Seek(0, io.SeekCurrent); err != nil {
-			// After the above seek executes we want to find out where we
-			// are in the file, Seeking to 1000 in a 10 byte file will work
-			// and return the offset of 10000. We seek to 0 with a relative
-			// offset to get the real location that the file pointer landed.
-			// Getting here means that the first seek worked, but the second
-			// didn't which is very odd and shouldn't ever happen.
-			log.LogAttrs(
-				ctx,
-				slog.LevelDebug,
-				"Could not obtain the current offset of the file pointer, "+
-					"falling back to alternate options.",
-				sloghelper.String("file", fn),
-				sloghelper.Error("error", err))
-		} else if uint64(n) != rc.Start() {
-			// The file was not large enough to get us to "start"
-			// as an offset and thus we need to return an error.
-			log.LogAttrs(
-				ctx,
-				slog.LevelDebug,
-				"Short seek when attempting to find id, falling back to"+
-					"alternate options.",
-				slog.String("file", fn),
-				slog.Int64("seeked-offset", n))
-		} else {
-			// We have a file with the position at the right place,
-			// now we need to create a limited reader that will
-			// only read the number of bytes necessary for the
-			// operation.
-			log.LogAttrs(
-				ctx,
-				slog.LevelDebug,
-				"Serving read request locally.",
-				sloghelper.String("file", fn))
-			return &limitReadCloser{
-				RC: fd,
-				N:  int64(rc.Length()),
-			}, nil
+		if rcloser := s.openLocal(ctx, fn, rc, log); rcloser != nil {
+			s.readServed(ctx, ReadSourceLocal)
+			return rcloser, nil
 		}
 	}
 
+	// The uncompressed file may already be gone while the compressed copy
+	// is still waiting to be uploaded, in which case the data is only
+	// available by decompressing it locally.
+	if rcloser := s.readLocalCompressed(ctx, rc, log); rcloser != nil {
+		s.readServed(ctx, ReadSourceLocal)
+		return rcloser, nil
+	}
+
 	// If this ReadConfig specifies that this should be a LocalOnly read then
 	// we need to stop here. We only want to process local files which we have
 	// done.
@@ -523,6 +1331,7 @@ func (s *Storage) Read(
 	// id we can get the Remote that created and served this file. That
 	// will let us fetch the data raw off disk from a remote machine
 	// rather than using the AWS API.
+	creatorDown := false
 	if s.settings.MachineID == rc.Machine() {
 		// This file was created on this machine, no need to try reading it
 		// from a remote.
@@ -531,124 +1340,858 @@ func (s *Storage) Read(
 			slog.LevelDebug,
 			"Data was created locally, but its not present. "+
 				"Falling back to S3.")
-	} else if rcloser, err := s.settings.Read(rc); err == nil {
+	} else if rcloser, err := s.settings.Read(ctx, rc); err == nil {
 		// There was no error which means that rc is fit for us to
 		// return to the called.
 		s.settings.BaseLogger.LogAttrs(
 			ctx,
 			slog.LevelDebug,
-			"Serving data from a remote Blobby server.",
-			sloghelper.Uint32("machine-id", rc.Machine()))
-		return rcloser, nil
-	} else if _, ok := err.(ErrNotFound); ok {
-		// Getting a 404 back from the caller means that the object was not
-		// found locally on the remote side so now we can proceed
-		// to fetch from S3.
-		if log.Enabled(ctx, slog.LevelDebug) {
-			log.LogAttrs(
-				ctx,
-				slog.LevelDebug,
-				"The remote did not have the data locally. "+
-					"Falling back to S3.",
-				sloghelper.Uint32("machine-id", rc.Machine()))
+			"Serving data from a remote Blobby server.",
+			sloghelper.Uint32("machine-id", rc.Machine()))
+		s.readServed(ctx, ReadSourceRemote)
+		return rcloser, nil
+	} else if _, ok := err.(ErrNotFound); ok {
+		// Getting a 404 back from the caller means that the object was not
+		// found locally on the remote side so now we can proceed
+		// to fetch from S3.
+		if log.Enabled(ctx, slog.LevelDebug) {
+			log.LogAttrs(
+				ctx,
+				slog.LevelDebug,
+				"The remote did not have the data locally. "+
+					"Falling back to S3.",
+				sloghelper.Uint32("machine-id", rc.Machine()))
+		}
+	} else {
+		// There was an error fetching the file that was NOT a ErrNotFound
+		// error which could be a network issue, or machine issue on the
+		// other end. As such we need to log it and then fall back to an
+		// S3 fetch.
+		log.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Error communicating with remote Blobby instance, "+
+				"Falling back to S3.",
+			sloghelper.Uint32("machine-id", rc.Machine()),
+			sloghelper.Error("error", err))
+		s.metrics.ReadSources.IncRemoteErrors()
+		creatorDown = true
+	}
+
+	// If this machine created the file then it knows which remotes it
+	// assigned as replicas, any of which may still have the data. Other
+	// machines do not know where the replicas are so if the creator could
+	// not be reached every machine that could hold one is asked instead.
+	var holders []Remote
+	if s.settings.MachineID == rc.Machine() {
+		holders = s.replicaLocations.get(rc.FIDString())
+	} else if creatorDown && s.settings.ReplicaHolders != nil {
+		holders = s.settings.ReplicaHolders(rc.Machine())
+	}
+	if rcloser := s.readReplicas(ctx, rc, holders, log); rcloser != nil {
+		return rcloser, nil
+	}
+
+	// Lastly we check S3 to see if it has the object. If S3 is having
+	// problems then any copy of the file that is still on disk (such as one
+	// being held by DelayDelete) can be used to serve the request instead.
+	// Compressed objects can only be read via their compress index since
+	// the offsets in the id do not match the compressed data.
+	read := s.readS3
+	if s.settings.Compress {
+		read = s.readS3Indexed
+		if rcloser := s.readS3Gzip(ctx, rc, log); rcloser != nil {
+			s.readServed(ctx, ReadSourceS3)
+			return rcloser, nil
+		}
+	}
+	rcloser, err := s.readThroughCache(ctx, rc, log, read)
+	if err == nil || !s.settings.StaleReadsOnS3Error {
+		return rcloser, err
+	} else if _, ok := err.(ErrNotFound); ok {
+		return nil, err
+	} else if _, ok := err.(ErrNotPossible); ok {
+		return nil, err
+	} else if stale := s.readStale(ctx, rc, log); stale != nil {
+		s.readServed(ctx, ReadSourceLocal)
+		return stale, nil
+	}
+	return nil, err
+}
+
+// Attempts to serve the request from a local file with the given name. If
+// the file can not be opened, or does not contain the requested range then
+// this returns nil and the caller is expected to try other options.
+func (s *Storage) openLocal(
+	ctx context.Context,
+	fn string,
+	rc ReadConfig,
+	log *slog.Logger,
+) io.ReadCloser {
+	// Try opening the file and seeking to the starting position of the
+	// data we need.
+	fd, err := os.Open(fn)
+	if err != nil {
+		// The file must have been removed before we were able to open
+		// it, in this case we need to just continue on.
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Attempt at a file open failed, falling back to "+
+				"alternate options.",
+			sloghelper.String("file", fn),
+			sloghelper.Error("error", err))
+	} else if _, err := fd.Seek(int64(rc.Start()), io.SeekStart); err != nil {
+		// There was an error seeking in the file. This is not expected
+		// but we can continue on pretending that the file was not
+		// able to be processed at all.
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Attempt at a file seek failed, falling back to "+
+				"alternate options.",
+			sloghelper.String("file", fn),
+			sloghelper.Error("error", err))
+	} else if n, err := fd.Seek(0, io.SeekCurrent); err != nil {
+		// After the above seek executes we want to find out where we
+		// are in the file, Seeking to 1000 in a 10 byte file will work
+		// and return the offset of 10000. We seek to 0 with a relative
+		// offset to get the real location that the file pointer landed.
+		// Getting here means that the first seek worked, but the second
+		// didn't which is very odd and shouldn't ever happen.
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Could not obtain the current offset of the file pointer, "+
+				"falling back to alternate options.",
+			sloghelper.String("file", fn),
+			sloghelper.Error("error", err))
+	} else if uint64(n) != rc.Start() {
+		// The file was not large enough to get us to "start"
+		// as an offset and thus we need to return an error.
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Short seek when attempting to find id, falling back to"+
+				"alternate options.",
+			slog.String("file", fn),
+			slog.Int64("seeked-offset", n))
+	} else {
+		// We have a file with the position at the right place,
+		// now we need to create a limited reader that will
+		// only read the number of bytes necessary for the
+		// operation.
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Serving read request locally.",
+			sloghelper.String("file", fn))
+		return &limitReadCloser{
+			RC: fd,
+			N:  int64(rc.Length()),
+		}
+	}
+	return nil
+}
+
+// Attempts to serve the request from the open file descriptor of a primary
+// or replica that holds the fid. This returns nil if neither has the file
+// open, or if the file does not contain the requested range.
+func (s *Storage) readOpenFile(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+) io.ReadCloser {
+	start := int64(rc.Start())
+	length := int64(rc.Length())
+	rcloser := func() io.ReadCloser {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		p, ok := s.primaries[rc.FIDString()]
+		if ok && atomic.LoadInt32(&p.quarantined) == 0 {
+			return p.fdRefs.reader(p.fd, start, length)
+		}
+		return nil
+	}()
+	if rcloser == nil {
+		rcloser = func() io.ReadCloser {
+			s.replicasLock.Lock()
+			defer s.replicasLock.Unlock()
+			r, ok := s.replicas[rc.FIDString()]
+			if ok && atomic.LoadInt32(&r.quarantined) == 0 {
+				return r.fdRefs.reader(r.fd, start, length)
+			}
+			return nil
+		}()
+	}
+	if rcloser != nil {
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Serving read request from an open local file.")
+	}
+	return rcloser
+}
+
+// Asks all of the given remotes for their local copy of the data at the
+// same time and returns the first one that can serve it. Any other remote
+// that also returns data has its reader closed. If none of the remotes can
+// serve the read then this returns nil.
+func (s *Storage) readReplicas(
+	ctx context.Context,
+	rc ReadConfig,
+	remotes []Remote,
+	log *slog.Logger,
+) io.ReadCloser {
+	type result struct {
+		remote  Remote
+		rcloser io.ReadCloser
+		err     error
+	}
+	results := make(chan result, len(remotes))
+	for _, remote := range remotes {
+		go func(remote Remote) {
+			rcloser, err := remote.Read(ctx, rc)
+			results <- result{remote: remote, rcloser: rcloser, err: err}
+		}(remote)
+	}
+	for i := range remotes {
+		res := <-results
+		if res.err == nil {
+			log.LogAttrs(
+				ctx,
+				slog.LevelDebug,
+				"Serving data from a replica.",
+				sloghelper.String("remote", res.remote.String()))
+			s.readServed(ctx, ReadSourceRemote)
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if res := <-results; res.err == nil {
+						res.rcloser.Close()
+					}
+				}
+			}(len(remotes) - i - 1)
+			return res.rcloser
+		} else if _, ok := res.err.(ErrNotFound); !ok {
+			log.LogAttrs(
+				ctx,
+				slog.LevelWarn,
+				"Error reading from a replica, trying the next option.",
+				sloghelper.String("remote", res.remote.String()),
+				sloghelper.Error("error", res.err))
+			s.metrics.ReadSources.IncRemoteErrors()
+		}
+	}
+	return nil
+}
+
+// Called when S3 returned an error while attempting to read. This checks the
+// data directory for any primary or replica file that still contains the
+// requested fid, regardless of the state it is in, so that reads can be
+// served through an S3 outage.
+func (s *Storage) readStale(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+) io.ReadCloser {
+	// Files recovered at startup stay where they were found so both
+	// layouts are checked if the directory is sharded.
+	dirs := []string{s.settings.dataDirectory(rc.FIDString())}
+	if s.settings.ShardDirectories > 0 {
+		dirs = append(dirs, s.settings.BaseDirectory)
+	}
+	for _, dir := range dirs {
+		for _, name := range []string{rc.FIDString(), "r-" + rc.FIDString()} {
+			fn := filepath.Join(dir, name)
+			if rcloser := s.openLocal(ctx, fn, rc, log); rcloser != nil {
+				log.LogAttrs(
+					ctx,
+					slog.LevelWarn,
+					"S3 is unavailable, serving the read from a local file.",
+					sloghelper.String("file", fn))
+				return rcloser
+			}
+		}
+	}
+	return nil
+}
+
+// Serves a read that must only return data which is durably stored in S3.
+// If the object is not in S3 yet then this returns ErrNotDurable rather than
+// falling back to the local or remote copies.
+func (s *Storage) readDurable(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+) (
+	io.ReadCloser,
+	error,
+) {
+	// Files that are being retained after their upload are known to be in
+	// S3 already so they can serve the read without going to S3.
+	if fn, _ := s.retainedFile(rc.FIDString()); fn != "" {
+		if rcloser := s.openLocal(ctx, fn, rc, log); rcloser != nil {
+			s.readServed(ctx, ReadSourceLocal)
+			return rcloser, nil
+		}
+	}
+
+	// Compressed objects can only be read via their compress index, if
+	// there is no index then durable reads are not possible.
+	read := s.readS3
+	if s.settings.Compress {
+		read = s.readS3Indexed
+		if rcloser := s.readS3Gzip(ctx, rc, log); rcloser != nil {
+			s.readServed(ctx, ReadSourceS3)
+			return rcloser, nil
+		}
+	}
+	rcloser, err := s.readThroughCache(ctx, rc, log, read)
+	if _, ok := err.(ErrNotFound); ok {
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Object is not in S3 yet, rejecting durable read.")
+		return nil, ErrNotDurable(rc.ID())
+	}
+	return rcloser, err
+}
+
+// If Settings.RetainForReads is enabled and the given fid is a primary or
+// replica that has been uploaded and is being retained for reads then this
+// returns the name of its local file along with LocationPrimary or
+// LocationReplica depending on which it is. The name is empty if there is
+// no such file.
+func (s *Storage) retainedFile(fidStr string) (string, string) {
+	if !s.settings.RetainForReads {
+		return "", ""
+	}
+	fn := func() string {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		p, ok := s.primaries[fidStr]
+		if !ok ||
+			atomic.LoadInt32(&p.state) != primaryStateDelayLocalDelete ||
+			atomic.LoadInt32(&p.quarantined) != 0 {
+			return ""
+		}
+		return p.fd.Name()
+	}()
+	if fn != "" {
+		return fn, LocationPrimary
+	}
+	s.replicasLock.Lock()
+	defer s.replicasLock.Unlock()
+	r, ok := s.replicas[fidStr]
+	if !ok ||
+		atomic.LoadInt32(&r.state) != replicaStateRetained ||
+		atomic.LoadInt32(&r.quarantined) != 0 {
+		return "", ""
+	}
+	return r.fd.Name(), LocationReplica
+}
+
+// Reads the data for the given ReadConfig from S3 using the given function.
+// If the read cache is enabled then the read is served from it when
+// possible, otherwise the data read from S3 is added to it.
+func (s *Storage) readThroughCache(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+	read func(context.Context, ReadConfig, *slog.Logger) (
+		io.ReadCloser,
+		error,
+	),
+) (
+	io.ReadCloser,
+	error,
+) {
+	if s.readCache != nil {
+		if rcloser := s.readCache.get(rc); rcloser != nil {
+			log.LogAttrs(
+				ctx,
+				slog.LevelDebug,
+				"Serving read request from the read cache.")
+			s.readServed(ctx, ReadSourceCache)
+			return rcloser, nil
+		}
+	}
+	rcloser, err := read(ctx, rc, log)
+	if err != nil {
+		return nil, err
+	}
+	s.readServed(ctx, ReadSourceS3)
+	if s.readCache != nil {
+		rcloser = s.readCache.tee(ctx, rc, rcloser)
+	}
+	return rcloser, nil
+}
+
+// Reads the data for the given ReadConfig directly out of S3. This is the
+// final fallback for Read() when the data is not available locally or on a
+// remote. If additional key formats are configured then each of them will
+// be tried in turn when the object is not found under the primary format.
+func (s *Storage) readS3(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+) (
+	io.ReadCloser,
+	error,
+) {
+	rcloser, err := s.readS3Key(
+		ctx,
+		rc,
+		filepath.Join(
+			s.settings.S3BasePath,
+			s.settings.S3KeyFormat.Format(rc.FID())),
+		log)
+	for _, format := range s.settings.S3AdditionalKeyFormats {
+		if _, ok := err.(ErrNotFound); !ok {
+			break
+		}
+		rcloser, err = s.readS3Key(
+			ctx,
+			rc,
+			filepath.Join(s.settings.S3BasePath, format.Format(rc.FID())),
+			log)
+	}
+	return rcloser, err
+}
+
+// Reads the data for the given ReadConfig from a specific key in S3.
+func (s *Storage) readS3Key(
+	ctx context.Context,
+	rc ReadConfig,
+	key string,
+	log *slog.Logger,
+) (
+	io.ReadCloser,
+	error,
+) {
+	// Check S3 to see if it has the object.
+	log = log.With(
+		sloghelper.String("bucket", s.settings.S3Bucket),
+		sloghelper.String("key", key))
+	body, err := s.settings.objectStore().GetRange(
+		ctx,
+		key,
+		int64(rc.Start()),
+		int64(rc.Length()),
+		"")
+	if err != nil {
+		return nil, s3GetError(ctx, rc, err, log)
+	} else if log.Enabled(ctx, slog.LevelDebug) {
+		// The request can be satisfied via S3 directly.
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Serving read request from S3.")
+	}
+
+	// As an added security precaution we make sure that we do not serve
+	// more content than would be expected via the request ID that we were
+	// given.
+	return &limitReadCloser{RC: body, N: int64(rc.Length())}, nil
+}
+
+// Converts an error returned from the object store into the error that
+// should be returned from a read, logging it along the way.
+func s3GetError(
+	ctx context.Context,
+	rc ReadConfig,
+	err error,
+	log *slog.Logger,
+) error {
+	switch err.(type) {
+	case ErrBucketNotFound:
+		log.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"AWS S3 Bucket does not exist.")
+		return fmt.Errorf("S3 bucket does not exist.")
+	case ErrNotFound:
+		log.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Object was not found in S3.")
+		return ErrNotFound(rc.ID())
+	}
+	log.LogAttrs(
+		ctx,
+		slog.LevelError,
+		"Error calling the S3 API.",
+		sloghelper.Error("error", err))
+	return err
+}
+
+// Reads the data for the given ReadConfig from a compressed object in S3
+// using the compress index that was uploaded with it. If no object has an
+// index then there is no way to seek to the data within the compressed
+// object, so unless Settings.AllowFullDecompressReads is enabled this
+// returns ErrNotPossible.
+func (s *Storage) readS3Indexed(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+) (
+	io.ReadCloser,
+	error,
+) {
+	formats := append(
+		[]*fid.Formatter{s.settings.S3KeyFormat},
+		s.settings.S3AdditionalKeyFormats...)
+	for _, format := range formats {
+		key := filepath.Join(s.settings.S3BasePath, format.Format(rc.FID()))
+		index, err := s.readCompressIndex(ctx, rc, key, log)
+		if _, ok := err.(ErrNotFound); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return s.readS3IndexedKey(ctx, rc, key, index, log)
+	}
+
+	// If allowed then the object is decompressed from the start instead.
+	// An empty index has no checkpoints so the whole object is fetched.
+	if s.settings.AllowFullDecompressReads {
+		for _, format := range formats {
+			key := filepath.Join(s.settings.S3BasePath, format.Format(rc.FID()))
+			log.LogAttrs(
+				ctx,
+				slog.LevelDebug,
+				"There is no compress index for the object in S3, "+
+					"decompressing the whole object.",
+				sloghelper.String("key", key))
+			rcloser, err := s.readS3IndexedKey(
+				ctx,
+				rc,
+				key,
+				&compressIndex{},
+				log)
+			if _, ok := err.(ErrNotFound); ok {
+				continue
+			}
+			return rcloser, err
+		}
+		return nil, ErrNotFound(rc.ID())
+	}
+	log.LogAttrs(
+		ctx,
+		slog.LevelDebug,
+		"Local data is not available and there is no compress index "+
+			"for the object in S3 which makes it impossible to seek in. "+
+			"Rejecting request")
+	return nil, ErrNotPossible{}
+}
+
+// Returns the raw compressed object from S3 if the caller accepts gzip, the
+// object is gzip compressed, and the ID covers all of the data in it. This
+// lets the caller decompress the data rather than having to do it here.
+// Whether the ID covers all of the data is checked against the uncompressed
+// length stored with the object, so objects uploaded without it can not be
+// served this way. If the object can not be served this way for any reason
+// then nil is returned and the caller should fall back to a normal read.
+func (s *Storage) readS3Gzip(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+) io.ReadCloser {
+	if !rc.AcceptGzip() || rc.Start() != 0 {
+		return nil
+	} else if _, ok := s.settings.compressor().(gzipCompressor); !ok {
+		return nil
+	}
+	formats := append(
+		[]*fid.Formatter{s.settings.S3KeyFormat},
+		s.settings.S3AdditionalKeyFormats...)
+	for _, format := range formats {
+		key := filepath.Join(s.settings.S3BasePath, format.Format(rc.FID()))
+		klog := log.With(
+			sloghelper.String("bucket", s.settings.S3Bucket),
+			sloghelper.String("key", key))
+		store := s.settings.objectStore()
+		info, err := store.Head(ctx, key)
+		if err != nil {
+			if _, ok := s3GetError(ctx, rc, err, klog).(ErrNotFound); ok {
+				continue
+			}
+			return nil
+		}
+		length := ""
+		for name, value := range info.Metadata {
+			if strings.EqualFold(name, uncompressedLengthMetadata) {
+				length = value
+			}
+		}
+		if length != strconv.FormatUint(uint64(rc.Length()), 10) {
+			return nil
+		}
+
+		// The ETag ensures that the object that is read is the same one
+		// that the length was checked against.
+		body, err := store.GetRange(ctx, key, 0, -1, info.ETag)
+		if err != nil {
+			s3GetError(ctx, rc, err, klog)
+			return nil
+		}
+		klog.LogAttrs(
+			ctx,
+			slog.LevelDebug,
+			"Serving read request from S3 without decompressing.")
+		return &EncodedReadCloser{
+			ReadCloser:      body,
+			ContentEncoding: "gzip",
 		}
-	} else {
-		// There was an error fetching the file that was NOT a ErrNotFound
-		// error which could be a network issue, or machine issue on the
-		// other end. As such we need to log it and then fall back to an
-		// S3 fetch.
+	}
+	return nil
+}
+
+// Fetches and decodes the compress index for the object at the given key.
+// Indexes are cached once fetched so this only goes to S3 the first time.
+func (s *Storage) readCompressIndex(
+	ctx context.Context,
+	rc ReadConfig,
+	key string,
+	log *slog.Logger,
+) (
+	*compressIndex,
+	error,
+) {
+	if index := s.compressIndexes.get(key); index != nil {
+		return index, nil
+	}
+	objectKey := key
+	key = key + compressIndexSuffix
+	log = log.With(
+		sloghelper.String("bucket", s.settings.S3Bucket),
+		sloghelper.String("key", key))
+	body, err := s.settings.objectStore().GetRange(ctx, key, 0, -1, "")
+	if err != nil {
+		return nil, s3GetError(ctx, rc, err, log)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
 		log.LogAttrs(
 			ctx,
-			slog.LevelWarn,
-			"Error communicating with remote Blobby instance, "+
-				"Falling back to S3.",
-			sloghelper.Uint32("machine-id", rc.Machine()),
+			slog.LevelError,
+			"Error reading the compress index from S3.",
 			sloghelper.Error("error", err))
+		return nil, err
 	}
-
-	// S3 only works if the file was not compressed when being uploaded
-	// otherwise the offsets will be all wrong. For now we just return
-	// a sentinel error to indicate that it is not possible to fetch
-	// the record.
-	if s.settings.Compress {
+	index, err := decodeCompressIndex(data)
+	if err != nil {
 		log.LogAttrs(
 			ctx,
-			slog.LevelDebug,
-			"Local data is not available and the files are compressed "+
-				"in S3 which makes them impossible to seek in. Rejecting "+
-				"request")
-		return nil, ErrNotPossible{}
+			slog.LevelError,
+			"Error decoding the compress index.",
+			sloghelper.Error("error", err))
+		return nil, err
 	}
+	s.compressIndexes.add(objectKey, index)
+	return index, nil
+}
 
-	// Lastly we check S3 to see if it has the object.
-	key := filepath.Join(
-		s.settings.S3BasePath,
-		s.settings.S3KeyFormat.Format(rc.FID()))
-	rng := fmt.Sprintf(
-		"bytes=%d-%d",
-		rc.Start(),
-		rc.Start()+uint64(rc.Length())-1)
-	goi := s3.GetObjectInput{
-		Bucket: &s.settings.S3Bucket,
-		Key:    &key,
-		Range:  &rng,
+// Reads the data for the given ReadConfig from the compressed object at the
+// given key. This fetches the object starting at the nearest checkpoint
+// before the data and decompresses forward until it reaches the start.
+func (s *Storage) readS3IndexedKey(
+	ctx context.Context,
+	rc ReadConfig,
+	key string,
+	index *compressIndex,
+	log *slog.Logger,
+) (
+	io.ReadCloser,
+	error,
+) {
+	checkpoint := index.find(rc.Start())
+	offset := int64(checkpoint.Compressed)
+	length := int64(-1)
+	if end := index.end(rc.Start() + uint64(rc.Length())); end > 0 {
+		length = int64(end) - offset
 	}
 	log = log.With(
 		sloghelper.String("bucket", s.settings.S3Bucket),
-		sloghelper.String("key", *goi.Key))
-	goo, err := s.settings.S3Client.GetObject(&goi)
+		sloghelper.String("key", key),
+		sloghelper.Int64("offset", offset),
+		sloghelper.Int64("length", length))
+	body, err := s.settings.objectStore().GetRange(ctx, key, offset, length, "")
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			switch awsErr.Code() {
-			case s3.ErrCodeNoSuchBucket:
-				log.LogAttrs(
-					ctx,
-					slog.LevelError,
-					"AWS S3 Bucket does not exist.")
-				return nil, fmt.Errorf("S3 bucket does not exist.")
-			case s3.ErrCodeNoSuchKey:
-				log.LogAttrs(
-					ctx,
-					slog.LevelDebug,
-					"Object was not found in S3.")
-				return nil, ErrNotFound(rc.ID())
-			}
-		}
-		log.With(
+		return nil, s3GetError(ctx, rc, err, log)
+	}
+	rcloser, err := s.decompressRange(body, rc, checkpoint)
+	if err != nil {
+		log.LogAttrs(
 			ctx,
 			slog.LevelError,
-			"Error calling the S3 API.",
+			"Error decompressing the object from S3.",
 			sloghelper.Error("error", err))
 		return nil, err
-	} else if goo.ContentLength == nil {
-		// There was no length returned which means we can not be sure
-		// that this is the right data.
+	}
+	log.LogAttrs(
+		ctx,
+		slog.LevelDebug,
+		"Serving read request from a compressed object in S3.")
+	return rcloser, nil
+}
+
+// Decompresses body, which must start at the given checkpoint, forward
+// until the start of the data requested in rc is reached and returns a
+// reader for just that data. body is closed if this returns an error.
+func (s *Storage) decompressRange(
+	body io.ReadCloser,
+	rc ReadConfig,
+	checkpoint compressCheckpoint,
+) (
+	io.ReadCloser,
+	error,
+) {
+	unzipper, err := s.settings.compressor().NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	skip := int64(rc.Start() - checkpoint.Uncompressed)
+	if _, err := io.CopyN(io.Discard, unzipper, skip); err != nil {
+		unzipper.Close()
+		body.Close()
+		return nil, err
+	}
+	return &limitReadCloser{
+		RC: &compressedReadCloser{
+			Reader:  unzipper,
+			closers: []io.Closer{unzipper, body},
+		},
+		N: int64(rc.Length()),
+	}, nil
+}
+
+// Returns the name of the local compressed file, its compress index and
+// LocationPrimary or LocationReplica depending on which holds it, for the
+// primary or replica with the given fid. The name is empty if there is no
+// such file or if it is not finished being written.
+func (s *Storage) localCompressed(
+	fidStr string,
+) (
+	string,
+	*compressIndex,
+	string,
+) {
+	s.primariesLock.Lock()
+	p, ok := s.primaries[fidStr]
+	s.primariesLock.Unlock()
+	if ok && atomic.LoadInt32(&p.quarantined) == 0 {
+		switch atomic.LoadInt32(&p.state) {
+		case primaryStatePendingUpload,
+			primaryStateUploading,
+			primaryStatePendingDeleteCompressed:
+			if p.compressFd != nil {
+				return p.compressFd.Name(), p.compressIndex, LocationPrimary
+			}
+		}
+	}
+	s.replicasLock.Lock()
+	r, ok := s.replicas[fidStr]
+	s.replicasLock.Unlock()
+	if ok && atomic.LoadInt32(&r.quarantined) == 0 {
+		switch atomic.LoadInt32(&r.state) {
+		case replicaStatePendingUpload,
+			replicaStateUploading,
+			replicaStateRetained,
+			replicaStatePendingDelete:
+			if r.compressFd != nil {
+				return r.compressFd.Name(), r.compressIndex, LocationReplica
+			}
+		}
+	}
+	return "", nil, ""
+}
+
+// Attempts to serve the request by decompressing the local compressed file
+// of a primary or replica. The compress index is used to start at the
+// nearest checkpoint if there is one, otherwise the file is decompressed
+// from the start. If there is no compressed file, or it can not be read,
+// then this returns nil and the caller is expected to try other options.
+func (s *Storage) readLocalCompressed(
+	ctx context.Context,
+	rc ReadConfig,
+	log *slog.Logger,
+) io.ReadCloser {
+	if !s.settings.Compress {
+		return nil
+	}
+	fn, index, _ := s.localCompressed(rc.FIDString())
+	if fn == "" {
+		return nil
+	} else if index == nil {
+		index = &compressIndex{}
+	}
+	checkpoint := index.find(rc.Start())
+	log = log.With(
+		sloghelper.String("file", fn),
+		sloghelper.Uint64("offset", checkpoint.Compressed))
+	fd, err := os.Open(fn)
+	if err != nil {
 		log.LogAttrs(
 			ctx,
-			slog.LevelWarn,
-			"S3 did not return a Content-Length header.")
-		return nil, fmt.Errorf("Missing content-length")
-	} else if *goo.ContentLength != int64(rc.Length()) {
-		// The wrong length was returned.
+			slog.LevelDebug,
+			"Attempt at a compressed file open failed, falling back to "+
+				"alternate options.",
+			sloghelper.Error("error", err))
+		return nil
+	}
+	_, err = fd.Seek(int64(checkpoint.Compressed), io.SeekStart)
+	if err != nil {
+		fd.Close()
 		log.LogAttrs(
 			ctx,
-			slog.LevelWarn,
-			"S3 returned an invalid Content-Length header.",
-			sloghelper.Uint32("expected", rc.Length()),
-			sloghelper.Int64("got", *goo.ContentLength))
-		return nil, fmt.Errorf("Invalid content-length.")
-	} else if log.Enabled(ctx, slog.LevelDebug) {
-		// The request can be satisfied via S3 directly.
+			slog.LevelDebug,
+			"Attempt at a compressed file seek failed, falling back to "+
+				"alternate options.",
+			sloghelper.Error("error", err))
+		return nil
+	}
+	rcloser, err := s.decompressRange(fd, rc, checkpoint)
+	if err != nil {
 		log.LogAttrs(
 			ctx,
-			slog.LevelDebug,
-			"Serving read request from S3.")
+			slog.LevelWarn,
+			"Error decompressing the local compressed file, falling "+
+				"back to alternate options.",
+			sloghelper.Error("error", err))
+		return nil
 	}
+	log.LogAttrs(
+		ctx,
+		slog.LevelDebug,
+		"Serving read request from a local compressed file.")
+	return rcloser
+}
 
-	// As an added security precaution we make sure that we do not serve
-	// more content than would be expected via the request ID that we were
-	// given.
-	return &limitReadCloser{RC: goo.Body, N: int64(rc.Length())}, nil
+// Returns the number of primaries and replicas that have not finished
+// processing yet.
+func (s *Storage) Pending() (primaries, replicas int) {
+	func() {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		for _, p := range s.primaries {
+			if atomic.LoadInt32(&p.state) != primaryStateComplete {
+				primaries++
+			}
+		}
+	}()
+	func() {
+		s.replicasLock.Lock()
+		defer s.replicasLock.Unlock()
+		for _, r := range s.replicas {
+			if atomic.LoadInt32(&r.state) != replicaStateCompleted {
+				replicas++
+			}
+		}
+	}()
+	return
 }
 
 // Performs a Heart Beat on a replica. The only error condition here is that
@@ -695,17 +2238,26 @@ func (s *Storage) ReplicaInitialize(ctx context.Context, fn string) error {
 	repl.s3key = filepath.Join(
 		s.settings.S3BasePath,
 		s.settings.S3KeyFormat.Format(repl.fid))
-	ok := func() bool {
+	existing := func() *replica {
 		s.replicasLock.Lock()
 		defer s.replicasLock.Unlock()
-		if _, ok := s.replicas[fn]; ok {
-			return false
+		if existing, ok := s.replicas[fn]; ok {
+			return existing
 		} else {
 			s.replicas[fn] = repl
-			return true
+			return nil
 		}
 	}()
-	if !ok {
+	if existing != nil {
+		// If configured then initializing a replica that is still
+		// accepting data is treated as a success so that primaries can
+		// safely retry the call.
+		if s.settings.IdempotentReplicaInitialize {
+			if err := existing.Reinitialize(ctx); err == nil {
+				s.metrics.ReplicaInitializes.IncSuccesses()
+				return nil
+			}
+		}
 		s.metrics.ReplicaInitializes.IncFailures()
 		return fmt.Errorf(
 			"Can not initialize '%s' in namespace '%s', it already exists.",
@@ -731,6 +2283,10 @@ func (s *Storage) ReplicaReplicate(
 	rc RemoteReplicateConfig,
 ) error {
 	s.metrics.ReplicaReplicates.IncTotal()
+	if max := s.settings.MaxRecordBytes; max > 0 && rc.Size() > uint64(max) {
+		s.metrics.ReplicaReplicates.IncFailures()
+		return ErrRecordTooLarge(max)
+	}
 	repl := func(fn string) *replica {
 		s.replicasLock.Lock()
 		defer s.replicasLock.Unlock()
@@ -773,6 +2329,77 @@ func (s *Storage) ReplicaQueueDelete(ctx context.Context, fn string) error {
 	}
 }
 
+// Enables or disables read only mode. While read only Insert() returns
+// ErrReadOnly, including for callers that are already waiting for a
+// primary, but reads, replication, uploads and deletes all continue as
+// normal. This is not persisted so it is reset when the process restarts.
+func (s *Storage) SetReadOnly(enabled bool) {
+	if enabled && atomic.CompareAndSwapInt32(&s.readOnly, 0, 1) {
+		s.settings.BaseLogger.Info("Inserts are disabled, now read only.")
+		s.waiting.wakeAll()
+	} else if !enabled && atomic.CompareAndSwapInt32(&s.readOnly, 1, 0) {
+		s.settings.BaseLogger.Info("Inserts are enabled, no longer read only.")
+	}
+}
+
+// Returns true if the Storage is in read only mode, see SetReadOnly().
+func (s *Storage) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+// Changes the size and age at which primaries are queued for upload, which
+// allows larger files to be built during a backfill or files to be flushed
+// sooner when traffic is low. Only primaries opened after the call use the
+// new thresholds, those that are already open keep the thresholds they were
+// opened with, including their expiry time. Each value must be within the
+// range given by the Settings minimum and maximum, otherwise ErrOutOfRange
+// is returned and neither threshold is changed. This is not persisted so it
+// is reset when the process restarts.
+func (s *Storage) SetUploadThresholds(
+	largerThan uint64,
+	older time.Duration,
+) error {
+	switch {
+	case largerThan < s.settings.UploadLargerThanMinimum ||
+		largerThan > s.settings.UploadLargerThanMaximum:
+		return ErrOutOfRange(fmt.Sprintf(
+			"The upload size must be between %d and %d bytes.",
+			s.settings.UploadLargerThanMinimum,
+			s.settings.UploadLargerThanMaximum))
+	case older < s.settings.UploadOlderMinimum ||
+		older > s.settings.UploadOlderMaximum:
+		return ErrOutOfRange(fmt.Sprintf(
+			"The upload age must be between %s and %s.",
+			s.settings.UploadOlderMinimum,
+			s.settings.UploadOlderMaximum))
+	}
+	atomic.StoreUint64(&s.uploadLargerThan, largerThan)
+	atomic.StoreInt64(&s.uploadOlder, int64(older))
+	s.settings.BaseLogger.LogAttrs(
+		context.Background(),
+		slog.LevelInfo,
+		"Upload thresholds changed.",
+		sloghelper.Uint64("larger-than", largerThan),
+		sloghelper.Duration("older", older))
+	return nil
+}
+
+// Returns the size and age at which newly opened primaries will be queued
+// for upload, see SetUploadThresholds().
+func (s *Storage) UploadThresholds() (uint64, time.Duration) {
+	return atomic.LoadUint64(&s.uploadLargerThan),
+		time.Duration(atomic.LoadInt64(&s.uploadOlder))
+}
+
+// Stops a drain started with Drain() so that the Storage will once again
+// open primaries and accept new data.
+func (s *Storage) Resume() {
+	if atomic.CompareAndSwapInt32(&s.draining, 1, 0) {
+		s.settings.BaseLogger.Info("No longer draining the namespace.")
+		s.checkIdleFiles()
+	}
+}
+
 // Starts all of the supporting routines for this Storage implementation.
 // This will also scan the storage directory looking for files created
 // by a previous run of blobby. These will be automatically configured
@@ -780,15 +2407,58 @@ func (s *Storage) ReplicaQueueDelete(ctx context.Context, fn string) error {
 // the data is written to S3 as quickly as possible since it may be from
 // a failed instance.
 func (s *Storage) Start(ctx context.Context) error {
+	// Make sure that the bucket can be used before doing anything else so
+	// that a bad configuration is caught now rather than by the first
+	// upload.
+	if s.settings.VerifyBucketOnStart {
+		if err := verifyBucket(&s.settings); err != nil {
+			s.settings.BaseLogger.Error(
+				"Unable to access the S3 bucket.",
+				sloghelper.String("bucket", s.settings.S3Bucket),
+				sloghelper.Error("error", err))
+			return err
+		}
+	}
+
+	// Create the shard directories so that files can be opened in them.
+	for i := 0; i < s.settings.ShardDirectories; i++ {
+		dir := filepath.Join(
+			s.settings.BaseDirectory,
+			shardDirectoryName(i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			s.settings.BaseLogger.Error(
+				"Error creating a shard directory.",
+				sloghelper.String("directory", dir),
+				sloghelper.Error("error", err))
+			return err
+		}
+	}
+
 	// Check the directory for pre-existing blobby files and for each
 	// add them as a replica.
-	files, err := ioutil.ReadDir(s.settings.BaseDirectory)
+	files, err := dataFiles(s.settings.BaseDirectory)
 	if err != nil {
 		s.settings.BaseLogger.Error(
 			"Error scanning for existing files.",
 			sloghelper.Error("error", err))
 		return err
 	}
+	if s.readCache != nil {
+		if err := s.readCache.reset(); err != nil {
+			s.settings.BaseLogger.Error(
+				"Error preparing the read cache directory.",
+				sloghelper.Error("error", err))
+			return err
+		}
+	}
+	if s.idempotency != nil {
+		if err := s.idempotency.load(); err != nil {
+			s.settings.BaseLogger.Error(
+				"Error loading the persisted idempotency keys.",
+				sloghelper.Error("error", err))
+			return err
+		}
+	}
 	for _, file := range files {
 		if !file.Mode().IsRegular() {
 			// Ignore anything that is not a regular file.
@@ -799,6 +2469,27 @@ func (s *Storage) Start(ctx context.Context) error {
 				sloghelper.String("file", file.Name()))
 			continue
 		}
+		if isCompressedFileName(file.Name()) {
+			// Compressed files left behind by a previous run can always
+			// be generated again from the data file so they are removed
+			// rather than recovered. This also cleans up files left by a
+			// different compression algorithm than is configured now.
+			s.settings.BaseLogger.LogAttrs(
+				ctx,
+				slog.LevelDebug,
+				"Removing left over compressed file.",
+				sloghelper.String("file", file.Name()))
+			fn := filepath.Join(file.dir, file.Name())
+			if err := os.Remove(fn); err != nil {
+				s.settings.BaseLogger.LogAttrs(
+					ctx,
+					slog.LevelWarn,
+					"Error removing left over compressed file.",
+					sloghelper.String("file", file.Name()),
+					sloghelper.Error("error", err))
+			}
+			continue
+		}
 		fidStr := strings.TrimPrefix(file.Name(), "r-")
 		repl := &replica{
 			fidStr:   fidStr,
@@ -824,8 +2515,7 @@ func (s *Storage) Start(ctx context.Context) error {
 			s.settings.S3BasePath,
 			s.settings.S3KeyFormat.Format(repl.fid))
 		var err error
-		repl.fd, err = os.Open(
-			filepath.Join(s.settings.BaseDirectory, file.Name()))
+		repl.fd, err = os.Open(filepath.Join(file.dir, file.Name()))
 		if err != nil {
 			// There was an error opening the file. This is actually
 			// a critical error as it means that we can not recover
@@ -837,11 +2527,22 @@ func (s *Storage) Start(ctx context.Context) error {
 				sloghelper.Error("error", err))
 			return err
 		}
+
+		// The hashes of the records in the file are lost but the number of
+		// them can be recovered if it was stored with the file.
+		if file.Size() > 0 {
+			if count, err := getRecordCount(repl.fd.Name()); err != nil {
+				repl.records.recovered = -1
+			} else {
+				repl.records.recovered = count
+			}
+		}
 		func() {
 			s.replicasLock.Lock()
 			defer s.replicasLock.Unlock()
 			s.replicas[fidStr] = repl
 		}()
+		atomic.AddInt64(&s.metrics.DiskBytes, file.Size())
 		repl.log.Info("Found pre-existing replica on disk at startup.")
 		if s.settings.Compress {
 			repl.setState(ctx, replicaStatePendingCompression)
@@ -850,19 +2551,72 @@ func (s *Storage) Start(ctx context.Context) error {
 		}
 	}
 
+	// Warm up the connections to S3 if configured to do so.
+	warmS3(ctx, &s.settings, s.settings.BaseLogger)
+
 	// Make sure we open the minimum number of primary files which will
 	// happen if we call this function.
 	s.checkIdleFiles()
 
+	// Start scrubbing the files on disk in the background if configured.
+	s.scheduleScrub()
+
 	// Log so its clear that the namespace is initialized.
 	s.settings.BaseLogger.Info("Namespace started.")
 	return nil
 }
 
+const (
+	// Status is written as human readable text. The format is undefined.
+	StatusFormatText = "text"
+
+	// Status is written as a JSON encoded NameSpaceStatus.
+	StatusFormatJSON = "json"
+)
+
+// The status of a single primary or replica file.
+type FileStatus struct {
+	FID   string `json:"fid"`
+	State string `json:"state"`
+	Size  uint64 `json:"size"`
+
+	// The number of records in the file, or -1 if it is not known. This
+	// can happen for replicas recovered at startup from a file system that
+	// could not store the count.
+	Records int `json:"records"`
+
+	// The number of seconds since the first insert into the file. This is
+	// only set for primaries that have been inserted into.
+	OldestInsertAge float64 `json:"oldest_insert_age,omitempty"`
+
+	// The number of failed uploads, only included if the
+	// StatusUploadFailures setting is enabled.
+	UploadFailures int32 `json:"upload_failures,omitempty"`
+
+	// The lag of each remote in bytes if TrackReplicaLag is enabled, and
+	// the remotes that hold replicas of the file. These are only set for
+	// primaries.
+	ReplicaLag []uint64 `json:"replica_lag,omitempty"`
+	Remotes    []string `json:"remotes,omitempty"`
+}
+
+// The status of all of the primaries and replicas in a Storage object.
+type NameSpaceStatus struct {
+	Primaries []FileStatus `json:"primaries"`
+	ReadOnly  bool         `json:"read_only"`
+	Replicas  []FileStatus `json:"replicas"`
+
+	// The upload thresholds for new primaries, the age being in seconds.
+	// These are only set if they were changed by SetUploadThresholds().
+	UploadLargerThan uint64  `json:"upload_larger_than,omitempty"`
+	UploadOlder      float64 `json:"upload_older,omitempty"`
+}
+
 // Gets the status for this Storage implementation and writes it to the
-// given io.Writer. This is a human readable status intended for administration
-// so the format is undefined.
-func (s *Storage) Status(out io.Writer) {
+// given io.Writer in the given format. StatusFormatText is a human readable
+// status intended for administration so its format is undefined, while
+// StatusFormatJSON writes a NameSpaceStatus for use by tooling.
+func (s *Storage) Status(out io.Writer, format string) {
 	// Get a list of primaries. Since this requires a lock we need to do
 	// this in a sub function.
 	primaries := func() primarySlice {
@@ -881,14 +2635,6 @@ func (s *Storage) Status(out io.Writer) {
 	// appear in a consistent order.
 	sort.Sort(primaries)
 
-	// Output the state of each of the primaries.
-	if len(primaries) > 0 {
-		fmt.Fprintf(out, "    Primaries:\n")
-		for _, p := range primaries {
-			fmt.Fprintf(out, "        %s\n", p.Status())
-		}
-	}
-
 	// Get a list of replicas. Since this requires a lock we need to do
 	// this in a sub function.
 	replicas := func() replicaSlice {
@@ -907,6 +2653,51 @@ func (s *Storage) Status(out io.Writer) {
 	// appear in a consistent order.
 	sort.Sort(replicas)
 
+	// The upload thresholds are only included if they have been changed
+	// from the configured values.
+	largerThan, older := s.UploadThresholds()
+	thresholdsChanged := largerThan != s.settings.UploadLargerThan ||
+		older != s.settings.UploadOlder
+
+	if format == StatusFormatJSON {
+		status := NameSpaceStatus{
+			Primaries: make([]FileStatus, len(primaries)),
+			ReadOnly:  s.ReadOnly(),
+			Replicas:  make([]FileStatus, len(replicas)),
+		}
+		if thresholdsChanged {
+			status.UploadLargerThan = largerThan
+			status.UploadOlder = older.Seconds()
+		}
+		for i, p := range primaries {
+			status.Primaries[i] = p.FileStatus()
+		}
+		for i, r := range replicas {
+			status.Replicas[i] = r.FileStatus()
+		}
+		json.NewEncoder(out).Encode(&status)
+		return
+	}
+
+	if s.ReadOnly() {
+		fmt.Fprintf(out, "    Read only, inserts are disabled.\n")
+	}
+	if thresholdsChanged {
+		fmt.Fprintf(
+			out,
+			"    Uploading new primaries larger than %s or older than %s.\n",
+			human.Bytes(largerThan),
+			older)
+	}
+
+	// Output the state of each of the primaries.
+	if len(primaries) > 0 {
+		fmt.Fprintf(out, "    Primaries:\n")
+		for _, p := range primaries {
+			fmt.Fprintf(out, "        %s\n", p.Status())
+		}
+	}
+
 	// Output the state of each of the replicas.
 	if len(replicas) > 0 {
 		fmt.Fprintf(out, "    Replicas:\n")
@@ -922,6 +2713,11 @@ func (s *Storage) Status(out io.Writer) {
 // get() loop for the waiting lists so it can not block on any
 // operation. All work must be done in a goroutine.
 func (s *Storage) checkIdleFiles() {
+	// No new files are opened while draining.
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return
+	}
+
 	// To start we initialize replicas until the replica count number is
 	// at least equal to the minimum replica count numbers. Normally this
 	// won't do anything but its cheap to check up front.
@@ -937,26 +2733,36 @@ func (s *Storage) checkIdleFiles() {
 	}
 
 	// If the open file count is greater or equal to the maximum allowed
-	// open files then we can stop now.
+	// open files then we can stop now. If a caller is waiting then it is
+	// going to block until an existing primary frees up so this is counted
+	// to help with sizing OpenFilesMaximum.
 	if of >= s.settings.OpenFilesMaximum {
+		if s.waiting.waiting > 0 {
+			atomic.AddInt64(&s.metrics.PrimaryPoolExhausted, 1)
+		}
 		return
 	}
 
 	// Next we check to see if the number of open files is appropriate
 	// for the given number of routines waiting on files being open.
-	// We use a very simple double power model here to ensure that we
-	// don't just open files quickly when its completely not necessary
-	// in most cases.
-	//
-	// FIXME: Ideally we add a multiplier here to make this not just a
-	// simple power of 2, but instead a less aggressive curve.
-	if s.waiting.waiting > 1<<uint32(of) {
+	// The curve is configurable so that files are not opened quickly when
+	// its completely not necessary, see openFilesThreshold().
+	if float64(s.waiting.waiting) > s.openFilesThreshold(of) {
 		atomic.AddInt32(&s.appendablePrimaries, 1)
 		go s.openNewPrimaryFile(context.Background()) // FIXME
 		return
 	}
 }
 
+// Returns the number of callers that can be waiting for a primary when
+// there are already the given number of primaries open before another is
+// opened. This is OpenFilesGrowthStep*open + OpenFilesGrowthFactor^open,
+// which with the defaults is 2^open.
+func (s *Storage) openFilesThreshold(open int32) float64 {
+	return s.settings.OpenFilesGrowthStep*float64(open) +
+		math.Pow(s.settings.OpenFilesGrowthFactor, float64(open))
+}
+
 // Opens a new primary file and places it in the idle pool. This is expected
 // to be run as a goroutine so it does not return errors.
 func (s *Storage) openNewPrimaryFile(ctx context.Context) {
@@ -1010,20 +2816,65 @@ func (s *Storage) openNewPrimaryFile(ctx context.Context) {
 	}
 	plog = plog.With(attrs...)
 	plog.LogAttrs(ctx, slog.LevelDebug, "Replicas assigned.")
+	unspread := !domainsSpread(s.settings.Zone, remotes)
+	if unspread {
+		plog.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"Replicas could not be spread across failure domains.")
+	}
 
 	// Start generating the primary structure that we will use for this
 	// primary. We do not want to add this to the map of primaries until
 	// we have replicas assigned so that we do not run the risk of having
 	// to revert.
+	now := time.Now()
+	largerThan, older := s.UploadThresholds()
+	expires := now.Add(older)
+	var rotateAt time.Time
+	if s.settings.RotateEvery > 0 {
+		// Truncate works on absolute time which means that the boundaries
+		// are aligned to the wall clock in UTC.
+		rotateAt = now.Truncate(s.settings.RotateEvery).
+			Add(s.settings.RotateEvery)
+		if rotateAt.Before(expires) {
+			expires = rotateAt
+		}
+	}
 	p := &primary{
-		expires:  time.Now().UnixNano() + int64(s.settings.UploadOlder),
-		log:      plog,
-		remotes:  remotes,
-		settings: &s.settings,
-		state:    primaryStateNew,
-		storage:  s,
+		expires:          expires.UnixNano(),
+		log:              plog,
+		remotes:          remotes,
+		rotateAt:         rotateAt,
+		settings:         &s.settings,
+		state:            primaryStateNew,
+		storage:          s,
+		unspread:         unspread,
+		uploadLargerThan: largerThan,
+	}
+	if s.settings.MillisecondFIDs {
+		err = p.fid.GenerateMilliseconds(
+			s.settings.MachineID,
+			s.settings.ClockSkewPolicy)
+	} else {
+		err = p.fid.GenerateWithPolicy(
+			s.settings.MachineID,
+			s.settings.ClockSkewPolicy)
+	}
+	if err != nil {
+		// The clock has moved backwards and we are configured to refuse
+		// creating new files when that happens. Like with the AssignRemotes
+		// failure above we back off and try again later, by which time
+		// the clock has hopefully caught up.
+		plog.LogAttrs(
+			ctx,
+			slog.LevelError,
+			"Error generating a fid for the new primary.",
+			sloghelper.Error("error", err))
+		go s.openNewPrimaryFile(context.Background()) // FIXME
+		s.newFileBackOff.Failure()
+		return
 	}
-	p.fid.Generate(s.settings.MachineID)
 	p.fidStr = p.fid.String()
 	p.s3key = filepath.Join(
 		s.settings.S3BasePath,
@@ -1112,7 +2963,11 @@ func (s *Storage) primaryStateChange(p *primary, old, current int32) {
 	switch current {
 	case primaryStateWaiting:
 		s.waiting.Put(p)
+		if atomic.LoadInt32(&s.draining) != 0 {
+			go p.expire(context.Background())
+		}
 	case primaryStateComplete:
+		s.replicaLocations.remove(p.fidStr)
 		s.primariesLock.Lock()
 		defer s.primariesLock.Unlock()
 		delete(s.primaries, p.fidStr)
@@ -7,22 +7,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"bou.ke/monkey"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/liquidgecka/testlib"
 
 	"github.com/liquidgecka/blobby/internal/backoff"
 	"github.com/liquidgecka/blobby/internal/delayqueue"
 	"github.com/liquidgecka/blobby/internal/workqueue"
+	"github.com/liquidgecka/blobby/storage/blastpath"
 	"github.com/liquidgecka/blobby/storage/fid"
 )
 
@@ -33,17 +39,15 @@ func TestNew_PanicConditions(t *testing.T) {
 	ar := func(int) ([]Remote, error) {
 		return nil, nil
 	}
-	nilRead := func(ReadConfig) (io.ReadCloser, error) {
+	nilRead := func(context.Context, ReadConfig) (io.ReadCloser, error) {
 		return nil, nil
 	}
-	uploader := &s3manager.Uploader{}
 	client := &s3.S3{}
 
 	// Validate that various settings that are required generate
 	// a panic as expected.
 	T.ExpectPanic(func() {
 		New(&Settings{
-			AWSUploader:   uploader,
 			BaseDirectory: "test",
 			Compress:      true,
 			CompressLevel: 1,
@@ -56,7 +60,6 @@ func TestNew_PanicConditions(t *testing.T) {
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			BaseDirectory: "test",
 			Compress:      true,
 			CompressLevel: 1,
 			DelayQueue:    &delayqueue.DelayQueue{},
@@ -64,49 +67,82 @@ func TestNew_PanicConditions(t *testing.T) {
 			S3Bucket:      "test",
 			S3Client:      client,
 		})
-	}, "settings.AWSUploader is required.")
+	}, "settings.BaseDirectory is required.")
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			AWSUploader:   uploader,
+			BaseDirectory: "test",
 			Compress:      true,
-			CompressLevel: 1,
+			CompressLevel: -2,
 			DelayQueue:    &delayqueue.DelayQueue{},
 			Read:          nilRead,
 			S3Bucket:      "test",
 			S3Client:      client,
 		})
-	}, "settings.BaseDirectory is required.")
+	}, "settings.CompressLevel can not be less than -1.")
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			AWSUploader:   uploader,
 			BaseDirectory: "test",
 			Compress:      true,
-			CompressLevel: -2,
+			CompressLevel: 100,
 			DelayQueue:    &delayqueue.DelayQueue{},
 			Read:          nilRead,
 			S3Bucket:      "test",
 			S3Client:      client,
 		})
-	}, "settings.CompressLevel can not be less than -1.")
+	}, "settings.CompressLevel can not be greater than 9.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:     ar,
+			BaseDirectory:     "test",
+			Compress:          true,
+			CompressAlgorithm: "zstd",
+			CompressLevel:     23,
+			DelayQueue:        &delayqueue.DelayQueue{},
+			Read:              nilRead,
+			S3Bucket:          "test",
+			S3Client:          client,
+		})
+	}, "settings.CompressLevel can not be greater than 22.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:     ar,
+			BaseDirectory:     "test",
+			Compress:          true,
+			CompressAlgorithm: "unknown",
+			DelayQueue:        &delayqueue.DelayQueue{},
+			Read:              nilRead,
+			S3Bucket:          "test",
+			S3Client:          client,
+		})
+	}, "settings.CompressAlgorithm 'unknown' is not supported.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:       ar,
+			BaseDirectory:       "test",
+			Compress:            true,
+			CompressIndexFormat: "unknown",
+			DelayQueue:          &delayqueue.DelayQueue{},
+			Read:                nilRead,
+			S3Bucket:            "test",
+			S3Client:            client,
+		})
+	}, "settings.CompressIndexFormat 'unknown' is not supported.")
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			AWSUploader:   uploader,
 			BaseDirectory: "test",
-			Compress:      true,
-			CompressLevel: 100,
 			DelayQueue:    &delayqueue.DelayQueue{},
 			Read:          nilRead,
 			S3Bucket:      "test",
 			S3Client:      client,
+			SyncPolicy:    "unknown",
 		})
-	}, "settings.CompressLevel can not be greater than 9.")
+	}, "settings.SyncPolicy 'unknown' is not supported.")
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			AWSUploader:   uploader,
 			BaseDirectory: "test",
 			Compress:      true,
 			CompressLevel: 1,
@@ -118,7 +154,6 @@ func TestNew_PanicConditions(t *testing.T) {
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			AWSUploader:   uploader,
 			BaseDirectory: "test",
 			Compress:      true,
 			CompressLevel: 1,
@@ -130,7 +165,6 @@ func TestNew_PanicConditions(t *testing.T) {
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			AWSUploader:   uploader,
 			BaseDirectory: "test",
 			Compress:      true,
 			CompressLevel: 1,
@@ -142,7 +176,6 @@ func TestNew_PanicConditions(t *testing.T) {
 	T.ExpectPanic(func() {
 		New(&Settings{
 			AssignRemotes: ar,
-			AWSUploader:   uploader,
 			BaseDirectory: "test",
 			Compress:      true,
 			CompressLevel: 1,
@@ -151,6 +184,107 @@ func TestNew_PanicConditions(t *testing.T) {
 			S3Bucket:      "test",
 		})
 	}, "settings.S3Client is required.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:         ar,
+			BaseDirectory:         "test",
+			DelayQueue:            &delayqueue.DelayQueue{},
+			OpenFilesGrowthFactor: 0.5,
+			Read:                  nilRead,
+			S3Bucket:              "test",
+			S3Client:              client,
+		})
+	}, "settings.OpenFilesGrowthFactor can not be less than 1.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:       ar,
+			BaseDirectory:       "test",
+			DelayQueue:          &delayqueue.DelayQueue{},
+			OpenFilesGrowthStep: -1,
+			Read:                nilRead,
+			S3Bucket:            "test",
+			S3Client:            client,
+		})
+	}, "settings.OpenFilesGrowthStep can not be negative.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes: ar,
+			BaseDirectory: "test",
+			DelayQueue:    &delayqueue.DelayQueue{},
+			FileMode:      os.ModeSetuid | 0644,
+			Read:          nilRead,
+			S3Bucket:      "test",
+			S3Client:      client,
+		})
+	}, "settings.FileMode can only contain permission bits.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:    ar,
+			BaseDirectory:    "test",
+			DelayQueue:       &delayqueue.DelayQueue{},
+			Read:             nilRead,
+			S3Bucket:         "test",
+			S3Client:         client,
+			ShardDirectories: -1,
+		})
+	}, "settings.ShardDirectories can not be negative.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:    ar,
+			BaseDirectory:    "test",
+			DelayQueue:       &delayqueue.DelayQueue{},
+			Read:             nilRead,
+			S3Bucket:         "test",
+			S3Client:         client,
+			ShardDirectories: 257,
+		})
+	}, "settings.ShardDirectories can not be more than 256.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:      ar,
+			BaseDirectory:      "test",
+			DelayQueue:         &delayqueue.DelayQueue{},
+			InsertQueueTimeout: -1,
+			Read:               nilRead,
+			S3Bucket:           "test",
+			S3Client:           client,
+		})
+	}, "settings.InsertQueueTimeout can not be negative.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:      ar,
+			BaseDirectory:      "test",
+			DelayQueue:         &delayqueue.DelayQueue{},
+			Read:               nilRead,
+			S3Bucket:           "test",
+			S3Client:           client,
+			S3OperationTimeout: -1,
+		})
+	}, "settings.S3OperationTimeout can not be negative.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:    ar,
+			BaseDirectory:    "test",
+			Compress:         true,
+			CompressLevelMax: 10,
+			DelayQueue:       &delayqueue.DelayQueue{},
+			Read:             nilRead,
+			S3Bucket:         "test",
+			S3Client:         client,
+		})
+	}, "settings.CompressLevelMax can not be greater than 9.")
+	T.ExpectPanic(func() {
+		New(&Settings{
+			AssignRemotes:    ar,
+			BaseDirectory:    "test",
+			CompressLevelMax: 2,
+			CompressLevelMin: 3,
+			DelayQueue:       &delayqueue.DelayQueue{},
+			Read:             nilRead,
+			S3Bucket:         "test",
+			S3Client:         client,
+		})
+	}, "settings.CompressLevelMax can not be less than settings.CompressLevelMin.")
 }
 
 func TestNew(t *testing.T) {
@@ -160,16 +294,14 @@ func TestNew(t *testing.T) {
 	ar := func(int) ([]Remote, error) {
 		return nil, nil
 	}
-	nilRead := func(ReadConfig) (io.ReadCloser, error) {
+	nilRead := func(context.Context, ReadConfig) (io.ReadCloser, error) {
 		return nil, nil
 	}
-	uploader := &s3manager.Uploader{}
 	client := &s3.S3{}
 
 	// Mostly default configuration.
 	settings := &Settings{
 		AssignRemotes: ar,
-		AWSUploader:   uploader,
 		BaseDirectory: "test",
 		Compress:      true,
 		CompressLevel: -1,
@@ -185,6 +317,7 @@ func TestNew(t *testing.T) {
 	T.NotEqual(s.newFileBackOff.X, time.Duration(0))
 	T.Equal(s.settings.HeartBeatTime, defaultHeartBeatTime)
 	T.Equal(s.settings.NameSpace, "default")
+	T.Equal(s.settings.OpenFilesGrowthFactor, defaultOpenFilesGrowthFactor)
 	T.Equal(s.settings.OpenFilesMaximum, defaultOpenFilesMaximum)
 	T.Equal(s.settings.OpenFilesMinimum, defaultOpenFilesMinimum)
 	T.Equal(s.settings.UploadLargerThan, defaultUploadLargerThan)
@@ -194,7 +327,6 @@ func TestNew(t *testing.T) {
 	// Do the same but with 0 for CompressLevel
 	settings = &Settings{
 		AssignRemotes: ar,
-		AWSUploader:   uploader,
 		BaseDirectory: "test",
 		Compress:      true,
 		CompressLevel: 0,
@@ -215,6 +347,25 @@ func TestNew(t *testing.T) {
 	T.Equal(s.settings.UploadLargerThan, defaultUploadLargerThan)
 	T.Equal(s.settings.UploadOlder, defaultUploadOlder)
 	T.Equal(s.settings.CompressLevel, gzip.DefaultCompression)
+	T.Equal(s.settings.compressTuner, (*compressTuner)(nil))
+
+	// Adaptive compression starts at the highest level.
+	settings = &Settings{
+		AssignRemotes:    ar,
+		BaseDirectory:    "test",
+		Compress:         true,
+		CompressAdaptive: true,
+		DelayQueue:       &delayqueue.DelayQueue{},
+		Read:             nilRead,
+		S3Bucket:         "test",
+		S3Client:         client,
+	}
+	s = New(settings)
+	T.Equal(s.settings.CompressAdaptiveTarget, defaultCompressAdaptiveTarget)
+	T.Equal(s.settings.CompressLevelMin, gzip.BestSpeed)
+	T.Equal(s.settings.CompressLevelMax, gzip.BestCompression)
+	T.Equal(s.settings.compressLevel(), gzip.BestCompression)
+	T.Equal(s.GetMetrics().CompressLevel, int64(gzip.BestCompression))
 }
 
 func TestStorage_BlastPathStatus(t *testing.T) {
@@ -256,6 +407,103 @@ func TestStorage_BlastPathStatus(t *testing.T) {
 	T.Equal(have, want)
 }
 
+func TestStorage_BlastPathList(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := Storage{
+		primaries: map[string]*primary{
+			"p2": &primary{
+				fidStr: "p2",
+				offset: 200,
+				s3key:  "key/p2",
+				state:  primaryStateUploading,
+			},
+			"p1": &primary{
+				fidStr: "p1",
+				offset: 100,
+				s3key:  "key/p1",
+				state:  primaryStateWaiting,
+			},
+		},
+		replicas: map[string]*replica{
+			"r1": &replica{
+				fidStr:  "r1",
+				offset:  50,
+				records: recordHashes{recovered: 3},
+				s3key:   "key/r1",
+				state:   replicaStateAppending,
+			},
+		},
+		settings: Settings{S3Bucket: "bucket"},
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	T.ExpectSuccess(s.BlastPathList(buffer))
+	T.Equal(strings.Split(buffer.String(), "\n"), []string{
+		`{"fid":"p1","type":"primary","state":"waiting","size":100,` +
+			`"records":0,"s3_bucket":"bucket","s3_key":"key/p1"}`,
+		`{"fid":"p2","type":"primary","state":"uploading","size":200,` +
+			`"records":0,"s3_bucket":"bucket","s3_key":"key/p2"}`,
+		`{"fid":"r1","type":"replica","state":"appending","size":50,` +
+			`"records":3,"s3_bucket":"bucket","s3_key":"key/r1"}`,
+		``,
+	})
+
+	// Writing stops at the first error.
+	fd := T.TempFile()
+	T.ExpectSuccess(fd.Close())
+	T.ExpectError(s.BlastPathList(fd))
+}
+
+func TestStorage_BlastPathReadRanges(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := fd.WriteString("0123456789abcdefghij")
+	T.ExpectSuccess(err)
+	s := Storage{
+		primaries: map[string]*primary{
+			"test": &primary{fd: fd, fidStr: "test", offset: 20},
+		},
+	}
+
+	// Each range is returned in order as a length followed by the data.
+	content, err := s.BlastPathReadRanges("test", []blastpath.Range{
+		{Start: 10, End: 15},
+		{Start: 0, End: 2},
+		{Start: 5, End: 5},
+	})
+	T.ExpectSuccess(err)
+	have, err := io.ReadAll(content)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(content.Close())
+	T.Equal(have, []byte(""+
+		"\x00\x00\x00\x00\x00\x00\x00\x05abcde"+
+		"\x00\x00\x00\x00\x00\x00\x00\x0201"+
+		"\x00\x00\x00\x00\x00\x00\x00\x00"))
+
+	// Ranges past the end of the primary can not be served.
+	_, err = s.BlastPathReadRanges("test", []blastpath.Range{
+		{Start: 0, End: 2},
+		{Start: 15, End: 21},
+	})
+	T.ExpectErrorMessage(err, "The requested operation is not possible.")
+
+	// As are ranges that end before they start.
+	_, err = s.BlastPathReadRanges("test", []blastpath.Range{
+		{Start: 5, End: 2},
+	})
+	T.ExpectErrorMessage(err, "The range 5-2 ends before it starts.")
+
+	// Unknown fids are not found.
+	_, err = s.BlastPathReadRanges("unknown", []blastpath.Range{
+		{Start: 0, End: 2},
+	})
+	T.Equal(err, ErrNotFound("unknown"))
+}
+
 func TestStorage_DebugID(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -333,106 +581,1337 @@ S3 Desintation: s3://s3_bucket/test/path/1970-01-01/00:00:00/0/%d%s`,
 	for i := 0; i < 100; i++ {
 		test(rand.Uint64(), rand.Uint32(), true, false)
 	}
-	s.primaries = nil
+	s.primaries = nil
+
+	// Run the tests again where the file is a replicas.
+	s.replicas = map[string]*replica{
+		f.String(): &replica{state: replicaStateWaiting},
+	}
+	for i := 0; i < 100; i++ {
+		test(rand.Uint64(), rand.Uint32(), true, false)
+	}
+	s.replicas = nil
+
+	// Make sure that an invalid FID returns an error.
+	b := bytes.Buffer{}
+	s.DebugID(&b, "INVALID")
+	T.Equal(b.String(), "Invalid ID: Not a valid ID token.\n")
+}
+
+func TestStorage_ExplainID(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	formatter, err := fid.NewFormatter("%y/%L")
+	T.ExpectSuccess(err)
+	s := Storage{
+		settings: Settings{
+			NameSpace:   "NSTEST",
+			S3BasePath:  "base",
+			S3KeyFormat: formatter,
+		},
+	}
+	f := fid.FID{94, 77, 232, 154, 0, 1, 0, 0, 0, 2}
+	s.replicas = map[string]*replica{
+		f.String(): &replica{state: replicaStateWaiting},
+	}
+	info, err := s.ExplainID(f.ID(5, 6))
+	T.ExpectSuccess(err)
+	T.Equal(info, &IDInfo{
+		NameSpace:     "NSTEST",
+		FID:           f.String(),
+		Machine:       2,
+		Created:       time.Date(2020, time.February, 20, 2, 2, 2, 0, time.UTC),
+		Start:         5,
+		Length:        6,
+		S3Destination: "s3://base/2020/0000000002",
+		ReplicaState:  "waiting",
+	})
+
+	// Invalid IDs return an error.
+	_, err = s.ExplainID("INVALID")
+	T.ExpectErrorMessage(err, "Not a valid ID token.")
+}
+
+func TestStorage_SeparateDirectories(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	newStorage := func(dir string) *Storage {
+		return newStartedTestStorage(T, Settings{
+			BaseDirectory: dir,
+			UploadOlder:   time.Hour,
+		})
+	}
+	insert := func(s *Storage) string {
+		id, err := s.Insert(context.Background(), &InsertData{
+			Source: strings.NewReader("data"),
+			Length: 4,
+		})
+		T.ExpectSuccess(err)
+		f, _, _, err := fid.ParseID(id)
+		T.ExpectSuccess(err)
+		return f.String()
+	}
+	names := func(dir string) []string {
+		infos, err := os.ReadDir(dir)
+		T.ExpectSuccess(err)
+		found := []string{}
+		for _, info := range infos {
+			found = append(found, info.Name())
+		}
+		return found
+	}
+
+	// Each namespace only writes to its own directory.
+	dirA, dirB := T.TempDir(), T.TempDir()
+	a, b := newStorage(dirA), newStorage(dirB)
+	fidA, fidB := insert(a), insert(b)
+	T.NotEqual(fidA, fidB)
+	T.Equal(names(dirA), []string{fidA})
+	T.Equal(names(dirB), []string{fidB})
+
+	// After a restart each namespace only recovers the files from its own
+	// directory.
+	recoveredA, recoveredB := newStorage(dirA), newStorage(dirB)
+	T.Equal(len(recoveredA.replicas), 1)
+	T.NotEqual(recoveredA.replicas[fidA], nil)
+	T.Equal(len(recoveredB.replicas), 1)
+	T.NotEqual(recoveredB.replicas[fidB], nil)
+}
+
+func TestStorage_Drain(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newStartedTestStorage(T, Settings{
+		UploadOlder: time.Hour,
+	})
+
+	// Insert data so that there is a primary waiting for more data.
+	id, err := s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.ExpectSuccess(err)
+	f, _, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+	p := func() *primary {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		return s.primaries[f.String()]
+	}()
+	T.NotEqual(p, nil)
+
+	// Draining queues the primary for upload and new data is rejected.
+	s.Drain(context.Background())
+	T.Equal(atomic.LoadInt32(&p.state), primaryStatePendingUpload)
+	primaries, replicas := s.Pending()
+	T.Equal(primaries, 1)
+	T.Equal(replicas, 0)
+	T.Equal(s.GetMetrics().PendingPrimaries, int64(1))
+	_, err = s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.Equal(err, ErrDraining{})
+
+	// Resuming opens a new primary that accepts data again.
+	s.Resume()
+	_, err = s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.ExpectSuccess(err)
+	primaries, _ = s.Pending()
+	T.Equal(primaries, 2)
+}
+
+func TestStorage_GetMetrics(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Mock out time.Now() since we need the return value to be
+	// consistent and testable.
+	now := time.Date(2020, 12, 31, 1, 2, 3, 4, time.UTC)
+	defer monkey.Patch(
+		time.Now,
+		func() time.Time { return now },
+	).Unpatch()
+
+	// Mock out Since() so it returns a consistent value as well.
+	defer monkey.Patch(
+		time.Since,
+		func(time.Time) time.Duration { return time.Second },
+	).Unpatch()
+
+	// Setup a storage to work with.
+	s := Storage{
+		primaries: map[string]*primary{
+			// Oldest firstInsert, youngest queuedForUpload
+			"test1": &primary{
+				firstInsert: time.Date(
+					2000, 1, 2, 3, 4, 5, 6, time.UTC,
+				),
+				queuedForUpload: time.Date(
+					2020, 1, 2, 3, 4, 5, 6, time.UTC,
+				),
+				offset: 100,
+			},
+			// Youngest firstInsert, oldest queuedForUpload
+			"test2": &primary{
+				firstInsert: time.Date(
+					2020, 1, 2, 3, 4, 5, 6, time.UTC,
+				),
+				queuedForUpload: time.Date(
+					2000, 1, 2, 3, 4, 5, 6, time.UTC,
+				),
+				offset: 20,
+			},
+			// default firstInsert, defualt queuedForUpload, stuck
+			// waiting on the remotes to be deleted for a minute.
+			"test3": &primary{
+				state:        primaryStatePendingDeleteRemotes,
+				stateChanged: now.Add(-time.Minute).UnixNano(),
+			},
+		},
+		replicas: map[string]*replica{
+			// Even older queuedForUpload
+			"test2": &replica{
+				queuedForUpload: time.Date(
+					1999, 1, 2, 3, 4, 5, 6, time.UTC,
+				),
+				offset: 5,
+			},
+			// default firstInsert, defualt queuedForUpload
+			"test3": &replica{},
+		},
+	}
+
+	// Run the actual test.
+	want := s.metrics
+	want.OldestQueuedUpload = 1.0
+	want.OldestUnUploadedData = 1.0
+	want.Primaries = 3
+	want.PrimaryBytes = 120
+	want.Replicas = 2
+	want.ReplicaBytes = 5
+	want.PrimaryStateAges = stateAges(
+		make([]int64, len(primaryStateStrings)),
+		primaryStateStrings)
+	want.PrimaryStateAges[primaryStatePendingDeleteRemotes].Seconds = 60
+	want.ReplicaStateAges = stateAges(
+		make([]int64, len(replicaStateStrings)),
+		replicaStateStrings)
+	have := s.GetMetrics()
+	T.Equal(have, want)
+}
+
+func TestStateAges(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	now := time.Now()
+	oldest := make([]int64, len(replicaStateStrings))
+	oldestInState(oldest, replicaStateUploading, 0)
+	oldestInState(oldest, replicaStateUploading, now.UnixNano())
+	oldestInState(
+		oldest,
+		replicaStateUploading,
+		now.Add(-time.Hour).UnixNano())
+	oldestInState(oldest, replicaStateUploading, now.UnixNano())
+	oldestInState(oldest, int32(len(oldest)), now.UnixNano())
+	T.Equal(oldest[replicaStateUploading], now.Add(-time.Hour).UnixNano())
+
+	ages := stateAges(oldest, replicaStateStrings)
+	T.Equal(len(ages), len(replicaStateStrings))
+	for i, age := range ages {
+		T.Equal(age.State, replicaStateStrings[int32(i)])
+		if int32(i) == replicaStateUploading {
+			T.Equal(age.Seconds >= time.Hour.Seconds(), true)
+		} else {
+			T.Equal(age.Seconds, float64(0))
+		}
+	}
+}
+
+func TestStorage_Health(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Happy path, all is healthy.
+	s := Storage{
+		newFileBackOff: backoff.BackOff{
+			Max:    time.Second * 1,
+			Period: time.Second * 30,
+			X:      time.Millisecond * 100,
+		},
+		settings: Settings{UnhealthyUploadFailures: 2},
+	}
+	h, out := s.Health()
+	T.Equal(h, true)
+	T.Equal(out, ""+
+		"New file creation: SUCCEEDED\n"+
+		"S3 uploads: SUCCEEDED\n")
+
+	// A single upload failure is tolerated.
+	s.uploadFailures = 1
+	h, out = s.Health()
+	T.Equal(h, true)
+	T.Equal(out, ""+
+		"New file creation: SUCCEEDED\n"+
+		"S3 uploads: SUCCEEDED\n")
+
+	// Uploads are unhealthy once enough fail in a row.
+	s.uploadFailures = 2
+	h, out = s.Health()
+	T.Equal(h, false)
+	T.Equal(out, ""+
+		"New file creation: SUCCEEDED\n"+
+		"S3 uploads: FAILED\n")
+
+	// Upload failures are ignored when the check is disabled.
+	s.settings.UnhealthyUploadFailures = 0
+	h, out = s.Health()
+	T.Equal(h, true)
+	T.Equal(out, "New file creation: SUCCEEDED\n")
+
+	// New file creation is unhealthy.
+	s.uploadFailures = 0
+	s.newFileBackOff.Failure()
+	h, out = s.Health()
+	T.Equal(h, false)
+	T.Equal(out, "New file creation: FAILED\n")
+}
+
+func TestStorage_Insert_MaxDiskBytes(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newStartedTestStorage(T, Settings{
+		MaxDiskBytes: 15,
+	})
+
+	// Data that fits within the limit is accepted and counted.
+	_, err := s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("0123456789"),
+		Length: 10,
+	})
+	T.ExpectSuccess(err)
+	T.Equal(s.GetMetrics().DiskBytes, int64(10))
+
+	// Data that would take the usage over the limit is rejected.
+	_, err = s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("0123456789"),
+		Length: 10,
+	})
+	T.Equal(err, ErrDiskFull{})
+	T.Equal(s.GetMetrics().DiskBytes, int64(10))
+	T.Equal(s.GetMetrics().PrimaryInserts.Failures, int64(1))
+}
+
+func TestStorage_Flush(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newStartedTestStorage(T, Settings{})
+	id, err := s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.ExpectSuccess(err)
+	f, _, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	// The waiting primary is shut down and queued for upload.
+	flushed, state, err := s.Flush(context.Background(), f.String())
+	T.ExpectSuccess(err)
+	T.Equal(flushed, true)
+	T.Equal(state, "pending-upload")
+	T.Equal(s.settings.UploadWorkQueue.Len(), 1)
+
+	// Once it is no longer waiting a flush does nothing.
+	flushed, state, err = s.Flush(context.Background(), f.String())
+	T.ExpectSuccess(err)
+	T.Equal(flushed, false)
+	T.Equal(state, "pending-upload")
+	T.Equal(s.settings.UploadWorkQueue.Len(), 1)
+
+	_, _, err = s.Flush(context.Background(), "unknown")
+	T.Equal(err, ErrNotFound("unknown"))
+}
+
+func TestStorage_FileMode(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	dir := T.TempDir()
+	s := newStartedTestStorage(T, Settings{
+		BaseDirectory:         dir,
+		FileMode:              0600,
+		IdempotencyKeyPersist: true,
+		IdempotencyKeyTTL:     time.Hour,
+	})
+	id, err := s.Insert(context.Background(), &InsertData{
+		IdempotencyKey: "key",
+		Source:         strings.NewReader("data"),
+		Length:         4,
+	})
+	T.ExpectSuccess(err)
+	f, _, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+
+	// Both the data file and the idempotency keys use the mode.
+	stat, err := os.Stat(filepath.Join(dir, f.String()))
+	T.ExpectSuccess(err)
+	T.Equal(stat.Mode().Perm(), os.FileMode(0600))
+	files, err := filepath.Glob(filepath.Join(dir, idempotencyDirectory, "*"))
+	T.ExpectSuccess(err)
+	T.NotEqual(len(files), 0)
+	for _, fn := range files {
+		stat, err := os.Stat(fn)
+		T.ExpectSuccess(err)
+		T.Equal(stat.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestStorage_Insert_NoReplicas(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newStartedTestStorage(T, Settings{
+		AssignRemotes: func(r int) ([]Remote, error) {
+			T.Equal(r, 0)
+			return nil, nil
+		},
+		AsyncReplication: true,
+		HeartBeatTime:    time.Second,
+	})
+
+	id, err := s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.ExpectSuccess(err)
+	f, _, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+	p := func() *primary {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		return s.primaries[f.String()]
+	}()
+	T.NotEqual(p, nil)
+
+	// None of the replica related work should have been started.
+	T.Equal(p.heartBeatToken.InList(), false)
+	T.Equal(p.asyncQueue, (chan replicatorConfig)(nil))
+	T.Equal(len(s.replicaLocations.get(p.fidStr)), 0)
+
+	// Once the primary is finished it skips deleting from the remotes.
+	p.deleteCompressed(context.Background())
+	T.Equal(atomic.LoadInt32(&p.state), primaryStatePendingDeleteLocal)
+}
+
+func TestStorage_Read_DurableOnly(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage with a primary that contains the data locally.
+	f := fid.FID{}
+	f.Generate(1)
+	fd := T.TempFile()
+	_, err := fd.Write([]byte("0123456789"))
+	T.ExpectSuccess(err)
+	s := Storage{
+		primaries: map[string]*primary{
+			f.String(): &primary{fd: fd},
+		},
+		settings: Settings{
+			BaseLogger: NewTestLogger(),
+			MachineID:  1,
+			S3Bucket:   "bucket",
+			S3Client:   &s3.S3{},
+		},
+	}
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		start:  2,
+		length: 4,
+	}
+
+	// Patch out S3 so that the object does not exist yet.
+	inS3 := false
+	defer monkey.Patch(
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			T.Equal(*goi.Bucket, "bucket")
+			if *goi.Key == f.String()+compressIndexSuffix {
+				return nil, awserr.New(s3.ErrCodeNoSuchKey, "missing", nil)
+			}
+			T.Equal(*goi.Key, f.String())
+			T.Equal(*goi.Range, "bytes=2-5")
+			if !inS3 {
+				return nil, awserr.New(s3.ErrCodeNoSuchKey, "missing", nil)
+			}
+			length := int64(4)
+			return &s3.GetObjectOutput{
+				Body:          io.NopCloser(strings.NewReader("2345")),
+				ContentLength: &length,
+			}, nil
+		},
+	).Unpatch()
+
+	// A normal read is served from the local file.
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+	rcloser.Close()
+
+	// A durable read of local data that is not in S3 is refused.
+	rc.durable = true
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotDurable("test-id"))
+
+	// The same is true if the namespace is configured for durable reads.
+	rc.durable = false
+	s.settings.DurableReadsOnly = true
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotDurable("test-id"))
+
+	// Once the data is in S3 it is served from there.
+	inS3 = true
+	rcloser, err = s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err = io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+
+	// Durable reads are not possible on compressed name spaces unless the
+	// object has a compress index.
+	s.settings.Compress = true
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotPossible{})
+}
+
+func TestStorage_Read_DurableRetained(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage with a primary and a replica that have both been
+	// uploaded and are being retained for reads.
+	pf := fid.FID{}
+	pf.Generate(1)
+	rf := fid.FID{}
+	rf.Generate(2)
+	pfd := T.TempFile()
+	_, err := pfd.Write([]byte("0123456789"))
+	T.ExpectSuccess(err)
+	rfd := T.TempFile()
+	_, err = rfd.Write([]byte("abcdefghij"))
+	T.ExpectSuccess(err)
+	s := Storage{
+		primaries: map[string]*primary{
+			pf.String(): &primary{
+				fd:     pfd,
+				offset: 10,
+				state:  primaryStateDelayLocalDelete,
+			},
+		},
+		replicas: map[string]*replica{
+			rf.String(): &replica{
+				fd:     rfd,
+				offset: 10,
+				state:  replicaStateRetained,
+			},
+		},
+		settings: Settings{
+			BaseLogger:       NewTestLogger(),
+			DurableReadsOnly: true,
+			MachineID:        1,
+			ObjectStore:      &headObjectStore{},
+			RetainForReads:   true,
+			S3Bucket:         "bucket",
+		},
+	}
+	read := func(f fid.FID) (string, error) {
+		rc := testReadConfig{id: "test-id", fid: f, start: 2, length: 4}
+		rcloser, err := s.Read(context.Background(), &rc)
+		if err != nil {
+			return "", err
+		}
+		defer rcloser.Close()
+		data, err := io.ReadAll(rcloser)
+		return string(data), err
+	}
+
+	// Both files serve durable reads locally.
+	data, err := read(pf)
+	T.ExpectSuccess(err)
+	T.Equal(data, "2345")
+	data, err = read(rf)
+	T.ExpectSuccess(err)
+	T.Equal(data, "cdef")
+	T.Equal(s.GetMetrics().RetainedBytes, uint64(20))
+
+	// Files that have not been uploaded yet must still be read from S3.
+	s.replicas[rf.String()].state = replicaStateUploading
+	_, err = read(rf)
+	T.ExpectErrorMessage(err, "not implemented")
+	T.Equal(s.GetMetrics().RetainedBytes, uint64(10))
+
+	// As must retained files if RetainForReads is not enabled.
+	s.settings.RetainForReads = false
+	_, err = read(pf)
+	T.ExpectErrorMessage(err, "not implemented")
+}
+
+func TestStorage_Read_ReadInfo(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage with a local primary for the file, and the same data
+	// in S3.
+	f := fid.FID{}
+	f.Generate(1)
+	fd := T.TempFile()
+	_, err := fd.Write([]byte("0123456789"))
+	T.ExpectSuccess(err)
+	s := Storage{
+		primaries: map[string]*primary{
+			f.String(): &primary{fd: fd, offset: 10},
+		},
+		replicas: map[string]*replica{},
+		settings: Settings{
+			BaseLogger:  NewTestLogger(),
+			MachineID:   1,
+			ObjectStore: memoryObjectStore{f.String(): []byte("0123456789")},
+			S3Bucket:    "bucket",
+		},
+	}
+	read := func() (*ReadInfo, string) {
+		info := &ReadInfo{}
+		rc := testReadConfig{id: "test-id", fid: f, start: 2, length: 4}
+		ctx := NewReadInfoContext(context.Background(), info)
+		rcloser, err := s.Read(ctx, &rc)
+		T.ExpectSuccess(err)
+		data, err := io.ReadAll(rcloser)
+		T.ExpectSuccess(err)
+		T.ExpectSuccess(rcloser.Close())
+		return info, string(data)
+	}
+
+	// The local file serves the read.
+	info, data := read()
+	T.Equal(data, "2345")
+	T.Equal(*info, ReadInfo{Source: ReadSourceLocal, BytesServed: 4})
+
+	// Once the local file is gone the read comes from S3.
+	delete(s.primaries, f.String())
+	info, data = read()
+	T.Equal(data, "2345")
+	T.Equal(*info, ReadInfo{Source: ReadSourceS3, BytesServed: 4})
+	T.Equal(s.GetMetrics().ReadSources.Local, int64(1))
+	T.Equal(s.GetMetrics().ReadSources.S3, int64(1))
+
+	// Failed reads do not record a source.
+	info = &ReadInfo{}
+	rc := testReadConfig{id: "test-id", fid: f, start: 20, length: 4}
+	s.settings.ObjectStore = memoryObjectStore{}
+	ctx := NewReadInfoContext(context.Background(), info)
+	_, err = s.Read(ctx, &rc)
+	T.Equal(err, ErrNotFound("test-id"))
+	T.Equal(*info, ReadInfo{})
+}
+
+func TestStorage_Read_StaleOnS3Error(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage where the data for the fid is still on disk but is
+	// no longer tracked as a primary, as happens while the file is working
+	// its way through the DelayDelete process.
+	f := fid.FID{}
+	f.Generate(1)
+	dir := T.TempDir()
+	err := os.WriteFile(
+		filepath.Join(dir, f.String()),
+		[]byte("0123456789"),
+		0644)
+	T.ExpectSuccess(err)
+	s := Storage{
+		primaries: map[string]*primary{},
+		replicas:  map[string]*replica{},
+		settings: Settings{
+			BaseDirectory:       dir,
+			BaseLogger:          NewTestLogger(),
+			MachineID:           1,
+			S3Bucket:            "bucket",
+			S3Client:            &s3.S3{},
+			StaleReadsOnS3Error: true,
+		},
+	}
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		start:  2,
+		length: 4,
+	}
+
+	// Patch out S3 so that it always fails.
+	s3Err := awserr.New("InternalError", "S3 is down", nil)
+	defer monkey.Patch(
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			return nil, s3Err
+		},
+	).Unpatch()
+
+	// The local file should be used to serve the request.
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+	rcloser.Close()
+
+	// The same works for replica files left on disk.
+	T.ExpectSuccess(os.Rename(
+		filepath.Join(dir, f.String()),
+		filepath.Join(dir, "r-"+f.String())))
+	rcloser, err = s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err = io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+	rcloser.Close()
+
+	// With the option disabled the S3 error is returned.
+	s.settings.StaleReadsOnS3Error = false
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, s3Err)
+
+	// And if the file is no longer on disk the error is returned too.
+	s.settings.StaleReadsOnS3Error = true
+	T.ExpectSuccess(os.Remove(filepath.Join(dir, "r-"+f.String())))
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, s3Err)
+}
+
+func TestStorage_Read_AdditionalKeyFormats(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage that has no local copy of the data and is configured
+	// with an additional key format.
+	f := fid.FID{}
+	f.Generate(1)
+	additional, err := fid.NewFormatter("new/%L-%K")
+	T.ExpectSuccess(err)
+	s := Storage{
+		primaries: map[string]*primary{},
+		replicas:  map[string]*replica{},
+		settings: Settings{
+			BaseLogger:             NewTestLogger(),
+			MachineID:              1,
+			S3AdditionalKeyFormats: []*fid.Formatter{additional},
+			S3Bucket:               "bucket",
+			S3Client:               &s3.S3{},
+		},
+	}
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		start:  2,
+		length: 4,
+	}
+
+	// Patch out S3 so that the object only exists under the keys that
+	// are in the objects map.
+	objects := map[string]string{}
+	requested := []string{}
+	defer monkey.Patch(
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			requested = append(requested, *goi.Key)
+			data, ok := objects[*goi.Key]
+			if !ok {
+				return nil, awserr.New(s3.ErrCodeNoSuchKey, "missing", nil)
+			}
+			length := int64(len(data))
+			return &s3.GetObjectOutput{
+				Body:          io.NopCloser(strings.NewReader(data)),
+				ContentLength: &length,
+			}, nil
+		},
+	).Unpatch()
+
+	// Only written under the primary key format.
+	objects[f.String()] = "2345"
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+	T.Equal(requested, []string{f.String()})
+
+	// Only written under the additional key format.
+	delete(objects, f.String())
+	objects[additional.Format(f)] = "2345"
+	requested = nil
+	rcloser, err = s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err = io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+	T.Equal(requested, []string{f.String(), additional.Format(f)})
+
+	// Not written under either.
+	delete(objects, additional.Format(f))
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotFound("test-id"))
+}
+
+func TestStorage_Read_CompressIndex(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage that has no local copy of the data and compresses
+	// its objects in S3.
+	f := fid.FID{}
+	f.Generate(1)
+	s := Storage{
+		primaries: map[string]*primary{},
+		replicas:  map[string]*replica{},
+		settings: Settings{
+			BaseLogger: NewTestLogger(),
+			Compress:   true,
+			MachineID:  1,
+			S3Bucket:   "bucket",
+			S3Client:   &s3.S3{},
+		},
+	}
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		start:  6,
+		length: 5,
+	}
+
+	// Generate the compressed object and its index.
+	buffer := bytes.Buffer{}
+	index, err := compressData(
+		&buffer,
+		strings.NewReader("0123456789abcdef"),
+		gzipCompressor{},
+		gzip.DefaultCompression,
+		16,
+		4)
+	T.ExpectSuccess(err)
+	encoded, err := index.encode(CompressIndexFormatBinary)
+	T.ExpectSuccess(err)
+
+	// Patch out S3 so that it serves ranges of the objects in the map.
+	objects := map[string][]byte{}
+	ranges := []string{}
+	defer monkey.Patch(
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			data, ok := objects[*goi.Key]
+			if !ok {
+				return nil, awserr.New(s3.ErrCodeNoSuchKey, "missing", nil)
+			}
+			if goi.Range != nil {
+				ranges = append(ranges, *goi.Range)
+				start, end := 0, len(data)-1
+				fmt.Sscanf(*goi.Range, "bytes=%d-%d", &start, &end)
+				data = data[start : end+1]
+			}
+			length := int64(len(data))
+			return &s3.GetObjectOutput{
+				Body:          io.NopCloser(bytes.NewReader(data)),
+				ContentLength: &length,
+			}, nil
+		},
+	).Unpatch()
+
+	// Without an index the read is not possible.
+	objects[f.String()] = buffer.Bytes()
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotPossible{})
+	T.Equal(len(ranges), 0)
+
+	// With the index the read only fetches the streams holding the data.
+	objects[f.String()+compressIndexSuffix] = encoded
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(rcloser.Close())
+	T.Equal(string(data), "6789a")
+	T.Equal(ranges, []string{fmt.Sprintf(
+		"bytes=%d-%d",
+		index.Checkpoints[1].Compressed,
+		index.Checkpoints[3].Compressed-1)})
+
+	// Reading through to the end of the object fetches the remainder.
+	ranges = nil
+	rc.start = 13
+	rc.length = 3
+	rcloser, err = s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err = io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "def")
+	T.Equal(ranges, []string{fmt.Sprintf(
+		"bytes=%d-",
+		index.Checkpoints[3].Compressed)})
+}
+
+// An ObjectStore that keeps objects in a map.
+type memoryObjectStore map[string][]byte
+
+func (m memoryObjectStore) Put(
+	ctx context.Context,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	contentType string,
+	metadata map[string]string,
+) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m[key] = data
+	return nil
+}
+
+func (m memoryObjectStore) GetRange(
+	ctx context.Context,
+	key string,
+	offset int64,
+	length int64,
+	etag string,
+) (
+	io.ReadCloser,
+	error,
+) {
+	data, ok := m[key]
+	if !ok {
+		return nil, ErrNotFound(key)
+	}
+	data = data[offset:]
+	if length >= 0 {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m memoryObjectStore) Head(
+	ctx context.Context,
+	key string,
+) (
+	*ObjectInfo,
+	error,
+) {
+	data, ok := m[key]
+	if !ok {
+		return nil, ErrNotFound(key)
+	}
+	return &ObjectInfo{Size: int64(len(data))}, nil
+}
+
+func (m memoryObjectStore) Delete(ctx context.Context, key string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestStorage_Delete(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage with an uploaded primary and a replica that is being
+	// retained for reads.
+	pf := fid.FID{}
+	pf.Generate(1)
+	rf := fid.FID{}
+	rf.Generate(2)
+	additional, err := fid.NewFormatter("extra/%F")
+	T.ExpectSuccess(err)
+	objects := memoryObjectStore{}
+	settings := Settings{
+		BaseLogger:             NewTestLogger(),
+		Compress:               true,
+		DelayDelete:            time.Hour,
+		DelayQueue:             &delayqueue.DelayQueue{},
+		DeleteLocalWorkQueue:   workqueue.New(0),
+		MachineID:              1,
+		ObjectStore:            objects,
+		S3AdditionalKeyFormats: []*fid.Formatter{additional},
+		S3Bucket:               "bucket",
+	}
+	s := Storage{
+		primaries: map[string]*primary{
+			pf.String(): &primary{
+				state:     primaryStateWaiting,
+				uploadKey: "custom/" + pf.String(),
+			},
+		},
+		replicas: map[string]*replica{
+			rf.String(): &replica{
+				fidStr:   rf.String(),
+				log:      NewTestLogger(),
+				settings: &settings,
+				state:    replicaStateRetained,
+			},
+		},
+		settings: settings,
+	}
+	pid := pf.ID(0, 10)
+	rid := rf.ID(0, 10)
+
+	// Invalid IDs are rejected.
+	T.Equal(s.Delete(context.Background(), "invalid"), ErrInvalidID{})
+
+	// Files that are still being written can not be deleted.
+	T.Equal(s.Delete(context.Background(), pid), ErrFileInUse(pf.String()))
+
+	// Once uploaded the object is removed from every key, along with its
+	// compress index.
+	s.primaries[pf.String()].state = primaryStateComplete
+	objects[pf.String()] = []byte("data")
+	objects[pf.String()+compressIndexSuffix] = []byte("index")
+	objects["custom/"+pf.String()] = []byte("data")
+	objects[additional.Format(pf)] = []byte("data")
+	objects[rf.String()] = []byte("data")
+	T.ExpectSuccess(s.Delete(context.Background(), pid))
+	T.Equal(objects, memoryObjectStore{rf.String(): []byte("data")})
+
+	// Deleting it again finds nothing.
+	T.Equal(s.Delete(context.Background(), pid), ErrNotFound(pid))
+
+	// A retained replica is queued for delete right away.
+	T.ExpectSuccess(s.Delete(context.Background(), rid))
+	T.Equal(len(objects), 0)
+	T.Equal(
+		atomic.LoadInt32(&s.replicas[rf.String()].state),
+		replicaStatePendingDelete)
+	T.Equal(settings.DeleteLocalWorkQueue.Len(), 1)
+}
 
-	// Run the tests again where the file is a replicas.
-	s.replicas = map[string]*replica{
-		f.String(): &replica{state: replicaStateWaiting},
+func TestStorage_Read_FullDecompress(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a storage that has no local copy of the data and compresses
+	// its objects in S3 without an index.
+	f := fid.FID{}
+	f.Generate(1)
+	additional, err := fid.NewFormatter("extra/%F")
+	T.ExpectSuccess(err)
+	objects := memoryObjectStore{}
+	s := Storage{
+		primaries: map[string]*primary{},
+		replicas:  map[string]*replica{},
+		settings: Settings{
+			BaseLogger:             NewTestLogger(),
+			Compress:               true,
+			MachineID:              1,
+			ObjectStore:            objects,
+			S3AdditionalKeyFormats: []*fid.Formatter{additional},
+			S3Bucket:               "bucket",
+		},
 	}
-	for i := 0; i < 100; i++ {
-		test(rand.Uint64(), rand.Uint32(), true, false)
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		start:  6,
+		length: 5,
 	}
-	s.replicas = nil
+	buffer := bytes.Buffer{}
+	_, err = compressData(
+		&buffer,
+		strings.NewReader("0123456789abcdef"),
+		gzipCompressor{},
+		gzip.DefaultCompression,
+		16,
+		4)
+	T.ExpectSuccess(err)
+	objects[additional.Format(f)] = buffer.Bytes()
 
-	// Make sure that an invalid FID returns an error.
-	b := bytes.Buffer{}
-	s.DebugID(&b, "INVALID")
-	T.Equal(b.String(), "Invalid ID: Not a valid ID token.\n")
+	// By default the read is not possible.
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotPossible{})
+
+	// Once allowed the object is decompressed to find the data, even if it
+	// is only stored under an additional key.
+	s.settings.AllowFullDecompressReads = true
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(rcloser.Close())
+	T.Equal(string(data), "6789a")
+
+	// The index is still preferred if one exists.
+	index := &compressIndex{Interval: 4}
+	objects[f.String()+compressIndexSuffix], err = index.encode(
+		CompressIndexFormatBinary)
+	T.ExpectSuccess(err)
+	objects[f.String()] = []byte("not gzip data")
+	_, err = s.Read(context.Background(), &rc)
+	T.ExpectErrorMessage(err, "gzip: invalid header")
+
+	// Objects that do not exist at all are not found.
+	delete(objects, f.String())
+	delete(objects, f.String()+compressIndexSuffix)
+	delete(objects, additional.Format(f))
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotFound("test-id"))
 }
 
-func TestStorage_GetMetrics(t *testing.T) {
+func TestStorage_Read_Gzip(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
 
-	// Mock out time.Now() since we need the return value to be
-	// consistent and testable.
-	now := time.Date(2020, 12, 31, 1, 2, 3, 4, time.UTC)
+	// Setup a storage that has no local copy of the data and compresses
+	// its objects in S3.
+	f := fid.FID{}
+	f.Generate(1)
+	s := Storage{
+		primaries: map[string]*primary{},
+		replicas:  map[string]*replica{},
+		settings: Settings{
+			BaseLogger: NewTestLogger(),
+			Compress:   true,
+			MachineID:  1,
+			S3Bucket:   "bucket",
+			S3Client:   &s3.S3{},
+		},
+	}
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		length: 16,
+		gzip:   true,
+	}
+	buffer := bytes.Buffer{}
+	_, err := compressData(
+		&buffer,
+		strings.NewReader("0123456789abcdef"),
+		gzipCompressor{},
+		gzip.DefaultCompression,
+		16,
+		0)
+	T.ExpectSuccess(err)
+
+	// Patch out S3 so that it serves the object with the given metadata.
+	metadata := map[string]*string{}
+	etag := `"etag"`
 	defer monkey.Patch(
-		time.Now,
-		func() time.Time { return now },
+		(*s3.S3).HeadObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			hoi *s3.HeadObjectInput,
+			_ ...request.Option,
+		) (*s3.HeadObjectOutput, error) {
+			T.Equal(*hoi.Key, f.String())
+			return &s3.HeadObjectOutput{ETag: &etag, Metadata: metadata}, nil
+		},
 	).Unpatch()
-
-	// Mock out Since() so it returns a consistent value as well.
 	defer monkey.Patch(
-		time.Since,
-		func(time.Time) time.Duration { return time.Second },
+		(*s3.S3).GetObjectWithContext,
+		func(
+			_ *s3.S3,
+			_ aws.Context,
+			goi *s3.GetObjectInput,
+			_ ...request.Option,
+		) (*s3.GetObjectOutput, error) {
+			T.Equal(goi.Range, (*string)(nil))
+			T.Equal(*goi.IfMatch, etag)
+			return &s3.GetObjectOutput{
+				Body: io.NopCloser(bytes.NewReader(buffer.Bytes())),
+			}, nil
+		},
 	).Unpatch()
 
-	// Setup a storage to work with.
+	// Objects that were uploaded without the uncompressed length can not
+	// be served compressed.
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotPossible{})
+
+	// With the length the raw object is returned.
+	metadata = aws.StringMap(compressedMetadata(&s.settings, 16))
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	encoded, ok := rcloser.(*EncodedReadCloser)
+	T.Equal(ok, true)
+	T.Equal(encoded.ContentEncoding, "gzip")
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(data, buffer.Bytes())
+
+	// An ID that only covers part of the object is still not possible.
+	rc.length = 15
+	_, err = s.Read(context.Background(), &rc)
+	T.Equal(err, ErrNotPossible{})
+}
+
+func TestStorage_Read_LocalCompressed(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Setup a primary that has been compressed and is waiting to be
+	// uploaded, but whose uncompressed file has been removed.
+	f := fid.FID{}
+	f.Generate(1)
+	fd := T.TempFile()
+	T.ExpectSuccess(os.Remove(fd.Name()))
+	compressFd := T.TempFile()
+	index, err := compressData(
+		compressFd,
+		strings.NewReader("0123456789abcdef"),
+		gzipCompressor{},
+		gzip.DefaultCompression,
+		16,
+		4)
+	T.ExpectSuccess(err)
+	p := &primary{
+		compressFd:    compressFd,
+		compressIndex: index,
+		fd:            fd,
+		state:         primaryStatePendingUpload,
+	}
 	s := Storage{
 		primaries: map[string]*primary{
-			// Oldest firstInsert, youngest queuedForUpload
-			"test1": &primary{
-				firstInsert: time.Date(
-					2000, 1, 2, 3, 4, 5, 6, time.UTC,
-				),
-				queuedForUpload: time.Date(
-					2020, 1, 2, 3, 4, 5, 6, time.UTC,
-				),
-			},
-			// Youngest firstInsert, oldest queuedForUpload
-			"test2": &primary{
-				firstInsert: time.Date(
-					2020, 1, 2, 3, 4, 5, 6, time.UTC,
-				),
-				queuedForUpload: time.Date(
-					2000, 1, 2, 3, 4, 5, 6, time.UTC,
-				),
-			},
-			// default firstInsert, defualt queuedForUpload
-			"test3": &primary{},
+			f.String(): p,
 		},
-		replicas: map[string]*replica{
-			// Even older queuedForUpload
-			"test2": &replica{
-				queuedForUpload: time.Date(
-					1999, 1, 2, 3, 4, 5, 6, time.UTC,
-				),
-			},
-			// default firstInsert, defualt queuedForUpload
-			"test3": &replica{},
+		replicas: map[string]*replica{},
+		settings: Settings{
+			BaseLogger: NewTestLogger(),
+			Compress:   true,
+			MachineID:  1,
 		},
 	}
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		start:  6,
+		length: 5,
+	}
 
-	// Run the actual test.
-	want := s.metrics
-	want.OldestQueuedUpload = 1.0
-	want.OldestUnUploadedData = 1.0
-	have := s.GetMetrics()
-	T.Equal(have, want)
+	// The read is served from the compressed file using the index.
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(rcloser.Close())
+	T.Equal(string(data), "6789a")
+	T.Equal(s.GetMetrics().ReadSources.Local, int64(1))
+
+	// Without an index the file is decompressed from the start.
+	p.compressIndex = nil
+	rcloser, err = s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	data, err = io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(rcloser.Close())
+	T.Equal(string(data), "6789a")
+
+	// The compressed file is only used once it has been fully written.
+	p.state = primaryStateCompressing
+	fn, _, _ := s.localCompressed(f.String())
+	T.Equal(fn, "")
+	p.state = primaryStateUploading
+	fn, _, source := s.localCompressed(f.String())
+	T.Equal(fn, compressFd.Name())
+	T.Equal(source, LocationPrimary)
+
+	// Replicas are checked as well.
+	delete(s.primaries, f.String())
+	s.replicas[f.String()] = &replica{
+		compressFd: compressFd,
+		state:      replicaStateRetained,
+	}
+	fn, _, source = s.localCompressed(f.String())
+	T.Equal(fn, compressFd.Name())
+	T.Equal(source, LocationReplica)
+	s.replicas[f.String()].quarantined = 1
+	fn, _, _ = s.localCompressed(f.String())
+	T.Equal(fn, "")
 }
 
-func TestStorage_Health(t *testing.T) {
+func TestStorage_Read_OpenFileDeleted(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
 
-	// Happy path, all is healthy.
+	// Setup a storage with a primary that holds the data for the fid.
+	f := fid.FID{}
+	f.Generate(1)
+	fd := T.TempFile()
+	_, err := fd.Write([]byte("0123456789"))
+	T.ExpectSuccess(err)
+	p := &primary{fd: fd}
 	s := Storage{
-		newFileBackOff: backoff.BackOff{
-			Max:    time.Second * 1,
-			Period: time.Second * 30,
-			X:      time.Millisecond * 100,
+		primaries: map[string]*primary{
+			f.String(): p,
+		},
+		replicas: map[string]*replica{},
+		settings: Settings{
+			BaseLogger:       NewTestLogger(),
+			MachineID:        1,
+			ReadFromOpenFile: true,
 		},
 	}
-	h, out := s.Health()
-	T.Equal(h, true)
-	T.Equal(out, "New file creation: SUCCEEDED\n")
+	rc := testReadConfig{
+		id:     "test-id",
+		fid:    f,
+		start:  2,
+		length: 4,
+	}
 
-	// New file creation is unhealthy.
-	s.newFileBackOff.Failure()
-	h, out = s.Health()
-	T.Equal(h, false)
-	T.Equal(out, "New file creation: FAILED\n")
+	// Start a read and then delete the file out from underneath it the
+	// same way that deleteLocal() does.
+	rcloser, err := s.Read(context.Background(), &rc)
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(os.Remove(fd.Name()))
+	T.ExpectSuccess(p.fdRefs.close(p.fd))
+	p.fd = nil
+
+	// The read should still be able to complete since it holds a reference
+	// to the open file.
+	data, err := io.ReadAll(rcloser)
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "2345")
+
+	// Once the read is closed the file descriptor is closed as well.
+	T.ExpectSuccess(rcloser.Close())
+	_, err = fd.Stat()
+	T.ExpectError(err)
 }
 
 func TestStorage_ReplicaHeartBeat(t *testing.T) {
@@ -477,6 +1956,60 @@ func TestStorage_ReplicaHeartBeat(t *testing.T) {
 	T.Equal(s.metrics.ReplicaHeartBeats.Successes, int64(1))
 }
 
+func TestStorage_ReplicaInitialize_Existing(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A replica that already exists for the fid being initialized.
+	f := fid.FID{}
+	f.Generate(1)
+	r := replica{
+		fidStr:  f.String(),
+		log:     NewTestLogger(),
+		state:   replicaStateWaiting,
+		storage: &Storage{},
+	}
+	s := Storage{
+		replicas: map[string]*replica{
+			f.String(): &r,
+		},
+		settings: Settings{
+			BaseDirectory: T.TempDir(),
+			BaseLogger:    NewTestLogger(),
+			DelayQueue:    &delayqueue.DelayQueue{},
+			HeartBeatTime: time.Minute,
+		},
+	}
+	r.settings = &s.settings
+	s.settings.DelayQueue.Start()
+	defer s.settings.DelayQueue.Stop()
+
+	// By default initializing an existing replica is an error.
+	T.ExpectErrorMessage(
+		s.ReplicaInitialize(context.Background(), f.String()),
+		"Can not initialize '"+f.String()+"' in namespace '', it already "+
+			"exists.")
+	T.Equal(s.metrics.ReplicaInitializes.Failures, int64(1))
+
+	// If configured then it succeeds and resets the heart beat timer.
+	s.settings.IdempotentReplicaInitialize = true
+	T.ExpectSuccess(s.ReplicaInitialize(context.Background(), f.String()))
+	T.Equal(s.metrics.ReplicaInitializes.Successes, int64(1))
+	T.NotEqual(r.heartBeatLast, time.Time{})
+	T.Equal(s.replicas[f.String()], &r)
+
+	// The same is true while the replica is appending data.
+	r.state = replicaStateAppending
+	T.ExpectSuccess(s.ReplicaInitialize(context.Background(), f.String()))
+	T.Equal(s.metrics.ReplicaInitializes.Successes, int64(2))
+
+	// But a replica that is no longer accepting data is a conflict.
+	r.state = replicaStateUploading
+	T.ExpectError(s.ReplicaInitialize(context.Background(), f.String()))
+	T.Equal(s.metrics.ReplicaInitializes.Failures, int64(2))
+	T.Equal(s.replicas[f.String()], &r)
+}
+
 func TestStorage_ReplicaQueueDelete(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -546,20 +2079,206 @@ func TestStorage_Status(t *testing.T) {
 		},
 	}
 	b := bytes.Buffer{}
-	s.Status(&b)
+	s.Status(&b, StatusFormatText)
 	T.Equal(b.String(), strings.Join([]string{
 		"    Primaries:",
-		"         state=new size=0B",
-		"         state=new size=0B",
-		"         state=new size=0B",
-		"         state=new size=0B",
+		"         state=new size=0B records=0",
+		"         state=new size=0B records=0",
+		"         state=new size=0B records=0",
+		"         state=new size=0B records=0",
 		"    Replicas:",
-		"         state=new size=0B",
-		"         state=new size=0B",
+		"         state=new size=0B records=0",
+		"         state=new size=0B records=0",
 		""},
 		"\n"))
 }
 
+func TestStorage_Status_JSON(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	settings := Settings{StatusUploadFailures: true}
+	s := Storage{
+		primaries: map[string]*primary{
+			"a": &primary{
+				fidStr:   "a",
+				offset:   10,
+				settings: &settings,
+				remotes: []Remote{
+					&testRemote{name: "rem1"},
+					&testRemote{name: "rem2"},
+				},
+			},
+			"b": &primary{
+				fidStr:         "b",
+				state:          primaryStatePendingUpload,
+				settings:       &settings,
+				uploadFailures: 2,
+			},
+		},
+		replicas: map[string]*replica{
+			"c": &replica{
+				fidStr:   "c",
+				state:    replicaStateWaiting,
+				offset:   5,
+				records:  recordHashes{recovered: -1},
+				settings: &settings,
+			},
+		},
+	}
+	b := bytes.Buffer{}
+	s.Status(&b, StatusFormatJSON)
+	status := NameSpaceStatus{}
+	T.ExpectSuccess(json.Unmarshal(b.Bytes(), &status))
+	T.Equal(status, NameSpaceStatus{
+		Primaries: []FileStatus{
+			{
+				FID:     "a",
+				State:   "new",
+				Size:    10,
+				Remotes: []string{"rem1", "rem2"},
+			},
+			{
+				FID:            "b",
+				State:          "pending-upload",
+				UploadFailures: 2,
+			},
+		},
+		Replicas: []FileStatus{
+			{
+				FID:     "c",
+				State:   "waiting",
+				Size:    5,
+				Records: -1,
+			},
+		},
+	})
+
+	// Empty namespaces still produce arrays.
+	s = Storage{}
+	b.Reset()
+	s.Status(&b, StatusFormatJSON)
+	T.Equal(
+		b.String(),
+		`{"primaries":[],"read_only":false,"replicas":[]}`+"\n")
+}
+
+func TestStorage_SetUploadThresholds(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newStartedTestStorage(T, Settings{
+		UploadLargerThan:        100,
+		UploadLargerThanMinimum: 10,
+		UploadLargerThanMaximum: 1000,
+		UploadOlder:             time.Hour,
+		UploadOlderMinimum:      time.Minute,
+	})
+	insert := func() *primary {
+		id, err := s.Insert(context.Background(), &InsertData{
+			Source: strings.NewReader("data"),
+			Length: 4,
+		})
+		T.ExpectSuccess(err)
+		f, _, _, err := fid.ParseID(id)
+		T.ExpectSuccess(err)
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		return s.primaries[f.String()]
+	}
+
+	// The thresholds start as the configured values.
+	largerThan, older := s.UploadThresholds()
+	T.Equal(largerThan, uint64(100))
+	T.Equal(older, time.Hour)
+	p1 := insert()
+	T.Equal(p1.uploadLargerThan, uint64(100))
+	expires := p1.expires
+	T.Equal(time.Unix(0, expires).After(time.Now().Add(time.Minute)), true)
+
+	// Values outside of the limits are rejected, unset limits default to
+	// the configured value.
+	T.Equal(
+		s.SetUploadThresholds(1001, time.Hour),
+		ErrOutOfRange("The upload size must be between 10 and 1000 bytes."))
+	T.Equal(
+		s.SetUploadThresholds(100, time.Hour*2),
+		ErrOutOfRange("The upload age must be between 1m0s and 1h0m0s."))
+	largerThan, older = s.UploadThresholds()
+	T.Equal(largerThan, uint64(100))
+	T.Equal(older, time.Hour)
+
+	// The status only reports the thresholds once they are changed.
+	buffer := bytes.Buffer{}
+	s.Status(&buffer, StatusFormatJSON)
+	status := NameSpaceStatus{}
+	T.ExpectSuccess(json.Unmarshal(buffer.Bytes(), &status))
+	T.Equal(status.UploadLargerThan, uint64(0))
+	T.ExpectSuccess(s.SetUploadThresholds(10, time.Minute))
+	buffer.Reset()
+	s.Status(&buffer, StatusFormatJSON)
+	status = NameSpaceStatus{}
+	T.ExpectSuccess(json.Unmarshal(buffer.Bytes(), &status))
+	T.Equal(status.UploadLargerThan, uint64(10))
+	T.Equal(status.UploadOlder, float64(60))
+	buffer.Reset()
+	s.Status(&buffer, StatusFormatText)
+	line := "    Uploading new primaries larger than 10B or older than 1m0s.\n"
+	T.Equal(strings.HasPrefix(buffer.String(), line), true)
+
+	// The primary that is already open keeps its thresholds while new
+	// primaries use the new ones.
+	T.Equal(p1.uploadLargerThan, uint64(100))
+	T.Equal(p1.expires, expires)
+	flushed, _, err := s.Flush(context.Background(), p1.fidStr)
+	T.ExpectSuccess(err)
+	T.Equal(flushed, true)
+	p2 := insert()
+	T.NotEqual(p2, p1)
+	T.Equal(p2.uploadLargerThan, uint64(10))
+	T.Equal(time.Unix(0, p2.expires).After(time.Now().Add(time.Minute)), false)
+}
+
+func TestStorage_RotateEvery(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := newStartedTestStorage(T, Settings{
+		RotateEvery: time.Millisecond * 200,
+		UploadOlder: time.Hour,
+	})
+
+	// Insert data so that a primary is opened.
+	id, err := s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.ExpectSuccess(err)
+	f, _, _, err := fid.ParseID(id)
+	T.ExpectSuccess(err)
+	p := func() *primary {
+		s.primariesLock.Lock()
+		defer s.primariesLock.Unlock()
+		return s.primaries[f.String()]
+	}()
+	T.NotEqual(p, nil)
+
+	// The primary should expire at the next boundary rather than after
+	// UploadOlder.
+	T.Equal(p.rotateAt.Truncate(s.settings.RotateEvery), p.rotateAt)
+	T.Equal(p.expires, p.rotateAt.UnixNano())
+	T.Equal(p.rotateAt.After(time.Now().Add(time.Minute)), false)
+
+	// Once the boundary is reached the primary should be queued for
+	// upload.
+	T.TryUntil(
+		func() bool {
+			return atomic.LoadInt32(&p.state) == primaryStatePendingUpload
+		},
+		time.Second)
+	T.Equal(time.Now().Before(p.rotateAt), false)
+}
+
 func TestStorage_Start(t *testing.T) {
 	T := testlib.NewT(t)
 	defer T.Finish()
@@ -598,6 +2317,13 @@ func TestStorage_Start(t *testing.T) {
 		// And a directory.
 		T.ExpectSuccess(os.Mkdir(filepath.Join(dir, "directory"), 0755))
 
+		// And compressed files left behind by each algorithm.
+		for _, ext := range []string{".gz", ".zst"} {
+			fd, err := os.Create(filepath.Join(dir, expected[1]+ext))
+			T.ExpectSuccess(err)
+			T.ExpectSuccess(fd.Close())
+		}
+
 		// Create a stub Storage object.
 		s := Storage{
 			settings: Settings{
@@ -650,6 +2376,12 @@ func TestStorage_Start(t *testing.T) {
 			T.NotEqual(s.replicas[fidStr].fd, nil)
 			T.NotEqual(s.replicas[fidStr].log, nil)
 		}
+
+		// The left over compressed files should have been removed.
+		for _, ext := range []string{".gz", ".zst"} {
+			_, err := os.Stat(filepath.Join(dir, expected[1]+ext))
+			T.Equal(os.IsNotExist(err), true)
+		}
 	}
 
 	// Run the test with compression and without
@@ -808,3 +2540,283 @@ func TestStorage_PrimaryStateChange(t *testing.T) {
 		runTest(s, primaryStateComplete, false, true)
 	}
 }
+
+func TestStorage_CheckIdleFiles_PoolExhausted(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	s := Storage{
+		appendablePrimaries: 2,
+		settings: Settings{
+			OpenFilesMinimum: 1,
+			OpenFilesMaximum: 2,
+		},
+	}
+
+	// Nothing is counted if nobody is waiting for a primary.
+	s.checkIdleFiles()
+	T.Equal(s.GetMetrics().PrimaryPoolExhausted, int64(0))
+
+	// A caller waiting while the pool is full is counted.
+	s.waiting.waiting = 1
+	s.checkIdleFiles()
+	m := s.GetMetrics()
+	T.Equal(m.PrimaryPoolAppendable, int64(2))
+	T.Equal(m.PrimaryPoolMaximum, int64(2))
+	T.Equal(m.PrimaryPoolExhausted, int64(1))
+	T.Equal(atomic.LoadInt32(&s.appendablePrimaries), int32(2))
+}
+
+func TestStorage_OpenFilesThreshold(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Returns true if checkIdleFiles would open a new primary with the
+	// given number of primaries open and callers waiting.
+	opens := func(s *Storage, open int32, waiting int) bool {
+		return float64(waiting) > s.openFilesThreshold(open)
+	}
+
+	// The default curve matches the original 1<<open model.
+	s := &Storage{settings: Settings{
+		OpenFilesGrowthFactor: defaultOpenFilesGrowthFactor,
+	}}
+	for open := int32(0); open < 20; open++ {
+		T.Equal(opens(s, open, 1<<uint32(open)), false)
+		T.Equal(opens(s, open, 1<<uint32(open)+1), true)
+	}
+
+	// A factor of 1 with a step is purely linear: 1 + 4*open.
+	s.settings.OpenFilesGrowthFactor = 1
+	s.settings.OpenFilesGrowthStep = 4
+	for _, tc := range []struct {
+		open    int32
+		waiting int
+		want    bool
+	}{
+		{0, 1, false},
+		{0, 2, true},
+		{1, 5, false},
+		{1, 6, true},
+		{10, 41, false},
+		{10, 42, true},
+	} {
+		T.Equal(opens(s, tc.open, tc.waiting), tc.want)
+	}
+
+	// A blend of both: 2*open + 3^open.
+	s.settings.OpenFilesGrowthFactor = 3
+	s.settings.OpenFilesGrowthStep = 2
+	for _, tc := range []struct {
+		open    int32
+		waiting int
+		want    bool
+	}{
+		{0, 1, false},
+		{0, 2, true},
+		{2, 13, false},
+		{2, 14, true},
+		{4, 89, false},
+		{4, 90, true},
+	} {
+		T.Equal(opens(s, tc.open, tc.waiting), tc.want)
+	}
+
+	// Very large exponents never overflow into opening files.
+	T.Equal(opens(s, 1000, math.MaxInt32), false)
+}
+
+func TestStorage_Insert_QueueTimeout(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A Storage whose primaries are all busy so inserts have to wait.
+	s := &Storage{
+		appendablePrimaries: 1,
+		settings: Settings{
+			BaseLogger:         NewTestLogger(),
+			InsertQueueTimeout: time.Millisecond * 50,
+			OpenFilesMaximum:   1,
+		},
+	}
+	_, err := s.Insert(context.Background(), &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.Equal(err, ErrInsertQueueTimeout{})
+	T.Equal(s.waiting.Waiting(), 0)
+	T.Equal(s.GetMetrics().InsertQueueTimeouts, int64(1))
+	T.Equal(s.GetMetrics().PrimaryInserts.Failures, int64(1))
+
+	// Canceling the request also stops the wait but is not counted as a
+	// timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	s.settings.InsertQueueTimeout = 0
+	go func() {
+		_, err := s.Insert(ctx, &InsertData{
+			Source: strings.NewReader("data"),
+			Length: 4,
+		})
+		errs <- err
+	}()
+	T.TryUntil(func() bool { return s.waiting.Waiting() == 1 }, time.Second)
+	cancel()
+	T.Equal(<-errs, context.Canceled)
+	T.Equal(s.waiting.Waiting(), 0)
+	T.Equal(s.GetMetrics().InsertQueueTimeouts, int64(1))
+	T.Equal(s.GetMetrics().InsertsCanceled, int64(1))
+	T.Equal(s.GetMetrics().PrimaryInserts.Failures, int64(2))
+
+	// A primary is not taken if the request was canceled before one was
+	// available.
+	p := &primary{state: primaryStateWaiting}
+	s.waiting.Put(p)
+	_, err = s.Insert(ctx, &InsertData{
+		Source: strings.NewReader("data"),
+		Length: 4,
+	})
+	T.Equal(err, context.Canceled)
+	T.Equal(s.waiting.head, p)
+	T.Equal(s.waiting.length, 1)
+	T.Equal(p.state, primaryStateWaiting)
+	T.Equal(s.GetMetrics().InsertsCanceled, int64(2))
+}
+
+func TestStorage_Insert_UnknownLength(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// Every replicate call is recorded along with the data it carried.
+	type replicated struct {
+		start, end uint64
+		data       string
+	}
+	var calls []replicated
+	remote := &testRemote{
+		name: "remote",
+		initialize: func(namespace, fn string) error {
+			return nil
+		},
+		heartBeat: func(namespace, fn string) (bool, error) {
+			return false, nil
+		},
+		replicate: func(rc RemoteReplicateConfig) (bool, error) {
+			body := rc.GetBody()
+			defer body.Close()
+			data, err := io.ReadAll(body)
+			T.ExpectSuccess(err)
+			calls = append(calls, replicated{
+				start: rc.Offset(),
+				end:   rc.Offset() + rc.Size(),
+				data:  string(data),
+			})
+			return false, nil
+		},
+	}
+	dir := T.TempDir()
+	s := newStartedTestStorage(T, Settings{
+		AssignRemotes: func(int) ([]Remote, error) {
+			return []Remote{remote}, nil
+		},
+		BaseDirectory: dir,
+		Replicas:      1,
+		UploadOlder:   time.Hour,
+	})
+
+	// Data sent in small pieces with no length, as a chunked HTTP request
+	// would be, is read until EOF.
+	insert := func(data string) (fid.FID, uint64, uint32) {
+		id, err := s.Insert(context.Background(), &InsertData{
+			Source: iotest.OneByteReader(strings.NewReader(data)),
+			Length: -1,
+		})
+		T.ExpectSuccess(err)
+		f, start, length, err := fid.ParseID(id)
+		T.ExpectSuccess(err)
+		return f, start, length
+	}
+	f1, start, length := insert("hello ")
+	T.Equal(start, uint64(0))
+	T.Equal(length, uint32(6))
+	f2, start, length := insert("world")
+	T.Equal(f2, f1)
+	T.Equal(start, uint64(6))
+	T.Equal(length, uint32(5))
+
+	// Both records were written to the file and replicated in order.
+	data, err := os.ReadFile(filepath.Join(dir, f1.String()))
+	T.ExpectSuccess(err)
+	T.Equal(string(data), "hello world")
+	T.Equal(calls, []replicated{
+		{start: 0, end: 6, data: "hello "},
+		{start: 6, end: 11, data: "world"},
+	})
+	T.Equal(s.GetMetrics().PrimaryBytes, uint64(11))
+	T.Equal(s.GetMetrics().DiskBytes, int64(11))
+
+	// Data that is too large for an ID is rejected without being read.
+	source := strings.NewReader("data")
+	_, err = s.Insert(context.Background(), &InsertData{
+		Source: source,
+		Length: maxRecordLength + 1,
+	})
+	T.Equal(err, ErrRecordTooLarge(maxRecordLength))
+	T.Equal(source.Len(), 4)
+}
+
+func TestStorage_SetReadOnly(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	// A Storage whose primaries are all busy so inserts have to wait.
+	s := &Storage{
+		appendablePrimaries: 1,
+		settings: Settings{
+			BaseLogger:       NewTestLogger(),
+			OpenFilesMaximum: 1,
+		},
+	}
+	ctx := context.Background()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := s.Insert(ctx, &InsertData{
+				Source: strings.NewReader("data"),
+				Length: 4,
+			})
+			errs <- err
+		}()
+	}
+	T.TryUntil(func() bool { return s.waiting.Waiting() == 2 }, time.Second)
+
+	// Enabling read only releases the waiting inserts.
+	T.Equal(s.ReadOnly(), false)
+	s.SetReadOnly(true)
+	T.Equal(s.ReadOnly(), true)
+	T.Equal(<-errs, ErrReadOnly{})
+	T.Equal(<-errs, ErrReadOnly{})
+	T.Equal(s.waiting.Waiting(), 0)
+
+	// New inserts are rejected right away.
+	_, err := s.Insert(ctx, &InsertData{Source: strings.NewReader("data")})
+	T.Equal(err, ErrReadOnly{})
+	T.Equal(s.GetMetrics().PrimaryInserts.Failures, int64(3))
+
+	// The status reports the mode.
+	buffer := bytes.Buffer{}
+	s.Status(&buffer, StatusFormatJSON)
+	status := NameSpaceStatus{}
+	T.ExpectSuccess(json.Unmarshal(buffer.Bytes(), &status))
+	T.Equal(status.ReadOnly, true)
+	buffer.Reset()
+	s.Status(&buffer, StatusFormatText)
+	T.Equal(buffer.String(), "    Read only, inserts are disabled.\n")
+
+	// Disabling it returns things to normal.
+	s.SetReadOnly(false)
+	T.Equal(s.ReadOnly(), false)
+	buffer.Reset()
+	s.Status(&buffer, StatusFormatText)
+	T.Equal(buffer.String(), "")
+}
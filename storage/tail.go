@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// Lets Blast Path tail readers follow a primary as data is appended to it.
+// The primary publishes its offset each time its state changes, which
+// includes the end of every insert, and readers wait to be woken when it
+// moves. Publishing never blocks on the readers, each reader reads the new
+// data from the file at its own pace, so a slow consumer only falls behind
+// and never holds up inserts.
+type tailNotifier struct {
+	lock sync.Mutex
+
+	// The number of bytes in the primary that are safe to read, and true
+	// once the primary has stopped accepting new data.
+	offset uint64
+	closed bool
+
+	// Closed and cleared each time the values above change. This is only
+	// allocated when a reader is waiting.
+	wake chan struct{}
+}
+
+// Records the current offset of the primary and whether it has stopped
+// accepting new data, waking any readers that are waiting.
+func (t *tailNotifier) publish(offset uint64, closed bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.offset = offset
+	t.closed = closed
+	if t.wake != nil {
+		close(t.wake)
+		t.wake = nil
+	}
+}
+
+// Returns the offset of the primary and true if it has stopped accepting
+// data. If the offset is not past have and the primary is open then this
+// also returns a channel that will be closed when either of those changes.
+func (t *tailNotifier) wait(have uint64) (uint64, bool, <-chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.offset > have || t.closed {
+		return t.offset, t.closed, nil
+	}
+	if t.wake == nil {
+		t.wake = make(chan struct{})
+	}
+	return t.offset, false, t.wake
+}
+
+// Returns a reader that starts at the given offset within the primary
+// with the given fid and returns data as it is appended, blocking when it
+// has caught up. Once the primary stops accepting data, because it is
+// being uploaded or has been closed, the remaining data is returned
+// followed by io.EOF. Reads return the error from ctx if it is canceled
+// while waiting. The reader uses its own file descriptor so it can finish
+// even if the primary's local file is deleted in the meantime.
+func (s *Storage) BlastPathTail(
+	ctx context.Context,
+	fid string,
+	start uint64,
+) (
+	io.ReadCloser,
+	error,
+) {
+	p, fd, err := s.blastPathOpen(fid, start)
+	if err != nil {
+		return nil, err
+	}
+	return &tailReader{
+		ctx:      ctx,
+		fd:       fd,
+		notifier: &p.tail,
+		pos:      start,
+	}, nil
+}
+
+// The io.ReadCloser returned from BlastPathTail.
+type tailReader struct {
+	ctx      context.Context
+	fd       *os.File
+	notifier *tailNotifier
+	pos      uint64
+}
+
+func (t *tailReader) Read(data []byte) (int, error) {
+	for {
+		offset, closed, wake := t.notifier.wait(t.pos)
+		if t.pos < offset {
+			if uint64(len(data)) > offset-t.pos {
+				data = data[:offset-t.pos]
+			}
+			n, err := t.fd.ReadAt(data, int64(t.pos))
+			t.pos += uint64(n)
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		} else if closed {
+			return 0, io.EOF
+		}
+		select {
+		case <-wake:
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		}
+	}
+}
+
+func (t *tailReader) Close() error {
+	return t.fd.Close()
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestTailNotifier(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	tn := tailNotifier{}
+	offset, closed, wake := tn.wait(0)
+	T.Equal(offset, uint64(0))
+	T.Equal(closed, false)
+	T.NotEqual(wake, nil)
+
+	// Publishing wakes the waiters.
+	tn.publish(10, false)
+	select {
+	case <-wake:
+	default:
+		T.Fatalf("The waiter was not woken.")
+	}
+	offset, closed, wake = tn.wait(0)
+	T.Equal(offset, uint64(10))
+	T.Equal(closed, false)
+	T.Equal(wake, (<-chan struct{})(nil))
+
+	// Once closed nothing else is published.
+	tn.publish(20, true)
+	tn.publish(30, false)
+	offset, closed, wake = tn.wait(20)
+	T.Equal(offset, uint64(20))
+	T.Equal(closed, true)
+	T.Equal(wake, (<-chan struct{})(nil))
+}
+
+func TestStorage_BlastPathTail(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := fd.WriteString("0123456789")
+	T.ExpectSuccess(err)
+	p := &primary{fd: fd, fidStr: "test", offset: 10}
+	p.tail.publish(10, false)
+	s := Storage{primaries: map[string]*primary{"test": p}}
+
+	// Starting past the end of the file is not possible.
+	_, err = s.BlastPathTail(context.Background(), "test", 11)
+	T.ExpectErrorMessage(err, "The requested operation is not possible.")
+	_, err = s.BlastPathTail(context.Background(), "unknown", 0)
+	T.Equal(err, ErrNotFound("unknown"))
+
+	content, err := s.BlastPathTail(context.Background(), "test", 5)
+	T.ExpectSuccess(err)
+	defer content.Close()
+	buffer := make([]byte, 100)
+	n, err := content.Read(buffer)
+	T.ExpectSuccess(err)
+	T.Equal(string(buffer[:n]), "56789")
+
+	// The next read blocks until more data is published.
+	done := make(chan string)
+	go func() {
+		n, err := content.Read(buffer)
+		T.ExpectSuccess(err)
+		done <- string(buffer[:n])
+	}()
+	select {
+	case <-done:
+		T.Fatalf("The read did not wait for more data.")
+	case <-time.After(time.Millisecond * 50):
+	}
+	_, err = fd.WriteString("abcdef")
+	T.ExpectSuccess(err)
+	p.tail.publish(13, false)
+	T.Equal(<-done, "abc")
+
+	// Once closed the rest of the data is returned, then EOF.
+	p.tail.publish(16, true)
+	rest, err := io.ReadAll(content)
+	T.ExpectSuccess(err)
+	T.Equal(string(rest), "def")
+}
+
+func TestStorage_BlastPathTail_Canceled(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	p := &primary{fd: fd, fidStr: "test"}
+	s := Storage{primaries: map[string]*primary{"test": p}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	content, err := s.BlastPathTail(ctx, "test", 0)
+	T.ExpectSuccess(err)
+	defer content.Close()
+	cancel()
+	_, err = content.Read(make([]byte, 10))
+	T.Equal(err, context.Canceled)
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reads a freshly written compressed file back through a decompressor to
+// ensure that it inflates to exactly the number of bytes that were in the
+// original data file. This catches bad compressed files before they are
+// uploaded to S3 where the problem would otherwise only be noticed when
+// the data was read back.
+func verifyCompressed(fd *os.File, c compressor, length uint64) error {
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	unzipper, err := c.NewReader(fd)
+	if err != nil {
+		return err
+	}
+	buffer := [4096]byte{}
+	n, err := io.CopyBuffer(io.Discard, unzipper, buffer[:])
+	if err != nil {
+		return err
+	} else if err := unzipper.Close(); err != nil {
+		return err
+	} else if uint64(n) != length {
+		return fmt.Errorf(
+			"Compressed file inflated to %d bytes, expected %d.",
+			n,
+			length)
+	}
+	return nil
+}
+
+// Removes a compressed file that failed verification so that the next
+// compression attempt starts from a clean slate.
+func removeCompressed(fd *os.File) error {
+	fd.Close()
+	return os.Remove(fd.Name())
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"compress/gzip"
+	"testing"
+
+	"github.com/liquidgecka/testlib"
+)
+
+func TestVerifyCompressed(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	zipper := gzip.NewWriter(fd)
+	_, err := zipper.Write([]byte("test data"))
+	T.ExpectSuccess(err)
+	T.ExpectSuccess(zipper.Close())
+
+	// The length matches so this should pass.
+	c := gzipCompressor{}
+	T.ExpectSuccess(verifyCompressed(fd, c, uint64(len("test data"))))
+
+	// The length is wrong so this should fail.
+	T.ExpectError(verifyCompressed(fd, c, 100))
+}
+
+func TestVerifyCompressed_Corrupt(t *testing.T) {
+	T := testlib.NewT(t)
+	defer T.Finish()
+
+	fd := T.TempFile()
+	_, err := fd.WriteString("not gzipped data")
+	T.ExpectSuccess(err)
+	c := gzipCompressor{}
+	T.ExpectError(verifyCompressed(fd, c, uint64(len("not gzipped data"))))
+}